@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+// Sensor fusion filters for raw IMU input
+const (
+	ahrsMadgwick = "madgwick"
+	ahrsMahony   = "mahony"
+)
+
+const (
+	defaultIMUFormat = "ax,ay,az,gx,gy,gz"
+	// imuMaxStep bounds the time step taken from the arrival of lines, so
+	// that a pause in the stream doesn't throw the filter off
+	imuMaxStep = 100 * time.Millisecond
+)
+
+var (
+	ahrsName  = flag.String("ahrs", ahrsMadgwick, "Sensor fusion filter for imu input (madgwick or mahony)")
+	gyroUnits = flag.String("gyro-units", quat.Degrees, "Units of gyroscope rates in imu input (deg or rad, per second)")
+	imuRate   = flag.Float64("imu-rate", 0, "Sample rate of imu input in Hz (default: measured from the arrival of lines)")
+	ahrsBeta  = flag.Float64("ahrs-beta", 0.1, "Gain of the Madgwick filter, higher trusts the accelerometer and magnetometer more")
+	ahrsKp    = flag.Float64("ahrs-kp", 1, "Proportional gain of the Mahony filter")
+	ahrsKi    = flag.Float64("ahrs-ki", 0, "Integral gain of the Mahony filter, which corrects gyroscope bias")
+)
+
+// parseAHRS validates the name of a sensor fusion filter
+func parseAHRS(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", ahrsMadgwick:
+		return ahrsMadgwick, nil
+	case ahrsMahony:
+		return ahrsMahony, nil
+	}
+	return "", fmt.Errorf("unknown filter %q, expected madgwick or mahony", s)
+}
+
+// imuSample is one line of raw IMU input. Gyroscope rates are in rad/s, the
+// accelerometer and magnetometer may be in any units.
+type imuSample struct {
+	accel, gyro, mag quat.Vector
+	hasMag           bool
+	temp             float64 // Temperature of the sensor, °C
+	hasTemp          bool
+}
+
+// ahrsFilter fuses raw IMU samples into an orientation
+type ahrsFilter interface {
+	// update advances the filter by dt seconds and returns the orientation,
+	// rotating sensor coordinates into an NWU frame (X north when a
+	// magnetometer is used, Z up)
+	update(s imuSample, dt float64) Quaternion
+	// reset starts the filter again from the given orientation
+	reset(q Quaternion)
+}
+
+func newAHRSFilter(name string) ahrsFilter {
+	if name == ahrsMahony {
+		return &mahonyFilter{q: Quaternion{Real: 1}, kp: *ahrsKp, ki: *ahrsKi}
+	}
+	return &madgwickFilter{q: Quaternion{Real: 1}, beta: *ahrsBeta}
+}
+
+// imuFusion turns a stream of raw IMU samples into orientations, measuring
+// the time step from their arrival unless the rate is given
+type imuFusion struct {
+	filter ahrsFilter
+	rate   float64        // Hz, 0 to measure
+	bias   *gyroBiasModel // Temperature model of the gyroscope bias, nil when off
+	last   time.Time
+}
+
+func (f *imuFusion) update(s imuSample, now time.Time) Quaternion {
+	if f.bias != nil {
+		s = f.bias.correct(s, now)
+	}
+	if f.last.IsZero() {
+		// Start from gravity and north instead of waiting for the filter to converge
+		roll := math.Atan2(s.accel.Y, s.accel.Z)
+		pitch := math.Atan2(-s.accel.X, math.Hypot(s.accel.Y, s.accel.Z))
+		var yaw float64
+		if s.hasMag {
+			m := s.mag
+			xh := m.X*math.Cos(pitch) + m.Y*math.Sin(roll)*math.Sin(pitch) + m.Z*math.Cos(roll)*math.Sin(pitch)
+			yh := m.Y*math.Cos(roll) - m.Z*math.Sin(roll)
+			yaw = math.Atan2(-yh, xh)
+		}
+		f.filter.reset(quat.FromEuler(roll, pitch, yaw, quat.Radians, defaultEulerOrder))
+		f.last = now
+		return f.filter.update(s, 0)
+	}
+	dt := 1 / f.rate
+	if f.rate <= 0 {
+		dt = min(now.Sub(f.last), imuMaxStep).Seconds()
+	}
+	f.last = now
+	return f.filter.update(s, dt)
+}
+
+// madgwickFilter is Sebastian Madgwick's gradient descent orientation filter
+type madgwickFilter struct {
+	q    Quaternion
+	beta float64
+}
+
+func (m *madgwickFilter) reset(q Quaternion) { m.q = q }
+
+func (m *madgwickFilter) update(s imuSample, dt float64) Quaternion {
+	q0, q1, q2, q3 := m.q.Real, m.q.I, m.q.J, m.q.K
+	gx, gy, gz := s.gyro.X, s.gyro.Y, s.gyro.Z
+
+	// Rate of change of the quaternion from the gyroscope
+	qDot1 := 0.5 * (-q1*gx - q2*gy - q3*gz)
+	qDot2 := 0.5 * (q0*gx + q2*gz - q3*gy)
+	qDot3 := 0.5 * (q0*gy - q1*gz + q3*gx)
+	qDot4 := 0.5 * (q0*gz + q1*gy - q2*gx)
+
+	ax, ay, az := s.accel.X, s.accel.Y, s.accel.Z
+	if n := math.Sqrt(ax*ax + ay*ay + az*az); n > 0 {
+		ax, ay, az = ax/n, ay/n, az/n
+		var s0, s1, s2, s3 float64
+		mx, my, mz := s.mag.X, s.mag.Y, s.mag.Z
+		if mn := math.Sqrt(mx*mx + my*my + mz*mz); s.hasMag && mn > 0 {
+			mx, my, mz = mx/mn, my/mn, mz/mn
+			// Reference direction of the Earth's magnetic field
+			hx := mx*(q0*q0+q1*q1-q2*q2-q3*q3) + 2*my*(q1*q2-q0*q3) + 2*mz*(q0*q2+q1*q3)
+			hy := 2*mx*(q0*q3+q1*q2) + my*(q0*q0-q1*q1+q2*q2-q3*q3) + 2*mz*(q2*q3-q0*q1)
+			bx := math.Sqrt(hx*hx + hy*hy)
+			bz := 2*mx*(q1*q3-q0*q2) + 2*my*(q0*q1+q2*q3) + mz*(q0*q0-q1*q1-q2*q2+q3*q3)
+
+			// Gradient of the objective function for gravity and the field
+			fg1 := 2*(q1*q3-q0*q2) - ax
+			fg2 := 2*(q0*q1+q2*q3) - ay
+			fg3 := 1 - 2*(q1*q1+q2*q2) - az
+			fb1 := 2*bx*(0.5-q2*q2-q3*q3) + 2*bz*(q1*q3-q0*q2) - mx
+			fb2 := 2*bx*(q1*q2-q0*q3) + 2*bz*(q0*q1+q2*q3) - my
+			fb3 := 2*bx*(q0*q2+q1*q3) + 2*bz*(0.5-q1*q1-q2*q2) - mz
+			s0 = -2*q2*fg1 + 2*q1*fg2 - 2*bz*q2*fb1 + (-2*bx*q3+2*bz*q1)*fb2 + 2*bx*q2*fb3
+			s1 = 2*q3*fg1 + 2*q0*fg2 - 4*q1*fg3 + 2*bz*q3*fb1 + (2*bx*q2+2*bz*q0)*fb2 + (2*bx*q3-4*bz*q1)*fb3
+			s2 = -2*q0*fg1 + 2*q3*fg2 - 4*q2*fg3 + (-4*bx*q2-2*bz*q0)*fb1 + (2*bx*q1+2*bz*q3)*fb2 + (2*bx*q0-4*bz*q2)*fb3
+			s3 = 2*q1*fg1 + 2*q2*fg2 + (-4*bx*q3+2*bz*q1)*fb1 + (-2*bx*q0+2*bz*q2)*fb2 + 2*bx*q1*fb3
+		} else {
+			s0 = 4*q0*q2*q2 + 2*q2*ax + 4*q0*q1*q1 - 2*q1*ay
+			s1 = 4*q1*q3*q3 - 2*q3*ax + 4*q0*q0*q1 - 2*q0*ay - 4*q1 + 8*q1*q1*q1 + 8*q1*q2*q2 + 4*q1*az
+			s2 = 4*q0*q0*q2 + 2*q0*ax + 4*q2*q3*q3 - 2*q3*ay - 4*q2 + 8*q2*q1*q1 + 8*q2*q2*q2 + 4*q2*az
+			s3 = 4*q1*q1*q3 - 2*q1*ax + 4*q2*q2*q3 - 2*q2*ay
+		}
+		if n := math.Sqrt(s0*s0 + s1*s1 + s2*s2 + s3*s3); n > 0 {
+			qDot1 -= m.beta * s0 / n
+			qDot2 -= m.beta * s1 / n
+			qDot3 -= m.beta * s2 / n
+			qDot4 -= m.beta * s3 / n
+		}
+	}
+
+	m.q, _ = quat.Normalize(Quaternion{
+		Real: q0 + qDot1*dt,
+		I:    q1 + qDot2*dt,
+		J:    q2 + qDot3*dt,
+		K:    q3 + qDot4*dt,
+	})
+	return m.q
+}
+
+// mahonyFilter is Robert Mahony's nonlinear complementary filter, which
+// steers the gyroscope with a PI controller on the error between measured
+// and estimated gravity and magnetic field
+type mahonyFilter struct {
+	q          Quaternion
+	kp, ki     float64
+	ix, iy, iz float64 // Integral of the error, an estimate of the gyroscope bias
+}
+
+func (m *mahonyFilter) reset(q Quaternion) {
+	m.q, m.ix, m.iy, m.iz = q, 0, 0, 0
+}
+
+func (m *mahonyFilter) update(s imuSample, dt float64) Quaternion {
+	q0, q1, q2, q3 := m.q.Real, m.q.I, m.q.J, m.q.K
+	gx, gy, gz := s.gyro.X, s.gyro.Y, s.gyro.Z
+
+	ax, ay, az := s.accel.X, s.accel.Y, s.accel.Z
+	if n := math.Sqrt(ax*ax + ay*ay + az*az); n > 0 {
+		ax, ay, az = ax/n, ay/n, az/n
+		// Estimated direction of gravity
+		vx := 2 * (q1*q3 - q0*q2)
+		vy := 2 * (q0*q1 + q2*q3)
+		vz := q0*q0 - q1*q1 - q2*q2 + q3*q3
+		ex, ey, ez := ay*vz-az*vy, az*vx-ax*vz, ax*vy-ay*vx
+
+		mx, my, mz := s.mag.X, s.mag.Y, s.mag.Z
+		if mn := math.Sqrt(mx*mx + my*my + mz*mz); s.hasMag && mn > 0 {
+			mx, my, mz = mx/mn, my/mn, mz/mn
+			hx := 2 * (mx*(0.5-q2*q2-q3*q3) + my*(q1*q2-q0*q3) + mz*(q1*q3+q0*q2))
+			hy := 2 * (mx*(q1*q2+q0*q3) + my*(0.5-q1*q1-q3*q3) + mz*(q2*q3-q0*q1))
+			bx := math.Sqrt(hx*hx + hy*hy)
+			bz := 2 * (mx*(q1*q3-q0*q2) + my*(q2*q3+q0*q1) + mz*(0.5-q1*q1-q2*q2))
+			// Estimated direction of the magnetic field
+			wx := 2 * (bx*(0.5-q2*q2-q3*q3) + bz*(q1*q3-q0*q2))
+			wy := 2 * (bx*(q1*q2-q0*q3) + bz*(q0*q1+q2*q3))
+			wz := 2 * (bx*(q0*q2+q1*q3) + bz*(0.5-q1*q1-q2*q2))
+			ex += my*wz - mz*wy
+			ey += mz*wx - mx*wz
+			ez += mx*wy - my*wx
+		}
+
+		if m.ki > 0 {
+			m.ix += m.ki * ex * dt
+			m.iy += m.ki * ey * dt
+			m.iz += m.ki * ez * dt
+			gx, gy, gz = gx+m.ix, gy+m.iy, gz+m.iz
+		}
+		gx, gy, gz = gx+m.kp*ex, gy+m.kp*ey, gz+m.kp*ez
+	}
+
+	gx, gy, gz = gx*0.5*dt, gy*0.5*dt, gz*0.5*dt
+	m.q, _ = quat.Normalize(Quaternion{
+		Real: q0 - q1*gx - q2*gy - q3*gz,
+		I:    q1 + q0*gx + q2*gz - q3*gy,
+		J:    q2 + q0*gy - q1*gz + q3*gx,
+		K:    q3 + q0*gz + q1*gy - q2*gx,
+	})
+	return m.q
+}
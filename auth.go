@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// passwordEnv names the environment variable holding the login password
+	passwordEnv = "QUATPLOT_PASSWORD"
+	// authCookie is the cookie a browser's token is kept in after logging in
+	authCookie = "quatplot_token"
+	// loginFailureDelay slows down password guessing
+	loginFailureDelay = time.Second
+)
+
+var (
+	authPassword = flag.String("password", "", "Password required to use the web interface and API (or set "+passwordEnv+", default: no authentication)")
+	tokenTTL     = flag.Duration("token-ttl", 12*time.Hour, "How long tokens issued by /api/login stay valid")
+
+	// apiTokens holds the tokens issued by /api/login
+	apiTokens      = make(map[string]apiToken)
+	apiTokensMutex sync.Mutex
+)
+
+// apiToken is a token issued by /api/login, or by /pair to a viewer
+type apiToken struct {
+	ns      *namespace // Namespace whose password was given, see authority
+	role    string
+	expires time.Time
+}
+
+// publicPages can be fetched without logging in. The pages themselves ask
+// for the password when the API refuses them.
+var publicPages = map[string]bool{
+	"/":                     true,
+	"/app.js":               true, // Assets of the page, which logs in
+	"/style.css":            true,
+	"/vendor/three.min.js":  true,
+	"/vendor/OBJLoader.js":  true,
+	"/vendor/MTLLoader.js":  true,
+	"/vendor/STLLoader.js":  true,
+	"/vendor/PLYLoader.js":  true,
+	"/vendor/GLTFLoader.js": true,
+	"/pair":                 true, // Checks its own pairing code
+	"/setup":                true,
+	"/api/openapi.json":     true,
+	"/api/clock":            true, // Other servers align their clocks to this one
+}
+
+// isPublic reports whether a request is allowed without a token
+func isPublic(r *http.Request) bool {
+	if r.URL.Path == "/api/login" || isFleetRegistration(r) {
+		return true
+	}
+	return publicPages[r.URL.Path] && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+}
+
+// loginPassword returns the configured password, empty when authentication is off
+func loginPassword() string {
+	if v := os.Getenv(passwordEnv); v != "" {
+		return v
+	}
+	return *authPassword
+}
+
+// authority returns the namespace whose login grants access to ns: a tenant
+// with its own password, or else the default namespace
+func (ns *namespace) authority() *namespace {
+	if ns.password != "" {
+		return ns
+	}
+	return defaultNamespace
+}
+
+// loginPassword returns the password for logging in to the namespace
+func (ns *namespace) loginPassword() string {
+	if ns.password != "" {
+		return ns.password
+	}
+	return loginPassword()
+}
+
+// authCookie returns the name of the cookie the namespace's token is kept
+// in, each tenant with a password has its own
+func (ns *namespace) authCookie() string {
+	if ns.authority() == defaultNamespace {
+		return authCookie
+	}
+	return authCookie + "_" + ns.name
+}
+
+// loginInfo is returned by /api/login
+type loginInfo struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// issueToken creates a token for the namespace granting the role, valid for
+// -token-ttl, dropping expired ones
+func issueToken(ns *namespace, role string) loginInfo {
+	now := time.Now()
+	info := loginInfo{Token: newRandomID() + newRandomID(), Expires: now.Add(*tokenTTL)}
+
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+	for tok, t := range apiTokens {
+		if now.After(t.expires) {
+			delete(apiTokens, tok)
+		}
+	}
+	apiTokens[info.Token] = apiToken{ns: ns.authority(), role: role, expires: info.Expires}
+	return info
+}
+
+// tokenRole returns the role granted by tok, and whether it was issued for
+// the namespace and hasn't expired or been revoked
+func tokenRole(ns *namespace, tok string) (string, bool) {
+	if tok == "" {
+		return "", false
+	}
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+	t, ok := apiTokens[tok]
+	if ok && time.Now().After(t.expires) {
+		delete(apiTokens, tok)
+		return "", false
+	}
+	if !ok || t.ns != ns.authority() {
+		return "", false
+	}
+	return t.role, true
+}
+
+func revokeToken(tok string) {
+	apiTokensMutex.Lock()
+	delete(apiTokens, tok)
+	apiTokensMutex.Unlock()
+}
+
+// requestToken returns the token sent with a request, from the Authorization
+// header, the login cookie, or the access_token query parameter used by
+// WebSocket clients that can't set headers
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if tok, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(tok)
+		}
+	}
+	if c, err := r.Cookie(requestNamespace(r).authCookie()); err == nil {
+		return c.Value
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// requireAuth refuses requests that aren't authenticated when a password or
+// proxy authentication is configured, and state changes by viewers
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublic(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, ok := authenticate(r)
+		if !ok {
+			if requestNamespace(r).loginPassword() != "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="quatplot"`)
+				http.Error(w, "authentication required, log in with POST /api/login", http.StatusUnauthorized)
+			} else {
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+			}
+			return
+		}
+		if needsController(r) && id.Role != roleController {
+			http.Error(w, "the "+id.Role+" role can't make changes", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleLogin exchanges the password for a token, e.g.
+// POST /api/login {"password":"..."}. The token is also set as a cookie.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ns := requestNamespace(r)
+	password := ns.loginPassword()
+	if password == "" {
+		http.Error(w, "authentication is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	// Compare digests so that the time taken doesn't reveal the length
+	want, got := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(req.Password))
+	if subtle.ConstantTimeCompare(want[:], got[:]) != 1 {
+		log.Printf("Failed login to the %s namespace from %s", ns, r.RemoteAddr)
+		time.Sleep(loginFailureDelay)
+		http.Error(w, "wrong password", http.StatusUnauthorized)
+		return
+	}
+
+	info := issueToken(ns, roleController)
+	setAuthCookie(w, ns, info)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// setAuthCookie keeps the token in the browser
+func setAuthCookie(w http.ResponseWriter, ns *namespace, info loginInfo) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ns.authCookie(),
+		Value:    info.Token,
+		Path:     ns.authority().path("/"),
+		Expires:  info.Expires,
+		HttpOnly: true,
+		Secure:   serveTLS(),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// handleLogout revokes the token the request was made with
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	revokeToken(requestToken(r))
+	ns := requestNamespace(r)
+	http.SetCookie(w, &http.Cookie{Name: ns.authCookie(), Value: "", Path: ns.authority().path("/"), MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+const (
+	// autoProbeTimeout is how long each port is listened to
+	autoProbeTimeout = 2 * time.Second
+	// autoProbeLines is how many lines are read from each port
+	autoProbeLines = 5
+	// autoProbeValid is how many of them must parse for the port to be picked
+	autoProbeValid = 3
+)
+
+// isAutoPort reports whether a port is to be found by probing, given as
+// "auto", or "auto:VID" or "auto:VID:PID" to only probe those USB devices
+func isAutoPort(spec string) bool {
+	kind, _, _ := strings.Cut(spec, ":")
+	return strings.EqualFold(kind, "auto")
+}
+
+// findSensorPort probes the serial ports an auto specification allows, USB
+// ports first, and returns the first that sends lines the format parses.
+// Ports held by another instance are skipped.
+func findSensorPort(spec string, baud int, format *lineFormat) (string, error) {
+	if format.packet != nil {
+		return "", errors.New("-port auto only recognizes text lines, name the port for binary packets")
+	}
+	_, ids, _ := strings.Cut(spec, ":")
+	var vid, pid string
+	if ids != "" {
+		parts := strings.Split(ids, ":")
+		if len(parts) > 2 || parts[0] == "" {
+			return "", fmt.Errorf("invalid port %q, expected auto, auto:VID or auto:VID:PID", spec)
+		}
+		vid = parts[0]
+		if len(parts) == 2 {
+			pid = parts[1]
+		}
+	}
+
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", fmt.Errorf("listing serial ports: %v", err)
+	}
+	sort.SliceStable(ports, func(i, j int) bool { return ports[i].IsUSB && !ports[j].IsUSB })
+	probed := 0
+	for _, p := range ports {
+		if vid != "" && (!p.IsUSB || !strings.EqualFold(p.VID, vid) || pid != "" && !strings.EqualFold(p.PID, pid)) {
+			continue
+		}
+		port, release, err := openSerialPort(p.Name, &serial.Mode{BaudRate: baud})
+		if err != nil {
+			continue
+		}
+		probed++
+		lines := readLines(port, autoProbeLines, autoProbeTimeout)
+		port.Close()
+		release()
+		valid := 0
+		for _, line := range lines {
+			if _, err := format.parse(line); err == nil {
+				valid++
+			}
+		}
+		if valid >= autoProbeValid {
+			return p.Name, nil
+		}
+	}
+	return "", &deviceNotFoundError{fmt.Sprintf("none of the %d serial ports that could be opened for %s sends valid lines at %d baud", probed, spec, baud)}
+}
+
+// runListPorts prints the serial ports of the machine with their USB IDs,
+// and returns the process exit code
+func runListPorts() int {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing serial ports: %v\n", err)
+		return 1
+	}
+	if len(ports) == 0 {
+		fmt.Println("No serial ports found")
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PORT\tDEVICE\tSERIAL\tPRODUCT")
+	for _, p := range ports {
+		device := "-"
+		if p.IsUSB {
+			device = "usb:" + strings.ToLower(p.VID) + ":" + strings.ToLower(p.PID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Name, device, orDash(p.SerialNumber), orDash(p.Product))
+	}
+	w.Flush()
+	return 0
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+// Native protocols of the Bosch (Hillcrest) BNO08x sensors
+const (
+	protocolBNORVC  = "bno-rvc"  // UART-RVC, yaw, pitch and roll sent unprompted
+	protocolBNOSHTP = "bno-shtp" // SHTP over UART, rotation vector reports
+)
+
+var bnoRate = flag.Float64("bno-rate", 100, "Rate in Hz of the rotation vector reports requested from a BNO08x with -protocol bno-shtp")
+
+// bnoRVC decodes the 19 byte packets a BNO08x sends in UART-RVC mode: a
+// 0xAAAA header, an index, yaw, pitch and roll in hundredths of a degree,
+// accelerations, three reserved bytes and a checksum of the bytes between
+// the header and the last reserved byte
+type bnoRVC struct{}
+
+const bnoRVCLength = 19
+
+var bnoRVCHeader = []byte{0xAA, 0xAA}
+
+func (bnoRVC) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return splitPackets(data, bnoRVCHeader, bnoRVCLength, bnoRVCValid)
+}
+
+func bnoRVCValid(packet []byte) bool {
+	var sum byte
+	for _, b := range packet[2:17] {
+		sum += b
+	}
+	return sum == packet[18]
+}
+
+func (bnoRVC) decode(f *lineFormat, packet []byte) (Quaternion, error) {
+	if !bnoRVCValid(packet) {
+		return Quaternion{}, fmt.Errorf("checksum mismatch")
+	}
+	angle := func(at int) float64 {
+		return float64(int16(binary.LittleEndian.Uint16(packet[at:]))) / 100
+	}
+	yaw, pitch, roll := angle(3), angle(5), angle(7)
+	// Applied yaw, then pitch, then roll
+	return quat.FromEuler(roll, pitch, yaw, quat.Degrees, defaultEulerOrder), nil
+}
+
+func (bnoRVC) start() []byte { return nil }
+
+// SHTP over UART frames each packet between 0x7E flags, after a protocol
+// byte, escaping flags and 0x7D within it as 0x7D followed by the byte XOR 0x20
+const (
+	shtpFlag     = 0x7E
+	shtpEscape   = 0x7D
+	shtpProtocol = 0x01 // Protocol byte of SHTP frames
+)
+
+// SHTP channels and reports
+const (
+	shtpChannelControl = 2 // Commands to the sensor hub
+	shtpChannelReports = 3 // Input reports
+	shtpChannelWake    = 4 // Wake input reports
+
+	shtpSetFeature      = 0xFD
+	shtpTimestampRebase = 0xFA
+	shtpBaseTimestamp   = 0xFB
+	shtpRotationVector  = 0x05
+	shtpGameRotation    = 0x08 // Rotation vector without the magnetometer
+	shtpARVRRotation    = 0x28
+	shtpARVRGame        = 0x29
+)
+
+// bnoSHTP decodes the rotation vector reports of a BNO08x in UART mode, and
+// asks for them when started
+type bnoSHTP struct {
+	rate float64 // Hz
+}
+
+func (bnoSHTP) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := bytes.IndexByte(data, shtpFlag)
+	if start < 0 {
+		return len(data), nil, nil
+	}
+	end := bytes.IndexByte(data[start+1:], shtpFlag)
+	if end < 0 {
+		return start, nil, nil
+	}
+	end += start + 1
+	if end == start+1 {
+		// Between two frames, the closing flag of one and the opening of the next
+		return end, nil, nil
+	}
+	// The closing flag may open the next frame
+	return end, data[start+1 : end], nil
+}
+
+func (bnoSHTP) decode(f *lineFormat, frame []byte) (Quaternion, error) {
+	if frame[0] != shtpProtocol {
+		return Quaternion{}, errNoSample
+	}
+	packet := make([]byte, 0, len(frame))
+	for i := 1; i < len(frame); i++ {
+		b := frame[i]
+		if b == shtpEscape && i+1 < len(frame) {
+			i++
+			b = frame[i] ^ 0x20
+		}
+		packet = append(packet, b)
+	}
+	if len(packet) < 4 {
+		return Quaternion{}, fmt.Errorf("SHTP packet of %d bytes is too short", len(packet))
+	}
+	length := int(binary.LittleEndian.Uint16(packet) & 0x7FFF)
+	if length < 4 || length > len(packet) {
+		return Quaternion{}, fmt.Errorf("SHTP packet of %d bytes claims %d", len(packet), length)
+	}
+	if channel := packet[2]; channel != shtpChannelReports && channel != shtpChannelWake {
+		return Quaternion{}, errNoSample
+	}
+
+	// A packet may hold several reports, the latest rotation is used
+	var (
+		quat  Quaternion
+		found bool
+	)
+	cargo := packet[4:length]
+	for len(cargo) > 0 {
+		var n int
+		switch cargo[0] {
+		case shtpBaseTimestamp, shtpTimestampRebase:
+			n = 5
+		case shtpRotationVector, shtpARVRRotation:
+			n = 14
+		case shtpGameRotation, shtpARVRGame:
+			n = 12
+		default:
+			// Reports of unknown length end the parse
+			n = len(cargo)
+		}
+		if n > len(cargo) {
+			return Quaternion{}, fmt.Errorf("SHTP report 0x%02X truncated", cargo[0])
+		}
+		switch cargo[0] {
+		case shtpRotationVector, shtpARVRRotation, shtpGameRotation, shtpARVRGame:
+			// Components are Q14 fixed point after the ID, sequence, status and delay
+			q14 := func(at int) float64 {
+				return float64(int16(binary.LittleEndian.Uint16(cargo[at:]))) / (1 << 14)
+			}
+			quat, found = Quaternion{I: q14(4), J: q14(6), K: q14(8), Real: q14(10)}, true
+		}
+		cargo = cargo[n:]
+	}
+	if !found {
+		return Quaternion{}, errNoSample
+	}
+	return quat, nil
+}
+
+// start returns the frame of a Set Feature command turning on rotation
+// vector reports at the configured rate
+func (s bnoSHTP) start() []byte {
+	cmd := make([]byte, 4+17)
+	binary.LittleEndian.PutUint16(cmd, uint16(len(cmd)))
+	cmd[2] = shtpChannelControl
+	cmd[4] = shtpSetFeature
+	cmd[5] = shtpRotationVector
+	binary.LittleEndian.PutUint32(cmd[9:], uint32(1e6/s.rate)) // Report interval, µs
+
+	frame := []byte{shtpFlag, shtpProtocol}
+	for _, b := range cmd {
+		if b == shtpFlag || b == shtpEscape {
+			frame = append(frame, shtpEscape, b^0x20)
+			continue
+		}
+		frame = append(frame, b)
+	}
+	return append(frame, shtpFlag)
+}
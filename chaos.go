@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var chaosMode = flag.Bool("chaos", false, "Enable /api/chaos, which breaks the WebSocket stream on purpose so that client developers can test their error handling. Never on a server others rely on")
+
+// Malformed messages /api/chaos/malformed sends
+var chaosMessages = map[string]string{
+	"truncated": `{"seq":1,"i":0,"j":0,"k":0.70`,
+	"garbage":   "quatplot chaos: this is not JSON",
+	"types":     `{"seq":"1","i":"zero","j":null,"k":[],"real":true}`,
+	"unknown":   `{"type":"chaos","time":"%s","data":{"note":"an event type clients don't know"}}`,
+}
+
+// chaosState is what /api/chaos has done to a namespace
+type chaosState struct {
+	mu          sync.Mutex
+	pausedUntil time.Time // Samples aren't sent to clients until then
+}
+
+// chaosInfo describes the state of /api/chaos
+type chaosInfo struct {
+	Paused      bool       `json:"paused"`
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+	Malformed   []string   `json:"malformed"` // Kinds of malformed messages that can be sent
+}
+
+// chaosRequest is the body of the POST requests of /api/chaos
+type chaosRequest struct {
+	Seconds float64 `json:"seconds"` // How long to pause, pause
+	Client  int64   `json:"client"`  // Client to target, 0 for every client of the namespace
+	Kind    string  `json:"kind"`    // Malformed message to send, malformed
+	Mode    string  `json:"mode"`    // "close" with a close frame or "drop" without, disconnect
+}
+
+// paused reports whether broadcasting samples is paused
+func (s *chaosState) paused(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.Before(s.pausedUntil)
+}
+
+func (s *chaosState) info() chaosInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := chaosInfo{Malformed: []string{"garbage", "truncated", "types", "unknown"}}
+	if time.Now().Before(s.pausedUntil) {
+		until := s.pausedUntil
+		info.Paused, info.PausedUntil = true, &until
+	}
+	return info
+}
+
+// handleChaos induces failures in the stream of the namespace:
+//
+//	GET  /api/chaos                 what is in effect
+//	POST /api/chaos/pause           stop sending samples for "seconds"
+//	POST /api/chaos/resume          send samples again
+//	POST /api/chaos/malformed       send a malformed message of a "kind"
+//	POST /api/chaos/disconnect      disconnect, with "mode" close or drop
+//
+// Malformed messages and disconnects go to "client", or to every client.
+func handleChaos(w http.ResponseWriter, r *http.Request) {
+	if !*chaosMode {
+		http.Error(w, "chaos endpoints are disabled, start the server with -chaos", http.StatusNotFound)
+		return
+	}
+	ns := requestNamespace(r)
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/chaos"), "/")
+	if action == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ns.chaos.info())
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req chaosRequest
+	if r.ContentLength != 0 && !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	switch action {
+	case "pause":
+		if req.Seconds <= 0 || req.Seconds > 3600 {
+			http.Error(w, "seconds must be between 0 and 3600", http.StatusBadRequest)
+			return
+		}
+		d := time.Duration(req.Seconds * float64(time.Second))
+		ns.chaos.mu.Lock()
+		ns.chaos.pausedUntil = time.Now().Add(d)
+		ns.chaos.mu.Unlock()
+		log.Printf("Chaos: pausing samples to clients of the %s namespace for %v", ns, d)
+	case "resume":
+		ns.chaos.mu.Lock()
+		ns.chaos.pausedUntil = time.Time{}
+		ns.chaos.mu.Unlock()
+		log.Printf("Chaos: resuming samples to clients of the %s namespace", ns)
+	case "malformed":
+		msg, ok := chaosMessages[req.Kind]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown kind %q, expected garbage, truncated, types or unknown", req.Kind), http.StatusBadRequest)
+			return
+		}
+		if req.Kind == "unknown" {
+			msg = fmt.Sprintf(msg, time.Now().UTC().Format(time.RFC3339Nano))
+		}
+		n := ns.chaosClients(req.Client, func(c *client) { c.sendEvent([]byte(msg)) })
+		if n == 0 {
+			http.Error(w, "no such client", http.StatusNotFound)
+			return
+		}
+		log.Printf("Chaos: sent a %s message to %d client(s) of the %s namespace", req.Kind, n, ns)
+	case "disconnect":
+		if req.Mode == "" {
+			req.Mode = "close"
+		}
+		if req.Mode != "close" && req.Mode != "drop" {
+			http.Error(w, fmt.Sprintf("unknown mode %q, expected close or drop", req.Mode), http.StatusBadRequest)
+			return
+		}
+		msg := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "chaos: disconnected on purpose")
+		n := ns.chaosClients(req.Client, func(c *client) {
+			if req.Mode == "close" {
+				c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(*writeTimeout))
+			}
+			// Closing the connection ends the read loop, which unregisters the client
+			c.conn.Close()
+		})
+		if n == 0 {
+			http.Error(w, "no such client", http.StatusNotFound)
+			return
+		}
+		log.Printf("Chaos: disconnected %d client(s) of the %s namespace (%s)", n, ns, req.Mode)
+	default:
+		http.Error(w, "unknown chaos action "+action, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ns.chaos.info())
+}
+
+// chaosClients calls fn for the client with the ID, or for every client
+// when it is 0, and returns how many there were
+func (ns *namespace) chaosClients(id int64, fn func(*client)) int {
+	ns.clientsMu.Lock()
+	defer ns.clientsMu.Unlock()
+	n := 0
+	for _, c := range ns.clients {
+		if id == 0 || c.id == id {
+			fn(c)
+			n++
+		}
+	}
+	return n
+}
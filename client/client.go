@@ -0,0 +1,371 @@
+// Package client connects to the WebSocket of a quatplot server and hands
+// out its samples and events, reconnecting when the connection drops and
+// asking the server for the samples missed in the meantime.
+//
+//	c := client.New("ws://localhost:8080/ws", client.Options{})
+//	go c.Run(ctx)
+//	for s := range c.Samples() {
+//		fmt.Println(s.ID, s.Quaternion)
+//	}
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// eventBuffer is how many events may wait to be read before further
+	// ones are dropped
+	eventBuffer = 64
+	// readTimeout is how long the server may stay silent, it pings every
+	// 30 seconds unless started with a longer -ping-interval
+	readTimeout = 90 * time.Second
+	// writeTimeout bounds the messages the client sends
+	writeTimeout = 10 * time.Second
+)
+
+// ErrNotConnected is returned when sending while the client is disconnected
+var ErrNotConnected = errors.New("not connected to the server")
+
+// Options are the settings of a connection. The zero value connects with
+// the server's settings.
+type Options struct {
+	Token   string        // API token from /api/login or /pair, when the server requires a password
+	Header  http.Header   // Extra headers of the WebSocket request, e.g. for an authenticating proxy
+	Angles  string        // Units of Euler angles, "deg" or "rad", the server's when empty
+	Order   string        // Rotation order of Euler angles, e.g. "XYZ", the server's when empty
+	Vectors string        // Derived vectors, e.g. "gravity,angular_velocity" or "none", the server's when empty
+	Follow  bool          // Receive the presenter's view as "view" events
+	History time.Duration // Recent past to receive on first connecting, the server's -backfill-on-connect when zero
+	TLS     *tls.Config   // For wss:// URLs, e.g. to trust a self-signed certificate, the system's roots when nil
+	Name    string        // Names the client to the server in its hello, e.g. "dashboard/1.2", "quatplot-go" when empty
+
+	// SigningKey is the key of the server's -signing-key-file. When set,
+	// a connection is dropped at the first message that fails Verify, such
+	// as one a relay changed, and messages signed with a kid other than
+	// SigningKeyID, when that is set.
+	SigningKey   []byte
+	SigningKeyID string
+
+	ReconnectDelay    time.Duration // Delay before the first reconnect attempt, 1s when zero
+	MaxReconnectDelay time.Duration // Attempts back off up to this delay, 30s when zero
+}
+
+// Client is a connection to a quatplot server that is reopened whenever it
+// drops. Samples and events are read from its channels while Run runs.
+type Client struct {
+	url     string
+	opts    Options
+	samples chan Sample
+	events  chan Event
+
+	mu      sync.Mutex // Guards the connection and writes to it
+	conn    *websocket.Conn
+	epoch   string // Epoch of the server, sequence numbers restart with it
+	token   string // Resume token of the last session
+	lastSeq uint64 // Sequence number of the last sample handed out, 0 for none
+	sub     *Subscription
+}
+
+// New returns a client of the WebSocket at url, e.g. ws://localhost:8080/ws
+// or wss://example.com/t/lab/ws for a tenant. Nothing happens until Run.
+func New(url string, opts Options) *Client {
+	if opts.ReconnectDelay <= 0 {
+		opts.ReconnectDelay = time.Second
+	}
+	if opts.MaxReconnectDelay <= 0 {
+		opts.MaxReconnectDelay = 30 * time.Second
+	}
+	if opts.Name == "" {
+		opts.Name = "quatplot-go"
+	}
+	return &Client{url: url, opts: opts, samples: make(chan Sample), events: make(chan Event, eventBuffer)}
+}
+
+// Samples returns the samples of the server in sequence order, backfilled
+// ones included. While nothing reads it, the server keeps only the latest
+// sample of each device for the client. It is closed when Run returns.
+func (c *Client) Samples() <-chan Sample {
+	return c.samples
+}
+
+// Events returns the events of the server. Events that aren't read are
+// dropped once 64 are waiting. It is closed when Run returns.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Run connects to the server and reads it until ctx is done, reconnecting
+// with a growing delay whenever the connection fails. It must only be
+// called once.
+func (c *Client) Run(ctx context.Context) error {
+	defer close(c.samples)
+	defer close(c.events)
+	delay := c.opts.ReconnectDelay
+	for {
+		connected, err := c.connect(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if connected {
+			delay = c.opts.ReconnectDelay
+		}
+		log.Printf("Connection to %s lost: %v, reconnecting in %v", c.url, err, delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, c.opts.MaxReconnectDelay)
+	}
+}
+
+// connect reads one connection until it fails, reporting whether it was
+// established
+func (c *Client) connect(ctx context.Context) (bool, error) {
+	u, err := c.dialURL()
+	if err != nil {
+		return false, err
+	}
+	header := c.opts.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if c.opts.Token != "" {
+		header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = c.opts.TLS
+	conn, resp, err := dialer.DialContext(ctx, u, header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return false, errors.New("the server requires a valid token")
+		}
+		return false, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	c.mu.Lock()
+	c.conn = conn
+	sub := c.sub
+	c.mu.Unlock()
+	// Servers started with -client-protocol strict send samples once they
+	// have both, older ones ignore the hello
+	if sub == nil {
+		sub = &Subscription{}
+	}
+	if err := c.send("hello", Hello{Protocol: ProtocolVersion, Client: c.opts.Name}); err != nil {
+		return true, err
+	}
+	if err := c.send("subscribe", sub); err != nil {
+		return true, err
+	}
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+	}()
+
+	// Answer the server's pings, which also show the connection is alive.
+	// The deadline starts over with every read, not while the samples
+	// channel is full.
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeTimeout))
+	})
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+		if err := c.handle(ctx, data); err != nil {
+			return true, err
+		}
+	}
+}
+
+// dialURL adds the settings and the state to resume from to the URL
+func (c *Client) dialURL() (string, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	// Samples decode from the keys i, j, k and real, whatever the server's
+	// -quat-keys
+	q.Set("keys", "ijk")
+	if c.opts.Angles != "" {
+		q.Set("angles", c.opts.Angles)
+	}
+	if c.opts.Order != "" {
+		q.Set("angle_order", c.opts.Order)
+	}
+	if c.opts.Vectors != "" {
+		q.Set("vectors", c.opts.Vectors)
+	}
+	c.mu.Lock()
+	follow := c.opts.Follow
+	c.mu.Unlock()
+	if follow {
+		q.Set("follow", "1")
+	}
+	if c.token != "" {
+		q.Set("token", c.token)
+	}
+	if c.epoch != "" && c.lastSeq != 0 {
+		q.Set("epoch", c.epoch)
+		q.Set("last_seq", strconv.FormatUint(c.lastSeq, 10))
+	} else if c.opts.History > 0 {
+		q.Set("history", strconv.FormatFloat(c.opts.History.Seconds(), 'f', -1, 64))
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// handle decodes a message and hands it out
+func (c *Client) handle(ctx context.Context, data []byte) error {
+	if c.opts.SigningKey != nil {
+		kid, ok := Verify(c.opts.SigningKey, data)
+		if !ok || (c.opts.SigningKeyID != "" && kid != c.opts.SigningKeyID) {
+			return ErrBadSignature
+		}
+	}
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return err
+	}
+	if typed.Type == "" {
+		// Samples have no type
+		var s Sample
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		return c.deliver(ctx, s)
+	}
+
+	var e Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return err
+	}
+	switch e.Type {
+	case "session":
+		var s Session
+		if err := json.Unmarshal(e.Data, &s); err != nil {
+			return err
+		}
+		if s.Epoch != c.epoch {
+			// The server restarted, its sequence numbers start over
+			c.epoch, c.lastSeq = s.Epoch, 0
+		}
+		c.token = s.Token
+	case "backfill":
+		var b Backfill
+		if err := json.Unmarshal(e.Data, &b); err != nil {
+			return err
+		}
+		for _, s := range b.Samples {
+			if err := c.deliver(ctx, s); err != nil {
+				return err
+			}
+		}
+	case "history":
+		var h History
+		if err := json.Unmarshal(e.Data, &h); err != nil {
+			return err
+		}
+		for _, s := range h.Samples() {
+			if err := c.deliver(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+	select {
+	case c.events <- e:
+	default:
+	}
+	return nil
+}
+
+// deliver hands out a sample, skipping those older than the last one
+// handed out. The current samples sent on connecting share a sequence
+// number, so equal ones are kept.
+func (c *Client) deliver(ctx context.Context, s Sample) error {
+	if s.Seq < c.lastSeq {
+		return nil
+	}
+	select {
+	case c.samples <- s:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if s.Seq > c.lastSeq {
+		c.lastSeq = s.Seq
+	}
+	return nil
+}
+
+// send writes a message to the server
+func (c *Client) send(msgType string, data any) error {
+	msg, err := json.Marshal(struct {
+		Type string `json:"type"`
+		Data any    `json:"data"`
+	}{msgType, data})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// Present starts or stops presenting, which needs the controller role. The
+// server answers with a "presenter" event.
+func (c *Client) Present(active bool) error {
+	return c.send("present", map[string]bool{"active": active})
+}
+
+// Follow sets whether the client receives the presenter's view, now and
+// after reconnecting
+func (c *Client) Follow(on bool) error {
+	c.mu.Lock()
+	c.opts.Follow = on
+	c.mu.Unlock()
+	return c.send("follow", map[string]bool{"active": on})
+}
+
+// SetView sends the view followers show while the client presents
+func (c *Client) SetView(v View) error {
+	return c.send("view", v)
+}
+
+// Subscribe narrows what the server sends, e.g. to 30 samples a second of
+// one device with only its Euler angles, now and after reconnecting. The
+// server answers with a "subscribed" event. While disconnected it returns
+// ErrNotConnected, and the subscription is sent once reconnected.
+func (c *Client) Subscribe(sub Subscription) error {
+	c.mu.Lock()
+	c.sub = &sub
+	c.mu.Unlock()
+	return c.send("subscribe", sub)
+}
@@ -0,0 +1,356 @@
+package client
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+// Sample is the orientation of a device, as streamed by the server. The
+// derived values are only there when the server or the connection's
+// Options ask for them.
+type Sample struct {
+	ID              string       `json:"id,omitempty"` // Device, empty for a single sensor
+	Seq             uint64       `json:"seq"`
+	quat.Quaternion              // Zero when a subscription leaves it out
+	Time            *time.Time   `json:"time,omitempty"` // Only set on backfilled and history samples
+	Euler           *quat.Euler  `json:"euler,omitempty"`
+	Gravity         *quat.Vector `json:"gravity,omitempty"`
+	Heading         *Heading     `json:"heading,omitempty"`
+	AngularVelocity *quat.Vector `json:"angular_velocity,omitempty"` // About the device's axes, in the angle units per second
+	Settling        bool         `json:"settling,omitempty"`         // Taken before the device settled after it started
+	Outlier         bool         `json:"outlier,omitempty"`          // Turned further than the server's -outlier-angle from the previous sample
+}
+
+// Heading is the direction a device faces, in the horizontal plane
+type Heading struct {
+	quat.Vector
+	Bearing *float64 `json:"bearing,omitempty"` // Clockwise from north, when the frame is known
+}
+
+// Event is a typed message of the server, such as a change of the state of
+// a sensor. Decode returns its payload.
+type Event struct {
+	Type string          `json:"type"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Decode returns the payload of the event as one of the types of this
+// package, e.g. *Status for "status" events, or the raw JSON for events it
+// doesn't know
+func (e Event) Decode() (any, error) {
+	var v any
+	switch e.Type {
+	case "session":
+		v = &Session{}
+	case "resume":
+		v = &Resume{}
+	case "backfill":
+		v = &Backfill{}
+	case "history":
+		v = &History{}
+	case "restarting":
+		v = &Restarting{}
+	case "status":
+		v = &Status{}
+	case "heartbeat":
+		v = &Heartbeat{}
+	case "fence":
+		v = &Fence{}
+	case "stream":
+		v = &Stream{}
+	case "model":
+		v = &ModelChange{}
+	case "presenter":
+		v = &Presenter{}
+	case "view":
+		v = &View{}
+	case "hello":
+		v = &Hello{}
+	case "subscribed":
+		v = &Subscribed{}
+	case "disk":
+		v = &Disk{}
+	case "tare":
+		v = &Tare{}
+	case "settled":
+		v = &Settled{}
+	case "smoothing":
+		v = &Smoothing{}
+	default:
+		return e.Data, nil
+	}
+	if err := json.Unmarshal(e.Data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ProtocolVersion is the version of the messages this package decodes. A
+// Session with a higher Protocol may hold messages it can't read.
+const ProtocolVersion = 1
+
+// Session is sent first on every connection
+type Session struct {
+	Server   string `json:"server"`   // "quatplot"
+	Version  string `json:"version"`  // Version of the server
+	Protocol int    `json:"protocol"` // Version of the messages, see ProtocolVersion
+	Epoch    string `json:"epoch"`    // Identifies the server process, sequence numbers restart with it
+	Seq      uint64 `json:"seq"`
+	Token    string `json:"token"` // Resumes the connection after a reconnect
+	Units    struct {
+		Angle string `json:"angle"`
+		Rate  string `json:"rate"`
+		Freq  string `json:"frequency"`
+	} `json:"units"`
+	EulerOrder string     `json:"euler_order"` // Rotation order of the Euler angles, e.g. "ZYX"
+	Convention Convention `json:"convention"`
+	Vectors    []string   `json:"vectors,omitempty"`
+	Streams    []Stream   `json:"streams"`
+	Model      *Model     `json:"model,omitempty"`
+	Status     Status     `json:"status"` // State of the sensor's connection when the client connected
+	Settings   Settings   `json:"settings"`
+	// Welcome is the payload set with the server's -welcome, nil when none is
+	Welcome json.RawMessage `json:"welcome,omitempty"`
+	// Handshake is set when the server disconnects clients that don't send
+	// a hello and a subscribe in time, which Client always does
+	Handshake *Handshake `json:"handshake,omitempty"`
+}
+
+// Handshake is the handshake a server requires
+type Handshake struct {
+	TimeoutMs int64 `json:"timeout_ms"` // Time a client has to complete it
+}
+
+// Hello is sent by the client on connecting, and answered by the server
+// with its own
+type Hello struct {
+	Protocol int    `json:"protocol"`         // Version of the messages, see ProtocolVersion
+	Client   string `json:"client,omitempty"` // Name of the client, only sent by clients
+	Strict   bool   `json:"strict,omitempty"` // Whether the server requires the handshake, only sent by servers
+}
+
+// Settings describe the input of the server and what it does to samples
+type Settings struct {
+	Source    string    `json:"source"` // Kind of input, e.g. "serial"
+	Input     string    `json:"input"`  // What the input holds, e.g. "quaternion" or "imu"
+	Format    string    `json:"format"` // Layout of incoming lines
+	Pipeline  *Pipeline `json:"pipeline,omitempty"`
+	Smoothing Smoothing `json:"smoothing"`
+	InputRate float64   `json:"input_rate_hz"` // Samples a second read when the client connected
+}
+
+// Pipeline is the corrections the server applies to samples
+type Pipeline struct {
+	Remap         string  `json:"remap,omitempty"`          // Axes of the sensor each axis is taken from
+	Mount         string  `json:"mount,omitempty"`          // Roll,pitch,yaw of the sensor on the body, degrees
+	HeadingOffset float64 `json:"heading_offset,omitempty"` // Degrees added to the yaw
+	Smoothing     float64 `json:"smoothing,omitempty"`      // Time constant of the low-pass filter, seconds
+	SmoothMethod  string  `json:"smoothing_method,omitempty"`
+}
+
+// Convention describes the quaternions of the server
+type Convention struct {
+	Convention       string   `json:"convention"`
+	Handedness       string   `json:"handedness"`
+	Components       []string `json:"components"`
+	Scalar           string   `json:"scalar"`
+	Rotation         string   `json:"rotation"`
+	Frame            string   `json:"frame"`
+	SourceConvention string   `json:"source_convention"`
+	SourceOrder      string   `json:"source_order"`
+	SourceInput      string   `json:"source_input"`
+	SourceEulerOrder string   `json:"source_euler_order,omitempty"`
+	SourceEulerUnits string   `json:"source_euler_units,omitempty"`
+}
+
+// Resume tells a reconnected client what it missed
+type Resume struct {
+	Epoch            string `json:"epoch"`
+	EpochChanged     bool   `json:"epoch_changed"` // The server restarted, sequence numbers aren't comparable
+	LastSeq          uint64 `json:"last_seq"`
+	CurrentSeq       uint64 `json:"current_seq"`
+	Missed           uint64 `json:"missed"`
+	FromSeq          uint64 `json:"from_seq,omitempty"`
+	ToSeq            uint64 `json:"to_seq,omitempty"`
+	Backfilled       int    `json:"backfilled,omitempty"`
+	HistoryTruncated bool   `json:"history_truncated,omitempty"`
+}
+
+// Backfill carries the samples a reconnected client missed. The client
+// delivers them on its Samples channel too.
+type Backfill struct {
+	Samples []Sample `json:"samples"`
+}
+
+// History carries the recent samples asked for with Options.History, each
+// a row of the columns in Fields. The client delivers them on its Samples
+// channel too.
+type History struct {
+	Seconds float64   `json:"seconds"`
+	Start   time.Time `json:"start"`
+	Fields  []string  `json:"fields"` // seq, t, i, j, k, real, t in milliseconds since Start
+	Devices []struct {
+		ID      string      `json:"id,omitempty"`
+		Samples [][]float64 `json:"samples"`
+	} `json:"devices"`
+}
+
+// Samples returns the rows as samples, in sequence order
+func (h *History) Samples() []Sample {
+	col := map[string]int{}
+	for n, f := range h.Fields {
+		col[f] = n
+	}
+	var out []Sample
+	for _, d := range h.Devices {
+		for _, row := range d.Samples {
+			if len(row) < len(h.Fields) {
+				continue
+			}
+			t := h.Start.Add(time.Duration(row[col["t"]] * float64(time.Millisecond)))
+			out = append(out, Sample{
+				ID:         d.ID,
+				Seq:        uint64(row[col["seq"]]),
+				Quaternion: quat.Quaternion{I: row[col["i"]], J: row[col["j"]], K: row[col["k"]], Real: row[col["real"]]},
+				Time:       &t,
+			})
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Seq < out[b].Seq })
+	return out
+}
+
+// Restarting is sent before the server restarts or shuts down
+type Restarting struct {
+	Reason         string `json:"reason"`
+	ExpectedDownMS int64  `json:"expected_downtime_ms"`
+	Epoch          string `json:"epoch"`
+	LastSeq        uint64 `json:"last_seq"`
+}
+
+// Status is the state of a sensor's connection
+type Status struct {
+	ID      string    `json:"id,omitempty"`
+	State   string    `json:"state"` // e.g. "connected" or "not_found"
+	Port    string    `json:"port"`
+	Message string    `json:"message,omitempty"`
+	Hint    string    `json:"hint,omitempty"`
+	Since   time.Time `json:"since"`
+	Devices []Status  `json:"devices,omitempty"`
+}
+
+// Heartbeat is sent every few seconds while the server receives no samples,
+// so a silent sensor can be told from a dead connection
+type Heartbeat struct {
+	Seq           uint64     `json:"seq"`
+	LastSample    *time.Time `json:"last_sample,omitempty"`        // nil before the first sample
+	LastSampleAge *int64     `json:"last_sample_age_ms,omitempty"` // In milliseconds
+	Status        Status     `json:"status"`
+}
+
+// Disk is sent when the volume the server records to runs low on space or
+// recovers
+type Disk struct {
+	Path       string `json:"path"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
+	MinFree    uint64 `json:"min_free_bytes"`
+	Low        bool   `json:"low"`
+	Policy     string `json:"policy"`           // "stop" or "delete-oldest"
+	Action     string `json:"action,omitempty"` // What the server did about it
+}
+
+// Tare is sent when the reference orientations set through /api/tare change.
+// Samples of a tared device are relative to its reference.
+type Tare struct {
+	Devices []TareRef `json:"devices"`
+}
+
+// TareRef is the orientation a device was tared at
+type TareRef struct {
+	Device    string          `json:"device"`
+	Reference quat.Quaternion `json:"reference"`
+	Time      time.Time       `json:"time"`
+}
+
+// Settled is sent when a device has settled after it started, with the
+// server's -settle-rate
+type Settled struct {
+	ID      string  `json:"id,omitempty"`
+	Seconds float64 `json:"seconds"` // How long the device was settling
+	Reason  string  `json:"reason"`  // "converged", or "timeout" when it still drifted
+}
+
+// Smoothing is sent when the low-pass filter is changed through
+// /api/smoothing
+type Smoothing struct {
+	Seconds    float64 `json:"seconds"` // Time constant or window length, 0 when off
+	Method     string  `json:"method"`  // "exponential" or "window"
+	Overridden bool    `json:"overridden"`
+}
+
+// Fence is sent when a device leaves or re-enters an orientation fence
+type Fence struct {
+	Fence        string    `json:"fence"`
+	ID           string    `json:"id,omitempty"`
+	State        string    `json:"state"` // "inside" or "outside"
+	AngleDeg     float64   `json:"angle_deg"`
+	HalfAngleDeg float64   `json:"half_angle_deg"`
+	Since        time.Time `json:"since"`
+}
+
+// Stream is how a device is displayed
+type Stream struct {
+	ID    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Color string `json:"color,omitempty"`
+	Model string `json:"model,omitempty"`
+	Units string `json:"units,omitempty"`
+}
+
+// Model is a model of the server's library
+type Model struct {
+	Name     string   `json:"name"`
+	MTL      string   `json:"mtl,omitempty"`
+	Textures []string `json:"textures,omitempty"`
+	Size     int64    `json:"size"`
+}
+
+// ModelChange is sent when the model viewers show is changed
+type ModelChange struct {
+	Model *Model `json:"model"` // nil for the viewers' own model
+}
+
+// Presenter tells who presents, see Client.Present
+type Presenter struct {
+	Active     bool   `json:"active"`
+	Client     int64  `json:"client,omitempty"`
+	User       string `json:"user,omitempty"`
+	Presenting bool   `json:"presenting,omitempty"` // This client is the presenter
+	Error      string `json:"error,omitempty"`
+}
+
+// View is the presenter's camera, sent to followers
+type View struct {
+	Zoom     float64         `json:"zoom"`
+	Rotation quat.Quaternion `json:"rotation"`
+	Pan      [2]float64      `json:"pan"`
+}
+
+// Subscription narrows what the server sends, see Client.Subscribe. The
+// zero value is every sample of every device.
+type Subscription struct {
+	Rate    float64  `json:"rate,omitempty"`    // Most samples per second of each device, 0 for all
+	Devices []string `json:"devices,omitempty"` // Only these devices, all when empty
+	Fields  []string `json:"fields,omitempty"`  // Any of quat, euler, gravity and heading, the connection's when empty
+}
+
+// Subscribed confirms a subscription, or tells why it was refused
+type Subscribed struct {
+	Subscription
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// ErrBadSignature is returned by Run's connections for a message that isn't
+// signed with Options.SigningKey
+var ErrBadSignature = errors.New("message not signed with the signing key")
+
+// Verify checks the signature a server started with -signing-key-file adds
+// to a message, as received, and returns the kid it names, empty when the
+// server has no -signing-key-id. A relay that changed, dropped or added
+// anything before the signature is caught.
+func Verify(key, msg []byte) (kid string, ok bool) {
+	n := bytes.LastIndex(msg, []byte(`"sig":"`))
+	if n < 0 || !bytes.HasSuffix(msg, []byte(`"}`)) {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(string(msg[n+len(`"sig":"`) : len(msg)-2]))
+	if err != nil {
+		return "", false
+	}
+	body := bytes.TrimSuffix(msg[:n], []byte(","))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	mac.Write([]byte("}"))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", false
+	}
+	var signed struct {
+		Kid string `json:"kid"`
+	}
+	json.Unmarshal(msg, &signed)
+	return signed.Kid, true
+}
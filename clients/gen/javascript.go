@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsType returns the JSDoc type of a schema
+func jsType(s obj) string {
+	if ref := refOf(s); ref != "" {
+		return ref
+	}
+	switch str(s, "type") {
+	case "string":
+		return "string"
+	case "number", "integer":
+		return "number"
+	case "boolean":
+		return "boolean"
+	case "array":
+		items, _ := s["items"].(obj)
+		return "Array<" + jsType(items) + ">"
+	case "object":
+		return "Object"
+	}
+	return "*"
+}
+
+// jsName returns the JavaScript name of a path parameter
+func jsName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range name {
+		switch {
+		case r == '_' || r == '-':
+			upper = true
+		case upper:
+			b.WriteString(strings.ToUpper(string(r)))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// jsPath returns a JavaScript expression building the path of an operation
+func jsPath(op operation) string {
+	var parts []string
+	rest := op.Path
+	for {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest, "}")
+		parts = append(parts, jsString(rest[:start]), "encodeURIComponent("+jsName(rest[start+1:end])+")")
+		rest = rest[end+1:]
+	}
+	if rest != "" || len(parts) == 0 {
+		parts = append(parts, jsString(rest))
+	}
+	return strings.Join(parts, " + ")
+}
+
+// jsString quotes a string in single quotes
+func jsString(s string) string {
+	q := strconv.Quote(s)
+	return "'" + strings.ReplaceAll(q[1:len(q)-1], "'", `\'`) + "'"
+}
+
+func (g *generator) javascript() []byte {
+	var b bytes.Buffer
+	b.WriteString(g.header("//"))
+	fmt.Fprintf(&b, `// Client of the quatplot HTTP API, generated from version %s of the API.
+// Every method resolves to the decoded JSON of the response, or to the
+// Response itself for endpoints that send text, and rejects when the server
+// refuses the request. Regenerate with make clients.
+
+export const PROTOCOL_VERSION = %s;
+export const SPEC_SHA256 = %s;
+`, g.version, jsString(g.version), jsString(g.hash))
+
+	for _, s := range g.schemas {
+		b.WriteString("\n/**\n")
+		comment(&b, " * ", s.Description)
+		fmt.Fprintf(&b, " * @typedef {Object} %s\n", s.Name)
+		for _, p := range s.Props {
+			name := p
+			if !s.Required[p] {
+				name = "[" + p + "]"
+			}
+			fmt.Fprintf(&b, " * @property {%s} %s\n", jsType(s.Types[p]), name)
+		}
+		b.WriteString(" */\n")
+	}
+
+	b.WriteString(`
+/**
+ * Client of a quatplot server, or of a tenant at http://host/t/{name}. A
+ * token from login, that is /api/login, or from pairing at /pair is sent as
+ * a bearer token when the server requires a password. In a page of the server itself, the login
+ * cookie is sent instead.
+ */
+export class QuatplotClient {
+    /**
+     * @param {string} baseURL Address of the server, e.g. http://localhost:8080
+     * @param {{token?: string}} [options]
+     */
+    constructor(baseURL, options = {}) {
+        this.baseURL = baseURL.replace(/\/+$/, '');
+        this.token = options.token || null;
+    }
+
+    async _request(method, path, query, body) {
+        const url = new URL(this.baseURL + path);
+        for (const [key, value] of Object.entries(query || {})) {
+            if (value !== undefined && value !== null) {
+                url.searchParams.set(key, String(value));
+            }
+        }
+        const headers = {};
+        if (body !== undefined) {
+            headers['Content-Type'] = 'application/json';
+        }
+        if (this.token) {
+            headers['Authorization'] = 'Bearer ' + this.token;
+        }
+        const response = await fetch(url, {
+            method: method,
+            headers: headers,
+            body: body === undefined ? undefined : JSON.stringify(body),
+            credentials: 'same-origin'
+        });
+        if (!response.ok) {
+            throw new Error(method + ' ' + path + ': ' + response.status + ' ' + (await response.text()).trim());
+        }
+        return response;
+    }
+
+    async _json(method, path, query, body) {
+        const response = await this._request(method, path, query, body);
+        const text = await response.text();
+        return text ? JSON.parse(text) : null;
+    }
+`)
+	for _, op := range g.ops {
+		g.javascriptMethod(&b, op)
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+func (g *generator) javascriptMethod(b *bytes.Buffer, op operation) {
+	name := op.ID
+	doc := op.Summary
+	if op.Description != "" {
+		doc += ". " + op.Description
+	}
+	var args []string
+	b.WriteString("\n    /**\n")
+	comment(b, "     * ", doc)
+	for _, p := range op.PathParams {
+		args = append(args, jsName(p.Name))
+		fmt.Fprintf(b, "     * @param {string} %s\n", jsName(p.Name))
+	}
+	query := "undefined"
+	if len(op.QueryParams) > 0 {
+		optional := true
+		for _, p := range op.QueryParams {
+			optional = optional && !p.Required
+		}
+		if optional {
+			args = append(args, "query = {}")
+			b.WriteString("     * @param {Object} [query]\n")
+		} else {
+			args = append(args, "query")
+			b.WriteString("     * @param {Object} query\n")
+		}
+		for _, p := range op.QueryParams {
+			field := "query." + p.Name
+			if !p.Required {
+				field = "[" + field + "]"
+			}
+			line := fmt.Sprintf("     * @param {%s} %s", jsType(p.Schema), field)
+			if p.Description != "" {
+				line += " " + p.Description
+			}
+			fmt.Fprintln(b, line)
+		}
+		query = "query"
+	}
+	body := "undefined"
+	if op.Body != nil {
+		if op.BodyNeeded {
+			args = append(args, "body")
+			fmt.Fprintf(b, "     * @param {Object} body\n")
+		} else {
+			args = append(args, "body = undefined")
+			fmt.Fprintf(b, "     * @param {Object} [body]\n")
+		}
+		body = "body"
+	}
+	switch op.Kind {
+	case "json":
+		fmt.Fprintf(b, "     * @returns {Promise<%s>}\n", jsType(op.Result))
+	case "text":
+		b.WriteString("     * @returns {Promise<Response>}\n")
+	case "websocket":
+		b.WriteString("     * @returns {string} The URL to open the WebSocket at\n")
+		name += "URL"
+	default:
+		b.WriteString("     * @returns {Promise<void>}\n")
+	}
+	b.WriteString("     */\n")
+	fmt.Fprintf(b, "    %s(%s) {\n", name, strings.Join(args, ", "))
+	switch op.Kind {
+	case "websocket":
+		fmt.Fprintf(b, "        const url = new URL(this.baseURL + %s);\n", jsPath(op))
+		b.WriteString(`        url.protocol = url.protocol === 'https:' ? 'wss:' : 'ws:';
+        for (const [key, value] of Object.entries(query)) {
+            if (value !== undefined && value !== null) {
+                url.searchParams.set(key, String(value));
+            }
+        }
+        if (this.token && !url.searchParams.has('access_token')) {
+            url.searchParams.set('access_token', this.token);
+        }
+        return url.toString();
+`)
+	case "json":
+		fmt.Fprintf(b, "        return this._json(%s, %s, %s, %s);\n", jsString(op.Method), jsPath(op), query, body)
+	case "text":
+		fmt.Fprintf(b, "        return this._request(%s, %s, %s, %s);\n", jsString(op.Method), jsPath(op), query, body)
+	default:
+		fmt.Fprintf(b, "        return this._request(%s, %s, %s, %s).then(() => {});\n", jsString(op.Method), jsPath(op), query, body)
+	}
+	b.WriteString("    }\n")
+}
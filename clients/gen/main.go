@@ -0,0 +1,287 @@
+// Command gen writes the Python and JavaScript clients of the quatplot API
+// from its OpenAPI document, as printed by quatplot openapi. Run it through
+// make clients rather than by hand.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var (
+	specPath = flag.String("spec", "clients/openapi.json", "OpenAPI document to generate the clients from")
+	outDir   = flag.String("out", "clients", "Directory the clients are written to, in python/ and js/")
+)
+
+type obj = map[string]any
+
+// operation is an endpoint of the API
+type operation struct {
+	ID          string
+	Method      string
+	Path        string
+	Summary     string
+	Description string
+	PathParams  []param
+	QueryParams []param
+	Body        obj    // Schema of the JSON request body, nil for none
+	BodyNeeded  bool   // The request body is required
+	Kind        string // What the response is: json, text, none or websocket
+	Result      obj    // Schema of a JSON response
+}
+
+// param is a path or query parameter
+type param struct {
+	Name        string
+	Required    bool
+	Schema      obj
+	Description string
+}
+
+// schema is a named schema of the components, with its properties merged
+// from allOf
+type schema struct {
+	Name        string
+	Description string
+	Props       []string
+	Types       map[string]obj
+	Required    map[string]bool
+}
+
+func main() {
+	flag.Parse()
+	data, err := os.ReadFile(*specPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var spec obj
+	if err := json.Unmarshal(data, &spec); err != nil {
+		log.Fatalf("%s: %v", *specPath, err)
+	}
+	sum := sha256.Sum256(data)
+	version, _ := get(spec, "info", "version").(string)
+	ops, err := operations(spec)
+	if err != nil {
+		log.Fatalf("%s: %v", *specPath, err)
+	}
+	schemas := componentSchemas(spec)
+	g := generator{version: version, hash: hex.EncodeToString(sum[:]), ops: ops, schemas: schemas}
+
+	files := map[string][]byte{
+		filepath.Join("python", "quatplot_client.py"): g.python(),
+		filepath.Join("js", "quatplot_client.js"):     g.javascript(),
+	}
+	for name, content := range files {
+		path := filepath.Join(*outDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// get follows keys into nested objects, nil when one is missing
+func get(v any, keys ...string) any {
+	for _, k := range keys {
+		o, ok := v.(obj)
+		if !ok {
+			return nil
+		}
+		v = o[k]
+	}
+	return v
+}
+
+// str returns a string field of an object, empty when missing
+func str(o obj, key string) string {
+	s, _ := o[key].(string)
+	return s
+}
+
+// operations lists the operations of the document, sorted by path
+func operations(spec obj) ([]operation, error) {
+	paths, _ := spec["paths"].(obj)
+	names := make([]string, 0, len(paths))
+	for p := range paths {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+
+	var ops []operation
+	for _, path := range names {
+		methods, _ := paths[path].(obj)
+		for _, method := range []string{"get", "post", "put", "delete"} {
+			o, ok := methods[method].(obj)
+			if !ok {
+				continue
+			}
+			op := operation{ID: str(o, "operationId"), Method: strings.ToUpper(method), Path: path, Summary: str(o, "summary"), Description: str(o, "description")}
+			if op.ID == "" {
+				return nil, fmt.Errorf("%s %s has no operationId", op.Method, path)
+			}
+			params, _ := o["parameters"].([]any)
+			for _, v := range params {
+				p, _ := v.(obj)
+				pp := param{Name: str(p, "name"), Description: str(p, "description")}
+				pp.Required, _ = p["required"].(bool)
+				pp.Schema, _ = p["schema"].(obj)
+				if str(p, "in") == "path" {
+					op.PathParams = append(op.PathParams, pp)
+				} else {
+					op.QueryParams = append(op.QueryParams, pp)
+				}
+			}
+			if body, ok := get(o, "requestBody", "content", "application/json", "schema").(obj); ok {
+				op.Body = body
+				op.BodyNeeded, _ = get(o, "requestBody", "required").(bool)
+			}
+			responses, _ := o["responses"].(obj)
+			switch {
+			case responses["101"] != nil:
+				op.Kind = "websocket"
+			case get(responses, "200", "content", "application/json") != nil:
+				op.Kind = "json"
+				op.Result, _ = get(responses, "200", "content", "application/json", "schema").(obj)
+			case get(responses, "200", "content") != nil:
+				op.Kind = "text"
+			default:
+				op.Kind = "none"
+			}
+			ops = append(ops, op)
+		}
+	}
+	return ops, nil
+}
+
+// componentSchemas returns the named schemas of the document, sorted by name
+func componentSchemas(spec obj) []schema {
+	all, _ := get(spec, "components", "schemas").(obj)
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out []schema
+	for _, name := range names {
+		s := schema{Name: name, Types: map[string]obj{}, Required: map[string]bool{}}
+		def, _ := all[name].(obj)
+		s.Description = str(def, "description")
+		s.merge(def, all)
+		out = append(out, s)
+	}
+	return out
+}
+
+// merge adds the properties of a schema and of those it is made of
+func (s *schema) merge(def obj, all obj) {
+	if ref := str(def, "$ref"); ref != "" {
+		target, _ := all[refName(ref)].(obj)
+		s.merge(target, all)
+		return
+	}
+	parts, _ := def["allOf"].([]any)
+	for _, p := range parts {
+		if o, ok := p.(obj); ok {
+			s.merge(o, all)
+		}
+	}
+	props, _ := def["properties"].(obj)
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := s.Types[name]; !ok {
+			s.Props = append(s.Props, name)
+		}
+		s.Types[name], _ = props[name].(obj)
+	}
+	required, _ := def["required"].([]any)
+	for _, r := range required {
+		if name, ok := r.(string); ok {
+			s.Required[name] = true
+		}
+	}
+}
+
+// refName returns the schema name of a $ref
+func refName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// refOf returns the schema a property refers to, directly or as the only
+// part of an allOf, empty when it doesn't
+func refOf(s obj) string {
+	if ref := str(s, "$ref"); ref != "" {
+		return refName(ref)
+	}
+	if parts, _ := s["allOf"].([]any); len(parts) == 1 {
+		if o, ok := parts[0].(obj); ok {
+			return refOf(o)
+		}
+	}
+	return ""
+}
+
+// words splits an operation ID such as getRecordingSummary into its words
+func words(id string) []string {
+	var out []string
+	start := 0
+	for i, r := range id {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(rune(id[i-1])) {
+			out = append(out, id[start:i])
+			start = i
+		}
+	}
+	return append(out, id[start:])
+}
+
+// snake converts an operation ID to a Python name
+func snake(id string) string {
+	return strings.ToLower(strings.Join(words(id), "_"))
+}
+
+// comment wraps text into comment lines starting with prefix
+func comment(b *bytes.Buffer, prefix, text string) {
+	line := ""
+	for _, w := range strings.Fields(text) {
+		if line != "" && len(prefix)+len(line)+1+len(w) > 79 {
+			fmt.Fprintf(b, "%s%s\n", prefix, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += w
+	}
+	if line != "" {
+		fmt.Fprintf(b, "%s%s\n", prefix, line)
+	}
+}
+
+// generator writes the clients
+type generator struct {
+	version string
+	hash    string
+	ops     []operation
+	schemas []schema
+}
+
+// header is the first line of every generated file
+func (g *generator) header(prefix string) string {
+	return prefix + " Code generated by go run ./clients/gen from clients/openapi.json. DO NOT EDIT.\n"
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pythonKeywords can't be used as parameter names
+var pythonKeywords = map[string]bool{
+	"and": true, "as": true, "class": true, "def": true, "for": true, "from": true,
+	"global": true, "if": true, "import": true, "in": true, "is": true, "lambda": true,
+	"not": true, "or": true, "pass": true, "return": true, "try": true, "while": true, "with": true,
+}
+
+// pyName returns the Python name of a parameter
+func pyName(name string) string {
+	name = strings.ReplaceAll(name, "-", "_")
+	if pythonKeywords[name] {
+		return name + "_"
+	}
+	return name
+}
+
+// pyType returns the Python type of a schema
+func pyType(s obj) string {
+	if ref := refOf(s); ref != "" {
+		return strconv.Quote(ref)
+	}
+	switch str(s, "type") {
+	case "string":
+		return "str"
+	case "number":
+		return "float"
+	case "integer":
+		return "int"
+	case "boolean":
+		return "bool"
+	case "array":
+		items, _ := s["items"].(obj)
+		return "List[" + pyType(items) + "]"
+	case "object":
+		return "Dict[str, Any]"
+	}
+	return "Any"
+}
+
+// pyPath returns a Python expression building the path of an operation
+func pyPath(op operation) string {
+	var parts []string
+	rest := op.Path
+	for {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest, "}")
+		parts = append(parts, strconv.Quote(rest[:start]), "_quote("+pyName(rest[start+1:end])+")")
+		rest = rest[end+1:]
+	}
+	if rest != "" || len(parts) == 0 {
+		parts = append(parts, strconv.Quote(rest))
+	}
+	return strings.Join(parts, " + ")
+}
+
+func (g *generator) python() []byte {
+	var b bytes.Buffer
+	b.WriteString(g.header("#"))
+	fmt.Fprintf(&b, `"""Client of the quatplot HTTP API, generated from version %s of the API.
+
+Every method returns the decoded JSON of the response, or the response
+itself for endpoints that send text, and raises urllib.error.HTTPError when
+the server refuses the request. Regenerate with make clients.
+"""
+
+import json
+import urllib.parse
+import urllib.request
+from typing import Any, Dict, List, Optional, TypedDict
+
+PROTOCOL_VERSION = %q
+SPEC_SHA256 = %q
+
+
+def _quote(value: str) -> str:
+    return urllib.parse.quote(str(value), safe="")
+
+`, g.version, g.version, g.hash)
+
+	for _, s := range g.schemas {
+		b.WriteString("\n")
+		comment(&b, "# ", s.Description)
+		fmt.Fprintf(&b, "%s = TypedDict(%q, {\n", s.Name, s.Name)
+		for _, p := range s.Props {
+			fmt.Fprintf(&b, "    %q: %s,\n", p, pyType(s.Types[p]))
+		}
+		b.WriteString("}, total=False)\n")
+	}
+
+	b.WriteString(`
+
+class Client:
+    """Client of a quatplot server, or of a tenant at http://host/t/{name}.
+
+    A token from login, that is /api/login, or from pairing at /pair is sent
+    as a bearer token when the server requires a password.
+    """
+
+    def __init__(self, base_url: str, token: Optional[str] = None, timeout: float = 10):
+        self.base_url = base_url.rstrip("/")
+        self.token = token
+        self.timeout = timeout
+
+    def _open(self, method: str, path: str, query: Optional[Dict[str, Any]] = None, body: Any = None):
+        url = self.base_url + path
+        query = {k: v for k, v in (query or {}).items() if v is not None}
+        if query:
+            url += "?" + urllib.parse.urlencode(query)
+        headers = {}
+        data = None
+        if body is not None:
+            data = json.dumps(body).encode()
+            headers["Content-Type"] = "application/json"
+        if self.token:
+            headers["Authorization"] = "Bearer " + self.token
+        request = urllib.request.Request(url, data=data, method=method, headers=headers)
+        return urllib.request.urlopen(request, timeout=self.timeout)
+
+    def _json(self, method: str, path: str, query: Optional[Dict[str, Any]] = None, body: Any = None) -> Any:
+        with self._open(method, path, query, body) as response:
+            data = response.read()
+        return json.loads(data) if data else None
+`)
+
+	for _, op := range g.ops {
+		g.pythonMethod(&b, op)
+	}
+	return b.Bytes()
+}
+
+func (g *generator) pythonMethod(b *bytes.Buffer, op operation) {
+	name := snake(op.ID)
+	args := []string{"self"}
+	for _, p := range op.PathParams {
+		args = append(args, pyName(p.Name)+": str")
+	}
+	var optional []string
+	for _, p := range op.QueryParams {
+		if p.Required {
+			args = append(args, pyName(p.Name)+": "+pyType(p.Schema))
+		} else {
+			optional = append(optional, pyName(p.Name)+": Optional["+pyType(p.Schema)+"] = None")
+		}
+	}
+	if op.Body != nil {
+		if op.BodyNeeded {
+			args = append(args, "body: Dict[str, Any]")
+		} else {
+			optional = append(optional, "body: Optional[Dict[str, Any]] = None")
+		}
+	}
+	if len(optional) > 0 {
+		args = append(args, "*")
+		args = append(args, optional...)
+	}
+
+	result := "Any"
+	switch op.Kind {
+	case "json":
+		result = pyType(op.Result)
+	case "websocket":
+		result = "str"
+		name += "_url"
+	case "none":
+		result = "None"
+	}
+	fmt.Fprintf(b, "\n    def %s(%s) -> %s:\n", name, strings.Join(args, ", "), result)
+	b.WriteString(`        """`)
+	doc := op.Summary
+	if op.Description != "" {
+		doc += ". " + op.Description
+	}
+	switch op.Kind {
+	case "text":
+		doc += " Returns the response, to read or iterate over line by line."
+	case "websocket":
+		doc += " Returns the URL to open it at."
+	}
+	b.WriteString(strings.TrimSpace(wrapped(doc, "        ")))
+	b.WriteString("\"\"\"\n")
+
+	query := "None"
+	if len(op.QueryParams) > 0 {
+		var items []string
+		for _, p := range op.QueryParams {
+			items = append(items, fmt.Sprintf("%q: %s", p.Name, pyName(p.Name)))
+		}
+		query = "{" + strings.Join(items, ", ") + "}"
+	}
+	body := "None"
+	if op.Body != nil {
+		body = "body"
+	}
+	switch op.Kind {
+	case "websocket":
+		fmt.Fprintf(b, "        query = {k: v for k, v in %s.items() if v is not None}\n", query)
+		b.WriteString(`        if self.token and "access_token" not in query:
+            query["access_token"] = self.token
+        url = "ws" + self.base_url[len("http"):] if self.base_url.startswith("http") else self.base_url
+`)
+		fmt.Fprintf(b, "        url += %s\n", pyPath(op))
+		b.WriteString(`        if query:
+            url += "?" + urllib.parse.urlencode(query)
+        return url
+`)
+	case "json":
+		fmt.Fprintf(b, "        return self._json(%q, %s, %s, %s)\n", op.Method, pyPath(op), query, body)
+	case "text":
+		fmt.Fprintf(b, "        return self._open(%q, %s, %s, %s)\n", op.Method, pyPath(op), query, body)
+	default:
+		fmt.Fprintf(b, "        self._open(%q, %s, %s, %s).close()\n", op.Method, pyPath(op), query, body)
+	}
+}
+
+// wrapped wraps text into lines indented by indent
+func wrapped(text, indent string) string {
+	var b bytes.Buffer
+	comment(&b, indent, text)
+	return b.String()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	clockRef      = flag.String("clock-ref", "", "Base URL of a quatplot server whose clock samples are aligned to, e.g. http://capture-1:8080")
+	clockInterval = flag.Duration("clock-interval", 10*time.Second, "How often the clock offset to -clock-ref is measured")
+)
+
+// clockProbes is the number of exchanges in each measurement of the offset,
+// the one with the shortest round trip is kept
+const clockProbes = 8
+
+// clockReply answers one exchange of the clock protocol, both times on the
+// server's reference clock
+type clockReply struct {
+	Receive  time.Time `json:"receive"`  // When the request arrived
+	Transmit time.Time `json:"transmit"` // When the reply was sent
+}
+
+// clockStats describes the alignment to the reference clock in /api/stats
+type clockStats struct {
+	Ref       string     `json:"ref"`
+	Synced    bool       `json:"synced"`
+	OffsetNS  int64      `json:"offset_ns"` // Added to local times to get reference times
+	DelayNS   int64      `json:"delay_ns"`  // Round trip of the exchange the offset was taken from
+	Measured  *time.Time `json:"measured,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// clockSync keeps track of the offset between the local clock and that of
+// the -clock-ref server, measured with an NTP-like exchange over HTTP
+type clockSync struct {
+	ref    string
+	client *http.Client
+
+	mu       sync.Mutex
+	synced   bool
+	offset   time.Duration
+	delay    time.Duration
+	measured time.Time
+	lastErr  string
+}
+
+// refClock is the alignment to -clock-ref, nil when samples aren't aligned
+var refClock *clockSync
+
+// startClockSync starts measuring the offset to -clock-ref, if set
+func startClockSync() error {
+	if *clockRef == "" {
+		return nil
+	}
+	c, err := newClockSync(*clockRef)
+	if err != nil {
+		return err
+	}
+	refClock = c
+	go c.loop()
+	return nil
+}
+
+func newClockSync(ref string) (*clockSync, error) {
+	u, err := url.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid clock reference %q, expected a URL such as http://host:8080", ref)
+	}
+	return &clockSync{ref: strings.TrimRight(ref, "/"), client: &http.Client{Timeout: 5 * time.Second}}, nil
+}
+
+// loop measures the offset every -clock-interval. The last offset measured
+// stays in use while the reference is unreachable.
+func (c *clockSync) loop() {
+	for {
+		offset, delay, err := c.measure()
+		c.mu.Lock()
+		if err != nil {
+			if c.lastErr != err.Error() {
+				log.Printf("Error measuring clock offset to %s: %v", c.ref, err)
+			}
+			c.lastErr = err.Error()
+		} else {
+			if !c.synced {
+				log.Printf("Clock aligned to %s, offset %v, round trip %v", c.ref, offset, delay)
+			}
+			c.synced, c.offset, c.delay, c.measured, c.lastErr = true, offset, delay, time.Now(), ""
+		}
+		c.mu.Unlock()
+		time.Sleep(*clockInterval)
+	}
+}
+
+// measure runs clockProbes exchanges with the reference and returns the
+// offset of the one with the shortest round trip, which is the least
+// affected by queueing and asymmetric delays
+func (c *clockSync) measure() (offset, delay time.Duration, err error) {
+	delay = -1
+	for n := 0; n < clockProbes; n++ {
+		o, d, err := c.exchange()
+		if err != nil {
+			return 0, 0, err
+		}
+		if delay < 0 || d < delay {
+			offset, delay = o, d
+		}
+	}
+	return offset, delay, nil
+}
+
+// exchange does one round trip. With t0 and t3 the local times the request
+// was sent and the reply received, and t1 and t2 the reference times it was
+// received and replied to, the offset is ((t1-t0)+(t2-t3))/2 and the round
+// trip (t3-t0)-(t2-t1).
+func (c *clockSync) exchange() (offset, delay time.Duration, err error) {
+	t0 := time.Now()
+	resp, err := c.client.Get(c.ref + "/api/clock")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("%s/api/clock returned %s", c.ref, resp.Status)
+	}
+	var reply clockReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return 0, 0, fmt.Errorf("reading reply: %v", err)
+	}
+	t3 := time.Now()
+	if reply.Receive.IsZero() || reply.Transmit.Before(reply.Receive) {
+		return 0, 0, errors.New("reply is not from a quatplot server")
+	}
+	// The reference times carry no monotonic reading, so these differences
+	// use the wall clock while t3-t0 uses the monotonic one
+	offset = (reply.Receive.Sub(t0) + reply.Transmit.Sub(t3)) / 2
+	delay = t3.Sub(t0) - reply.Transmit.Sub(reply.Receive)
+	return offset, delay, nil
+}
+
+// refTime converts a local time to the reference clock. It reports false
+// when there is no reference or no offset has been measured yet.
+func (c *clockSync) refTime(t time.Time) (time.Time, bool) {
+	if c == nil {
+		return time.Time{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.synced {
+		return time.Time{}, false
+	}
+	return t.Round(0).Add(c.offset), true
+}
+
+func (c *clockSync) stats() *clockStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := &clockStats{
+		Ref:       c.ref,
+		Synced:    c.synced,
+		OffsetNS:  c.offset.Nanoseconds(),
+		DelayNS:   c.delay.Nanoseconds(),
+		LastError: c.lastErr,
+	}
+	if c.synced {
+		measured := c.measured
+		st.Measured = &measured
+	}
+	return st
+}
+
+// clockNow returns the current time on the reference clock when aligned to
+// one, so that servers can be chained, and the local time otherwise
+func clockNow() time.Time {
+	now := time.Now()
+	if t, ok := refClock.refTime(now); ok {
+		return t
+	}
+	return now
+}
+
+// handleClock answers an exchange of the clock protocol from a server
+// aligning its samples to this one
+func handleClock(w http.ResponseWriter, r *http.Request) {
+	receive := clockNow()
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(clockReply{Receive: receive, Transmit: clockNow()})
+}
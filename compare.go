@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var (
+	compareDevice   = flag.String("compare-device", "", "Device of the recording compared by compare (default: the only one)")
+	referenceDevice = flag.String("reference-device", "", "Device of the reference compared against by compare (default: the only one)")
+	timeOffset      = flag.Duration("time-offset", 0, "Time added to the samples of the recording compared by compare, to line them up with the reference")
+	offsetSearch    = flag.Duration("offset-search", 0, "How far either side of -time-offset compare searches for the offset with the smallest error (default: no search)")
+	compareJSON     = flag.Bool("compare-json", false, "Print the comparison as JSON")
+)
+
+const (
+	// compareMaxGap is the longest gap between reference samples that a
+	// sample of the recording is interpolated across
+	compareMaxGap = 250 * time.Millisecond
+	// compareMinOverlap is the share of samples that must be matched for an
+	// offset to be considered in a search
+	compareMinOverlap = 0.5
+)
+
+// compareSample is a sample of one device, at the time it is compared at
+type compareSample struct {
+	t      time.Time
+	ref    *time.Time
+	q      Quaternion
+	origin time.Time // Local time, to report errors against
+}
+
+// errorStats summarizes the errors of the compared samples, in degrees
+type errorStats struct {
+	RMSE  float64   `json:"rmse"`
+	Mean  float64   `json:"mean"`
+	Max   float64   `json:"max"`
+	MaxAt time.Time `json:"max_at"` // Time of the sample in the recording with the largest error
+}
+
+// comparison reports the angular error of a recording against a reference
+type comparison struct {
+	Samples   int        `json:"samples"`   // Samples of the recording matched with the reference
+	Unmatched int        `json:"unmatched"` // Samples outside the reference, or in its gaps
+	TimeBasis string     `json:"time_basis"`
+	OffsetMS  float64    `json:"offset_ms"` // Time added to the recording's samples
+	Start     time.Time  `json:"start"`
+	End       time.Time  `json:"end"`
+	Angle     errorStats `json:"angle"` // Angle of the rotation between the two orientations
+	Roll      errorStats `json:"roll"`
+	Pitch     errorStats `json:"pitch"`
+	Yaw       errorStats `json:"yaw"`
+}
+
+// loadCompareSamples reads the samples of one device from a recording,
+// limited to the session starting at session when it isn't zero. With no
+// device, the recording must hold only one.
+func loadCompareSamples(path, device string, session time.Time) ([]compareSample, error) {
+	recording, err := openRecording(path)
+	if err != nil {
+		return nil, err
+	}
+	defer recording.Close()
+
+	var (
+		samples []compareSample
+		devices = map[string]bool{}
+		inside  = session.IsZero()
+	)
+	for {
+		header, s, err := recording.next()
+		var bad *badLineError
+		if errors.As(err, &bad) {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header != nil {
+			inside = session.IsZero() || header.Started.UTC().Format(summaryStamp) == session.UTC().Format(summaryStamp)
+			continue
+		}
+		if !inside {
+			continue
+		}
+		devices[s.ID] = true
+		if device != "" && s.ID != device {
+			continue
+		}
+		samples = append(samples, compareSample{t: s.Time, ref: s.RefTime, q: s.Quaternion, origin: s.Time})
+	}
+	if device == "" && len(devices) > 1 {
+		ids := make([]string, 0, len(devices))
+		for id := range devices {
+			ids = append(ids, fmt.Sprintf("%q", id))
+		}
+		sort.Strings(ids)
+		return nil, fmt.Errorf("%s holds samples of the devices %s, pick one", path, strings.Join(ids, ", "))
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("%s holds no samples to compare", path)
+	}
+	return samples, nil
+}
+
+// compareRecordings lines up the samples of a recording with a reference,
+// searching either side of offset for the best fit when search is positive,
+// and reports the error
+func compareRecordings(samples, reference []compareSample, offset, search time.Duration) (comparison, error) {
+	// Times on a common reference clock are used when both have them
+	basis := "ref_time"
+	for _, set := range [][]compareSample{samples, reference} {
+		for _, s := range set {
+			if s.ref == nil {
+				basis = "time"
+			}
+		}
+	}
+	for _, set := range [][]compareSample{samples, reference} {
+		for i := range set {
+			if basis == "ref_time" {
+				set[i].t = *set[i].ref
+			}
+		}
+		sort.SliceStable(set, func(a, b int) bool { return set[a].t.Before(set[b].t) })
+	}
+
+	if search > 0 {
+		// A coarse search, then a finer one around its best offset
+		step := max(search/50, time.Millisecond)
+		best := bestOffset(samples, reference, offset-search, offset+search, step)
+		offset = bestOffset(samples, reference, best-step, best+step, max(step/10, time.Millisecond))
+	}
+	c := measureError(samples, reference, offset)
+	if c.Samples == 0 {
+		return c, errors.New("the recording and the reference don't overlap in time")
+	}
+	c.TimeBasis = basis
+	return c, nil
+}
+
+// bestOffset returns the offset between from and to, in steps, with the
+// smallest mean angular error, the middle one when none overlap enough
+func bestOffset(samples, reference []compareSample, from, to, step time.Duration) time.Duration {
+	best, bestErr := from+(to-from)/2, math.Inf(1)
+	for offset := from; offset <= to; offset += step {
+		c := measureError(samples, reference, offset)
+		if float64(c.Samples) < compareMinOverlap*float64(len(samples)) {
+			continue
+		}
+		if c.Angle.Mean < bestErr {
+			best, bestErr = offset, c.Angle.Mean
+		}
+	}
+	return best
+}
+
+// measureError compares each sample, moved by offset, with the reference
+// interpolated at its time
+func measureError(samples, reference []compareSample, offset time.Duration) comparison {
+	c := comparison{OffsetMS: float64(offset) / float64(time.Millisecond)}
+	var sums [4]struct{ sum, sq float64 }
+	stats := []*errorStats{&c.Angle, &c.Roll, &c.Pitch, &c.Yaw}
+	j := 0
+	for _, s := range samples {
+		t := s.t.Add(offset)
+		for j+1 < len(reference) && !reference[j+1].t.After(t) {
+			j++
+		}
+		if j+1 >= len(reference) || t.Before(reference[j].t) || reference[j+1].t.Sub(reference[j].t) > compareMaxGap {
+			c.Unmatched++
+			continue
+		}
+		a, b := reference[j], reference[j+1]
+		ref := a.q
+		if span := b.t.Sub(a.t); span > 0 {
+			qa, okA := quat.Normalize(a.q)
+			qb, okB := quat.Normalize(b.q)
+			if okA && okB {
+				ref = quat.Slerp(qa, qb, float64(t.Sub(a.t))/float64(span))
+			}
+		}
+
+		q, ok := quat.Normalize(s.q)
+		ref, okRef := quat.Normalize(ref)
+		if !ok || !okRef {
+			c.Unmatched++
+			continue
+		}
+		angle := quat.Angle(ref, q)
+		e, r := quat.ToEuler(q, quat.Degrees), quat.ToEuler(ref, quat.Degrees)
+		errs := []float64{angle, wrapDegrees(e.Roll - r.Roll), wrapDegrees(e.Pitch - r.Pitch), wrapDegrees(e.Yaw - r.Yaw)}
+
+		if c.Samples == 0 {
+			c.Start = s.origin
+		}
+		c.End = s.origin
+		c.Samples++
+		for i, v := range errs {
+			v = math.Abs(v)
+			sums[i].sum += v
+			sums[i].sq += v * v
+			if v > stats[i].Max || c.Samples == 1 {
+				stats[i].Max, stats[i].MaxAt = v, s.origin
+			}
+		}
+	}
+	if c.Samples > 0 {
+		for i, st := range stats {
+			st.Mean = sums[i].sum / float64(c.Samples)
+			st.RMSE = math.Sqrt(sums[i].sq / float64(c.Samples))
+		}
+	}
+	return c
+}
+
+// wrapDegrees wraps an angle difference into [-180, 180)
+func wrapDegrees(d float64) float64 {
+	d = math.Mod(d+180, 360)
+	if d < 0 {
+		d += 360
+	}
+	return d - 180
+}
+
+// runCompare compares a recording with a reference, such as a motion
+// capture system, and prints the angular error. With one recording, two of
+// its devices are compared. It returns the process exit code.
+func runCompare() int {
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		fmt.Fprintln(os.Stderr, "usage: quatplot compare [flags] RECORDING [REFERENCE]")
+		return 2
+	}
+	if _, err := initConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 1
+	}
+	path, refPath := flag.Arg(0), flag.Arg(1)
+	if refPath == "" {
+		if *compareDevice == "" || *referenceDevice == "" {
+			fmt.Fprintln(os.Stderr, "comparing two devices of one recording needs -compare-device and -reference-device")
+			return 2
+		}
+		refPath = path
+	}
+
+	samples, err := loadCompareSamples(path, *compareDevice, time.Time{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	reference, err := loadCompareSamples(refPath, *referenceDevice, time.Time{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	c, err := compareRecordings(samples, reference, *timeOffset, *offsetSearch)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *compareJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(c)
+		return 0
+	}
+	fmt.Printf("Compared %d samples from %s to %s, %d unmatched\n", c.Samples, c.Start.Format(time.RFC3339Nano), c.End.Format(time.RFC3339Nano), c.Unmatched)
+	fmt.Printf("Aligned on %s, offset %.1f ms\n\n", c.TimeBasis, c.OffsetMS)
+	fmt.Printf("%-6s %9s %9s %9s  %s\n", "error", "rmse", "mean", "max", "max at")
+	for _, row := range []struct {
+		name string
+		st   errorStats
+	}{{"angle", c.Angle}, {"roll", c.Roll}, {"pitch", c.Pitch}, {"yaw", c.Yaw}} {
+		fmt.Printf("%-6s %8.3f° %8.3f° %8.3f°  %s\n", row.name, row.st.RMSE, row.st.Mean, row.st.Max, row.st.MaxAt.Format(time.RFC3339Nano))
+	}
+	return 0
+}
+
+// handleRecordingCompare compares two devices in the recording, e.g. a
+// sensor and a reference system read side by side
+func handleRecordingCompare(w http.ResponseWriter, r *http.Request) {
+	if *recordPath == "" {
+		http.Error(w, "not recording", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	device, reference := q.Get("device"), q.Get("reference")
+	if !q.Has("device") || !q.Has("reference") {
+		http.Error(w, "device and reference are required", http.StatusBadRequest)
+		return
+	}
+	var session time.Time
+	if s := q.Get("session"); s != "" {
+		var err error
+		if session, err = time.Parse(summaryStamp, s); err != nil {
+			http.Error(w, "invalid session", http.StatusBadRequest)
+			return
+		}
+	}
+	var offset, search time.Duration
+	for _, p := range []struct {
+		name string
+		dst  *time.Duration
+	}{{"offset", &offset}, {"search", &search}} {
+		if s := q.Get(p.name); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %v", p.name, err), http.StatusBadRequest)
+				return
+			}
+			*p.dst = d
+		}
+	}
+	if search < 0 || search > time.Minute {
+		http.Error(w, "search must be between 0 and 1m", http.StatusBadRequest)
+		return
+	}
+
+	samples, err := loadCompareSamples(*recordPath, device, session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	refSamples, err := loadCompareSamples(*recordPath, reference, session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	c, err := compareRecordings(samples, refSamples, offset, search)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+// Config holds the settings persisted to the configuration file
+type Config struct {
+	Source        string  `json:"source,omitempty"`  // Kind of input, "serial" when empty
+	Listen        string  `json:"listen,omitempty"`  // Address network sources listen on, e.g. ":9000"
+	Connect       string  `json:"connect,omitempty"` // Address tcp-connect dials, e.g. "gateway:7777"
+	File          string  `json:"file,omitempty"`    // Recording the file source plays back
+	Port          string  `json:"port"`
+	Baud          int     `json:"baud"`
+	Order         string  `json:"order"`                    // Component order of incoming lines, e.g. "i,j,k,real"
+	Protocol      string  `json:"protocol,omitempty"`       // How samples are sent, "text" lines or "binary" packets
+	Format        string  `json:"format,omitempty"`         // Layout of incoming lines, overrides Order, e.g. "w x y z"
+	Input         string  `json:"input,omitempty"`          // What lines hold, "quaternion" or "euler"
+	EulerUnits    string  `json:"euler_units,omitempty"`    // Units of Euler angle input, "deg" or "rad"
+	EulerOrder    string  `json:"euler_order,omitempty"`    // Rotation order of Euler angle input, e.g. "ZYX"
+	AHRS          string  `json:"ahrs,omitempty"`           // Sensor fusion filter for imu input, "madgwick" or "mahony"
+	GyroUnits     string  `json:"gyro_units,omitempty"`     // Units of gyroscope rates in imu input, "deg" or "rad"
+	IMURate       float64 `json:"imu_rate,omitempty"`       // Sample rate of imu input in Hz, 0 to measure it
+	AngleUnits    string  `json:"angle_units,omitempty"`    // Units of derived angles, "deg" or "rad"
+	AngleOrder    string  `json:"angle_order,omitempty"`    // Rotation order of the Euler angles sent, e.g. "ZYX"
+	Vectors       string  `json:"vectors,omitempty"`        // Derived vectors sent with samples, e.g. "gravity,heading"
+	QuatKeys      string  `json:"quat_keys,omitempty"`      // Keys of quaternion components sent, "ijk" or "wxyz"
+	Remap         string  `json:"remap,omitempty"`          // Axes of the sensor each axis is taken from, e.g. "x:-y,y:z,z:x"
+	Mount         string  `json:"mount,omitempty"`          // Roll,pitch,yaw of the sensor on the body in degrees, taken out of samples
+	HeadingOffset float64 `json:"heading_offset,omitempty"` // Degrees added to the yaw of samples
+	Smoothing     float64 `json:"smoothing,omitempty"`      // Time constant of the orientation low-pass filter, seconds
+	Convention    string  `json:"convention,omitempty"`     // Quaternion convention of the sensor, "hamilton" or "jpl"
+	Frame         string  `json:"frame,omitempty"`          // Reference frame of the sensor, e.g. "enu"
+	// SmoothMethod is the low-pass filter of Smoothing, "exponential" or "window"
+	SmoothMethod string `json:"smoothing_method,omitempty"`
+
+	Streams map[string]StreamDisplay `json:"streams,omitempty"` // Display settings of each device's stream, by ID
+
+	Welcome json.RawMessage `json:"welcome,omitempty"` // Sent to clients in the session message, any JSON value
+
+	EncryptionKeyFile string `json:"encryption_key_file,omitempty"` // File holding the key for encrypting data at rest
+
+	Storage string `json:"storage,omitempty"` // Where history and finished recordings are kept, e.g. "s3://lab/quatplot"
+
+	Tenants map[string]TenantConfig `json:"tenants,omitempty"` // Independent namespaces served under /t/{name}/
+
+	// Flags sets other command-line flags by name, e.g. "web" or "record",
+	// unless they are given on the command line or in the environment
+	Flags map[string]flagSetting `json:"flags,omitempty"`
+
+	preview *previewBuffer // Where sources record raw lines, set by the namespace
+}
+
+// previewBuffer returns the buffer raw lines read with the configuration are
+// recorded in, a throwaway one when it isn't tied to a namespace
+func (cfg Config) previewBuffer() *previewBuffer {
+	if cfg.preview == nil {
+		return newPreviewBuffer(previewCapacity)
+	}
+	return cfg.preview
+}
+
+const defaultOrder = "i,j,k,real"
+
+// inputFormat returns the layout of incoming lines: the format when one is
+// set, otherwise roll,pitch,yaw for Euler angles, the nine elements of a
+// matrix by rows, and the component order for quaternions
+func (cfg Config) inputFormat() string {
+	if cfg.Format != "" {
+		return cfg.Format
+	}
+	switch cfg.inputKind() {
+	case inputEuler:
+		return defaultEulerFormat
+	case inputMatrix:
+		return defaultMatrixFormat
+	case inputIMU:
+		return defaultIMUFormat
+	}
+	return cfg.Order
+}
+
+// inputKind returns what incoming lines hold, quaternions unless the input
+// setting says otherwise
+func (cfg Config) inputKind() string {
+	input, err := parseInputMode(cfg.Input)
+	if err != nil {
+		return inputQuaternion
+	}
+	return input
+}
+
+// protocol returns how samples are sent, text lines unless the protocol
+// setting says otherwise
+func (cfg Config) protocol() string {
+	p, err := parseProtocol(cfg.Protocol)
+	if err != nil {
+		return protocolText
+	}
+	return p
+}
+
+// eulerUnits returns the units of Euler angle input, degrees by default
+func (cfg Config) eulerUnits() string {
+	if cfg.EulerUnits == "" {
+		return quat.Degrees
+	}
+	return cfg.EulerUnits
+}
+
+// gyroUnits returns the units of gyroscope rates in imu input, degrees per
+// second by default
+func (cfg Config) gyroUnits() string {
+	if cfg.GyroUnits == "" {
+		return quat.Degrees
+	}
+	return cfg.GyroUnits
+}
+
+// eulerOrder returns the rotation order of Euler angle input, ZYX by default
+func (cfg Config) eulerOrder() string {
+	if cfg.EulerOrder == "" {
+		return defaultEulerOrder
+	}
+	return cfg.EulerOrder
+}
+
+// angleOrder returns the rotation order of the Euler angles sent to
+// clients, ZYX by default
+func (cfg Config) angleOrder() string {
+	if cfg.AngleOrder == "" {
+		return quat.DefaultOrder
+	}
+	return cfg.AngleOrder
+}
+
+var (
+	angleUnits = flag.String("angle-units", quat.Degrees, "Units of derived angles sent to clients (deg or rad)")
+	angleOrder = flag.String("angle-order", quat.DefaultOrder, "Rotation order of the Euler angles sent to clients, intrinsic axes applied left to right, e.g. ZYX for yaw, then pitch, then roll")
+
+	config      Config
+	configMutex sync.RWMutex
+)
+
+// currentConfig returns a copy of the active configuration
+func currentConfig() Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config
+}
+
+// setConfig replaces the active configuration
+func setConfig(cfg Config) {
+	configMutex.Lock()
+	config = cfg
+	configMutex.Unlock()
+}
+
+// loadConfig reads and validates a configuration file, in JSON, YAML or
+// TOML. A missing file is reported with an error satisfying
+// errors.Is(err, fs.ErrNotExist), invalid settings with a configErrors
+// listing each of them.
+func loadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg, errs := validateConfigFile(path, data)
+	if len(errs) > 0 {
+		return cfg, fmt.Errorf("%s: %w", path, errs)
+	}
+	return cfg, nil
+}
+
+// saveConfig writes the configuration atomically by renaming a temporary
+// file, in the format of the file
+func saveConfig(path string, cfg Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err == nil {
+		data, err = formatConfigData(path, data)
+	}
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".quatplot-*"+filepath.Ext(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// flagDefaultConfig returns the settings the flags give, those of a config
+// file that leaves them all out
+func flagDefaultConfig() Config {
+	return Config{
+		Source:        *sourceKind,
+		Listen:        *listenAddr,
+		Connect:       *connectAddr,
+		File:          *replayFile,
+		Port:          portName.text,
+		Baud:          *baudRate,
+		Order:         defaultOrder,
+		Protocol:      *protocol,
+		Format:        *inputFormatSpec,
+		Input:         *inputMode,
+		EulerUnits:    *eulerUnits,
+		EulerOrder:    *eulerOrder,
+		AHRS:          *ahrsName,
+		GyroUnits:     *gyroUnits,
+		IMURate:       *imuRate,
+		AngleUnits:    *angleUnits,
+		AngleOrder:    *angleOrder,
+		Vectors:       *derivedVectors,
+		QuatKeys:      *quatKeys,
+		Remap:         *axisRemapping,
+		Mount:         *mountOffset,
+		HeadingOffset: *headingOffset,
+		Smoothing:     *smoothing,
+		SmoothMethod:  *smoothMethod,
+		Convention:    *inputConvention,
+		Frame:         *referenceFrame,
+
+		EncryptionKeyFile: *encryptionKeyFile,
+		Storage:           *storageSpec,
+		Welcome:           welcomePayload(*welcomeMessage),
+	}
+}
+
+// initConfig builds the startup configuration from the config file and the
+// command line. Flags given explicitly or in the environment override values
+// from the file, which can also set other flags in its flags section. It
+// reports whether the first-run setup wizard should be offered, which is the
+// case when no config file exists and no port was given on the command line.
+func initConfig() (needsSetup bool, err error) {
+	cfg := flagDefaultConfig()
+
+	fileCfg, err := loadConfig(*configPath)
+	switch {
+	case err == nil:
+		if fileCfg.Source != "" {
+			cfg.Source = fileCfg.Source
+		}
+		if fileCfg.Listen != "" {
+			cfg.Listen = fileCfg.Listen
+		}
+		if fileCfg.Connect != "" {
+			cfg.Connect = fileCfg.Connect
+		}
+		if fileCfg.File != "" {
+			cfg.File = fileCfg.File
+		}
+		if fileCfg.Port != "" {
+			cfg.Port = fileCfg.Port
+		}
+		if fileCfg.Baud != 0 {
+			cfg.Baud = fileCfg.Baud
+		}
+		if fileCfg.Order != "" {
+			cfg.Order = fileCfg.Order
+		}
+		if fileCfg.Protocol != "" {
+			cfg.Protocol = fileCfg.Protocol
+		}
+		if fileCfg.Format != "" {
+			cfg.Format = fileCfg.Format
+		}
+		if fileCfg.Input != "" {
+			cfg.Input = fileCfg.Input
+		}
+		if fileCfg.EulerUnits != "" {
+			cfg.EulerUnits = fileCfg.EulerUnits
+		}
+		if fileCfg.EulerOrder != "" {
+			cfg.EulerOrder = fileCfg.EulerOrder
+		}
+		if fileCfg.AHRS != "" {
+			cfg.AHRS = fileCfg.AHRS
+		}
+		if fileCfg.GyroUnits != "" {
+			cfg.GyroUnits = fileCfg.GyroUnits
+		}
+		if fileCfg.IMURate != 0 {
+			cfg.IMURate = fileCfg.IMURate
+		}
+		if fileCfg.AngleUnits != "" {
+			cfg.AngleUnits = fileCfg.AngleUnits
+		}
+		if fileCfg.AngleOrder != "" {
+			cfg.AngleOrder = fileCfg.AngleOrder
+		}
+		if fileCfg.Vectors != "" {
+			cfg.Vectors = fileCfg.Vectors
+		}
+		if fileCfg.QuatKeys != "" {
+			cfg.QuatKeys = fileCfg.QuatKeys
+		}
+		if fileCfg.Remap != "" {
+			cfg.Remap = fileCfg.Remap
+		}
+		if fileCfg.Mount != "" {
+			cfg.Mount = fileCfg.Mount
+		}
+		if fileCfg.HeadingOffset != 0 {
+			cfg.HeadingOffset = fileCfg.HeadingOffset
+		}
+		if fileCfg.Smoothing != 0 {
+			cfg.Smoothing = fileCfg.Smoothing
+		}
+		if fileCfg.SmoothMethod != "" {
+			cfg.SmoothMethod = fileCfg.SmoothMethod
+		}
+		if fileCfg.Convention != "" {
+			cfg.Convention = fileCfg.Convention
+		}
+		if fileCfg.Frame != "" {
+			cfg.Frame = fileCfg.Frame
+		}
+		if fileCfg.EncryptionKeyFile != "" {
+			cfg.EncryptionKeyFile = fileCfg.EncryptionKeyFile
+		}
+		if fileCfg.Storage != "" {
+			cfg.Storage = fileCfg.Storage
+		}
+		if len(fileCfg.Welcome) > 0 {
+			cfg.Welcome = fileCfg.Welcome
+		}
+		cfg.Streams = fileCfg.Streams
+		cfg.Tenants = fileCfg.Tenants
+		cfg.Flags = fileCfg.Flags
+		if err := applyFileFlags(fileCfg.Flags); err != nil {
+			return false, fmt.Errorf("%s: %v", *configPath, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		needsSetup = true
+	default:
+		return false, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "source":
+			cfg.Source = *sourceKind
+		case "listen":
+			cfg.Listen = *listenAddr
+		case "connect":
+			cfg.Connect = *connectAddr
+		case "file":
+			cfg.File = *replayFile
+		case "simulate":
+			if *simulate {
+				cfg.Source = "simulate"
+			}
+		case "port":
+			cfg.Port = portName.text
+			needsSetup = false
+		case "baud":
+			cfg.Baud = *baudRate
+		case "protocol":
+			cfg.Protocol = *protocol
+		case "format":
+			cfg.Format = *inputFormatSpec
+		case "input":
+			cfg.Input = *inputMode
+		case "euler-units":
+			cfg.EulerUnits = *eulerUnits
+		case "euler-order":
+			cfg.EulerOrder = *eulerOrder
+		case "ahrs":
+			cfg.AHRS = *ahrsName
+		case "gyro-units":
+			cfg.GyroUnits = *gyroUnits
+		case "imu-rate":
+			cfg.IMURate = *imuRate
+		case "angle-units":
+			cfg.AngleUnits = *angleUnits
+		case "angle-order":
+			cfg.AngleOrder = *angleOrder
+		case "vectors":
+			cfg.Vectors = *derivedVectors
+		case "quat-keys":
+			cfg.QuatKeys = *quatKeys
+		case "remap":
+			cfg.Remap = *axisRemapping
+		case "mount":
+			cfg.Mount = *mountOffset
+		case "heading-offset":
+			cfg.HeadingOffset = *headingOffset
+		case "smoothing":
+			cfg.Smoothing = *smoothing
+		case "smoothing-method":
+			cfg.SmoothMethod = *smoothMethod
+		case "convention":
+			cfg.Convention = *inputConvention
+		case "frame":
+			cfg.Frame = *referenceFrame
+		case "encryption-key-file":
+			cfg.EncryptionKeyFile = *encryptionKeyFile
+		case "storage":
+			cfg.Storage = *storageSpec
+		case "welcome":
+			cfg.Welcome = welcomePayload(*welcomeMessage)
+		}
+	})
+
+	if len(streamFlags.streams) > 0 {
+		// Streams given as flags replace those of the same ID in the file
+		streams := make(map[string]StreamDisplay, len(cfg.Streams)+len(streamFlags.streams))
+		for id, d := range cfg.Streams {
+			streams[id] = d
+		}
+		for id, d := range streamFlags.streams {
+			streams[id] = d
+		}
+		cfg.Streams = streams
+	}
+
+	if cfg.Source != "serial" {
+		// Only serial ports are picked in the setup wizard
+		needsSetup = false
+	}
+	if err := checkConfig(&cfg); err != nil {
+		return false, err
+	}
+	if encryptionKey, err = loadEncryptionKey(cfg.EncryptionKeyFile); err != nil {
+		return false, fmt.Errorf("loading encryption key: %v", err)
+	}
+
+	setConfig(cfg)
+	return needsSetup, nil
+}
+
+// checkConfig checks the settings of a configuration that the file's
+// validation can't, such as those given as flags, and normalizes their names
+func checkConfig(cfg *Config) error {
+	var err error
+	if cfg.AngleUnits, err = quat.ParseUnits(cfg.AngleUnits); err != nil {
+		return err
+	}
+	if cfg.AngleOrder, err = quat.ParseOrder(cfg.angleOrder()); err != nil {
+		return err
+	}
+	if _, err := parseVectors(cfg.Vectors); err != nil {
+		return err
+	}
+	if cfg.QuatKeys, err = parseQuatKeys(cfg.QuatKeys); err != nil {
+		return err
+	}
+	if _, err := parseRemap(cfg.Remap); err != nil {
+		return err
+	}
+	if _, err := parseMount(cfg.Mount); err != nil {
+		return err
+	}
+	if cfg.Smoothing < 0 {
+		return fmt.Errorf("invalid smoothing %g, must not be negative", cfg.Smoothing)
+	}
+	if cfg.SmoothMethod, err = parseSmoothMethod(cfg.SmoothMethod); err != nil {
+		return err
+	}
+	if err := checkStreams(cfg.Streams); err != nil {
+		return err
+	}
+	if cfg.Convention, err = parseConvention(cfg.Convention); err != nil {
+		return err
+	}
+	if cfg.Frame, err = parseFrame(cfg.Frame); err != nil {
+		return err
+	}
+	if cfg.Protocol, err = parseProtocol(cfg.Protocol); err != nil {
+		return err
+	}
+	if cfg.Input, err = parseInputMode(cfg.Input); err != nil {
+		return err
+	}
+	if cfg.IMURate < 0 {
+		return fmt.Errorf("invalid imu rate %g, must not be negative", cfg.IMURate)
+	}
+	if _, err := cfg.checkLineFormat(); err != nil {
+		return err
+	}
+	if err := validateOutlierAction(*outlierAction); err != nil {
+		return err
+	}
+	if err := checkStorage(cfg.Storage); err != nil {
+		return err
+	}
+	return nil
+}
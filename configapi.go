@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// redacted replaces secrets in the configuration returned by /api/config.
+// Given back in a PUT, it keeps the secret that is set.
+const redacted = "<redacted>"
+
+// secretFlags are the flags of a config file's flags section whose values
+// are secrets
+var secretFlags = map[string]bool{"password": true, "influx-token": true, "tui-token": true, "fleet-token": true}
+
+// restartSettings are the settings that only take effect when the server
+// is restarted
+var restartSettings = map[string]bool{"flags": true}
+
+// importableFlags are the flags of a config file's flags section that PUT
+// /api/config may change: those of the input, its processing and what
+// clients are sent. Flags that run commands, name files or directories,
+// listen or connect elsewhere, or decide who may connect are changed by
+// editing the config file on the server.
+var importableFlags = map[string]bool{
+	"ahrs-beta": true, "ahrs-ki": true, "ahrs-kp": true,
+	"backfill-on-connect": true, "bno-rate": true, "client-protocol": true,
+	"default-model": true, "fence": true, "fence-debounce": true,
+	"gyro-bias-still": true, "handshake-timeout": true, "history": true,
+	"idle-heartbeat": true, "jitter-window": true, "log-attitude": true,
+	"max-rate": true, "outlier-action": true, "outlier-angle": true,
+	"packet-checksum": true, "packet-endian": true, "packet-float": true,
+	"packet-sync": true, "ping-interval": true, "presenter-rate": true,
+	"reconnect-attempts": true, "settle-rate": true, "settle-time": true,
+	"settle-timeout": true, "sim-accel-noise": true, "sim-axis": true,
+	"sim-gyro-bias": true, "sim-gyro-noise": true, "sim-mag-noise": true,
+	"sim-motion": true, "sim-rate": true, "sim-speed": true, "sim-truth": true,
+	"speed": true, "still-threshold": true, "watchdog": true, "write-timeout": true,
+}
+
+// serverSettings are the settings that name files or directories, listen
+// or connect elsewhere, or decide who may connect, which an import can't
+// change either
+var serverSettings = []string{"source", "listen", "connect", "file", "storage", "encryption_key_file", "tenants"}
+
+// configApplyInfo reports what a PUT /api/config changed
+type configApplyInfo struct {
+	DryRun          bool     `json:"dry_run,omitempty"`
+	Saved           string   `json:"saved,omitempty"`            // Config file written
+	Applied         []string `json:"applied"`                    // Settings now in effect
+	Pinned          []string `json:"pinned,omitempty"`           // Settings kept as the command line or environment gives them
+	RestartRequired []string `json:"restart_required,omitempty"` // Settings in effect once the server restarts
+}
+
+// handleConfig exports the running configuration with GET /api/config, its
+// secrets redacted, and imports one with PUT /api/config. An import is
+// checked like check-config, then saved to the config file and applied:
+// input and display settings at once, restarting the sources, and the
+// others with the next restart. ?dry_run=1 only checks it and reports what
+// would change. Both carry an ETag, which If-Match can require to be
+// unchanged so that two scripts don't overwrite each other's changes.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	if requestNamespace(r) != defaultNamespace {
+		http.Error(w, "the configuration is the server's, tenants can't read or change it", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		cfg := currentConfig()
+		w.Header().Set("ETag", configETag(cfg))
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(redactConfig(cfg))
+	case http.MethodPut:
+		importConfig(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// importConfig checks, saves and applies the configuration of a PUT
+func importConfig(w http.ResponseWriter, r *http.Request) {
+	if inSetupMode() {
+		http.Error(w, "finish the setup wizard at /setup first", http.StatusConflict)
+		return
+	}
+	var data json.RawMessage
+	if !decodeJSONBody(w, r, &data) {
+		return
+	}
+	running := currentConfig()
+	if match := r.Header.Get("If-Match"); match != "" && match != configETag(running) {
+		http.Error(w, "the configuration changed since it was read", http.StatusPreconditionFailed)
+		return
+	}
+
+	next, errs := validateConfigData(data)
+	if len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(struct {
+			Errors []string `json:"errors"`
+		}{configErrorList(errs)})
+		return
+	}
+	restoreSecrets(&next, running)
+	if errs := checkImportable(next, running); len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(struct {
+			Errors []string `json:"errors"`
+		}{errs})
+		return
+	}
+
+	cfg, info, err := mergeRunningConfig(running, next)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(struct {
+			Errors []string `json:"errors"`
+		}{[]string{err.Error()}})
+		return
+	}
+
+	if r.URL.Query().Get("dry_run") == "1" {
+		info.DryRun = true
+	} else {
+		if err := saveConfig(*configPath, next); err != nil {
+			log.Printf("Error saving config: %v", err)
+			http.Error(w, "saving config: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		info.Saved = *configPath
+		log.Printf("Imported a configuration into %s, applied %s", *configPath, describeSettings(info.Applied))
+		if len(info.RestartRequired) > 0 {
+			log.Printf("Restart to apply %s", describeSettings(info.RestartRequired))
+		}
+		if len(info.Applied) > 0 {
+			defaultNamespace.announceRestart("config", time.Second)
+			setConfig(cfg)
+			restartSources()
+		}
+	}
+
+	w.Header().Set("ETag", configETag(currentConfig()))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// mergeRunningConfig returns the running configuration with the settings a
+// new config file changes, except those the command line or environment
+// gives and those that need a restart, which are listed. As at startup,
+// settings the file leaves out take the defaults of their flags.
+func mergeRunningConfig(running, next Config) (Config, configApplyInfo, error) {
+	info := configApplyInfo{Applied: []string{}}
+	pinned := givenFlags()
+	for key := range running.Flags {
+		// Set by the config file, not the command line
+		delete(pinned, strings.ReplaceAll(key, "_", "-"))
+	}
+	pinned["source"] = pinned["source"] || pinned["simulate"]
+	pinned["streams"] = len(streamFlags.streams) > 0
+
+	wanted := flagDefaultConfig()
+	want := reflect.ValueOf(&wanted).Elem()
+	src := reflect.ValueOf(next)
+	t := want.Type()
+	for idx := 0; idx < t.NumField(); idx++ {
+		f := src.Field(idx)
+		if jsonName(t.Field(idx)) != "" && !f.IsZero() && !(f.Kind() == reflect.Map && f.Len() == 0) {
+			want.Field(idx).Set(f)
+		}
+	}
+	if err := checkConfig(&wanted); err != nil {
+		return running, info, err
+	}
+
+	merged := running
+	dst := reflect.ValueOf(&merged).Elem()
+	for idx := 0; idx < t.NumField(); idx++ {
+		name := jsonName(t.Field(idx))
+		if name == "" || reflect.DeepEqual(dst.Field(idx).Interface(), want.Field(idx).Interface()) {
+			continue
+		}
+		switch {
+		case restartSettings[name]:
+			info.RestartRequired = append(info.RestartRequired, name)
+		case pinned[strings.ReplaceAll(name, "_", "-")]:
+			info.Pinned = append(info.Pinned, name)
+		default:
+			dst.Field(idx).Set(want.Field(idx))
+			info.Applied = append(info.Applied, name)
+		}
+	}
+	// The pinned settings may not go with the others
+	return merged, info, checkConfig(&merged)
+}
+
+// checkImportable returns a problem for each setting an imported
+// configuration changes that only the config file on the server may: flags
+// other than importableFlags, which it may neither add, change nor remove,
+// and serverSettings, which it may neither change nor leave out. Those it
+// gives as they run are kept, so that an exported configuration can be
+// imported back.
+func checkImportable(next, running Config) []string {
+	byName := func(flags map[string]flagSetting) map[string]flagSetting {
+		named := make(map[string]flagSetting, len(flags))
+		for key, value := range flags {
+			named[strings.ReplaceAll(key, "_", "-")] = value
+		}
+		return named
+	}
+	nextFlags, runningFlags := byName(next.Flags), byName(running.Flags)
+	names := make([]string, 0, len(nextFlags)+len(runningFlags))
+	for name := range nextFlags {
+		names = append(names, name)
+	}
+	for name := range runningFlags {
+		if _, ok := nextFlags[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var errs []string
+	for _, name := range names {
+		value, given := nextFlags[name]
+		if importableFlags[name] || value == runningFlags[name] {
+			continue
+		}
+		change := "changed"
+		if !given {
+			change = "removed"
+		}
+		errs = append(errs, fmt.Sprintf("flags.%s: can't be %s through /api/config, edit %s on the server", name, change, *configPath))
+	}
+
+	// Settings left out take the defaults of their flags
+	want, have, defaults := reflect.ValueOf(next), reflect.ValueOf(running), reflect.ValueOf(flagDefaultConfig())
+	t := want.Type()
+	for idx := 0; idx < t.NumField(); idx++ {
+		name := jsonName(t.Field(idx))
+		if !containsString(serverSettings, name) {
+			continue
+		}
+		value, change := want.Field(idx), "changed"
+		if value.IsZero() || (value.Kind() == reflect.Map && value.Len() == 0) {
+			value, change = defaults.Field(idx), "removed"
+		}
+		if !sameSetting(value, have.Field(idx)) {
+			errs = append(errs, fmt.Sprintf("%s: can't be %s through /api/config, edit %s on the server", name, change, *configPath))
+		}
+	}
+	return errs
+}
+
+// sameSetting reports whether two values of a setting are the same, an
+// empty map being the same as none
+func sameSetting(a, b reflect.Value) bool {
+	if a.Kind() == reflect.Map && a.Len() == 0 && b.Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// redactConfig returns a copy of the configuration without its secrets:
+// the passwords of tenants, secret flags and passwords in URLs
+func redactConfig(cfg Config) Config {
+	if cfg.Tenants != nil {
+		tenants := make(map[string]TenantConfig, len(cfg.Tenants))
+		for name, t := range cfg.Tenants {
+			if t.Password != "" {
+				t.Password = redacted
+			}
+			tenants[name] = t
+		}
+		cfg.Tenants = tenants
+	}
+	if cfg.Flags != nil {
+		flags := make(map[string]flagSetting, len(cfg.Flags))
+		for key, value := range cfg.Flags {
+			switch {
+			case secretFlags[strings.ReplaceAll(key, "_", "-")]:
+				value = redacted
+			default:
+				value = flagSetting(redactURL(string(value)))
+			}
+			flags[key] = value
+		}
+		cfg.Flags = flags
+	}
+	cfg.Storage = redactURL(cfg.Storage)
+	return cfg
+}
+
+// redactURL hides the password of a URL, returning anything else as it is
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	u.User = url.UserPassword(u.User.Username(), redacted)
+	return strings.Replace(u.String(), url.QueryEscape(redacted), redacted, 1)
+}
+
+// restoreSecrets puts back the secrets of the running configuration that an
+// imported one gives as redacted
+func restoreSecrets(next *Config, running Config) {
+	for name, t := range next.Tenants {
+		if t.Password == redacted {
+			t.Password = running.Tenants[name].Password
+			next.Tenants[name] = t
+		}
+	}
+	for key, value := range next.Flags {
+		if strings.Contains(string(value), redacted) {
+			next.Flags[key] = running.Flags[key]
+		}
+	}
+	if strings.Contains(next.Storage, redacted) {
+		next.Storage = running.Storage
+	}
+}
+
+// configETagKey keys the ETags of configurations. It is random and only
+// known to this process, so that an ETag tells nothing of the secrets it
+// covers.
+var configETagKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// configETag identifies a configuration, secrets and all, with an HMAC that
+// changes when the server restarts
+func configETag(cfg Config) string {
+	data, _ := json.Marshal(cfg)
+	mac := hmac.New(sha256.New, configETagKey)
+	mac.Write(data)
+	return `"` + hex.EncodeToString(mac.Sum(nil)[:8]) + `"`
+}
+
+// configErrorList returns each problem of a configuration as text
+func configErrorList(errs configErrors) []string {
+	list := make([]string, len(errs))
+	for idx, e := range errs {
+		list[idx] = e.Error()
+	}
+	return list
+}
+
+// describeSettings lists the names of settings for the log
+func describeSettings(names []string) string {
+	if len(names) == 0 {
+		return "nothing"
+	}
+	return strings.Join(names, ", ")
+}
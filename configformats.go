@@ -0,0 +1,897 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Formats of configuration files, told apart by their extension
+const (
+	configJSON = "json"
+	configYAML = "yaml"
+	configTOML = "toml"
+)
+
+// configFileFormat returns the format of a configuration file: YAML for
+// .yaml and .yml files, TOML for .toml files, otherwise JSON
+func configFileFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return configYAML
+	case ".toml":
+		return configTOML
+	}
+	return configJSON
+}
+
+// configJSONData converts a YAML or TOML configuration file to JSON, so that
+// it is decoded and checked like a JSON one
+func configJSONData(path string, data []byte) ([]byte, error) {
+	var v any
+	var err error
+	switch configFileFormat(path) {
+	case configYAML:
+		v, err = parseYAML(string(data))
+	case configTOML:
+		v, err = parseTOML(string(data))
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		// An empty file sets nothing
+		v = map[string]any{}
+	}
+	return json.Marshal(v)
+}
+
+// formatConfigData converts the JSON of a configuration to the format of
+// the file it is saved to
+func formatConfigData(path string, data []byte) ([]byte, error) {
+	format := configFileFormat(path)
+	if format == configJSON {
+		return data, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeOrdered(dec)
+	if err != nil {
+		return nil, err
+	}
+	entries, ok := v.([]configEntry)
+	if !ok {
+		return nil, errors.New("expected an object of settings")
+	}
+	var b strings.Builder
+	if format == configYAML {
+		writeYAML(&b, entries, 0)
+	} else if err := writeTOML(&b, entries, nil); err != nil {
+		return nil, err
+	}
+	// saveConfig ends the file with a newline
+	return []byte(strings.TrimSuffix(b.String(), "\n")), nil
+}
+
+// YAML
+
+// yamlLine is a line of a YAML file holding something
+type yamlLine struct {
+	num    int
+	indent int
+	text   string // Without the indentation and comment
+}
+
+// yamlParser reads the subset of YAML configuration files need: nested
+// mappings and sequences, flow collections, quoted and plain scalars, and
+// comments. Anchors, tags and multi-line strings aren't supported.
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func parseYAML(data string) (any, error) {
+	p := &yamlParser{}
+	for n, raw := range strings.Split(data, "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, YAML doesn't allow tabs", n+1)
+		}
+		text = strings.TrimSpace(stripComment(text, true))
+		if text == "" || text == "---" || text == "..." || strings.HasPrefix(text, "%") {
+			continue
+		}
+		p.lines = append(p.lines, yamlLine{num: n + 1, indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	first := p.lines[0]
+	if !isYAMLItem(first.text) {
+		if _, _, ok := splitYAMLKey(first.text); !ok {
+			// A document of a single value
+			if len(p.lines) > 1 {
+				return nil, fmt.Errorf("line %d: expected key: value", first.num)
+			}
+			v, err := yamlValue(first.text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", first.num, err)
+			}
+			return v, nil
+		}
+	}
+	v, err := p.block(first.indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return v, nil
+}
+
+// block reads the mapping or sequence starting at the current line
+func (p *yamlParser) block(indent int) (any, error) {
+	if isYAMLItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := map[string]any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent || l.indent == indent && isYAMLItem(l.text) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		key, rest, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", l.num)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: %s is set twice", l.num, key)
+		}
+		p.pos++
+		var v any
+		var err error
+		switch {
+		case rest != "":
+			if v, err = yamlValue(rest); err != nil {
+				return nil, fmt.Errorf("line %d: %v", l.num, err)
+			}
+		case p.pos < len(p.lines):
+			// The value is the block below, a sequence may also be level
+			// with the key
+			next := p.lines[p.pos]
+			if next.indent > indent || next.indent == indent && isYAMLItem(next.text) {
+				if v, err = p.block(next.indent); err != nil {
+					return nil, err
+				}
+			}
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	list := []any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent || l.indent == indent && !isYAMLItem(l.text) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		rest := strings.TrimSpace(l.text[1:])
+		var v any
+		var err error
+		if _, _, isKey := splitYAMLKey(rest); isKey || isYAMLItem(rest) {
+			// A mapping or sequence starting on the line of the item,
+			// indented as far as its first entry
+			p.lines[p.pos] = yamlLine{num: l.num, indent: indent + len(l.text) - len(rest), text: rest}
+			v, err = p.block(p.lines[p.pos].indent)
+		} else {
+			p.pos++
+			switch {
+			case rest != "":
+				if v, err = yamlValue(rest); err != nil {
+					err = fmt.Errorf("line %d: %v", l.num, err)
+				}
+			case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+				v, err = p.block(p.lines[p.pos].indent)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func isYAMLItem(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ")
+}
+
+// splitYAMLKey splits "key: value" into the key and the value, if the line
+// is an entry of a mapping
+func splitYAMLKey(s string) (key, rest string, ok bool) {
+	if s == "" || strings.ContainsRune("[{", rune(s[0])) {
+		return "", "", false
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		sc := &valueScanner{s: s}
+		k, err := sc.quoted()
+		if err != nil {
+			return "", "", false
+		}
+		after := s[sc.i:]
+		if after == ":" || strings.HasPrefix(after, ": ") {
+			return k, strings.TrimSpace(after[1:]), true
+		}
+		return "", "", false
+	}
+	if i := strings.Index(s, ": "); i > 0 {
+		return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+2:]), true
+	}
+	if strings.HasSuffix(s, ":") && len(s) > 1 {
+		return strings.TrimSpace(s[:len(s)-1]), "", true
+	}
+	return "", "", false
+}
+
+// yamlValue reads the value of an entry given on its line
+func yamlValue(s string) (any, error) {
+	switch s[0] {
+	case '|', '>':
+		return nil, errors.New("multi-line strings aren't supported, write the value on one line")
+	case '&', '*', '!':
+		return nil, errors.New("anchors, aliases and tags aren't supported")
+	case '[', '{', '"', '\'':
+		sc := &valueScanner{s: s, yaml: true}
+		v, err := sc.value()
+		if err != nil {
+			return nil, err
+		}
+		if sc.skip(); sc.i < len(s) {
+			return nil, fmt.Errorf("unexpected %q after the value", s[sc.i:])
+		}
+		return v, nil
+	}
+	return yamlPlain(s), nil
+}
+
+var yamlNumber = regexp.MustCompile(`^[-+]?(\d+(\.\d*)?|\.\d+)([eE][-+]?\d+)?$`)
+
+// yamlPlain types an unquoted scalar: null, true or false, a number, or a
+// string
+func yamlPlain(s string) any {
+	switch strings.ToLower(s) {
+	case "null", "~":
+		return nil
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if yamlNumber.MatchString(s) {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return s
+}
+
+// TOML
+
+// parseTOML reads the subset of TOML configuration files need: tables,
+// dotted keys, strings, numbers, booleans, arrays and inline tables. Arrays
+// of tables, multi-line strings and dates aren't supported.
+func parseTOML(data string) (any, error) {
+	root := map[string]any{}
+	table := root
+	lines := strings.Split(data, "\n")
+	for n := 0; n < len(lines); n++ {
+		num := n + 1
+		line := strings.TrimSpace(stripComment(strings.TrimRight(lines[n], "\r"), false))
+		// Arrays and inline tables may span lines
+		for !balanced(line) && n+1 < len(lines) {
+			n++
+			line += " " + strings.TrimSpace(stripComment(strings.TrimRight(lines[n], "\r"), false))
+		}
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "[["):
+			return nil, fmt.Errorf("line %d: arrays of tables aren't supported", num)
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: expected ] after the table name", num)
+			}
+			keys, err := tomlKeys(line[1 : len(line)-1])
+			if err == nil {
+				table, err = tomlTable(root, keys)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", num, err)
+			}
+		default:
+			if err := tomlEntry(table, line); err != nil {
+				return nil, fmt.Errorf("line %d: %v", num, err)
+			}
+		}
+	}
+	return root, nil
+}
+
+// tomlEntry sets the value of a key = value line in a table
+func tomlEntry(table map[string]any, line string) error {
+	eq := indexUnquoted(line, '=')
+	if eq < 0 {
+		return errors.New("expected key = value")
+	}
+	keys, err := tomlKeys(line[:eq])
+	if err != nil {
+		return err
+	}
+	sc := &valueScanner{s: strings.TrimSpace(line[eq+1:])}
+	v, err := sc.value()
+	if err != nil {
+		return err
+	}
+	if sc.skip(); sc.i < len(sc.s) {
+		return fmt.Errorf("unexpected %q after the value", sc.s[sc.i:])
+	}
+	t, err := tomlTable(table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	key := keys[len(keys)-1]
+	if _, dup := t[key]; dup {
+		return fmt.Errorf("%s is set twice", strings.Join(keys, "."))
+	}
+	t[key] = v
+	return nil
+}
+
+// tomlKeys splits a dotted key, e.g. tenants.lab or streams."imu 1"
+func tomlKeys(s string) ([]string, error) {
+	var keys []string
+	sc := &valueScanner{s: strings.TrimSpace(s)}
+	for {
+		sc.skip()
+		if sc.i >= len(sc.s) {
+			return nil, errors.New("missing key")
+		}
+		var key string
+		if c := sc.s[sc.i]; c == '"' || c == '\'' {
+			var err error
+			if key, err = sc.quoted(); err != nil {
+				return nil, err
+			}
+		} else {
+			start := sc.i
+			for sc.i < len(sc.s) && isBareKeyChar(sc.s[sc.i]) {
+				sc.i++
+			}
+			if key = sc.s[start:sc.i]; key == "" {
+				return nil, fmt.Errorf("invalid key %q", s)
+			}
+		}
+		keys = append(keys, key)
+		sc.skip()
+		if sc.i == len(sc.s) {
+			return keys, nil
+		}
+		if sc.s[sc.i] != '.' {
+			return nil, fmt.Errorf("invalid key %q", s)
+		}
+		sc.i++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '-'
+}
+
+// tomlTable returns the table at a path of keys, creating it as needed
+func tomlTable(root map[string]any, keys []string) (map[string]any, error) {
+	t := root
+	for n, key := range keys {
+		switch v := t[key].(type) {
+		case nil:
+			sub := map[string]any{}
+			t[key] = sub
+			t = sub
+		case map[string]any:
+			t = v
+		default:
+			return nil, fmt.Errorf("%s is not a table", strings.Join(keys[:n+1], "."))
+		}
+	}
+	return t, nil
+}
+
+var tomlInteger = regexp.MustCompile(`^[-+]?\d+$`)
+
+// tomlScalar types a bare TOML value: true or false, or a number
+func tomlScalar(s string) (any, error) {
+	switch s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	digits := strings.ReplaceAll(s, "_", "")
+	if tomlInteger.MatchString(digits) {
+		return strconv.ParseInt(digits, 10, 64)
+	}
+	for prefix, base := range map[string]int{"0x": 16, "0o": 8, "0b": 2} {
+		if strings.HasPrefix(digits, prefix) {
+			return strconv.ParseInt(digits[2:], base, 64)
+		}
+	}
+	if f, err := strconv.ParseFloat(digits, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unsupported value %q, quote strings", s)
+}
+
+// Shared by both
+
+// valueScanner reads values written on one line: quoted strings, arrays,
+// and YAML flow mappings or TOML inline tables
+type valueScanner struct {
+	s    string
+	i    int
+	yaml bool // Mappings are {key: value} and scalars may be unquoted
+}
+
+func (sc *valueScanner) skip() {
+	for sc.i < len(sc.s) && (sc.s[sc.i] == ' ' || sc.s[sc.i] == '\t') {
+		sc.i++
+	}
+}
+
+func (sc *valueScanner) value() (any, error) {
+	sc.skip()
+	if sc.i >= len(sc.s) {
+		return nil, errors.New("missing value")
+	}
+	switch sc.s[sc.i] {
+	case '"', '\'':
+		return sc.quoted()
+	case '[':
+		sc.i++
+		list := []any{}
+		for {
+			sc.skip()
+			if sc.i < len(sc.s) && sc.s[sc.i] == ']' {
+				sc.i++
+				return list, nil
+			}
+			v, err := sc.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			if err := sc.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		sc.i++
+		m := map[string]any{}
+		for {
+			sc.skip()
+			if sc.i < len(sc.s) && sc.s[sc.i] == '}' {
+				sc.i++
+				return m, nil
+			}
+			key, err := sc.key()
+			if err != nil {
+				return nil, err
+			}
+			v, err := sc.value()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := m[key]; dup {
+				return nil, fmt.Errorf("%s is set twice", key)
+			}
+			m[key] = v
+			if err := sc.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Unquoted, up to the end of the collection or the next item
+	start := sc.i
+	for sc.i < len(sc.s) && !strings.ContainsRune(",]}", rune(sc.s[sc.i])) {
+		sc.i++
+	}
+	text := strings.TrimSpace(sc.s[start:sc.i])
+	if sc.yaml {
+		return yamlPlain(text), nil
+	}
+	return tomlScalar(text)
+}
+
+// key reads the key of a mapping entry and the separator after it
+func (sc *valueScanner) key() (string, error) {
+	sep := byte('=')
+	if sc.yaml {
+		sep = ':'
+	}
+	var key string
+	if c := sc.s[sc.i]; c == '"' || c == '\'' {
+		var err error
+		if key, err = sc.quoted(); err != nil {
+			return "", err
+		}
+	} else {
+		start := sc.i
+		for sc.i < len(sc.s) && sc.s[sc.i] != sep && !strings.ContainsRune(",}", rune(sc.s[sc.i])) {
+			sc.i++
+		}
+		key = strings.TrimSpace(sc.s[start:sc.i])
+	}
+	sc.skip()
+	if key == "" || sc.i >= len(sc.s) || sc.s[sc.i] != sep {
+		return "", fmt.Errorf("expected key %c value in %s", sep, sc.s)
+	}
+	sc.i++
+	return key, nil
+}
+
+// separator reads the comma between items, or the end of a collection
+func (sc *valueScanner) separator(end byte) error {
+	sc.skip()
+	switch {
+	case sc.i >= len(sc.s):
+		return fmt.Errorf("missing %c", end)
+	case sc.s[sc.i] == ',':
+		sc.i++
+	case sc.s[sc.i] != end:
+		return fmt.Errorf("expected , or %c in %s", end, sc.s)
+	}
+	return nil
+}
+
+// quoted reads a string in double quotes, with escapes, or single quotes,
+// in which YAML writes a quote as two
+func (sc *valueScanner) quoted() (string, error) {
+	q := sc.s[sc.i]
+	if strings.HasPrefix(sc.s[sc.i:], `"""`) || strings.HasPrefix(sc.s[sc.i:], "'''") {
+		return "", errors.New("multi-line strings aren't supported, write the value on one line")
+	}
+	for n := sc.i + 1; n < len(sc.s); n++ {
+		switch {
+		case q == '"' && sc.s[n] == '\\':
+			n++
+		case sc.s[n] == q && q == '\'' && n+1 < len(sc.s) && sc.s[n+1] == '\'':
+			n++
+		case sc.s[n] == q:
+			text := sc.s[sc.i : n+1]
+			sc.i = n + 1
+			if q == '\'' {
+				return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+			}
+			s, err := strconv.Unquote(text)
+			if err != nil {
+				return "", fmt.Errorf("invalid string %s", text)
+			}
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("missing closing quote in %s", sc.s[sc.i:])
+}
+
+// stripComment removes a # comment from a line, outside quotes. YAML only
+// starts comments at the start of the line or after a space.
+func stripComment(line string, yaml bool) string {
+	var quote byte
+	for n := 0; n < len(line); n++ {
+		c := line[n]
+		switch {
+		case quote == '"' && c == '\\':
+			n++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (!yaml || n == 0 || line[n-1] == ' ' || line[n-1] == '\t'):
+			return line[:n]
+		}
+	}
+	return line
+}
+
+// indexUnquoted returns the index of the first c outside quotes, -1 if none
+func indexUnquoted(s string, c byte) int {
+	var quote byte
+	for n := 0; n < len(s); n++ {
+		switch {
+		case quote == '"' && s[n] == '\\':
+			n++
+		case quote != 0:
+			if s[n] == quote {
+				quote = 0
+			}
+		case s[n] == '"' || s[n] == '\'':
+			quote = s[n]
+		case s[n] == c:
+			return n
+		}
+	}
+	return -1
+}
+
+// balanced reports whether the brackets and braces of a line are closed
+func balanced(line string) bool {
+	depth := 0
+	var quote byte
+	for n := 0; n < len(line); n++ {
+		c := line[n]
+		switch {
+		case quote == '"' && c == '\\':
+			n++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// Writing
+
+// configEntry is a setting of a configuration, keeping the order of the
+// fields of Config when saving. Objects are []configEntry.
+type configEntry struct {
+	key   string
+	value any
+}
+
+// decodeOrdered decodes JSON keeping the order of object keys
+func decodeOrdered(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		entries := []configEntry{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, configEntry{key: key.(string), value: v})
+		}
+		_, err := dec.Token()
+		return entries, err
+	case json.Delim('['):
+		list := []any{}
+		for dec.More() {
+			v, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err := dec.Token()
+		return list, err
+	}
+	return tok, nil
+}
+
+func writeYAML(w io.StringWriter, entries []configEntry, indent int) {
+	pad := strings.Repeat(" ", indent)
+	for _, e := range entries {
+		sub, ok := e.value.([]configEntry)
+		switch {
+		case ok && len(sub) > 0:
+			w.WriteString(pad + yamlString(e.key) + ":\n")
+			writeYAML(w, sub, indent+2)
+		case ok:
+			w.WriteString(pad + yamlString(e.key) + ": {}\n")
+		default:
+			w.WriteString(pad + yamlString(e.key) + ": " + yamlScalar(e.value) + "\n")
+		}
+	}
+}
+
+// yamlScalar writes a value on the line of its key. Sequences and mappings
+// are written as flow collections.
+func yamlScalar(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return yamlString(v)
+	case []any:
+		items := make([]string, len(v))
+		for n, item := range v {
+			items[n] = yamlFlow(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case []configEntry:
+		items := make([]string, len(v))
+		for n, e := range v {
+			items[n] = yamlFlowString(e.key) + ": " + yamlFlow(e.value)
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	}
+	return fmt.Sprint(v)
+}
+
+// yamlFlow writes a value inside a flow collection
+func yamlFlow(v any) string {
+	if s, ok := v.(string); ok {
+		return yamlFlowString(s)
+	}
+	return yamlScalar(v)
+}
+
+// yamlFlowString writes a string inside a flow collection, quoted when it
+// holds a character that would end an item or a key
+func yamlFlowString(s string) string {
+	if strings.ContainsAny(s, ",:[]{}") {
+		return strconv.Quote(s)
+	}
+	return yamlString(s)
+}
+
+// yamlString writes a string plainly when it would be read back the same,
+// otherwise quoted
+func yamlString(s string) string {
+	if s != "" && yamlPlain(s) == s && strings.TrimSpace(s) == s && !strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`") && !strings.Contains(s, "'") &&
+		!strings.Contains(s, ": ") && !strings.Contains(s, " #") && strconv.Quote(s) == `"`+s+`"` {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// writeTOML writes the entries of the table at path. TOML has no null, so
+// a null anywhere is refused.
+func writeTOML(w io.StringWriter, entries []configEntry, path []string) error {
+	// Values come before the tables in a table
+	var tables []configEntry
+	for _, e := range entries {
+		if _, ok := e.value.([]configEntry); ok {
+			tables = append(tables, e)
+			continue
+		}
+		v, err := tomlValue(e.value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", strings.Join(append(append([]string(nil), path...), e.key), "."), err)
+		}
+		w.WriteString(tomlKey(e.key) + " = " + v + "\n")
+	}
+	for _, t := range tables {
+		sub := append(append([]string(nil), path...), t.key)
+		keys := make([]string, len(sub))
+		for n, k := range sub {
+			keys[n] = tomlKey(k)
+		}
+		entries := t.value.([]configEntry)
+		// Tables holding only tables need no header of their own
+		header := len(entries) == 0
+		for _, e := range entries {
+			if _, ok := e.value.([]configEntry); !ok {
+				header = true
+			}
+		}
+		if header {
+			w.WriteString("\n[" + strings.Join(keys, ".") + "]\n")
+		}
+		if err := writeTOML(w, entries, sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tomlKey(k string) string {
+	for n := 0; n < len(k); n++ {
+		if !isBareKeyChar(k[n]) {
+			return tomlString(k)
+		}
+	}
+	if k == "" {
+		return `""`
+	}
+	return k
+}
+
+// errTOMLNull is returned for a null, which TOML can't write
+var errTOMLNull = errors.New("TOML has no null, save the configuration as JSON or YAML")
+
+// tomlValue writes a value on the line of its key. Arrays are written on
+// one line, and tables in them as inline tables.
+func tomlValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", errTOMLNull
+	case string:
+		return tomlString(v), nil
+	case []any:
+		items := make([]string, len(v))
+		for n, item := range v {
+			text, err := tomlValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[n] = text
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case []configEntry:
+		items := make([]string, len(v))
+		for n, e := range v {
+			text, err := tomlValue(e.value)
+			if err != nil {
+				return "", err
+			}
+			items[n] = tomlKey(e.key) + " = " + text
+		}
+		return "{" + strings.Join(items, ", ") + "}", nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// tomlString quotes a string with the escapes of TOML basic strings
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
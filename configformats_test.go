@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// formatValues are the shapes of values a configuration may hold, as the
+// JSON of a setting, e.g. in welcome
+var formatValues = []struct {
+	name, json string
+}{
+	{"plain string", `"hello"`},
+	{"empty string", `""`},
+	{"string with spaces", `"  padded  "`},
+	{"string with comma", `"a, b"`},
+	{"string with colon", `"host:8080"`},
+	{"string with colon and space", `"key: value"`},
+	{"string with comment", `"a #1"`},
+	{"string starting with hash", `"#rrggbb"`},
+	{"string starting with dash", `"-x"`},
+	{"string with brackets", `"[a]{b}"`},
+	{"string with quotes", `"say \"hi\" it's"`},
+	{"string with backslash", `"C:\\data\\run.csv"`},
+	{"string with newline and tab", `"a\nb\tc"`},
+	{"unicode string", `"°C ✓"`},
+	{"string like null", `"null"`},
+	{"string like a bool", `"true"`},
+	{"string like a number", `"123"`},
+	{"integer", `42`},
+	{"negative integer", `-7`},
+	{"float", `0.25`},
+	{"exponent", `1.5e-3`},
+	{"true", `true`},
+	{"false", `false`},
+	{"empty object", `{}`},
+	{"empty array", `[]`},
+	{"object", `{"name": "imu", "rate": 100, "on": true}`},
+	{"nested object", `{"a": {"b": {"c": "d"}, "e": 1}}`},
+	{"odd keys", `{"with space": 1, "dot.ted": 2, "co:lon": 3, "": 4}`},
+	{"array of scalars", `[1, "two", 3.5, false, "a, b", "x:y"]`},
+	{"array of arrays", `[[1, 2], [], [["deep"]]]`},
+	{"array of objects", `[{"a": 1}, {"b": "x", "c": [1, {"d": "e"}]}, {}]`},
+	{"object of arrays", `{"list": [{"k": "v"}], "empty": []}`},
+}
+
+// roundTrip writes the JSON of a configuration in the format of path and
+// reads it back as JSON
+func roundTrip(t *testing.T, path, data string) (any, error) {
+	t.Helper()
+	written, err := formatConfigData(path, []byte(data))
+	if err != nil {
+		return nil, err
+	}
+	back, err := configJSONData(path, written)
+	if err != nil {
+		t.Fatalf("reading back\n%s\n: %v", written, err)
+	}
+	var v any
+	if err := json.Unmarshal(back, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v, nil
+}
+
+func TestConfigFormatRoundTrip(t *testing.T) {
+	for _, path := range []string{"quatplot.yaml", "quatplot.toml"} {
+		for _, tt := range formatValues {
+			data := `{"welcome": ` + tt.json + `, "port": "auto", "baud": 115200}`
+			var want any
+			if err := json.Unmarshal([]byte(data), &want); err != nil {
+				t.Fatal(err)
+			}
+			got, err := roundTrip(t, path, data)
+			if err != nil {
+				t.Errorf("%s %s: %v", path, tt.name, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %s: read back %v, want %v", path, tt.name, got, want)
+			}
+		}
+	}
+}
+
+func TestConfigFormatNull(t *testing.T) {
+	data := `{"welcome": {"items": [[{"a": 1}], [{"b": null}]], "none": null}}`
+	var want any
+	json.Unmarshal([]byte(data), &want)
+	got, err := roundTrip(t, "quatplot.yaml", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("YAML read back %v, want %v", got, want)
+	}
+
+	for _, data := range []string{
+		`{"welcome": null}`,
+		`{"welcome": {"none": null}}`,
+		`{"welcome": [1, null]}`,
+		`{"welcome": [{"b": null}]}`,
+	} {
+		if _, err := formatConfigData("quatplot.toml", []byte(data)); err == nil || !strings.Contains(err.Error(), "null") {
+			t.Errorf("TOML of %s: error %v, want one about null", data, err)
+		}
+	}
+}
+
+func TestConfigFormatKeepsOrder(t *testing.T) {
+	data := `{"source": "simulate", "port": "auto", "streams": {"b": {"name": "B"}, "a": {"name": "A"}}}`
+	tests := []struct {
+		path, want string
+	}{
+		{"quatplot.yaml", "source: simulate\nport: auto\nstreams:\n  b:\n    name: B\n  a:\n    name: A"},
+		{"quatplot.toml", "source = \"simulate\"\nport = \"auto\"\n\n[streams.b]\nname = \"B\"\n\n[streams.a]\nname = \"A\""},
+	}
+	for _, tt := range tests {
+		got, err := formatConfigData(tt.path, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s:\n%s\nwant\n%s", tt.path, got, tt.want)
+		}
+	}
+}
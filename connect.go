@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// connectRequest is the body of POST /api/connect
+type connectRequest struct {
+	Port string `json:"port"`
+	Baud int    `json:"baud"`           // Kept when left out
+	Save bool   `json:"save,omitempty"` // Also write it to the config file
+}
+
+// portsInfo is the answer to GET /api/ports
+type portsInfo struct {
+	Port       string     `json:"port"` // Configured, e.g. auto or /dev/ttyACM0
+	Baud       int        `json:"baud"`
+	Switchable bool       `json:"switchable"` // Whether /api/connect can change the port
+	Reason     string     `json:"reason,omitempty"`
+	Status     string     `json:"status"` // State of the connection, see /api/status
+	Ports      []portInfo `json:"ports"`
+}
+
+// portInfo describes a serial port of the machine
+type portInfo struct {
+	Name    string `json:"name"`
+	USB     string `json:"usb,omitempty"` // usb:VID:PID, as -port accepts
+	Serial  string `json:"serial,omitempty"`
+	Product string `json:"product,omitempty"`
+}
+
+// switchablePort checks that the input is a single untagged serial port,
+// the only kind of source whose port can be changed at runtime
+func switchablePort(cfg Config) error {
+	if cfg.Source != "serial" {
+		return errors.New("the input is not a serial port, see -source")
+	}
+	if ports, err := parseDevicePorts(cfg.Port); err != nil || len(ports) != 1 || ports[0].ID != "" {
+		return errors.New("the input is several tagged serial ports, change -port and restart instead")
+	}
+	return nil
+}
+
+// handlePorts lists the serial ports of the machine, along with the port
+// and baud rate in use
+func handlePorts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	detected, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		http.Error(w, "listing serial ports: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cfg := currentConfig()
+	info := portsInfo{Port: cfg.Port, Baud: cfg.Baud, Switchable: true, Status: defaultNamespace.getStatus().State, Ports: []portInfo{}}
+	if err := switchablePort(cfg); err != nil {
+		info.Switchable, info.Reason = false, err.Error()
+	}
+	for _, p := range detected {
+		pi := portInfo{Name: p.Name, Serial: p.SerialNumber, Product: p.Product}
+		if p.IsUSB {
+			pi.USB = "usb:" + strings.ToLower(p.VID) + ":" + strings.ToLower(p.PID)
+		}
+		info.Ports = append(info.Ports, pi)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// handleConnect switches the serial input to another port or baud rate
+// without restarting the server. The source is reopened straight away and
+// keeps retrying like at startup when the port can't be opened.
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if inSetupMode() {
+		http.Error(w, "finish the setup wizard at /setup first", http.StatusConflict)
+		return
+	}
+	var req connectRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	cfg := currentConfig()
+	if err := switchablePort(cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	req.Port = strings.TrimSpace(req.Port)
+	if req.Port == "" {
+		http.Error(w, "port is required", http.StatusBadRequest)
+		return
+	}
+	if ports, err := parseDevicePorts(req.Port); err != nil || len(ports) != 1 || ports[0].ID != "" {
+		http.Error(w, "port must be a single serial port, e.g. /dev/ttyACM0, usb:VID:PID or auto", http.StatusBadRequest)
+		return
+	}
+	if req.Baud < 0 {
+		http.Error(w, "baud must be positive", http.StatusBadRequest)
+		return
+	}
+	if req.Baud == 0 {
+		req.Baud = cfg.Baud
+	}
+
+	cfg.Port, cfg.Baud = req.Port, req.Baud
+	if req.Save {
+		if err := saveConfig(*configPath, cfg); err != nil {
+			log.Printf("Error saving config: %v", err)
+			http.Error(w, "saving config: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Printf("Switching the serial input to %s at %d baud", cfg.Port, cfg.Baud)
+	defaultNamespace.announceRestart("source", time.Second)
+	setConfig(cfg)
+	restartSources()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(defaultNamespace.sources["serial"].info())
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+// Quaternion conventions accepted from sensors
+const (
+	conventionHamilton = "hamilton"
+	conventionJPL      = "jpl"
+)
+
+var (
+	inputConvention = flag.String("convention", conventionHamilton, "Quaternion convention of the sensor (hamilton or jpl)")
+	referenceFrame  = flag.String("frame", "unspecified", "Reference frame of the sensor orientation (enu, ned, nwu or unspecified)")
+)
+
+// conventionInfo declares exactly how to interpret the quaternions on the
+// wire. Output is always Hamilton, scalar last, rotating sensor (body)
+// coordinates into the reference frame; sensors using the JPL convention are
+// converted on input.
+type conventionInfo struct {
+	Convention       string   `json:"convention"`        // Always "hamilton"
+	Handedness       string   `json:"handedness"`        // i*j = k holds, right-handed
+	Components       []string `json:"components"`        // JSON keys, vector part first
+	Scalar           string   `json:"scalar"`            // Key of the scalar (w) component
+	Rotation         string   `json:"rotation"`          // Direction of the rotation
+	Frame            string   `json:"frame"`             // Reference frame, e.g. "enu"
+	SourceConvention string   `json:"source_convention"` // Convention the sensor reported in
+	SourceOrder      string   `json:"source_order"`      // Component order of the sensor's lines
+	SourceInput      string   `json:"source_input"`      // What the sensor's lines hold, "quaternion" or "euler"
+	SourceEulerOrder string   `json:"source_euler_order,omitempty"`
+	SourceEulerUnits string   `json:"source_euler_units,omitempty"`
+}
+
+// parseConvention validates a quaternion convention name
+func parseConvention(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case conventionHamilton:
+		return conventionHamilton, nil
+	case conventionJPL:
+		return conventionJPL, nil
+	}
+	return "", fmt.Errorf("unknown quaternion convention %q, expected hamilton or jpl", s)
+}
+
+// parseFrame validates a reference frame name
+func parseFrame(s string) (string, error) {
+	switch f := strings.ToLower(s); f {
+	case "enu", "ned", "nwu", "unspecified":
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown reference frame %q, expected enu, ned, nwu or unspecified", s)
+}
+
+// describeConvention builds the convention descriptor for a configuration
+func describeConvention(cfg Config) conventionInfo {
+	info := conventionInfo{
+		Convention:       conventionHamilton,
+		Handedness:       "right",
+		Components:       []string{"i", "j", "k", "real"},
+		Scalar:           "real",
+		Rotation:         "body-to-reference",
+		Frame:            cfg.Frame,
+		SourceConvention: cfg.Convention,
+		SourceOrder:      componentOrder(cfg.inputFormat()),
+		SourceInput:      cfg.inputKind(),
+	}
+	if info.SourceInput != inputQuaternion {
+		// Euler angles and matrices are converted straight to Hamilton quaternions
+		info.SourceConvention = conventionHamilton
+	}
+	if info.SourceInput == inputEuler {
+		info.SourceEulerOrder = strings.ToUpper(cfg.eulerOrder())
+		info.SourceEulerUnits, _ = quat.ParseUnits(cfg.eulerUnits())
+	}
+	return info
+}
+
+// toHamilton converts a quaternion from the given convention to Hamilton.
+// A JPL quaternion for a rotation is the conjugate of the Hamilton one.
+func toHamilton(q Quaternion, convention string) Quaternion {
+	if convention == conventionJPL {
+		return Quaternion{I: -q.I, J: -q.J, K: -q.K, Real: q.Real}
+	}
+	return q
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// encryptionKeyEnv names the environment variable holding the encryption key
+const encryptionKeyEnv = "QUATPLOT_ENCRYPTION_KEY"
+
+// sealedMagic starts every encrypted file
+var sealedMagic = []byte("quatplot-aesgcm-v1\n")
+
+// errTruncated is returned for a record cut short, e.g. by a power loss
+var errTruncated = errors.New("truncated")
+
+// sealedMaxRecord bounds the records written and read, so that a corrupt
+// length doesn't make a reader allocate gigabytes. Records are recording
+// buffers, spool segments and summaries, far smaller.
+const sealedMaxRecord = 64 << 20
+
+var (
+	encryptionKeyFile = flag.String("encryption-key-file", "", "File holding the AES key used to encrypt data written to disk (or set "+encryptionKeyEnv+")")
+
+	// encryptionKey encrypts files written to disk, nil when encryption is off
+	encryptionKey []byte
+)
+
+// parseEncryptionKey decodes a 16, 24 or 32 byte AES key given as hex or base64
+func parseEncryptionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil {
+		return nil, errors.New("encryption key must be hex or base64 encoded")
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key is %d bytes, must be 16, 24 or 32", len(key))
+}
+
+// loadEncryptionKey returns the key from the environment, or failing that
+// from the key file, or nil when neither is set
+func loadEncryptionKey(path string) ([]byte, error) {
+	if v := os.Getenv(encryptionKeyEnv); v != "" {
+		key, err := parseEncryptionKey(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", encryptionKeyEnv, err)
+		}
+		return key, nil
+	}
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseEncryptionKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+// sealedWriter writes an encrypted file as a sequence of records, each
+// sealed with AES-GCM under a fresh nonce. The record index is authenticated
+// so records can't be reordered or dropped from the middle unnoticed.
+type sealedWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	index uint64
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newSealedWriter writes the file header and returns a writer for its records
+func newSealedWriter(w io.Writer, key []byte) (*sealedWriter, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(sealedMagic); err != nil {
+		return nil, err
+	}
+	return &sealedWriter{w: w, aead: aead}, nil
+}
+
+// openSealedAppend opens an encrypted file for appending records, creating it
+// if needed. The records already in the file are checked, so that numbering
+// carries on from the last one.
+func openSealedAppend(path string, key []byte) (*os.File, *sealedWriter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		w, err := newSealedWriter(f, key)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return f, w, nil
+	}
+
+	sr, err := newSealedReader(bufio.NewReader(f), key)
+	for err == nil {
+		_, err = sr.ReadRecord()
+	}
+	if err != io.EOF {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return f, &sealedWriter{w: f, aead: sr.aead, index: sr.index}, nil
+}
+
+// isSealedFile reports whether path is an existing encrypted file
+func isSealedFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(sealedMagic))
+	_, err = io.ReadFull(f, magic)
+	return err == nil && bytes.Equal(magic, sealedMagic)
+}
+
+// WriteRecord encrypts p and appends it as one record
+func (s *sealedWriter) WriteRecord(p []byte) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	var ad [8]byte
+	binary.BigEndian.PutUint64(ad[:], s.index)
+	sealed := s.aead.Seal(nonce, nonce, p, ad[:])
+	if len(sealed) > sealedMaxRecord {
+		return fmt.Errorf("record of %d bytes is over the limit of %d", len(p), sealedMaxRecord)
+	}
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := s.w.Write(append(length[:], sealed...)); err != nil {
+		return err
+	}
+	s.index++
+	return nil
+}
+
+// sealedReader reads the records of a file written by sealedWriter
+type sealedReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	index uint64
+}
+
+// newSealedReader checks the file header and returns a reader for its records
+func newSealedReader(r io.Reader, key []byte) (*sealedReader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(sealedMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, sealedMagic) {
+		return nil, errors.New("not an encrypted quatplot file")
+	}
+	return &sealedReader{r: r, aead: aead}, nil
+}
+
+// ReadRecord returns the next decrypted record, or io.EOF after the last one
+func (s *sealedReader) ReadRecord() ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(s.r, length[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("record %d: %w", s.index, errTruncated)
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > sealedMaxRecord {
+		// Most likely the garbage of a write cut short, recovered like one
+		return nil, fmt.Errorf("record %d: length of %d bytes: %w", s.index, n, errTruncated)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(s.r, sealed); err != nil {
+		return nil, fmt.Errorf("record %d: %w", s.index, errTruncated)
+	}
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("record %d: %w", s.index, errTruncated)
+	}
+
+	var ad [8]byte
+	binary.BigEndian.PutUint64(ad[:], s.index)
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, ad[:])
+	if err != nil {
+		return nil, fmt.Errorf("record %d: wrong key or corrupted data", s.index)
+	}
+	s.index++
+	return plain, nil
+}
+
+// recordStream reads the decrypted records of a sealedReader as one stream
+type recordStream struct {
+	sr  *sealedReader
+	buf []byte
+}
+
+func (s *recordStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		record, err := s.sr.ReadRecord()
+		if err != nil {
+			return 0, err
+		}
+		s.buf = record
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// writeSealedFile writes data to path encrypted as a single record
+func writeSealedFile(path string, data []byte, key []byte) error {
+	sealed, err := sealBytes(data, key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, sealed, 0o600)
+}
+
+// sealBytes encrypts data as a single record, as writeSealedFile stores it
+func sealBytes(data []byte, key []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := newSealedWriter(&buf, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.WriteRecord(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readSealedFile decrypts every record of an encrypted file and returns them concatenated
+func readSealedFile(path string, key []byte) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readSealed(f, key)
+}
+
+func readSealed(r io.Reader, key []byte) ([]byte, error) {
+	sr, err := newSealedReader(r, key)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	for {
+		record, err := sr.ReadRecord()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+		out = append(out, record...)
+	}
+}
+
+// runDecrypt writes the decrypted contents of an encrypted file to stdout
+// and returns the process exit code
+func runDecrypt() int {
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: quatplot decrypt [flags] FILE")
+		return 2
+	}
+	if _, err := initConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 1
+	}
+	if encryptionKey == nil {
+		fmt.Fprintf(os.Stderr, "no encryption key, set %s or -encryption-key-file\n", encryptionKeyEnv)
+		return 1
+	}
+	data, err := readSealedFile(flag.Arg(0), encryptionKey)
+	os.Stdout.Write(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestSealedRecords(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	var buf bytes.Buffer
+	w, err := newSealedWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte("x"), 100000)}
+	for _, p := range records {
+		if err := w.WriteRecord(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteRecord(make([]byte, sealedMaxRecord)); err == nil {
+		t.Error("WriteRecord over sealedMaxRecord succeeded")
+	}
+	sealed := buf.Bytes()
+
+	r, err := newSealedReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range records {
+		got, err := r.ReadRecord()
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("record %d: %d bytes, %v, want %d bytes", n, len(got), err, len(want))
+		}
+	}
+	if _, err := r.ReadRecord(); err != io.EOF {
+		t.Errorf("after the last record: %v, want io.EOF", err)
+	}
+
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{"cut length", []byte{0, 0}},
+		{"cut record", []byte{0, 0, 0, 64, 1, 2, 3}},
+		{"huge length", binary.BigEndian.AppendUint32(nil, 0xffffffff)},
+	}
+	for _, tt := range tests {
+		r, _ := newSealedReader(bytes.NewReader(append(append([]byte(nil), sealed...), tt.tail...)), key)
+		for range records {
+			r.ReadRecord()
+		}
+		if _, err := r.ReadRecord(); !errors.Is(err, errTruncated) {
+			t.Errorf("%s: %v, want errTruncated", tt.name, err)
+		}
+	}
+
+	r, _ = newSealedReader(bytes.NewReader(sealed), bytes.Repeat([]byte{8}, 32))
+	if _, err := r.ReadRecord(); err == nil || errors.Is(err, errTruncated) {
+		t.Errorf("wrong key: %v, want a decryption error", err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strings"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// deviceNotFoundError reports that no connected port matches a device
+// specification, it matches fs.ErrNotExist like a missing port path
+type deviceNotFoundError struct {
+	msg string
+}
+
+func (e *deviceNotFoundError) Error() string { return e.msg }
+func (e *deviceNotFoundError) Unwrap() error { return fs.ErrNotExist }
+
+// resolvePortName turns a friendly device specification into the platform
+// specific port path. Supported specifications are:
+//
+//	usb:VID:PID          first USB serial device with the given vendor and product IDs
+//	usb:VID:PID:SERIAL   as above, restricted to one serial number
+//	bluetooth:NAME       Bluetooth serial port whose name or description contains NAME
+//
+// Anything else is treated as a port path and returned unchanged.
+func resolvePortName(spec string) (string, error) {
+	kind, rest, ok := strings.Cut(spec, ":")
+	if !ok {
+		return spec, nil
+	}
+
+	switch strings.ToLower(kind) {
+	case "usb":
+		return resolveUSBPort(spec, rest)
+	case "bluetooth", "bt":
+		return resolveBluetoothPort(spec, rest)
+	default:
+		return spec, nil
+	}
+}
+
+// resolveUSBPort finds the port for a "VID:PID[:SERIAL]" specification
+func resolveUSBPort(spec, ids string) (string, error) {
+	parts := strings.Split(ids, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid device %q, expected usb:VID:PID or usb:VID:PID:SERIAL", spec)
+	}
+
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %v", spec, err)
+	}
+	for _, p := range ports {
+		if !p.IsUSB || !strings.EqualFold(p.VID, parts[0]) || !strings.EqualFold(p.PID, parts[1]) {
+			continue
+		}
+		if len(parts) == 3 && !strings.EqualFold(p.SerialNumber, parts[2]) {
+			continue
+		}
+		return p.Name, nil
+	}
+	return "", &deviceNotFoundError{fmt.Sprintf("no USB serial device matching %s is connected", spec)}
+}
+
+// resolveBluetoothPort finds the port for a Bluetooth device name. macOS
+// names ports after the paired device (/dev/cu.HC-05-DevB), Windows and
+// Linux usually expose the name in the port description.
+func resolveBluetoothPort(spec, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("invalid device %q, expected bluetooth:NAME", spec)
+	}
+
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %v", spec, err)
+	}
+	want := strings.ToLower(name)
+	for _, p := range ports {
+		if strings.Contains(strings.ToLower(p.Name), want) || strings.Contains(strings.ToLower(p.Product), want) {
+			return p.Name, nil
+		}
+	}
+	return "", &deviceNotFoundError{fmt.Sprintf("no serial port for Bluetooth device %s, check that it is paired", name)}
+}
+
+// devicePort is one of the serial ports given with -port, with the ID its
+// samples are tagged with
+type devicePort struct {
+	ID   string
+	Spec string
+}
+
+// deviceID restricts device IDs to what is easy to type in URLs and scripts
+var deviceID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// parseDevicePorts splits a comma separated list of ports, each optionally
+// named with an ID, e.g. "upper=/dev/ttyUSB0,fore=/dev/ttyUSB1". Unnamed
+// ports are numbered imu1, imu2... when there are several, and a single
+// unnamed port is left untagged so that its samples carry no ID.
+func parseDevicePorts(list string) ([]devicePort, error) {
+	var ports []devicePort
+	seen := map[string]bool{}
+	entries := strings.Split(list, ",")
+	for n, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		id, spec, named := strings.Cut(entry, "=")
+		if !named {
+			id, spec = "", entry
+			if len(entries) > 1 {
+				id = fmt.Sprintf("imu%d", n+1)
+			}
+		}
+		id, spec = strings.TrimSpace(id), strings.TrimSpace(spec)
+		switch {
+		case spec == "":
+			return nil, fmt.Errorf("empty port in %q", list)
+		case named && !deviceID.MatchString(id):
+			return nil, fmt.Errorf("invalid device ID %q, use letters, digits, - and _", id)
+		case seen[id]:
+			return nil, fmt.Errorf("device ID %s is used twice", id)
+		}
+		seen[id] = true
+		ports = append(ports, devicePort{ID: id, Spec: spec})
+	}
+	return ports, nil
+}
+
+// deviceIDs returns the IDs samples of the configuration are tagged with,
+// nil when they are untagged
+func deviceIDs(cfg Config) []string {
+	if cfg.Source != "serial" {
+		return nil
+	}
+	ports, err := parseDevicePorts(cfg.Port)
+	if err != nil || len(ports) == 1 && ports[0].ID == "" {
+		return nil
+	}
+	ids := make([]string, len(ports))
+	for n, p := range ports {
+		ids[n] = p.ID
+	}
+	return ids
+}
+
+// portList is the -port flag, which may be repeated to read several ports,
+// e.g. -port /dev/ttyUSB0 -port /dev/ttyUSB1 is the same as a comma list
+type portList struct {
+	text string
+	set  bool
+}
+
+func newPortList(name, value, usage string) *portList {
+	l := &portList{text: value}
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *portList) String() string { return l.text }
+
+func (l *portList) Set(s string) error {
+	if l.set {
+		s = l.text + "," + s
+	}
+	l.text, l.set = s, true
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// diskCheckInterval is how often the free space of the recording's volume
+// is checked
+const diskCheckInterval = 10 * time.Second
+
+// Policies when the recording's volume runs low
+const (
+	diskFullStop         = "stop"
+	diskFullDeleteOldest = "delete-oldest"
+)
+
+var (
+	diskMinFree = flag.Int("disk-min-free", 500, "Free space in MB below which the recording's volume counts as low and -disk-full applies (0 to not watch it)")
+	diskFull    = flag.String("disk-full", diskFullStop, "What to do when the recording's volume runs low: stop recording, or delete-oldest recordings of the same extension next to it")
+)
+
+// diskStats describes the recording's volume in /api/stats and in "disk"
+// events
+type diskStats struct {
+	Path       string `json:"path"` // Directory of the recording
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
+	MinFree    uint64 `json:"min_free_bytes"`
+	Low        bool   `json:"low"`
+	Policy     string `json:"policy"`
+	Action     string `json:"action,omitempty"` // What was done about it, in events
+	Error      string `json:"error,omitempty"`
+}
+
+// checkDiskPolicy checks the -disk-full policy
+func checkDiskPolicy(policy string) error {
+	switch policy {
+	case diskFullStop, diskFullDeleteOldest:
+		return nil
+	}
+	return fmt.Errorf("unknown -disk-full policy %q, must be %s or %s", policy, diskFullStop, diskFullDeleteOldest)
+}
+
+// watchDisk checks the free space of the recording's volume until the
+// recording stops. Crossing -disk-min-free is logged and sent to clients
+// as a "disk" event, and running low applies the -disk-full policy.
+func (r *recorder) watchDisk() {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		r.checkDisk()
+		select {
+		case <-ticker.C:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// checkDisk measures the free space once and acts on it
+func (r *recorder) checkDisk() {
+	st := r.measureDisk()
+	r.mu.Lock()
+	wasLow := r.disk != nil && r.disk.Low
+	r.disk = &st
+	r.mu.Unlock()
+	if st.Error != "" {
+		return
+	}
+
+	switch {
+	case st.Low && !wasLow:
+		log.Printf("Low disk space for %s: %s free, below %s", r.path, formatMB(st.FreeBytes), formatMB(st.MinFree))
+		event := st
+		event.Action = r.freeDisk(st)
+		defaultNamespace.broadcastEvent("disk", event)
+	case st.Low && st.Policy == diskFullDeleteOldest:
+		// Keep making room while recording
+		event := st
+		if event.Action = r.freeDisk(st); event.Action != "" {
+			defaultNamespace.broadcastEvent("disk", event)
+		}
+	case !st.Low && wasLow:
+		log.Printf("Disk space for %s back to %s free", r.path, formatMB(st.FreeBytes))
+		defaultNamespace.broadcastEvent("disk", st)
+	}
+}
+
+// measureDisk returns the state of the recording's volume
+func (r *recorder) measureDisk() diskStats {
+	st := diskStats{Path: filepath.Dir(r.path), MinFree: uint64(*diskMinFree) << 20, Policy: *diskFull}
+	free, total, err := diskUsage(st.Path)
+	if err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	st.FreeBytes, st.TotalBytes = free, total
+	st.Low = free < st.MinFree
+	return st
+}
+
+// recording reports whether samples are still being recorded
+func (r *recorder) recording() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file != nil
+}
+
+// freeDisk applies the -disk-full policy and describes what it did. Older
+// recordings are deleted until there is enough space again, and recording
+// stops when that isn't enough.
+func (r *recorder) freeDisk(st diskStats) string {
+	if !r.recording() {
+		return ""
+	}
+	if st.Policy == diskFullDeleteOldest {
+		var deleted []string
+		for st.Low {
+			path, ok := r.deleteOldest()
+			if !ok {
+				break
+			}
+			deleted = append(deleted, filepath.Base(path))
+			st = r.measureDisk()
+		}
+		if !st.Low {
+			return "deleted " + strings.Join(deleted, ", ")
+		}
+		log.Printf("No older recordings left to delete next to %s", r.path)
+	}
+	r.stop(fmt.Sprintf("low disk space, %s free", formatMB(st.FreeBytes)))
+	return "stopped recording"
+}
+
+// deleteOldest deletes the oldest recording with the same extension as the
+// one being recorded, in the same directory, with its summaries
+func (r *recorder) deleteOldest() (string, bool) {
+	sets, err := recordingsNextTo(r.path)
+	if err != nil {
+		return "", false
+	}
+	var oldest *retentionSet
+	for n := range sets {
+		if !sets[n].keep && (oldest == nil || sets[n].modified.Before(oldest.modified)) {
+			oldest = &sets[n]
+		}
+	}
+	if oldest == nil {
+		return "", false
+	}
+	path := oldest.files[0]
+	if err := os.Remove(path); err != nil {
+		log.Printf("Error deleting %s to free disk space: %v", path, err)
+		return "", false
+	}
+	for _, s := range oldest.files[1:] {
+		os.Remove(s)
+	}
+	log.Printf("Deleted %s to free disk space", path)
+	return path, true
+}
+
+// formatMB formats a number of bytes in MB
+func formatMB(bytes uint64) string {
+	return fmt.Sprintf("%.0f MB", float64(bytes)/(1<<20))
+}
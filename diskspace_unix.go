@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// diskUsage returns the space available to the server and the size of the
+// volume holding path, in bytes
+func diskUsage(path string) (free, total uint64, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
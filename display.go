@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var streamFlags = newStreamList("stream", "Display settings of a device's stream, as ID:KEY=VALUE,... with the keys name, color (#rrggbb), model and units (deg or rad), and an empty ID for an untagged sensor. May be repeated.")
+
+// StreamDisplay holds how clients should show one device's stream. Settings
+// left out get defaults.
+type StreamDisplay struct {
+	Name  string `json:"name,omitempty"`  // Label, the device ID by default
+	Color string `json:"color,omitempty"` // #rrggbb, picked from the ID by default
+	Model string `json:"model,omitempty"` // Model file to show the device with, the viewer's model by default
+	Units string `json:"units,omitempty"` // Angle units to show the device's angles in, the client's by default
+}
+
+// streamInfo is the display metadata of a device sent to clients
+type streamInfo struct {
+	ID string `json:"id"`
+	StreamDisplay
+}
+
+// streamPalette holds the default colors, picked by a hash of the device ID
+// so that every client shows a device in the same color
+var streamPalette = []string{"#4caf50", "#2196f3", "#ff9800", "#e91e63", "#9c27b0", "#00bcd4", "#ffeb3b", "#795548"}
+
+var hexColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// streamList is the -stream flag, which may be repeated
+type streamList struct {
+	streams map[string]StreamDisplay
+	text    []string
+}
+
+func newStreamList(name, usage string) *streamList {
+	l := &streamList{streams: map[string]StreamDisplay{}}
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *streamList) String() string { return strings.Join(l.text, " ") }
+
+func (l *streamList) Set(s string) error {
+	id, d, err := parseStream(s)
+	if err != nil {
+		return err
+	}
+	if _, ok := l.streams[id]; ok {
+		return fmt.Errorf("stream %q given more than once", id)
+	}
+	l.streams[id], l.text = d, append(l.text, s)
+	return nil
+}
+
+// parseStream parses display settings such as
+// "upper:name=Upper arm,color=#e91e63,model=arm.obj"
+func parseStream(s string) (string, StreamDisplay, error) {
+	var d StreamDisplay
+	id, spec, ok := strings.Cut(s, ":")
+	if !ok || id != "" && !deviceID.MatchString(id) {
+		return "", d, fmt.Errorf("invalid stream %q, expected ID:KEY=VALUE,...", s)
+	}
+	for _, setting := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(setting, "=")
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "name":
+			d.Name = value
+		case "color":
+			d.Color = value
+		case "model":
+			d.Model = value
+		case "units":
+			d.Units = value
+		default:
+			ok = false
+		}
+		if !ok {
+			return "", d, fmt.Errorf("invalid stream setting %q, expected name, color, model or units", setting)
+		}
+	}
+	if err := d.check(); err != nil {
+		return "", d, fmt.Errorf("stream %s: %v", id, err)
+	}
+	return id, d, nil
+}
+
+// check validates the display settings of a stream
+func (d StreamDisplay) check() error {
+	if d.Color != "" && !hexColor.MatchString(d.Color) {
+		return fmt.Errorf("invalid color %q, expected #rrggbb", d.Color)
+	}
+	if d.Model != "" && (strings.ContainsAny(d.Model, `/\`) || strings.HasPrefix(d.Model, ".")) {
+		return fmt.Errorf("invalid model %q, expected a file name", d.Model)
+	}
+	if d.Units != "" {
+		if _, err := quat.ParseUnits(d.Units); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkStreams validates the display settings of every stream
+func checkStreams(streams map[string]StreamDisplay) error {
+	ids := make([]string, 0, len(streams))
+	for id := range streams {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if id != "" && !deviceID.MatchString(id) {
+			return fmt.Errorf("invalid stream ID %q, use letters, digits, - and _", id)
+		}
+		if err := streams[id].check(); err != nil {
+			return fmt.Errorf("stream %q: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// streamInfo returns the display metadata of a device, with defaults for
+// what isn't configured
+func (cfg Config) streamInfo(id string) streamInfo {
+	info := streamInfo{ID: id, StreamDisplay: cfg.Streams[id]}
+	if info.Name == "" {
+		info.Name = id
+		if id == "" {
+			info.Name = "Sensor"
+		}
+	}
+	if info.Color == "" {
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		info.Color = streamPalette[h.Sum32()%uint32(len(streamPalette))]
+	}
+	if info.Units != "" {
+		info.Units, _ = quat.ParseUnits(info.Units)
+	}
+	return info
+}
+
+// streams returns the display metadata of the devices of the namespace,
+// the known ones followed by those only configured, by ID
+func (ns *namespace) streams() []streamInfo {
+	cfg := ns.config()
+	ns.quatMu.RLock()
+	ids := ns.knownDevices()
+	ns.quatMu.RUnlock()
+	var configured []string
+	for id := range cfg.Streams {
+		if !containsString(ids, id) {
+			configured = append(configured, id)
+		}
+	}
+	sort.Strings(configured)
+	list := []streamInfo{}
+	for _, id := range append(ids, configured...) {
+		list = append(list, cfg.streamInfo(id))
+	}
+	return list
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Outcomes of a doctor check
+const (
+	checkPass = "PASS"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+)
+
+// checkResult is the outcome of a single doctor check
+type checkResult struct {
+	Name   string
+	Status string
+	Detail string
+	Hint   string
+}
+
+// doctorChecks are run in order by the doctor command
+var doctorChecks = []func(Config) []checkResult{
+	configChecks,
+	serialChecks,
+	replayChecks,
+	webPortChecks,
+	sinkChecks,
+	clockChecks,
+}
+
+// runDoctor checks the environment for common problems, prints a report and
+// returns the process exit code
+func runDoctor() int {
+	// An unreadable config file is reported by configChecks, carry on with the flags
+	initConfig()
+	cfg := currentConfig()
+
+	var results []checkResult
+	for _, check := range doctorChecks {
+		results = append(results, check(cfg)...)
+	}
+
+	printReport(os.Stdout, results)
+	for _, r := range results {
+		if r.Status == checkFail {
+			return 1
+		}
+	}
+	return 0
+}
+
+// configChecks checks that the config file, if any, parses and holds valid values
+func configChecks(Config) []checkResult {
+	_, err := loadConfig(*configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []checkResult{{Name: "Config file", Status: checkWarn, Detail: *configPath + " not found, using defaults and flags", Hint: "Start the server without -port to run the setup wizard."}}
+	}
+	if err != nil {
+		return []checkResult{{Name: "Config file", Status: checkFail, Detail: err.Error()}}
+	}
+	return []checkResult{{Name: "Config file", Status: checkPass, Detail: *configPath + " is valid"}}
+}
+
+// serialChecks checks that the configured serial devices are present,
+// accessible and not held by another process
+func serialChecks(cfg Config) []checkResult {
+	if cfg.Source != "serial" {
+		return nil
+	}
+	ports, err := parseDevicePorts(cfg.Port)
+	if err != nil {
+		return []checkResult{{Name: "Serial device", Status: checkFail, Detail: err.Error(), Hint: "Fix the list of ports given with -port."}}
+	}
+	var results []checkResult
+	for _, p := range ports {
+		results = append(results, serialPortChecks(p, cfg.Baud, cfg.lineFormat())...)
+	}
+	return results
+}
+
+// serialPortChecks checks one serial device, naming it by its ID when it
+// has one. With -port auto, the ports are probed for it with the format.
+func serialPortChecks(p devicePort, baud int, format *lineFormat) []checkResult {
+	suffix := ""
+	if p.ID != "" {
+		suffix = " " + p.ID
+	}
+	if isAutoPort(p.Spec) {
+		name, err := findSensorPort(p.Spec, baud, format)
+		if err != nil {
+			return []checkResult{{Name: "Serial device" + suffix, Status: checkFail, Detail: err.Error(), Hint: "Plug the sensor in and check -baud and -format, or name its port with -port, see quatplot list-ports."}}
+		}
+		p.Spec = name
+	}
+	path, err := resolvePortName(p.Spec)
+	if err != nil {
+		return []checkResult{{Name: "Serial device" + suffix, Status: checkFail, Detail: err.Error(), Hint: "Run with -port set to the device, or plug it in."}}
+	}
+	if _, err := os.Stat(path); err != nil {
+		// Windows COM ports can't be stat'ed, fall back to the port list there
+		if !portListed(path) {
+			return []checkResult{{Name: "Serial device" + suffix, Status: checkFail, Detail: path + " not found", Hint: "Check that the device is plugged in and the port name is correct."}}
+		}
+	}
+
+	results := []checkResult{{Name: "Serial device" + suffix, Status: checkPass, Detail: path + " present"}}
+	results = append(results, serialPermissionChecks(path)...)
+
+	port, release, err := openSerialPort(path, &serial.Mode{BaudRate: baud})
+	if err != nil {
+		st := classifyOpenError(path, err)
+		return append(results, checkResult{Name: "Serial availability" + suffix, Status: checkFail, Detail: st.Message, Hint: st.Hint})
+	}
+	port.Close()
+	release()
+	return append(results, checkResult{Name: "Serial availability" + suffix, Status: checkPass, Detail: fmt.Sprintf("opened %s at %d baud", path, baud)})
+}
+
+// replayChecks checks that the recording played by the file source, or the
+// capture played by the raw source, can be read
+func replayChecks(cfg Config) []checkResult {
+	var src Source
+	switch cfg.Source {
+	case "file":
+		src = newFileSource(cfg)
+	case "raw":
+		src = newRawSource(cfg)
+	default:
+		return nil
+	}
+	if err := src.Open(); err != nil {
+		return []checkResult{{Name: "Recording", Status: checkFail, Detail: err.Error(), Hint: "Check the path given with -file or to the replay command."}}
+	}
+	src.Close()
+	return []checkResult{{Name: "Recording", Status: checkPass, Detail: cfg.File + " is readable"}}
+}
+
+// webPortChecks checks that the HTTP port is free
+func webPortChecks(Config) []checkResult {
+	l, err := net.Listen("tcp", ":"+*webPort)
+	if err != nil {
+		return []checkResult{{Name: "Web port", Status: checkFail, Detail: err.Error(), Hint: "Another server is using the port, stop it or choose a different one with -web."}}
+	}
+	l.Close()
+	return []checkResult{{Name: "Web port", Status: checkPass, Detail: ":" + *webPort + " is free"}}
+}
+
+// sinkChecks checks that the destination of every configured output sink is reachable
+func sinkChecks(Config) []checkResult {
+	configured, err := configuredSinks()
+	if err != nil {
+		return []checkResult{{Name: "Sinks", Status: checkFail, Detail: err.Error()}}
+	}
+	var results []checkResult
+	for name, s := range configured {
+		checker, ok := s.(sinkChecker)
+		if !ok {
+			continue
+		}
+		if err := checker.Check(); err != nil {
+			results = append(results, checkResult{Name: "Sink " + name, Status: checkFail, Detail: s.Target() + ": " + err.Error(), Hint: "Check that the server is running and reachable from this machine."})
+			continue
+		}
+		results = append(results, checkResult{Name: "Sink " + name, Status: checkPass, Detail: s.Target() + " is reachable"})
+	}
+	return results
+}
+
+// clockChecks checks that the system clock is plausible, recordings and
+// timestamps are useless when it has been reset to the epoch on boot
+func clockChecks(Config) []checkResult {
+	now := time.Now()
+	earliest := minPlausibleTime()
+	var results []checkResult
+	switch {
+	case now.Before(earliest):
+		results = append(results, checkResult{Name: "Clock", Status: checkFail, Detail: "system time " + now.Format(time.RFC3339) + " is before " + earliest.Format("2006-01-02"), Hint: "Set the clock or enable NTP (e.g. `timedatectl set-ntp true`)."})
+	case now.After(earliest.AddDate(20, 0, 0)):
+		results = append(results, checkResult{Name: "Clock", Status: checkWarn, Detail: "system time " + now.Format(time.RFC3339) + " is implausibly far in the future"})
+	default:
+		results = append(results, checkResult{Name: "Clock", Status: checkPass, Detail: now.Format(time.RFC3339)})
+	}
+	return append(results, clockRefChecks()...)
+}
+
+// clockRefChecks measures the offset to the -clock-ref server, if set
+func clockRefChecks() []checkResult {
+	if *clockRef == "" {
+		return nil
+	}
+	c, err := newClockSync(*clockRef)
+	if err != nil {
+		return []checkResult{{Name: "Clock reference", Status: checkFail, Detail: err.Error()}}
+	}
+	offset, delay, err := c.measure()
+	if err != nil {
+		return []checkResult{{Name: "Clock reference", Status: checkFail, Detail: err.Error(), Hint: "Check that the server given with -clock-ref is running and reachable."}}
+	}
+	return []checkResult{{Name: "Clock reference", Status: checkPass, Detail: fmt.Sprintf("offset %v to %s, round trip %v", offset, c.ref, delay)}}
+}
+
+// minPlausibleTime returns the commit time of this build, or a fixed date
+// when the binary carries no VCS information
+func minPlausibleTime() time.Time {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.time" {
+				if t, err := time.Parse(time.RFC3339, s.Value); err == nil {
+					return t
+				}
+			}
+		}
+	}
+	return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// portListed reports whether a port appears in the serial port list
+func portListed(name string) bool {
+	ports, err := serial.GetPortsList()
+	if err != nil {
+		return false
+	}
+	for _, p := range ports {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// printReport writes the results of the doctor checks
+func printReport(w io.Writer, results []checkResult) {
+	failed := 0
+	for _, r := range results {
+		fmt.Fprintf(w, "[%s] %s: %s\n", r.Status, r.Name, r.Detail)
+		if r.Hint != "" && r.Status != checkPass {
+			fmt.Fprintf(w, "       %s\n", r.Hint)
+		}
+		if r.Status == checkFail {
+			failed++
+		}
+	}
+	if failed == 0 {
+		fmt.Fprintln(w, "\nAll checks passed.")
+	} else {
+		fmt.Fprintf(w, "\n%d check(s) failed.\n", failed)
+	}
+}
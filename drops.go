@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Why a client missed samples
+const (
+	dropConflated    = "conflated"    // Replaced by a newer sample before being sent
+	dropRateLimited  = "rate_limited" // Skipped by the adaptive rate limit
+	dropDisconnected = "disconnected" // Sent while the client was reconnecting
+)
+
+// dropMergeGap is how close together misses of the same kind must be to
+// count as one range
+const dropMergeGap = 250 * time.Millisecond
+
+// maxDropRanges is how many ranges are kept for each client, oldest first
+const maxDropRanges = 500
+
+// dropRange is a stretch of time in which a client didn't get every sample,
+// so that what it shows or analyses there is degraded
+type dropRange struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Reason   string    `json:"reason"`  // conflated, rate_limited or disconnected
+	Samples  uint64    `json:"samples"` // Samples the client didn't get
+	FirstSeq uint64    `json:"first_seq"`
+	LastSeq  uint64    `json:"last_seq"`
+}
+
+// dropLog remembers when a client missed samples. It is kept with the
+// client's resume token, so that the ranges of a viewer that reconnects
+// carry on where they left off.
+type dropLog struct {
+	mu     sync.Mutex
+	ranges []dropRange
+	left   time.Time // When the client last disconnected
+}
+
+// add records a sample the client missed, extending the last range when it
+// is of the same kind and recent
+func (l *dropLog) add(reason string, seq uint64, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := len(l.ranges); n > 0 {
+		last := &l.ranges[n-1]
+		if last.Reason == reason && now.Sub(last.End) <= dropMergeGap {
+			last.End = now
+			last.Samples++
+			last.FirstSeq, last.LastSeq = min(last.FirstSeq, seq), max(last.LastSeq, seq)
+			return
+		}
+	}
+	l.append(dropRange{Start: now, End: now, Reason: reason, Samples: 1, FirstSeq: seq, LastSeq: seq})
+}
+
+// addGap records the samples a client missed while it was reconnecting
+func (l *dropLog) addGap(info resumeInfo, now time.Time) {
+	if info.Missed == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := l.left
+	if start.IsZero() {
+		start = now
+	}
+	l.append(dropRange{Start: start, End: now, Reason: dropDisconnected, Samples: info.Missed, FirstSeq: info.FromSeq, LastSeq: info.ToSeq})
+}
+
+// append adds a range, forgetting the oldest beyond maxDropRanges. Must be
+// called with l.mu held.
+func (l *dropLog) append(r dropRange) {
+	if len(l.ranges) >= maxDropRanges {
+		l.ranges = append(l.ranges[:0], l.ranges[1:]...)
+	}
+	l.ranges = append(l.ranges, r)
+}
+
+// disconnected notes when the client left, for the gap it finds on
+// reconnecting
+func (l *dropLog) disconnected(now time.Time) {
+	l.mu.Lock()
+	l.left = now
+	l.mu.Unlock()
+}
+
+// since returns the ranges that ended at or after the given time
+func (l *dropLog) since(t time.Time) []dropRange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ranges := []dropRange{}
+	for _, r := range l.ranges {
+		if !r.End.Before(t) {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// clientDrops are the ranges in which one client missed samples
+type clientDrops struct {
+	ID        int64       `json:"id,omitempty"` // Omitted for a token whose client is disconnected
+	Addr      string      `json:"addr,omitempty"`
+	Client    string      `json:"client,omitempty"` // Name the client gave in its hello
+	Connected bool        `json:"connected"`
+	Ranges    []dropRange `json:"ranges"`
+}
+
+// handleDrops reports when clients missed samples, e.g.
+// GET /api/clients/drops for every connected client,
+// GET /api/clients/drops?client=3 for one of them, or
+// GET /api/clients/drops?token=... for the client holding a resume token,
+// which a viewer reads from its session event to check its own samples.
+// since=RFC3339 leaves out ranges that ended before then.
+func handleDrops(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	ns := requestNamespace(r)
+
+	var list []clientDrops
+	if token := q.Get("token"); token != "" {
+		drops := tokenDrops(ns, token)
+		if drops == nil {
+			http.Error(w, "unknown or expired token", http.StatusNotFound)
+			return
+		}
+		cd := clientDrops{Ranges: drops.since(since)}
+		ns.clientsMu.Lock()
+		for _, c := range ns.clients {
+			if c.token == token {
+				cd.ID, cd.Addr, cd.Client, cd.Connected = c.id, c.addr, c.clientName(), true
+			}
+		}
+		ns.clientsMu.Unlock()
+		list = append(list, cd)
+	} else {
+		var id int64
+		if s := q.Get("client"); s != "" {
+			var err error
+			if id, err = strconv.ParseInt(s, 10, 64); err != nil {
+				http.Error(w, "client must be a client ID from /api/stats", http.StatusBadRequest)
+				return
+			}
+		}
+		ns.clientsMu.Lock()
+		for _, c := range ns.clients {
+			if id == 0 || c.id == id {
+				list = append(list, clientDrops{ID: c.id, Addr: c.addr, Client: c.clientName(), Connected: true, Ranges: c.drops.since(since)})
+			}
+		}
+		ns.clientsMu.Unlock()
+		if id != 0 && len(list) == 0 {
+			http.Error(w, "no such client", http.StatusNotFound)
+			return
+		}
+		sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+	}
+	if list == nil {
+		list = []clientDrops{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Clients []clientDrops `json:"clients"`
+	}{list})
+}
+
+// clientName returns the name the client gave in its hello
+func (c *client) clientName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
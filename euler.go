@@ -0,0 +1,18 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+const (
+	defaultEulerOrder   = quat.DefaultOrder
+	defaultEulerFormat  = "roll,pitch,yaw"
+	defaultMatrixFormat = "m11,m12,m13,m21,m22,m23,m31,m32,m33"
+)
+
+var (
+	eulerUnits = flag.String("euler-units", quat.Degrees, "Units of Euler angle input (deg or rad)")
+	eulerOrder = flag.String("euler-order", defaultEulerOrder, "Rotation order of Euler angle input, intrinsic axes applied left to right, e.g. ZYX for yaw, then pitch, then roll")
+)
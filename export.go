@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	anonymize    = flag.Bool("anonymize", false, "Remove the host name, device and time zone from exported recordings")
+	relativeTime = flag.Bool("relative-time", false, "Shift the times in exported recordings so that they start at the Unix epoch")
+	exportFormat = flag.String("export-format", "", "Format of exported recordings, jsonl or csv (default: csv for .csv files, otherwise jsonl)")
+)
+
+// runExport copies a recording, e.g. to share it, converting its format,
+// anonymizing it or shifting its times as requested by the flags. It
+// returns the process exit code.
+func runExport() int {
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		fmt.Fprintln(os.Stderr, "usage: quatplot export [flags] RECORDING [OUTPUT]")
+		return 2
+	}
+	if _, err := initConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 1
+	}
+	in, out := flag.Arg(0), flag.Arg(1)
+	format, err := recordingFormat(out, *exportFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	recording, err := openRecording(in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer recording.Close()
+
+	w := io.Writer(os.Stdout)
+	if out != "" && out != "-" {
+		if sameFile(in, out) {
+			fmt.Fprintln(os.Stderr, "the output must be a different file from the recording")
+			return 2
+		}
+		f, err := os.Create(out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var (
+		buf     bytes.Buffer
+		shift   time.Duration
+		shifted bool
+		samples int
+		skipped int
+	)
+	// shiftTime moves t back by the offset of the first session, found from start
+	shiftTime := func(t, start time.Time) time.Time {
+		if !shifted {
+			shift, shifted = start.Sub(time.Unix(0, 0)), true
+		}
+		return t.Add(-shift).UTC()
+	}
+	for {
+		header, sample, err := recording.next()
+		var bad *badLineError
+		if errors.As(err, &bad) {
+			skipped++
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", in, err)
+			return 1
+		}
+
+		if header != nil {
+			// Written in the current format, whatever the version read
+			header.Version = recordingVersion
+			if *anonymize {
+				header.Host, header.Device, header.ClockRef = "", "", ""
+				header.Started = header.Started.UTC()
+			}
+			if *relativeTime {
+				header.Started = shiftTime(header.Started, header.Started)
+			}
+			writeRecordingHeader(&buf, format, *header)
+		} else {
+			if *anonymize {
+				sample.Time = sample.Time.UTC()
+			}
+			if *relativeTime {
+				sample.Time = shiftTime(sample.Time, sample.Time.Add(-time.Duration(sample.MonoNS)))
+			}
+			if sample.RefTime != nil {
+				// Shifted like the local time, keeping the offset between the clocks
+				t := *sample.RefTime
+				if *anonymize {
+					t = t.UTC()
+				}
+				if *relativeTime {
+					t = t.Add(-shift).UTC()
+				}
+				sample.RefTime = &t
+			}
+			writeRecordedSample(&buf, format, sample)
+			samples++
+		}
+		if buf.Len() >= recordFlushSize {
+			if _, err := buf.WriteTo(w); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+	}
+	if _, err := buf.WriteTo(w); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d samples", samples)
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, ", skipped %d lines that didn't parse", skipped)
+	}
+	fmt.Fprintln(os.Stderr)
+	return 0
+}
+
+// sameFile reports whether two paths name the same existing file
+func sameFile(a, b string) bool {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	ib, err := os.Stat(b)
+	return err == nil && os.SameFile(ia, ib)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var (
+	fenceFlags    = newFenceList("fence", "Orientation cone a sensor axis must stay in, as NAME=X,Y,Z:DEGREES[:BX,BY,BZ] with the cone's axis in the reference frame and the sensor axis, X by default. May be repeated.")
+	fenceDebounce = flag.Duration("fence-debounce", time.Second, "How long a sensor must stay outside or back inside a -fence cone before an event is raised")
+)
+
+// Fence states reported in events and /api/fences
+const (
+	fenceInside  = "inside"
+	fenceOutside = "outside"
+)
+
+// fence is an allowed orientation: a cone about an axis of the reference
+// frame that an axis of the sensor must point within
+type fence struct {
+	name      string
+	axis      quat.Vector // Unit axis of the cone, in the reference frame
+	halfAngle float64     // Degrees
+	body      quat.Vector // Unit axis of the sensor that must stay in the cone
+}
+
+// fenceList is the -fence flag, which may be repeated
+type fenceList struct {
+	fences []fence
+	text   []string
+}
+
+func newFenceList(name, usage string) *fenceList {
+	l := &fenceList{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *fenceList) String() string { return strings.Join(l.text, " ") }
+
+func (l *fenceList) Set(s string) error {
+	f, err := parseFence(s)
+	if err != nil {
+		return err
+	}
+	for _, other := range l.fences {
+		if other.name == f.name {
+			return fmt.Errorf("fence %q given more than once", f.name)
+		}
+	}
+	l.fences, l.text = append(l.fences, f), append(l.text, s)
+	return nil
+}
+
+// parseFence parses a fence such as "antenna=0,0,1:10" or
+// "camera=1,0,0:5:0,0,-1"
+func parseFence(s string) (fence, error) {
+	name, spec, ok := strings.Cut(s, "=")
+	if !ok || !deviceID.MatchString(name) {
+		return fence{}, fmt.Errorf("invalid fence %q, expected NAME=X,Y,Z:DEGREES[:BX,BY,BZ]", s)
+	}
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return fence{}, fmt.Errorf("invalid fence %q, expected NAME=X,Y,Z:DEGREES[:BX,BY,BZ]", s)
+	}
+	f := fence{name: name, body: quat.Vector{X: 1}}
+	axis, err := parseAxis(parts[0])
+	if err != nil {
+		return fence{}, fmt.Errorf("fence %s: %v", name, err)
+	}
+	f.axis = quat.Vector{X: axis[0], Y: axis[1], Z: axis[2]}
+	if f.halfAngle, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil || f.halfAngle <= 0 || f.halfAngle >= 180 {
+		return fence{}, fmt.Errorf("fence %s: invalid half-angle %q, expected degrees between 0 and 180", name, parts[1])
+	}
+	if len(parts) == 3 {
+		body, err := parseAxis(parts[2])
+		if err != nil {
+			return fence{}, fmt.Errorf("fence %s: sensor %v", name, err)
+		}
+		f.body = quat.Vector{X: body[0], Y: body[1], Z: body[2]}
+	}
+	return f, nil
+}
+
+// offAxis returns the angle in degrees between the fence's sensor axis, as
+// rotated by q, and the axis of its cone
+func (f fence) offAxis(q Quaternion) float64 {
+	q, ok := quat.Normalize(q)
+	if !ok {
+		return 0
+	}
+	v := quat.Rotate(q, f.body)
+	dot := v.X*f.axis.X + v.Y*f.axis.Y + v.Z*f.axis.Z
+	return math.Acos(math.Max(-1, math.Min(1, dot))) * 180 / math.Pi
+}
+
+// fenceState tracks whether one device is inside one fence
+type fenceState struct {
+	outside  bool
+	since    time.Time // When the current state began
+	changing time.Time // When samples started disagreeing with the state, zero while they agree
+	angle    float64   // Off-axis angle of the latest sample, degrees
+}
+
+// fenceKey identifies the state of a device in a fence
+type fenceKey struct {
+	fence  string
+	device string
+}
+
+var (
+	fenceMu     sync.Mutex
+	fenceStates = map[fenceKey]*fenceState{}
+)
+
+// fenceEvent is the payload of a fence event, sent when a device has been
+// outside a fence, or back inside it, for -fence-debounce
+type fenceEvent struct {
+	Fence        string    `json:"fence"`
+	ID           string    `json:"id,omitempty"`
+	State        string    `json:"state"`
+	AngleDeg     float64   `json:"angle_deg"`
+	HalfAngleDeg float64   `json:"half_angle_deg"`
+	Since        time.Time `json:"since"`
+}
+
+// checkFences updates the state of a device in every fence with a new
+// sample, and raises an event for each state that has changed for longer
+// than the debounce period
+func (ns *namespace) checkFences(device string, quat Quaternion, now time.Time) {
+	if len(fenceFlags.fences) == 0 {
+		return
+	}
+	var events []fenceEvent
+	fenceMu.Lock()
+	for _, f := range fenceFlags.fences {
+		key := fenceKey{f.name, device}
+		st := fenceStates[key]
+		if st == nil {
+			st = &fenceState{since: now}
+			fenceStates[key] = st
+		}
+		st.angle = f.offAxis(quat)
+		outside := st.angle > f.halfAngle
+		if outside == st.outside {
+			st.changing = time.Time{}
+			continue
+		}
+		if st.changing.IsZero() {
+			st.changing = now
+		}
+		if now.Sub(st.changing) < *fenceDebounce {
+			continue
+		}
+		st.outside, st.since, st.changing = outside, st.changing, time.Time{}
+		events = append(events, fenceEvent{Fence: f.name, ID: device, State: st.state(), AngleDeg: st.angle, HalfAngleDeg: f.halfAngle, Since: st.since})
+	}
+	fenceMu.Unlock()
+
+	for _, e := range events {
+		name := e.Fence
+		if e.ID != "" {
+			name += " (" + e.ID + ")"
+		}
+		if e.State == fenceOutside {
+			log.Printf("Fence %s: left the cone, %.1f° off axis", name, e.AngleDeg)
+		} else {
+			log.Printf("Fence %s: back inside the cone", name)
+		}
+		ns.broadcastEvent("fence", e)
+	}
+}
+
+func (st *fenceState) state() string {
+	if st.outside {
+		return fenceOutside
+	}
+	return fenceInside
+}
+
+// fenceInfo describes a fence and the state of each device in /api/fences
+type fenceInfo struct {
+	Name         string             `json:"name"`
+	Axis         quat.Vector        `json:"axis"`
+	BodyAxis     quat.Vector        `json:"body_axis"`
+	HalfAngleDeg float64            `json:"half_angle_deg"`
+	Devices      []fenceDeviceState `json:"devices"`
+}
+
+type fenceDeviceState struct {
+	ID       string    `json:"id,omitempty"`
+	State    string    `json:"state"`
+	AngleDeg float64   `json:"angle_deg"`
+	Since    time.Time `json:"since"`
+	Changing bool      `json:"changing,omitempty"` // Samples disagree with the state, which changes after -fence-debounce
+}
+
+// handleFences lists the fences and whether each device is inside them
+func handleFences(w http.ResponseWriter, r *http.Request) {
+	fenceMu.Lock()
+	infos := make([]fenceInfo, 0, len(fenceFlags.fences))
+	for _, f := range fenceFlags.fences {
+		info := fenceInfo{Name: f.name, Axis: f.axis, BodyAxis: f.body, HalfAngleDeg: f.halfAngle, Devices: []fenceDeviceState{}}
+		for key, st := range fenceStates {
+			if key.fence == f.name {
+				info.Devices = append(info.Devices, fenceDeviceState{ID: key.device, State: st.state(), AngleDeg: st.angle, Since: st.since, Changing: !st.changing.IsZero()})
+			}
+		}
+		sort.Slice(info.Devices, func(a, b int) bool { return info.Devices[a].ID < info.Devices[b].ID })
+		infos = append(infos, info)
+	}
+	fenceMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerSource("file", sourceType{new: newFileSource, once: true, hamilton: true})
+}
+
+var (
+	replayFile  = flag.String("file", "", "Recording the file source plays back, e.g. session.qlog, or raw capture the raw source plays back")
+	replaySpeed = flag.Float64("speed", 1, "Playback speed of the file source, e.g. 0.5 for half speed or 10 for ten times faster")
+)
+
+// fileSource plays back a recording made with -record, keeping the timing
+// between samples. Each session in the recording starts playing straight
+// after the previous one ends.
+type fileSource struct {
+	path  string
+	speed float64
+
+	recording *recordingReader
+	start     time.Time // Wall clock time the current session started playing
+	first     int64     // mono_ns of the first sample of the current session, -1 before it
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFileSource(cfg Config) Source {
+	return &fileSource{path: cfg.File, speed: *replaySpeed}
+}
+
+func (s *fileSource) String() string { return s.path }
+
+func (s *fileSource) Open() error {
+	if s.path == "" {
+		return errors.New("no recording to play, set -file")
+	}
+	if s.speed <= 0 {
+		return fmt.Errorf("invalid speed %v, must be greater than 0", s.speed)
+	}
+	recording, err := openRecording(s.path)
+	if err != nil {
+		return err
+	}
+	s.recording = recording
+	s.first = -1
+	s.closed = make(chan struct{})
+	return nil
+}
+
+func (s *fileSource) ReadQuaternion() (Quaternion, error) {
+	_, quat, err := s.ReadTagged()
+	return quat, err
+}
+
+// ReadTagged returns the next sample with the ID of the device it was
+// recorded from
+func (s *fileSource) ReadTagged() (string, Quaternion, error) {
+	for {
+		header, sample, err := s.recording.next()
+		var bad *badLineError
+		if errors.As(err, &bad) {
+			log.Printf("Error parsing %s: %v", s.path, err)
+			continue
+		}
+		if err != nil {
+			return "", Quaternion{}, err
+		}
+		if header != nil {
+			s.first = -1
+			continue
+		}
+
+		if s.first < 0 {
+			s.first, s.start = sample.MonoNS, time.Now()
+		}
+		due := s.start.Add(time.Duration(float64(sample.MonoNS-s.first) / s.speed))
+		select {
+		case <-time.After(time.Until(due)):
+		case <-s.closed:
+			return "", Quaternion{}, errors.New("source closed")
+		}
+		return sample.ID, sample.Quaternion, nil
+	}
+}
+
+// Close stops playback. It may be called from another goroutine to
+// interrupt the wait for the next sample, and more than once.
+func (s *fileSource) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.recording.Close()
+	})
+	return err
+}
+
+// runReplay parses the arguments of the replay command, which serves a
+// recording with the file source as if it were arriving live
+func runReplay(args []string) error {
+	parseFlags(args)
+	if flag.NArg() != 1 {
+		return errors.New("usage: quatplot replay [flags] FILE")
+	}
+	flag.Set("source", "file")
+	return flag.Set("file", flag.Arg(0))
+}
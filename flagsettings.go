@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// envPrefix starts the environment variables that set flags, e.g.
+// QUATPLOT_PORT for -port or QUATPLOT_RECORD_FORMAT for -record-format
+const envPrefix = "QUATPLOT_"
+
+// flagSetting is the value of a flag in the flags section of the
+// configuration file, which may also be written as a number or a boolean
+type flagSetting string
+
+func (s *flagSetting) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		*s = flagSetting(v)
+	case float64, bool:
+		// The text as written, so that 115200 isn't read as 1.152e+05
+		*s = flagSetting(data)
+	default:
+		return errors.New("expected a string, number or boolean")
+	}
+	return nil
+}
+
+// parseFlags parses the command line, then sets the flags it doesn't give
+// from the environment
+func parseFlags(args []string) {
+	flag.CommandLine.Parse(args)
+	if err := applyEnvFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+// envName returns the environment variable setting a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvFlags sets the flags not given on the command line from their
+// QUATPLOT_* environment variables. Unknown variables are warned about, as
+// they are usually misspelt.
+func applyEnvFlags() error {
+	given := givenFlags()
+	// The encryption and signing keys have no flag, so that they aren't seen
+	// in the process list
+	known := map[string]bool{encryptionKeyEnv: true, signingKeyEnv: true}
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		known[name] = true
+		value, ok := os.LookupEnv(name)
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s: %v", name, setErr)
+		}
+	})
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, envPrefix) || known[name] {
+			continue
+		}
+		hint, dist := "", len(name)/2+2
+		for k := range known {
+			if d := editDistance(name, k); d < dist || d == dist && k < hint {
+				hint, dist = k, d
+			}
+		}
+		if hint != "" {
+			hint = "; did you mean " + hint + "?"
+		}
+		log.Printf("Ignoring %s, no flag is set by it%s", name, hint)
+	}
+	return err
+}
+
+// givenFlags returns the flags set on the command line or, once applied,
+// by the environment
+func givenFlags() map[string]bool {
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	return given
+}
+
+// settingFlags are flags that have a setting of their own in the
+// configuration file, which is used instead of the flags section
+var settingFlags = map[string]string{
+	"simulate": "source",
+	"stream":   "streams",
+}
+
+// checkFileFlag checks that a key of the flags section of the configuration
+// file names a flag without a setting of its own. Keys may be written with
+// _ in place of -.
+func checkFileFlag(key string) error {
+	name := strings.ReplaceAll(key, "_", "-")
+	if flag.Lookup(name) == nil {
+		var names []string
+		flag.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+		return fmt.Errorf("unknown flag%s", didYouMean(name, names))
+	}
+	setting := settingFlags[name]
+	if field := strings.ReplaceAll(name, "-", "_"); containsString(configFields(), field) {
+		setting = field
+	}
+	switch {
+	case name == "config":
+		return errors.New("the configuration file can't name another one")
+	case setting != "":
+		return fmt.Errorf("set %s instead, outside the flags section", setting)
+	}
+	return nil
+}
+
+// applyFileFlags sets the flags of the flags section of the configuration
+// file that aren't given on the command line or in the environment
+func applyFileFlags(flags map[string]flagSetting) error {
+	given := givenFlags()
+	keys := make([]string, 0, len(flags))
+	for key := range flags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := strings.ReplaceAll(key, "_", "-")
+		if err := checkFileFlag(key); err != nil {
+			return fmt.Errorf("flags.%s: %v", key, err)
+		}
+		if given[name] {
+			continue
+		}
+		if err := flag.Set(name, string(flags[key])); err != nil {
+			return fmt.Errorf("flags.%s: %v", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	fleetDirectory = flag.Bool("fleet-directory", false, "Serve a directory of the quatplot servers that register with -fleet-register, at /fleet")
+	fleetRegister  = flag.String("fleet-register", "", "Base URL of a quatplot directory this server registers with, e.g. http://lab-hub:8080")
+	fleetName      = flag.String("fleet-name", "", "Name of this server in the directory (default: the host name)")
+	fleetURL       = flag.String("fleet-url", "", "Base URL the directory links to this server's viewer at (default: the host name and -web port)")
+	fleetInterval  = flag.Duration("fleet-interval", 10*time.Second, "How often this server sends its heartbeat to -fleet-register")
+	fleetToken     = flag.String("fleet-token", "", "Shared secret servers register with, required by a directory that sets it")
+)
+
+const (
+	// fleetMissedHeartbeats is how many heartbeats a server may miss before
+	// the directory shows it offline
+	fleetMissedHeartbeats = 3
+	// fleetForget is how long the directory shows a server that went offline
+	fleetForget = time.Hour
+	// maxFleetNodes is how many servers a directory keeps
+	maxFleetNodes = 1000
+	// minFleetInterval and maxFleetInterval bound the interval a heartbeat
+	// gives, so that a server isn't shown live long after it went away
+	minFleetInterval = time.Second
+	maxFleetInterval = 10 * time.Minute
+)
+
+// fleetKey identifies this server process to the directory, which keeps
+// its name for it
+var fleetKey = newRandomID()
+
+// fleetLink is a page of a server the directory links to
+type fleetLink struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// fleetSensor is one input of a server, as sent in its heartbeat
+type fleetSensor struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	State string `json:"state"`
+	Port  string `json:"port,omitempty"`
+}
+
+// fleetHeartbeat is what a server sends the directory every -fleet-interval
+type fleetHeartbeat struct {
+	Name      string        `json:"name"`
+	URL       string        `json:"url"`
+	Started   time.Time     `json:"started"`
+	Interval  float64       `json:"interval_s"`    // Seconds until the next heartbeat
+	Key       string        `json:"key,omitempty"` // Random ID of the server process, not listed
+	Leaving   bool          `json:"leaving,omitempty"`
+	Sensors   []fleetSensor `json:"sensors"`
+	Clients   int           `json:"clients"`
+	InputRate float64       `json:"input_rate_hz"`
+	Links     []fleetLink   `json:"links"`
+}
+
+// fleetNode is a registered server, as the directory lists it
+type fleetNode struct {
+	fleetHeartbeat
+	Addr      string    `json:"addr"` // Address the heartbeat came from
+	Live      bool      `json:"live"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	key  string // Key of the process that holds the name
+	host string // Host the heartbeats come from
+}
+
+var (
+	fleetMu    sync.Mutex
+	fleetNodes = map[string]*fleetNode{}
+)
+
+// startFleetRegistration starts sending heartbeats to -fleet-register, if
+// set
+func startFleetRegistration() error {
+	if *fleetRegister == "" {
+		return nil
+	}
+	u, err := url.Parse(*fleetRegister)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid -fleet-register %q, expected a URL such as http://lab-hub:8080", *fleetRegister)
+	}
+	if *fleetInterval < time.Second {
+		return fmt.Errorf("invalid -fleet-interval %v, must be at least 1s", *fleetInterval)
+	}
+	if *fleetURL != "" {
+		if u, err := url.Parse(*fleetURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid -fleet-url %q, expected a URL such as http://rig-3:8080", *fleetURL)
+		}
+	}
+	go registerLoop(strings.TrimRight(*fleetRegister, "/")+"/api/fleet/register", &http.Client{Timeout: 5 * time.Second})
+	return nil
+}
+
+// registerLoop sends a heartbeat every -fleet-interval, logging when the
+// directory stops or starts accepting them
+func registerLoop(endpoint string, client *http.Client) {
+	var lastErr string
+	registered := false
+	for {
+		if err := sendHeartbeat(client, endpoint, fleetStatus(false)); err != nil {
+			if err.Error() != lastErr {
+				log.Printf("Error registering with the directory %s: %v", *fleetRegister, err)
+			}
+			lastErr = err.Error()
+		} else {
+			if !registered || lastErr != "" {
+				log.Printf("Registered with the directory %s as %s", *fleetRegister, fleetSelfName())
+			}
+			registered, lastErr = true, ""
+		}
+		time.Sleep(*fleetInterval)
+	}
+}
+
+// leaveFleet tells the directory this server is shutting down, so that it
+// shows it offline straight away
+func leaveFleet() {
+	if *fleetRegister == "" {
+		return
+	}
+	endpoint := strings.TrimRight(*fleetRegister, "/") + "/api/fleet/register"
+	if err := sendHeartbeat(&http.Client{Timeout: 2 * time.Second}, endpoint, fleetStatus(true)); err != nil {
+		log.Printf("Error leaving the directory %s: %v", *fleetRegister, err)
+	}
+}
+
+// sendHeartbeat posts a heartbeat to the directory
+func sendHeartbeat(client *http.Client, endpoint string, hb fleetHeartbeat) error {
+	body, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *fleetToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*fleetToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the directory returned %s", resp.Status)
+	}
+	return nil
+}
+
+// fleetStatus returns the heartbeat of this server: its sensors, viewers and
+// the pages of each namespace
+func fleetStatus(leaving bool) fleetHeartbeat {
+	base := fleetSelfURL()
+	st := collectStats(defaultNamespace)
+	hb := fleetHeartbeat{
+		Name:      fleetSelfName(),
+		URL:       base,
+		Started:   startTime,
+		Interval:  fleetInterval.Seconds(),
+		Key:       fleetKey,
+		Leaving:   leaving,
+		Sensors:   []fleetSensor{},
+		Clients:   st.Clients,
+		InputRate: st.InputRate,
+	}
+	for _, s := range defaultNamespace.sourceList() {
+		info := s.info()
+		hb.Sensors = append(hb.Sensors, fleetSensor{ID: info.ID, Kind: info.Kind, State: info.Status.State, Port: info.Status.Port})
+	}
+	for _, ns := range namespaces() {
+		name := "Viewer"
+		if ns.name != "" {
+			name = "Viewer of " + ns.name
+		}
+		hb.Links = append(hb.Links, fleetLink{Name: name, URL: base + ns.path("/")})
+	}
+	hb.Links = append(hb.Links, fleetLink{Name: "Status", URL: base + "/status"})
+	return hb
+}
+
+// fleetSelfName returns the name this server registers as
+func fleetSelfName() string {
+	if *fleetName != "" {
+		return *fleetName
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "quatplot"
+	}
+	return host
+}
+
+// fleetSelfURL returns the base URL the directory links to
+func fleetSelfURL() string {
+	if *fleetURL != "" {
+		return strings.TrimRight(*fleetURL, "/")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s://%s:%s", webScheme(), host, *webPort)
+}
+
+// isFleetRegistration reports whether a request is a heartbeat that checks
+// the -fleet-token itself, instead of logging in
+func isFleetRegistration(r *http.Request) bool {
+	return *fleetDirectory && *fleetToken != "" && r.URL.Path == "/api/fleet/register" && r.Method == http.MethodPost
+}
+
+// handleFleetRegister records the heartbeat of a server, e.g.
+// POST /api/fleet/register {"name":"rig-3","url":"http://rig-3:8080",...}
+func handleFleetRegister(w http.ResponseWriter, r *http.Request) {
+	if !checkFleetDirectory(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if *fleetToken != "" {
+		// Compare digests so that the time taken doesn't reveal the length
+		want, got := sha256.Sum256([]byte(*fleetToken)), sha256.Sum256([]byte(requestToken(r)))
+		if subtle.ConstantTimeCompare(want[:], got[:]) != 1 {
+			http.Error(w, "wrong fleet token, see -fleet-token", http.StatusUnauthorized)
+			return
+		}
+	}
+	var hb fleetHeartbeat
+	if !decodeJSONBody(w, r, &hb) {
+		return
+	}
+	hb.Name = strings.TrimSpace(hb.Name)
+	if hb.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(hb.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be the http or https base URL of the server", http.StatusBadRequest)
+		return
+	}
+	for _, l := range hb.Links {
+		if u, err := url.Parse(l.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			http.Error(w, "links must be http or https URLs", http.StatusBadRequest)
+			return
+		}
+	}
+	if hb.Interval <= 0 {
+		hb.Interval = fleetInterval.Seconds()
+	}
+	hb.Interval = min(max(hb.Interval, minFleetInterval.Seconds()), maxFleetInterval.Seconds())
+	key := hb.Key
+	hb.Key = ""
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	now := time.Now()
+	fleetMu.Lock()
+	pruneFleet(now)
+	node, ok := fleetNodes[hb.Name]
+	if ok && !node.heldBy(key, host) {
+		// Another server took the name first. A restarted one comes from
+		// the same host, and is let back in.
+		fleetMu.Unlock()
+		log.Printf("Refused a heartbeat from %s as %s, which %s holds", r.RemoteAddr, hb.Name, node.host)
+		http.Error(w, fmt.Sprintf("%s is registered by another server, pick another -fleet-name", hb.Name), http.StatusConflict)
+		return
+	}
+	if !ok {
+		if len(fleetNodes) >= maxFleetNodes {
+			fleetMu.Unlock()
+			http.Error(w, "the directory is full", http.StatusServiceUnavailable)
+			return
+		}
+		node = &fleetNode{FirstSeen: now}
+		fleetNodes[hb.Name] = node
+	}
+	wasLive := ok && node.live(now)
+	node.fleetHeartbeat, node.Addr, node.LastSeen = hb, r.RemoteAddr, now
+	node.key, node.host = key, host
+	fleetMu.Unlock()
+
+	switch {
+	case hb.Leaving:
+		log.Printf("%s left the directory", hb.Name)
+	case !wasLive:
+		log.Printf("%s joined the directory from %s, viewer at %s", hb.Name, r.RemoteAddr, hb.URL)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Nodes int `json:"nodes"`
+	}{len(fleetList(now))})
+}
+
+// heldBy reports whether a heartbeat with the key, from the host, is of the
+// server that holds the node's name: the same process, or one on the same
+// host, e.g. after a restart
+func (n *fleetNode) heldBy(key, host string) bool {
+	return key != "" && key == n.key || host == n.host
+}
+
+// live reports whether the server sent its last heartbeat recently enough
+func (n *fleetNode) live(now time.Time) bool {
+	if n.Leaving {
+		return false
+	}
+	missed := time.Duration(n.Interval*fleetMissedHeartbeats) * time.Second
+	return now.Sub(n.LastSeen) <= missed
+}
+
+// pruneFleet forgets the servers offline for longer than fleetForget. Must
+// be called with fleetMu held.
+func pruneFleet(now time.Time) {
+	for name, n := range fleetNodes {
+		if now.Sub(n.LastSeen) > fleetForget {
+			delete(fleetNodes, name)
+		}
+	}
+}
+
+// fleetList returns the registered servers, live ones first, then by name
+func fleetList(now time.Time) []fleetNode {
+	fleetMu.Lock()
+	defer fleetMu.Unlock()
+	pruneFleet(now)
+	list := make([]fleetNode, 0, len(fleetNodes))
+	for _, n := range fleetNodes {
+		node := *n
+		node.Live = n.live(now)
+		list = append(list, node)
+	}
+	sort.Slice(list, func(a, b int) bool {
+		if list[a].Live != list[b].Live {
+			return list[a].Live
+		}
+		return list[a].Name < list[b].Name
+	})
+	return list
+}
+
+// checkFleetDirectory refuses requests unless the server is a directory,
+// of the default namespace
+func checkFleetDirectory(w http.ResponseWriter, r *http.Request) bool {
+	if !*fleetDirectory {
+		http.Error(w, "this server is not a directory, start it with -fleet-directory", http.StatusNotFound)
+		return false
+	}
+	if requestNamespace(r) != defaultNamespace {
+		http.Error(w, "the directory is the server's, tenants have none", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// handleFleet lists the registered servers with GET /api/fleet
+func handleFleet(w http.ResponseWriter, r *http.Request) {
+	if !checkFleetDirectory(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Nodes []fleetNode `json:"nodes"`
+	}{fleetList(time.Now())})
+}
+
+// fleetPage is what the directory's index page shows
+type fleetPage struct {
+	Nodes   []fleetNode
+	Live    int
+	Refresh int // Seconds until the page reloads
+}
+
+// handleFleetPage shows the registered servers with links to their viewers,
+// e.g. on a screen in a lab running many rigs
+func handleFleetPage(w http.ResponseWriter, r *http.Request) {
+	if !checkFleetDirectory(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page := fleetPage{Nodes: fleetList(time.Now()), Refresh: 10}
+	for _, n := range page.Nodes {
+		if n.Live {
+			page.Live++
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fleetTemplate.Execute(w, page)
+}
+
+var fleetTemplate = template.Must(template.New("fleet").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string { return time.Since(t).Round(time.Second).String() + " ago" },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>quatplot directory</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; vertical-align: top; }
+th { background: #f0f0f0; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+tr.offline { color: #999; }
+.connected { color: #2e7d32; }
+.disconnected, .error { color: #c62828; }
+</style>
+</head>
+<body>
+<h1>quatplot directory</h1>
+<p>{{.Live}} of {{len .Nodes}} servers live</p>
+{{if .Nodes}}<table>
+<tr><th>Server</th><th>State</th><th>Sensors</th><th class="num">Input rate</th><th class="num">Viewers</th><th>Last heartbeat</th><th>Links</th></tr>
+{{range .Nodes}}<tr{{if not .Live}} class="offline"{{end}}>
+<td><a href="{{.URL}}/">{{.Name}}</a></td>
+<td>{{if .Live}}live{{else}}offline{{end}}</td>
+<td>{{range .Sensors}}<div>{{.ID}}: <span class="{{.State}}">{{.State}}</span>{{if .Port}} ({{.Port}}){{end}}</div>{{end}}</td>
+<td class="num">{{printf "%.1f" .InputRate}} Hz</td>
+<td class="num">{{.Clients}}</td>
+<td>{{ago .LastSeen}}</td>
+<td>{{range .Links}}<div><a href="{{.URL}}">{{.Name}}</a></div>{{end}}</td>
+</tr>
+{{end}}</table>{{else}}<p>No servers have registered yet, start them with -fleet-register pointing here.</p>{{end}}
+</body>
+</html>
+`))
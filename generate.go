@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+	"go.bug.st/serial"
+)
+
+var (
+	generateRate     = flag.Float64("generate-rate", 1000, "Samples per second written by the generate command")
+	generateDuration = flag.Duration("generate-duration", 0, "How long the generate command writes for (default: until interrupted)")
+)
+
+// generateReportInterval is how often the generate command reports the rate
+// it achieved
+const generateReportInterval = 5 * time.Second
+
+// generateBacklog is how far the generate command may fall behind, when
+// whatever reads the port can't keep up, before it skips samples
+const generateBacklog = time.Second
+
+// runGenerate writes the motion of the simulator at -generate-rate to a
+// pseudo-terminal or serial port, as the lines or packets the configured
+// -format, -input and -protocol describe, so that the whole serial path of a
+// server can be stress tested
+func runGenerate() int {
+	if *generateRate <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid -generate-rate %v, must be greater than 0\n", *generateRate)
+		return 2
+	}
+	if _, err := initConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 1
+	}
+	cfg := currentConfig()
+	enc, err := newSampleEncoder(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 1
+	}
+	sim := newSimSource(cfg).(*simSource)
+	if sim.motion != simSpin && sim.motion != simWander {
+		fmt.Fprintf(os.Stderr, "unknown simulator motion %q, must be %s or %s\n", sim.motion, simSpin, simWander)
+		return 2
+	}
+	if strings.Contains(portName.text, ",") {
+		fmt.Fprintln(os.Stderr, "generate writes to one port, give -port pty or a single device")
+		return 2
+	}
+
+	var out io.WriteCloser
+	name := portName.text
+	if name == "pty" || isAutoPort(name) {
+		p, path, err := openPTY()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating pseudo-terminal: %v\n", err)
+			return 1
+		}
+		out, name = p, path
+	} else {
+		port, release, err := openSerialPort(name, &serial.Mode{BaudRate: cfg.Baud})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening %s: %v\n", name, err)
+			return 1
+		}
+		defer release()
+		out = port
+	}
+	fmt.Fprintf(os.Stderr, "Writing %g samples per second of %s to %s, read it with -port %s\n", *generateRate, enc, name, name)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *generateDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *generateDuration)
+		defer cancel()
+	}
+	// Closing the port unblocks a write that whatever reads it holds up
+	go func() {
+		<-ctx.Done()
+		out.Close()
+	}()
+	if err := generate(ctx, out, enc, sim, *generateRate); err != nil && ctx.Err() == nil {
+		fmt.Fprintf(os.Stderr, "Error writing to %s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// generate writes samples of the motion at the given rate until the context
+// is done, in batches at most a millisecond apart so that high rates are kept
+// without a timer per sample
+func generate(ctx context.Context, w io.Writer, enc *sampleEncoder, sim *simSource, rate float64) error {
+	interval := max(time.Duration(float64(time.Second)/rate), time.Millisecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	start := time.Now()
+	if err := sim.startMotion(start); err != nil {
+		return err
+	}
+	var (
+		sent, skipped, written    int64
+		reportSent, reportWritten int64
+		lastReport                = start
+		buf                       []byte
+	)
+	report := func(now time.Time, samples, bytes int64, since time.Time) {
+		secs := now.Sub(since).Seconds()
+		fmt.Fprintf(os.Stderr, "Wrote %d samples in %s, %.0f per second, %.1f KB/s", samples, now.Sub(since).Round(time.Millisecond), float64(samples)/secs, float64(bytes)/secs/1024)
+		if skipped > 0 {
+			fmt.Fprintf(os.Stderr, ", %d skipped falling behind", skipped)
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+	defer func() {
+		report(time.Now(), sent, written, start)
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			due := int64(now.Sub(start).Seconds()*rate) - sent - skipped
+			if behind := int64(generateBacklog.Seconds() * rate); due > behind {
+				skipped += due - behind
+				due = behind
+			}
+			buf = buf[:0]
+			for n := int64(0); n < due; n++ {
+				at := start.Add(time.Duration(float64(sent+skipped+n) / rate * float64(time.Second)))
+				buf = enc.append(buf, sim.orientation(at))
+			}
+			if len(buf) > 0 {
+				if _, err := w.Write(buf); err != nil {
+					return err
+				}
+			}
+			sent += due
+			written += int64(len(buf))
+			if now.Sub(lastReport) >= generateReportInterval {
+				report(now, sent-reportSent, written-reportWritten, lastReport)
+				reportSent, reportWritten, lastReport = sent, written, now
+			}
+		}
+	}
+}
+
+// sampleEncoder writes orientations as the lines or packets the server reads
+// with the same settings
+type sampleEncoder struct {
+	format     *lineFormat
+	packet     *packetFormat // Nil for text lines
+	convention string
+}
+
+// newSampleEncoder builds the encoder for the configured -format, -input and
+// -protocol. Raw IMU readings and the packets of BNO sensors aren't generated.
+func newSampleEncoder(cfg Config) (*sampleEncoder, error) {
+	f, err := cfg.checkLineFormat()
+	if err != nil {
+		return nil, err
+	}
+	if f.input == inputIMU {
+		return nil, errors.New("generate can't write imu input, use quaternion, euler or matrix")
+	}
+	e := &sampleEncoder{format: f, convention: cfg.Convention}
+	switch p := f.packet.(type) {
+	case nil:
+	case *packetFormat:
+		e.packet = p
+	default:
+		return nil, fmt.Errorf("generate can't write the %s protocol, use text or binary", cfg.protocol())
+	}
+	return e, nil
+}
+
+func (e *sampleEncoder) String() string {
+	if e.packet != nil {
+		return fmt.Sprintf("binary packets of %s", e.format.components())
+	}
+	return fmt.Sprintf("lines of %s", e.format.components())
+}
+
+// values returns the value of each component of the input for an orientation
+func (e *sampleEncoder) values(q Quaternion) map[string]float64 {
+	switch e.format.input {
+	case inputEuler:
+		order := e.format.order
+		if order == "" {
+			order = defaultEulerOrder
+		}
+		a := quat.ToEulerOrder(q, e.format.units, order)
+		return map[string]float64{"roll": a.Roll, "pitch": a.Pitch, "yaw": a.Yaw}
+	case inputMatrix:
+		m := quat.ToMatrix(q)
+		values := make(map[string]float64, 9)
+		for r := 0; r < 3; r++ {
+			for c := 0; c < 3; c++ {
+				values[fmt.Sprintf("m%d%d", r+1, c+1)] = m[r][c]
+			}
+		}
+		return values
+	}
+	// The conventions are their own inverses
+	q = toHamilton(q, e.convention)
+	return map[string]float64{"i": q.I, "j": q.J, "k": q.K, "real": q.Real}
+}
+
+// append appends the line or packet of an orientation to buf
+func (e *sampleEncoder) append(buf []byte, q Quaternion) []byte {
+	values := e.values(q)
+	if e.packet == nil {
+		delim := e.format.delim
+		if delim == "" {
+			delim = " "
+		}
+		for n, c := range e.format.columns {
+			if n > 0 {
+				buf = append(buf, delim...)
+			}
+			buf = strconv.AppendFloat(buf, values[c], 'f', 6, 64)
+		}
+		return append(buf, '\r', '\n')
+	}
+	p := e.packet
+	buf = append(buf, p.sync...)
+	payload := len(buf)
+	var raw [8]byte
+	for _, c := range e.format.columns {
+		if p.size == 4 {
+			p.order.PutUint32(raw[:], math.Float32bits(float32(values[c])))
+		} else {
+			p.order.PutUint64(raw[:], math.Float64bits(values[c]))
+		}
+		buf = append(buf, raw[:p.size]...)
+	}
+	switch p.checksum {
+	case checksumSum8:
+		var s byte
+		for _, b := range buf[payload:] {
+			s += b
+		}
+		buf = append(buf, s)
+	case checksumXOR8:
+		var x byte
+		for _, b := range buf[payload:] {
+			x ^= b
+		}
+		buf = append(buf, x)
+	case checksumCRC16:
+		p.order.PutUint16(raw[:], crc16CCITT(buf[payload:]))
+		buf = append(buf, raw[:2]...)
+	}
+	return buf
+}
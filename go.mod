@@ -5,10 +5,10 @@ go 1.21
 require (
 	github.com/gorilla/websocket v1.5.1
 	go.bug.st/serial v1.6.1
+	golang.org/x/sys v0.13.0
 )
 
 require (
 	github.com/creack/goselect v0.1.2 // indirect
 	golang.org/x/net v0.17.0 // indirect
-	golang.org/x/sys v0.13.0 // indirect
 )
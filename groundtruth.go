@@ -0,0 +1,237 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+// Devices the simulator tags its streams with in ground truth mode
+const (
+	simTruthDevice    = "truth"
+	simMeasuredDevice = "measured"
+)
+
+// truthErrorWindow is how long the errors of the measured stream are kept
+const truthErrorWindow = 10 * time.Second
+
+var (
+	simTruth      = flag.Bool("sim-truth", false, "Also simulate the raw readings of an IMU following the simulated rotation and fuse them with -ahrs, sending the true orientation as device \"truth\" and the estimate as \"measured\"")
+	simGyroNoise  = flag.Float64("sim-gyro-noise", 0.5, "Standard deviation of the simulated gyroscope noise in degrees per second, with -sim-truth")
+	simGyroBias   = flag.Float64("sim-gyro-bias", 0.5, "Constant bias of the simulated gyroscope in degrees per second, about a random axis, with -sim-truth")
+	simAccelNoise = flag.Float64("sim-accel-noise", 0.02, "Standard deviation of the simulated accelerometer noise in g, with -sim-truth")
+	simMagNoise   = flag.Float64("sim-mag-noise", 0.02, "Standard deviation of the simulated magnetometer noise, as a share of the field, with -sim-truth")
+)
+
+// Earth's magnetic field in the NWU frame the filters estimate in, pointing
+// north and 60° down
+var simMagField = quat.Vector{X: math.Cos(60 * math.Pi / 180), Z: -math.Sin(60 * math.Pi / 180)}
+
+// simTruthSource follows the simulated rotation with a simulated IMU, and
+// sends both the true orientation and the one the configured filter
+// estimates from the noisy readings
+type simTruthSource struct {
+	*simSource
+	filter  string
+	fusion  *imuFusion
+	bias    quat.Vector // Rad/s
+	last    Quaternion
+	started bool
+	pending *Quaternion // Estimate to send after the truth
+}
+
+func newSimTruthSource(cfg Config) Source {
+	filter, err := parseAHRS(cfg.AHRS)
+	if err != nil {
+		// Reported by the config check, fall back until it is fixed
+		filter = ahrsMadgwick
+	}
+	return &simTruthSource{simSource: newSimSource(cfg).(*simSource), filter: filter}
+}
+
+func (s *simTruthSource) String() string {
+	return s.simSource.String() + " with a simulated " + s.filter + " IMU"
+}
+
+func (s *simTruthSource) Open() error {
+	if err := s.simSource.Open(); err != nil {
+		return err
+	}
+	axis := randomOrientation()
+	bias := *simGyroBias * math.Pi / 180
+	s.bias = quat.Rotate(axis, quat.Vector{X: bias})
+	s.fusion = &imuFusion{filter: newAHRSFilter(s.filter), rate: s.rate}
+	s.started, s.pending = false, nil
+	return nil
+}
+
+// ReadTagged returns the true orientation of each step of the simulation,
+// then the filter's estimate
+func (s *simTruthSource) ReadTagged() (string, Quaternion, error) {
+	if s.pending != nil {
+		q := *s.pending
+		s.pending = nil
+		return simMeasuredDevice, q, nil
+	}
+	truth, err := s.simSource.ReadQuaternion()
+	if err != nil {
+		return "", Quaternion{}, err
+	}
+	if !s.started {
+		s.last, s.started = truth, true
+	}
+	estimate := s.fusion.update(s.readIMU(s.last, truth), time.Now())
+	s.last = truth
+	s.pending = &estimate
+	return simTruthDevice, truth, nil
+}
+
+// readIMU simulates the readings of an IMU turning from prev to q over one
+// step: the rate of turn in its own axes, and gravity and the magnetic
+// field seen from them, with noise and a gyroscope bias
+func (s *simTruthSource) readIMU(prev, q Quaternion) imuSample {
+	// Rotation over the step in the sensor's own axes
+	d := quat.Multiply(quat.Conjugate(prev), q)
+	if d.Real < 0 {
+		d = Quaternion{I: -d.I, J: -d.J, K: -d.K, Real: -d.Real}
+	}
+	var rate quat.Vector
+	if sin := math.Sqrt(d.I*d.I + d.J*d.J + d.K*d.K); sin > 0 {
+		scale := 2 * math.Atan2(sin, d.Real) / sin * s.rate
+		rate = quat.Vector{X: d.I * scale, Y: d.J * scale, Z: d.K * scale}
+	}
+
+	gyroNoise := *simGyroNoise * math.Pi / 180
+	inverse := quat.Conjugate(q)
+	return imuSample{
+		accel:  addNoise(quat.Rotate(inverse, quat.Vector{Z: 1}), *simAccelNoise),
+		gyro:   addNoise(quat.Vector{X: rate.X + s.bias.X, Y: rate.Y + s.bias.Y, Z: rate.Z + s.bias.Z}, gyroNoise),
+		mag:    addNoise(quat.Rotate(inverse, simMagField), *simMagNoise),
+		hasMag: true,
+	}
+}
+
+// addNoise adds normally distributed noise of the given standard deviation
+// to each component
+func addNoise(v quat.Vector, sd float64) quat.Vector {
+	return quat.Vector{X: v.X + rand.NormFloat64()*sd, Y: v.Y + rand.NormFloat64()*sd, Z: v.Z + rand.NormFloat64()*sd}
+}
+
+// simFilterInfo describes the filter and smoothing the measured stream of
+// the simulator goes through
+func simFilterInfo(cfg Config) string {
+	filter, err := parseAHRS(cfg.AHRS)
+	if err != nil {
+		filter = ahrsMadgwick
+	}
+	info := fmt.Sprintf("%s beta=%g", filter, *ahrsBeta)
+	if filter == ahrsMahony {
+		info = fmt.Sprintf("%s kp=%g ki=%g", filter, *ahrsKp, *ahrsKi)
+	}
+	if cfg.Smoothing > 0 {
+		info += fmt.Sprintf(" smoothing=%gs", cfg.Smoothing)
+	}
+	return info
+}
+
+// truthMeter measures the error of the simulator's measured stream against
+// the true orientation, as both are broadcast
+type truthMeter struct {
+	mu     sync.Mutex
+	truth  *Quaternion
+	errors []truthError
+}
+
+type truthError struct {
+	t    time.Time
+	errs [4]float64 // Angle, roll, pitch and yaw, in degrees
+}
+
+// filterError reports the live error of the measured stream over the last
+// truthErrorWindow, in degrees
+type filterError struct {
+	Filter  string     `json:"filter"` // Filter and smoothing settings measured
+	Samples int        `json:"samples"`
+	Current float64    `json:"current"` // Angle of the latest sample
+	Angle   errorStats `json:"angle"`
+	Roll    errorStats `json:"roll"`
+	Pitch   errorStats `json:"pitch"`
+	Yaw     errorStats `json:"yaw"`
+}
+
+func newTruthMeter() *truthMeter {
+	return &truthMeter{}
+}
+
+// add records a broadcast sample, measuring those of the measured stream
+// against the latest truth. A nil meter does nothing.
+func (m *truthMeter) add(device string, q Quaternion, now time.Time) {
+	if m == nil {
+		return
+	}
+	q, ok := quat.Normalize(q)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case device == simTruthDevice:
+		m.truth = &q
+		return
+	case device != simMeasuredDevice || m.truth == nil:
+		return
+	}
+	e, r := quat.ToEuler(q, quat.Degrees), quat.ToEuler(*m.truth, quat.Degrees)
+	m.errors = append(m.errors, truthError{t: now, errs: [4]float64{
+		quat.Angle(*m.truth, q),
+		math.Abs(wrapDegrees(e.Roll - r.Roll)),
+		math.Abs(wrapDegrees(e.Pitch - r.Pitch)),
+		math.Abs(wrapDegrees(e.Yaw - r.Yaw)),
+	}})
+	cut := 0
+	for cut < len(m.errors) && now.Sub(m.errors[cut].t) > truthErrorWindow {
+		cut++
+	}
+	if cut > 0 {
+		m.errors = append(m.errors[:0], m.errors[cut:]...)
+	}
+}
+
+// stats summarizes the errors over the window, nil for a nil meter
+func (m *truthMeter) stats(cfg Config, now time.Time) *filterError {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fe := &filterError{Filter: simFilterInfo(cfg)}
+	var sums [4]struct{ sum, sq float64 }
+	stats := []*errorStats{&fe.Angle, &fe.Roll, &fe.Pitch, &fe.Yaw}
+	for _, e := range m.errors {
+		if now.Sub(e.t) > truthErrorWindow {
+			continue
+		}
+		fe.Samples++
+		fe.Current = e.errs[0]
+		for i, v := range e.errs {
+			sums[i].sum += v
+			sums[i].sq += v * v
+			if v > stats[i].Max || fe.Samples == 1 {
+				stats[i].Max, stats[i].MaxAt = v, e.t
+			}
+		}
+	}
+	if fe.Samples > 0 {
+		for i, st := range stats {
+			st.Mean = sums[i].sum / float64(fe.Samples)
+			st.RMSE = math.Sqrt(sums[i].sq / float64(fe.Samples))
+		}
+	}
+	return fe
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var (
+	gyroBiasDir   = flag.String("gyro-bias-dir", "", "Directory keeping a model of the gyroscope bias of each imu sensor against its temperature, learned while the sensor is still and taken out of its rates. Needs a temp column in the format (default: off)")
+	gyroBiasStill = flag.Float64("gyro-bias-still", 3, "Largest gyroscope rate in degrees per second, after the modelled bias is taken out, at which a sensor counts as still and its bias is learned")
+)
+
+const (
+	// biasMinSamples is how many still samples a temperature needs before
+	// its bias is used
+	biasMinSamples = 100
+	// biasMaxWeight bounds the weight of the samples learned at each
+	// temperature, so that the bias can follow the sensor as it ages
+	biasMaxWeight = 20000
+	// biasAccelChange is the largest change of the accelerometer between two
+	// samples, as a share of gravity, at which a sensor counts as still
+	biasAccelChange = 0.02
+	// biasSaveInterval is how often a model that learned is saved
+	biasSaveInterval = time.Minute
+)
+
+// biasFileName replaces what isn't safe in file names, e.g. the slashes of
+// a port name
+var biasFileName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// biasBin holds the mean gyroscope rates of a still sensor at one
+// temperature, 1 °C wide
+type biasBin struct {
+	Temp   float64     `json:"temp"`   // Mean temperature, °C
+	Rate   quat.Vector `json:"rate"`   // Mean rate, rad/s
+	Weight float64     `json:"weight"` // Samples averaged, up to biasMaxWeight
+}
+
+// gyroBiasModel learns the gyroscope bias of a sensor at each temperature
+// and fits a straight line through it, which is persisted per sensor
+type gyroBiasModel struct {
+	Sensor  string    `json:"sensor"`
+	Updated time.Time `json:"updated"`
+	Bins    []biasBin `json:"bins"` // Sorted by temperature
+	// Fit of the bins with enough samples: the bias at Ref, and how much it
+	// changes per °C
+	Ref    float64     `json:"ref_temp"`
+	Offset quat.Vector `json:"offset"`
+	Slope  quat.Vector `json:"slope"`
+	Min    float64     `json:"min_temp"` // Range of the fitted temperatures, outside which the bias is held
+	Max    float64     `json:"max_temp"`
+	Fitted bool        `json:"fitted"`
+
+	mu        sync.Mutex
+	path      string
+	loaded    bool
+	prevAccel quat.Vector
+	learned   bool // Since the model was last saved
+	saved     time.Time
+}
+
+var (
+	gyroBiasMu sync.Mutex
+	// gyroBiasModels holds the model of each sensor, kept while the server
+	// runs so that a sensor reconnecting goes on learning
+	gyroBiasModels = map[string]*gyroBiasModel{}
+)
+
+// gyroBiasModelFor returns the model of a sensor, named by sensorID
+func gyroBiasModelFor(sensor string) *gyroBiasModel {
+	gyroBiasMu.Lock()
+	defer gyroBiasMu.Unlock()
+	m := gyroBiasModels[sensor]
+	if m == nil {
+		name := biasFileName.ReplaceAllString(sensor, "_") + ".json"
+		m = &gyroBiasModel{Sensor: sensor, path: filepath.Join(*gyroBiasDir, name)}
+		gyroBiasModels[sensor] = m
+	}
+	return m
+}
+
+// saveGyroBiasModels saves what the models learned since they were last
+// saved, on shutdown
+func saveGyroBiasModels() {
+	gyroBiasMu.Lock()
+	defer gyroBiasMu.Unlock()
+	for _, m := range gyroBiasModels {
+		m.mu.Lock()
+		if m.learned {
+			m.learned = false
+			if err := m.save(); err != nil {
+				log.Printf("Error saving gyroscope bias model: %v", err)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// sensorID names the sensor a source configuration reads from, for its
+// gyroscope bias model
+func (cfg Config) sensorID() string {
+	switch cfg.Source {
+	case "", "serial":
+		return cfg.Port
+	case "tcp-listen", "udp":
+		return cfg.Source + " " + cfg.Listen
+	case "tcp-connect":
+		return "tcp " + cfg.Connect
+	}
+	return cfg.Source
+}
+
+// correct takes the modelled bias out of the gyroscope rates of a sample,
+// learning from it first when the sensor is still
+func (m *gyroBiasModel) correct(s imuSample, now time.Time) imuSample {
+	if !s.hasTemp {
+		return s
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.loaded {
+		if err := m.load(); err != nil {
+			log.Printf("Error loading gyroscope bias model: %v", err)
+		}
+		m.loaded, m.saved = true, now
+	}
+	bias := m.bias(s.temp)
+	if m.still(s, bias) {
+		m.learn(s.temp, s.gyro, now)
+	}
+	m.prevAccel = s.accel
+	if m.learned && now.Sub(m.saved) >= biasSaveInterval {
+		m.learned, m.saved = false, now
+		if err := m.save(); err != nil {
+			log.Printf("Error saving gyroscope bias model: %v", err)
+		}
+	}
+	s.gyro = quat.Vector{X: s.gyro.X - bias.X, Y: s.gyro.Y - bias.Y, Z: s.gyro.Z - bias.Z}
+	return s
+}
+
+// still reports whether the sensor neither turns nor is shaken
+func (m *gyroBiasModel) still(s imuSample, bias quat.Vector) bool {
+	g := quat.Vector{X: s.gyro.X - bias.X, Y: s.gyro.Y - bias.Y, Z: s.gyro.Z - bias.Z}
+	if vectorNorm(g)*180/math.Pi > *gyroBiasStill {
+		return false
+	}
+	a := vectorNorm(s.accel)
+	d := quat.Vector{X: s.accel.X - m.prevAccel.X, Y: s.accel.Y - m.prevAccel.Y, Z: s.accel.Z - m.prevAccel.Z}
+	return a > 0 && vectorNorm(d) <= biasAccelChange*a
+}
+
+// learn adds the rates of a still sensor to the bin of its temperature and
+// fits the model again
+func (m *gyroBiasModel) learn(temp float64, rate quat.Vector, now time.Time) {
+	key := math.Round(temp)
+	i := sort.Search(len(m.Bins), func(i int) bool { return math.Round(m.Bins[i].Temp) >= key })
+	if i == len(m.Bins) || math.Round(m.Bins[i].Temp) != key {
+		m.Bins = append(m.Bins, biasBin{})
+		copy(m.Bins[i+1:], m.Bins[i:])
+		m.Bins[i] = biasBin{Temp: temp}
+	}
+	b := &m.Bins[i]
+	b.Weight = min(b.Weight+1, biasMaxWeight)
+	k := 1 / b.Weight
+	b.Temp += (temp - b.Temp) * k
+	b.Rate = quat.Vector{X: b.Rate.X + (rate.X-b.Rate.X)*k, Y: b.Rate.Y + (rate.Y-b.Rate.Y)*k, Z: b.Rate.Z + (rate.Z-b.Rate.Z)*k}
+	m.Updated, m.learned = now, true
+	m.fit()
+}
+
+// fit fits a line through the bins with enough samples by weighted least
+// squares, a constant bias when they span less than 2 °C
+func (m *gyroBiasModel) fit() {
+	var w, wt, wtt float64
+	var wr, wtr quat.Vector
+	m.Fitted = false
+	for _, b := range m.Bins {
+		if b.Weight < biasMinSamples {
+			continue
+		}
+		if !m.Fitted {
+			m.Min, m.Max, m.Fitted = b.Temp, b.Temp, true
+		}
+		m.Min, m.Max = math.Min(m.Min, b.Temp), math.Max(m.Max, b.Temp)
+		w += b.Weight
+		wt += b.Weight * b.Temp
+		wtt += b.Weight * b.Temp * b.Temp
+		wr = quat.Vector{X: wr.X + b.Weight*b.Rate.X, Y: wr.Y + b.Weight*b.Rate.Y, Z: wr.Z + b.Weight*b.Rate.Z}
+		wtr = quat.Vector{X: wtr.X + b.Weight*b.Temp*b.Rate.X, Y: wtr.Y + b.Weight*b.Temp*b.Rate.Y, Z: wtr.Z + b.Weight*b.Temp*b.Rate.Z}
+	}
+	if !m.Fitted {
+		return
+	}
+	m.Ref = wt / w
+	m.Offset = quat.Vector{X: wr.X / w, Y: wr.Y / w, Z: wr.Z / w}
+	m.Slope = quat.Vector{}
+	if varT := wtt/w - m.Ref*m.Ref; m.Max-m.Min >= 2 && varT > 0 {
+		slope := func(sumTR, sumR float64) float64 { return (sumTR/w - m.Ref*sumR/w) / varT }
+		m.Slope = quat.Vector{X: slope(wtr.X, wr.X), Y: slope(wtr.Y, wr.Y), Z: slope(wtr.Z, wr.Z)}
+	}
+}
+
+// bias returns the modelled bias at a temperature, zero until it is known
+func (m *gyroBiasModel) bias(temp float64) quat.Vector {
+	if !m.Fitted {
+		return quat.Vector{}
+	}
+	d := math.Max(m.Min, math.Min(m.Max, temp)) - m.Ref
+	return quat.Vector{X: m.Offset.X + m.Slope.X*d, Y: m.Offset.Y + m.Slope.Y*d, Z: m.Offset.Z + m.Slope.Z*d}
+}
+
+// load reads the model saved for the sensor, if there is one
+func (m *gyroBiasModel) load() error {
+	data, err := os.ReadFile(m.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved gyroBiasModel
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %v", m.path, err)
+	}
+	m.Updated, m.Bins = saved.Updated, saved.Bins
+	m.fit()
+	log.Printf("Loaded the gyroscope bias model of %s from %s, learned at %d temperatures", m.Sensor, m.path, len(m.Bins))
+	return nil
+}
+
+// save writes the model atomically by renaming a temporary file
+func (m *gyroBiasModel) save() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*gyroBiasDir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(*gyroBiasDir, ".quatplot-bias-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.path)
+}
+
+func vectorNorm(v quat.Vector) float64 {
+	return math.Sqrt(v.X*v.X + v.Y*v.Y + v.Z*v.Z)
+}
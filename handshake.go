@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	clientProtocol   = flag.String("client-protocol", protocolLegacy, "How WebSocket clients start: legacy to send samples at once, or strict to disconnect clients that don't send hello and then subscribe within -handshake-timeout")
+	handshakeTimeout = flag.Duration("handshake-timeout", 5*time.Second, "Time a client has to complete the handshake with -client-protocol strict")
+)
+
+// Values of -client-protocol
+const (
+	protocolLegacy = "legacy"
+	protocolStrict = "strict"
+)
+
+// helloRequest is the data of a "hello" message, the first a client sends
+type helloRequest struct {
+	Protocol int    `json:"protocol"` // Version of the messages the client speaks
+	Client   string `json:"client"`   // Name and version of the client, e.g. "dashboard/1.2"
+}
+
+// helloInfo answers a hello in a "hello" event
+type helloInfo struct {
+	Protocol int  `json:"protocol"`
+	Strict   bool `json:"strict"` // Whether samples wait for a subscribe
+}
+
+// handshakeInfo tells clients in the session message that they must
+// complete the handshake, omitted in legacy mode
+type handshakeInfo struct {
+	TimeoutMs int64 `json:"timeout_ms"`
+}
+
+// checkClientProtocol checks -client-protocol and -handshake-timeout
+func checkClientProtocol() error {
+	switch *clientProtocol {
+	case protocolLegacy:
+	case protocolStrict:
+		if *handshakeTimeout <= 0 {
+			return fmt.Errorf("-handshake-timeout must be positive, got %v", *handshakeTimeout)
+		}
+		log.Printf("Disconnecting clients that don't complete the handshake within %v", *handshakeTimeout)
+	default:
+		return fmt.Errorf("unknown -client-protocol %q, expected legacy or strict", *clientProtocol)
+	}
+	return nil
+}
+
+// strictClients reports whether clients must complete the handshake
+func strictClients() bool {
+	return *clientProtocol == protocolStrict
+}
+
+// sessionHandshake returns the handshake of the session message, nil when
+// none is needed
+func sessionHandshake() *handshakeInfo {
+	if !strictClients() {
+		return nil
+	}
+	return &handshakeInfo{TimeoutMs: handshakeTimeout.Milliseconds()}
+}
+
+// awaitHandshake disconnects the client unless it completes the handshake
+// in time. The returned timer is stopped when the client disconnects.
+func (c *client) awaitHandshake() *time.Timer {
+	return time.AfterFunc(*handshakeTimeout, func() {
+		c.mu.Lock()
+		pending := c.handshaking
+		c.mu.Unlock()
+		if pending {
+			c.reject(fmt.Sprintf("handshake not completed within %v", *handshakeTimeout))
+		}
+	})
+}
+
+// handshakeStep checks a message of the client against the handshake, and
+// reports whether it should be handled. Hellos are answered here, in any
+// mode, and clients that break the handshake are disconnected.
+func (c *client) handshakeStep(msg clientMessage) bool {
+	if msg.Type == "hello" {
+		c.handleHello(msg.Data)
+		return false
+	}
+	c.mu.Lock()
+	handshaking, helloed := c.handshaking, c.name != ""
+	c.mu.Unlock()
+	switch {
+	case !handshaking:
+		return true
+	case !helloed:
+		c.reject(fmt.Sprintf("expected hello, got %s", msg.Type))
+		return false
+	case msg.Type != "subscribe":
+		c.reject(fmt.Sprintf("expected subscribe after hello, got %s", msg.Type))
+		return false
+	}
+	return true
+}
+
+// handleHello checks the protocol of a client, and answers it
+func (c *client) handleHello(data json.RawMessage) {
+	var req helloRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.Protocol == 0 {
+		c.reject("hello needs the protocol version")
+		return
+	}
+	if req.Protocol != protocolVersion {
+		c.reject(fmt.Sprintf("protocol %d isn't supported, this server speaks %d", req.Protocol, protocolVersion))
+		return
+	}
+	if req.Client == "" {
+		req.Client = "unnamed"
+	}
+	c.mu.Lock()
+	c.name = req.Client
+	c.mu.Unlock()
+	log.Printf("Client %d (%s) is %s, protocol %d", c.id, c.addr, req.Client, req.Protocol)
+	c.sendEvent(mustMarshalEvent("hello", helloInfo{Protocol: protocolVersion, Strict: strictClients()}))
+}
+
+// completeHandshake starts sending samples to a client that completed the
+// handshake, beginning with the current orientation of every device
+func (ns *namespace) completeHandshake(c *client) {
+	c.mu.Lock()
+	pending := c.handshaking
+	c.handshaking = false
+	c.mu.Unlock()
+	if pending {
+		ns.sendCurrent(c)
+	}
+}
+
+// reject disconnects a client that broke the protocol, telling it why in
+// the close message
+func (c *client) reject(reason string) {
+	log.Printf("Client %d (%s) broke the protocol: %s, disconnecting", c.id, c.addr, reason)
+	msg := websocket.FormatCloseMessage(websocket.CloseProtocolError, reason)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(*writeTimeout))
+	// Closing the connection ends the read loop, which unregisters the client
+	c.conn.Close()
+}
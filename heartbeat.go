@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/intermernet/quatplot/hub"
+)
+
+var idleHeartbeat = flag.Duration("idle-heartbeat", 5*time.Second, "While no samples arrive, send WebSocket clients a heartbeat event this often, so they can tell a silent sensor from a dead connection (0 to disable)")
+
+// heartbeatInfo is sent to the clients of a namespace while its sources are
+// silent
+type heartbeatInfo struct {
+	Seq           uint64       `json:"seq"`                          // Last sequence number sent
+	LastSample    *time.Time   `json:"last_sample,omitempty"`        // When the last sample arrived, omitted before the first
+	LastSampleAge *int64       `json:"last_sample_age_ms,omitempty"` // How long ago, in milliseconds
+	Status        serialStatus `json:"status"`                       // State of the input, as returned by /api/status
+}
+
+// lastSampleTime returns when a source of the namespace last sent a
+// sample, zero before the first
+func (ns *namespace) lastSampleTime() time.Time {
+	var last int64
+	for _, s := range ns.sourceList() {
+		last = max(last, s.lastSample.Load())
+	}
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// heartbeat sends a heartbeat event every interval during which the
+// namespace received no sample. Heartbeats aren't recorded.
+func (ns *namespace) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		last := ns.lastSampleTime()
+		if !last.IsZero() && now.Sub(last) < interval {
+			continue
+		}
+		info := heartbeatInfo{Seq: ns.seq.Load(), Status: ns.getStatus()}
+		if !last.IsZero() {
+			age := now.Sub(last).Milliseconds()
+			info.LastSample, info.LastSampleAge = &last, &age
+		}
+		data, err := hub.MarshalEvent("heartbeat", now, info)
+		if err != nil {
+			log.Printf("Error marshaling heartbeat event: %v", err)
+			continue
+		}
+		ns.clientsMu.Lock()
+		for _, c := range ns.clients {
+			c.sendEvent(data)
+		}
+		ns.clientsMu.Unlock()
+	}
+}
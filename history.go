@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	historySize       = flag.Int("history", 6000, "Number of recent samples kept in memory for backfilling clients")
+	backfillOnConnect = flag.Duration("backfill-on-connect", 0, "Send new WebSocket clients the samples of this long before they connected, e.g. 10s, unless they ask otherwise with ?history= (default: 0, none)")
+)
+
+// historyFields are the columns of each sample of a history message, and
+// wxyzHistoryFields their names with the keys w, x, y and z
+var (
+	historyFields     = []string{"seq", "t", "i", "j", "k", "real"}
+	wxyzHistoryFields = []string{"seq", "t", "x", "y", "z", "w"}
+)
+
+// historySample is a sample kept in the history buffer
+type historySample struct {
+	ID   string    `json:"id,omitempty"` // Device the sample came from, empty when untagged
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// RefTime is Time on the -clock-ref server's clock, when aligned to one
+	RefTime *time.Time `json:"ref_time,omitempty"`
+	sampleMarks
+	Quaternion
+}
+
+// sampleHistory is a ring buffer of the most recent samples
+type sampleHistory struct {
+	mu      sync.RWMutex
+	samples []historySample
+	next    int
+	full    bool
+}
+
+func newSampleHistory(capacity int) *sampleHistory {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &sampleHistory{samples: make([]historySample, capacity)}
+}
+
+// add appends a sample, overwriting the oldest one when full
+func (h *sampleHistory) add(s historySample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.next] = s
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// ordered returns the buffered samples, oldest first. Must be called with h.mu held.
+func (h *sampleHistory) ordered() []historySample {
+	if !h.full {
+		return h.samples[:h.next]
+	}
+	return append(append([]historySample(nil), h.samples[h.next:]...), h.samples[:h.next]...)
+}
+
+// since returns the buffered samples with a sequence number above seq. It
+// reports complete=false when some of them have already been overwritten.
+func (h *sampleHistory) since(seq uint64) (samples []historySample, complete bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	all := h.ordered()
+	if len(all) == 0 {
+		return nil, true
+	}
+	complete = all[0].Seq <= seq+1
+	for _, s := range all {
+		if s.Seq > seq {
+			samples = append(samples, s)
+		}
+	}
+	return append([]historySample(nil), samples...), complete
+}
+
+// within returns the buffered samples taken at or after start, oldest first
+func (h *sampleHistory) within(start time.Time) []historySample {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	all := h.ordered()
+	first := len(all)
+	for first > 0 && !all[first-1].Time.Before(start) {
+		first--
+	}
+	return append([]historySample(nil), all[first:]...)
+}
+
+// historyBatch carries the recent samples sent to a new client, as rows of
+// historyFields per device to keep it small. t is in milliseconds since Start.
+type historyBatch struct {
+	Seconds float64         `json:"seconds"`
+	Start   time.Time       `json:"start"`
+	Fields  []string        `json:"fields"`
+	Devices []historyDevice `json:"devices"`
+}
+
+// historyDevice holds the recent samples of one device
+type historyDevice struct {
+	ID      string       `json:"id,omitempty"`
+	Samples [][6]float64 `json:"samples"`
+}
+
+// historyWindow returns how far back a new client asked to be sent, with
+// ?history=SECONDS, or -backfill-on-connect
+func historyWindow(r *http.Request) time.Duration {
+	v := r.URL.Query().Get("history")
+	if v == "" {
+		return *backfillOnConnect
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 || math.IsInf(seconds, 0) {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// recentHistory returns the samples of the last window as a history
+// message with the fields named in a key scheme, nil when there are none
+func (ns *namespace) recentHistory(window time.Duration, now time.Time, keys string) *historyBatch {
+	samples := ns.history.within(now.Add(-window))
+	if len(samples) == 0 {
+		return nil
+	}
+	batch := &historyBatch{Seconds: window.Seconds(), Start: samples[0].Time, Fields: historyFields}
+	if keys == keysWXYZ {
+		batch.Fields = wxyzHistoryFields
+	}
+	index := map[string]int{}
+	for _, s := range samples {
+		n, ok := index[s.ID]
+		if !ok {
+			n = len(batch.Devices)
+			index[s.ID] = n
+			batch.Devices = append(batch.Devices, historyDevice{ID: s.ID})
+		}
+		t := math.Round(float64(s.Time.Sub(batch.Start))/float64(time.Millisecond)*10) / 10
+		batch.Devices[n].Samples = append(batch.Devices[n].Samples, [6]float64{
+			float64(s.Seq), t, roundComponent(s.I), roundComponent(s.J), roundComponent(s.K), roundComponent(s.Real),
+		})
+	}
+	return batch
+}
+
+// roundComponent rounds a quaternion component to 6 decimals, well below
+// the noise of any sensor
+func roundComponent(v float64) float64 {
+	return math.Round(v*1e6) / 1e6
+}
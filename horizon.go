@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var logAttitude = flag.Duration("log-attitude", 0, "Log a small ASCII artificial horizon of each device this often, for debugging over a serial console or SSH (0 to disable)")
+
+const (
+	// horizonWidth and horizonHeight are the size of an artificial horizon
+	// in characters, inside its frame
+	horizonWidth  = 11
+	horizonHeight = 5
+	// horizonPitch is the pitch in degrees that moves the horizon from the
+	// middle to the top or bottom edge
+	horizonPitch = 45
+	// horizonAspect is the height of a character over its width
+	horizonAspect = 2
+)
+
+// horizon draws an artificial horizon of the given attitude in degrees: sky
+// above, ground (#) below, tilting with roll and moving down as the nose
+// pitches up, with the aircraft (-o-) in the middle. Each row is framed.
+func horizon(e quat.Euler) []string {
+	sin, cos := math.Sincos(e.Roll * math.Pi / 180)
+	offset := -e.Pitch / horizonPitch
+	rows := make([]string, horizonHeight)
+	for r := range rows {
+		row := []byte(strings.Repeat(" ", horizonWidth))
+		// Cell centers, from -1 to 1 across the height, y up
+		y := 1 - (float64(r)+0.5)*2/horizonHeight
+		for c := range row {
+			x := ((float64(c)+0.5)*2/horizonWidth - 1) * horizonWidth / horizonHeight / horizonAspect
+			if y*cos-x*sin < offset {
+				row[c] = '#'
+			}
+		}
+		if r == horizonHeight/2 {
+			mid := horizonWidth / 2
+			copy(row[mid-1:], "-o-")
+		}
+		rows[r] = "|" + string(row) + "|"
+	}
+	return rows
+}
+
+// compassPoint names the heading of a yaw in degrees, e.g. NE
+func compassPoint(yaw float64) string {
+	points := []string{"N", "NE", "E", "SE", "S", "SW", "W", "NW"}
+	n := int(math.Round(math.Mod(yaw, 360)/45)) % len(points)
+	if n < 0 {
+		n += len(points)
+	}
+	return points[n]
+}
+
+// attitudeNotes are the angles shown alongside a horizon, one a row from
+// the second
+func attitudeNotes(e quat.Euler) []string {
+	return []string{
+		"",
+		fmt.Sprintf("roll  %+7.1f°", e.Roll),
+		fmt.Sprintf("pitch %+7.1f°", e.Pitch),
+		fmt.Sprintf("yaw   %+7.1f° %s", e.Yaw, compassPoint(e.Yaw)),
+	}
+}
+
+// attitudeLog returns the lines logged for an attitude: its horizon, with
+// the angles alongside
+func attitudeLog(e quat.Euler) string {
+	notes := attitudeNotes(e)
+	var b strings.Builder
+	for n, row := range horizon(e) {
+		b.WriteString("\n  " + row)
+		if n < len(notes) && notes[n] != "" {
+			b.WriteString("  " + notes[n])
+		}
+	}
+	return b.String()
+}
+
+// logAttitudes logs the horizon of each device of the namespace that sent a
+// sample during the last interval
+func (ns *namespace) logAttitudes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var seq uint64
+	for range ticker.C {
+		samples, _ := ns.history.since(seq)
+		latest := map[string]Quaternion{}
+		for _, s := range samples {
+			latest[s.ID], seq = s.Quaternion, s.Seq
+		}
+		ids := make([]string, 0, len(latest))
+		for id := range latest {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			name := id
+			if name == "" {
+				name = "sensor"
+			}
+			if ns.name != "" {
+				name = ns.name + "/" + name
+			}
+			log.Printf("Attitude of %s:%s", name, attitudeLog(quat.ToEuler(latest[id], "deg")))
+		}
+	}
+}
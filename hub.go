@@ -0,0 +1,454 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/intermernet/quatplot/hub"
+	"github.com/intermernet/quatplot/quat"
+)
+
+const (
+	// adaptFullThreshold is how many consecutive samples may be conflated
+	// before a client's update rate is reduced
+	adaptFullThreshold = 3
+	// adaptBaseInterval is the first rate limit applied to a slow client (30 Hz)
+	adaptBaseInterval = time.Second / 30
+	// adaptMaxInterval is the slowest rate a client is reduced to (1 Hz)
+	adaptMaxInterval = time.Second
+	// adaptRestoreAfter is how long a client must keep up before its rate is
+	// raised again
+	adaptRestoreAfter = 5 * time.Second
+)
+
+var (
+	writeTimeout = flag.Duration("write-timeout", 10*time.Second, "Disconnect a WebSocket client when sending it a message takes longer than this, e.g. a phone that dropped off the WiFi")
+	pingInterval = flag.Duration("ping-interval", 30*time.Second, "Ping WebSocket clients this often, and disconnect those that answer nothing for twice as long, e.g. a laptop that went to sleep")
+)
+
+// pingPeriod returns how often clients are pinged, at least once a second
+func pingPeriod() time.Duration {
+	return max(*pingInterval, time.Second)
+}
+
+// pongWait returns how long a client may go without answering a ping or
+// sending anything before it is disconnected
+func pongWait() time.Duration {
+	return 2 * pingPeriod()
+}
+
+// client is a connected WebSocket viewer. Messages come in two classes:
+// events (status changes, notifications) are queued and always delivered in
+// order, while orientation samples are conflated so that a slow client only
+// ever gets the latest one of each device, see hub.Conn.
+type client struct {
+	id        int64
+	conn      *websocket.Conn
+	out       *hub.Conn
+	addr      string
+	connected time.Time
+	bytes     rateMeter
+	messages  rateMeter
+	ns        *namespace
+	token     string    // Resume token identifying the client across reconnects
+	units     string    // Angle units of derived values sent to this client
+	order     string    // Rotation order of the Euler angles sent to this client
+	keys      string    // Key scheme of the quaternions sent to this client
+	vectors   vectorSet // Derived vectors sent to this client
+	role      string    // Role the client authenticated with, empty when it didn't
+	user      string
+	follow    atomic.Bool // Whether the client shows the presenter's view
+
+	mu           sync.Mutex
+	deliveredSeq uint64               // Sequence number of the last sample written to the connection
+	interval     time.Duration        // Minimum time between samples, 0 when unlimited
+	lastQueued   map[string]time.Time // When the last sample of each device was queued
+	lastAdapted  time.Time
+	overflows    int // Consecutive conflated samples since the last adaptation
+	conflated    uint64
+	skipped      uint64
+	sub          subscription // What the client asked to be sent
+	handshaking  bool         // Samples wait for the client to send hello and subscribe
+	name         string       // Name the client gave in its hello, empty before
+	drops        *dropLog     // When the client missed samples, kept with its resume token
+}
+
+var (
+	nextClientID atomic.Int64
+	upgrader     = websocket.Upgrader{CheckOrigin: originAllowed}
+)
+
+func newClient(conn *websocket.Conn, addr string) *client {
+	c := &client{
+		id:         nextClientID.Add(1),
+		conn:       conn,
+		out:        hub.NewConn(conn),
+		addr:       addr,
+		connected:  time.Now(),
+		lastQueued: make(map[string]time.Time),
+	}
+	c.out.WriteTimeout = *writeTimeout
+	c.out.Prepare = signMessage
+	c.out.Written = c.written
+	return c
+}
+
+// writeLoop sends pending messages to the client until it is closed
+func (c *client) writeLoop() {
+	err := c.out.WriteLoop()
+	var netErr net.Error
+	switch {
+	case err == nil:
+	case errors.As(err, &netErr) && netErr.Timeout():
+		log.Printf("Client %d (%s) stalled for %v, disconnecting", c.id, c.addr, *writeTimeout)
+	case !errors.Is(err, websocket.ErrCloseSent):
+		log.Printf("WebSocket write error: %v", err)
+	}
+}
+
+// written records a message written to the client, with the sequence
+// number of samples
+func (c *client) written(data []byte, seq uint64) {
+	if seq != 0 {
+		c.mu.Lock()
+		c.deliveredSeq = seq
+		c.mu.Unlock()
+	}
+	c.bytes.add(len(data))
+	c.messages.add(1)
+	bytesSent.add(len(data))
+	messagesSent.add(1)
+}
+
+// close stops the writer and the pings, discarding anything still pending
+func (c *client) close() {
+	c.out.Close()
+}
+
+// sendEvent queues an event for the client. Events are never dropped, a
+// client that lets too many pile up is disconnected instead.
+func (c *client) sendEvent(data []byte) {
+	if err := c.out.Event(data); err != nil {
+		log.Printf("Client %d (%s) has %d undelivered events, disconnecting", c.id, c.addr, hub.MaxPendingEvents)
+	}
+}
+
+// offer hands a sample to the client without blocking, replacing any sample
+// of the same device it hasn't sent yet. Samples arriving faster than the
+// client's current rate limit are skipped. When samples keep being conflated the rate limit is
+// tightened, and it is relaxed again once the client has kept up for a while.
+func (c *client) offer(device string, data []byte, seq uint64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handshaking || c.out.Closed() {
+		return
+	}
+
+	if events, samples := c.out.Pending(); events+samples == 0 {
+		c.overflows = 0
+		if c.interval > 0 && now.Sub(c.lastAdapted) >= adaptRestoreAfter {
+			c.adapt(c.interval/2, now)
+		}
+	}
+
+	if c.interval > 0 && now.Sub(c.lastQueued[device]) < c.interval {
+		c.skipped++
+		c.drops.add(dropRateLimited, seq, now)
+		return
+	}
+	if c.sub.interval > 0 && now.Sub(c.lastQueued[device]) < c.sub.interval {
+		// The client asked for fewer samples
+		return
+	}
+
+	if replacedSeq, replaced := c.out.Offer(device, data, seq); replaced {
+		c.conflated++
+		c.drops.add(dropConflated, replacedSeq, now)
+		c.overflows++
+		if c.overflows >= adaptFullThreshold {
+			c.adapt(c.interval*2, now)
+		}
+	}
+	c.lastQueued[device] = now
+}
+
+// adapt changes the client's rate limit, clamped to the adaptive range.
+// Must be called with c.mu held.
+func (c *client) adapt(interval time.Duration, now time.Time) {
+	switch {
+	case interval > adaptMaxInterval:
+		interval = adaptMaxInterval
+	case interval == 0 && c.interval == 0:
+		interval = adaptBaseInterval
+	case interval < adaptBaseInterval:
+		interval = 0
+	}
+	c.overflows = 0
+	c.lastAdapted = now
+	if interval == c.interval {
+		return
+	}
+
+	if interval == 0 {
+		log.Printf("Client %d (%s) caught up, sending every sample", c.id, c.addr)
+	} else {
+		log.Printf("Client %d (%s) is falling behind, limiting to %.1f Hz", c.id, c.addr, float64(time.Second)/float64(interval))
+	}
+	c.interval = interval
+}
+
+// mustMarshalEvent encodes an event whose payload is known to marshal
+func mustMarshalEvent(eventType string, payload any) []byte {
+	data, err := hub.MarshalEvent(eventType, time.Now(), payload)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// broadcastEvent sends a typed event to the WebSocket clients of the namespace
+func (ns *namespace) broadcastEvent(eventType string, payload any) {
+	now := time.Now()
+	data, err := hub.MarshalEvent(eventType, now, payload)
+	if err != nil {
+		log.Printf("Error marshaling %s event: %v", eventType, err)
+		return
+	}
+	if ns == defaultNamespace {
+		recordEvent(eventType, now, payload)
+	}
+
+	ns.clientsMu.Lock()
+	defer ns.clientsMu.Unlock()
+	for _, c := range ns.clients {
+		c.sendEvent(data)
+	}
+}
+
+// broadcastQuaternion makes quat the current orientation of a device of the
+// namespace, empty when untagged, and queues it for its WebSocket clients.
+// Samples of the default namespace are also recorded, forwarded to the
+// output sinks and checked against the fences.
+func (ns *namespace) broadcastQuaternion(device string, quat Quaternion, outlier bool) {
+	now := time.Now()
+	ns.quatMu.Lock()
+	_, known := ns.current[device]
+	ns.current[device] = quat
+	omega := ns.updateMotion(device, quat, now)
+	ns.quatMu.Unlock()
+	marks := sampleMarks{Outlier: outlier}
+	var settled *settledInfo
+	marks.Settling, settled = ns.settle.add(device, quat, now)
+	if !known && !containsString(ns.devices, device) {
+		// Clients were only told about the devices known when they connected
+		ns.broadcastEvent("stream", ns.config().streamInfo(device))
+	}
+
+	seq := ns.seq.Add(1)
+	samplesIn.add(1)
+	ns.samplesIn.add(1)
+	sample := historySample{ID: device, Seq: seq, Time: now, sampleMarks: marks, Quaternion: quat}
+	if t, ok := refClock.refTime(now); ok {
+		sample.RefTime = &t
+	}
+	ns.history.add(sample)
+	ns.publishLive(sample)
+	ns.noise.add(device, quat, now)
+	ns.truth.add(device, quat, now)
+	if ns == defaultNamespace {
+		recordSample(sample)
+		forwardToSinks(sample)
+		ns.checkFences(device, quat, now)
+	}
+
+	if ns.throttle.admit(ns, device, seq, quat, omega, marks, now) {
+		ns.sendSample(device, seq, quat, omega, marks, now)
+	}
+	if settled != nil {
+		who := "The sensor"
+		if device != "" {
+			who = "Device " + device
+		}
+		log.Printf("%s of the %s namespace settled after %.1fs (%s)", who, ns, settled.Seconds, settled.Reason)
+		ns.broadcastEvent("settled", settled)
+	}
+}
+
+// sendSample queues a sample for the WebSocket clients of the namespace
+func (ns *namespace) sendSample(device string, seq uint64, quat Quaternion, omega *quat.Vector, marks sampleMarks, now time.Time) {
+	if ns.chaos.paused(now) {
+		return
+	}
+	// Encode once per distinct unit and vector preference
+	frame := ns.config().Frame
+	encoded := make(map[sampleEncoding][]byte, 2)
+	ns.clientsMu.Lock()
+	defer ns.clientsMu.Unlock()
+	for _, c := range ns.clients {
+		enc, wanted := c.encoding(device, frame)
+		if !wanted {
+			continue
+		}
+		data, ok := encoded[enc]
+		if !ok {
+			var err error
+			data, err = encodeSample(device, seq, quat, omega, marks, enc)
+			if err != nil {
+				log.Printf("Error marshaling quaternion: %v", err)
+				return
+			}
+			encoded[enc] = data
+		}
+		c.offer(device, data, seq, now)
+	}
+}
+
+// sendCurrent offers the client the current quaternion of every device
+func (ns *namespace) sendCurrent(c *client) {
+	frame := ns.config().Frame
+	seq := ns.seq.Load()
+	ns.quatMu.RLock()
+	defer ns.quatMu.RUnlock()
+	for _, device := range ns.knownDevices() {
+		enc, _ := c.encoding(device, frame)
+		data, _ := encodeSample(device, seq, ns.current[device], ns.motion[device].omega, sampleMarks{Settling: ns.settle.settling(device)}, enc)
+		c.offer(device, data, seq, time.Now())
+	}
+}
+
+// handleWebSocket handles WebSocket connections
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+
+	ns := requestNamespace(r)
+	c := newClient(conn, r.RemoteAddr)
+	c.ns = ns
+	cfg := ns.config()
+	c.units = cfg.AngleUnits
+	if v := r.URL.Query().Get("angles"); v != "" {
+		if units, err := quat.ParseUnits(v); err == nil {
+			c.units = units
+		}
+	}
+	c.order = cfg.angleOrder()
+	if v := r.URL.Query().Get("angle_order"); v != "" {
+		if order, err := quat.ParseOrder(v); err == nil {
+			c.order = order
+		}
+	}
+	c.keys, _ = parseQuatKeys(cfg.QuatKeys)
+	if v := r.URL.Query().Get("keys"); v != "" {
+		if keys, err := parseQuatKeys(v); err == nil {
+			c.keys = keys
+		}
+	}
+	c.vectors, _ = parseVectors(cfg.Vectors)
+	if q := r.URL.Query(); q.Has("vectors") {
+		if vectors, err := parseVectors(q.Get("vectors")); err == nil {
+			c.vectors = vectors
+		}
+	}
+	if id, ok := authenticate(r); ok {
+		c.role, c.user = id.Role, id.User
+	}
+	c.follow.Store(r.URL.Query().Get("follow") == "1")
+	c.handshaking = strictClients()
+	token, tokenSeq, tokenKnown := claimToken(ns, r.URL.Query().Get("token"))
+	c.token = token
+	c.drops = tokenDrops(ns, token)
+	go c.writeLoop()
+
+	// Tell the client how to resume, and what it missed if it is resuming
+	seq := ns.seq.Load()
+	conv := describeConvention(cfg)
+	conv.Components, conv.Scalar = quatKeyNames(c.keys)
+	c.sendEvent(mustMarshalEvent("session", sessionInfo{
+		Server:     "quatplot",
+		Version:    serverVersion(),
+		Protocol:   protocolVersion,
+		Epoch:      serverEpoch,
+		Seq:        seq,
+		Token:      token,
+		Units:      prefsFor(c.units),
+		EulerOrder: c.order,
+		Convention: conv,
+		Vectors:    c.vectors.names(),
+		Streams:    ns.streams(),
+		Model:      ns.viewModel.get(),
+		Status:     ns.getStatus(),
+		Settings:   ns.sessionSettings(),
+		Welcome:    cfg.Welcome,
+		Handshake:  sessionHandshake(),
+	}))
+	if info, ok := resumeRequest(r, ns, tokenSeq, tokenKnown); ok {
+		missed := backfill(r, ns, &info)
+		if tokenKnown {
+			c.drops.addGap(info, time.Now())
+		}
+		c.sendEvent(mustMarshalEvent("resume", info))
+		if len(missed) > 0 {
+			c.sendEvent(mustMarshalEvent("backfill", backfillInfo{Samples: samplesWithKeys(missed, c.keys)}))
+		}
+	} else if window := historyWindow(r); window > 0 {
+		// New clients may ask for the recent past, to fill charts at once
+		if batch := ns.recentHistory(window, time.Now(), c.keys); batch != nil {
+			c.sendEvent(mustMarshalEvent("history", batch))
+		}
+	}
+
+	// Send the current quaternion of every device immediately, or once
+	// the client completed the handshake
+	if c.handshaking {
+		timer := c.awaitHandshake()
+		defer timer.Stop()
+	} else {
+		ns.sendCurrent(c)
+	}
+
+	ns.clientsMu.Lock()
+	ns.clients[conn] = c
+	ns.clientsMu.Unlock()
+	if info := ns.presenterInfo(c); info.Active {
+		c.sendEvent(mustMarshalEvent("presenter", info))
+		ns.follow(c, c.follow.Load())
+	}
+
+	log.Println("New WebSocket client connected")
+
+	// Keep connection alive and handle disconnection
+	defer func() {
+		ns.clientsMu.Lock()
+		delete(ns.clients, conn)
+		ns.clientsMu.Unlock()
+		ns.stopPresenting(c)
+		c.close()
+		c.mu.Lock()
+		releaseToken(c.token, c.deliveredSeq)
+		c.mu.Unlock()
+		conn.Close()
+		log.Println("WebSocket client disconnected")
+	}()
+
+	// Read messages from the client, which also keeps the connection alive.
+	// A client that neither answers pings nor sends anything is gone.
+	conn.SetReadLimit(maxClientMessage)
+	go c.out.PingLoop(pingPeriod())
+	err = c.out.ReadLoop(pongWait(), func(data []byte) {
+		ns.handleClientMessage(c, data)
+	})
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		log.Printf("Client %d (%s) answered no ping for %v, disconnecting", c.id, c.addr, pongWait())
+	}
+}
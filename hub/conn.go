@@ -0,0 +1,225 @@
+package hub
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MaxPendingEvents is the number of undelivered events a connection may
+// accumulate before it is considered dead and disconnected
+const MaxPendingEvents = 1024
+
+// ErrBacklog is returned by Conn.Event when the connection had
+// MaxPendingEvents undelivered events, and was closed
+var ErrBacklog = errors.New("too many undelivered events")
+
+// Conn is a WebSocket connection and the messages waiting to be written to
+// it. Events are queued and delivered in order, while samples are conflated
+// so that a slow connection only ever gets the latest one of each device.
+// Offering and queueing never block, the messages are written by WriteLoop.
+type Conn struct {
+	ws *websocket.Conn
+
+	// WriteTimeout is how long writing a message may take before the
+	// connection is given up, DefaultWriteTimeout when zero
+	WriteTimeout time.Duration
+	// Prepare, when set, returns the message to write in place of each
+	// one, e.g. with a signature added
+	Prepare func(data []byte) []byte
+	// Written, when set, is called after each message is written, with the
+	// sequence number of samples and 0 for events
+	Written func(data []byte, seq uint64)
+
+	mu      sync.Mutex
+	wake    chan struct{} // Signals the writer that messages are pending
+	done    chan struct{} // Closed with the connection, ends the pings
+	closed  bool
+	events  [][]byte
+	samples []pendingSample // Latest undelivered sample of each device, oldest first
+}
+
+// pendingSample is an encoded sample waiting to be written
+type pendingSample struct {
+	device string
+	data   []byte
+	seq    uint64
+}
+
+// NewConn returns a Conn writing to ws, with nothing pending
+func NewConn(ws *websocket.Conn) *Conn {
+	return &Conn{ws: ws, wake: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+// signal wakes the writer goroutine. Must be called with c.mu held.
+func (c *Conn) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops WriteLoop and PingLoop, discarding anything still pending. It
+// doesn't close the WebSocket, and may be called more than once.
+func (c *Conn) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.wake)
+		close(c.done)
+	}
+}
+
+// Closed reports whether Close was called
+func (c *Conn) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Pending returns the number of events and samples waiting to be written
+func (c *Conn) Pending() (events, samples int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.events), len(c.samples)
+}
+
+// Event queues an encoded event. Events are never dropped: when
+// MaxPendingEvents are already waiting the WebSocket is closed instead, and
+// ErrBacklog returned.
+func (c *Conn) Event(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	if len(c.events) >= MaxPendingEvents {
+		c.ws.Close()
+		return ErrBacklog
+	}
+	c.events = append(c.events, data)
+	c.signal()
+	return nil
+}
+
+// Offer queues an encoded sample of a device, replacing any sample of the
+// same device that wasn't written yet. It reports the sequence number of the
+// sample it replaced, if any.
+func (c *Conn) Offer(device string, data []byte, seq uint64) (replacedSeq uint64, replaced bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, false
+	}
+	for n, p := range c.samples {
+		if p.device != device {
+			continue
+		}
+		// Queue the replacement last, so that samples stay in sequence order
+		c.samples = append(c.samples[:n], c.samples[n+1:]...)
+		replacedSeq, replaced = p.seq, true
+		break
+	}
+	c.samples = append(c.samples, pendingSample{device: device, data: data, seq: seq})
+	c.signal()
+	return replacedSeq, replaced
+}
+
+// next returns the oldest pending event, or failing that the oldest pending
+// sample and its sequence number
+func (c *Conn) next() (data []byte, seq uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, 0, false
+	}
+	if len(c.events) > 0 {
+		data := c.events[0]
+		c.events[0] = nil
+		c.events = c.events[1:]
+		return data, 0, true
+	}
+	if len(c.samples) > 0 {
+		p := c.samples[0]
+		c.samples[0] = pendingSample{}
+		c.samples = c.samples[1:]
+		return p.data, p.seq, true
+	}
+	return nil, 0, false
+}
+
+// WriteLoop writes pending messages until the connection is closed, or
+// until a write fails. A failed write closes the WebSocket, which ends the
+// reads of its handler, and is returned.
+func (c *Conn) WriteLoop() error {
+	timeout := c.WriteTimeout
+	if timeout <= 0 {
+		timeout = DefaultWriteTimeout
+	}
+	for range c.wake {
+		for {
+			data, seq, ok := c.next()
+			if !ok {
+				break
+			}
+			if c.Prepare != nil {
+				data = c.Prepare(data)
+			}
+			c.ws.SetWriteDeadline(time.Now().Add(timeout))
+			if err := c.ws.WriteMessage(websocket.TextMessage, data); err != nil {
+				c.ws.Close()
+				return err
+			}
+			if c.Written != nil {
+				c.Written(data, seq)
+			}
+		}
+	}
+	return nil
+}
+
+// PingLoop pings the WebSocket every interval until the connection is
+// closed or a ping fails. Pings are written alongside WriteLoop, which the
+// WebSocket allows for control messages.
+func (c *Conn) PingLoop(interval time.Duration) {
+	timeout := c.WriteTimeout
+	if timeout <= 0 {
+		timeout = DefaultWriteTimeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ReadLoop reads messages from the WebSocket until reading fails, passing
+// each one to handle unless it is nil, and returns the error. A connection
+// that neither answers pings nor sends anything for pongWait is given up,
+// the read failing with a timeout.
+func (c *Conn) ReadLoop(pongWait time.Duration, handle func(data []byte)) error {
+	c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		c.ws.SetReadDeadline(time.Now().Add(pongWait))
+		if handle != nil {
+			handle(data)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package hub
+
+import (
+	"encoding/json"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+// Key schemes of quaternion components in samples
+const (
+	KeysIJK  = "ijk"  // i, j, k and real, the default
+	KeysWXYZ = "wxyz" // w, x, y and z, as many other tools expect
+)
+
+// WXYZ is a quaternion with the keys w, x, y and z
+type WXYZ struct {
+	W float64 `json:"w"`
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+// ToWXYZ returns q with the keys w, x, y and z
+func ToWXYZ(q quat.Quaternion) *WXYZ {
+	return &WXYZ{W: q.Real, X: q.I, Y: q.J, Z: q.K}
+}
+
+// Sample is the message sent for each orientation, with the quaternion
+// fields flattened next to the sequence number. Events are sent as objects
+// with a type field, samples have none.
+type Sample struct {
+	ID  string `json:"id,omitempty"` // Device, empty for a single sensor
+	Seq uint64 `json:"seq"`
+	*quat.Quaternion
+	*WXYZ
+	Euler *quat.Euler `json:"euler,omitempty"`
+}
+
+// Encoding is how samples are sent: the keys of the quaternion and the
+// units and rotation order of the Euler angles, or without either. The zero
+// value sends both, with the keys i, j, k and real and angles in degrees in
+// the quat.DefaultOrder.
+type Encoding struct {
+	Units        string // quat.Degrees or quat.Radians, degrees when empty
+	Order        string // Rotation order of the Euler angles, quat.DefaultOrder when empty
+	Keys         string // KeysIJK or KeysWXYZ, KeysIJK when empty
+	NoQuaternion bool   // Leave out the quaternion
+	NoEuler      bool   // Leave out the Euler angles
+}
+
+// Sample returns the message of a sample of a device in the encoding
+func (e Encoding) Sample(device string, seq uint64, q quat.Quaternion) Sample {
+	s := Sample{ID: device, Seq: seq}
+	switch {
+	case e.NoQuaternion:
+	case e.Keys == KeysWXYZ:
+		s.WXYZ = ToWXYZ(q)
+	default:
+		s.Quaternion = &q
+	}
+	if !e.NoEuler {
+		units, order := e.Units, e.Order
+		if units == "" {
+			units = quat.Degrees
+		}
+		if order == "" {
+			order = quat.DefaultOrder
+		}
+		euler := quat.ToEulerOrder(q, units, order)
+		s.Euler = &euler
+	}
+	return s
+}
+
+// Marshal encodes a sample of a device in the encoding
+func (e Encoding) Marshal(device string, seq uint64, q quat.Quaternion) ([]byte, error) {
+	return json.Marshal(e.Sample(device, seq, q))
+}
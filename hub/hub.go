@@ -0,0 +1,173 @@
+// Package hub broadcasts orientation samples to WebSocket clients, such as
+// the viewer of the web package, in the message format of the quatplot
+// server. Each client gets the latest sample of every device: a client too
+// slow to keep up skips samples instead of holding up the others.
+package hub
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/intermernet/quatplot/quat"
+)
+
+const (
+	// DefaultWriteTimeout is the WriteTimeout of a Hub or Conn that doesn't
+	// set one
+	DefaultWriteTimeout = 10 * time.Second
+	// DefaultPingInterval is the PingInterval of a Hub that doesn't set one
+	DefaultPingInterval = 30 * time.Second
+)
+
+// Event is a typed, non-sample message
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data,omitempty"`
+}
+
+// MarshalEvent encodes an event of the type with the payload, sent at t
+func MarshalEvent(eventType string, t time.Time, payload any) ([]byte, error) {
+	return json.Marshal(Event{Type: eventType, Time: t, Data: payload})
+}
+
+// Hub is an http.Handler upgrading requests to WebSockets that are sent
+// every sample given to Broadcast. The zero value is not usable, call New.
+type Hub struct {
+	// CheckOrigin decides whether a page of another origin may connect,
+	// by default only pages of the same host may
+	CheckOrigin func(r *http.Request) bool
+	// WriteTimeout is how long sending a message may take before the
+	// client is disconnected, DefaultWriteTimeout when zero
+	WriteTimeout time.Duration
+	// PingInterval is how often clients are pinged, so that a connection
+	// that silently died is noticed. Clients that answer nothing for twice
+	// as long are disconnected. DefaultPingInterval when zero.
+	PingInterval time.Duration
+	// Encoding is how samples are sent, by default with the keys i, j, k
+	// and real and Euler angles in degrees
+	Encoding Encoding
+
+	mu      sync.Mutex
+	clients map[*websocket.Conn]*Conn
+	latest  map[string][]byte // Last sample of each device, sent to new clients
+	seq     uint64
+	closed  bool
+}
+
+// New returns a Hub without clients
+func New() *Hub {
+	return &Hub{clients: map[*websocket.Conn]*Conn{}, latest: map[string][]byte{}}
+}
+
+// ServeHTTP upgrades the request to a WebSocket and sends it samples until
+// the client disconnects or the hub is closed
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: h.CheckOrigin}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error
+		return
+	}
+	ping := h.PingInterval
+	if ping <= 0 {
+		ping = DefaultPingInterval
+	}
+	c := NewConn(ws)
+	c.WriteTimeout = h.WriteTimeout
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		GoingAway(ws, time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
+	h.clients[ws] = c
+	for device, data := range h.latest {
+		c.Offer(device, data, 0)
+	}
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.clients, ws)
+		h.mu.Unlock()
+		c.Close()
+		ws.Close()
+	}()
+	go c.WriteLoop()
+	go c.PingLoop(ping)
+
+	// Messages from clients are ignored, reading only notices disconnects
+	c.ReadLoop(2*ping, nil)
+}
+
+// Broadcast sends the orientation of a device to every client, replacing
+// any sample of the device a client hasn't been sent yet. Use an empty
+// device for a single sensor.
+func (h *Hub) Broadcast(device string, q quat.Quaternion) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	data, err := h.Encoding.Marshal(device, h.seq, q)
+	if err != nil {
+		// Only NaN and infinite components fail to marshal
+		return
+	}
+	h.latest[device] = data
+	for _, c := range h.clients {
+		c.Offer(device, data, h.seq)
+	}
+}
+
+// Event sends a typed event to every client. Events are never dropped, a
+// client that lets too many pile up is disconnected instead.
+func (h *Hub) Event(eventType string, payload any) error {
+	data, err := MarshalEvent(eventType, time.Now(), payload)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ws, c := range h.clients {
+		if err := c.Event(data); err != nil {
+			log.Printf("WebSocket client %s: %v, disconnecting", ws.RemoteAddr(), err)
+		}
+	}
+	return nil
+}
+
+// Clients returns the number of connected clients
+func (h *Hub) Clients() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Close disconnects every client with a going away close frame, and refuses
+// new ones
+func (h *Hub) Close() {
+	h.mu.Lock()
+	h.closed = true
+	clients := make([]*websocket.Conn, 0, len(h.clients))
+	for ws := range h.clients {
+		clients = append(clients, ws)
+	}
+	h.mu.Unlock()
+	for _, ws := range clients {
+		GoingAway(ws, time.Now().Add(time.Second))
+		ws.Close()
+	}
+}
+
+// GoingAway sends a WebSocket the close frame of a server shutting down,
+// which clients answer by reconnecting later rather than giving up
+func GoingAway(ws *websocket.Conn, deadline time.Time) error {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	return ws.WriteControl(websocket.CloseMessage, msg, deadline)
+}
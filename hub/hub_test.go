@@ -0,0 +1,228 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/intermernet/quatplot/quat"
+)
+
+// dial connects to the WebSocket of a test server
+func dial(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return ws
+}
+
+// readJSON reads the next message of a WebSocket as a JSON object
+func readJSON(t *testing.T, ws *websocket.Conn) map[string]any {
+	t.Helper()
+	var msg map[string]any
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// waitClients waits until the hub has n clients
+func waitClients(t *testing.T, h *Hub, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); h.Clients() != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients, want %d", h.Clients(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	q := quat.FromEuler(0, 0, 90, quat.Degrees, quat.DefaultOrder)
+	tests := []struct {
+		name string
+		enc  Encoding
+		want []string // Keys of the message
+		yaw  float64
+	}{
+		{"zero value", Encoding{}, []string{"euler", "i", "id", "j", "k", "real", "seq"}, 90},
+		{"wxyz in radians", Encoding{Keys: KeysWXYZ, Units: quat.Radians}, []string{"euler", "id", "seq", "w", "x", "y", "z"}, math.Pi / 2},
+		{"quaternion only", Encoding{NoEuler: true}, []string{"i", "id", "j", "k", "real", "seq"}, 0},
+		{"Euler angles only", Encoding{NoQuaternion: true}, []string{"euler", "id", "seq"}, 90},
+	}
+	for _, tt := range tests {
+		data, err := tt.enc.Marshal("imu", 7, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg map[string]any
+		json.Unmarshal(data, &msg)
+		var keys []string
+		for k := range msg {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if got, want := strings.Join(keys, ","), strings.Join(tt.want, ","); got != want {
+			t.Errorf("%s: keys %s, want %s", tt.name, got, want)
+		}
+		if msg["id"] != "imu" || msg["seq"] != 7.0 {
+			t.Errorf("%s: id %v and seq %v, want imu and 7", tt.name, msg["id"], msg["seq"])
+		}
+		if euler, ok := msg["euler"].(map[string]any); ok {
+			if yaw := euler["yaw"].(float64); math.Abs(yaw-tt.yaw) > 1e-9 {
+				t.Errorf("%s: yaw %g, want %g", tt.name, yaw, tt.yaw)
+			}
+		}
+	}
+}
+
+func TestHub(t *testing.T) {
+	h := New()
+	h.Encoding.Keys = KeysWXYZ
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// A client connecting later is sent the latest sample of each device
+	h.Broadcast("a", quat.Identity)
+	ws := dial(t, srv)
+	if msg := readJSON(t, ws); msg["id"] != "a" || msg["w"] != 1.0 || msg["seq"] != 1.0 {
+		t.Errorf("latest sample %v, want seq 1 of a with w 1", msg)
+	}
+	waitClients(t, h, 1)
+
+	h.Broadcast("b", quat.Quaternion{K: 1})
+	if msg := readJSON(t, ws); msg["id"] != "b" || msg["z"] != 1.0 || msg["seq"] != 2.0 {
+		t.Errorf("sample %v, want seq 2 of b with z 1", msg)
+	}
+	if err := h.Event("note", map[string]string{"text": "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, ws); msg["type"] != "note" || msg["data"].(map[string]any)["text"] != "hi" {
+		t.Errorf("event %v, want a note saying hi", msg)
+	}
+
+	// Closing the hub says it is going away, and turns new clients away
+	h.Close()
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("read after Close: %v, want a going away close", err)
+	}
+	_, _, err = dial(t, srv).ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("connecting after Close: %v, want a going away close", err)
+	}
+}
+
+// connPair returns a Conn of the server end of a WebSocket, and the client end
+func connPair(t *testing.T) (*Conn, *websocket.Conn) {
+	t.Helper()
+	server := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		server <- ws
+	}))
+	t.Cleanup(srv.Close)
+	client := dial(t, srv)
+	ws := <-server
+	t.Cleanup(func() { ws.Close() })
+	return NewConn(ws), client
+}
+
+func TestConn(t *testing.T) {
+	c, client := connPair(t)
+
+	// Samples of a device replace those not written yet, and events queue
+	c.Offer("a", []byte(`{"seq":1}`), 1)
+	c.Offer("b", []byte(`{"seq":2}`), 2)
+	if seq, replaced := c.Offer("a", []byte(`{"seq":3}`), 3); !replaced || seq != 1 {
+		t.Errorf("Offer replaced %d, %v, want 1", seq, replaced)
+	}
+	c.Event([]byte(`{"type":"e1"}`))
+	c.Event([]byte(`{"type":"e2"}`))
+	if events, samples := c.Pending(); events != 2 || samples != 2 {
+		t.Errorf("Pending = %d events and %d samples, want 2 and 2", events, samples)
+	}
+
+	var written []uint64
+	done := make(chan struct{})
+	c.Written = func(data []byte, seq uint64) {
+		written = append(written, seq)
+		if len(written) == 4 {
+			close(done)
+		}
+	}
+	c.Prepare = func(data []byte) []byte { return append(data, '\n') }
+	go c.WriteLoop()
+	// Events go first, then the samples oldest first
+	for _, want := range []string{`{"type":"e1"}`, `{"type":"e2"}`, `{"seq":2}`, `{"seq":3}`} {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want+"\n" {
+			t.Errorf("read %q, want %q", data, want+"\n")
+		}
+	}
+	<-done
+	if len(written) != 4 || written[0] != 0 || written[2] != 2 || written[3] != 3 {
+		t.Errorf("Written with %v, want [0 0 2 3]", written)
+	}
+
+	c.Close()
+	c.Close()
+	if !c.Closed() {
+		t.Error("Closed after Close is false")
+	}
+	if _, replaced := c.Offer("a", nil, 4); replaced {
+		t.Error("Offer after Close replaced a sample")
+	}
+}
+
+func TestConnBacklog(t *testing.T) {
+	c, client := connPair(t)
+	for i := 0; i < MaxPendingEvents; i++ {
+		if err := c.Event([]byte(`{}`)); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+	}
+	if err := c.Event([]byte(`{}`)); !errors.Is(err, ErrBacklog) {
+		t.Errorf("event past the limit: %v, want ErrBacklog", err)
+	}
+	// The WebSocket was closed, which the client notices
+	if _, _, err := client.ReadMessage(); err == nil {
+		t.Error("client read a message from a connection closed for its backlog")
+	}
+}
+
+func TestReadLoop(t *testing.T) {
+	c, client := connPair(t)
+	got := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.ReadLoop(50*time.Millisecond, func(data []byte) { got <- string(data) })
+	}()
+	client.WriteMessage(websocket.TextMessage, []byte("hello"))
+	if msg := <-got; msg != "hello" {
+		t.Errorf("handled %q, want hello", msg)
+	}
+	// The client sends nothing more, so the read times out
+	err := <-done
+	if !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("ReadLoop returned %v, want a timeout", err)
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var (
+	importFormat = flag.String("import-format", "auto", "Format of the datasets given to import: auto, x-imu, phyphox or rosbag")
+	importRate   = flag.Float64("import-rate", 0, "Sample rate in Hz of imported data without a time column, such as x-IMU exports timed by packet number")
+	importTopics = flag.String("import-topics", "", "Comma-separated sensor_msgs/Imu topics of a ROS bag to import (default: all of them)")
+)
+
+// Formats of datasets import reads
+const (
+	importXIMU    = "x-imu"
+	importPhyphox = "phyphox"
+	importROSBag  = "rosbag"
+)
+
+// importedDataset is a third-party dataset converted to orientations
+type importedDataset struct {
+	format  string
+	frame   string // Reference frame of the orientations, e.g. "enu"
+	input   string // What the dataset holds, quaternions or raw imu samples fused here
+	samples []importedSample
+}
+
+// importedSample is one orientation of a dataset
+type importedSample struct {
+	t  time.Time
+	id string
+	q  Quaternion
+}
+
+// runImport converts datasets recorded with other tools into recordings
+// that can be played back with -source file, summarized and compared. It
+// returns the process exit code.
+func runImport() int {
+	if flag.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: quatplot import [flags] DATASET...")
+		return 2
+	}
+	if _, err := initConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 1
+	}
+	format, err := recordingFormat("", *recordFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	status := 0
+	for _, in := range flag.Args() {
+		out := importedPath(in, *reprocessDir, format)
+		ds, err := importDataset(in)
+		if err == nil {
+			err = writeImported(in, out, format, ds)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", in, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Imported %d samples of %s (%s) into %s\n", len(ds.samples), in, ds.format, out)
+	}
+	return status
+}
+
+// importedPath returns where the recording converted from a dataset goes
+func importedPath(in, dir, format string) string {
+	ext := ".qlog"
+	if format == formatCSV {
+		ext = ".csv"
+	}
+	base := filepath.Base(filepath.Clean(in))
+	name := strings.TrimSuffix(base, filepath.Ext(base)) + ".imported" + ext
+	if dir == "" {
+		dir = filepath.Dir(filepath.Clean(in))
+	}
+	return filepath.Join(dir, name)
+}
+
+// importDataset reads a dataset in the format given with -import-format, or
+// the one its name and contents suggest
+func importDataset(in string) (*importedDataset, error) {
+	kind := strings.ToLower(*importFormat)
+	if kind == "auto" {
+		kind = guessImportFormat(in)
+	}
+	switch kind {
+	case importROSBag:
+		var topics []string
+		if *importTopics != "" {
+			topics = strings.Split(*importTopics, ",")
+		}
+		return readROSBag(in, topics)
+	case importXIMU, importPhyphox:
+		tables, start, err := readTables(in)
+		if err != nil {
+			return nil, err
+		}
+		return tablesDataset(kind, tables, start)
+	}
+	return nil, fmt.Errorf("unknown import format %q, must be auto, %s, %s or %s", *importFormat, importXIMU, importPhyphox, importROSBag)
+}
+
+// guessImportFormat tells the format of a dataset from its name and first line
+func guessImportFormat(in string) string {
+	if info, err := os.Stat(in); err == nil && info.IsDir() || strings.EqualFold(filepath.Ext(in), ".zip") {
+		return importPhyphox
+	}
+	f, err := os.Open(in)
+	if err != nil {
+		return importPhyphox
+	}
+	defer f.Close()
+	first := make([]byte, 256)
+	n, _ := io.ReadFull(f, first)
+	line, _, _ := bytes.Cut(first[:n], []byte("\n"))
+	lower := strings.ToLower(string(line))
+	switch {
+	case strings.HasPrefix(lower, "#rosbag"):
+		return importROSBag
+	case strings.Contains(lower, "packet number") || strings.Contains(lower, "timestamp (us)"):
+		return importXIMU
+	}
+	return importPhyphox
+}
+
+// dataTable is a CSV export, one row of numbers per sample
+type dataTable struct {
+	name    string
+	columns []string
+	rows    [][]float64
+}
+
+// readTables reads the CSV files of a dataset: a CSV file, or the files of
+// a phyphox export as a zip or unpacked into a directory. The start time is
+// that of the export's meta/time.csv, zero when unknown.
+func readTables(in string) ([]*dataTable, time.Time, error) {
+	var fsys fs.FS
+	info, err := os.Stat(in)
+	switch {
+	case err != nil:
+		return nil, time.Time{}, err
+	case info.IsDir():
+		fsys = os.DirFS(in)
+	case strings.EqualFold(filepath.Ext(in), ".zip"):
+		z, err := zip.OpenReader(in)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		defer z.Close()
+		fsys = z
+	default:
+		f, err := os.Open(in)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		defer f.Close()
+		t, err := readTable(filepath.Base(in), f)
+		return []*dataTable{t}, time.Time{}, err
+	}
+
+	var tables []*dataTable
+	var start time.Time
+	err = fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.EqualFold(path.Ext(p), ".csv") {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		t, err := readTable(p, bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		if path.Base(path.Dir(p)) == "meta" {
+			if path.Base(p) == "time.csv" {
+				start = phyphoxStart(t)
+			}
+			return nil
+		}
+		tables = append(tables, t)
+		return nil
+	})
+	if err == nil && len(tables) == 0 {
+		err = errors.New("no CSV files found")
+	}
+	return tables, start, err
+}
+
+// readTable reads a CSV export with a header row. The separator is the
+// first of comma, semicolon or tab on the header row, and decimal commas
+// are accepted with the latter two, as phyphox writes them.
+func readTable(name string, r io.Reader) (*dataTable, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	header, _, _ := bytes.Cut(data, []byte("\n"))
+	sep := ','
+	if i := bytes.IndexAny(header, ",;\t"); i >= 0 {
+		sep = rune(header[i])
+	}
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.Comma, cr.FieldsPerRecord, cr.LazyQuotes = sep, -1, true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("empty file")
+	}
+	t := &dataTable{name: name, columns: records[0]}
+	for _, rec := range records[1:] {
+		// Short rows are padded with NaN, and skipped with other gaps
+		row := make([]float64, max(len(rec), len(t.columns)))
+		for n := range row {
+			row[n] = math.NaN()
+		}
+		for n, cell := range rec {
+			if sep != ',' {
+				cell = strings.Replace(cell, ",", ".", 1)
+			}
+			if v, err := strconv.ParseFloat(strings.TrimSpace(cell), 64); err == nil {
+				row[n] = v
+			}
+		}
+		t.rows = append(t.rows, row)
+	}
+	return t, nil
+}
+
+// phyphoxStart reads the system time the experiment started at from the
+// meta/time.csv of a phyphox export
+func phyphoxStart(t *dataTable) time.Time {
+	for _, row := range t.rows {
+		// event, experiment time, system time
+		if len(row) >= 3 && !math.IsNaN(row[1]) && row[2] > 0 {
+			sec := row[2] - row[1]
+			return time.Unix(0, int64(sec*1e9)).UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// tableColumns locates the columns of a table
+type tableColumns struct {
+	time      int     // -1 when there is none
+	timeScale float64 // Seconds per unit of the time column
+	packet    bool    // The time column counts packets, see -import-rate
+	quat      [4]int  // w, x, y and z, -1 when missing
+	elements  bool    // The quaternion is x-IMU's Element 1 to 4
+	accel     [3]int
+	gyro      [3]int
+	gyroScale float64 // To rad/s
+}
+
+var (
+	accelColumn = regexp.MustCompile(`^(acceleration|accelerometer) ([xyz])$`)
+	gyroColumn  = regexp.MustCompile(`^(gyroscope|gyro|angular velocity) ([xyz])$`)
+	quatColumn  = regexp.MustCompile(`^(quaternion |q)?([wxyz])$`)
+	elemColumn  = regexp.MustCompile(`^element ([1-4])$`)
+)
+
+// findColumns recognizes the columns of x-IMU, x-IMU3 and phyphox exports
+// by their names, e.g. "Time (s)", "Gyroscope x (rad/s)" or "W"
+func findColumns(names []string) tableColumns {
+	c := tableColumns{time: -1, quat: [4]int{-1, -1, -1, -1}, accel: [3]int{-1, -1, -1}, gyro: [3]int{-1, -1, -1}, gyroScale: 1}
+	axis := func(s string) int { return int(s[0] - 'x') }
+	for n, name := range names {
+		base, unit, _ := strings.Cut(strings.ToLower(strings.TrimSpace(name)), "(")
+		base, unit = strings.TrimSpace(base), strings.TrimSuffix(strings.TrimSpace(unit), ")")
+		switch {
+		case base == "time" || base == "t" || base == "timestamp":
+			c.time, c.timeScale = n, 1
+			switch unit {
+			case "ms":
+				c.timeScale = 1e-3
+			case "us", "µs":
+				c.timeScale = 1e-6
+			case "ns":
+				c.timeScale = 1e-9
+			}
+		case base == "packet number":
+			c.time, c.timeScale, c.packet = n, 1, true
+		case elemColumn.MatchString(base):
+			c.quat[base[len(base)-1]-'1'] = n
+			c.elements = true
+		case quatColumn.MatchString(base):
+			c.quat[strings.Index("wxyz", base[len(base)-1:])] = n
+		case accelColumn.MatchString(base):
+			c.accel[axis(accelColumn.FindStringSubmatch(base)[2])] = n
+		case gyroColumn.MatchString(base):
+			c.gyro[axis(gyroColumn.FindStringSubmatch(base)[2])] = n
+			if strings.Contains(unit, "deg") || strings.Contains(unit, "°") {
+				c.gyroScale = math.Pi / 180
+			}
+		}
+	}
+	return c
+}
+
+func complete(cols []int) bool {
+	for _, n := range cols {
+		if n < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// rowTimes returns the time of each row of a table in seconds from its
+// first, from its time column or -import-rate
+func rowTimes(t *dataTable, c tableColumns) ([]float64, error) {
+	times := make([]float64, len(t.rows))
+	switch {
+	case *importRate > 0:
+	case c.packet:
+		return nil, fmt.Errorf("%s is timed by packet number, give its sample rate with -import-rate", t.name)
+	case c.time < 0:
+		return nil, fmt.Errorf("%s has no time column, give its sample rate with -import-rate", t.name)
+	}
+	for n, row := range t.rows {
+		switch {
+		case c.time >= 0 && !c.packet:
+			times[n] = row[c.time] * c.timeScale
+		case c.packet:
+			times[n] = row[c.time] / *importRate
+		default:
+			times[n] = float64(n) / *importRate
+		}
+	}
+	return times, nil
+}
+
+// tablesDataset converts the tables of an export into orientations: the
+// quaternions of a table that has them, otherwise accelerometer and
+// gyroscope readings fused with -ahrs
+func tablesDataset(kind string, tables []*dataTable, start time.Time) (*importedDataset, error) {
+	var accel, gyro *dataTable
+	var accelCols, gyroCols tableColumns
+	for _, t := range tables {
+		c := findColumns(t.columns)
+		if complete(c.quat[:]) {
+			return quaternionTable(kind, t, c, start)
+		}
+		if accel == nil && complete(c.accel[:]) {
+			accel, accelCols = t, c
+		}
+		if gyro == nil && complete(c.gyro[:]) {
+			gyro, gyroCols = t, c
+		}
+	}
+	if accel == nil || gyro == nil {
+		return nil, errors.New("found no quaternion columns, nor both accelerometer and gyroscope columns, e.g. Time (s), Gyroscope x (rad/s)")
+	}
+	return fuseTables(kind, accel, accelCols, gyro, gyroCols, start)
+}
+
+// quaternionTable reads the orientations of a table of quaternions
+func quaternionTable(kind string, t *dataTable, c tableColumns, start time.Time) (*importedDataset, error) {
+	times, err := rowTimes(t, c)
+	if err != nil {
+		return nil, err
+	}
+	ds := &importedDataset{format: kind, frame: "unspecified", input: inputQuaternion}
+	if kind == importXIMU {
+		// x-IMU and x-IMU3 report in their north-west-up earth frame
+		ds.frame = "nwu"
+	}
+	start = importStart(t.name, start, times)
+	for n, row := range t.rows {
+		q := Quaternion{Real: row[c.quat[0]], I: row[c.quat[1]], J: row[c.quat[2]], K: row[c.quat[3]]}
+		if math.IsNaN(q.Real + q.I + q.J + q.K + times[n]) {
+			continue
+		}
+		if c.elements {
+			// The first x-IMU describes the earth relative to the sensor
+			q = quat.Conjugate(q)
+		}
+		ds.samples = append(ds.samples, importedSample{t: start.Add(seconds(times[n])), q: q})
+	}
+	return ds, nil
+}
+
+// fuseTables fuses accelerometer and gyroscope readings, which may be in
+// separate tables as phyphox exports them, pairing each gyroscope reading
+// with the latest accelerometer one
+func fuseTables(kind string, accel *dataTable, ac tableColumns, gyro *dataTable, gc tableColumns, start time.Time) (*importedDataset, error) {
+	gyroTimes, err := rowTimes(gyro, gc)
+	if err != nil {
+		return nil, err
+	}
+	accelTimes, err := rowTimes(accel, ac)
+	if err != nil {
+		return nil, err
+	}
+	ds := &importedDataset{format: kind, frame: "nwu", input: inputIMU}
+	start = importStart(gyro.name, start, gyroTimes)
+	fusion := &imuFusion{filter: newAHRSFilter(*ahrsName)}
+	a := 0
+	for n, row := range gyro.rows {
+		for a+1 < len(accel.rows) && accelTimes[a+1] <= gyroTimes[n] {
+			a++
+		}
+		s := imuSample{
+			accel: quat.Vector{X: accel.rows[a][ac.accel[0]], Y: accel.rows[a][ac.accel[1]], Z: accel.rows[a][ac.accel[2]]},
+			gyro:  quat.Vector{X: row[gc.gyro[0]] * gc.gyroScale, Y: row[gc.gyro[1]] * gc.gyroScale, Z: row[gc.gyro[2]] * gc.gyroScale},
+		}
+		if math.IsNaN(s.accel.X + s.accel.Y + s.accel.Z + s.gyro.X + s.gyro.Y + s.gyro.Z + gyroTimes[n]) {
+			continue
+		}
+		t := start.Add(seconds(gyroTimes[n]))
+		ds.samples = append(ds.samples, importedSample{t: t, q: fusion.update(s, t)})
+	}
+	return ds, nil
+}
+
+// importStart returns the time the first row of a table was taken at: the
+// start of the export when known, the time column when it holds Unix times,
+// and otherwise as long before the table was last modified as it lasts
+func importStart(name string, start time.Time, times []float64) time.Time {
+	if len(times) == 0 {
+		return start
+	}
+	first, last := times[0], times[len(times)-1]
+	switch {
+	case first > 1e9:
+		// Unix times, made relative to the first here
+		for n := range times {
+			times[n] -= first
+		}
+		return time.Unix(0, int64(first*1e9)).UTC()
+	case !start.IsZero():
+		return start
+	}
+	for n := range times {
+		times[n] -= first
+	}
+	modified := time.Now()
+	if info, err := os.Stat(name); err == nil {
+		modified = info.ModTime()
+	}
+	return modified.Add(-seconds(last - first)).UTC()
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// writeImported writes a dataset as a recording of one session
+func writeImported(in, out, format string, ds *importedDataset) error {
+	if len(ds.samples) == 0 {
+		return errors.New("no samples found")
+	}
+	if sameFile(in, out) {
+		return errors.New("the output must be a different file from the dataset")
+	}
+	sort.SliceStable(ds.samples, func(i, j int) bool { return ds.samples[i].t.Before(ds.samples[j].t) })
+
+	conv := describeConvention(currentConfig())
+	conv.Frame = ds.frame
+	conv.SourceConvention, conv.SourceOrder, conv.SourceInput = conventionHamilton, "real,i,j,k", ds.input
+	conv.SourceEulerOrder, conv.SourceEulerUnits = "", ""
+	started := ds.samples[0].t
+	var buf bytes.Buffer
+	writeRecordingHeader(&buf, format, recordingHeader{
+		Type:       "header",
+		Version:    recordingVersion,
+		Started:    started,
+		Source:     "import " + ds.format,
+		Device:     filepath.Base(filepath.Clean(in)),
+		Convention: conv,
+	})
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var seq uint64
+	for _, s := range ds.samples {
+		q, ok := quat.Normalize(s.q)
+		if !ok {
+			continue
+		}
+		seq++
+		writeRecordedSample(&buf, format, recordedSample{
+			MonoNS:     s.t.Sub(started).Nanoseconds(),
+			Time:       s.t,
+			Seq:        seq,
+			ID:         s.id,
+			Quaternion: q,
+		})
+		if buf.Len() >= recordFlushSize {
+			if _, err := buf.WriteTo(f); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := buf.WriteTo(f); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	influxURL         = flag.String("influx-url", "", "InfluxDB write URL samples are forwarded to, e.g. http://localhost:8086/api/v2/write?org=lab&bucket=imu")
+	influxToken       = flag.String("influx-token", "", "InfluxDB API token")
+	influxMeasurement = flag.String("influx-measurement", "quatplot", "InfluxDB measurement samples are written to")
+)
+
+// influxSink writes samples to InfluxDB using the line protocol over HTTP
+type influxSink struct {
+	url         string
+	token       string
+	measurement string
+	client      *http.Client
+}
+
+func newInfluxSink(writeURL, token, measurement string) *influxSink {
+	return &influxSink{
+		url:         writeURL,
+		token:       token,
+		measurement: measurement,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *influxSink) Kind() string { return "influx" }
+
+func (s *influxSink) Target() string {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return s.url
+	}
+	u.User = nil
+	return u.Redacted()
+}
+
+// influxTagEscaper escapes the characters of a tag value that are special in the line protocol
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// Write sends a batch of samples in one request, with nanosecond timestamps
+// on the reference clock when aligned to one. Samples of tagged devices
+// carry a device tag.
+func (s *influxSink) Write(samples []historySample) error {
+	var body bytes.Buffer
+	for _, sample := range samples {
+		body.WriteString(s.measurement)
+		if sample.ID != "" {
+			body.WriteString(",device=")
+			body.WriteString(influxTagEscaper.Replace(sample.ID))
+		}
+		body.WriteString(" i=")
+		body.WriteString(strconv.FormatFloat(sample.I, 'g', -1, 64))
+		body.WriteString(",j=")
+		body.WriteString(strconv.FormatFloat(sample.J, 'g', -1, 64))
+		body.WriteString(",k=")
+		body.WriteString(strconv.FormatFloat(sample.K, 'g', -1, 64))
+		body.WriteString(",real=")
+		body.WriteString(strconv.FormatFloat(sample.Real, 'g', -1, 64))
+		body.WriteString(",seq=")
+		body.WriteString(strconv.FormatUint(sample.Seq, 10))
+		body.WriteString("i ")
+		stamp := sample.Time
+		if sample.RefTime != nil {
+			stamp = *sample.RefTime
+		}
+		body.WriteString(strconv.FormatInt(stamp.UnixNano(), 10))
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Check pings the InfluxDB server the write URL points at
+func (s *influxSink) Check() error {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return err
+	}
+	ping := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/ping"}
+	resp, err := s.client.Get(ping.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("ping returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"time"
+)
+
+var gopsAddr = flag.String("gops-addr", "", "Listen on this address for the gops tool, e.g. 127.0.0.1:0, so that gops can show the stacks, memory and GC of the running server (empty to disable)")
+
+func init() {
+	expvar.Publish("quatplot", expvar.Func(func() any { return collectVars() }))
+}
+
+// introspectVars are the counters of the server published with expvar
+type introspectVars struct {
+	Uptime     float64           `json:"uptime_seconds"`
+	Goroutines int               `json:"goroutines"`
+	SamplesIn  uint64            `json:"samples_received"`
+	InputRate  float64           `json:"input_rate_hz"`
+	Clients    map[string]int    `json:"clients"` // By namespace, "" for the default one
+	Queues     introspectQueues  `json:"queues"`
+	GC         introspectGC      `json:"gc"`
+	Sinks      map[string]uint64 `json:"sinks_written"`
+	Outliers   map[string]uint64 `json:"outliers"`
+}
+
+// introspectQueues are the depths of the server's queues
+type introspectQueues struct {
+	ClientEvents  map[string]int `json:"client_events"`  // Events waiting for each client, by ID
+	ClientSamples map[string]int `json:"client_samples"` // Conflated samples waiting for each client, by ID
+	LiveDownloads []int          `json:"live_downloads"` // Samples waiting for each /api/live.csv download
+	Sinks         map[string]int `json:"sinks"`          // Samples queued in memory for each sink
+	Recording     uint64         `json:"recording"`      // Samples not yet written to the recording
+}
+
+// introspectGC summarizes the garbage collector, the full runtime.MemStats
+// are published as memstats
+type introspectGC struct {
+	Cycles    uint32  `json:"cycles"`
+	PauseMs   float64 `json:"last_pause_ms"`
+	HeapBytes uint64  `json:"heap_alloc_bytes"`
+	NextBytes uint64  `json:"next_gc_bytes"`
+	Percent   int     `json:"gc_percent"`
+}
+
+// collectVars gathers the published counters
+func collectVars() introspectVars {
+	v := introspectVars{
+		Uptime:     time.Since(startTime).Seconds(),
+		Goroutines: runtime.NumGoroutine(),
+		Clients:    map[string]int{},
+		Sinks:      map[string]uint64{},
+		Outliers:   map[string]uint64{},
+		Queues: introspectQueues{
+			ClientEvents:  map[string]int{},
+			ClientSamples: map[string]int{},
+			LiveDownloads: []int{},
+			Sinks:         map[string]int{},
+		},
+	}
+	v.SamplesIn, v.InputRate = samplesIn.read()
+
+	if defaultNamespace != nil {
+		for _, ns := range namespaces() {
+			ns.clientsMu.Lock()
+			v.Clients[ns.name] = len(ns.clients)
+			for _, c := range ns.clients {
+				id := strconv.FormatInt(c.id, 10)
+				v.Queues.ClientEvents[id], v.Queues.ClientSamples[id] = c.out.Pending()
+			}
+			ns.clientsMu.Unlock()
+			ns.liveMu.Lock()
+			for s := range ns.live {
+				v.Queues.LiveDownloads = append(v.Queues.LiveDownloads, len(s.samples))
+			}
+			ns.liveMu.Unlock()
+			v.Outliers[ns.name] = ns.outliers.Load()
+		}
+	}
+	for _, s := range sinkStatuses() {
+		v.Queues.Sinks[s.Name], v.Sinks[s.Name] = s.Queued, s.Written
+	}
+	if r := activeRecorder; r != nil {
+		r.mu.Lock()
+		v.Queues.Recording = r.samples - r.flushed
+		r.mu.Unlock()
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	v.GC = introspectGC{Cycles: m.NumGC, HeapBytes: m.HeapAlloc, NextBytes: m.NextGC}
+	if m.NumGC > 0 {
+		v.GC.PauseMs = float64(m.PauseNs[(m.NumGC+255)%256]) / 1e6
+	}
+	sample := []metrics.Sample{{Name: "/gc/gogc:percent"}}
+	if metrics.Read(sample); sample[0].Value.Kind() == metrics.KindUint64 {
+		v.GC.Percent = int(sample[0].Value.Uint64())
+	}
+	return v
+}
+
+// handleDebugVars serves the expvar variables like the handler the expvar
+// package registers at /debug/vars, but without the command line, which may
+// hold the password
+func handleDebugVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	vars := map[string]json.RawMessage{}
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key != "cmdline" {
+			vars[kv.Key] = json.RawMessage(kv.Value.String())
+		}
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(vars)
+}
+
+// Commands of the gops tool, each sent as a byte on a new connection
+const (
+	gopsStackTrace   = 0x1
+	gopsGC           = 0x2
+	gopsMemStats     = 0x3
+	gopsVersion      = 0x4
+	gopsHeapProfile  = 0x5
+	gopsCPUProfile   = 0x6
+	gopsStats        = 0x7
+	gopsTrace        = 0x8
+	gopsBinaryDump   = 0x9
+	gopsSetGCPercent = 0x10
+)
+
+// gopsPortFile is where the gops tool finds the port of this process
+var gopsPortFile string
+
+// startGops listens for the gops tool on -gops-addr and tells it the port
+// through a file named after the process ID in its configuration directory
+func startGops() error {
+	if *gopsAddr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", *gopsAddr)
+	if err != nil {
+		return fmt.Errorf("gops: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	if dir, err := gopsConfigDir(); err != nil {
+		log.Printf("Error finding the gops directory, gops needs the address %s: %v", ln.Addr(), err)
+	} else if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("Error creating %s, gops needs the address %s: %v", dir, ln.Addr(), err)
+	} else {
+		path := filepath.Join(dir, strconv.Itoa(os.Getpid()))
+		if err := os.WriteFile(path, []byte(strconv.Itoa(port)), 0o644); err != nil {
+			log.Printf("Error writing %s, gops needs the address %s: %v", path, ln.Addr(), err)
+		} else {
+			gopsPortFile = path
+		}
+	}
+	log.Printf("gops agent listening on %s", ln.Addr())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("Error accepting gops connection: %v", err)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := handleGops(conn); err != nil {
+					log.Printf("Error answering gops: %v", err)
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+// stopGops removes the port file, so that gops no longer lists this process
+// as one it can talk to
+func stopGops() {
+	if gopsPortFile != "" {
+		os.Remove(gopsPortFile)
+	}
+}
+
+// gopsConfigDir returns the directory gops looks for port files in
+func gopsConfigDir() (string, error) {
+	if dir := os.Getenv("GOPS_CONFIG_DIR"); dir != "" {
+		return dir, nil
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gops"), nil
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "gops"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "gops"), nil
+}
+
+// handleGops answers a command of the gops tool
+func handleGops(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case gopsStackTrace:
+		return pprof.Lookup("goroutine").WriteTo(conn, 2)
+	case gopsGC:
+		runtime.GC()
+		_, err := io.WriteString(conn, "ok")
+		return err
+	case gopsMemStats:
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		fmt.Fprintf(conn, "alloc: %v\n", formatBytes(m.Alloc))
+		fmt.Fprintf(conn, "total-alloc: %v\n", formatBytes(m.TotalAlloc))
+		fmt.Fprintf(conn, "sys: %v\n", formatBytes(m.Sys))
+		fmt.Fprintf(conn, "mallocs: %v\n", m.Mallocs)
+		fmt.Fprintf(conn, "frees: %v\n", m.Frees)
+		fmt.Fprintf(conn, "heap-alloc: %v\n", formatBytes(m.HeapAlloc))
+		fmt.Fprintf(conn, "heap-sys: %v\n", formatBytes(m.HeapSys))
+		fmt.Fprintf(conn, "heap-idle: %v\n", formatBytes(m.HeapIdle))
+		fmt.Fprintf(conn, "heap-in-use: %v\n", formatBytes(m.HeapInuse))
+		fmt.Fprintf(conn, "heap-released: %v\n", formatBytes(m.HeapReleased))
+		fmt.Fprintf(conn, "heap-objects: %v\n", m.HeapObjects)
+		fmt.Fprintf(conn, "stack-in-use: %v\n", formatBytes(m.StackInuse))
+		fmt.Fprintf(conn, "stack-sys: %v\n", formatBytes(m.StackSys))
+		fmt.Fprintf(conn, "gc-sys: %v\n", formatBytes(m.GCSys))
+		fmt.Fprintf(conn, "other-sys: %v\n", formatBytes(m.OtherSys))
+		fmt.Fprintf(conn, "next-gc: when heap-alloc >= %v\n", formatBytes(m.NextGC))
+		if m.LastGC > 0 {
+			fmt.Fprintf(conn, "last-gc: %v\n", time.Unix(0, int64(m.LastGC)))
+		} else {
+			fmt.Fprintf(conn, "last-gc: -\n")
+		}
+		fmt.Fprintf(conn, "gc-pause-total: %v\n", time.Duration(m.PauseTotalNs))
+		fmt.Fprintf(conn, "gc-pause: %v\n", m.PauseNs[(m.NumGC+255)%256])
+		fmt.Fprintf(conn, "num-gc: %v\n", m.NumGC)
+		fmt.Fprintf(conn, "num-forced-gc: %v\n", m.NumForcedGC)
+		fmt.Fprintf(conn, "gc-cpu-fraction: %v\n", m.GCCPUFraction)
+		fmt.Fprintf(conn, "enable-gc: %v\n", m.EnableGC)
+		_, err := fmt.Fprintf(conn, "debug-gc: %v\n", m.DebugGC)
+		return err
+	case gopsVersion:
+		_, err := fmt.Fprintf(conn, "%v\n", runtime.Version())
+		return err
+	case gopsHeapProfile:
+		return pprof.WriteHeapProfile(conn)
+	case gopsCPUProfile:
+		if err := pprof.StartCPUProfile(conn); err != nil {
+			return err
+		}
+		time.Sleep(30 * time.Second)
+		pprof.StopCPUProfile()
+	case gopsStats:
+		fmt.Fprintf(conn, "goroutines: %v\n", runtime.NumGoroutine())
+		fmt.Fprintf(conn, "OS threads: %v\n", pprof.Lookup("threadcreate").Count())
+		fmt.Fprintf(conn, "GOMAXPROCS: %v\n", runtime.GOMAXPROCS(0))
+		_, err := fmt.Fprintf(conn, "num CPU: %v\n", runtime.NumCPU())
+		return err
+	case gopsTrace:
+		if err := trace.Start(conn); err != nil {
+			return err
+		}
+		time.Sleep(5 * time.Second)
+		trace.Stop()
+	case gopsBinaryDump:
+		path, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(conn, f)
+		return err
+	case gopsSetGCPercent:
+		percent, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(conn, "New GC percent set to %v. Previous value was %v.\n", percent, debug.SetGCPercent(int(percent)))
+		return err
+	default:
+		return fmt.Errorf("unknown command %#x", cmd)
+	}
+	return nil
+}
+
+// formatBytes writes a size in bytes the way gops shows it
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	allowList = newIPList("allow", "Comma-separated addresses or CIDR ranges allowed to connect (default: everyone)")
+	denyList  = newIPList("deny", "Comma-separated addresses or CIDR ranges refused, even if allowed")
+
+	// refusedAddrs remembers which addresses have been logged as refused
+	refusedAddrs sync.Map
+)
+
+// ipList is a flag holding a list of CIDR ranges
+type ipList struct {
+	nets []*net.IPNet
+	text string
+}
+
+func newIPList(name, usage string) *ipList {
+	l := &ipList{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *ipList) String() string { return l.text }
+
+func (l *ipList) Set(s string) error {
+	nets, err := parseCIDRList(s)
+	if err != nil {
+		return err
+	}
+	l.nets, l.text = nets, s
+	return nil
+}
+
+// contains reports whether ip is in any of the ranges
+func (l *ipList) contains(ip net.IP) bool {
+	return ipInNets(ip, l.nets)
+}
+
+// parseCIDRList parses comma-separated CIDR ranges, where a bare address
+// stands for a range holding just that address
+func parseCIDRList(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an address or CIDR range", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			entry = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR range", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the address a request came from directly
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP returns the address of the client behind a request. For requests
+// from trusted proxies it is taken from X-Forwarded-For, skipping any
+// further trusted proxies from the right.
+func clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if ip == nil || !ipInNets(ip, trustedProxyNets) {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for idx := len(hops) - 1; idx >= 0; idx-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[idx]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !ipInNets(hop, trustedProxyNets) {
+			break
+		}
+	}
+	return ip
+}
+
+// filterIPs refuses requests from clients outside -allow or inside -deny
+func filterIPs(next http.Handler) http.Handler {
+	if len(allowList.nets) == 0 && len(denyList.nets) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ip == nil || denyList.contains(ip) || (len(allowList.nets) > 0 && !allowList.contains(ip)) {
+			if _, logged := refusedAddrs.LoadOrStore(ip.String(), true); !logged {
+				log.Printf("Refusing requests from %s", ip)
+			}
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/intermernet/quatplot/hub"
+)
+
+// Key schemes of quaternion components in the JSON sent to clients
+const (
+	keysIJK  = hub.KeysIJK  // i, j, k and real, the default
+	keysWXYZ = hub.KeysWXYZ // w, x, y and z, as many other tools expect
+)
+
+var quatKeys = flag.String("quat-keys", keysIJK, "Keys of quaternion components in the JSON sent to clients, ijk for i, j, k and real, or wxyz for w, x, y and z")
+
+// parseQuatKeys validates a key scheme, accepting the keys spelled out
+func parseQuatKeys(s string) (string, error) {
+	switch strings.ToLower(strings.ReplaceAll(s, ",", "")) {
+	case "", keysIJK, "ijkreal":
+		return keysIJK, nil
+	case keysWXYZ, "xyzw":
+		return keysWXYZ, nil
+	}
+	return "", fmt.Errorf("unknown quaternion keys %q, expected ijk or wxyz", s)
+}
+
+// quatKeyNames returns the keys of the vector part and of the scalar in a
+// key scheme, as declared in the session message
+func quatKeyNames(keys string) ([]string, string) {
+	if keys == keysWXYZ {
+		return []string{"x", "y", "z", "w"}, "w"
+	}
+	return []string{"i", "j", "k", "real"}, "real"
+}
+
+// wxyzSample is a historySample with the keys w, x, y and z
+type wxyzSample struct {
+	ID      string     `json:"id,omitempty"`
+	Seq     uint64     `json:"seq"`
+	Time    time.Time  `json:"time"`
+	RefTime *time.Time `json:"ref_time,omitempty"`
+	sampleMarks
+	*hub.WXYZ
+}
+
+// samplesWithKeys returns samples to marshal with the keys of a scheme
+func samplesWithKeys(samples []historySample, keys string) any {
+	if keys != keysWXYZ {
+		return samples
+	}
+	out := make([]wxyzSample, len(samples))
+	for n, s := range samples {
+		out[n] = wxyzSample{ID: s.ID, Seq: s.Seq, Time: s.Time, RefTime: s.RefTime, sampleMarks: s.sampleMarks, WXYZ: hub.ToWXYZ(s.Quaternion)}
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/intermernet/quatplot/web"
+)
+
+// kioskWatchdog is how long a source may stay silent in kiosk mode before
+// it is restarted, unless -watchdog says otherwise
+const kioskWatchdog = 10 * time.Second
+
+var (
+	kiosk        = flag.Bool("kiosk", false, "Run an unattended display: load the default model, hide the menus, reconnect viewers quickly and reload them when stuck, restart stalled sources and show an uptime overlay")
+	defaultModel = flag.String("default-model", "", "Model of the -model-dir library viewers show until another one is chosen through /api/view/model (default: none, the first model of the library with -kiosk)")
+	watchdog     = flag.Duration("watchdog", 0, "Restart a source that has sent no samples for this long (default: off, 10s with -kiosk)")
+)
+
+// currentClientSettings returns the settings of the viewer page
+func currentClientSettings() web.Settings {
+	if *kiosk {
+		return web.Settings{Kiosk: true, ReconnectMs: 500, MaxReconnectMs: 5000, ReloadAfterMs: 60000}
+	}
+	return web.DefaultSettings
+}
+
+// watchdogTimeout returns how long sources may stay silent, 0 when they
+// aren't watched
+func watchdogTimeout() time.Duration {
+	if *watchdog == 0 && *kiosk {
+		return kioskWatchdog
+	}
+	return max(*watchdog, 0)
+}
+
+// initDefaultModel makes viewers of every namespace start with the default
+// model of the library
+func initDefaultModel() error {
+	name := *defaultModel
+	if name == "" && *kiosk {
+		if list, err := listModels(); err == nil && len(list) > 0 {
+			name = list[0].Name
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	m, ok := loadModelInfo(name)
+	if !ok {
+		return fmt.Errorf("no model %s in the -model-dir library", name)
+	}
+	for _, ns := range namespaces() {
+		ns.viewModel.set(m)
+	}
+	log.Printf("Viewers start with model %s", m.Name)
+	return nil
+}
+
+// watch restarts the source whenever it has been open for timeout without
+// sending a sample, for sensors that hang without closing the connection
+func (s *sourceRunner) watch(timeout time.Duration) {
+	ticker := time.NewTicker(max(timeout/4, 100*time.Millisecond))
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		active, since := s.active, s.opened
+		if last := time.Unix(0, s.lastSample.Load()); last.After(since) {
+			since = last
+		}
+		stalled := active != nil && time.Since(since) > timeout
+		if stalled {
+			// Give the restart a full timeout before judging again
+			s.opened = time.Now()
+		}
+		s.mu.Unlock()
+		if stalled {
+			log.Printf("No samples from %s for %v, restarting it", sourceName(active), timeout)
+			s.restart()
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"mime"
+	"net/http"
+)
+
+var maxBodySize = flag.Int64("max-body", 64<<10, "Maximum size in bytes of HTTP request bodies")
+
+// limitBodies refuses request bodies larger than -max-body. Bodies sent
+// without a length are cut off at the limit while being read.
+func limitBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > *maxBodySize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, *maxBodySize)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeJSONBody decodes a request body holding a single JSON object into v.
+// When the body is not sent as application/json, doesn't start like a JSON
+// object, is too large or is followed by other data, it writes the error
+// response and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	// Requiring the JSON media type also stops plain cross-site form posts
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	// Check the first byte before parsing, so that binary data is refused straight away
+	body := bufio.NewReader(r.Body)
+	for {
+		c, err := body.ReadByte()
+		if err != nil {
+			return bodyError(w, err)
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+		if c != '{' {
+			http.Error(w, "invalid request body: expected a JSON object", http.StatusBadRequest)
+			return false
+		}
+		body.UnreadByte()
+		break
+	}
+
+	dec := json.NewDecoder(body)
+	if err := dec.Decode(v); err != nil {
+		return bodyError(w, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after JSON object")
+		}
+		return bodyError(w, err)
+	}
+	return true
+}
+
+// bodyError writes the response for an error reading a request body and returns false
+func bodyError(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+	case err == io.EOF:
+		http.Error(w, "invalid request body: empty", http.StatusBadRequest)
+	default:
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+	}
+	return false
+}
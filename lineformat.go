@@ -0,0 +1,384 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var (
+	inputFormatSpec = flag.String("format", "", `Layout of incoming lines, e.g. "w,x,y,z" or "x y z w", with _ for an ignored column and a trailing ... for any further ones (default: the order setting, "i,j,k,real")`)
+	inputMode       = flag.String("input", inputQuaternion, "What incoming lines hold: quaternion, euler for roll,pitch,yaw angles, matrix for a row-major 3x3 rotation matrix or imu for raw accelerometer, gyroscope and magnetometer readings")
+)
+
+// Kinds of values sensors send on each line
+const (
+	inputQuaternion = "quaternion"
+	inputEuler      = "euler"
+	inputMatrix     = "matrix"
+	inputIMU        = "imu"
+)
+
+// inputKind describes the values of one kind of input
+type inputKind struct {
+	name       string
+	components []string // Values each line must hold
+	optional   []string // Values lines may also hold, all of them or none
+	extras     []string // Values lines may also hold, each on its own
+	describe   string   // How to name them in a format
+}
+
+var inputKinds = []inputKind{
+	{name: inputQuaternion, components: []string{"i", "j", "k", "real"}, describe: "i, j, k and real, or x, y, z and w"},
+	{name: inputEuler, components: []string{"roll", "pitch", "yaw"}, describe: "roll, pitch and yaw"},
+	{name: inputMatrix, components: []string{"m11", "m12", "m13", "m21", "m22", "m23", "m31", "m32", "m33"}, describe: "m11 to m33"},
+	{name: inputIMU, components: []string{"ax", "ay", "az", "gx", "gy", "gz"}, optional: []string{"mx", "my", "mz"}, extras: []string{"temp"}, describe: "ax, ay, az, gx, gy and gz, optionally with mx, my and mz, and temp"},
+}
+
+// componentNames maps the column names accepted in a line format to the
+// values they hold
+var componentNames = map[string]string{
+	"x": "i", "y": "j", "z": "k", "w": "real",
+}
+
+func init() {
+	for _, kind := range inputKinds {
+		for _, c := range append(append(kind.components, kind.optional...), kind.extras...) {
+			componentNames[c] = c
+		}
+	}
+}
+
+// lookupInputKind returns the kind of input a value belongs to
+func lookupInputKind(component string) inputKind {
+	for _, kind := range inputKinds {
+		if containsString(kind.components, component) || containsString(kind.optional, component) || containsString(kind.extras, component) {
+			return kind
+		}
+	}
+	return inputKinds[0]
+}
+
+// inputKindNamed returns the kind of input with the given name
+func inputKindNamed(name string) inputKind {
+	for _, kind := range inputKinds {
+		if kind.name == name {
+			return kind
+		}
+	}
+	return inputKinds[0]
+}
+
+// parseInputMode validates the kind of values incoming lines hold
+func parseInputMode(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", inputQuaternion:
+		return inputQuaternion, nil
+	case inputEuler:
+		return inputEuler, nil
+	case inputMatrix:
+		return inputMatrix, nil
+	case inputIMU:
+		return inputIMU, nil
+	}
+	return "", fmt.Errorf("unknown input %q, expected quaternion, euler, matrix or imu", s)
+}
+
+// lineFormatDelims are the column separators a line format may use. A
+// format without any of them has columns separated by white space.
+const lineFormatDelims = ",;|:"
+
+// lineFormat describes the layout of the text lines sensors send: which
+// column holds each component, how columns are separated and which are ignored
+type lineFormat struct {
+	columns []string // Component of each column, empty for ignored ones
+	delim   string   // Column separator, empty for any run of white space
+	extra   bool     // Columns after the last one are ignored
+
+	input string // Kind of values the columns hold, e.g. "euler"
+	units string // Units of Euler angles or gyroscope rates, degrees unless set to "rad"
+	order string // Rotation order of Euler angles, ZYX when empty
+	err   error  // Why the configured format is unusable, returned for every line
+
+	layout *quat.Format   // Parses the lines of quaternion input
+	fusion *imuFusion     // Filter turning raw IMU lines into orientations
+	packet packetProtocol // Framing of binary packets, nil for text lines
+}
+
+// parseLineFormat parses a line format such as "i,j,k,real", "w x y z",
+// "_;x;y;z;w;...", "roll,pitch,yaw" or "m11,m12,...,m33". The first separator used in the
+// format separates the columns of lines.
+func parseLineFormat(spec string) (*lineFormat, error) {
+	f := &lineFormat{}
+	var names []string
+	if idx := strings.IndexAny(spec, lineFormatDelims); idx >= 0 {
+		f.delim = spec[idx : idx+1]
+		names = strings.Split(spec, f.delim)
+	} else {
+		names = strings.Fields(spec)
+	}
+	if n := len(names); n > 0 && strings.TrimSpace(names[n-1]) == "..." {
+		f.extra, names = true, names[:n-1]
+	}
+
+	var known []string
+	for name := range componentNames {
+		known = append(known, name)
+	}
+	sort.Strings(known)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "_" {
+			f.columns = append(f.columns, "")
+			continue
+		}
+		component, ok := componentNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("component %q unknown%s", name, didYouMean(name, known))
+		}
+		if seen[component] {
+			return nil, fmt.Errorf("component %q appears more than once", name)
+		}
+		seen[component] = true
+		f.columns = append(f.columns, component)
+	}
+	kind := inputKinds[0]
+	for _, c := range f.columns {
+		if c != "" {
+			kind = lookupInputKind(c)
+			break
+		}
+	}
+	for _, c := range f.columns {
+		if c != "" && !containsString(kind.components, c) && !containsString(kind.optional, c) && !containsString(kind.extras, c) {
+			return nil, fmt.Errorf("component %q can't be mixed with %s", c, kind.describe)
+		}
+	}
+	for _, c := range kind.components {
+		if !seen[c] {
+			return nil, fmt.Errorf("component %q missing, the format must name %s", c, kind.describe)
+		}
+	}
+	for _, c := range kind.optional {
+		if seen[kind.optional[0]] != seen[c] {
+			return nil, fmt.Errorf("components %s must all be given or none", strings.Join(kind.optional, ", "))
+		}
+	}
+	f.input = kind.name
+	if f.input == inputQuaternion {
+		// Lines of quaternions are parsed as the quat package does for
+		// programs embedding it, the other kinds are converted below
+		var err error
+		if f.layout, err = quat.ParseFormat(spec); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// parse reads a quaternion from a line in the format
+func (f *lineFormat) parse(line string) (Quaternion, error) {
+	if f.err != nil {
+		return Quaternion{}, f.err
+	}
+	if f.layout != nil {
+		return f.layout.Parse(line)
+	}
+	var parts []string
+	if f.delim == "" {
+		parts = strings.Fields(line)
+	} else {
+		parts = strings.Split(strings.TrimSpace(line), f.delim)
+	}
+	switch {
+	case f.extra && len(parts) < len(f.columns):
+		return Quaternion{}, fmt.Errorf("expected at least %d values, got %d", len(f.columns), len(parts))
+	case !f.extra && len(parts) != len(f.columns):
+		return Quaternion{}, fmt.Errorf("expected %d values, got %d", len(f.columns), len(parts))
+	}
+
+	values := make(map[string]float64, len(f.columns))
+	for idx, component := range f.columns {
+		if component == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(parts[idx]), 64)
+		if err != nil {
+			return Quaternion{}, fmt.Errorf("invalid %s value: %v", component, err)
+		}
+		values[component] = v
+	}
+	return f.convert(values)
+}
+
+// convert turns the values of one line, by component, into a quaternion
+func (f *lineFormat) convert(values map[string]float64) (Quaternion, error) {
+	switch f.input {
+	case inputEuler:
+		order := f.order
+		if order == "" {
+			order = defaultEulerOrder
+		}
+		return quat.FromEuler(values["roll"], values["pitch"], values["yaw"], f.units, order), nil
+	case inputIMU:
+		s := imuSample{
+			accel: quat.Vector{X: values["ax"], Y: values["ay"], Z: values["az"]},
+			gyro:  quat.Vector{X: values["gx"], Y: values["gy"], Z: values["gz"]},
+			mag:   quat.Vector{X: values["mx"], Y: values["my"], Z: values["mz"]},
+		}
+		_, s.hasMag = values["mx"]
+		s.temp, s.hasTemp = values["temp"]
+		if f.units != quat.Radians {
+			s.gyro = quat.Vector{X: s.gyro.X * math.Pi / 180, Y: s.gyro.Y * math.Pi / 180, Z: s.gyro.Z * math.Pi / 180}
+		}
+		if f.fusion == nil {
+			f.fusion = &imuFusion{filter: newAHRSFilter(ahrsMadgwick)}
+		}
+		return f.fusion.update(s, time.Now()), nil
+	case inputMatrix:
+		var m [3][3]float64
+		for r := 0; r < 3; r++ {
+			for c := 0; c < 3; c++ {
+				m[r][c] = values[fmt.Sprintf("m%d%d", r+1, c+1)]
+			}
+		}
+		return quat.FromMatrix(m)
+	}
+	return Quaternion{I: values["i"], J: values["j"], K: values["k"], Real: values["real"]}, nil
+}
+
+// components returns the components in the order of their columns, e.g.
+// "real,i,j,k"
+func (f *lineFormat) components() string {
+	var components []string
+	for _, c := range f.columns {
+		if c != "" {
+			components = append(components, c)
+		}
+	}
+	return strings.Join(components, ",")
+}
+
+// parseQuaternion parses a line in the given format, e.g. "i,j,k,real" or
+// "w x y z", see parseLineFormat
+func parseQuaternion(line, format string) (Quaternion, error) {
+	f, err := parseLineFormat(format)
+	if err != nil {
+		return Quaternion{}, err
+	}
+	return f.parse(line)
+}
+
+// componentOrder returns the order of the components in a format, or the
+// format itself when it doesn't parse
+func componentOrder(format string) string {
+	if f, err := parseLineFormat(format); err == nil {
+		return f.components()
+	}
+	return format
+}
+
+// validOrder reports whether a component order or format names each of i,
+// j, k and real exactly once
+func validOrder(order string) bool {
+	return checkOrder(order) == nil
+}
+
+// checkOrder explains what is wrong with a component order or format of
+// quaternion lines
+func checkOrder(order string) error {
+	f, err := parseLineFormat(order)
+	if err == nil && f.input != inputQuaternion {
+		return fmt.Errorf("names %s, which need a format and %s input", inputKindNamed(f.input).describe, f.input)
+	}
+	return err
+}
+
+// checkInput explains why the format doesn't fit the kind of input
+func (f *lineFormat) checkInput(input string) error {
+	if f.input == input {
+		return nil
+	}
+	if input == inputQuaternion {
+		return fmt.Errorf("names %s, set the input to %s", inputKindNamed(f.input).describe, f.input)
+	}
+	return fmt.Errorf("names %s, expected %s with %s input", inputKindNamed(f.input).describe, inputKindNamed(input).describe, input)
+}
+
+// lineFormat returns the layout of incoming lines, with Euler angles
+// converted as configured. A format that doesn't parse, or doesn't match the
+// kind of input, yields an error for every line.
+func (cfg Config) lineFormat() *lineFormat {
+	f, err := cfg.checkLineFormat()
+	if err != nil {
+		return &lineFormat{err: err}
+	}
+	return f
+}
+
+// checkLineFormat parses the layout of incoming lines and checks that it
+// matches the kind of input
+func (cfg Config) checkLineFormat() (*lineFormat, error) {
+	spec := cfg.inputFormat()
+	f, err := parseLineFormat(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid line format %q: %v", spec, err)
+	}
+	input, err := parseInputMode(cfg.Input)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.checkInput(input); err != nil {
+		return nil, fmt.Errorf("line format %q %v", spec, err)
+	}
+	switch p := cfg.protocol(); p {
+	case protocolBinary:
+		if f.extra {
+			return nil, fmt.Errorf("line format %q ends with ..., binary packets need every value named", spec)
+		}
+		if f.packet, err = parsePacketFormat(len(f.columns)); err != nil {
+			return nil, err
+		}
+	case protocolBNORVC, protocolBNOSHTP:
+		// The sensor's own packets, which don't follow the format
+		if input != inputQuaternion {
+			return nil, fmt.Errorf("the %s protocol sends orientations, it can't be used with %s input", p, input)
+		}
+		if *bnoRate <= 0 {
+			return nil, fmt.Errorf("invalid BNO report rate %g, must be positive", *bnoRate)
+		}
+		f.packet = bnoRVC{}
+		if p == protocolBNOSHTP {
+			f.packet = bnoSHTP{rate: *bnoRate}
+		}
+	}
+	if f.input == inputIMU {
+		if f.units, err = quat.ParseUnits(cfg.gyroUnits()); err != nil {
+			return nil, err
+		}
+		filter, err := parseAHRS(cfg.AHRS)
+		if err != nil {
+			return nil, err
+		}
+		f.fusion = &imuFusion{filter: newAHRSFilter(filter), rate: cfg.IMURate}
+		if *gyroBiasDir != "" && containsString(f.columns, "temp") {
+			f.fusion.bias = gyroBiasModelFor(cfg.sensorID())
+		}
+	}
+	if f.input == inputEuler {
+		if f.units, err = quat.ParseUnits(cfg.eulerUnits()); err != nil {
+			return nil, err
+		}
+		if f.order, err = quat.ParseOrder(cfg.eulerOrder()); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
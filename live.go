@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+const (
+	// liveBuffer is how many samples a live download may fall behind by
+	// before samples are dropped
+	liveBuffer = 1024
+	// liveFlushInterval is how often buffered CSV lines are sent
+	liveFlushInterval = 100 * time.Millisecond
+	// liveColumns names the columns of /api/live.csv
+	liveColumns = "time,seq,id,i,j,k,real,roll,pitch,yaw"
+)
+
+// liveSubscriber is a download of the live stream
+type liveSubscriber struct {
+	samples chan historySample
+	dropped int
+}
+
+var (
+	// liveDone is closed when the server shuts down, to end the downloads
+	liveDone     = make(chan struct{})
+	liveDoneOnce sync.Once
+)
+
+// stopLiveStreams ends every live download
+func stopLiveStreams() {
+	liveDoneOnce.Do(func() { close(liveDone) })
+}
+
+// subscribeLive registers a download of the namespace's samples
+func (ns *namespace) subscribeLive() *liveSubscriber {
+	s := &liveSubscriber{samples: make(chan historySample, liveBuffer)}
+	ns.liveMu.Lock()
+	ns.live[s] = struct{}{}
+	ns.liveMu.Unlock()
+	return s
+}
+
+func (ns *namespace) unsubscribeLive(s *liveSubscriber) {
+	ns.liveMu.Lock()
+	delete(ns.live, s)
+	ns.liveMu.Unlock()
+}
+
+// publishLive hands a sample to the live downloads without blocking,
+// dropping it for those that have fallen behind
+func (ns *namespace) publishLive(sample historySample) {
+	ns.liveMu.Lock()
+	defer ns.liveMu.Unlock()
+	for s := range ns.live {
+		select {
+		case s.samples <- sample:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// handleLiveCSV streams the samples of the namespace as CSV for as long as
+// the connection is open, e.g. curl -N http://localhost:8080/api/live.csv.
+// ?device=ID keeps a single device, ?rate=HZ thins each device's samples
+// out to at most that rate, ?duration=30s ends the download after a while
+// and ?angles=rad sets the units of the Euler angles.
+func handleLiveCSV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ns := requestNamespace(r)
+	q := r.URL.Query()
+	units := ns.config().AngleUnits
+	if v := q.Get("angles"); v != "" {
+		var err error
+		if units, err = quat.ParseUnits(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var interval time.Duration
+	if v := q.Get("rate"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate <= 0 {
+			http.Error(w, "invalid rate, expected a positive number of Hz", http.StatusBadRequest)
+			return
+		}
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+	var deadline <-chan time.Time
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid duration, expected e.g. 30s", http.StatusBadRequest)
+			return
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	device, filtered := q.Get("device"), q.Has("device")
+
+	s := ns.subscribeLive()
+	log.Printf("Streaming samples of the %s namespace as CSV to %s", ns, r.RemoteAddr)
+	rows := 0
+	defer func() {
+		ns.unsubscribeLive(s)
+		log.Printf("CSV stream to %s ended after %d samples, %d dropped", r.RemoteAddr, rows, s.dropped)
+	}()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "# angles: %s\n", units)
+	out.WriteString(liveColumns + "\n")
+	out.Flush()
+	flusher.Flush()
+
+	ticker := time.NewTicker(liveFlushInterval)
+	defer ticker.Stop()
+	last := map[string]time.Time{}
+	for {
+		select {
+		case sample := <-s.samples:
+			if filtered && sample.ID != device {
+				continue
+			}
+			if interval > 0 {
+				if sample.Time.Sub(last[sample.ID]) < interval {
+					continue
+				}
+				last[sample.ID] = sample.Time
+			}
+			writeLiveSample(out, sample, units)
+			rows++
+		case <-ticker.C:
+			if out.Buffered() == 0 {
+				continue
+			}
+			if out.Flush() != nil {
+				return
+			}
+			flusher.Flush()
+		case <-deadline:
+			out.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		case <-liveDone:
+			out.Flush()
+			return
+		}
+	}
+}
+
+// writeLiveSample appends a CSV line for the sample
+func writeLiveSample(out *bufio.Writer, s historySample, units string) {
+	e := quat.ToEuler(s.Quaternion, units)
+	b := out.AvailableBuffer()
+	b = s.Time.AppendFormat(b, time.RFC3339Nano)
+	b = append(b, ',')
+	b = strconv.AppendUint(b, s.Seq, 10)
+	b = append(b, ',')
+	b = append(b, s.ID...)
+	for _, v := range []float64{s.I, s.J, s.K, s.Real, e.Roll, e.Pitch, e.Yaw} {
+		b = append(b, ',')
+		b = strconv.AppendFloat(b, v, 'g', -1, 64)
+	}
+	out.Write(append(b, '\n'))
+}
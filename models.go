@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var modelDir = flag.String("model-dir", "", "Directory of .obj models, with their .mtl materials and textures, and of .stl, .ply, .glb and .gltf models, that viewers can load from the server (default: no model library)")
+
+// modelExts are the extensions of the files of the library that are models
+var modelExts = map[string]bool{".obj": true, ".stl": true, ".ply": true, ".glb": true, ".gltf": true}
+
+// modelInfo describes a model of the library: an .obj file, the .mtl file
+// of the same name if there is one, and the textures the .mtl refers to, or
+// an .stl, .ply, .glb or .gltf file and the buffers and images a .gltf
+// refers to
+type modelInfo struct {
+	Name      string   `json:"name"`
+	MTL       string   `json:"mtl,omitempty"`
+	Textures  []string `json:"textures,omitempty"`
+	Resources []string `json:"resources,omitempty"` // Buffers and images of a .gltf file
+	Size      int64    `json:"size"`                // Bytes of the model file
+}
+
+// viewModelInfo is the body of /api/view/model and of model events
+type viewModelInfo struct {
+	Model *modelInfo `json:"model"` // null for the viewer's own model
+}
+
+// viewModel is the model every viewer of a namespace is asked to show
+type viewModel struct {
+	mu    sync.Mutex
+	model *modelInfo // nil for the viewer's own model
+}
+
+func (v *viewModel) get() *modelInfo {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.model
+}
+
+func (v *viewModel) set(m *modelInfo) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.model = m
+}
+
+// libraryFile reports whether name is a file directly in the model library,
+// and returns its path
+func libraryFile(name string) (string, bool) {
+	if *modelDir == "" || name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return "", false
+	}
+	path := filepath.Join(*modelDir, name)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	return path, true
+}
+
+// loadModelInfo describes the model of the library in the file name
+func loadModelInfo(name string) (*modelInfo, bool) {
+	ext := strings.ToLower(filepath.Ext(name))
+	if !modelExts[ext] {
+		return nil, false
+	}
+	path, ok := libraryFile(name)
+	if !ok {
+		return nil, false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	m := &modelInfo{Name: name, Size: info.Size()}
+	switch ext {
+	case ".obj":
+		mtl := strings.TrimSuffix(name, filepath.Ext(name)) + ".mtl"
+		if mtlPath, ok := libraryFile(mtl); ok {
+			m.MTL = mtl
+			m.Textures = mtlTextures(mtlPath)
+		}
+	case ".gltf":
+		m.Resources = gltfResources(path)
+	}
+	return m, true
+}
+
+// gltfResources returns the buffers and images a .gltf file refers to that
+// are in the library, by file name. Those embedded as data: URIs need no
+// file.
+func gltfResources(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var doc struct {
+		Buffers []struct {
+			URI string `json:"uri"`
+		} `json:"buffers"`
+		Images []struct {
+			URI string `json:"uri"`
+		} `json:"images"`
+	}
+	if json.Unmarshal(data, &doc) != nil {
+		return nil
+	}
+	uris := make([]string, 0, len(doc.Buffers)+len(doc.Images))
+	for _, b := range doc.Buffers {
+		uris = append(uris, b.URI)
+	}
+	for _, img := range doc.Images {
+		uris = append(uris, img.URI)
+	}
+	seen := map[string]bool{}
+	var resources []string
+	for _, uri := range uris {
+		if uri == "" || strings.HasPrefix(uri, "data:") {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(uri); err == nil {
+			uri = unescaped
+		}
+		name := filepath.Base(strings.ReplaceAll(uri, `\`, "/"))
+		if _, ok := libraryFile(name); ok && !seen[name] {
+			seen[name] = true
+			resources = append(resources, name)
+		}
+	}
+	return resources
+}
+
+// mtlTextures returns the texture maps a material file refers to that are
+// in the library, by file name
+func mtlTextures(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	seen := map[string]bool{}
+	var textures []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(strings.ToLower(fields[0]), "map_") && !strings.EqualFold(fields[0], "bump") {
+			continue
+		}
+		// The file is last, after any options
+		name := filepath.Base(strings.ReplaceAll(fields[len(fields)-1], `\`, "/"))
+		if _, ok := libraryFile(name); ok && !seen[name] {
+			seen[name] = true
+			textures = append(textures, name)
+		}
+	}
+	return textures
+}
+
+// listModels returns the models of the library, by name
+func listModels() ([]modelInfo, error) {
+	list := []modelInfo{}
+	if *modelDir == "" {
+		return list, nil
+	}
+	entries, err := os.ReadDir(*modelDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if m, ok := loadModelInfo(e.Name()); ok {
+			list = append(list, *m)
+		}
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+	return list, nil
+}
+
+// handleModels lists the models of the library
+func handleModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list, err := listModels()
+	if err != nil {
+		log.Printf("Error listing models: %v", err)
+		http.Error(w, "can't read the model library", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleModelFile serves a file of the model library, e.g. GET /models/arm.obj
+func handleModelFile(w http.ResponseWriter, r *http.Request) {
+	path, ok := libraryFile(strings.TrimPrefix(r.URL.Path, "/models/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// handleViewModel shows the model viewers of the namespace are asked to
+// load, and sets it, e.g. POST /api/view/model {"model":"arm.obj"}. An
+// empty model sends them back to their own.
+func handleViewModel(w http.ResponseWriter, r *http.Request) {
+	ns := requestNamespace(r)
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(viewModelInfo{Model: ns.viewModel.get()})
+	case http.MethodPost:
+		var req struct {
+			Model string `json:"model"`
+		}
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		var m *modelInfo
+		if req.Model != "" {
+			var ok bool
+			if m, ok = loadModelInfo(req.Model); !ok {
+				http.Error(w, "no model "+req.Model+" in the library", http.StatusNotFound)
+				return
+			}
+		}
+		ns.viewModel.set(m)
+		if m != nil {
+			log.Printf("Switching viewers of the %s namespace to model %s", ns, m.Name)
+		} else {
+			log.Printf("Switching viewers of the %s namespace back to their own model", ns)
+		}
+		ns.broadcastEvent("model", viewModelInfo{Model: m})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(viewModelInfo{Model: m})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
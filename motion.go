@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+// maxMotionGap is the longest time between two samples of a device that its
+// angular velocity is derived from. After a longer silence it is unknown
+// until the next sample.
+const maxMotionGap = time.Second
+
+// motionState is the latest sample of a device and the angular velocity
+// derived from it
+type motionState struct {
+	quat  Quaternion
+	time  time.Time
+	omega *quat.Vector // Radians per second, nil when unknown
+}
+
+// updateMotion derives the angular velocity of a device from its previous
+// sample and returns it, nil when unknown. Must be called with ns.quatMu
+// held.
+func (ns *namespace) updateMotion(device string, q Quaternion, now time.Time) *quat.Vector {
+	prev, ok := ns.motion[device]
+	m := motionState{quat: q, time: now}
+	if dt := now.Sub(prev.time); ok && dt > 0 && dt <= maxMotionGap {
+		if w, ok := quat.AngularVelocity(prev.quat, q, dt.Seconds()); ok {
+			m.omega = &w
+		}
+	}
+	ns.motion[device] = m
+	return m.omega
+}
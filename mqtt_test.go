@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBroker accepts MQTT connections, answering with the given CONNACK
+// return code and acknowledging every publish, which it sends on published
+type fakeBroker struct {
+	l         net.Listener
+	code      byte
+	user      chan string
+	published chan [2]string // Topic and payload
+}
+
+func newFakeBroker(t *testing.T, code byte) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{l: l, code: code, user: make(chan string, 10), published: make(chan [2]string, 100)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := mqttReadPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case mqttConnect:
+			// Protocol name, level, flags and keep alive, then the client ID
+			flags := body[7]
+			rest := body[10:]
+			n := binary.BigEndian.Uint16(rest)
+			rest = rest[2+n:]
+			user := ""
+			if flags&0x80 != 0 {
+				n = binary.BigEndian.Uint16(rest)
+				user = string(rest[2 : 2+n])
+			}
+			b.user <- user
+			mqttWritePacket(conn, mqttConnack<<4, []byte{0, b.code})
+		case mqttPublish:
+			n := binary.BigEndian.Uint16(body)
+			topic := string(body[2 : 2+n])
+			id := body[2+n : 4+n]
+			b.published <- [2]string{topic, string(body[4+n:])}
+			mqttWritePacket(conn, mqttPuback<<4, id)
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+func TestMQTTSink(t *testing.T) {
+	b := newFakeBroker(t, 0)
+	s, err := newMQTTSink("mqtt://lab:secret@"+b.l.Addr().String(), "imu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target := s.Target(); strings.Contains(target, "secret") {
+		t.Errorf("target %q shows the password", target)
+	}
+	samples := []historySample{
+		{Seq: 1, Time: time.Now(), Quaternion: Quaternion{Real: 1}},
+		{ID: "arm/left", Seq: 2, Time: time.Now(), Quaternion: Quaternion{I: 1}},
+	}
+	if err := s.Write(samples); err != nil {
+		t.Fatal(err)
+	}
+	if user := <-b.user; user != "lab" {
+		t.Errorf("connected as %q, want lab", user)
+	}
+	for _, want := range []struct {
+		topic string
+		seq   uint64
+	}{{"imu", 1}, {"imu/arm_left", 2}} {
+		p := <-b.published
+		var got historySample
+		if err := json.Unmarshal([]byte(p[1]), &got); err != nil {
+			t.Fatal(err)
+		}
+		if p[0] != want.topic || got.Seq != want.seq {
+			t.Errorf("published seq %d to %q, want seq %d to %q", got.Seq, p[0], want.seq, want.topic)
+		}
+	}
+
+	// The connection is kept for the next batch
+	if err := s.Write(samples[:1]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case user := <-b.user:
+		t.Errorf("connected again as %q", user)
+	case <-b.published:
+	}
+}
+
+func TestMQTTSinkRefused(t *testing.T) {
+	b := newFakeBroker(t, 4)
+	s, err := newMQTTSink("mqtt://"+b.l.Addr().String(), "imu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Write([]historySample{{Seq: 1}})
+	if err == nil || !strings.Contains(err.Error(), "bad user name or password") {
+		t.Errorf("error %v, want bad user name or password", err)
+	}
+
+	b.l.Close()
+	if err := s.Check(); err == nil {
+		t.Error("checking a broker that is gone succeeded")
+	}
+
+	for _, bad := range []string{"http://broker", "mqtt://", "mqtt://broker/%zz"} {
+		if _, err := newMQTTSink(bad, "imu"); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+	if _, err := newMQTTSink("mqtt://broker", "imu/#"); err == nil {
+		t.Error("wildcard topic: no error")
+	}
+}
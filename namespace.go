@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// tenantPrefix is the path tenants are served under, e.g. /t/lab-a/ws
+const tenantPrefix = "/t/"
+
+// tenantName restricts tenant names to what is safe in a URL path
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// TenantConfig holds the settings of one tenant in the configuration file.
+// Settings left out are taken from the main configuration.
+type TenantConfig struct {
+	Source        string                   `json:"source,omitempty"`
+	Listen        string                   `json:"listen,omitempty"`
+	Connect       string                   `json:"connect,omitempty"`
+	File          string                   `json:"file,omitempty"`
+	Port          string                   `json:"port,omitempty"`
+	Baud          int                      `json:"baud,omitempty"`
+	Order         string                   `json:"order,omitempty"`
+	Protocol      string                   `json:"protocol,omitempty"`
+	Format        string                   `json:"format,omitempty"`
+	Input         string                   `json:"input,omitempty"`
+	EulerUnits    string                   `json:"euler_units,omitempty"`
+	EulerOrder    string                   `json:"euler_order,omitempty"`
+	AHRS          string                   `json:"ahrs,omitempty"`
+	GyroUnits     string                   `json:"gyro_units,omitempty"`
+	IMURate       float64                  `json:"imu_rate,omitempty"`
+	AngleUnits    string                   `json:"angle_units,omitempty"`
+	AngleOrder    string                   `json:"angle_order,omitempty"`
+	Vectors       string                   `json:"vectors,omitempty"`
+	QuatKeys      string                   `json:"quat_keys,omitempty"`
+	Remap         string                   `json:"remap,omitempty"`
+	Mount         string                   `json:"mount,omitempty"`
+	HeadingOffset float64                  `json:"heading_offset,omitempty"`
+	Smoothing     float64                  `json:"smoothing,omitempty"`
+	SmoothMethod  string                   `json:"smoothing_method,omitempty"`
+	Convention    string                   `json:"convention,omitempty"`
+	Frame         string                   `json:"frame,omitempty"`
+	Streams       map[string]StreamDisplay `json:"streams,omitempty"`
+	Welcome       json.RawMessage          `json:"welcome,omitempty"`
+	Password      string                   `json:"password,omitempty"` // Login of the tenant, independent of -password
+}
+
+// apply returns the main configuration with the tenant's settings applied
+func (t TenantConfig) apply(cfg Config) Config {
+	cfg.Tenants = nil
+	for _, s := range []struct {
+		dst *string
+		src string
+	}{
+		{&cfg.Source, t.Source},
+		{&cfg.Listen, t.Listen},
+		{&cfg.Connect, t.Connect},
+		{&cfg.File, t.File},
+		{&cfg.Port, t.Port},
+		{&cfg.Order, t.Order},
+		{&cfg.Protocol, t.Protocol},
+		{&cfg.Format, t.Format},
+		{&cfg.Input, t.Input},
+		{&cfg.EulerUnits, t.EulerUnits},
+		{&cfg.EulerOrder, t.EulerOrder},
+		{&cfg.AHRS, t.AHRS},
+		{&cfg.GyroUnits, t.GyroUnits},
+		{&cfg.AngleUnits, t.AngleUnits},
+		{&cfg.AngleOrder, t.AngleOrder},
+		{&cfg.Vectors, t.Vectors},
+		{&cfg.QuatKeys, t.QuatKeys},
+		{&cfg.Remap, t.Remap},
+		{&cfg.Mount, t.Mount},
+		{&cfg.SmoothMethod, t.SmoothMethod},
+		{&cfg.Convention, t.Convention},
+		{&cfg.Frame, t.Frame},
+	} {
+		if s.src != "" {
+			*s.dst = s.src
+		}
+	}
+	if t.Baud != 0 {
+		cfg.Baud = t.Baud
+	}
+	if t.IMURate != 0 {
+		cfg.IMURate = t.IMURate
+	}
+	if t.HeadingOffset != 0 {
+		cfg.HeadingOffset = t.HeadingOffset
+	}
+	if t.Smoothing != 0 {
+		cfg.Smoothing = t.Smoothing
+	}
+	if len(t.Welcome) > 0 {
+		cfg.Welcome = t.Welcome
+	}
+	if t.Streams != nil {
+		cfg.Streams = t.Streams
+	}
+	if (t.Order != "" || t.Input != "") && t.Format == "" {
+		// The tenant's order or input would be hidden by the main format
+		cfg.Format = ""
+	}
+	return cfg
+}
+
+// namespace is an independent stream of samples with its own input sources,
+// settings, WebSocket clients and login. The default namespace is served at
+// the root of the server, tenants under /t/{name}/.
+type namespace struct {
+	name     string // Empty for the default namespace
+	password string // Password of a tenant, the default namespace uses -password
+	tenant   *Config
+
+	clientsMu sync.Mutex
+	clients   map[*websocket.Conn]*client
+	seq       atomic.Uint64
+	samplesIn rateMeter
+	outliers  atomic.Uint64 // Samples that turned further than -outlier-angle
+	history   *sampleHistory
+	preview   *previewBuffer
+	sources   map[string]*sourceRunner // Filled in before the server starts, not modified afterwards
+
+	devices []string // IDs of the devices samples are tagged with, [""] when untagged
+
+	quatMu  sync.RWMutex
+	current map[string]Quaternion  // Latest orientation of each device
+	motion  map[string]motionState // Angular velocity of each device
+
+	noise  *noiseMeter  // Recent samples of each device, to measure their jitter
+	truth  *truthMeter  // Error of the simulator's measured stream, nil unless -sim-truth
+	settle *settleMeter // Whether each device has settled after it started, nil unless -settle-rate
+
+	viewModel viewModel         // Model the viewers are asked to show, set through /api/view/model
+	presenter presenter         // Client whose view the followers show
+	throttle  broadcastThrottle // Holds back samples beyond -max-rate
+	chaos     chaosState        // Failures induced through /api/chaos
+	tare      tareState         // Reference orientations set through /api/tare
+
+	// smoothing is set through /api/smoothing, nil for the configuration's
+	smoothing atomic.Pointer[smoothingOverride]
+
+	liveMu sync.Mutex
+	live   map[*liveSubscriber]struct{} // Downloads of /api/live.csv
+}
+
+var (
+	// defaultNamespace is created once the flags have been parsed
+	defaultNamespace *namespace
+	// tenants holds the tenant namespaces by name. It is filled in by
+	// initTenants before the server starts and not modified afterwards.
+	tenants = map[string]*namespace{}
+)
+
+func newNamespace(name string, cfg *Config, password string) *namespace {
+	return &namespace{
+		name:     name,
+		password: password,
+		tenant:   cfg,
+		clients:  make(map[*websocket.Conn]*client),
+		live:     map[*liveSubscriber]struct{}{},
+		history:  newSampleHistory(*historySize),
+		preview:  newPreviewBuffer(previewCapacity),
+		sources:  map[string]*sourceRunner{},
+		current:  map[string]Quaternion{},
+		motion:   map[string]motionState{},
+		noise:    newNoiseMeter(),
+		settle:   newSettleMeter(),
+	}
+}
+
+// initTenants creates a namespace for every tenant in the configuration
+func initTenants(cfg Config) error {
+	for name, t := range cfg.Tenants {
+		if !tenantName.MatchString(name) {
+			return fmt.Errorf("invalid tenant name %q, use lower case letters, digits, - and _", name)
+		}
+		tcfg := t.apply(cfg)
+		ns := newNamespace(name, &tcfg, t.Password)
+		if err := ns.initSources(tcfg); err != nil {
+			return fmt.Errorf("tenant %s: %v", name, err)
+		}
+		tenants[name] = ns
+	}
+	return nil
+}
+
+// namespaces returns the default namespace followed by the tenants, sorted by name
+func namespaces() []*namespace {
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	all := []*namespace{defaultNamespace}
+	for _, name := range names {
+		all = append(all, tenants[name])
+	}
+	return all
+}
+
+// knownDevices returns the configured devices followed by those that have
+// only been seen in samples, sorted. Must be called with ns.quatMu held.
+func (ns *namespace) knownDevices() []string {
+	var seen []string
+	for device := range ns.current {
+		if !containsString(ns.devices, device) {
+			seen = append(seen, device)
+		}
+	}
+	sort.Strings(seen)
+	return append(append([]string(nil), ns.devices...), seen...)
+}
+
+// config returns the settings of the namespace
+func (ns *namespace) config() Config {
+	cfg := currentConfig()
+	if ns.tenant != nil {
+		cfg = *ns.tenant
+	}
+	if s := ns.smoothing.Load(); s != nil {
+		cfg.Smoothing, cfg.SmoothMethod = s.Seconds, s.Method
+	}
+	cfg.preview = ns.preview
+	return cfg
+}
+
+// path returns the URL path of p within the namespace, e.g. /t/lab-a/ws for /ws
+func (ns *namespace) path(p string) string {
+	if ns.name == "" {
+		return p
+	}
+	return tenantPrefix + ns.name + p
+}
+
+// String names the namespace in logs
+func (ns *namespace) String() string {
+	if ns.name == "" {
+		return "default"
+	}
+	return "tenant " + ns.name
+}
+
+type namespaceKey struct{}
+
+// requestNamespace returns the namespace a request was made to
+func requestNamespace(r *http.Request) *namespace {
+	if ns, ok := r.Context().Value(namespaceKey{}).(*namespace); ok {
+		return ns
+	}
+	return defaultNamespace
+}
+
+// tenantMux routes requests within a tenant, the paths are those of the
+// default namespace
+var tenantMux = http.NewServeMux()
+
+func init() {
+	tenantMux.HandleFunc("/", serveHome)
+	tenantMux.HandleFunc("/ws", handleWebSocket)
+	tenantMux.HandleFunc("/api/status", handleStatus)
+	tenantMux.HandleFunc("/status", handleStatusPage)
+	tenantMux.HandleFunc("/pair", handlePair)
+	tenantMux.HandleFunc("/api/pair", handlePairing)
+	tenantMux.HandleFunc("/api/serial/preview", handleSerialPreview)
+	tenantMux.HandleFunc("/api/sources", handleSources)
+	tenantMux.HandleFunc("/api/sources/", handleSources)
+	tenantMux.HandleFunc("/api/stats", handleStats)
+	tenantMux.HandleFunc("/api/live.csv", handleLiveCSV)
+	tenantMux.HandleFunc("/api/models", handleModels)
+	tenantMux.HandleFunc("/models/", handleModelFile)
+	tenantMux.HandleFunc("/api/view/model", handleViewModel)
+	tenantMux.HandleFunc("/api/login", handleLogin)
+	tenantMux.HandleFunc("/api/logout", handleLogout)
+	tenantMux.HandleFunc("/api/whoami", handleWhoAmI)
+	tenantMux.HandleFunc("/api/chaos", handleChaos)
+	tenantMux.HandleFunc("/api/chaos/", handleChaos)
+	tenantMux.HandleFunc("/api/tare", handleTare)
+	tenantMux.HandleFunc("/api/tare/", handleTare)
+	tenantMux.HandleFunc("/api/smoothing", handleSmoothing)
+	tenantMux.HandleFunc("/api/smoothing/", handleSmoothing)
+}
+
+// withNamespace serves requests under /t/{name}/ from the tenant's namespace,
+// with the prefix stripped, and everything else from the default namespace
+func withNamespace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, tenantPrefix)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name, sub, found := strings.Cut(rest, "/")
+		ns, known := tenants[name]
+		if !known {
+			http.NotFound(w, r)
+			return
+		}
+		if !found {
+			// Relative URLs in the page only resolve with the trailing slash
+			http.Redirect(w, r, ns.path("/"), http.StatusMovedPermanently)
+			return
+		}
+
+		r2 := r.WithContext(context.WithValue(r.Context(), namespaceKey{}, ns))
+		u := *r.URL
+		u.Path = "/" + sub
+		u.RawPath = ""
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// serveNamespaced dispatches a request to the mux of its namespace
+func serveNamespaced(w http.ResponseWriter, r *http.Request) {
+	if requestNamespace(r) != defaultNamespace {
+		tenantMux.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == "/debug/vars" {
+		// Instead of the handler of the expvar package, which shows the
+		// command line
+		handleDebugVars(w, r)
+		return
+	}
+	http.DefaultServeMux.ServeHTTP(w, r)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var (
+	jitterWindow   = flag.Duration("jitter-window", 2*time.Second, "Window the mean orientation and jitter of each device are measured over")
+	stillThreshold = flag.Float64("still-threshold", 2, "Largest deviation in degrees from the mean orientation for a device to count as still, when its jitter is measured")
+)
+
+// noiseMaxSamples bounds the samples kept per device, whatever the rate
+const noiseMaxSamples = 10000
+
+// noiseMeter keeps the recent samples of each device of a namespace, to
+// measure the sensor's noise while it is still
+type noiseMeter struct {
+	mu      sync.Mutex
+	devices map[string][]timedQuaternion
+}
+
+type timedQuaternion struct {
+	t time.Time
+	q Quaternion
+}
+
+// noiseStats describes the orientation of a device over the jitter window
+type noiseStats struct {
+	ID           string     `json:"id,omitempty"`
+	Samples      int        `json:"samples"`
+	Mean         Quaternion `json:"mean"`          // Average orientation over the window
+	MaxDeviation float64    `json:"max_deviation"` // Degrees from the mean of the farthest sample
+	Still        bool       `json:"still"`         // Every sample is within -still-threshold of the mean
+	// Jitter is the RMS angle in degrees between the samples and the mean,
+	// only measured while the device is still
+	Jitter *float64 `json:"jitter_deg,omitempty"`
+}
+
+func newNoiseMeter() *noiseMeter {
+	return &noiseMeter{devices: map[string][]timedQuaternion{}}
+}
+
+// add records a sample of a device, dropping those older than the window
+func (m *noiseMeter) add(device string, q Quaternion, now time.Time) {
+	q, ok := quat.Normalize(q)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	samples := append(m.devices[device], timedQuaternion{t: now, q: q})
+	cut := 0
+	for cut < len(samples) && (now.Sub(samples[cut].t) > *jitterWindow || len(samples)-cut > noiseMaxSamples) {
+		cut++
+	}
+	if cut > 0 {
+		samples = append(samples[:0], samples[cut:]...)
+	}
+	m.devices[device] = samples
+}
+
+// stats measures every device over the samples in the window, by device ID
+func (m *noiseMeter) stats(now time.Time) []noiseStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := []noiseStats{}
+	for device, samples := range m.devices {
+		var recent []Quaternion
+		for _, s := range samples {
+			if now.Sub(s.t) <= *jitterWindow {
+				recent = append(recent, s.q)
+			}
+		}
+		if len(recent) == 0 {
+			continue
+		}
+		list = append(list, measureNoise(device, recent))
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+	return list
+}
+
+// measureNoise averages unit quaternions and measures how far they spread
+// about the mean
+func measureNoise(device string, qs []Quaternion) noiseStats {
+	st := noiseStats{ID: device, Samples: len(qs), Mean: quat.Average(qs)}
+	var sq float64
+	for _, q := range qs {
+		angle := quat.Angle(st.Mean, q)
+		sq += angle * angle
+		st.MaxDeviation = math.Max(st.MaxDeviation, angle)
+	}
+	st.Still = st.MaxDeviation <= *stillThreshold
+	if st.Still && len(qs) > 1 {
+		jitter := math.Sqrt(sq / float64(len(qs)))
+		st.Jitter = &jitter
+	}
+	return st
+}
@@ -0,0 +1,794 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+// obj is shorthand for the JSON objects making up the OpenAPI document
+type obj = map[string]any
+
+// buildOpenAPI describes the HTTP API and WebSocket messages. It is generated
+// from the running configuration so that the quaternion convention, frame
+// and units it declares match what the server actually sends.
+func buildOpenAPI(cfg Config) obj {
+	conv := describeConvention(cfg)
+	units := prefsFor(cfg.AngleUnits)
+
+	ref := func(name string) obj { return obj{"$ref": "#/components/schemas/" + name} }
+	jsonResponse := func(desc string, schema obj) obj {
+		return obj{"200": obj{"description": desc, "content": obj{"application/json": obj{"schema": schema}}}}
+	}
+	number := obj{"type": "number"}
+	tareBody := obj{"content": obj{"application/json": obj{"schema": obj{
+		"type":       "object",
+		"properties": obj{"device": obj{"type": "string", "description": "Device to tare, every device when omitted."}},
+	}}}}
+
+	schemas := obj{
+		"Quaternion": obj{
+			"type":                    "object",
+			"description":             fmt.Sprintf("Unit quaternion, %s convention, %s-handed, scalar part in %q, rotating %s in the %s frame.", conv.Convention, conv.Handedness, conv.Scalar, conv.Rotation, conv.Frame),
+			"required":                []string{"i", "j", "k", "real"},
+			"properties":              obj{"i": number, "j": number, "k": number, "real": number},
+			"x-quaternion-convention": conv,
+		},
+		"Euler": obj{
+			"type":        "object",
+			"description": fmt.Sprintf("Euler angles in %s, for intrinsic rotations in the order %s unless the client chose another with angle_order.", units.Angle, cfg.angleOrder()),
+			"properties":  obj{"roll": number, "pitch": number, "yaw": number},
+		},
+		"Sample": obj{
+			"description": "Orientation sample sent over the WebSocket. Samples carry no type field.",
+			"allOf": []obj{
+				ref("Quaternion"),
+				{"type": "object", "required": []string{"seq"}, "properties": obj{
+					"id":               obj{"type": "string", "description": "Device the sample came from, omitted when a single untagged sensor is read."},
+					"seq":              obj{"type": "integer", "description": "Sequence number, restarts from zero with each server epoch, or from the samples restored from -storage."},
+					"euler":            ref("Euler"),
+					"gravity":          obj{"allOf": []obj{ref("Vector")}, "description": "Unit vector pointing down in the sensor's axes, when requested with vectors."},
+					"heading":          obj{"allOf": []obj{ref("Heading")}, "description": "Direction the sensor's X axis faces, when requested with vectors and it isn't vertical."},
+					"angular_velocity": obj{"allOf": []obj{ref("Vector")}, "description": fmt.Sprintf("Rate of rotation about the sensor's axes in %s, derived from the previous sample, when requested with vectors and the previous sample was at most a second before.", units.Rate)},
+					"settling":         obj{"type": "boolean", "description": "Taken before the device settled after it started, only with -settle-rate."},
+					"outlier":          obj{"type": "boolean", "description": "Turned further than -outlier-angle from the previous sample, only with -outlier-action flag."},
+				}},
+			},
+		},
+		"Vector": obj{
+			"type":       "object",
+			"properties": obj{"x": number, "y": number, "z": number},
+		},
+		"Heading": obj{
+			"description": fmt.Sprintf("Sensor X axis projected onto the horizontal plane of the %s frame, as a unit vector.", conv.Frame),
+			"allOf": []obj{
+				ref("Vector"),
+				{"type": "object", "properties": obj{
+					"bearing": obj{"type": "number", "description": fmt.Sprintf("Compass bearing, clockwise from north in %s, omitted when the frame is unspecified.", units.Angle)},
+				}},
+			},
+		},
+		"Event": obj{
+			"type":        "object",
+			"description": "Typed message sent over the WebSocket.",
+			"required":    []string{"type", "time"},
+			"properties": obj{
+				"type": obj{"type": "string", "enum": []string{"session", "resume", "backfill", "history", "restarting", "status", "heartbeat", "fence", "stream", "model", "presenter", "view", "hello", "subscribed", "disk", "tare", "settled", "smoothing"}},
+				"time": obj{"type": "string", "format": "date-time"},
+				"data": obj{"type": "object"},
+			},
+		},
+		"Convention": obj{
+			"type":        "object",
+			"description": "Declares how to interpret quaternions, sent in the session event.",
+			"properties": obj{
+				"convention":         obj{"type": "string", "enum": []string{conventionHamilton}},
+				"handedness":         obj{"type": "string"},
+				"components":         obj{"type": "array", "items": obj{"type": "string"}},
+				"scalar":             obj{"type": "string"},
+				"rotation":           obj{"type": "string"},
+				"frame":              obj{"type": "string", "enum": []string{"enu", "ned", "nwu", "unspecified"}},
+				"source_convention":  obj{"type": "string", "enum": []string{conventionHamilton, conventionJPL}},
+				"source_order":       obj{"type": "string"},
+				"source_input":       obj{"type": "string", "enum": []string{inputQuaternion, inputEuler, inputMatrix, inputIMU}},
+				"source_euler_order": obj{"type": "string", "description": "Rotation order of Euler angle input, intrinsic axes applied left to right."},
+				"source_euler_units": obj{"type": "string", "enum": []string{quat.Degrees, quat.Radians}},
+			},
+			"example": conv,
+		},
+		"Stream": obj{
+			"type":        "object",
+			"description": "Display metadata of a device's stream, listed in the session event and sent in stream events.",
+			"properties": obj{
+				"id":    obj{"type": "string"},
+				"name":  obj{"type": "string"},
+				"color": obj{"type": "string", "description": "Color as #rrggbb."},
+				"model": obj{"type": "string", "description": "Model file to show the device with, omitted for the viewer's model."},
+				"units": obj{"type": "string", "enum": []string{quat.Degrees, quat.Radians}, "description": "Angle units to show the device's angles in, omitted for the client's."},
+			},
+		},
+		"Session": obj{
+			"type":        "object",
+			"description": "Data of the session event, sent first on every connection so that clients can configure themselves.",
+			"properties": obj{
+				"server":      obj{"type": "string", "enum": []string{"quatplot"}},
+				"version":     obj{"type": "string", "description": "Version of the server, or the commit it was built from."},
+				"protocol":    obj{"type": "integer", "description": "Version of the messages, raised when a change would break existing clients.", "example": protocolVersion},
+				"epoch":       obj{"type": "string"},
+				"seq":         obj{"type": "integer"},
+				"token":       obj{"type": "string"},
+				"euler_order": obj{"type": "string"},
+				"convention":  ref("Convention"),
+				"vectors":     obj{"type": "array", "items": obj{"type": "string"}},
+				"streams":     obj{"type": "array", "items": ref("Stream")},
+				"settings": obj{
+					"type": "object",
+					"properties": obj{
+						"source":        obj{"type": "string"},
+						"input":         obj{"type": "string", "enum": []string{inputQuaternion, inputEuler, inputMatrix, inputIMU}},
+						"format":        obj{"type": "string"},
+						"pipeline":      obj{"type": "object", "description": "Remap, mount, heading offset and smoothing applied to samples, omitted when none are."},
+						"smoothing":     obj{"type": "object"},
+						"input_rate_hz": obj{"type": "number"},
+					},
+				},
+				"welcome": obj{"description": "Payload set with -welcome or welcome in the configuration, omitted when none is."},
+				"handshake": obj{
+					"type":        "object",
+					"description": "Set with -client-protocol strict: clients that don't send hello and then subscribe within timeout_ms are disconnected.",
+					"properties":  obj{"timeout_ms": obj{"type": "integer"}},
+				},
+			},
+		},
+		"Model": obj{
+			"type": "object",
+			"properties": obj{
+				"name":      obj{"type": "string", "description": "The .obj, .stl, .ply, .glb or .gltf file."},
+				"mtl":       obj{"type": "string", "description": "Materials of an .obj file, when there is an .mtl file of the same name."},
+				"textures":  obj{"type": "array", "items": obj{"type": "string"}, "description": "Textures the .mtl file refers to."},
+				"resources": obj{"type": "array", "items": obj{"type": "string"}, "description": "Buffers and images a .gltf file refers to."},
+				"size":      obj{"type": "integer", "description": "Bytes of the model file."},
+			},
+		},
+		"Chaos": obj{
+			"type":        "object",
+			"description": "Failures induced through /api/chaos.",
+			"properties": obj{
+				"paused":       obj{"type": "boolean", "description": "Samples aren't being sent to clients."},
+				"paused_until": obj{"type": "string", "format": "date-time"},
+				"malformed":    obj{"type": "array", "items": obj{"type": "string"}, "description": "Kinds of malformed messages that can be sent."},
+			},
+		},
+		"Tare": obj{
+			"type":        "object",
+			"description": "Reference orientations set through /api/tare. Samples of a tared device are sent relative to its reference.",
+			"properties": obj{
+				"devices": obj{"type": "array", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"device":    obj{"type": "string"},
+						"reference": ref("Quaternion"),
+						"time":      obj{"type": "string", "format": "date-time"},
+					},
+				}},
+			},
+		},
+		"Smoothing": obj{
+			"type":        "object",
+			"description": "Low-pass filter applied to the orientation of each device.",
+			"properties": obj{
+				"seconds":    obj{"type": "number", "description": "Time constant of the exponential filter, or length of the window, 0 when off."},
+				"method":     obj{"type": "string", "enum": []string{smoothExponential, smoothWindow}},
+				"overridden": obj{"type": "boolean", "description": "Set through /api/smoothing rather than the configuration."},
+			},
+		},
+		"ViewModel": obj{
+			"type":       "object",
+			"properties": obj{"model": obj{"allOf": []obj{ref("Model")}, "nullable": true}},
+		},
+		"Source": obj{
+			"type": "object",
+			"properties": obj{
+				"id":           obj{"type": "string"},
+				"kind":         obj{"type": "string"},
+				"enabled":      obj{"type": "boolean"},
+				"status":       ref("SerialStatus"),
+				"failures":     obj{"type": "integer", "description": "Failed attempts in a row to open the source."},
+				"next_attempt": obj{"type": "string", "format": "date-time", "description": "When the source is opened again, while backing off."},
+			},
+		},
+		"Sink": obj{
+			"type": "object",
+			"properties": obj{
+				"name":                 obj{"type": "string"},
+				"kind":                 obj{"type": "string"},
+				"target":               obj{"type": "string"},
+				"enabled":              obj{"type": "boolean"},
+				"state":                obj{"type": "string", "enum": []string{sinkIdle, sinkOK, sinkRetrying, sinkDisabled}},
+				"queued":               obj{"type": "integer"},
+				"buffered":             obj{"type": "integer"},
+				"buffered_bytes":       obj{"type": "integer"},
+				"written":              obj{"type": "integer"},
+				"dropped":              obj{"type": "integer"},
+				"failures":             obj{"type": "integer"},
+				"consecutive_failures": obj{"type": "integer"},
+				"last_error":           obj{"type": "string"},
+				"last_error_time":      obj{"type": "string", "format": "date-time"},
+				"last_success":         obj{"type": "string", "format": "date-time"},
+				"next_retry":           obj{"type": "string", "format": "date-time"},
+				"backoff_ms":           obj{"type": "integer"},
+			},
+		},
+		"FleetHeartbeat": obj{
+			"type":     "object",
+			"required": []string{"name", "url"},
+			"properties": obj{
+				"name":       obj{"type": "string", "description": "Name of the server, -fleet-name."},
+				"url":        obj{"type": "string", "description": "Base URL of the server's viewer, -fleet-url."},
+				"started":    obj{"type": "string", "format": "date-time"},
+				"interval_s": obj{"type": "number", "description": "Seconds until the next heartbeat, taken as 1 to 600."},
+				"key":        obj{"type": "string", "description": "Random ID of the server process. The name stays with the process, or the host, that first registered it. Not listed."},
+				"leaving":    obj{"type": "boolean", "description": "Sent once when the server shuts down."},
+				"sensors": obj{"type": "array", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"id":    obj{"type": "string"},
+						"kind":  obj{"type": "string"},
+						"state": obj{"type": "string"},
+						"port":  obj{"type": "string"},
+					},
+				}},
+				"clients":       obj{"type": "integer", "description": "Viewers connected."},
+				"input_rate_hz": obj{"type": "number"},
+				"links": obj{"type": "array", "items": obj{
+					"type":       "object",
+					"properties": obj{"name": obj{"type": "string"}, "url": obj{"type": "string"}},
+				}},
+			},
+		},
+		"FleetNode": obj{
+			"allOf": []obj{ref("FleetHeartbeat"), {
+				"type": "object",
+				"properties": obj{
+					"addr":       obj{"type": "string", "description": "Address the last heartbeat came from."},
+					"live":       obj{"type": "boolean", "description": "Whether the server sent a heartbeat within three intervals."},
+					"first_seen": obj{"type": "string", "format": "date-time"},
+					"last_seen":  obj{"type": "string", "format": "date-time"},
+				},
+			}},
+		},
+		"SerialStatus": obj{
+			"type": "object",
+			"properties": obj{
+				"id":      obj{"type": "string", "description": "Device the status is of, when several are read."},
+				"state":   obj{"type": "string", "enum": []string{serialConnecting, serialConnected, serialBusy, serialNotFound, serialPermissionDenied, serialError, serialDisabled, serialEnded, serialFailed}},
+				"port":    obj{"type": "string"},
+				"message": obj{"type": "string"},
+				"hint":    obj{"type": "string"},
+				"since":   obj{"type": "string", "format": "date-time"},
+				"devices": obj{"type": "array", "items": ref("SerialStatus"), "description": "Status of each device, when several are read."},
+			},
+		},
+		"ErrorStats": obj{
+			"type":        "object",
+			"description": "Absolute errors in degrees, with the time of the sample with the largest.",
+			"properties": obj{
+				"rmse":   number,
+				"mean":   number,
+				"max":    number,
+				"max_at": obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"Comparison": obj{
+			"type":        "object",
+			"description": "Angular error of a device against a reference.",
+			"properties": obj{
+				"samples":    obj{"type": "integer"},
+				"unmatched":  obj{"type": "integer"},
+				"time_basis": obj{"type": "string", "enum": []string{"time", "ref_time"}},
+				"offset_ms":  number,
+				"start":      obj{"type": "string", "format": "date-time"},
+				"end":        obj{"type": "string", "format": "date-time"},
+				"angle":      ref("ErrorStats"),
+				"roll":       ref("ErrorStats"),
+				"pitch":      ref("ErrorStats"),
+				"yaw":        ref("ErrorStats"),
+			},
+		},
+		"Fence": obj{
+			"type":        "object",
+			"description": "Orientation cone set with -fence, with whether each device's sensor axis is inside it.",
+			"properties": obj{
+				"name":           obj{"type": "string"},
+				"axis":           ref("Vector"),
+				"body_axis":      ref("Vector"),
+				"half_angle_deg": number,
+				"devices": obj{"type": "array", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"id":        obj{"type": "string"},
+						"state":     obj{"type": "string", "enum": []string{fenceInside, fenceOutside}},
+						"angle_deg": number,
+						"since":     obj{"type": "string", "format": "date-time"},
+						"changing":  obj{"type": "boolean"},
+					},
+				}},
+			},
+		},
+		"PreviewLine": obj{
+			"type": "object",
+			"properties": obj{
+				"time":  obj{"type": "string", "format": "date-time"},
+				"line":  obj{"type": "string"},
+				"ok":    obj{"type": "boolean"},
+				"error": obj{"type": "string"},
+				"quat":  ref("Quaternion"),
+			},
+		},
+	}
+
+	paths := obj{
+		"/ws": obj{"get": obj{
+			"operationId": "stream",
+			"summary":     "WebSocket stream of Sample and Event messages",
+			"description": "Upgrade to a WebSocket. The first message is a session event (see Session) declaring the server's version, the convention, units and settings. Clients then send {\"type\":\"hello\",\"data\":{\"protocol\":1,\"client\":\"name/version\"}} and a subscribe message, which servers started with -client-protocol strict require within session.handshake.timeout_ms before sending samples. Servers started with -signing-key-file end every message with kid and sig, the HMAC-SHA256 in unpadded base64url of the message with ,\"sig\":\"...\" cut off.",
+			"parameters": []obj{
+				{"name": "angles", "in": "query", "schema": obj{"type": "string", "enum": []string{quat.Degrees, quat.Radians}}},
+				{"name": "token", "in": "query", "schema": obj{"type": "string"}},
+				{"name": "epoch", "in": "query", "schema": obj{"type": "string"}},
+				{"name": "last_seq", "in": "query", "schema": obj{"type": "integer"}},
+				{"name": "keys", "in": "query", "schema": obj{"type": "string", "enum": []string{keysIJK, keysWXYZ}}, "description": "Keys of the quaternion components in samples, backfill and history: ijk for i, j, k and real, or wxyz for w, x, y and z. Defaults to -quat-keys."},
+				{"name": "angle_order", "in": "query", "schema": obj{"type": "string"}, "description": "Rotation order of the Euler angles, e.g. XYZ. Defaults to -angle-order."},
+				{"name": "vectors", "in": "query", "schema": obj{"type": "string"}, "description": "Derived vectors to send with samples, comma separated: gravity, heading, angular_velocity, or none."},
+				{"name": "backfill", "in": "query", "schema": obj{"type": "string", "enum": []string{"1"}}},
+				{"name": "history", "in": "query", "schema": obj{"type": "number", "minimum": 0}, "description": "Send the samples of this many seconds before connecting in a history event, 0 for none. Defaults to -backfill-on-connect."},
+				{"name": "follow", "in": "query", "schema": obj{"type": "string", "enum": []string{"1"}}, "description": "Show the presenter's view from the start."},
+				{"name": "access_token", "in": "query", "schema": obj{"type": "string"}, "description": "Token from /api/login, for clients that can't send headers or cookies."},
+			},
+			"responses": obj{"101": obj{"description": "Switching protocols"}},
+		}},
+		"/api/status": obj{"get": obj{
+			"operationId": "getStatus",
+			"summary":     "State of the serial link",
+			"responses":   jsonResponse("Serial link status", ref("SerialStatus")),
+		}},
+		"/api/sources": obj{"get": obj{
+			"operationId": "listSources",
+			"summary":     "Input sources and the state of their connections",
+			"responses":   jsonResponse("Input sources", obj{"type": "array", "items": ref("Source")}),
+		}},
+		"/api/sources/{id}/{action}": obj{"post": obj{
+			"operationId": "sourceAction",
+			"summary":     "Restart, disable or enable one input source without affecting the others",
+			"parameters": []obj{
+				{"name": "id", "in": "path", "required": true, "schema": obj{"type": "string"}},
+				{"name": "action", "in": "path", "required": true, "schema": obj{"type": "string", "enum": []string{"restart", "disable", "enable"}}},
+			},
+			"responses": jsonResponse("The source after the action", ref("Source")),
+		}},
+		"/api/ports": obj{"get": obj{
+			"operationId": "listPorts",
+			"summary":     "Serial ports of the machine, with the port and baud rate in use",
+			"responses": jsonResponse("Serial ports", obj{
+				"type": "object",
+				"properties": obj{
+					"port":       obj{"type": "string"},
+					"baud":       obj{"type": "integer"},
+					"switchable": obj{"type": "boolean", "description": "Whether /api/connect can change the port, false for other sources and several tagged ports."},
+					"reason":     obj{"type": "string"},
+					"status":     obj{"type": "string"},
+					"ports": obj{"type": "array", "items": obj{
+						"type": "object",
+						"properties": obj{
+							"name":    obj{"type": "string"},
+							"usb":     obj{"type": "string", "description": "usb:VID:PID, as -port accepts"},
+							"serial":  obj{"type": "string"},
+							"product": obj{"type": "string"},
+						},
+					}},
+				},
+			}),
+		}},
+		"/api/connect": obj{"post": obj{
+			"operationId": "connectPort",
+			"summary":     "Switch the serial input to another port or baud rate without restarting the server",
+			"requestBody": obj{"required": true, "content": obj{"application/json": obj{"schema": obj{
+				"type":     "object",
+				"required": []string{"port"},
+				"properties": obj{
+					"port": obj{"type": "string", "description": "A port, usb:VID:PID or auto"},
+					"baud": obj{"type": "integer", "minimum": 0, "description": "Kept when left out"},
+					"save": obj{"type": "boolean", "description": "Also write the port and baud rate to the config file"},
+				},
+			}}}},
+			"responses": jsonResponse("The serial source after the switch", ref("Source")),
+		}},
+		"/api/config": obj{
+			"get": obj{
+				"operationId": "getConfig",
+				"summary":     "The running configuration, in the format of the config file",
+				"description": "Passwords of tenants, secret flags and passwords in URLs are given as <redacted>. The ETag header identifies the configuration for If-Match.",
+				"responses":   jsonResponse("Configuration", obj{"type": "object"}),
+			},
+			"put": obj{
+				"operationId": "importConfig",
+				"summary":     "Check, save and apply a configuration",
+				"description": "The configuration is checked like check-config and written to the config file. Input and display settings take effect at once, restarting the sources, unless the command line or environment gives them; flags with the next restart. Flags that run commands, name files, listen or connect elsewhere, or decide who may connect, and the source, listen, connect, file, storage, encryption_key_file and tenants settings, are refused with 422 unless given as they run. Secrets given as <redacted> are kept. Problems are reported with 422 and an errors list. An If-Match header with the ETag of GET /api/config refuses the import with 412 if the configuration changed since.",
+				"parameters": []obj{
+					{"name": "dry_run", "in": "query", "schema": obj{"type": "string", "enum": []string{"1"}}, "description": "Only check the configuration and report what would change."},
+				},
+				"requestBody": obj{"required": true, "content": obj{"application/json": obj{"schema": obj{"type": "object"}}}},
+				"responses": jsonResponse("What changed", obj{
+					"type": "object",
+					"properties": obj{
+						"dry_run":          obj{"type": "boolean"},
+						"saved":            obj{"type": "string", "description": "Config file written"},
+						"applied":          obj{"type": "array", "items": obj{"type": "string"}, "description": "Settings now in effect"},
+						"pinned":           obj{"type": "array", "items": obj{"type": "string"}, "description": "Settings kept as the command line or environment gives them"},
+						"restart_required": obj{"type": "array", "items": obj{"type": "string"}, "description": "Settings in effect once the server restarts"},
+					},
+				}),
+			},
+		},
+		"/api/sinks": obj{"get": obj{
+			"operationId": "listSinks",
+			"summary":     "Output sinks with their health and retry state",
+			"responses":   jsonResponse("Output sinks", obj{"type": "array", "items": ref("Sink")}),
+		}},
+		"/api/sinks/{name}/{action}": obj{"post": obj{
+			"operationId": "sinkAction",
+			"summary":     "Enable or disable an output sink, or retry a failing one now",
+			"parameters": []obj{
+				{"name": "name", "in": "path", "required": true, "schema": obj{"type": "string"}},
+				{"name": "action", "in": "path", "required": true, "schema": obj{"type": "string", "enum": []string{"enable", "disable", "retry"}}},
+			},
+			"responses": jsonResponse("The sink after the action", ref("Sink")),
+		}},
+		"/api/models": obj{"get": obj{
+			"operationId": "listModels",
+			"summary":     "Models in the -model-dir library, downloadable from /models/{file}",
+			"responses":   jsonResponse("Models", obj{"type": "array", "items": ref("Model")}),
+		}},
+		"/api/view/model": obj{
+			"get": obj{
+				"operationId": "getViewModel",
+				"summary":     "Model every viewer is asked to show",
+				"responses":   jsonResponse("The model, null when viewers show their own", ref("ViewModel")),
+			},
+			"post": obj{
+				"operationId": "setViewModel",
+				"summary":     "Ask every viewer to load a model of the library",
+				"description": "An empty model sends viewers back to their own. Viewers are sent a model event.",
+				"requestBody": obj{"required": true, "content": obj{"application/json": obj{"schema": obj{
+					"type":       "object",
+					"properties": obj{"model": obj{"type": "string", "description": "Name of the .obj file, empty for the viewers' own model."}},
+				}}}},
+				"responses": jsonResponse("The model set", ref("ViewModel")),
+			},
+		},
+		"/api/stats": obj{"get": obj{
+			"operationId": "getStats",
+			"summary":     "Input rate, broadcast traffic overall and per client, and the recording",
+			"responses":   jsonResponse("Server statistics", obj{"type": "object"}),
+		}},
+		"/api/clients/drops": obj{"get": obj{
+			"operationId": "getClientDrops",
+			"summary":     "When clients missed samples",
+			"description": "Ranges of time in which the server conflated samples, skipped them to rate limit a slow client, or sent them while the client was reconnecting, so that charts of the samples a client received can shade where they are degraded. Ranges are kept with the client's resume token, across reconnects.",
+			"parameters": []obj{
+				{"name": "client", "in": "query", "schema": obj{"type": "integer"}, "description": "Only this client, by its ID in /api/stats."},
+				{"name": "token", "in": "query", "schema": obj{"type": "string"}, "description": "Only the client holding this resume token, from its session event, even while it is disconnected."},
+				{"name": "since", "in": "query", "schema": obj{"type": "string", "format": "date-time"}, "description": "Leave out ranges that ended before this time."},
+			},
+			"responses": jsonResponse("Missed samples of each client", obj{
+				"type": "object",
+				"properties": obj{
+					"clients": obj{"type": "array", "items": obj{
+						"type": "object",
+						"properties": obj{
+							"id":        obj{"type": "integer"},
+							"addr":      obj{"type": "string"},
+							"client":    obj{"type": "string"},
+							"connected": obj{"type": "boolean"},
+							"ranges": obj{"type": "array", "items": obj{
+								"type": "object",
+								"properties": obj{
+									"start":     obj{"type": "string", "format": "date-time"},
+									"end":       obj{"type": "string", "format": "date-time"},
+									"reason":    obj{"type": "string", "enum": []string{dropConflated, dropRateLimited, dropDisconnected}},
+									"samples":   obj{"type": "integer"},
+									"first_seq": obj{"type": "integer"},
+									"last_seq":  obj{"type": "integer"},
+								},
+							}},
+						},
+					}},
+				},
+			}),
+		}},
+		"/api/fleet": obj{"get": obj{
+			"operationId": "listFleet",
+			"summary":     "Servers registered with this directory",
+			"description": "Only served with -fleet-directory. Servers that missed three heartbeats are listed as not live, and forgotten an hour after their last one.",
+			"responses": jsonResponse("Registered servers, live ones first", obj{
+				"type":       "object",
+				"properties": obj{"nodes": obj{"type": "array", "items": ref("FleetNode")}},
+			}),
+		}},
+		"/api/fleet/register": obj{"post": obj{
+			"operationId": "registerFleetNode",
+			"summary":     "Send the heartbeat of a server to this directory",
+			"description": "Sent by servers started with -fleet-register every -fleet-interval. With -fleet-token the token is sent as a bearer token instead of logging in. A name held by another server, one with another key from another host, is refused with 409.",
+			"requestBody": obj{"required": true, "content": obj{"application/json": obj{"schema": ref("FleetHeartbeat")}}},
+			"responses": jsonResponse("Accepted", obj{
+				"type":       "object",
+				"properties": obj{"nodes": obj{"type": "integer", "description": "Servers registered"}},
+			}),
+		}},
+		"/api/fences": obj{"get": obj{
+			"operationId": "listFences",
+			"summary":     "Orientation fences and whether each device is inside them",
+			"responses":   jsonResponse("Fences", obj{"type": "array", "items": ref("Fence")}),
+		}},
+		"/api/recording/summary": obj{"get": obj{
+			"operationId": "getRecordingSummary",
+			"summary":     "Summary of the session being recorded so far",
+			"description": "Duration, sample rate, gaps, extremes, a drift estimate and the events of the session, as JSON or with format=html as a report page.",
+			"parameters":  []obj{{"name": "format", "in": "query", "schema": obj{"type": "string", "enum": []string{"json", "html"}}}},
+			"responses":   jsonResponse("Session summary", obj{"type": "object"}),
+		}},
+		"/api/recording/summaries": obj{"get": obj{
+			"operationId": "listRecordingSummaries",
+			"summary":     "Summaries stored next to the recording, one per finished session",
+			"responses": jsonResponse("Stored summaries, oldest first", obj{"type": "array", "items": obj{
+				"type": "object",
+				"properties": obj{
+					"session": obj{"type": "string"},
+					"started": obj{"type": "string", "format": "date-time"},
+				},
+			}}),
+		}},
+		"/api/recording/summaries/{session}": obj{"get": obj{
+			"operationId": "getStoredSummary",
+			"summary":     "A stored session summary, as JSON or with format=html as a report page",
+			"parameters": []obj{
+				{"name": "session", "in": "path", "required": true, "schema": obj{"type": "string"}},
+				{"name": "format", "in": "query", "schema": obj{"type": "string", "enum": []string{"json", "html"}}},
+			},
+			"responses": jsonResponse("Session summary", obj{"type": "object"}),
+		}},
+		"/api/recording/compare": obj{"get": obj{
+			"operationId": "compareRecording",
+			"summary":     "Angular error of one device in the recording against another",
+			"description": "Lines up the samples of device with those of reference, e.g. an IMU and a motion capture system read side by side, and reports the error of device in degrees.",
+			"parameters": []obj{
+				{"name": "device", "in": "query", "required": true, "schema": obj{"type": "string"}},
+				{"name": "reference", "in": "query", "required": true, "schema": obj{"type": "string"}},
+				{"name": "session", "in": "query", "schema": obj{"type": "string"}, "description": "Start of the session to compare, as listed by /api/recording/summaries (default: all sessions)."},
+				{"name": "offset", "in": "query", "schema": obj{"type": "string"}, "description": "Time added to the device's samples, e.g. -30ms."},
+				{"name": "search", "in": "query", "schema": obj{"type": "string"}, "description": "How far either side of offset to search for the offset with the smallest error, up to 1m."},
+			},
+			"responses": jsonResponse("Comparison", ref("Comparison")),
+		}},
+		"/api/serial/preview": obj{"get": obj{
+			"operationId": "getSerialPreview",
+			"summary":     "Most recent raw lines from the serial port with their parse status",
+			"parameters":  []obj{{"name": "n", "in": "query", "schema": obj{"type": "integer", "minimum": 1}}},
+			"responses":   jsonResponse("Raw lines, oldest first", obj{"type": "array", "items": ref("PreviewLine")}),
+		}},
+		"/api/login": obj{"post": obj{
+			"operationId": "login",
+			"summary":     "Exchange the password for a token, also set as a cookie",
+			"requestBody": obj{"required": true, "content": obj{"application/json": obj{"schema": obj{
+				"type":       "object",
+				"properties": obj{"password": obj{"type": "string"}},
+			}}}},
+			"responses": jsonResponse("Token and its expiry", obj{
+				"type":       "object",
+				"properties": obj{"token": obj{"type": "string"}, "expires": obj{"type": "string", "format": "date-time"}},
+			}),
+			"security": []obj{},
+		}},
+		"/api/logout": obj{"post": obj{
+			"operationId": "logout",
+			"summary":     "Revoke the token the request is made with",
+			"responses":   obj{"204": obj{"description": "Logged out"}},
+		}},
+		"/api/chaos": obj{"get": obj{
+			"operationId": "getChaos",
+			"summary":     "Failures induced in the stream, only with -chaos",
+			"responses":   jsonResponse("Chaos state", ref("Chaos")),
+		}},
+		"/api/chaos/{action}": obj{"post": obj{
+			"operationId": "chaosAction",
+			"summary":     "Break the stream on purpose to test a client's error handling, only with -chaos",
+			"description": "pause stops sending samples for the given seconds and resume sends them again. malformed sends a malformed message of the given kind, and disconnect closes the connection with a close frame (code 1011) or drops it without one. Both go to the given client, or to every client when it is 0.",
+			"parameters": []obj{
+				{"name": "action", "in": "path", "required": true, "schema": obj{"type": "string", "enum": []string{"pause", "resume", "malformed", "disconnect"}}},
+			},
+			"requestBody": obj{"content": obj{"application/json": obj{"schema": obj{
+				"type": "object",
+				"properties": obj{
+					"seconds": obj{"type": "number", "description": "How long to pause, up to an hour."},
+					"client":  obj{"type": "integer", "description": "ID of the client as listed by /api/stats, 0 for every client."},
+					"kind":    obj{"type": "string", "enum": []string{"garbage", "truncated", "types", "unknown"}},
+					"mode":    obj{"type": "string", "enum": []string{"close", "drop"}},
+				},
+			}}}},
+			"responses": jsonResponse("Chaos state after the action", ref("Chaos")),
+		}},
+		"/api/tare": obj{
+			"get": obj{
+				"operationId": "getTare",
+				"summary":     "Reference orientations of the tared devices",
+				"responses":   jsonResponse("Tare", ref("Tare")),
+			},
+			"post": obj{
+				"operationId": "tare",
+				"summary":     "Make the current orientation of a device, or of every device, the reference samples are sent relative to",
+				"requestBody": tareBody,
+				"responses":   jsonResponse("Tare after the change", ref("Tare")),
+			},
+		},
+		"/api/tare/clear": obj{"post": obj{
+			"operationId": "clearTare",
+			"summary":     "Remove the reference of a device, or of every device",
+			"requestBody": tareBody,
+			"responses":   jsonResponse("Tare after the change", ref("Tare")),
+		}},
+		"/api/storage": obj{"get": obj{
+			"operationId": "listStorage",
+			"summary":     "Saved history and archived recordings in the storage set with -storage",
+			"parameters":  []obj{{"name": "prefix", "in": "query", "schema": obj{"type": "string"}}},
+			"responses": jsonResponse("Storage and its objects, sorted by name", obj{
+				"type": "object",
+				"properties": obj{
+					"storage": obj{"type": "string"},
+					"objects": obj{"type": "array", "items": obj{
+						"type": "object",
+						"properties": obj{
+							"name":     obj{"type": "string"},
+							"size":     obj{"type": "integer"},
+							"modified": obj{"type": "string", "format": "date-time"},
+						},
+					}},
+				},
+			}),
+		}},
+		"/api/storage/{name}": obj{"get": obj{
+			"operationId": "getStoredObject",
+			"summary":     "Download an object of the storage, e.g. recordings/rig-2/session.qlog",
+			"parameters":  []obj{{"name": "name", "in": "path", "required": true, "schema": obj{"type": "string"}}},
+			"responses":   obj{"200": obj{"description": "The object", "content": obj{"application/octet-stream": obj{}}}},
+		}},
+		"/api/smoothing": obj{
+			"get": obj{
+				"operationId": "getSmoothing",
+				"summary":     "Low-pass filter applied to the orientation",
+				"responses":   jsonResponse("Smoothing", ref("Smoothing")),
+			},
+			"post": obj{
+				"operationId": "setSmoothing",
+				"summary":     "Change the low-pass filter until the server restarts, settings left out are kept",
+				"requestBody": obj{"required": true, "content": obj{"application/json": obj{"schema": obj{
+					"type": "object",
+					"properties": obj{
+						"seconds": obj{"type": "number", "minimum": 0, "maximum": maxSmoothing, "description": "0 turns smoothing off."},
+						"method":  obj{"type": "string", "enum": []string{smoothExponential, smoothWindow}},
+					},
+				}}}},
+				"responses": jsonResponse("Smoothing after the change", ref("Smoothing")),
+			},
+		},
+		"/api/smoothing/reset": obj{"post": obj{
+			"operationId": "resetSmoothing",
+			"summary":     "Go back to the smoothing of the configuration",
+			"responses":   jsonResponse("Smoothing after the change", ref("Smoothing")),
+		}},
+		"/api/whoami": obj{"get": obj{
+			"operationId": "whoami",
+			"summary":     "The user and role the request is authenticated as",
+			"responses": jsonResponse("Identity", obj{
+				"type": "object",
+				"properties": obj{
+					"user": obj{"type": "string"},
+					"role": obj{"type": "string", "enum": []string{roleViewer, roleController}},
+					"via":  obj{"type": "string", "enum": []string{"none", "token", "proxy"}},
+				},
+			}),
+		}},
+		"/api/pair": obj{"get": obj{
+			"operationId": "getPairing",
+			"summary":     "A viewer URL to share, with a pairing code letting people in as viewers when a password is set",
+			"responses": jsonResponse("Pairing", obj{
+				"type": "object",
+				"properties": obj{
+					"url":     obj{"type": "string"},
+					"expires": obj{"type": "string", "format": "date-time"},
+				},
+			}),
+		}},
+		"/api/clock": obj{"get": obj{
+			"operationId": "getClock",
+			"summary":     "One exchange of the clock alignment protocol",
+			"description": "Servers started with -clock-ref poll this endpoint to measure their clock offset to this server. Times are on this server's reference clock.",
+			"security":    []obj{},
+			"responses": jsonResponse("Clock reply", obj{
+				"type": "object",
+				"properties": obj{
+					"receive":  obj{"type": "string", "format": "date-time"},
+					"transmit": obj{"type": "string", "format": "date-time"},
+				},
+			}),
+		}},
+		"/api/live.csv": obj{"get": obj{
+			"operationId": "liveCSV",
+			"summary":     "Samples as CSV, streamed for as long as the connection is open",
+			"description": "Columns are time, seq, id, i, j, k, real, roll, pitch and yaw, after a comment line giving the angle units.",
+			"parameters": []obj{
+				{"name": "device", "in": "query", "schema": obj{"type": "string"}, "description": "Only samples of this device."},
+				{"name": "rate", "in": "query", "schema": obj{"type": "number"}, "description": "Most samples per second of each device."},
+				{"name": "duration", "in": "query", "schema": obj{"type": "string"}, "description": "End the download after this long, e.g. 30s."},
+				{"name": "angles", "in": "query", "schema": obj{"type": "string", "enum": []string{quat.Degrees, quat.Radians}}},
+			},
+			"responses": obj{"200": obj{"description": "CSV stream", "content": obj{"text/csv": obj{}}}},
+		}},
+		"/metrics": obj{"get": obj{
+			"operationId": "getMetrics",
+			"summary":     "Statistics in the Prometheus text format",
+			"responses":   obj{"200": obj{"description": "Prometheus metrics", "content": obj{"text/plain": obj{}}}},
+		}},
+		"/debug/vars": obj{"get": obj{
+			"operationId": "getDebugVars",
+			"summary":     "Runtime counters, goroutines, GC and queue depths in the expvar format",
+			"responses":   obj{"200": obj{"description": "expvar variables", "content": obj{"application/json": obj{"schema": obj{"type": "object"}}}}},
+		}},
+	}
+
+	components := obj{"schemas": schemas}
+	doc := obj{
+		"openapi": "3.0.3",
+		"info": obj{
+			"title":       "quatplot",
+			"description": "Real-time quaternion streaming from a serial sensor. Tenants serve the same paths under /t/{name}/.",
+			"version":     fmt.Sprint(protocolVersion), // Of the messages, as in the session event
+		},
+		"paths":      paths,
+		"components": components,
+	}
+	if loginPassword() != "" {
+		components["securitySchemes"] = obj{
+			"bearer": obj{"type": "http", "scheme": "bearer"},
+			"cookie": obj{"type": "apiKey", "in": "cookie", "name": authCookie},
+		}
+		doc["security"] = []obj{{"bearer": []string{}}, {"cookie": []string{}}}
+	}
+	return doc
+}
+
+// handleOpenAPI serves the OpenAPI document for the running configuration
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(buildOpenAPI(currentConfig()))
+}
+
+// runOpenAPI prints the OpenAPI document for the configuration, which the
+// clients under clients/ are generated from
+func runOpenAPI() int {
+	if _, err := initConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(buildOpenAPI(currentConfig())); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	allowedOrigins = newOriginList("allowed-origins", "Comma-separated origins of other sites allowed to open the WebSocket and call the API from a browser, e.g. https://dash.example.com or https://*.example.com, * for any (default: the server's own)")
+
+	// refusedOrigins remembers which origins have been logged as refused
+	refusedOrigins sync.Map
+)
+
+// corsMaxAge is how long browsers may keep the answer to a preflight, in
+// seconds
+const corsMaxAge = "600"
+
+// originList is a flag holding the origins allowed besides the server's own
+type originList struct {
+	any     bool     // Every origin is allowed
+	exact   []string // Origins such as https://dash.example.com
+	domains []string // Schemes and parent domains of wildcards, such as https://.example.com
+	text    string
+}
+
+func newOriginList(name, usage string) *originList {
+	l := &originList{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *originList) String() string { return l.text }
+
+func (l *originList) Set(s string) error {
+	parsed := originList{text: s}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(entry), "/"))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			parsed.any = true
+			continue
+		}
+		u, err := url.Parse(entry)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("%q is not an origin like https://dash.example.com", entry)
+		}
+		if domain, ok := strings.CutPrefix(u.Host, "*."); ok {
+			parsed.domains = append(parsed.domains, u.Scheme+"://."+domain)
+		} else {
+			parsed.exact = append(parsed.exact, entry)
+		}
+	}
+	*l = parsed
+	return nil
+}
+
+// contains reports whether an origin, lowercased, is in the list
+func (l *originList) contains(origin string) bool {
+	if l.any {
+		return true
+	}
+	for _, o := range l.exact {
+		if o == origin {
+			return true
+		}
+	}
+	scheme, host, ok := strings.Cut(origin, "://")
+	if !ok {
+		return false
+	}
+	for _, d := range l.domains {
+		prefix, domain, _ := strings.Cut(d, "://")
+		if prefix == scheme && strings.HasSuffix(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether the origin is the server's own: the host the
+// request was sent to, as forwarded by a trusted proxy, or that of
+// -public-url
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	hosts := []string{r.Host}
+	if fromTrustedProxy(r) {
+		if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+			hosts = append(hosts, strings.TrimSpace(strings.Split(h, ",")[0]))
+		}
+	}
+	if p, err := url.Parse(*publicURL); err == nil && p.Host != "" {
+		hosts = append(hosts, p.Host)
+	}
+	for _, h := range hosts {
+		if strings.EqualFold(u.Host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// originAllowed reports whether a browser on another site may use the
+// server. Requests without an Origin, such as those of scripts, and those of
+// the server's own pages always may.
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || sameOrigin(r, origin) || allowedOrigins.contains(strings.ToLower(origin)) {
+		return true
+	}
+	if _, logged := refusedOrigins.LoadOrStore(origin, true); !logged {
+		log.Printf("Refusing requests from pages of %s, add it to -allowed-origins to allow them", origin)
+	}
+	return false
+}
+
+// withCORS lets the pages of -allowed-origins call the API, answering the
+// preflight requests of their browsers. Requests that change anything are
+// refused from other sites, so that their pages can't act for a visitor.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || sameOrigin(r, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		if !originAllowed(r) {
+			if preflight || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			// Browsers keep the answer from the page without CORS headers
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var (
+	outlierAngle  = flag.Float64("outlier-angle", 0, "Largest angle in degrees the orientation may turn between two samples, samples turning further are outliers, e.g. garbled lines that still parse (default: 0, off)")
+	outlierAction = flag.String("outlier-action", outlierDrop, "What to do with outliers: drop, or flag to send them marked as outliers")
+)
+
+// Outlier actions
+const (
+	outlierDrop = "drop"
+	outlierFlag = "flag"
+)
+
+// outlierRecover is how many outliers in a row, agreeing with each other,
+// are taken as the orientation having really jumped
+const outlierRecover = 3
+
+// outlierFilter tells outliers apart in the samples of a source, by how far
+// each turned from the latest sample that wasn't one
+type outlierFilter struct {
+	max     float64 // Degrees
+	last    map[string]timedQuaternion
+	pending map[string]outlierRun
+}
+
+// outlierRun is a run of outliers of a device that agree with each other
+type outlierRun struct {
+	quat  Quaternion
+	count int
+}
+
+// newOutlierFilter returns the filter, nil when -outlier-angle is 0
+func newOutlierFilter() *outlierFilter {
+	if *outlierAngle <= 0 {
+		return nil
+	}
+	return &outlierFilter{
+		max:     *outlierAngle,
+		last:    map[string]timedQuaternion{},
+		pending: map[string]outlierRun{},
+	}
+}
+
+func validateOutlierAction(action string) error {
+	switch action {
+	case outlierDrop, outlierFlag:
+		return nil
+	}
+	return fmt.Errorf("invalid -outlier-action %q, must be drop or flag", action)
+}
+
+// outlier reports whether a sample of a device is an outlier. A device
+// seen for the first time or after a gap starts again from its sample.
+func (f *outlierFilter) outlier(device string, q Quaternion, now time.Time) bool {
+	if f == nil {
+		return false
+	}
+	q, ok := quat.Normalize(q)
+	if !ok {
+		return true
+	}
+	last, seen := f.last[device]
+	if !seen || now.Sub(last.t) > maxMotionGap || quat.Angle(last.q, q) <= f.max {
+		f.last[device] = timedQuaternion{t: now, q: q}
+		delete(f.pending, device)
+		return false
+	}
+	run := f.pending[device]
+	if run.count > 0 && quat.Angle(run.quat, q) <= f.max {
+		run.count++
+	} else {
+		run.count = 1
+	}
+	run.quat = q
+	if run.count >= outlierRecover {
+		// Not a glitch, the device turned faster than the threshold
+		f.last[device] = timedQuaternion{t: now, q: q}
+		delete(f.pending, device)
+		return false
+	}
+	f.pending[device] = run
+	return true
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Protocols sensors send samples in
+const (
+	protocolText   = "text"
+	protocolBinary = "binary"
+)
+
+// Checksums that may end a binary packet
+const (
+	checksumNone  = "none"
+	checksumSum8  = "sum8"
+	checksumXOR8  = "xor8"
+	checksumCRC16 = "crc16"
+)
+
+var (
+	protocol       = flag.String("protocol", protocolText, "Protocol of incoming samples: text lines, binary packets framed as set by the -packet flags, or bno-rvc or bno-shtp for a BNO08x sensor with its stock firmware")
+	packetSync     = flag.String("packet-sync", "AA55", "Sync bytes starting each binary packet, in hex")
+	packetFloat    = flag.String("packet-float", "float32", "Type of the values in binary packets, float32 or float64")
+	packetEndian   = flag.String("packet-endian", "little", "Byte order of binary packets, little or big")
+	packetChecksum = flag.String("packet-checksum", checksumNone, "Checksum ending each binary packet, computed over the values: none, sum8, xor8 or crc16 (CRC-16/CCITT-FALSE)")
+)
+
+// parseProtocol validates the protocol of incoming samples
+func parseProtocol(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", protocolText:
+		return protocolText, nil
+	case protocolBinary:
+		return protocolBinary, nil
+	case protocolBNORVC:
+		return protocolBNORVC, nil
+	case protocolBNOSHTP:
+		return protocolBNOSHTP, nil
+	}
+	return "", fmt.Errorf("unknown protocol %q, expected text, binary, bno-rvc or bno-shtp", s)
+}
+
+// packetProtocol reads samples from a stream of binary packets
+type packetProtocol interface {
+	// split is a bufio.SplitFunc returning whole packets
+	split(data []byte, atEOF bool) (advance int, token []byte, err error)
+	// decode reads a sample from a whole packet, errNoSample when it holds none
+	decode(f *lineFormat, packet []byte) (Quaternion, error)
+	// start returns what to send the sensor to start its reports, if anything
+	start() []byte
+}
+
+// errNoSample is returned for packets that are valid but hold no sample,
+// such as replies to commands
+var errNoSample = errors.New("no sample in packet")
+
+// packetFormat describes the framing of binary packets: sync bytes, one
+// float per column of the line format, then an optional checksum
+type packetFormat struct {
+	sync     []byte
+	size     int // Bytes per value, 4 or 8
+	order    binary.ByteOrder
+	checksum string
+	values   int
+}
+
+// parsePacketFormat builds the framing of packets holding the given number
+// of values from the -packet flags
+func parsePacketFormat(values int) (*packetFormat, error) {
+	p := &packetFormat{values: values}
+	var err error
+	if p.sync, err = hex.DecodeString(strings.ReplaceAll(*packetSync, " ", "")); err != nil || len(p.sync) == 0 {
+		return nil, fmt.Errorf("invalid packet sync %q, expected one or more bytes in hex, e.g. AA55", *packetSync)
+	}
+	switch strings.ToLower(*packetFloat) {
+	case "float32", "f32":
+		p.size = 4
+	case "float64", "f64":
+		p.size = 8
+	default:
+		return nil, fmt.Errorf("unknown packet float %q, expected float32 or float64", *packetFloat)
+	}
+	switch strings.ToLower(*packetEndian) {
+	case "little", "le":
+		p.order = binary.LittleEndian
+	case "big", "be":
+		p.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("unknown packet byte order %q, expected little or big", *packetEndian)
+	}
+	switch c := strings.ToLower(*packetChecksum); c {
+	case "", checksumNone:
+		p.checksum = checksumNone
+	case checksumSum8, checksumXOR8, checksumCRC16:
+		p.checksum = c
+	default:
+		return nil, fmt.Errorf("unknown packet checksum %q, expected none, sum8, xor8 or crc16", *packetChecksum)
+	}
+	return p, nil
+}
+
+// checksumSize returns the length of the checksum in bytes
+func (p *packetFormat) checksumSize() int {
+	switch p.checksum {
+	case checksumSum8, checksumXOR8:
+		return 1
+	case checksumCRC16:
+		return 2
+	}
+	return 0
+}
+
+// length returns the length of a whole packet in bytes
+func (p *packetFormat) length() int {
+	return len(p.sync) + p.values*p.size + p.checksumSize()
+}
+
+// valid reports whether the checksum of a whole packet matches its values
+func (p *packetFormat) valid(packet []byte) bool {
+	payload := packet[len(p.sync) : len(packet)-p.checksumSize()]
+	sum := packet[len(packet)-p.checksumSize():]
+	switch p.checksum {
+	case checksumSum8:
+		var s byte
+		for _, b := range payload {
+			s += b
+		}
+		return sum[0] == s
+	case checksumXOR8:
+		var x byte
+		for _, b := range payload {
+			x ^= b
+		}
+		return sum[0] == x
+	case checksumCRC16:
+		return p.order.Uint16(sum) == crc16CCITT(payload)
+	}
+	return true
+}
+
+// crc16CCITT computes the CRC-16/CCITT-FALSE of data
+func crc16CCITT(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func (p *packetFormat) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return splitPackets(data, p.sync, p.length(), p.valid)
+}
+
+func (p *packetFormat) start() []byte { return nil }
+
+// splitPackets finds the next packet of n bytes starting with sync in data,
+// as a bufio.SplitFunc, skipping the bytes before it. A packet that isn't
+// valid is returned all the same, to be reported, but only its first byte is
+// consumed so that a real packet starting inside it is still found.
+func splitPackets(data, sync []byte, n int, valid func([]byte) bool) (advance int, token []byte, err error) {
+	start := bytes.Index(data, sync)
+	if start < 0 {
+		// Keep what may be the start of a sync split across reads
+		if skip := len(data) - len(sync) + 1; skip > 0 {
+			return skip, nil, nil
+		}
+		return 0, nil, nil
+	}
+	if len(data)-start < n {
+		return start, nil, nil
+	}
+	packet := data[start : start+n]
+	if !valid(packet) {
+		return start + 1, packet, nil
+	}
+	return start + n, packet, nil
+}
+
+// parsePacket reads a quaternion from a whole packet. It returns
+// errNoSample for packets that don't hold one.
+func (f *lineFormat) parsePacket(packet []byte) (Quaternion, error) {
+	if f.err != nil {
+		return Quaternion{}, f.err
+	}
+	return f.packet.decode(f, packet)
+}
+
+// decode reads the values of a packet as the columns of the line format
+func (p *packetFormat) decode(f *lineFormat, packet []byte) (Quaternion, error) {
+	if !p.valid(packet) {
+		return Quaternion{}, fmt.Errorf("checksum mismatch")
+	}
+	values := make(map[string]float64, len(f.columns))
+	payload := packet[len(p.sync):]
+	for idx, component := range f.columns {
+		if component == "" {
+			continue
+		}
+		raw := payload[idx*p.size:]
+		if p.size == 4 {
+			values[component] = float64(math.Float32frombits(p.order.Uint32(raw)))
+		} else {
+			values[component] = math.Float64frombits(p.order.Uint64(raw))
+		}
+	}
+	return f.convert(values)
+}
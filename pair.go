@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	publicURL = flag.String("public-url", "", "Address people in the room open the viewer at, e.g. http://192.168.1.20:8080, encoded in the pairing QR code (default: taken from the request, with this machine's network address in place of localhost)")
+	pairTTL   = flag.Duration("pair-ttl", 5*time.Minute, "How long the pairing code of the status page lets people in without the password")
+)
+
+// pairCode lets whoever scans the QR code of the status page in as a
+// viewer until it expires. Everyone in the room shares the same code.
+type pairCode struct {
+	ns      *namespace // Authority of the namespace the code is for
+	expires time.Time
+}
+
+var (
+	pairCodes   = map[string]pairCode{}
+	pairCodesMu sync.Mutex
+)
+
+// pairingInfo is returned by /api/pair and shown on the status page
+type pairingInfo struct {
+	URL     string     `json:"url"`               // Viewer URL, with the pairing code when a password is required
+	Expires *time.Time `json:"expires,omitempty"` // When the pairing code stops working
+}
+
+// issuePairCode creates a pairing code for the namespace valid for
+// -pair-ttl, dropping expired ones
+func issuePairCode(ns *namespace) (string, time.Time) {
+	now := time.Now()
+	code, expires := newRandomID(), now.Add(*pairTTL)
+	pairCodesMu.Lock()
+	defer pairCodesMu.Unlock()
+	for c, p := range pairCodes {
+		if now.After(p.expires) {
+			delete(pairCodes, c)
+		}
+	}
+	pairCodes[code] = pairCode{ns: ns.authority(), expires: expires}
+	return code, expires
+}
+
+// validPairCode reports whether code was issued for the namespace and
+// hasn't expired
+func validPairCode(ns *namespace, code string) bool {
+	pairCodesMu.Lock()
+	defer pairCodesMu.Unlock()
+	p, ok := pairCodes[code]
+	return ok && p.ns == ns.authority() && time.Now().Before(p.expires)
+}
+
+// pairing returns the URL phones should open to join the live view of the
+// namespace, with a new pairing code when a password is required
+func pairing(r *http.Request, ns *namespace) pairingInfo {
+	base := strings.TrimSuffix(*publicURL, "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + reachableHost(r.Host)
+	}
+	if ns.loginPassword() == "" {
+		return pairingInfo{URL: base + ns.path("/")}
+	}
+	code, expires := issuePairCode(ns)
+	return pairingInfo{URL: base + ns.path("/pair") + "?code=" + code, Expires: &expires}
+}
+
+// reachableHost replaces a loopback host, which a phone can't reach, with
+// the first network address of this machine
+func reachableHost(host string) string {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, ""
+	}
+	if ip := net.ParseIP(name); name != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return host
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return host
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && n.IP.IsGlobalUnicast() {
+			if port == "" {
+				return n.IP.String()
+			}
+			return net.JoinHostPort(n.IP.String(), port)
+		}
+	}
+	return host
+}
+
+// handlePair lets a phone that scanned the QR code in as a viewer, e.g.
+// GET /pair?code=..., and sends it on to the live view
+func handlePair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ns := requestNamespace(r)
+	if ns.loginPassword() != "" {
+		if !validPairCode(ns, r.URL.Query().Get("code")) {
+			http.Error(w, "the pairing code has expired, scan the QR code again", http.StatusForbidden)
+			return
+		}
+		setAuthCookie(w, ns, issueToken(ns, roleViewer))
+		log.Printf("Paired a viewer from %s with the %s namespace", r.RemoteAddr, ns)
+	}
+	http.Redirect(w, r, ns.path("/"), http.StatusSeeOther)
+}
+
+// handlePairing returns a viewer URL to share, e.g. GET /api/pair
+func handlePairing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pairing(r, requestNamespace(r)))
+}
+
+// statusPage is the data of the status page
+type statusPage struct {
+	Namespace string
+	Stats     serverStats
+	Sources   []sourceInfo
+	Pairing   pairingInfo
+	QRCode    template.HTML
+	Refresh   int // Seconds until the page reloads, before the pairing code expires
+}
+
+// handleStatusPage shows the state of the server and a QR code that joins
+// phones to the live view, e.g. on a projector before a demo
+func handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ns := requestNamespace(r)
+	page := statusPage{Namespace: ns.name, Stats: collectStats(ns), Pairing: pairing(r, ns), Refresh: 30}
+	for _, s := range ns.sourceList() {
+		page.Sources = append(page.Sources, s.info())
+	}
+	if page.Pairing.Expires != nil {
+		page.Refresh = max(int(pairTTL.Seconds())/2, 5)
+	}
+	if q, err := encodeQR([]byte(page.Pairing.URL)); err != nil {
+		log.Printf("Error encoding the pairing QR code: %v", err)
+	} else {
+		page.QRCode = template.HTML(q.svg(6))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, page)
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>quatplot status{{if .Namespace}} - {{.Namespace}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+th { background: #f0f0f0; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+.pair { float: right; text-align: center; margin-left: 2em; }
+.pair a { font-family: monospace; font-size: 12px; word-break: break-all; }
+</style>
+</head>
+<body>
+<div class="pair">
+{{if .QRCode}}{{.QRCode}}{{end}}
+<p>Scan to open the live view on your phone</p>
+<p><a href="{{.Pairing.URL}}">{{.Pairing.URL}}</a></p>
+{{if .Pairing.Expires}}<p>The code works until {{.Pairing.Expires.Format "15:04:05"}}, this page renews it</p>{{end}}
+</div>
+<h1>quatplot status{{if .Namespace}} - {{.Namespace}}{{end}}</h1>
+<table>
+<tr><th>Uptime</th><td>{{.Stats.Uptime}}</td></tr>
+<tr><th>Input rate</th><td class="num">{{printf "%.1f" .Stats.InputRate}} Hz</td></tr>
+<tr><th>Samples received</th><td class="num">{{.Stats.SamplesIn}}</td></tr>
+<tr><th>Viewers connected</th><td class="num">{{.Stats.Clients}}</td></tr>
+</table>
+<h2>Sources</h2>
+<table>
+<tr><th>Source</th><th>State</th><th>Port</th><th>Message</th></tr>
+{{range .Sources}}<tr><td>{{.ID}}</td><td>{{.Status.State}}{{if not .Enabled}} (disabled){{end}}</td><td>{{.Status.Port}}</td><td>{{.Status.Message}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
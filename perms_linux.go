@@ -0,0 +1,180 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// deviceGroup returns the name of the group owning a device node
+func deviceGroup(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("no ownership information for %s", path)
+	}
+	gid := strconv.Itoa(int(st.Gid))
+	g, err := user.LookupGroupId(gid)
+	if err != nil {
+		return gid, nil
+	}
+	return g.Name, nil
+}
+
+// groupMembership reports whether the current user is listed in a group, and
+// whether that membership is active in this process. Membership only takes
+// effect after logging in again.
+func groupMembership(group string) (listed, active bool) {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return false, false
+	}
+	if u, err := user.Current(); err == nil {
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if id == g.Gid {
+					listed = true
+				}
+			}
+		}
+	}
+	if gids, err := os.Getgroups(); err == nil {
+		for _, gid := range gids {
+			if strconv.Itoa(gid) == g.Gid {
+				active = true
+			}
+		}
+	}
+	return listed, active
+}
+
+// permissionHint explains how to gain access to a serial port after EACCES
+func permissionHint(port string) string {
+	path, err := resolvePortName(port)
+	if err != nil {
+		return "The current user is not allowed to open the port. Run `quatplot doctor` for details."
+	}
+	group, err := deviceGroup(path)
+	if err != nil {
+		return "The current user is not allowed to open the port. Run `quatplot doctor` for details."
+	}
+
+	listed, active := groupMembership(group)
+	if listed && !active {
+		return fmt.Sprintf("%s is owned by group %q. Your user was added to it but this session predates that, log out and back in (or run `newgrp %s`).", path, group, group)
+	}
+	return fmt.Sprintf("%s is owned by group %q. Add your user to it with `sudo usermod -aG %s $USER`, then log out and back in.", path, group, group)
+}
+
+// serialPermissionChecks checks whether the current user can read and write a device node
+func serialPermissionChecks(path string) []checkResult {
+	var results []checkResult
+
+	group, err := deviceGroup(path)
+	if err != nil {
+		return append(results, checkResult{Name: "Device group", Status: checkWarn, Detail: err.Error()})
+	}
+
+	if unix.Access(path, unix.R_OK|unix.W_OK) == nil {
+		results = append(results, checkResult{Name: "Serial permissions", Status: checkPass, Detail: fmt.Sprintf("%s is readable and writable (group %s)", path, group)})
+	} else {
+		results = append(results, checkResult{
+			Name:   "Serial permissions",
+			Status: checkFail,
+			Detail: fmt.Sprintf("no read/write access to %s (group %s)", path, group),
+			Hint:   permissionHint(path),
+		})
+	}
+
+	if os.Geteuid() != 0 {
+		listed, active := groupMembership(group)
+		switch {
+		case active:
+			results = append(results, checkResult{Name: "Group membership", Status: checkPass, Detail: "member of " + group})
+		case listed:
+			results = append(results, checkResult{Name: "Group membership", Status: checkWarn, Detail: "added to " + group + " but not active in this session", Hint: "Log out and back in, or run `newgrp " + group + "`."})
+		default:
+			results = append(results, checkResult{Name: "Group membership", Status: checkWarn, Detail: "not a member of " + group, Hint: "sudo usermod -aG " + group + " $USER"})
+		}
+	}
+
+	return append(results, udevChecks(path)...)
+}
+
+// udevChecks looks for udev rules that mention the USB device behind a port.
+// The brltty rules shipped by several distributions grab common USB serial
+// adapters (e.g. CH340) and are a frequent cause of disappearing ports.
+func udevChecks(path string) []checkResult {
+	vid, pid := usbIDs(path)
+	if vid == "" {
+		return nil
+	}
+
+	var matches, conflicts []string
+	for _, dir := range []string{"/etc/udev/rules.d", "/lib/udev/rules.d", "/usr/lib/udev/rules.d"} {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.rules"))
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			text := strings.ToLower(string(data))
+			if !strings.Contains(text, vid) || !strings.Contains(text, pid) {
+				continue
+			}
+			if strings.Contains(filepath.Base(file), "brltty") {
+				conflicts = append(conflicts, file)
+			} else {
+				matches = append(matches, file)
+			}
+		}
+	}
+
+	var results []checkResult
+	if len(conflicts) > 0 {
+		results = append(results, checkResult{
+			Name:   "udev rules",
+			Status: checkWarn,
+			Detail: fmt.Sprintf("brltty rules claim %s:%s (%s)", vid, pid, strings.Join(conflicts, ", ")),
+			Hint:   "If the port disappears shortly after plugging in, remove the brltty package or disable its udev rules.",
+		})
+	}
+	if len(matches) > 0 {
+		results = append(results, checkResult{Name: "udev rules", Status: checkPass, Detail: "custom rules for " + vid + ":" + pid + " in " + strings.Join(matches, ", ")})
+	} else if len(conflicts) == 0 {
+		results = append(results, checkResult{Name: "udev rules", Status: checkPass, Detail: "no rules affecting " + vid + ":" + pid})
+	}
+	return results
+}
+
+// usbIDs returns the lower case USB vendor and product IDs behind a tty, if any
+func usbIDs(path string) (vid, pid string) {
+	dev, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", ""
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", filepath.Base(dev), "device"))
+	if err != nil {
+		return "", ""
+	}
+	// Walk up from the interface to the USB device, which has idVendor/idProduct
+	for ; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		v, errV := os.ReadFile(filepath.Join(dir, "idVendor"))
+		p, errP := os.ReadFile(filepath.Join(dir, "idProduct"))
+		if errV == nil && errP == nil {
+			return strings.ToLower(strings.TrimSpace(string(v))), strings.ToLower(strings.TrimSpace(string(p)))
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+// permissionHint explains how to gain access to a serial port after a permission error
+func permissionHint(port string) string {
+	return "The current user is not allowed to open the port. Check that no other program has claimed it and that your account may access serial devices."
+}
+
+// serialPermissionChecks has no platform specific checks outside Linux
+func serialPermissionChecks(path string) []checkResult {
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var (
+	axisRemapping = flag.String("remap", "", "Axes of the sensor each axis is taken from, as x:AXIS,y:AXIS,z:AXIS with a - for a flipped axis, e.g. x:-y,y:z,z:x. A remapping with an odd number of flips also corrects the handedness")
+	mountOffset   = flag.String("mount", "", "Orientation of the sensor on the body it measures, as roll,pitch,yaw in degrees (ZYX), which is taken out of every sample")
+	headingOffset = flag.Float64("heading-offset", 0, "Degrees added to the yaw of every sample, about the Z axis of the reference frame")
+	smoothing     = flag.Float64("smoothing", 0, "Time constant in seconds of a low-pass filter on the orientation of each device, or the length of its window (default: no smoothing)")
+	smoothMethod  = flag.String("smoothing-method", smoothExponential, "Low-pass filter of -smoothing, exponential to interpolate towards each sample, or window to average the samples of the last -smoothing seconds")
+)
+
+// Low-pass filters of -smoothing
+const (
+	smoothExponential = "exponential" // Slerp towards each sample, by 1-exp(-dt/τ)
+	smoothWindow      = "window"      // Average of the samples in a sliding window
+)
+
+// smoothWindowMax bounds the samples averaged per device, whatever the rate
+const smoothWindowMax = 1000
+
+// parseSmoothMethod validates a low-pass filter, exponential when empty
+func parseSmoothMethod(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", smoothExponential, "exp", "slerp":
+		return smoothExponential, nil
+	case smoothWindow, "average":
+		return smoothWindow, nil
+	}
+	return "", fmt.Errorf("unknown smoothing method %q, expected exponential or window", s)
+}
+
+// parseMount parses a mounting offset given as roll,pitch,yaw in degrees,
+// the identity when it is empty
+func parseMount(s string) (Quaternion, error) {
+	if strings.TrimSpace(s) == "" {
+		return Quaternion{Real: 1}, nil
+	}
+	fields := strings.Split(s, ",")
+	if len(fields) != 3 {
+		return Quaternion{}, fmt.Errorf("invalid mount %q, expected roll,pitch,yaw in degrees", s)
+	}
+	var angles [3]float64
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return Quaternion{}, fmt.Errorf("invalid mount %q, expected roll,pitch,yaw in degrees", s)
+		}
+		angles[i] = v
+	}
+	return quat.FromEuler(angles[0], angles[1], angles[2], quat.Degrees, defaultEulerOrder), nil
+}
+
+// axisRemap takes each axis of the corrected frame from an axis of the
+// sensor, possibly flipped
+type axisRemap struct {
+	from [3]int     // Axis of the sensor each axis is taken from
+	sign [3]float64 // -1 where the axis is flipped
+	det  float64    // -1 when the remapping changes the handedness
+}
+
+// parseRemap parses an axis remapping given as x:AXIS,y:AXIS,z:AXIS, nil
+// when it is empty
+func parseRemap(s string) (*axisRemap, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	invalid := fmt.Errorf("invalid remap %q, expected x:AXIS,y:AXIS,z:AXIS with each of x, y and z once, e.g. x:-y,y:z,z:x", s)
+	fields := strings.Split(s, ",")
+	if len(fields) != 3 {
+		return nil, invalid
+	}
+	var m axisRemap
+	var seenTo, seenFrom [3]bool
+	for _, f := range fields {
+		to, from, ok := strings.Cut(strings.ToLower(strings.TrimSpace(f)), ":")
+		sign := 1.0
+		if from = strings.TrimSpace(from); strings.HasPrefix(from, "-") {
+			sign, from = -1, from[1:]
+		} else {
+			from = strings.TrimPrefix(from, "+")
+		}
+		i, j := strings.Index("xyz", strings.TrimSpace(to)), strings.Index("xyz", from)
+		if !ok || len(strings.TrimSpace(to)) != 1 || len(from) != 1 || i < 0 || j < 0 || seenTo[i] || seenFrom[j] {
+			return nil, invalid
+		}
+		seenTo[i], seenFrom[j] = true, true
+		m.from[i], m.sign[i] = j, sign
+	}
+	// The determinant of a signed permutation is its parity times its
+	// signs. Of the permutations of three axes, those that keep one axis
+	// and swap the others are odd.
+	m.det = m.sign[0] * m.sign[1] * m.sign[2]
+	if m.from != [3]int{0, 1, 2} && (m.from[0] == 0 || m.from[1] == 1 || m.from[2] == 2) {
+		m.det = -m.det
+	}
+	return &m, nil
+}
+
+// apply expresses an orientation in the remapped axes. Rotation axes are
+// pseudovectors, flipped once more when the handedness changes.
+func (m *axisRemap) apply(q Quaternion) Quaternion {
+	if m == nil {
+		return q
+	}
+	v := [3]float64{q.I, q.J, q.K}
+	var r [3]float64
+	for i := range r {
+		r[i] = m.det * m.sign[i] * v[m.from[i]]
+	}
+	return Quaternion{I: r[0], J: r[1], K: r[2], Real: q.Real}
+}
+
+// undo expresses an orientation in the axes of the sensor again
+func (m *axisRemap) undo(q Quaternion) Quaternion {
+	if m == nil {
+		return q
+	}
+	r := [3]float64{q.I, q.J, q.K}
+	var v [3]float64
+	for i := range r {
+		v[m.from[i]] = m.det * m.sign[i] * r[i]
+	}
+	return Quaternion{I: v[0], J: v[1], K: v[2], Real: q.Real}
+}
+
+// pipelineInfo describes the corrections applied to samples after they are
+// converted to Hamilton quaternions, as recorded in recording headers
+type pipelineInfo struct {
+	Remap         string  `json:"remap,omitempty"`          // Axes of the sensor each axis is taken from
+	Mount         string  `json:"mount,omitempty"`          // Roll,pitch,yaw of the sensor on the body, degrees
+	HeadingOffset float64 `json:"heading_offset,omitempty"` // Degrees added to the yaw
+	Smoothing     float64 `json:"smoothing,omitempty"`      // Time constant of the low-pass filter, seconds
+	// SmoothMethod is the low-pass filter when it isn't exponential
+	SmoothMethod string `json:"smoothing_method,omitempty"`
+}
+
+// pipelineInfo returns the corrections the configuration applies to
+// samples, nil when it applies none
+func (cfg Config) pipelineInfo() *pipelineInfo {
+	info := pipelineInfo{Remap: strings.ReplaceAll(cfg.Remap, " ", ""), Mount: strings.ReplaceAll(cfg.Mount, " ", ""), HeadingOffset: cfg.HeadingOffset, Smoothing: cfg.Smoothing}
+	if method, _ := parseSmoothMethod(cfg.SmoothMethod); method != smoothExponential && cfg.Smoothing > 0 {
+		info.SmoothMethod = method
+	}
+	if info == (pipelineInfo{}) {
+		return nil
+	}
+	return &info
+}
+
+// String formats the corrections for the header of CSV recordings
+func (p pipelineInfo) String() string {
+	var parts []string
+	if p.Remap != "" {
+		parts = append(parts, "remap="+p.Remap)
+	}
+	if p.Mount != "" {
+		parts = append(parts, "mount="+p.Mount)
+	}
+	if p.HeadingOffset != 0 {
+		parts = append(parts, "heading_offset="+strconv.FormatFloat(p.HeadingOffset, 'g', -1, 64))
+	}
+	if p.Smoothing != 0 {
+		parts = append(parts, "smoothing="+strconv.FormatFloat(p.Smoothing, 'g', -1, 64))
+	}
+	if p.SmoothMethod != "" {
+		parts = append(parts, "smoothing_method="+p.SmoothMethod)
+	}
+	return strings.Join(parts, " ")
+}
+
+// parsePipelineInfo reads the corrections back from a CSV header
+func parsePipelineInfo(s string) *pipelineInfo {
+	var p pipelineInfo
+	for _, part := range strings.Fields(s) {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "remap":
+			p.Remap = value
+		case "mount":
+			p.Mount = value
+		case "heading_offset":
+			p.HeadingOffset, _ = strconv.ParseFloat(value, 64)
+		case "smoothing":
+			p.Smoothing, _ = strconv.ParseFloat(value, 64)
+		case "smoothing_method":
+			p.SmoothMethod = value
+		}
+	}
+	return &p
+}
+
+// pipeline applies the corrections of a configuration to the samples of
+// each device: the axes are remapped, the mounting offset is taken out on
+// the body side, the heading offset added on the reference side, and the
+// result smoothed, either exponentially or over a sliding window
+type pipeline struct {
+	remap    *axisRemap // Nil when the axes are the sensor's
+	mount    Quaternion // Orientation of the sensor on the body
+	heading  Quaternion // Rotation about the reference Z axis
+	tau      float64    // Smoothing time constant, or window length, seconds
+	window   bool       // Average over a window rather than smoothing exponentially
+	smoothed map[string]smoothedSample
+	recent   map[string][]timedQuaternion // Samples in the window of each device
+}
+
+type smoothedSample struct {
+	q Quaternion
+	t time.Time
+}
+
+// newPipeline builds the pipeline for the given corrections, nil when there
+// are none. The remap and mount must already be valid.
+func newPipeline(info *pipelineInfo) *pipeline {
+	if info == nil {
+		return nil
+	}
+	remap, _ := parseRemap(info.Remap)
+	mount, _ := parseMount(info.Mount)
+	half := info.HeadingOffset * math.Pi / 360
+	return &pipeline{
+		remap:    remap,
+		mount:    mount,
+		heading:  Quaternion{K: math.Sin(half), Real: math.Cos(half)},
+		tau:      info.Smoothing,
+		window:   info.SmoothMethod == smoothWindow,
+		smoothed: map[string]smoothedSample{},
+		recent:   map[string][]timedQuaternion{},
+	}
+}
+
+// apply corrects a sample of a device taken at t
+func (p *pipeline) apply(device string, q Quaternion, t time.Time) Quaternion {
+	if p == nil {
+		return q
+	}
+	q = quat.Multiply(quat.Multiply(p.heading, p.remap.apply(q)), quat.Conjugate(p.mount))
+	if p.tau <= 0 {
+		return q
+	}
+	q, ok := quat.Normalize(q)
+	if !ok {
+		return q
+	}
+	if p.window {
+		return p.average(device, q, t)
+	}
+	prev, seen := p.smoothed[device]
+	if seen && t.After(prev.t) {
+		q = quat.Slerp(prev.q, q, 1-math.Exp(-t.Sub(prev.t).Seconds()/p.tau))
+	}
+	p.smoothed[device] = smoothedSample{q: q, t: t}
+	return q
+}
+
+// average adds a sample of a device to its window and returns the mean
+// orientation of the samples in it
+func (p *pipeline) average(device string, q Quaternion, t time.Time) Quaternion {
+	window := time.Duration(p.tau * float64(time.Second))
+	samples := append(p.recent[device], timedQuaternion{t: t, q: q})
+	cut := 0
+	for cut < len(samples) && (t.Sub(samples[cut].t) > window || len(samples)-cut > smoothWindowMax) {
+		cut++
+	}
+	if cut > 0 {
+		samples = append(samples[:0], samples[cut:]...)
+	}
+	p.recent[device] = samples
+	qs := make([]Quaternion, len(samples))
+	for n, s := range samples {
+		qs[n] = s.q
+	}
+	return quat.Average(qs)
+}
+
+// undo reverses the rotations of the pipeline. Smoothing can't be reversed.
+func (p *pipeline) undo(q Quaternion) Quaternion {
+	if p == nil {
+		return q
+	}
+	return p.remap.undo(quat.Multiply(quat.Multiply(quat.Conjugate(p.heading), q), p.mount))
+}
+
+// frameAxes gives the axes of each known reference frame in ENU coordinates
+var frameAxes = map[string][3][3]float64{
+	"enu": {{1, 0, 0}, {0, 1, 0}, {0, 0, 1}},
+	"ned": {{0, 1, 0}, {1, 0, 0}, {0, 0, -1}},
+	"nwu": {{0, 1, 0}, {-1, 0, 0}, {0, 0, 1}},
+}
+
+// frameRotation returns the rotation taking coordinates in one reference
+// frame to another, false when either frame is unknown
+func frameRotation(from, to string) (Quaternion, bool) {
+	a, okFrom := frameAxes[from]
+	b, okTo := frameAxes[to]
+	if !okFrom || !okTo {
+		return Quaternion{}, false
+	}
+	// The rows of b times the columns of a, i.e. b*aᵀ
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += b[i][k] * a[j][k]
+			}
+		}
+	}
+	q, err := quat.FromMatrix(m)
+	return q, err == nil
+}
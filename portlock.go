@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.bug.st/serial"
+)
+
+// portLockedError reports that another quatplot process holds the advisory lock for a port
+type portLockedError struct {
+	Port string
+	PID  int
+}
+
+func (e *portLockedError) Error() string {
+	return fmt.Sprintf("serial port %s is locked by quatplot process %d", e.Port, e.PID)
+}
+
+// portLockPath returns the advisory lock file used for a serial port
+func portLockPath(port string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, port)
+	return filepath.Join(os.TempDir(), "quatplot-"+name+".lock")
+}
+
+// acquirePortLock takes the advisory lock for a serial port, replacing stale
+// locks left behind by processes that no longer exist. The returned function
+// releases the lock.
+func acquirePortLock(port string) (func(), error) {
+	path := portLockPath(port)
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			return nil, &portLockedError{Port: port, PID: pid}
+		}
+		// Stale or unreadable lock, remove it and try again
+		os.Remove(path)
+	}
+	return nil, fmt.Errorf("could not acquire lock file %s", path)
+}
+
+// classifyOpenError turns an error from opening a serial port into a status
+// with a human readable message and a hint on how to fix it
+func classifyOpenError(port string, err error) serialStatus {
+	st := serialStatus{State: serialError, Port: port, Message: err.Error()}
+
+	var lockErr *portLockedError
+	var portErr *serial.PortError
+	switch {
+	case errors.As(err, &lockErr):
+		st.State = serialBusy
+		st.Hint = fmt.Sprintf("Another quatplot instance (pid %d) is reading this port. Stop it or choose a different port.", lockErr.PID)
+	case errors.As(err, &portErr) && portErr.Code() == serial.PortBusy:
+		st.State = serialBusy
+		st.Hint = "Another program has the port open, e.g. a serial monitor, terminal or ModemManager. Close it and the port will be reopened automatically."
+	case errors.As(err, &portErr) && portErr.Code() == serial.PermissionDenied:
+		st.State = serialPermissionDenied
+		st.Hint = permissionHint(port)
+	case errors.As(err, &portErr) && portErr.Code() == serial.PortNotFound, errors.Is(err, fs.ErrNotExist):
+		st.State = serialNotFound
+		st.Hint = "Check that the device is plugged in and the port name is correct."
+		if isAutoPort(port) {
+			st.Hint = "Check that the sensor is plugged in and streaming at the -baud rate in the -format set, or run quatplot list-ports and name its port."
+		}
+	}
+	return st
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// processAlive reports whether a process with the given pid exists
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// FindProcess may hold a pidfd, which has to be released
+	defer p.Release()
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// processAlive reports whether a process with the given pid exists
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+// maxClientMessage is the largest message a WebSocket client may send
+const maxClientMessage = 4096
+
+var presenterRate = flag.Float64("presenter-rate", 10, "Maximum rate in Hz at which the presenter's view is sent to followers, 0 for no limit")
+
+// clientMessage is a message sent by a WebSocket client
+type clientMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// viewState is the camera and view settings of the presenter's viewer
+type viewState struct {
+	Zoom     float64    `json:"zoom"`     // Camera distance as a multiple of the default
+	Rotation Quaternion `json:"rotation"` // Rotation applied on top of the devices' orientation
+	Pan      [2]float64 `json:"pan"`      // Camera offset, in scene units
+}
+
+// presenterInfo is the payload of presenter events
+type presenterInfo struct {
+	Active     bool   `json:"active"`
+	Client     int64  `json:"client,omitempty"`     // ID of the presenting client
+	User       string `json:"user,omitempty"`       // Name of the presenter, when authenticated by a proxy
+	Presenting bool   `json:"presenting,omitempty"` // Whether the receiving client is the presenter
+	Error      string `json:"error,omitempty"`      // Why a request to present was refused
+}
+
+// presenter is the client of a namespace whose view its followers show
+type presenter struct {
+	mu      sync.Mutex
+	client  *client // nil when nobody presents
+	view    *viewState
+	sent    time.Time
+	pending bool // A timer is due to send the latest view
+}
+
+// handleClientMessage acts on a message from a WebSocket client. Unknown
+// and malformed messages are ignored.
+func (ns *namespace) handleClientMessage(c *client, data []byte) {
+	var msg clientMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+	if !c.handshakeStep(msg) {
+		return
+	}
+	switch msg.Type {
+	case "present", "follow":
+		var req struct {
+			Active bool `json:"active"`
+		}
+		if json.Unmarshal(msg.Data, &req) != nil {
+			return
+		}
+		if msg.Type == "follow" {
+			ns.follow(c, req.Active)
+		} else if req.Active {
+			ns.startPresenting(c)
+		} else {
+			ns.stopPresenting(c)
+		}
+	case "view":
+		var v viewState
+		if json.Unmarshal(msg.Data, &v) != nil {
+			return
+		}
+		if v, ok := v.check(); ok {
+			ns.setView(c, v)
+		}
+	case "subscribe":
+		if c.handleSubscribe(msg.Data) {
+			ns.completeHandshake(c)
+		}
+	}
+}
+
+// check normalizes a view, and reports whether it can be shown
+func (v viewState) check() (viewState, bool) {
+	q, ok := quat.Normalize(v.Rotation)
+	if !ok || !(v.Zoom > 0 && v.Zoom <= 100) || math.IsNaN(v.Pan[0]) || math.IsNaN(v.Pan[1]) || math.Abs(v.Pan[0]) > 1000 || math.Abs(v.Pan[1]) > 1000 {
+		return v, false
+	}
+	v.Rotation = q
+	return v, true
+}
+
+// startPresenting makes c the presenter, taking over from any other. Only
+// controllers may present.
+func (ns *namespace) startPresenting(c *client) {
+	if c.role != roleController {
+		c.sendEvent(mustMarshalEvent("presenter", presenterInfo{Error: "presenting needs the controller role"}))
+		return
+	}
+	p := &ns.presenter
+	p.mu.Lock()
+	previous := p.client
+	p.client, p.view = c, nil
+	p.mu.Unlock()
+	if previous != nil && previous != c {
+		log.Printf("Client %d (%s) takes over presenting from client %d in the %s namespace", c.id, c.addr, previous.id, ns)
+	} else {
+		log.Printf("Client %d (%s) is presenting in the %s namespace", c.id, c.addr, ns)
+	}
+	ns.announcePresenter()
+}
+
+// stopPresenting ends the presentation if c is the presenter
+func (ns *namespace) stopPresenting(c *client) {
+	p := &ns.presenter
+	p.mu.Lock()
+	if p.client != c {
+		p.mu.Unlock()
+		return
+	}
+	p.client, p.view = nil, nil
+	p.mu.Unlock()
+	log.Printf("Client %d (%s) stopped presenting in the %s namespace", c.id, c.addr, ns)
+	ns.announcePresenter()
+}
+
+// presenterInfo describes the presenter to client c
+func (ns *namespace) presenterInfo(c *client) presenterInfo {
+	p := &ns.presenter
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == nil {
+		return presenterInfo{}
+	}
+	return presenterInfo{Active: true, Client: p.client.id, User: p.client.user, Presenting: p.client == c}
+}
+
+// announcePresenter tells every client of the namespace who presents
+func (ns *namespace) announcePresenter() {
+	now := time.Now()
+	info := ns.presenterInfo(nil)
+	if ns == defaultNamespace {
+		recordEvent("presenter", now, info)
+	}
+	mine := info
+	mine.Presenting = true
+	data, presenterData := mustMarshalEvent("presenter", info), mustMarshalEvent("presenter", mine)
+	ns.clientsMu.Lock()
+	defer ns.clientsMu.Unlock()
+	for _, c := range ns.clients {
+		if info.Active && info.Client == c.id {
+			c.sendEvent(presenterData)
+		} else {
+			c.sendEvent(data)
+		}
+	}
+}
+
+// follow sets whether c shows the presenter's view, sending it the current
+// one right away
+func (ns *namespace) follow(c *client, on bool) {
+	c.follow.Store(on)
+	if !on {
+		return
+	}
+	p := &ns.presenter
+	p.mu.Lock()
+	view := p.view
+	presenting := p.client == c
+	p.mu.Unlock()
+	if view != nil && !presenting {
+		c.sendEvent(mustMarshalEvent("view", *view))
+	}
+}
+
+// setView takes a view from c if it is the presenter, and sends it to the
+// followers at most -presenter-rate times a second, the latest one last
+func (ns *namespace) setView(c *client, v viewState) {
+	p := &ns.presenter
+	p.mu.Lock()
+	if p.client != c {
+		p.mu.Unlock()
+		return
+	}
+	p.view = &v
+	if p.pending {
+		p.mu.Unlock()
+		return
+	}
+	var interval time.Duration
+	if *presenterRate > 0 {
+		interval = time.Duration(float64(time.Second) / *presenterRate)
+	}
+	if wait := interval - time.Since(p.sent); wait > 0 {
+		p.pending = true
+		time.AfterFunc(wait, ns.flushView)
+		p.mu.Unlock()
+		return
+	}
+	p.sent = time.Now()
+	p.mu.Unlock()
+	ns.sendView(c, v)
+}
+
+// flushView sends the view held back by setView
+func (ns *namespace) flushView() {
+	p := &ns.presenter
+	p.mu.Lock()
+	p.pending = false
+	if p.client == nil || p.view == nil {
+		p.mu.Unlock()
+		return
+	}
+	presenter, v := p.client, *p.view
+	p.sent = time.Now()
+	p.mu.Unlock()
+	ns.sendView(presenter, v)
+}
+
+// sendView sends the presenter's view to the followers of the namespace
+func (ns *namespace) sendView(presenter *client, v viewState) {
+	data := mustMarshalEvent("view", v)
+	ns.clientsMu.Lock()
+	defer ns.clientsMu.Unlock()
+	for _, c := range ns.clients {
+		if c != presenter && c.follow.Load() {
+			c.sendEvent(data)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const previewCapacity = 100
+
+// previewBuffer keeps the most recent raw lines received from the device
+type previewBuffer struct {
+	mu    sync.Mutex
+	lines []previewLine
+	next  int
+	full  bool
+}
+
+func newPreviewBuffer(capacity int) *previewBuffer {
+	return &previewBuffer{lines: make([]previewLine, capacity)}
+}
+
+// add records a raw line together with the result of parsing it
+func (b *previewBuffer) add(line string, quat Quaternion, err error) {
+	pl := previewLine{Time: time.Now(), Line: line}
+	if err != nil {
+		pl.Error = err.Error()
+	} else {
+		pl.OK = true
+		pl.Quat = &quat
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lines[b.next] = pl
+	b.next = (b.next + 1) % len(b.lines)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// last returns up to n of the most recent lines, oldest first
+func (b *previewBuffer) last(n int) []previewLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	count := b.next
+	if b.full {
+		count = len(b.lines)
+	}
+	if n > count {
+		n = count
+	}
+
+	out := make([]previewLine, 0, n)
+	for idx := n; idx > 0; idx-- {
+		out = append(out, b.lines[(b.next-idx+len(b.lines))%len(b.lines)])
+	}
+	return out
+}
+
+// handleSerialPreview returns the last N raw lines received from the serial
+// port with their parse status, e.g. GET /api/serial/preview?n=20
+func handleSerialPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := 20
+	if v := r.URL.Query().Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requestNamespace(r).preview.last(n))
+}
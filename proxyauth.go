@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Roles of authenticated users. Viewers may watch the stream and read the
+// API, controllers may also change settings and restart sources and sinks.
+const (
+	roleViewer     = "viewer"
+	roleController = "controller"
+)
+
+var (
+	proxyUserHeader   = flag.String("proxy-user-header", "", "Header a trusted reverse proxy puts the authenticated user name in, e.g. X-Forwarded-User (default: disabled)")
+	proxyGroupsHeader = flag.String("proxy-groups-header", "X-Forwarded-Groups", "Header a trusted reverse proxy puts the user's comma-separated groups in")
+	trustedProxies    = flag.String("trusted-proxies", "127.0.0.1/32,::1/128", "Comma-separated addresses or CIDR ranges of reverse proxies whose user headers are trusted")
+	controllers       = flag.String("controllers", "", "Comma-separated proxy users, or groups as group:NAME, given the controller role (others are viewers)")
+
+	trustedProxyNets []*net.IPNet
+)
+
+// identity is who a request was made by
+type identity struct {
+	User string `json:"user,omitempty"`
+	Role string `json:"role"`
+	Via  string `json:"via"` // How the user was authenticated: none, token or proxy
+}
+
+// initAuth parses the trusted proxy ranges
+func initAuth() error {
+	nets, err := parseCIDRList(*trustedProxies)
+	if err != nil {
+		return fmt.Errorf("trusted proxy %v", err)
+	}
+	trustedProxyNets = nets
+	return nil
+}
+
+// authEnabled reports whether requests have to be authenticated at all
+func authEnabled() bool {
+	return loginPassword() != "" || *proxyUserHeader != ""
+}
+
+// fromTrustedProxy reports whether the request came directly from a trusted reverse proxy
+func fromTrustedProxy(r *http.Request) bool {
+	ip := remoteIP(r)
+	return ip != nil && ipInNets(ip, trustedProxyNets)
+}
+
+// proxyRole maps a user authenticated by the proxy to a role
+func proxyRole(user string, groups []string) string {
+	for _, entry := range strings.Split(*controllers, ",") {
+		entry = strings.TrimSpace(entry)
+		if group, ok := strings.CutPrefix(entry, "group:"); ok {
+			for _, g := range groups {
+				if strings.TrimSpace(g) == group {
+					return roleController
+				}
+			}
+		} else if entry != "" && entry == user {
+			return roleController
+		}
+	}
+	return roleViewer
+}
+
+// authenticate identifies the user behind a request. Tokens from /api/login
+// carry the controller role, users named by a trusted proxy get the role
+// -controllers gives them. With authentication off everyone is a controller.
+// A tenant with its own password only accepts tokens issued for it.
+func authenticate(r *http.Request) (identity, bool) {
+	ns := requestNamespace(r)
+	if ns.authority() != defaultNamespace {
+		if role, ok := tokenRole(ns, requestToken(r)); ok {
+			return identity{Role: role, Via: "token"}, true
+		}
+		return identity{}, false
+	}
+	if !authEnabled() {
+		return identity{Role: roleController, Via: "none"}, true
+	}
+	if *proxyUserHeader != "" && fromTrustedProxy(r) {
+		if user := r.Header.Get(*proxyUserHeader); user != "" {
+			var groups []string
+			if v := r.Header.Get(*proxyGroupsHeader); v != "" {
+				groups = strings.Split(v, ",")
+			}
+			return identity{User: user, Role: proxyRole(user, groups), Via: "proxy"}, true
+		}
+	}
+	if loginPassword() != "" {
+		if role, ok := tokenRole(ns, requestToken(r)); ok {
+			return identity{Role: role, Via: "token"}, true
+		}
+	}
+	return identity{}, false
+}
+
+// needsController reports whether a request changes state and so requires
+// the controller role
+func needsController(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return r.URL.Path != "/api/login" && r.URL.Path != "/api/logout"
+}
+
+// handleWhoAmI reports who the request was authenticated as
+func handleWhoAmI(w http.ResponseWriter, r *http.Request) {
+	id, _ := authenticate(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(id)
+}
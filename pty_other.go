@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// pty is a pseudo-terminal, only created on Linux
+type pty struct{}
+
+// openPTY fails outside Linux, where a pair of virtual serial ports such as
+// those of com0com or socat must be written to instead
+func openPTY() (*pty, string, error) {
+	return nil, "", errors.New("pseudo-terminals are only created on Linux, give -port one end of a virtual serial port pair instead")
+}
+
+func (p *pty) Write(b []byte) (int, error) { return 0, errors.New("no pseudo-terminal") }
+
+func (p *pty) Close() error { return nil }
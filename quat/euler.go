@@ -0,0 +1,124 @@
+package quat
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Angle units
+const (
+	Degrees = "deg"
+	Radians = "rad"
+)
+
+// DefaultOrder is the aerospace rotation order, yaw, then pitch, then roll
+const DefaultOrder = "ZYX"
+
+// ParseUnits validates an angle unit name, accepting common spellings
+func ParseUnits(s string) (string, error) {
+	switch s {
+	case "deg", "degree", "degrees":
+		return Degrees, nil
+	case "rad", "radian", "radians":
+		return Radians, nil
+	}
+	return "", fmt.Errorf("unknown angle units %q, expected deg or rad", s)
+}
+
+// ConvertAngle converts an angle in radians to the given units
+func ConvertAngle(rad float64, units string) float64 {
+	if units == Degrees {
+		return rad * 180 / math.Pi
+	}
+	return rad
+}
+
+// ParseOrder validates a rotation order, which names each of the axes X, Y
+// and Z once
+func ParseOrder(s string) (string, error) {
+	order := strings.ToUpper(s)
+	if len(order) != 3 || strings.Count(order, "X") != 1 || strings.Count(order, "Y") != 1 || strings.Count(order, "Z") != 1 {
+		return "", fmt.Errorf("invalid rotation order %q, expected the axes X, Y and Z each once, e.g. ZYX", s)
+	}
+	return order, nil
+}
+
+// Euler are roll, pitch and yaw, rotations about the X, Y and Z axes
+type Euler struct {
+	Roll  float64 `json:"roll"`
+	Pitch float64 `json:"pitch"`
+	Yaw   float64 `json:"yaw"`
+}
+
+// ToEuler converts a quaternion to aerospace (Z-Y-X) Euler angles in the
+// given units
+func ToEuler(q Quaternion, units string) Euler {
+	return ToEulerOrder(q, units, DefaultOrder)
+}
+
+// ToEulerOrder converts a quaternion to Euler angles in the given units,
+// for intrinsic rotations applied in the given order. It reverses FromEuler.
+// The middle rotation is kept within ±90°, the others within ±180°.
+func ToEulerOrder(q Quaternion, units, order string) Euler {
+	q, ok := Normalize(q)
+	if !ok || len(order) != 3 {
+		return Euler{}
+	}
+	m := ToMatrix(q)
+	a, b, c := axisIndex(order[0]), axisIndex(order[1]), axisIndex(order[2])
+	if a < 0 || b < 0 || c < 0 {
+		return Euler{}
+	}
+	// Odd permutations of XYZ flip the signs
+	sign := 1.0
+	if (b-a+3)%3 != 1 {
+		sign = -1
+	}
+	var angles [3]float64
+	angles[a] = math.Atan2(-sign*m[b][c], m[c][c])
+	angles[b] = math.Asin(math.Max(-1, math.Min(1, sign*m[a][c])))
+	angles[c] = math.Atan2(-sign*m[a][b], m[a][a])
+
+	return Euler{
+		Roll:  ConvertAngle(angles[0], units),
+		Pitch: ConvertAngle(angles[1], units),
+		Yaw:   ConvertAngle(angles[2], units),
+	}
+}
+
+// axisIndex returns 0, 1 or 2 for the axis X, Y or Z, -1 for anything else
+func axisIndex(axis byte) int {
+	switch axis {
+	case 'X', 'x':
+		return 0
+	case 'Y', 'y':
+		return 1
+	case 'Z', 'z':
+		return 2
+	}
+	return -1
+}
+
+// FromEuler converts roll, pitch and yaw, rotations about the X, Y and Z
+// axes, to a Hamilton quaternion. The rotations are intrinsic and applied in
+// the given order, so ZYX is the aerospace convention that ToEuler reverses.
+func FromEuler(roll, pitch, yaw float64, units, order string) Quaternion {
+	if units != Radians {
+		roll, pitch, yaw = roll*math.Pi/180, pitch*math.Pi/180, yaw*math.Pi/180
+	}
+	q := Identity
+	for _, axis := range order {
+		var r Quaternion
+		switch axis {
+		case 'X':
+			r = Quaternion{I: math.Sin(roll / 2), Real: math.Cos(roll / 2)}
+		case 'Y':
+			r = Quaternion{J: math.Sin(pitch / 2), Real: math.Cos(pitch / 2)}
+		case 'Z':
+			r = Quaternion{K: math.Sin(yaw / 2), Real: math.Cos(yaw / 2)}
+		}
+		q = Multiply(q, r)
+	}
+	return q
+}
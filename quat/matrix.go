@@ -0,0 +1,75 @@
+package quat
+
+import (
+	"errors"
+	"math"
+)
+
+// MatrixTolerance is how far a matrix may be from orthonormal, with
+// determinant 1, and still be taken as a rotation
+const MatrixTolerance = 0.05
+
+// FromMatrix converts a rotation matrix, rows first, to a Hamilton
+// quaternion rotating the same way. The largest of the four candidate
+// components is computed first, which keeps the conversion accurate for
+// every rotation.
+func FromMatrix(m [3][3]float64) (Quaternion, error) {
+	if err := CheckMatrix(m); err != nil {
+		return Quaternion{}, err
+	}
+	var q Quaternion
+	switch trace := m[0][0] + m[1][1] + m[2][2]; {
+	case trace > 0:
+		s := 2 * math.Sqrt(1+trace)
+		q = Quaternion{Real: s / 4, I: (m[2][1] - m[1][2]) / s, J: (m[0][2] - m[2][0]) / s, K: (m[1][0] - m[0][1]) / s}
+	case m[0][0] > m[1][1] && m[0][0] > m[2][2]:
+		s := 2 * math.Sqrt(1+m[0][0]-m[1][1]-m[2][2])
+		q = Quaternion{Real: (m[2][1] - m[1][2]) / s, I: s / 4, J: (m[0][1] + m[1][0]) / s, K: (m[0][2] + m[2][0]) / s}
+	case m[1][1] > m[2][2]:
+		s := 2 * math.Sqrt(1+m[1][1]-m[0][0]-m[2][2])
+		q = Quaternion{Real: (m[0][2] - m[2][0]) / s, I: (m[0][1] + m[1][0]) / s, J: s / 4, K: (m[1][2] + m[2][1]) / s}
+	default:
+		s := 2 * math.Sqrt(1+m[2][2]-m[0][0]-m[1][1])
+		q = Quaternion{Real: (m[1][0] - m[0][1]) / s, I: (m[0][2] + m[2][0]) / s, J: (m[1][2] + m[2][1]) / s, K: s / 4}
+	}
+	if q.Real < 0 {
+		q = Quaternion{I: -q.I, J: -q.J, K: -q.K, Real: -q.Real}
+	}
+	q, _ = Normalize(q)
+	return q, nil
+}
+
+// ToMatrix converts a unit quaternion to the rotation matrix, rows first,
+// that FromMatrix takes back to it
+func ToMatrix(q Quaternion) [3][3]float64 {
+	w, x, y, z := q.Real, q.I, q.J, q.K
+	return [3][3]float64{
+		{1 - 2*(y*y+z*z), 2 * (x*y - w*z), 2 * (x*z + w*y)},
+		{2 * (x*y + w*z), 1 - 2*(x*x+z*z), 2 * (y*z - w*x)},
+		{2 * (x*z - w*y), 2 * (y*z + w*x), 1 - 2*(x*x+y*y)},
+	}
+}
+
+// CheckMatrix rejects matrices too far from a proper rotation, such as
+// those of a misread line or with a reflection
+func CheckMatrix(m [3][3]float64) error {
+	for r := 0; r < 3; r++ {
+		for c := r; c < 3; c++ {
+			dot := m[r][0]*m[c][0] + m[r][1]*m[c][1] + m[r][2]*m[c][2]
+			want := 0.0
+			if r == c {
+				want = 1
+			}
+			if math.Abs(dot-want) > MatrixTolerance {
+				return errors.New("not a rotation matrix, the rows aren't orthonormal")
+			}
+		}
+	}
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if det < 0 {
+		return errors.New("not a rotation matrix, the determinant is negative")
+	}
+	return nil
+}
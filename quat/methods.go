@@ -0,0 +1,61 @@
+package quat
+
+import "math"
+
+// The methods below chain the package's functions, e.g.
+// a.Conjugate().Mul(b).ToEuler(quat.Degrees) for the rotation from a to b.
+// Orientations are made with FromEuler, FromMatrix or a Quaternion literal.
+
+// Norm returns the length of q, 1 for a rotation
+func (q Quaternion) Norm() float64 {
+	return math.Sqrt(q.I*q.I + q.J*q.J + q.K*q.K + q.Real*q.Real)
+}
+
+// Normalize returns q scaled to unit length, or q itself when it is zero.
+// The function Normalize tells the two apart.
+func (q Quaternion) Normalize() Quaternion {
+	if n, ok := Normalize(q); ok {
+		return n
+	}
+	return q
+}
+
+// Conjugate returns the conjugate of q, the inverse rotation when q is a
+// unit quaternion
+func (q Quaternion) Conjugate() Quaternion {
+	return Conjugate(q)
+}
+
+// Mul returns the Hamilton product q*r, the rotation r followed by q
+func (q Quaternion) Mul(r Quaternion) Quaternion {
+	return Multiply(q, r)
+}
+
+// Rotate rotates a vector by the unit quaternion q
+func (q Quaternion) Rotate(v Vector) Vector {
+	return Rotate(q, v)
+}
+
+// Slerp interpolates from the unit quaternion q to r along the shortest
+// path, t running from 0 at q to 1 at r
+func (q Quaternion) Slerp(r Quaternion, t float64) Quaternion {
+	return Slerp(q, r, t)
+}
+
+// Angle returns the angle in degrees of the rotation between the unit
+// quaternions q and r
+func (q Quaternion) Angle(r Quaternion) float64 {
+	return Angle(q, r)
+}
+
+// ToEuler converts q to aerospace (Z-Y-X) Euler angles in the given units.
+// ToEulerOrder takes another rotation order.
+func (q Quaternion) ToEuler(units string) Euler {
+	return ToEuler(q, units)
+}
+
+// ToMatrix converts q to its rotation matrix, rows first, after scaling it
+// to unit length
+func (q Quaternion) ToMatrix() [3][3]float64 {
+	return ToMatrix(q.Normalize())
+}
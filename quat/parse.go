@@ -0,0 +1,108 @@
+package quat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultFormat is the layout of lines quatplot reads unless told otherwise
+const DefaultFormat = "i,j,k,real"
+
+// formatDelims are the column separators a format may use. A format without
+// any of them has columns separated by white space.
+const formatDelims = ",;|:"
+
+// Format is the layout of text lines holding a quaternion: which column
+// holds each component, how columns are separated and which are ignored
+type Format struct {
+	columns []int // Component of each column, 0 to 3 for i, j, k and real, -1 when ignored
+	delim   string
+	extra   bool // Columns after the last one are ignored
+}
+
+// componentNames are the names of the components in error messages
+var componentNames = [4]string{"i", "j", "k", "real"}
+
+// componentIndex maps the column names of a format to the components
+var componentIndex = map[string]int{
+	"i": 0, "j": 1, "k": 2, "real": 3,
+	"x": 0, "y": 1, "z": 2, "w": 3,
+}
+
+// ParseFormat parses a layout such as "i,j,k,real", "w x y z" or
+// "_;x;y;z;w;...", with _ for an ignored column and a trailing ... for any
+// further ones. The first separator used in the format separates the
+// columns of lines.
+func ParseFormat(spec string) (*Format, error) {
+	f := &Format{}
+	var names []string
+	if idx := strings.IndexAny(spec, formatDelims); idx >= 0 {
+		f.delim = spec[idx : idx+1]
+		names = strings.Split(spec, f.delim)
+	} else {
+		names = strings.Fields(spec)
+	}
+	seen := [4]bool{}
+	for n, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name == "..." && n == len(names)-1:
+			f.extra = true
+			continue
+		case name == "_":
+			f.columns = append(f.columns, -1)
+			continue
+		}
+		c, ok := componentIndex[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q in format %q, expected i, j, k and real, or x, y, z and w", name, spec)
+		}
+		if seen[c] {
+			return nil, fmt.Errorf("column %q appears twice in format %q", name, spec)
+		}
+		seen[c] = true
+		f.columns = append(f.columns, c)
+	}
+	for _, ok := range seen {
+		if !ok {
+			return nil, fmt.Errorf("format %q must name each of i, j, k and real, or x, y, z and w", spec)
+		}
+	}
+	return f, nil
+}
+
+// Parse reads a quaternion from a line laid out as the format says
+func (f *Format) Parse(line string) (Quaternion, error) {
+	var fields []string
+	if f.delim == "" {
+		fields = strings.Fields(line)
+	} else {
+		fields = strings.Split(strings.TrimSpace(line), f.delim)
+	}
+	switch {
+	case f.extra && len(fields) < len(f.columns):
+		return Quaternion{}, fmt.Errorf("expected at least %d values, got %d", len(f.columns), len(fields))
+	case !f.extra && len(fields) != len(f.columns):
+		return Quaternion{}, fmt.Errorf("expected %d values, got %d", len(f.columns), len(fields))
+	}
+	var v [4]float64
+	for n, c := range f.columns {
+		if c < 0 {
+			continue
+		}
+		x, err := strconv.ParseFloat(strings.TrimSpace(fields[n]), 64)
+		if err != nil {
+			return Quaternion{}, fmt.Errorf("invalid %s value: %w", componentNames[c], err)
+		}
+		v[c] = x
+	}
+	return Quaternion{I: v[0], J: v[1], K: v[2], Real: v[3]}, nil
+}
+
+var defaultFormat, _ = ParseFormat(DefaultFormat)
+
+// Parse reads a quaternion from an "i,j,k,real" line
+func Parse(line string) (Quaternion, error) {
+	return defaultFormat.Parse(line)
+}
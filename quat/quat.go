@@ -0,0 +1,150 @@
+// Package quat is the quaternion math of quatplot: products, rotations,
+// interpolation, averaging, angular velocity, and conversions from and to
+// Euler angles and rotation matrices. Quaternions are Hamilton quaternions,
+// and samples rotate the sensor's own axes into the reference frame.
+package quat
+
+import "math"
+
+// Quaternion represents a quaternion with i, j, k, real components
+type Quaternion struct {
+	I    float64 `json:"i"`
+	J    float64 `json:"j"`
+	K    float64 `json:"k"`
+	Real float64 `json:"real"`
+}
+
+// Identity is the quaternion of no rotation
+var Identity = Quaternion{Real: 1}
+
+// Vector is a vector in three dimensions, usually of unit length
+type Vector struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+// Multiply returns the Hamilton product a*b
+func Multiply(a, b Quaternion) Quaternion {
+	return Quaternion{
+		I:    a.Real*b.I + a.I*b.Real + a.J*b.K - a.K*b.J,
+		J:    a.Real*b.J - a.I*b.K + a.J*b.Real + a.K*b.I,
+		K:    a.Real*b.K + a.I*b.J - a.J*b.I + a.K*b.Real,
+		Real: a.Real*b.Real - a.I*b.I - a.J*b.J - a.K*b.K,
+	}
+}
+
+// Conjugate returns the conjugate of q, the inverse rotation of a unit quaternion
+func Conjugate(q Quaternion) Quaternion {
+	return Quaternion{I: -q.I, J: -q.J, K: -q.K, Real: q.Real}
+}
+
+// Normalize scales q to unit length, false when it is zero
+func Normalize(q Quaternion) (Quaternion, bool) {
+	n := math.Sqrt(q.I*q.I + q.J*q.J + q.K*q.K + q.Real*q.Real)
+	if n == 0 {
+		return Quaternion{}, false
+	}
+	return Quaternion{I: q.I / n, J: q.J / n, K: q.K / n, Real: q.Real / n}, true
+}
+
+// Rotate rotates v by the unit quaternion q, q*v*q⁻¹
+func Rotate(q Quaternion, v Vector) Vector {
+	p := Multiply(Multiply(q, Quaternion{I: v.X, J: v.Y, K: v.Z}), Conjugate(q))
+	return Vector{X: p.I, Y: p.J, Z: p.K}
+}
+
+// AngularVelocity returns the rate in radians per second that turns a into
+// b in dt seconds, about the axes of the sensor as a gyroscope measures it.
+// It takes the shorter way, so rotations of more than half a turn between
+// samples can't be told apart from slower ones the other way.
+func AngularVelocity(a, b Quaternion, dt float64) (Vector, bool) {
+	a, okA := Normalize(a)
+	b, okB := Normalize(b)
+	if !okA || !okB || dt <= 0 {
+		return Vector{}, false
+	}
+	// b = a*d, with d the rotation in the sensor's axes
+	d := Multiply(Conjugate(a), b)
+	if d.Real < 0 {
+		d = Quaternion{I: -d.I, J: -d.J, K: -d.K, Real: -d.Real}
+	}
+	n := math.Sqrt(d.I*d.I + d.J*d.J + d.K*d.K)
+	if n < 1e-12 {
+		return Vector{}, true
+	}
+	rate := 2 * math.Atan2(n, d.Real) / dt / n
+	return Vector{X: d.I * rate, Y: d.J * rate, Z: d.K * rate}, true
+}
+
+// Angle returns the angle in degrees of the rotation between two unit
+// quaternions
+func Angle(a, b Quaternion) float64 {
+	dot := math.Abs(a.I*b.I + a.J*b.J + a.K*b.K + a.Real*b.Real)
+	return 2 * math.Acos(math.Min(1, dot)) * 180 / math.Pi
+}
+
+// Slerp interpolates between two unit quaternions along the shortest path,
+// t running from 0 at a to 1 at b
+func Slerp(a, b Quaternion, t float64) Quaternion {
+	dot := a.I*b.I + a.J*b.J + a.K*b.K + a.Real*b.Real
+	if dot < 0 {
+		b = Quaternion{I: -b.I, J: -b.J, K: -b.K, Real: -b.Real}
+		dot = -dot
+	}
+	wa, wb := 1-t, t
+	if dot < 0.9995 {
+		theta := math.Acos(dot)
+		wa = math.Sin((1-t)*theta) / math.Sin(theta)
+		wb = math.Sin(t*theta) / math.Sin(theta)
+	}
+	q := Quaternion{I: wa*a.I + wb*b.I, J: wa*a.J + wb*b.J, K: wa*a.K + wb*b.K, Real: wa*a.Real + wb*b.Real}
+	norm := math.Sqrt(q.I*q.I + q.J*q.J + q.K*q.K + q.Real*q.Real)
+	return Quaternion{I: q.I / norm, J: q.J / norm, K: q.K / norm, Real: q.Real / norm}
+}
+
+// Average returns the mean rotation of unit quaternions, the eigenvector of
+// the largest eigenvalue of the sum of their outer products (Markley et
+// al.), which is unaffected by their signs. It is found by power iteration
+// from the last quaternion, which is close to it. qs must not be empty.
+func Average(qs []Quaternion) Quaternion {
+	var m [4][4]float64
+	for _, q := range qs {
+		v := [4]float64{q.I, q.J, q.K, q.Real}
+		for r := 0; r < 4; r++ {
+			for c := 0; c < 4; c++ {
+				m[r][c] += v[r] * v[c]
+			}
+		}
+	}
+	last := qs[len(qs)-1]
+	v := [4]float64{last.I, last.J, last.K, last.Real}
+	for iter := 0; iter < 50; iter++ {
+		var next [4]float64
+		var norm float64
+		for r := 0; r < 4; r++ {
+			for c := 0; c < 4; c++ {
+				next[r] += m[r][c] * v[c]
+			}
+			norm += next[r] * next[r]
+		}
+		norm = math.Sqrt(norm)
+		if norm == 0 {
+			break
+		}
+		var change float64
+		for r := range next {
+			next[r] /= norm
+			change += math.Abs(next[r] - v[r])
+		}
+		v = next
+		if change < 1e-12 {
+			break
+		}
+	}
+	if v[3] < 0 {
+		// Keep the real part positive, like the rest of the output
+		v = [4]float64{-v[0], -v[1], -v[2], -v[3]}
+	}
+	return Quaternion{I: v[0], J: v[1], K: v[2], Real: v[3]}
+}
@@ -0,0 +1,269 @@
+package quat
+
+import (
+	"math"
+	"testing"
+)
+
+// orders are the six rotation orders naming each axis once
+var orders = []string{"XYZ", "XZY", "YXZ", "YZX", "ZXY", "ZYX"}
+
+// sameRotation reports whether a and b rotate the same way, either sign
+func sameRotation(a, b Quaternion) bool {
+	dot := a.I*b.I + a.J*b.J + a.K*b.K + a.Real*b.Real
+	return math.Abs(math.Abs(dot)-1) < 1e-9
+}
+
+func TestEulerRoundTrip(t *testing.T) {
+	// Angles of the first, middle and last axis of the order. The middle
+	// one is within ±90°, which ToEulerOrder keeps it in.
+	tests := []struct {
+		name                string
+		first, middle, last float64
+	}{
+		{"zero", 0, 0, 0},
+		{"small", 10, 20, 30},
+		{"negative", -45, -60, -15},
+		{"large outer", 150, -40, -120},
+		{"near gimbal lock", 30, 89, -70},
+	}
+	for _, order := range orders {
+		for _, tt := range tests {
+			var angles [3]float64
+			angles[axisIndex(order[0])] = tt.first
+			angles[axisIndex(order[1])] = tt.middle
+			angles[axisIndex(order[2])] = tt.last
+
+			q := FromEuler(angles[0], angles[1], angles[2], Degrees, order)
+			if n := q.Norm(); math.Abs(n-1) > 1e-12 {
+				t.Errorf("%s %s: FromEuler norm %g, want 1", order, tt.name, n)
+			}
+			got := ToEulerOrder(q, Degrees, order)
+			want := Euler{Roll: angles[0], Pitch: angles[1], Yaw: angles[2]}
+			if math.Abs(got.Roll-want.Roll) > 1e-6 || math.Abs(got.Pitch-want.Pitch) > 1e-6 || math.Abs(got.Yaw-want.Yaw) > 1e-6 {
+				t.Errorf("%s %s: ToEulerOrder(FromEuler) = %+v, want %+v", order, tt.name, got, want)
+			}
+
+			// The same rotation in radians
+			r := FromEuler(angles[0]*math.Pi/180, angles[1]*math.Pi/180, angles[2]*math.Pi/180, Radians, order)
+			if !sameRotation(q, r) {
+				t.Errorf("%s %s: FromEuler in radians = %+v, want %+v", order, tt.name, r, q)
+			}
+		}
+	}
+}
+
+func TestFromEulerSingleAxis(t *testing.T) {
+	s := math.Sqrt(0.5)
+	tests := []struct {
+		name             string
+		roll, pitch, yaw float64
+		want             Quaternion
+	}{
+		{"roll", 90, 0, 0, Quaternion{I: s, Real: s}},
+		{"pitch", 0, 90, 0, Quaternion{J: s, Real: s}},
+		{"yaw", 0, 0, 90, Quaternion{K: s, Real: s}},
+	}
+	for _, order := range orders {
+		for _, tt := range tests {
+			if got := FromEuler(tt.roll, tt.pitch, tt.yaw, Degrees, order); !sameRotation(got, tt.want) {
+				t.Errorf("%s %s: FromEuler = %+v, want %+v", order, tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestMatrixRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		q    Quaternion
+	}{
+		{"identity", Identity},
+		{"half turn about X", Quaternion{I: 1}},
+		{"half turn about Y", Quaternion{J: 1}},
+		{"half turn about Z", Quaternion{K: 1}},
+		{"quarter turn about Z", Quaternion{K: math.Sqrt(0.5), Real: math.Sqrt(0.5)}},
+		{"general", FromEuler(20, -35, 170, Degrees, DefaultOrder)},
+		{"negative real part", Quaternion{I: -0.1, J: 0.7, K: 0.1, Real: -0.7}.Normalize()},
+	}
+	for _, tt := range tests {
+		m := tt.q.ToMatrix()
+		got, err := FromMatrix(m)
+		if err != nil {
+			t.Errorf("%s: FromMatrix: %v", tt.name, err)
+			continue
+		}
+		if !sameRotation(got, tt.q) {
+			t.Errorf("%s: FromMatrix(ToMatrix) = %+v, want %+v", tt.name, got, tt.q)
+		}
+		if got.Real < 0 {
+			t.Errorf("%s: FromMatrix real part %g, want it positive", tt.name, got.Real)
+		}
+		if math.Abs(got.Norm()-1) > 1e-12 {
+			t.Errorf("%s: FromMatrix norm %g, want 1", tt.name, got.Norm())
+		}
+
+		// The matrix rotates vectors as the quaternion does
+		v := Vector{X: 0.3, Y: -0.5, Z: 0.8}
+		want := tt.q.Rotate(v)
+		mv := Vector{
+			X: m[0][0]*v.X + m[0][1]*v.Y + m[0][2]*v.Z,
+			Y: m[1][0]*v.X + m[1][1]*v.Y + m[1][2]*v.Z,
+			Z: m[2][0]*v.X + m[2][1]*v.Y + m[2][2]*v.Z,
+		}
+		if math.Abs(mv.X-want.X) > 1e-12 || math.Abs(mv.Y-want.Y) > 1e-12 || math.Abs(mv.Z-want.Z) > 1e-12 {
+			t.Errorf("%s: matrix rotates to %+v, quaternion to %+v", tt.name, mv, want)
+		}
+	}
+}
+
+func TestFromMatrixRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		m    [3][3]float64
+	}{
+		{"reflection", [3][3]float64{{-1, 0, 0}, {0, 1, 0}, {0, 0, 1}}},
+		{"scaled", [3][3]float64{{2, 0, 0}, {0, 2, 0}, {0, 0, 2}}},
+		{"sheared", [3][3]float64{{1, 0.5, 0}, {0, 1, 0}, {0, 0, 1}}},
+		{"zero", [3][3]float64{}},
+	}
+	for _, tt := range tests {
+		if q, err := FromMatrix(tt.m); err == nil {
+			t.Errorf("%s: FromMatrix = %+v, want an error", tt.name, q)
+		}
+	}
+}
+
+func TestSlerp(t *testing.T) {
+	a := FromEuler(10, 20, 30, Degrees, DefaultOrder)
+	b := FromEuler(-40, 60, 100, Degrees, DefaultOrder)
+	negB := Quaternion{I: -b.I, J: -b.J, K: -b.K, Real: -b.Real}
+	near := FromEuler(10, 20, 30.01, Degrees, DefaultOrder)
+
+	tests := []struct {
+		name string
+		a, b Quaternion
+		t    float64
+		want Quaternion
+	}{
+		{"start", a, b, 0, a},
+		{"end", a, b, 1, b},
+		{"antipodal start", a, negB, 0, a},
+		{"antipodal end", a, negB, 1, b},
+		{"antipodal middle", a, negB, 0.5, Slerp(a, b, 0.5)},
+		{"same rotation, opposite sign", a, Quaternion{I: -a.I, J: -a.J, K: -a.K, Real: -a.Real}, 0.5, a},
+		{"nearly equal", a, near, 1, near},
+	}
+	for _, tt := range tests {
+		got := Slerp(tt.a, tt.b, tt.t)
+		if !sameRotation(got, tt.want) {
+			t.Errorf("%s: Slerp(%g) = %+v, want %+v", tt.name, tt.t, got, tt.want)
+		}
+		if math.Abs(got.Norm()-1) > 1e-12 {
+			t.Errorf("%s: Slerp norm %g, want 1", tt.name, got.Norm())
+		}
+	}
+
+	// The middle is half way along the shorter path, also when b is given
+	// with the opposite sign
+	for _, other := range []Quaternion{b, negB} {
+		mid := a.Slerp(other, 0.5)
+		if d1, d2 := Angle(a, mid), Angle(mid, b); math.Abs(d1-d2) > 1e-6 || math.Abs(d1+d2-Angle(a, b)) > 1e-6 {
+			t.Errorf("Slerp middle is %g° from a and %g° from b, %g° apart", d1, d2, Angle(a, b))
+		}
+	}
+}
+
+func TestAverage(t *testing.T) {
+	flip := func(q Quaternion) Quaternion { return Quaternion{I: -q.I, J: -q.J, K: -q.K, Real: -q.Real} }
+	yaw := func(deg float64) Quaternion { return FromEuler(0, 0, deg, Degrees, DefaultOrder) }
+	q := FromEuler(30, -20, 120, Degrees, DefaultOrder)
+
+	tests := []struct {
+		name string
+		qs   []Quaternion
+		want Quaternion
+	}{
+		{"one", []Quaternion{q}, q},
+		{"one flipped", []Quaternion{flip(q)}, q},
+		{"symmetric", []Quaternion{yaw(-10), yaw(10)}, Identity},
+		{"symmetric, one flipped", []Quaternion{yaw(-10), flip(yaw(10))}, Identity},
+		{"three, middle flipped", []Quaternion{yaw(20), flip(yaw(30)), yaw(40)}, yaw(30)},
+		{"all flipped", []Quaternion{flip(yaw(170)), flip(yaw(-170))}, yaw(180)},
+	}
+	for _, tt := range tests {
+		got := Average(tt.qs)
+		if !sameRotation(got, tt.want) {
+			t.Errorf("%s: Average = %+v, want %+v", tt.name, got, tt.want)
+		}
+		if got.Real < 0 {
+			t.Errorf("%s: Average real part %g, want it positive", tt.name, got.Real)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		q      Quaternion
+		want   Quaternion
+		wantOK bool
+	}{
+		{"zero", Quaternion{}, Quaternion{}, false},
+		{"unit", Identity, Identity, true},
+		{"scaled", Quaternion{I: 2, Real: 2}, Quaternion{I: math.Sqrt(0.5), Real: math.Sqrt(0.5)}, true},
+		{"negative", Quaternion{K: -3}, Quaternion{K: -1}, true},
+	}
+	for _, tt := range tests {
+		got, ok := Normalize(tt.q)
+		if ok != tt.wantOK || math.Abs(got.I-tt.want.I) > 1e-12 || math.Abs(got.J-tt.want.J) > 1e-12 ||
+			math.Abs(got.K-tt.want.K) > 1e-12 || math.Abs(got.Real-tt.want.Real) > 1e-12 {
+			t.Errorf("%s: Normalize = %+v, %v, want %+v, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+		// The method gives back a zero quaternion as it is
+		if m := tt.q.Normalize(); tt.wantOK && m != got || !tt.wantOK && m != tt.q {
+			t.Errorf("%s: Quaternion.Normalize = %+v", tt.name, m)
+		}
+	}
+	if e := ToEulerOrder(Quaternion{}, Degrees, DefaultOrder); e != (Euler{}) {
+		t.Errorf("ToEulerOrder of the zero quaternion = %+v, want zero angles", e)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		format, line string
+		want         Quaternion
+	}{
+		{DefaultFormat, "0.1,0.2,0.3,0.9", Quaternion{I: 0.1, J: 0.2, K: 0.3, Real: 0.9}},
+		{"w,x,y,z", " 0.9, 0.1 ,0.2,0.3 ", Quaternion{I: 0.1, J: 0.2, K: 0.3, Real: 0.9}},
+		{"W X Y Z", "0.9\t0.1  0.2 0.3", Quaternion{I: 0.1, J: 0.2, K: 0.3, Real: 0.9}},
+		{"_;x;y;z;w;...", "17;0.1;0.2;0.3;0.9;ok;42", Quaternion{I: 0.1, J: 0.2, K: 0.3, Real: 0.9}},
+		{"real|i|j|k", "1|0|0|0", Identity},
+	}
+	for _, tt := range tests {
+		f, err := ParseFormat(tt.format)
+		if err != nil {
+			t.Errorf("ParseFormat(%q): %v", tt.format, err)
+			continue
+		}
+		got, err := f.Parse(tt.line)
+		if err != nil || got != tt.want {
+			t.Errorf("%q Parse(%q) = %+v, %v, want %+v", tt.format, tt.line, got, err, tt.want)
+		}
+	}
+
+	if q, err := Parse("0,0,0,1"); err != nil || q != Identity {
+		t.Errorf("Parse = %+v, %v, want the identity", q, err)
+	}
+	for _, line := range []string{"", "0,0,0", "0,0,0,1,2", "0,0,x,1", "Booting sensor..."} {
+		if q, err := Parse(line); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", line, q)
+		}
+	}
+	for _, format := range []string{"", "i,j,k", "i,j,k,k", "i,j,k,real,q", "i,j,...,k,real"} {
+		if _, err := ParseFormat(format); err == nil {
+			t.Errorf("ParseFormat(%q) succeeded, want an error", format)
+		}
+	}
+}
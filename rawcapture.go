@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerSource("raw", sourceType{new: newRawSource, once: true})
+}
+
+// rawCaptureVersion is the version of the raw capture format
+const rawCaptureVersion = 1
+
+var (
+	rawCapturePath = flag.String("record-raw", "", "File the bytes read from serial ports are appended to with the time they arrived, to run the parser on again with -source raw (default: not capturing)")
+
+	activeRawCapture *rawCapture
+)
+
+// rawCaptureHeader starts each capture session, i.e. each run of the server
+// appending to the file, with the settings the bytes were parsed with
+type rawCaptureHeader struct {
+	Type     string    `json:"type"` // Always "header", chunks have no type
+	Version  int       `json:"version"`
+	Started  time.Time `json:"started"`
+	Host     string    `json:"host,omitempty"`
+	Baud     int       `json:"baud"`
+	Protocol string    `json:"protocol,omitempty"`
+	Input    string    `json:"input"`
+	Format   string    `json:"format"`
+}
+
+// rawChunk is the bytes of one read from a serial port
+type rawChunk struct {
+	MonoNS int64  `json:"mono_ns"` // Monotonic nanoseconds since the session started
+	Port   string `json:"port"`
+	Data   []byte `json:"data"` // Base64 in the file
+}
+
+// rawCapture appends what serial ports send to a file, buffered and written
+// once a second like a recording, as one sealed record each time when
+// encrypted
+type rawCapture struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	sealed  *sealedWriter // Nil unless the capture is encrypted
+	buf     bytes.Buffer
+	start   time.Time
+	bytes   uint64
+	lastErr error
+	done    chan struct{}
+}
+
+// startRawCapture opens the file given by -record-raw, if any, and writes
+// the header of a new session
+func startRawCapture(cfg Config) error {
+	if *rawCapturePath == "" {
+		return nil
+	}
+	c := &rawCapture{path: *rawCapturePath, start: time.Now(), done: make(chan struct{})}
+	if encryptionKey == nil && isSealedFile(c.path) {
+		return fmt.Errorf("%s is encrypted, set the encryption key to append to it", c.path)
+	}
+	var err error
+	if encryptionKey != nil {
+		c.file, c.sealed, err = openSealedAppend(c.path, encryptionKey)
+	} else {
+		c.file, err = os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	}
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	header, _ := json.Marshal(rawCaptureHeader{
+		Type:     "header",
+		Version:  rawCaptureVersion,
+		Started:  c.start,
+		Host:     host,
+		Baud:     cfg.Baud,
+		Protocol: cfg.Protocol,
+		Input:    cfg.inputKind(),
+		Format:   cfg.inputFormat(),
+	})
+	c.buf.Write(header)
+	c.buf.WriteByte('\n')
+	if err := c.flush(); err != nil {
+		c.file.Close()
+		return err
+	}
+	activeRawCapture = c
+	go c.flushLoop()
+	log.Printf("Capturing the raw bytes of serial ports to %s", c.path)
+	return nil
+}
+
+// add appends the bytes of a read from a port
+func (c *rawCapture) add(port string, data []byte) {
+	line, _ := json.Marshal(rawChunk{MonoNS: int64(time.Since(c.start)), Port: port, Data: data})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return
+	}
+	c.buf.Write(line)
+	c.buf.WriteByte('\n')
+	c.bytes += uint64(len(data))
+	if c.buf.Len() >= recordFlushSize {
+		c.flushLocked()
+	}
+}
+
+// flushLoop writes the buffer every second until the capture stops
+func (c *rawCapture) flushLoop() {
+	ticker := time.NewTicker(recordFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flush()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *rawCapture) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
+
+// flushLocked writes the buffer to the file. Must be called with c.mu held.
+func (c *rawCapture) flushLocked() error {
+	if c.buf.Len() == 0 || c.file == nil {
+		return nil
+	}
+	var err error
+	if c.sealed != nil {
+		err = c.sealed.WriteRecord(c.buf.Bytes())
+	} else {
+		_, err = c.file.Write(c.buf.Bytes())
+	}
+	if err != nil {
+		if c.lastErr == nil {
+			log.Printf("Error writing raw capture %s: %v", c.path, err)
+		}
+		c.lastErr = err
+		return err
+	}
+	c.lastErr = nil
+	c.buf.Reset()
+	return nil
+}
+
+// stopRawCapture writes what is left of the capture and closes it
+func stopRawCapture() {
+	c := activeRawCapture
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return
+	}
+	close(c.done)
+	c.flushLocked()
+	if err := c.file.Sync(); err != nil {
+		log.Printf("Error syncing raw capture %s: %v", c.path, err)
+	}
+	if err := c.file.Close(); err != nil {
+		log.Printf("Error closing raw capture %s: %v", c.path, err)
+	}
+	c.file = nil
+	log.Printf("Captured %d raw bytes to %s", c.bytes, c.path)
+}
+
+// captureRaw returns r, copying what is read from it to the raw capture
+// when there is one
+func captureRaw(r io.Reader, port string) io.Reader {
+	if activeRawCapture == nil {
+		return r
+	}
+	return &rawTee{r: r, port: port, capture: activeRawCapture}
+}
+
+// rawTee copies what is read from a port to a raw capture
+type rawTee struct {
+	r       io.Reader
+	port    string
+	capture *rawCapture
+}
+
+func (t *rawTee) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.capture.add(t.port, p[:n])
+	}
+	return n, err
+}
+
+// rawSource plays back a capture made with -record-raw, feeding the bytes
+// of one port to the parser with the timing they arrived with, so that the
+// parser and the current -format, -input and -protocol can be tried on them
+// again. Each session starts playing straight after the previous one ends.
+type rawSource struct {
+	path    string
+	port    string // Port whose bytes are played, the first in the capture when empty
+	speed   float64
+	format  *lineFormat
+	preview *previewBuffer
+
+	file      *os.File
+	chunks    *bufio.Scanner
+	lines     *lineReader
+	pending   []byte
+	played    bool      // Whether any bytes of the port were found
+	start     time.Time // Wall clock time the current session started playing
+	first     int64     // mono_ns of the first chunk of the current session, -1 before it
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newRawSource(cfg Config) Source {
+	s := &rawSource{path: cfg.File, speed: *replaySpeed, format: cfg.lineFormat(), preview: cfg.previewBuffer()}
+	if !isAutoPort(cfg.Port) {
+		s.port = cfg.Port
+	}
+	return s
+}
+
+func (s *rawSource) String() string { return s.path }
+
+func (s *rawSource) Open() error {
+	if s.path == "" {
+		return errors.New("no raw capture to play, set -file")
+	}
+	if s.speed <= 0 {
+		return fmt.Errorf("invalid speed %v, must be greater than 0", s.speed)
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = bufio.NewReader(f)
+	if isSealedFile(s.path) {
+		if encryptionKey == nil {
+			f.Close()
+			return fmt.Errorf("%s is encrypted, set the encryption key to read it", s.path)
+		}
+		sr, err := newSealedReader(r, encryptionKey)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		r = &recordStream{sr: sr}
+	}
+	s.file = f
+	s.chunks = bufio.NewScanner(r)
+	s.chunks.Buffer(nil, 1<<20)
+	s.lines = newLineReader(s, s.format, s.preview)
+	s.first = -1
+	s.closed = make(chan struct{})
+	return nil
+}
+
+func (s *rawSource) ReadQuaternion() (Quaternion, error) {
+	return s.lines.next()
+}
+
+// Read returns the bytes of the capture, each chunk once it is due
+func (s *rawSource) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if !s.chunks.Scan() {
+			if err := s.chunks.Err(); err != nil {
+				return 0, err
+			}
+			if !s.played {
+				log.Printf("%s holds no bytes of %s", s.path, s.port)
+			}
+			return 0, io.EOF
+		}
+		line := bytes.TrimSpace(s.chunks.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var chunk struct {
+			rawChunk
+			rawCaptureHeader
+		}
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			log.Printf("Error parsing %s: %v", s.path, err)
+			continue
+		}
+		if chunk.Type == "header" {
+			log.Printf("Playing the raw capture of %s started %s, %s at %d baud", s.path, chunk.Started.Format(time.RFC3339), strings.TrimSpace(chunk.Input+" "+chunk.Format), chunk.Baud)
+			s.first = -1
+			continue
+		}
+		if s.port == "" {
+			s.port = chunk.Port
+		}
+		if chunk.Port != s.port {
+			continue
+		}
+		if s.first < 0 {
+			s.first, s.start = chunk.MonoNS, time.Now()
+		}
+		due := s.start.Add(time.Duration(float64(chunk.MonoNS-s.first) / s.speed))
+		select {
+		case <-time.After(time.Until(due)):
+		case <-s.closed:
+			return 0, errors.New("source closed")
+		}
+		s.pending, s.played = chunk.Data, true
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Close stops playback. It may be called from another goroutine to
+// interrupt the wait for the next chunk, and more than once.
+func (s *rawSource) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.file.Close()
+	})
+	return err
+}
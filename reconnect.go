@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var (
+	reconnectAttempts = flag.Int("reconnect-attempts", 0, "Give up on a source after this many failed attempts in a row to open it, until it is restarted through the API (default: 0, retry forever)")
+	reconnectHook     = flag.String("reconnect-hook", "", "Shell command run when a source is given up on after -reconnect-attempts, e.g. to power-cycle a USB hub, with QUATPLOT_SOURCE, QUATPLOT_PORT and QUATPLOT_ERROR set (default: none)")
+)
+
+const (
+	// sourceMinBackoff and sourceMaxBackoff bound the delay between attempts
+	// to open a source, which doubles after each failure
+	sourceMinBackoff = 500 * time.Millisecond
+	sourceMaxBackoff = 30 * time.Second
+	// sourceJitter spreads the delays by up to this fraction either way, so
+	// that sensors unplugged together aren't retried in lockstep
+	sourceJitter = 0.2
+	// sourceStable is how long a source must stay open for its failures to
+	// be forgotten. One that drops sooner is backed off like a failed open.
+	sourceStable = 5 * time.Second
+	// reconnectHookTimeout bounds how long -reconnect-hook may run
+	reconnectHookTimeout = time.Minute
+)
+
+// reconnectDelay returns the wait before the next attempt to open a source
+// that failed the given number of times in a row
+func reconnectDelay(failures int) time.Duration {
+	delay := sourceMaxBackoff
+	if failures < 16 {
+		delay = min(sourceMinBackoff<<max(failures-1, 0), sourceMaxBackoff)
+	}
+	return time.Duration(float64(delay) * (1 + sourceJitter*(2*rand.Float64()-1)))
+}
+
+// backOff waits before the next attempt to open the source, unless it is
+// restarted or switched to another port in the meantime
+func (s *sourceRunner) backOff(failures int) {
+	delay := reconnectDelay(failures)
+	s.mu.Lock()
+	s.failures, s.nextAttempt = failures, time.Now().Add(delay)
+	s.mu.Unlock()
+	select {
+	case <-time.After(delay):
+	case <-s.kick:
+	}
+	s.mu.Lock()
+	s.nextAttempt = time.Time{}
+	s.mu.Unlock()
+}
+
+// giveUp stops retrying a source that failed -reconnect-attempts times in a
+// row, runs -reconnect-hook, and waits until the source is restarted
+func (s *sourceRunner) giveUp(name string, st serialStatus, failures int, err error) {
+	st.State = serialFailed
+	st.Message = fmt.Sprintf("gave up after %d attempts: %v", failures, err)
+	s.setStatus(st)
+	log.Printf("Giving up on %s after %d failed attempts: %v. Restart it through /api/sources to try again", name, failures, err)
+	if *reconnectHook != "" {
+		runReconnectHook(s.id, name, err)
+	}
+	s.mu.Lock()
+	s.failures = failures
+	s.mu.Unlock()
+	<-s.kick
+}
+
+// runReconnectHook runs -reconnect-hook through the shell, logging what it
+// prints
+func runReconnectHook(id, port string, cause error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reconnectHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", *reconnectHook)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", *reconnectHook)
+	}
+	cmd.Env = append(os.Environ(), "QUATPLOT_SOURCE="+id, "QUATPLOT_PORT="+port, "QUATPLOT_ERROR="+cause.Error())
+	out, err := cmd.CombinedOutput()
+	if text := strings.TrimSpace(string(out)); text != "" {
+		log.Printf("Reconnect hook: %s", text)
+	}
+	if err != nil {
+		log.Printf("Error running the reconnect hook: %v", err)
+	}
+}
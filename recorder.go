@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// recordFlushInterval is how often buffered samples are written to the recording
+	recordFlushInterval = time.Second
+	// recordFlushSize is how much may be buffered before it is written early
+	recordFlushSize = 64 << 10
+)
+
+var (
+	recordPath   = flag.String("record", "", "File every sample is appended to, e.g. session.qlog (default: not recording)")
+	recordFormat = flag.String("record-format", "", "Format of the recording, jsonl or csv (default: csv for .csv files, otherwise jsonl)")
+	recordSync   = flag.Duration("record-sync", 5*time.Second, "Sync the recording to disk this often, so that a power loss loses at most this much of it (0 to sync only on shutdown)")
+
+	activeRecorder *recorder
+)
+
+// recorder appends samples to a recording file. Samples are buffered and
+// written once a second, as one sealed record each time when encrypted, and
+// synced to disk every -record-sync.
+type recorder struct {
+	path   string
+	format string
+
+	mu      sync.Mutex
+	file    *os.File
+	sealed  *sealedWriter // Nil unless the recording is encrypted
+	buf     bytes.Buffer
+	start   time.Time
+	samples uint64
+	written int64
+	lastErr error
+	flushed uint64    // Samples written to the file
+	synced  uint64    // Samples known to be on disk
+	syncAt  time.Time // When the file was last synced
+	done    chan struct{}
+	acc     *sessionAccumulator // Summary of the session so far
+	disk    *diskStats          // Last check of the recording's volume
+	stopped string              // Why recording stopped early, empty while recording
+}
+
+// recordingStats describes the recording in /api/stats
+type recordingStats struct {
+	Path      string     `json:"path"`
+	Format    string     `json:"format"`
+	Encrypted bool       `json:"encrypted"`
+	Started   time.Time  `json:"started"`
+	Samples   uint64     `json:"samples"`
+	Bytes     int64      `json:"bytes"`
+	Synced    uint64     `json:"synced_samples"`      // Samples that survive a power loss
+	LastSync  *time.Time `json:"last_sync,omitempty"` // When they were synced to disk
+	Disk      *diskStats `json:"disk,omitempty"`
+	Stopped   string     `json:"stopped,omitempty"` // Why recording stopped before shutdown
+	Error     string     `json:"error,omitempty"`
+}
+
+// startRecording opens the recording file given by -record, if any, and
+// writes the header of a new session
+func startRecording(cfg Config) error {
+	if *recordPath == "" {
+		return nil
+	}
+	format, err := recordingFormat(*recordPath, *recordFormat)
+	if err != nil {
+		return err
+	}
+
+	r := &recorder{path: *recordPath, format: format, start: time.Now(), done: make(chan struct{}), acc: newSessionAccumulator()}
+	if err := checkDiskPolicy(*diskFull); err != nil {
+		return err
+	}
+	if encryptionKey == nil && isSealedFile(r.path) {
+		return fmt.Errorf("%s is encrypted, set the encryption key to append to it", r.path)
+	}
+	if err := logRecovery(r.path); err != nil {
+		return err
+	}
+	_, statErr := os.Stat(r.path)
+	if encryptionKey != nil {
+		r.file, r.sealed, err = openSealedAppend(r.path, encryptionKey)
+	} else {
+		r.file, err = os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	}
+	if err != nil {
+		return err
+	}
+	if os.IsNotExist(statErr) {
+		// A new file is only there after a power loss once its directory is synced
+		syncDir(filepath.Dir(r.path))
+	}
+
+	host, _ := os.Hostname()
+	writeRecordingHeader(&r.buf, r.format, recordingHeader{
+		Type:       "header",
+		Version:    recordingVersion,
+		Started:    r.start,
+		Host:       host,
+		Source:     cfg.Source,
+		Device:     sourceName(sourceTypes[cfg.Source].new(cfg)),
+		Convention: describeConvention(cfg),
+		ClockRef:   strings.TrimRight(*clockRef, "/"),
+		Pipeline:   cfg.pipelineInfo(),
+	})
+	if err := r.flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	r.sync()
+
+	activeRecorder = r
+	go r.flushLoop()
+	if *diskMinFree > 0 {
+		go r.watchDisk()
+	}
+	log.Printf("Recording samples to %s (%s%s)", r.path, format, map[bool]string{true: ", encrypted"}[r.sealed != nil])
+	return nil
+}
+
+// recordSample appends a sample to the recording, if there is one
+func recordSample(s historySample) {
+	if activeRecorder != nil {
+		activeRecorder.add(s)
+	}
+}
+
+func (r *recorder) add(s historySample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return
+	}
+	writeRecordedSample(&r.buf, r.format, recordedSample{
+		MonoNS:      s.Time.Sub(r.start).Nanoseconds(),
+		Time:        s.Time,
+		Seq:         s.Seq,
+		ID:          s.ID,
+		RefTime:     s.RefTime,
+		sampleMarks: s.sampleMarks,
+		Quaternion:  s.Quaternion,
+	})
+	r.samples++
+	r.acc.add(s)
+	if r.buf.Len() >= recordFlushSize {
+		r.flushLocked()
+	}
+}
+
+// recordEvent adds an event sent to clients to the summary of the session,
+// if recording
+func recordEvent(eventType string, t time.Time, payload any) {
+	if r := activeRecorder; r != nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.file != nil {
+			r.acc.addEvent(eventType, t, payload)
+		}
+	}
+}
+
+// summary returns the summary of the session so far
+func (r *recorder) summary() sessionSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.acc.summary(r.path, r.start, nil)
+}
+
+// flushLoop writes buffered samples once a second, and syncs them every
+// -record-sync, until the recording stops
+func (r *recorder) flushLoop() {
+	ticker := time.NewTicker(recordFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			r.flush()
+			r.mu.Lock()
+			due := *recordSync > 0 && now.Sub(r.syncAt) >= *recordSync && r.synced < r.flushed
+			r.mu.Unlock()
+			if due {
+				r.sync()
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// sync makes what was written to the recording survive a power loss. The
+// lock isn't held while syncing, which can take a while on an SD card.
+func (r *recorder) sync() {
+	r.mu.Lock()
+	f, flushed := r.file, r.flushed
+	r.mu.Unlock()
+	if f == nil {
+		return
+	}
+	if err := f.Sync(); err != nil {
+		r.mu.Lock()
+		if r.lastErr == nil && r.file != nil {
+			log.Printf("Error syncing recording %s: %v", r.path, err)
+			r.lastErr = err
+		}
+		r.mu.Unlock()
+		return
+	}
+	r.mu.Lock()
+	r.synced, r.syncAt = flushed, time.Now()
+	r.mu.Unlock()
+}
+
+// syncDir syncs a directory, so that files created in it survive a power
+// loss. Not every platform can, so errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+func (r *recorder) flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.flushLocked()
+}
+
+// flushLocked writes the buffer to the file. Must be called with r.mu held.
+func (r *recorder) flushLocked() error {
+	if r.buf.Len() == 0 || r.file == nil {
+		return nil
+	}
+	var err error
+	if r.sealed != nil {
+		err = r.sealed.WriteRecord(r.buf.Bytes())
+	} else {
+		_, err = r.file.Write(r.buf.Bytes())
+	}
+	if err != nil {
+		if r.lastErr == nil {
+			log.Printf("Error writing recording %s: %v", r.path, err)
+		}
+		r.lastErr = err
+		return err
+	}
+	r.written += int64(r.buf.Len())
+	r.flushed = r.samples
+	r.lastErr = nil
+	r.buf.Reset()
+	return nil
+}
+
+// stopRecording writes what is left of the recording and closes it, and
+// stores the summary of the session next to it
+func stopRecording() {
+	if r := activeRecorder; r != nil {
+		r.stop("")
+	}
+}
+
+// stop ends the recording, giving the reason when it stops before the
+// server does. Stopping again does nothing.
+func (r *recorder) stop(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return
+	}
+	close(r.done)
+	r.flushLocked()
+	if err := r.file.Sync(); err != nil {
+		log.Printf("Error syncing recording %s: %v", r.path, err)
+	}
+	if err := r.file.Close(); err != nil {
+		log.Printf("Error closing recording %s: %v", r.path, err)
+	}
+	r.file = nil
+	r.stopped = reason
+	if reason != "" {
+		log.Printf("Stopped recording to %s: %s", r.path, reason)
+	}
+	log.Printf("Recorded %d samples to %s", r.samples, r.path)
+
+	ended := time.Now()
+	base := summaryBase(r.path, r.start)
+	if err := writeSummary(r.path, r.acc.summary(r.path, r.start, &ended)); err != nil {
+		log.Printf("Error writing summary of %s: %v", r.path, err)
+		archiveRecording(r.path)
+	} else {
+		log.Printf("Wrote session summary to %s.json and .html", base)
+		archiveRecording(r.path, base+".json", base+".html")
+	}
+}
+
+func (r *recorder) stats() *recordingStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := &recordingStats{
+		Path:      r.path,
+		Format:    r.format,
+		Encrypted: r.sealed != nil,
+		Started:   r.start,
+		Samples:   r.samples,
+		Bytes:     r.written,
+		Synced:    r.synced,
+		Disk:      r.disk,
+		Stopped:   r.stopped,
+	}
+	if !r.syncAt.IsZero() {
+		st.LastSync = &r.syncAt
+	}
+	if r.lastErr != nil {
+		st.Error = r.lastErr.Error()
+	}
+	return st
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordingVersion is the version of the recording format
+const recordingVersion = 5
+
+// Recording formats
+const (
+	formatJSONL = "jsonl"
+	formatCSV   = "csv"
+)
+
+const (
+	// csvColumns names the columns of a CSV recording
+	csvColumns = "mono_ns,time,seq,i,j,k,real,id,ref_time,settling,outlier"
+	// csvColumnsV1 names the columns of a version 1 CSV recording, which has no device IDs
+	csvColumnsV1 = "mono_ns,time,seq,i,j,k,real"
+	// csvColumnsV2 names the columns of a version 2 CSV recording, which has no reference times
+	csvColumnsV2 = "mono_ns,time,seq,i,j,k,real,id"
+	// csvColumnsV3 names the columns of a version 3 CSV recording, which doesn't mark settling samples
+	csvColumnsV3 = "mono_ns,time,seq,i,j,k,real,id,ref_time"
+	// csvColumnsV4 names the columns of a version 4 CSV recording, which doesn't mark outliers
+	csvColumnsV4 = "mono_ns,time,seq,i,j,k,real,id,ref_time,settling"
+)
+
+// recordingHeader starts each recording session, i.e. each run of the server
+// appending to the file. In CSV recordings it is written as comment lines.
+type recordingHeader struct {
+	Type       string         `json:"type"` // Always "header", samples have no type
+	Version    int            `json:"version"`
+	Started    time.Time      `json:"started"`
+	Host       string         `json:"host,omitempty"`
+	Source     string         `json:"source"`
+	Device     string         `json:"device,omitempty"`
+	Convention conventionInfo `json:"convention"`
+	ClockRef   string         `json:"clock_ref,omitempty"` // Server whose clock ref_time is on
+	Pipeline   *pipelineInfo  `json:"pipeline,omitempty"`  // Corrections applied to the samples
+}
+
+// recordedSample is one sample in a recording
+type recordedSample struct {
+	MonoNS int64     `json:"mono_ns"` // Monotonic nanoseconds since the session started
+	Time   time.Time `json:"time"`
+	Seq    uint64    `json:"seq"`
+	ID     string    `json:"id,omitempty"` // Device the sample came from, empty when untagged
+	// RefTime is the time on the clock of the header's ClockRef, when aligned to one
+	RefTime *time.Time `json:"ref_time,omitempty"`
+	sampleMarks
+	Quaternion
+}
+
+// recordingFormat returns the format to record path in
+func recordingFormat(path, format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "":
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			return formatCSV, nil
+		}
+		return formatJSONL, nil
+	case formatJSONL, "json":
+		return formatJSONL, nil
+	case formatCSV:
+		return formatCSV, nil
+	}
+	return "", fmt.Errorf("unknown recording format %q, must be jsonl or csv", format)
+}
+
+// writeRecordingHeader appends the header of a session to buf
+func writeRecordingHeader(buf *bytes.Buffer, format string, h recordingHeader) {
+	if format == formatJSONL {
+		data, _ := json.Marshal(h)
+		buf.Write(append(data, '\n'))
+		return
+	}
+	fmt.Fprintf(buf, "# quatplot recording v%d\n", h.Version)
+	fmt.Fprintf(buf, "# started: %s\n", h.Started.Format(time.RFC3339Nano))
+	if h.Host != "" {
+		fmt.Fprintf(buf, "# host: %s\n", h.Host)
+	}
+	fmt.Fprintf(buf, "# source: %s\n", h.Source)
+	if h.Device != "" {
+		fmt.Fprintf(buf, "# device: %s\n", h.Device)
+	}
+	fmt.Fprintf(buf, "# convention: %s, frame %s\n", h.Convention.Convention, h.Convention.Frame)
+	if h.Convention.SourceConvention != "" {
+		fmt.Fprintf(buf, "# sensor: %s, order %s\n", h.Convention.SourceConvention, h.Convention.SourceOrder)
+	}
+	if h.ClockRef != "" {
+		fmt.Fprintf(buf, "# clock: %s\n", h.ClockRef)
+	}
+	if h.Pipeline != nil {
+		fmt.Fprintf(buf, "# pipeline: %s\n", h.Pipeline)
+	}
+	buf.WriteString(csvColumns + "\n")
+}
+
+// writeRecordedSample appends a sample to buf
+func writeRecordedSample(buf *bytes.Buffer, format string, s recordedSample) {
+	if format == formatJSONL {
+		data, _ := json.Marshal(s)
+		buf.Write(append(data, '\n'))
+		return
+	}
+	b := buf.AvailableBuffer()
+	b = strconv.AppendInt(b, s.MonoNS, 10)
+	b = append(b, ',')
+	b = s.Time.AppendFormat(b, time.RFC3339Nano)
+	b = append(b, ',')
+	b = strconv.AppendUint(b, s.Seq, 10)
+	for _, v := range []float64{s.I, s.J, s.K, s.Real} {
+		b = append(b, ',')
+		b = strconv.AppendFloat(b, v, 'g', -1, 64)
+	}
+	b = append(b, ',')
+	b = append(b, s.ID...)
+	b = append(b, ',')
+	if s.RefTime != nil {
+		b = s.RefTime.AppendFormat(b, time.RFC3339Nano)
+	}
+	b = append(b, ',')
+	if s.Settling {
+		b = append(b, '1')
+	}
+	b = append(b, ',')
+	if s.Outlier {
+		b = append(b, '1')
+	}
+	buf.Write(append(b, '\n'))
+}
+
+// badLineError reports a line of a recording that doesn't parse
+type badLineError struct {
+	line string
+	err  error
+}
+
+func (e *badLineError) Error() string {
+	return fmt.Sprintf("%v (line: %s)", e.err, e.line)
+}
+
+// recordingReader reads the sessions and samples of a recording in either
+// format, decrypting it if needed
+type recordingReader struct {
+	path   string
+	file   *os.File
+	lines  *bufio.Scanner
+	header *recordingHeader // CSV header being read from comment lines
+}
+
+// openRecording opens a recording for reading. Encrypted recordings need
+// the encryption key.
+func openRecording(path string) (*recordingReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = bufio.NewReader(f)
+	if isSealedFile(path) {
+		if encryptionKey == nil {
+			f.Close()
+			return nil, fmt.Errorf("%s is encrypted, set the encryption key to read it", path)
+		}
+		sr, err := newSealedReader(r, encryptionKey)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		r = &recordStream{sr: sr}
+	}
+	return &recordingReader{path: path, file: f, lines: bufio.NewScanner(r)}, nil
+}
+
+// next returns the next session header or sample, whichever comes first in
+// the recording, or io.EOF at the end. Lines that don't parse are returned
+// as a *badLineError and may be skipped by calling next again.
+func (r *recordingReader) next() (*recordingHeader, recordedSample, error) {
+	for r.lines.Scan() {
+		line := strings.TrimSpace(r.lines.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "{"):
+			var rec struct {
+				recordingHeader
+				recordedSample
+			}
+			rec.MonoNS = -1
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				return nil, recordedSample{}, &badLineError{line, err}
+			}
+			if rec.Type != "" {
+				return &rec.recordingHeader, recordedSample{}, nil
+			}
+			if rec.MonoNS < 0 {
+				return nil, recordedSample{}, &badLineError{line, errors.New("sample without mono_ns")}
+			}
+			return nil, rec.recordedSample, nil
+		case strings.HasPrefix(line, "#"):
+			r.parseComment(line)
+			continue
+		case line == csvColumns || line == csvColumnsV4 || line == csvColumnsV3 || line == csvColumnsV2 || line == csvColumnsV1:
+			if h := r.header; h != nil {
+				r.header = nil
+				return h, recordedSample{}, nil
+			}
+			continue
+		}
+
+		s, err := parseCSVSample(line)
+		if err != nil {
+			return nil, recordedSample{}, &badLineError{line, err}
+		}
+		return nil, s, nil
+	}
+	if err := r.lines.Err(); err != nil {
+		return nil, recordedSample{}, err
+	}
+	return nil, recordedSample{}, io.EOF
+}
+
+// parseComment reads a line of a CSV session header
+func (r *recordingReader) parseComment(line string) {
+	if v, ok := strings.CutPrefix(line, "# quatplot recording v"); ok {
+		r.header = &recordingHeader{Type: "header", Convention: describeConvention(Config{})}
+		r.header.Version, _ = strconv.Atoi(v)
+		return
+	}
+	if r.header == nil {
+		return
+	}
+	key, value, _ := strings.Cut(strings.TrimPrefix(line, "# "), ": ")
+	switch key {
+	case "started":
+		r.header.Started, _ = time.Parse(time.RFC3339Nano, value)
+	case "host":
+		r.header.Host = value
+	case "source":
+		r.header.Source = value
+	case "device":
+		r.header.Device = value
+	case "convention":
+		_, r.header.Convention.Frame, _ = strings.Cut(value, ", frame ")
+	case "clock":
+		r.header.ClockRef = value
+	case "pipeline":
+		r.header.Pipeline = parsePipelineInfo(value)
+	case "sensor":
+		cfg := Config{Frame: r.header.Convention.Frame}
+		cfg.Convention, cfg.Order, _ = strings.Cut(value, ", order ")
+		r.header.Convention = describeConvention(cfg)
+	}
+}
+
+// parseCSVSample parses a line of samples in a CSV recording
+func parseCSVSample(line string) (recordedSample, error) {
+	fields := strings.Split(line, ",")
+	if len(fields) < 7 || len(fields) > 11 {
+		return recordedSample{}, errors.New("not a quatplot recording")
+	}
+	var s recordedSample
+	marks := []struct {
+		name string
+		set  *bool
+	}{{"settling", &s.Settling}, {"outlier", &s.Outlier}}
+	for n, mark := range marks {
+		if len(fields) <= 9+n {
+			break
+		}
+		switch fields[9+n] {
+		case "1":
+			*mark.set = true
+		case "":
+		default:
+			return s, fmt.Errorf("invalid %s %q", mark.name, fields[9+n])
+		}
+	}
+	if len(fields) >= 9 && fields[8] != "" {
+		t, err := time.Parse(time.RFC3339Nano, fields[8])
+		if err != nil {
+			return s, fmt.Errorf("invalid ref_time %q", fields[8])
+		}
+		s.RefTime = &t
+	}
+	if len(fields) >= 8 {
+		s.ID = fields[7]
+	}
+	fields = fields[:7]
+	var err error
+	if s.MonoNS, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return s, fmt.Errorf("invalid mono_ns %q", fields[0])
+	}
+	if s.Time, err = time.Parse(time.RFC3339Nano, fields[1]); err != nil {
+		return s, fmt.Errorf("invalid time %q", fields[1])
+	}
+	if s.Seq, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+		return s, fmt.Errorf("invalid seq %q", fields[2])
+	}
+	var v [4]float64
+	for n, f := range fields[3:] {
+		if v[n], err = strconv.ParseFloat(f, 64); err != nil {
+			return s, fmt.Errorf("invalid value %q", f)
+		}
+	}
+	s.Quaternion = Quaternion{I: v[0], J: v[1], K: v[2], Real: v[3]}
+	return s, nil
+}
+
+// Close closes the recording file
+func (r *recordingReader) Close() error {
+	return r.file.Close()
+}
+
+// isRecording reports whether the file at path is a quatplot recording: an
+// encrypted one, or one starting with the header of a session. Other files,
+// such as CSVs of another program next to a recording, aren't.
+func isRecording(path string) bool {
+	if isSealedFile(path) {
+		return true
+	}
+	r, err := openRecording(path)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	h, _, err := r.next()
+	return err == nil && h != nil && h.Type == "header"
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsRecording(t *testing.T) {
+	dir := t.TempDir()
+	header := recordingHeader{Type: "header", Version: 1, Started: time.Now(), Source: "simulate"}
+	sample := recordedSample{MonoNS: 1, Time: time.Now(), Seq: 1}
+	recording := func(format string) string {
+		var buf bytes.Buffer
+		writeRecordingHeader(&buf, format, header)
+		writeRecordedSample(&buf, format, sample)
+		return buf.String()
+	}
+	tests := []struct {
+		name, data string
+		want       bool
+	}{
+		{"run.csv", recording(formatCSV), true},
+		{"run.jsonl", recording(formatJSONL), true},
+		{"sealed.jsonl", string(sealedMagic) + "anything", true},
+		{"sheet.csv", "a,b,c\n1,2,3\n", false},
+		{"log.jsonl", `{"type":"event","msg":"hi"}` + "\n", false},
+		{"samples.csv", csvColumns + "\n1,2026-01-01T00:00:00Z,1,0,0,0,1,,,,\n", false},
+		{"empty.csv", "", false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if got := isRecording(path); got != tt.want {
+			t.Errorf("isRecording(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// recoveryReport tells what recoverRecording did to a recording
+type recoveryReport struct {
+	Dropped int64  // Bytes of an incomplete write cut off the end
+	Samples uint64 // Samples in the last session
+	Summary string // Summary written for the last session, empty when it had one
+}
+
+// recovered reports whether anything had to be done
+func (r recoveryReport) recovered() bool {
+	return r.Dropped > 0 || r.Summary != ""
+}
+
+// String describes the report for logs
+func (r recoveryReport) String() string {
+	s := fmt.Sprintf("kept %d samples of the last session", r.Samples)
+	if r.Dropped > 0 {
+		s += fmt.Sprintf(", dropped %d bytes of an incomplete write", r.Dropped)
+	}
+	if r.Summary != "" {
+		s += ", wrote its summary to " + r.Summary + ".json"
+	}
+	return s
+}
+
+// recoverRecording salvages a recording left behind by a crash or a power
+// loss. Whatever follows the last complete line, or the last intact record
+// of an encrypted recording, is cut off, and the summary of the last
+// session is written from its samples if the server couldn't. A recording
+// that doesn't exist yet is left alone.
+func recoverRecording(path string) (recoveryReport, error) {
+	var report recoveryReport
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) || err == nil && info.Size() == 0 {
+		return report, nil
+	}
+	if err != nil {
+		return report, err
+	}
+
+	var end int64
+	if isSealedFile(path) {
+		if encryptionKey == nil {
+			return report, fmt.Errorf("%s is encrypted, set the encryption key to recover it", path)
+		}
+		end, err = sealedEnd(path, encryptionKey)
+	} else {
+		end, err = linesEnd(path)
+	}
+	if err != nil {
+		return report, err
+	}
+	if end < info.Size() {
+		if err := os.Truncate(path, end); err != nil {
+			return report, err
+		}
+		report.Dropped = info.Size() - end
+	}
+
+	report.Samples, report.Summary, err = recoverSummary(path)
+	return report, err
+}
+
+// linesEnd returns the length of a plain recording up to its last complete
+// line. Filesystems may leave zeros where a write was lost, so a zero byte
+// ends the recording too.
+func linesEnd(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var offset, end int64
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := f.Read(buf)
+		chunk := buf[:n]
+		zero := bytes.IndexByte(chunk, 0)
+		if zero >= 0 {
+			chunk = chunk[:zero]
+		}
+		if nl := bytes.LastIndexByte(chunk, '\n'); nl >= 0 {
+			end = offset + int64(nl) + 1
+		}
+		offset += int64(n)
+		if zero >= 0 || err == io.EOF {
+			return end, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sealedEnd returns the length of an encrypted recording up to the end of
+// its last intact record
+func sealedEnd(path string, key []byte) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// The sealed reader doesn't read ahead, so the count is where the
+	// last record it returned ends
+	counter := &countingReader{r: bufio.NewReader(f)}
+	sr, err := newSealedReader(counter, key)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+	end := counter.n
+	for {
+		if _, err := sr.ReadRecord(); err != nil {
+			if sr.index == 0 && err != io.EOF && !errors.Is(err, errTruncated) {
+				// Not a single record opens, most likely the wrong key
+				return 0, fmt.Errorf("%s: %v", path, err)
+			}
+			return end, nil
+		}
+		end = counter.n
+	}
+}
+
+// recoverSummary writes the summary of the last session of a recording
+// when there is none, ending it at its last sample. It returns the number
+// of samples of the session and the base path of the summary written.
+func recoverSummary(path string) (uint64, string, error) {
+	r, err := openRecording(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer r.Close()
+
+	var (
+		header *recordingHeader
+		acc    *sessionAccumulator
+		last   time.Time
+		n      uint64
+	)
+	for {
+		h, s, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		var bad *badLineError
+		if errors.As(err, &bad) {
+			continue
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		if h != nil {
+			header, acc, last, n = h, newSessionAccumulator(), h.Started, 0
+			continue
+		}
+		if acc != nil {
+			acc.add(historySample{ID: s.ID, Seq: s.Seq, Time: s.Time, RefTime: s.RefTime, Quaternion: s.Quaternion})
+			last, n = s.Time, n+1
+		}
+	}
+	if header == nil {
+		return 0, "", nil
+	}
+	base := summaryBase(path, header.Started)
+	if _, err := os.Stat(base + ".json"); err == nil {
+		return n, "", nil
+	}
+	if err := writeSummary(path, acc.summary(path, header.Started, &last)); err != nil {
+		return n, "", err
+	}
+	return n, base, nil
+}
+
+// runRecover salvages the recordings given as arguments and returns the
+// process exit code
+func runRecover() int {
+	if flag.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: quatplot recover [flags] RECORDING...")
+		return 2
+	}
+	if _, err := initConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 1
+	}
+	code := 0
+	for _, path := range flag.Args() {
+		report, err := recoverRecording(path)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			code = 1
+		case report.recovered():
+			fmt.Printf("%s: %s\n", path, report)
+		default:
+			fmt.Printf("%s: intact, %d samples in the last session\n", path, report.Samples)
+		}
+	}
+	return code
+}
+
+// logRecovery recovers the recording about to be appended to, logging
+// what had to be done
+func logRecovery(path string) error {
+	report, err := recoverRecording(path)
+	if err != nil {
+		return fmt.Errorf("recovering %s: %v", path, err)
+	}
+	if report.recovered() {
+		log.Printf("Recovered %s after an unclean shutdown: %s", path, report)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var reprocessDir = flag.String("output-dir", "", "Directory reprocessed and imported recordings are written to (default: next to each input, as NAME.reprocessed.EXT or NAME.imported.EXT)")
+
+// reprocessPlan is the pipeline configuration recordings are reprocessed with
+type reprocessPlan struct {
+	pipeline   *pipelineInfo
+	frame      string // Reference frame to convert to, "unspecified" to keep the recorded one
+	convention string // Convention the sensor really used, empty to keep the recorded one
+}
+
+// runReprocess runs recordings through a new pipeline configuration, e.g.
+// an improved mounting offset, smoothing or another reference frame, and
+// writes the corrected recordings. It returns the process exit code.
+func runReprocess() int {
+	if flag.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: quatplot reprocess [flags] RECORDING...")
+		return 2
+	}
+	if _, err := initConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+		return 1
+	}
+	cfg := currentConfig()
+	plan := reprocessPlan{pipeline: cfg.pipelineInfo(), frame: cfg.Frame}
+	flag.Visit(func(f *flag.Flag) {
+		// The convention always has a value, so only correct it when asked to
+		if f.Name == "convention" {
+			plan.convention = cfg.Convention
+		}
+	})
+
+	status := 0
+	for _, in := range flag.Args() {
+		out := reprocessedPath(in, *reprocessDir)
+		if sameFile(in, out) {
+			fmt.Fprintf(os.Stderr, "%s: the output must be a different file from the recording\n", in)
+			status = 1
+			continue
+		}
+		samples, skipped, err := reprocessRecording(in, out, plan)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", in, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Reprocessed %d samples of %s into %s", samples, in, out)
+		if skipped > 0 {
+			fmt.Fprintf(os.Stderr, ", skipped %d lines that didn't parse", skipped)
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+	return status
+}
+
+// reprocessedPath returns where the reprocessed copy of a recording goes
+func reprocessedPath(in, dir string) string {
+	ext := filepath.Ext(in)
+	name := strings.TrimSuffix(filepath.Base(in), ext) + ".reprocessed" + ext
+	if dir == "" {
+		dir = filepath.Dir(in)
+	}
+	return filepath.Join(dir, name)
+}
+
+// reprocessRecording writes a copy of the recording at in to out with the
+// pipeline of each session replaced by the plan's. Rotations the recorded
+// pipeline applied are reversed first, its smoothing can't be.
+func reprocessRecording(in, out string, plan reprocessPlan) (samples, skipped int, err error) {
+	format, err := recordingFormat(out, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	recording, err := openRecording(in)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer recording.Close()
+
+	f, err := os.Create(out)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var (
+		buf        bytes.Buffer
+		old, pipe  *pipeline
+		frame      Quaternion
+		convert    bool
+		conjugated bool
+		warned     bool
+	)
+	for {
+		header, sample, err := recording.next()
+		var bad *badLineError
+		if errors.As(err, &bad) {
+			skipped++
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return samples, skipped, err
+		}
+
+		if header != nil {
+			if header.Pipeline != nil && header.Pipeline.Smoothing > 0 && !warned {
+				fmt.Fprintf(os.Stderr, "%s: warning: the recording was smoothed, which can't be undone\n", in)
+				warned = true
+			}
+			old, pipe = newPipeline(header.Pipeline), newPipeline(plan.pipeline)
+
+			// Quaternion input was converted with the recorded convention
+			conjugated = plan.convention != "" && header.Convention.SourceInput == inputQuaternion &&
+				header.Convention.SourceConvention != plan.convention
+			if conjugated {
+				header.Convention.SourceConvention = plan.convention
+			}
+			frame, convert = frameRotation(header.Convention.Frame, plan.frame)
+			if plan.frame != "unspecified" {
+				header.Convention.Frame = plan.frame
+			}
+
+			header.Version = recordingVersion
+			header.Pipeline = plan.pipeline
+			writeRecordingHeader(&buf, format, *header)
+		} else {
+			q := old.undo(sample.Quaternion)
+			if conjugated {
+				q = quat.Conjugate(q)
+			}
+			if convert {
+				q = quat.Multiply(frame, q)
+			}
+			sample.Quaternion = pipe.apply(sample.ID, q, time.Unix(0, sample.MonoNS))
+			writeRecordedSample(&buf, format, sample)
+			samples++
+		}
+		if buf.Len() >= recordFlushSize {
+			if _, err := buf.WriteTo(f); err != nil {
+				return samples, skipped, err
+			}
+		}
+	}
+	if _, err := buf.WriteTo(f); err != nil {
+		return samples, skipped, err
+	}
+	return samples, skipped, f.Close()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/intermernet/quatplot/hub"
+)
+
+var (
+	restartHint     = flag.Duration("restart-hint", 5*time.Second, "Expected downtime announced to clients when the server shuts down")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "How long to wait for HTTP requests in progress to finish when shutting down")
+)
+
+// httpServer is the server started by main, shut down on SIGINT or SIGTERM
+var httpServer *http.Server
+
+// restartInfo is sent to clients before the server or a source restarts
+type restartInfo struct {
+	Reason         string `json:"reason"`
+	ExpectedDownMS int64  `json:"expected_downtime_ms"`
+	Epoch          string `json:"epoch"`
+	LastSeq        uint64 `json:"last_seq"`
+}
+
+// announceRestart tells the namespace's clients that data will stop for
+// about downtime, and gives their writers up to a second to deliver the message
+func (ns *namespace) announceRestart(reason string, downtime time.Duration) {
+	ns.broadcastEvent("restarting", ns.restartInfo(reason, downtime))
+	flushClients([]*namespace{ns}, time.Second)
+}
+
+// announceShutdown tells the clients of every namespace that the server is going down
+func announceShutdown(downtime time.Duration) {
+	all := namespaces()
+	for _, ns := range all {
+		ns.broadcastEvent("restarting", ns.restartInfo("shutdown", downtime))
+	}
+	flushClients(all, time.Second)
+}
+
+func (ns *namespace) restartInfo(reason string, downtime time.Duration) restartInfo {
+	return restartInfo{
+		Reason:         reason,
+		ExpectedDownMS: downtime.Milliseconds(),
+		Epoch:          serverEpoch,
+		LastSeq:        ns.seq.Load(),
+	}
+}
+
+// flushClients waits until every client of the namespaces has sent its
+// pending events, or the timeout expires
+func flushClients(list []*namespace, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		pending := 0
+		for _, ns := range list {
+			ns.clientsMu.Lock()
+			for _, c := range ns.clients {
+				events, _ := c.out.Pending()
+				pending += events
+			}
+			ns.clientsMu.Unlock()
+		}
+		if pending == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// closeClients sends a close frame to the WebSocket clients of every
+// namespace, and waits up to timeout for them to disconnect
+func closeClients(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	all := namespaces()
+	for _, ns := range all {
+		ns.clientsMu.Lock()
+		for conn := range ns.clients {
+			hub.GoingAway(conn, deadline)
+		}
+		ns.clientsMu.Unlock()
+	}
+	for time.Now().Before(deadline) {
+		connected := 0
+		for _, ns := range all {
+			ns.clientsMu.Lock()
+			connected += len(ns.clients)
+			ns.clientsMu.Unlock()
+		}
+		if connected == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Clients that didn't answer the close frame are dropped
+	for _, ns := range all {
+		ns.clientsMu.Lock()
+		for conn := range ns.clients {
+			conn.Close()
+		}
+		ns.clientsMu.Unlock()
+	}
+}
+
+// handleShutdownSignals shuts the server down cleanly when the process is
+// interrupted or terminated: it announces the restart to clients, closes the
+// sources so serial ports are released, closes the WebSocket connections,
+// lets HTTP requests in progress finish, saves unwritten sink samples and the
+// recording, then exits. A second signal exits straight away.
+func handleShutdownSignals() {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	s := <-sig
+	log.Printf("Received %v, shutting down", s)
+	go func() {
+		s := <-sig
+		log.Printf("Received %v again, exiting without saving", s)
+		os.Exit(1)
+	}()
+
+	announceShutdown(*restartHint)
+	leaveFleet()
+	stopSources()
+	closeClients(time.Second)
+	stopLiveStreams()
+	if httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down the web server: %v", err)
+		}
+		cancel()
+	}
+	spillSinks()
+	saveGyroBiasModels()
+	saveHistories()
+	stopRecording()
+	stopRawCapture()
+	waitUploads(*shutdownTimeout)
+	stopGops()
+	log.Printf("Shut down")
+	os.Exit(0)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	retainAge         = flag.Duration("retain-age", 0, "Delete recordings next to -record older than this, with their summaries, e.g. 720h (default: 0, kept forever)")
+	retainSize        = flag.Int("retain-size", 0, "Largest total size in MB of the recordings next to -record, the oldest are deleted beyond it (default: 0, no limit)")
+	storageRetainAge  = flag.Duration("storage-retain-age", 0, "Delete recordings archived to -storage older than this, with their summaries (default: 0, kept forever)")
+	storageRetainSize = flag.Int("storage-retain-size", 0, "Largest total size in MB of the recordings archived to -storage, the oldest are deleted beyond it (default: 0, no limit)")
+)
+
+// retentionInterval is how often the retention policies are applied, they
+// are also applied when the server starts
+const retentionInterval = time.Hour
+
+// summarySuffix matches the end of the name of a session summary file, what
+// comes before it is the name of the recording
+var summarySuffix = regexp.MustCompile(`\.\d{8}T\d{6}Z\.summary\.(json|html)$`)
+
+// retentionStats describes the retention policies in /api/stats
+type retentionStats struct {
+	LastRun *time.Time     `json:"last_run,omitempty"`
+	Local   *retentionArea `json:"local,omitempty"`   // Recordings next to -record
+	Storage *retentionArea `json:"storage,omitempty"` // Recordings archived to -storage
+}
+
+// retentionArea is where a retention policy applies, and what it did there
+type retentionArea struct {
+	Where       string   `json:"where"`
+	MaxAge      string   `json:"max_age,omitempty"`
+	MaxBytes    int64    `json:"max_bytes,omitempty"`
+	Recordings  int      `json:"recordings"` // Kept after the last run
+	Bytes       int64    `json:"bytes"`      // Taken by them and their summaries
+	Deleted     uint64   `json:"deleted"`    // Recordings deleted since the server started
+	FreedBytes  int64    `json:"freed_bytes"`
+	LastDeleted []string `json:"last_deleted,omitempty"` // By the last run that deleted any
+	Error       string   `json:"error,omitempty"`
+}
+
+// retentionSet is a recording and its summary files
+type retentionSet struct {
+	name     string
+	files    []string
+	modified time.Time
+	size     int64
+	keep     bool // Being recorded or waiting to be uploaded
+}
+
+var (
+	retentionMu sync.Mutex
+	retention   *retentionStats // Nil unless a policy is set
+)
+
+// startRetention applies the retention policies now and every
+// retentionInterval, when any is set
+func startRetention() {
+	local := *recordPath != "" && (*retainAge > 0 || *retainSize > 0)
+	archive := storagePersistent() && (*storageRetainAge > 0 || *storageRetainSize > 0)
+	if !local && !archive {
+		return
+	}
+	st := &retentionStats{}
+	if local {
+		st.Local = &retentionArea{Where: filepath.Dir(*recordPath), MaxAge: durationSetting(*retainAge), MaxBytes: int64(*retainSize) << 20}
+	}
+	if archive {
+		st.Storage = &retentionArea{Where: activeStorage.String(), MaxAge: durationSetting(*storageRetainAge), MaxBytes: int64(*storageRetainSize) << 20}
+	}
+	retention = st
+	go func() {
+		for {
+			applyRetention(time.Now())
+			time.Sleep(retentionInterval)
+		}
+	}()
+}
+
+// durationSetting formats a duration for the stats, empty when unset
+func durationSetting(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// applyRetention runs the retention policies once
+func applyRetention(now time.Time) {
+	if retention.Local != nil {
+		sets, err := recordingsNextTo(*recordPath)
+		prune(retention.Local, sets, *retainAge, now, os.Remove, err)
+	}
+	if retention.Storage != nil {
+		sets, err := archivedRecordings()
+		prune(retention.Storage, sets, *storageRetainAge, now, activeStorage.Delete, err)
+	}
+	retentionMu.Lock()
+	retention.LastRun = &now
+	retentionMu.Unlock()
+}
+
+// prune deletes the recordings older than maxAge, then the oldest ones
+// until the rest fit in the area's size limit
+func prune(area *retentionArea, sets []retentionSet, maxAge time.Duration, now time.Time, remove func(string) error, err error) {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	if err != nil {
+		log.Printf("Error listing the recordings in %s: %v", area.Where, err)
+		area.Error = err.Error()
+		return
+	}
+	area.Error = ""
+	sort.Slice(sets, func(i, j int) bool { return sets[i].modified.Before(sets[j].modified) })
+	var total int64
+	for _, s := range sets {
+		total += s.size
+	}
+	var deleted []string
+	kept := 0
+	for _, s := range sets {
+		expired := maxAge > 0 && now.Sub(s.modified) > maxAge
+		if s.keep || !expired && (area.MaxBytes == 0 || total <= area.MaxBytes) {
+			kept++
+			continue
+		}
+		var failed error
+		for _, f := range s.files {
+			if err := remove(f); err != nil && failed == nil {
+				failed = err
+			}
+		}
+		if failed != nil {
+			log.Printf("Error deleting %s from %s: %v", s.name, area.Where, failed)
+			area.Error = failed.Error()
+			kept++
+			continue
+		}
+		reason := "older than " + area.MaxAge
+		if !expired {
+			reason = fmt.Sprintf("over %s in total", formatMB(uint64(area.MaxBytes)))
+		}
+		log.Printf("Deleted %s from %s, %s", s.name, area.Where, reason)
+		total -= s.size
+		area.Deleted++
+		area.FreedBytes += s.size
+		deleted = append(deleted, s.name)
+	}
+	area.Recordings, area.Bytes = kept, total
+	if len(deleted) > 0 {
+		area.LastDeleted = deleted
+	}
+}
+
+// recordingsNextTo lists the recordings with the extension of record next
+// to it, grouped with their summaries, which are the ones retention and
+// -disk-full delete-oldest may delete. Files that don't start like a
+// recording are left alone, and record itself and recordings waiting to be
+// uploaded are kept.
+func recordingsNextTo(record string) ([]retentionSet, error) {
+	dir, ext := filepath.Dir(record), filepath.Ext(record)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var sets []retentionSet
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if !e.Type().IsRegular() || ext == "" || !strings.EqualFold(filepath.Ext(e.Name()), ext) {
+			continue
+		}
+		if !sameFile(path, record) && !isRecording(path) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		set := retentionSet{name: e.Name(), files: []string{path}, modified: info.ModTime(), size: info.Size()}
+		set.keep = sameFile(path, record) || activeUploader.pendingFile(path)
+		summaries, _ := filepath.Glob(globEscape(path) + ".*.summary.*")
+		for _, s := range summaries {
+			if info, err := os.Stat(s); err == nil {
+				set.files = append(set.files, s)
+				set.size += info.Size()
+			}
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// archivedRecordings lists the recordings archived to the storage, grouped
+// with their summaries
+func archivedRecordings() ([]retentionSet, error) {
+	objects, err := activeStorage.List("recordings/")
+	if err != nil {
+		return nil, err
+	}
+	index := map[string]int{}
+	var sets []retentionSet
+	for _, o := range objects {
+		name := summarySuffix.ReplaceAllString(o.Name, "")
+		n, ok := index[name]
+		if !ok {
+			n = len(sets)
+			index[name] = n
+			sets = append(sets, retentionSet{name: name})
+		}
+		s := &sets[n]
+		s.files = append(s.files, o.Name)
+		s.size += o.Size
+		if o.Modified.After(s.modified) {
+			s.modified = o.Modified
+		}
+	}
+	return sets, nil
+}
+
+// retentionInfo returns the state of the retention policies, nil when none
+// is set
+func retentionInfo() *retentionStats {
+	if retention == nil {
+		return nil
+	}
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	st := *retention
+	for _, area := range []**retentionArea{&st.Local, &st.Storage} {
+		if *area != nil {
+			copied := **area
+			*area = &copied
+		}
+	}
+	return &st
+}
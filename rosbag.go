@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// rosbagMagic starts a ROS 1 bag, the only version of the format there is
+const rosbagMagic = "#ROSBAG V2.0\n"
+
+// Record types of a ROS bag
+const (
+	bagOpMessage    = 0x02
+	bagOpChunk      = 0x05
+	bagOpConnection = 0x07
+)
+
+// bagMaxRecord bounds the records read, so that a corrupt length doesn't
+// exhaust memory
+const bagMaxRecord = 1 << 30
+
+// bagConnection is a topic of a bag
+type bagConnection struct {
+	topic string
+	imu   bool // Carries sensor_msgs/Imu messages
+}
+
+// bagReader collects the orientations of the sensor_msgs/Imu messages of a
+// ROS bag, by topic
+type bagReader struct {
+	topics    map[string]bool // Topics to import, all IMU topics when empty
+	conns     map[uint32]bagConnection
+	samples   map[string][]importedSample
+	unknown   int // Messages whose orientation the IMU didn't estimate
+	imuTopics []string
+}
+
+// readROSBag reads the orientations of the IMU topics of a ROS 1 bag.
+// Samples of several topics are tagged with the topic, e.g. imu_left for
+// /imu/left.
+func readROSBag(path string, topics []string) (*importedDataset, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 1<<20)
+	magic := make([]byte, len(rosbagMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != rosbagMagic {
+		return nil, errors.New("not a ROS 1 bag, ROS 2 bags (.db3, .mcap) can be converted with rosbags-convert")
+	}
+
+	b := &bagReader{topics: map[string]bool{}, conns: map[uint32]bagConnection{}, samples: map[string][]importedSample{}}
+	for _, t := range topics {
+		b.topics["/"+strings.Trim(t, "/")] = true
+	}
+	for {
+		header, data, err := readBagRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := b.handle(header, data); err != nil {
+			return nil, err
+		}
+	}
+
+	ds := &importedDataset{format: "rosbag", frame: "enu", input: inputQuaternion}
+	for topic, samples := range b.samples {
+		id := ""
+		if len(b.samples) > 1 {
+			id = topicDeviceID(topic)
+		}
+		for _, s := range samples {
+			s.id = id
+			ds.samples = append(ds.samples, s)
+		}
+	}
+	switch {
+	case len(ds.samples) > 0:
+	case len(b.imuTopics) == 0:
+		return nil, errors.New("no sensor_msgs/Imu topics in the bag")
+	case b.unknown > 0:
+		return nil, fmt.Errorf("the IMU messages carry no orientation (covariance -1), topics: %s", strings.Join(b.imuTopics, ", "))
+	default:
+		return nil, fmt.Errorf("no messages on the topics asked for, the bag's IMU topics are %s", strings.Join(b.imuTopics, ", "))
+	}
+	if b.unknown > 0 {
+		fmt.Fprintf(os.Stderr, "%s: skipped %d messages without an orientation\n", path, b.unknown)
+	}
+	return ds, nil
+}
+
+// handle reads one record of the bag, or of a chunk
+func (b *bagReader) handle(header map[string][]byte, data []byte) error {
+	op := header["op"]
+	if len(op) != 1 {
+		return errors.New("bag record without an op")
+	}
+	switch op[0] {
+	case bagOpConnection:
+		id, ok := bagUint32(header["conn"])
+		if !ok {
+			return errors.New("bag connection without an ID")
+		}
+		fields, err := parseBagFields(data)
+		if err != nil {
+			return err
+		}
+		topic := string(header["topic"])
+		imu := string(fields["type"]) == "sensor_msgs/Imu"
+		if _, seen := b.conns[id]; !seen && imu {
+			b.imuTopics = append(b.imuTopics, topic)
+		}
+		b.conns[id] = bagConnection{topic: topic, imu: imu}
+	case bagOpMessage:
+		id, _ := bagUint32(header["conn"])
+		conn, ok := b.conns[id]
+		if !ok || !conn.imu || len(b.topics) > 0 && !b.topics[conn.topic] {
+			return nil
+		}
+		stamp, q, known, err := parseIMUMessage(data)
+		if err != nil {
+			return fmt.Errorf("topic %s: %v", conn.topic, err)
+		}
+		if !known {
+			b.unknown++
+			return nil
+		}
+		if stamp.IsZero() {
+			// Unstamped messages are timed by when they were recorded
+			stamp = bagTime(header["time"])
+		}
+		b.samples[conn.topic] = append(b.samples[conn.topic], importedSample{t: stamp, q: q})
+	case bagOpChunk:
+		var body io.Reader
+		switch c := string(header["compression"]); c {
+		case "none":
+			body = bytes.NewReader(data)
+		case "bz2":
+			body = bzip2.NewReader(bytes.NewReader(data))
+		default:
+			return fmt.Errorf("chunks compressed with %s aren't supported, run rosbag decompress on the bag first", c)
+		}
+		r := bufio.NewReader(body)
+		for {
+			header, data, err := readBagRecord(r)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := b.handle(header, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readBagRecord reads the header fields and data of a record
+func readBagRecord(r io.Reader) (map[string][]byte, []byte, error) {
+	raw, err := readBagBlock(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := parseBagFields(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := readBagBlock(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return header, data, err
+}
+
+// readBagBlock reads a length-prefixed block
+func readBagBlock(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if n > bagMaxRecord {
+		return nil, fmt.Errorf("bag record of %d bytes, the bag is corrupt", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf, nil
+}
+
+// parseBagFields splits length-prefixed name=value fields
+func parseBagFields(b []byte) (map[string][]byte, error) {
+	fields := map[string][]byte{}
+	for len(b) > 0 {
+		n, ok := bagUint32(b[:min(4, len(b))])
+		if !ok || int(n) > len(b)-4 {
+			return nil, errors.New("truncated bag header field")
+		}
+		field := b[4 : 4+n]
+		name, value, found := bytes.Cut(field, []byte("="))
+		if !found {
+			return nil, fmt.Errorf("bag header field without =: %q", field)
+		}
+		fields[string(name)] = value
+		b = b[4+n:]
+	}
+	return fields, nil
+}
+
+// parseIMUMessage reads the stamp and orientation of a serialized
+// sensor_msgs/Imu message. known is false when the orientation covariance
+// starts with -1, which marks an IMU that doesn't estimate orientation.
+func parseIMUMessage(b []byte) (stamp time.Time, q Quaternion, known bool, err error) {
+	// std_msgs/Header: seq, stamp and frame_id
+	if len(b) < 16 {
+		return stamp, q, false, errors.New("truncated message")
+	}
+	if sec, nsec := binary.LittleEndian.Uint32(b[4:]), binary.LittleEndian.Uint32(b[8:]); sec != 0 || nsec != 0 {
+		stamp = time.Unix(int64(sec), int64(nsec)).UTC()
+	}
+	off := 16 + int(binary.LittleEndian.Uint32(b[12:]))
+	// Orientation as x, y, z, w, then the first of its covariance
+	if off < 16 || len(b) < off+5*8 {
+		return stamp, q, false, errors.New("truncated message")
+	}
+	f := func(n int) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b[off+8*n:])) }
+	q = Quaternion{I: f(0), J: f(1), K: f(2), Real: f(3)}
+	return stamp, q, f(4) != -1, nil
+}
+
+func bagUint32(b []byte) (uint32, bool) {
+	if len(b) != 4 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(b), true
+}
+
+// bagTime reads a time field of a record header
+func bagTime(b []byte) time.Time {
+	if len(b) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.LittleEndian.Uint32(b)), int64(binary.LittleEndian.Uint32(b[4:]))).UTC()
+}
+
+// topicDeviceID turns a topic into a device ID, e.g. imu_left for /imu/left
+func topicDeviceID(topic string) string {
+	id := []byte(strings.Trim(topic, "/"))
+	for n, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			id[n] = '_'
+		}
+	}
+	if len(id) == 0 || !deviceID.Match(id) {
+		return "imu"
+	}
+	return string(id)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	s3Endpoint = flag.String("s3-endpoint", "", "Endpoint of the S3 service of s3:// storage, e.g. http://minio:9000 for MinIO, credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY (default: AWS)")
+	s3Region   = flag.String("s3-region", "", "Region of s3:// storage (default: AWS_REGION, or us-east-1)")
+)
+
+// s3Timeout bounds each request to S3, long enough to upload a large recording
+const s3Timeout = 10 * time.Minute
+
+// s3Storage keeps objects in an S3 bucket, or a compatible service such as
+// MinIO. Requests are signed with AWS Signature Version 4.
+type s3Storage struct {
+	spec     string
+	base     url.URL // Scheme and host, with the path of the bucket for path-style requests
+	prefix   string  // Prepended to object names, ends in a slash when set
+	region   string
+	keyID    string
+	secret   string
+	session  string // Token of temporary credentials, if any
+	client   *http.Client
+	signTime func() time.Time
+}
+
+// parseS3Location splits s3://BUCKET/PREFIX into its bucket and prefix
+func parseS3Location(spec string) (bucket, prefix string, err error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid s3 storage %q, use s3://BUCKET/PREFIX", spec)
+	}
+	prefix = strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return u.Host, prefix, nil
+}
+
+func newS3Storage(spec string) (*s3Storage, error) {
+	bucket, prefix, err := parseS3Location(spec)
+	if err != nil {
+		return nil, err
+	}
+	s := &s3Storage{
+		spec:     spec,
+		prefix:   prefix,
+		region:   *s3Region,
+		keyID:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret:   os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		session:  os.Getenv("AWS_SESSION_TOKEN"),
+		client:   &http.Client{Timeout: s3Timeout},
+		signTime: time.Now,
+	}
+	if s.keyID == "" || s.secret == "" {
+		return nil, errors.New("s3 storage needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if *s3Endpoint == "" {
+		// Virtual-hosted requests, as AWS prefers
+		s.base = url.URL{Scheme: "https", Host: bucket + ".s3." + s.region + ".amazonaws.com"}
+		return s, nil
+	}
+	u, err := url.Parse(*s3Endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -s3-endpoint %q", *s3Endpoint)
+	}
+	// Path-style requests, which MinIO and most other services expect
+	s.base = url.URL{Scheme: u.Scheme, Host: u.Host, Path: strings.TrimRight(u.Path, "/") + "/" + bucket}
+	return s, nil
+}
+
+func (s *s3Storage) String() string { return s.spec }
+
+// request sends a signed request for an object, or for the bucket when key
+// is empty
+func (s *s3Storage) request(method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := s.base
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, "UNSIGNED-PAYLOAD", s.signTime())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound && key != "" {
+			return nil, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		var e struct{ Code, Message string }
+		if xml.Unmarshal(msg, &e) == nil && e.Code != "" {
+			return nil, fmt.Errorf("%s: %s: %s", resp.Status, e.Code, e.Message)
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+func (s *s3Storage) Put(name string, r io.Reader, size int64) error {
+	if err := checkObjectName(name); err != nil {
+		return err
+	}
+	resp, err := s.request(http.MethodPut, s.prefix+name, nil, r, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Get(name string) (io.ReadCloser, error) {
+	if err := checkObjectName(name); err != nil {
+		return nil, err
+	}
+	resp, err := s.request(http.MethodGet, s.prefix+name, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// s3ListResult is the answer to a ListObjectsV2 request
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Storage) List(prefix string) ([]storedObject, error) {
+	list := []storedObject{}
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+	for {
+		resp, err := s.request(http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var page s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range page.Contents {
+			list = append(list, storedObject{Name: strings.TrimPrefix(o.Key, s.prefix), Size: o.Size, Modified: o.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return list, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+func (s *s3Storage) Delete(name string) error {
+	if err := checkObjectName(name); err != nil {
+		return err
+	}
+	resp, err := s.request(http.MethodDelete, s.prefix+name, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// sign adds the Signature Version 4 authorization of a request to it,
+// signing the host and every header set so far
+func (s *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.session != "" {
+		req.Header.Set("X-Amz-Security-Token", s.session)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	request := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonical.String(), signed, payloadHash}, "\n")
+	scope := stamp[:8] + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hexSHA256(request)
+
+	key := []byte("AWS4" + s.secret)
+	for _, part := range []string{stamp[:8], s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.keyID+"/"+scope+", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, and
+// slashes unless encodeSlash, as Signature Version 4 expects
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes a query sorted by key, which is also its canonical form
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,176 @@
+// Package serialreader reads orientation quaternions from sensors, one text
+// line each, such as an Arduino printing "i,j,k,real" to a serial port.
+package serialreader
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+	"go.bug.st/serial"
+)
+
+// RetryDelay is how long Run waits before opening a source again after it
+// failed or ended
+const RetryDelay = 5 * time.Second
+
+// Source is an input that produces quaternions, such as a serial port. The
+// same source may be opened again after it has been closed.
+type Source interface {
+	Open() error
+	// ReadQuaternion blocks until the next quaternion arrives. It returns
+	// io.EOF when the input has ended, and an error once the source is closed.
+	ReadQuaternion() (quat.Quaternion, error)
+	Close() error
+}
+
+// Reader is a Source reading quaternion lines from a serial port
+type Reader struct {
+	Port   string       // e.g. COM3 or /dev/ttyUSB0
+	Baud   int          // 115200 when zero
+	Format *quat.Format // quat.DefaultFormat when nil
+
+	// OpenPort, when set, opens the port in place of serial.Open, e.g. to
+	// resolve its name or lock it. The function it returns, unless nil, is
+	// called once the port has been closed.
+	OpenPort func(name string, mode *serial.Mode) (serial.Port, func(), error)
+	// Decode, when set, is called with each port opened and returns the
+	// function reading its quaternions, in place of parsing lines of Format,
+	// e.g. for binary packets. The port is closed again when it fails.
+	Decode func(port serial.Port) (next func() (quat.Quaternion, error), err error)
+
+	mu      sync.Mutex
+	port    serial.Port
+	release func()
+	next    func() (quat.Quaternion, error)
+}
+
+// New returns a Reader of "i,j,k,real" lines at the given baud rate
+func New(port string, baud int) *Reader {
+	return &Reader{Port: port, Baud: baud}
+}
+
+func (r *Reader) String() string { return r.Port }
+
+// Open opens the serial port
+func (r *Reader) Open() error {
+	baud := r.Baud
+	if baud == 0 {
+		baud = 115200
+	}
+	mode := &serial.Mode{BaudRate: baud}
+	var port serial.Port
+	var release func()
+	var err error
+	if r.OpenPort != nil {
+		port, release, err = r.OpenPort(r.Port, mode)
+	} else {
+		port, err = serial.Open(r.Port, mode)
+	}
+	if err != nil {
+		return err
+	}
+	next := r.readLines(port)
+	if r.Decode != nil {
+		if next, err = r.Decode(port); err != nil {
+			port.Close()
+			if release != nil {
+				release()
+			}
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.port, r.release, r.next = port, release, next
+	r.mu.Unlock()
+	return nil
+}
+
+// readLines returns a function reading the quaternion of the next line of
+// the port that parses, skipping the others, such as the start-up messages
+// of sensors
+func (r *Reader) readLines(port serial.Port) func() (quat.Quaternion, error) {
+	scanner := bufio.NewScanner(port)
+	format := r.Format
+	return func() (quat.Quaternion, error) {
+		for scanner.Scan() {
+			var q quat.Quaternion
+			var err error
+			if format == nil {
+				q, err = quat.Parse(scanner.Text())
+			} else {
+				q, err = format.Parse(scanner.Text())
+			}
+			if err == nil {
+				return q, nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return quat.Quaternion{}, err
+		}
+		return quat.Quaternion{}, fmt.Errorf("serial port %s closed", r.Port)
+	}
+}
+
+// ReadQuaternion returns the next quaternion read from the port
+func (r *Reader) ReadQuaternion() (quat.Quaternion, error) {
+	r.mu.Lock()
+	next := r.next
+	r.mu.Unlock()
+	if next == nil {
+		return quat.Quaternion{}, errors.New("serial port is not open")
+	}
+	return next()
+}
+
+// Close closes the port. It may be called from another goroutine to
+// interrupt a read, and more than once.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	port, release := r.port, r.release
+	r.port, r.release, r.next = nil, nil, nil
+	r.mu.Unlock()
+	if port == nil {
+		return nil
+	}
+	err := port.Close()
+	if release != nil {
+		release()
+	}
+	return err
+}
+
+// Run reads src until ctx is done, calling handle with each quaternion.
+// The source is opened again RetryDelay after it fails or ends, so that a
+// sensor can be unplugged and plugged back in.
+func Run(ctx context.Context, src Source, handle func(quat.Quaternion)) {
+	for {
+		if err := src.Open(); err != nil {
+			log.Printf("Error opening %v: %v", src, err)
+		} else {
+			stop := context.AfterFunc(ctx, func() { src.Close() })
+			for {
+				q, err := src.ReadQuaternion()
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Error reading %v: %v", src, err)
+					}
+					break
+				}
+				handle(q)
+			}
+			stop()
+			src.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(RetryDelay):
+		}
+	}
+}
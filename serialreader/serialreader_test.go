@@ -0,0 +1,149 @@
+package serialreader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+	"go.bug.st/serial"
+)
+
+// fakePort is a serial.Port reading the given text
+type fakePort struct {
+	io.Reader
+	closed atomic.Bool
+}
+
+func (p *fakePort) SetMode(*serial.Mode) error  { return nil }
+func (p *fakePort) Write(b []byte) (int, error) { return len(b), nil }
+func (p *fakePort) Drain() error                { return nil }
+func (p *fakePort) ResetInputBuffer() error     { return nil }
+func (p *fakePort) ResetOutputBuffer() error    { return nil }
+func (p *fakePort) SetDTR(bool) error           { return nil }
+func (p *fakePort) SetRTS(bool) error           { return nil }
+func (p *fakePort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+func (p *fakePort) SetReadTimeout(time.Duration) error { return nil }
+func (p *fakePort) Break(time.Duration) error          { return nil }
+
+func (p *fakePort) Close() error {
+	p.closed.Store(true)
+	return nil
+}
+
+func TestReader(t *testing.T) {
+	port := &fakePort{Reader: strings.NewReader("Booting...\n0,0,0,1\n0.9 0.1 0.2 0.3\n1,2\n0.5,0.5,0.5,0.5\n")}
+	format, err := quat.ParseFormat("w,x,y,z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	released := false
+	r := New("ttyTEST", 0)
+	r.Format = format
+	r.OpenPort = func(name string, mode *serial.Mode) (serial.Port, func(), error) {
+		if name != "ttyTEST" || mode.BaudRate != 115200 {
+			t.Errorf("opened %s at %d baud, want ttyTEST at 115200", name, mode.BaudRate)
+		}
+		return port, func() { released = true }, nil
+	}
+
+	if _, err := r.ReadQuaternion(); err == nil {
+		t.Error("read before opening succeeded")
+	}
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// Lines that don't parse in the format are skipped
+	for _, want := range []quat.Quaternion{{K: 1}, {I: 0.5, J: 0.5, K: 0.5, Real: 0.5}} {
+		got, err := r.ReadQuaternion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("read %+v, want %+v", got, want)
+		}
+	}
+	if _, err := r.ReadQuaternion(); err == nil {
+		t.Error("read past the end succeeded")
+	}
+	r.Close()
+	r.Close()
+	if !port.closed.Load() || !released {
+		t.Errorf("closed %v, released %v, want both", port.closed.Load(), released)
+	}
+}
+
+func TestReaderDecode(t *testing.T) {
+	port := &fakePort{Reader: strings.NewReader("")}
+	r := New("ttyTEST", 9600)
+	r.OpenPort = func(string, *serial.Mode) (serial.Port, func(), error) { return port, nil, nil }
+	r.Decode = func(serial.Port) (func() (quat.Quaternion, error), error) {
+		return nil, errors.New("no reports")
+	}
+	if err := r.Open(); err == nil || !port.closed.Load() {
+		t.Errorf("Open with a failing Decode: %v, port closed %v", err, port.closed.Load())
+	}
+
+	port = &fakePort{Reader: strings.NewReader("")}
+	r.Decode = func(serial.Port) (func() (quat.Quaternion, error), error) {
+		return func() (quat.Quaternion, error) { return quat.Identity, nil }, nil
+	}
+	if err := r.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := r.ReadQuaternion(); err != nil || q != quat.Identity {
+		t.Errorf("read %+v, %v, want the identity", q, err)
+	}
+}
+
+// countingSource produces n quaternions each time it is opened
+type countingSource struct {
+	n, left int
+	opened  int
+}
+
+func (s *countingSource) Open() error {
+	s.opened++
+	s.left = s.n
+	return nil
+}
+
+func (s *countingSource) ReadQuaternion() (quat.Quaternion, error) {
+	if s.left == 0 {
+		return quat.Quaternion{}, io.EOF
+	}
+	s.left--
+	return quat.Identity, nil
+}
+
+func (s *countingSource) Close() error { return nil }
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	src := &countingSource{n: 3}
+	got := 0
+	done := make(chan struct{})
+	go func() {
+		Run(ctx, src, func(quat.Quaternion) {
+			got++
+			if got == 3 {
+				cancel()
+			}
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return once the context was done")
+	}
+	if got != 3 || src.opened != 1 {
+		t.Errorf("handled %d quaternions from %d opens, want 3 from 1", got, src.opened)
+	}
+}
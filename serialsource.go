@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/intermernet/quatplot/serialreader"
+	"go.bug.st/serial"
+)
+
+func init() {
+	registerSource("serial", sourceType{new: newSerialSource})
+}
+
+// serialSource reads quaternion lines from a serial port. The port is
+// opened and closed by serialreader.Reader, the lines or packets are decoded
+// in the configured format.
+type serialSource struct {
+	serialreader.Reader
+	spec    string
+	format  *lineFormat
+	preview *previewBuffer
+}
+
+func newSerialSource(cfg Config) Source {
+	s := &serialSource{spec: cfg.Port, format: cfg.lineFormat(), preview: cfg.previewBuffer()}
+	s.Baud = cfg.Baud
+	s.OpenPort = openSerialPort
+	s.Decode = s.decode
+	return s
+}
+
+func (s *serialSource) String() string { return s.spec }
+
+func (s *serialSource) Open() error {
+	s.Port = s.spec
+	if isAutoPort(s.spec) {
+		name, err := findSensorPort(s.spec, s.Baud, s.format)
+		if err != nil {
+			return err
+		}
+		log.Printf("Found a sensor on %s", name)
+		s.Port = name
+	}
+	return s.Reader.Open()
+}
+
+// decode reads the lines or packets of the format from an opened port,
+// after sending the command that starts the reports of sensors that need one
+func (s *serialSource) decode(port serial.Port) (func() (Quaternion, error), error) {
+	lines := newLineReader(captureRaw(port, s.Port), s.format, s.preview)
+	if s.format.packet != nil {
+		if cmd := s.format.packet.start(); cmd != nil {
+			if err := writeSlowly(port, cmd); err != nil {
+				return nil, fmt.Errorf("starting reports: %v", err)
+			}
+		}
+	}
+	return lines.next, nil
+}
+
+// writeSlowly writes to a serial port a byte at a time, as sensors such as
+// the BNO08x drop bytes that arrive less than 100µs apart
+func writeSlowly(port serial.Port, data []byte) error {
+	for _, b := range data {
+		if _, err := port.Write([]byte{b}); err != nil {
+			return err
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	return nil
+}
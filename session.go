@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/intermernet/quatplot/hub"
+	"github.com/intermernet/quatplot/quat"
+)
+
+const (
+	// resumeTokenTTL is how long a disconnected client's token stays valid
+	resumeTokenTTL = time.Hour
+	// maxResumeTokens bounds the number of remembered client identities
+	maxResumeTokens = 10000
+)
+
+// sampleMessage is an orientation sample as sent to WebSocket clients: the
+// message of the hub package, with the derived vectors and marks the server
+// adds to it
+type sampleMessage struct {
+	hub.Sample
+	Gravity         *quat.Vector   `json:"gravity,omitempty"`
+	Heading         *headingVector `json:"heading,omitempty"`
+	AngularVelocity *quat.Vector   `json:"angular_velocity,omitempty"`
+	sampleMarks
+}
+
+// sampleMarks flag samples that can't be trusted
+type sampleMarks struct {
+	Settling bool `json:"settling,omitempty"` // Taken before the device settled, see -settle-rate
+	Outlier  bool `json:"outlier,omitempty"`  // Jumped further than -outlier-angle from the previous sample
+}
+
+// sampleEncoding is what derived values a client is sent, and how
+type sampleEncoding struct {
+	hub.Encoding           // Keys of the quaternion, and units and order of the Euler angles
+	vectors      vectorSet // Derived vectors
+	frame        string    // Reference frame the vectors are derived in
+}
+
+// encodeSample marshals a sample with the derived values of an encoding.
+// omega is the device's angular velocity in radians per second, nil when
+// unknown.
+func encodeSample(id string, seq uint64, q Quaternion, omega *quat.Vector, marks sampleMarks, enc sampleEncoding) ([]byte, error) {
+	msg := sampleMessage{Sample: enc.Sample(id, seq, q), sampleMarks: marks}
+	if enc.vectors.Gravity {
+		msg.Gravity = gravityVector(q, enc.frame)
+	}
+	if enc.vectors.Heading {
+		msg.Heading = heading(q, enc.frame, enc.Units)
+	}
+	if enc.vectors.AngularVelocity && omega != nil {
+		w := quat.Vector{X: quat.ConvertAngle(omega.X, enc.Units), Y: quat.ConvertAngle(omega.Y, enc.Units), Z: quat.ConvertAngle(omega.Z, enc.Units)}
+		msg.AngularVelocity = &w
+	}
+	return json.Marshal(msg)
+}
+
+// sessionInfo is sent to every client on connect so that it can resume later
+type sessionInfo struct {
+	Server     string          `json:"server"`   // Always "quatplot"
+	Version    string          `json:"version"`  // Version of the server, see serverVersion
+	Protocol   int             `json:"protocol"` // Version of the messages, see protocolVersion
+	Epoch      string          `json:"epoch"`
+	Seq        uint64          `json:"seq"`
+	Token      string          `json:"token"`
+	Units      unitPrefs       `json:"units"`
+	EulerOrder string          `json:"euler_order"` // Rotation order of the Euler angles sent
+	Convention conventionInfo  `json:"convention"`
+	Vectors    []string        `json:"vectors,omitempty"` // Derived vectors sent with samples
+	Streams    []streamInfo    `json:"streams"`           // Display metadata of each device
+	Model      *modelInfo      `json:"model,omitempty"`   // Model set through /api/view/model
+	Status     serialStatus    `json:"status"`            // State of the input, as returned by /api/status
+	Settings   sessionSettings `json:"settings"`
+	Welcome    json.RawMessage `json:"welcome,omitempty"`   // Set with -welcome, omitted when it isn't
+	Handshake  *handshakeInfo  `json:"handshake,omitempty"` // Set with -client-protocol strict
+}
+
+// resumeInfo answers a client that reconnected, either with the last
+// sequence number it received or with its resume token. When the epoch
+// differs the server has restarted since, and sequence numbers are no longer
+// comparable.
+type resumeInfo struct {
+	Epoch            string `json:"epoch"`
+	EpochChanged     bool   `json:"epoch_changed"`
+	LastSeq          uint64 `json:"last_seq"`
+	CurrentSeq       uint64 `json:"current_seq"`
+	Missed           uint64 `json:"missed"`
+	FromSeq          uint64 `json:"from_seq,omitempty"` // First missed sequence number
+	ToSeq            uint64 `json:"to_seq,omitempty"`   // Last missed sequence number
+	Backfilled       int    `json:"backfilled,omitempty"`
+	HistoryTruncated bool   `json:"history_truncated,omitempty"`
+}
+
+// backfillInfo carries missed samples from the history buffer
+type backfillInfo struct {
+	Samples any `json:"samples"` // Samples with the client's keys, see samplesWithKeys
+}
+
+// resumeToken remembers what was delivered to a client identity across reconnects
+type resumeToken struct {
+	ns        *namespace
+	lastSeq   uint64
+	connected bool
+	seen      time.Time
+	drops     *dropLog // When the client missed samples, see /api/clients/drops
+}
+
+var (
+	// serverEpoch identifies this server process, sequence numbers restart
+	// from zero with every new epoch
+	serverEpoch = newRandomID()
+
+	resumeTokens      = make(map[string]*resumeToken)
+	resumeTokensMutex sync.Mutex
+)
+
+func newRandomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// claimToken returns the client's resume token and the last sequence number
+// delivered to it. Unknown, expired or in-use tokens are replaced by a new one.
+func claimToken(ns *namespace, token string) (string, uint64, bool) {
+	resumeTokensMutex.Lock()
+	defer resumeTokensMutex.Unlock()
+
+	now := time.Now()
+	for t, rt := range resumeTokens {
+		if !rt.connected && now.Sub(rt.seen) > resumeTokenTTL {
+			delete(resumeTokens, t)
+		}
+	}
+
+	if rt, ok := resumeTokens[token]; ok && !rt.connected && rt.ns == ns {
+		rt.connected = true
+		rt.seen = now
+		return token, rt.lastSeq, true
+	}
+
+	if len(resumeTokens) >= maxResumeTokens {
+		// Forget the least recently seen disconnected client
+		oldest := ""
+		for t, rt := range resumeTokens {
+			if !rt.connected && (oldest == "" || rt.seen.Before(resumeTokens[oldest].seen)) {
+				oldest = t
+			}
+		}
+		delete(resumeTokens, oldest)
+	}
+	token = newRandomID() + newRandomID()
+	resumeTokens[token] = &resumeToken{ns: ns, connected: true, seen: now, drops: &dropLog{}}
+	return token, 0, false
+}
+
+// releaseToken records the last sequence number delivered to a disconnecting client
+func releaseToken(token string, lastSeq uint64) {
+	resumeTokensMutex.Lock()
+	defer resumeTokensMutex.Unlock()
+	if rt, ok := resumeTokens[token]; ok {
+		rt.lastSeq = lastSeq
+		rt.connected = false
+		rt.seen = time.Now()
+		rt.drops.disconnected(rt.seen)
+	}
+}
+
+// tokenDrops returns when the client holding a resume token of the namespace
+// missed samples, nil for unknown or expired tokens
+func tokenDrops(ns *namespace, token string) *dropLog {
+	resumeTokensMutex.Lock()
+	defer resumeTokensMutex.Unlock()
+	if rt, ok := resumeTokens[token]; ok && rt.ns == ns {
+		return rt.drops
+	}
+	return nil
+}
+
+// resumeRequest works out what a reconnecting client missed. Clients pass
+// the last sequence number they received, e.g. /ws?epoch=4f1c2a9d0b3e7a65&last_seq=1234,
+// or a resume token from a previous session, in which case the last sequence
+// number the server delivered to it is used.
+func resumeRequest(r *http.Request, ns *namespace, tokenSeq uint64, tokenKnown bool) (info resumeInfo, ok bool) {
+	q := r.URL.Query()
+	info = resumeInfo{Epoch: serverEpoch, CurrentSeq: ns.seq.Load()}
+
+	switch {
+	case q.Has("last_seq"):
+		lastSeq, err := strconv.ParseUint(q.Get("last_seq"), 10, 64)
+		if err != nil {
+			return info, false
+		}
+		info.LastSeq = lastSeq
+		info.EpochChanged = q.Get("epoch") != serverEpoch
+	case tokenKnown:
+		info.LastSeq = tokenSeq
+	case q.Has("token"):
+		// A token from before a restart, the gap can't be measured
+		info.EpochChanged = true
+		return info, true
+	default:
+		return info, false
+	}
+
+	if !info.EpochChanged && info.CurrentSeq > info.LastSeq {
+		info.Missed = info.CurrentSeq - info.LastSeq
+		info.FromSeq = info.LastSeq + 1
+		info.ToSeq = info.CurrentSeq
+	}
+	return info, true
+}
+
+// backfill returns the missed samples a resuming client asked for with
+// backfill=1, updating info with how many could be recovered
+func backfill(r *http.Request, ns *namespace, info *resumeInfo) []historySample {
+	if info.Missed == 0 || r.URL.Query().Get("backfill") != "1" {
+		return nil
+	}
+	samples, complete := ns.history.since(info.LastSeq)
+	var out []historySample
+	for _, s := range samples {
+		if s.Seq <= info.ToSeq {
+			out = append(out, s)
+		}
+	}
+	info.Backfilled = len(out)
+	info.HistoryTruncated = !complete
+	return out
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var (
+	settleRate    = flag.Float64("settle-rate", 0, "Drift in degrees per second below which a device's orientation counts as settled after it starts, see -settle-time (default: 0, samples are never marked settling)")
+	settleTime    = flag.Duration("settle-time", 2*time.Second, "How long the orientation must drift less than -settle-rate for the device to have settled")
+	settleTimeout = flag.Duration("settle-timeout", time.Minute, "Longest a device is settling, it counts as settled afterwards even if it still drifts")
+)
+
+// settleGap is the silence after which a device is taken to have been
+// restarted, and settles again
+const settleGap = 5 * time.Second
+
+// settleMeter tells when the orientation filter of each device of a
+// namespace has converged after it starts, or a sensor has warmed up. Until
+// then its orientation drifts even when the device is still.
+type settleMeter struct {
+	mu      sync.Mutex
+	devices map[string]*settleState
+}
+
+type settleState struct {
+	started time.Time  // First sample since the device started
+	last    time.Time  // Latest sample
+	anchor  Quaternion // Orientation the drift is measured from
+	since   time.Time  // When the orientation was anchor
+	settled bool
+}
+
+// settledInfo is sent when a device has settled
+type settledInfo struct {
+	ID      string  `json:"id,omitempty"`
+	Seconds float64 `json:"seconds"` // How long the device was settling
+	Reason  string  `json:"reason"`  // "converged", or "timeout" after -settle-timeout
+}
+
+// newSettleMeter returns the meter, nil when -settle-rate is 0
+func newSettleMeter() *settleMeter {
+	if *settleRate <= 0 {
+		return nil
+	}
+	return &settleMeter{devices: map[string]*settleState{}}
+}
+
+// add reports whether a sample of a device was taken while it was settling,
+// and describes how it settled when this sample completed it
+func (m *settleMeter) add(device string, q Quaternion, now time.Time) (settling bool, settled *settledInfo) {
+	if m == nil {
+		return false, nil
+	}
+	q, ok := quat.Normalize(q)
+	if !ok {
+		return false, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.devices[device]
+	if s == nil || now.Sub(s.last) > settleGap {
+		s = &settleState{started: now, anchor: q, since: now}
+		m.devices[device] = s
+	}
+	s.last = now
+	if s.settled {
+		return false, nil
+	}
+
+	info := settledInfo{ID: device, Seconds: now.Sub(s.started).Seconds()}
+	switch {
+	case now.Sub(s.started) >= *settleTimeout:
+		info.Reason = "timeout"
+	case quat.Angle(s.anchor, q) > *settleRate*settleTime.Seconds():
+		// Still drifting, measure again from here
+		s.anchor, s.since = q, now
+		return true, nil
+	case now.Sub(s.since) >= *settleTime:
+		info.Reason = "converged"
+	default:
+		return true, nil
+	}
+	s.settled = true
+	return false, &info
+}
+
+// settling reports whether a device is settling
+func (m *settleMeter) settling(device string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.devices[device]
+	return s != nil && !s.settled
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+const (
+	setupPreviewLines   = 10
+	setupPreviewTimeout = 3 * time.Second
+)
+
+// setupRequest is the body posted by the setup wizard to save a configuration
+type setupRequest struct {
+	Port  string `json:"port"`
+	Baud  int    `json:"baud"`
+	Order string `json:"order"`
+}
+
+// previewLine is a raw line read from the device with its parse result
+type previewLine struct {
+	Time  time.Time   `json:"time"`
+	Line  string      `json:"line"`
+	OK    bool        `json:"ok"`
+	Error string      `json:"error,omitempty"`
+	Quat  *Quaternion `json:"quat,omitempty"`
+}
+
+// handleSetup serves the setup wizard page and saves its configuration
+func handleSetup(w http.ResponseWriter, r *http.Request) {
+	if !inSetupMode() {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(setupHTML))
+	case http.MethodPost:
+		var req setupRequest
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		if req.Port == "" {
+			http.Error(w, "port is required", http.StatusBadRequest)
+			return
+		}
+		if req.Baud <= 0 {
+			http.Error(w, "baud must be positive", http.StatusBadRequest)
+			return
+		}
+		if !validOrder(req.Order) {
+			http.Error(w, "order must name i, j, k and real exactly once", http.StatusBadRequest)
+			return
+		}
+
+		cfg := currentConfig()
+		cfg.Port, cfg.Baud, cfg.Order = req.Port, req.Baud, req.Order
+		if err := saveConfig(*configPath, cfg); err != nil {
+			log.Printf("Error saving config: %v", err)
+			http.Error(w, "saving config: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Setup complete, config written to %s", *configPath)
+
+		defaultNamespace.announceRestart("config", time.Second)
+		setConfig(cfg)
+		setSetupMode(false)
+		startSources()
+		restartSources()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSetupPorts lists the serial ports detected on this machine
+func handleSetupPorts(w http.ResponseWriter, r *http.Request) {
+	if !inSetupMode() {
+		http.NotFound(w, r)
+		return
+	}
+
+	ports, err := serial.GetPortsList()
+	if err != nil {
+		http.Error(w, "listing serial ports: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ports == nil {
+		ports = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ports)
+}
+
+// handleSetupPreview briefly opens a port and returns the first lines it
+// sends, parsed with the requested component order
+func handleSetupPreview(w http.ResponseWriter, r *http.Request) {
+	if !inSetupMode() {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	name := q.Get("port")
+	baud, err := strconv.Atoi(q.Get("baud"))
+	if name == "" || err != nil || baud <= 0 {
+		http.Error(w, "port and a positive baud are required", http.StatusBadRequest)
+		return
+	}
+	order := q.Get("order")
+	if order == "" {
+		order = defaultOrder
+	}
+	if !validOrder(order) {
+		http.Error(w, "order must name i, j, k and real exactly once", http.StatusBadRequest)
+		return
+	}
+
+	port, release, err := openSerialPort(name, &serial.Mode{BaudRate: baud})
+	if err != nil {
+		http.Error(w, "opening "+name+": "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer release()
+	defer port.Close()
+
+	lines := []previewLine{}
+	for _, line := range readLines(port, setupPreviewLines, setupPreviewTimeout) {
+		pl := previewLine{Time: time.Now(), Line: line}
+		quat, err := parseQuaternion(line, order)
+		if err != nil {
+			pl.Error = err.Error()
+		} else {
+			pl.OK = true
+			pl.Quat = &quat
+		}
+		lines = append(lines, pl)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lines)
+}
+
+// readLines collects up to limit complete lines from port, giving up after timeout
+func readLines(port serial.Port, limit int, timeout time.Duration) []string {
+	port.SetReadTimeout(200 * time.Millisecond)
+
+	var lines []string
+	var pending []byte
+	buf := make([]byte, 256)
+	deadline := time.Now().Add(timeout)
+	for len(lines) < limit && time.Now().Before(deadline) {
+		n, err := port.Read(buf)
+		if err != nil {
+			break
+		}
+		pending = append(pending, buf[:n]...)
+		for len(lines) < limit {
+			idx := bytes.IndexByte(pending, '\n')
+			if idx < 0 {
+				break
+			}
+			line := strings.TrimRight(string(pending[:idx]), "\r")
+			pending = pending[idx+1:]
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines
+}
+
+const setupHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Quatplot Setup</title>
+    <style>
+        body {
+            margin: 0;
+            padding: 30px 15px;
+            font-family: Arial, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            min-height: 100vh;
+            box-sizing: border-box;
+            color: white;
+        }
+        #wizard {
+            max-width: 640px;
+            margin: 0 auto;
+            background: rgba(0, 0, 0, 0.8);
+            border-radius: 8px;
+            padding: 20px 25px;
+            box-shadow: 0 4px 20px rgba(0,0,0,0.5);
+        }
+        h1 {
+            font-size: 22px;
+            margin-top: 0;
+        }
+        h2 {
+            font-size: 16px;
+            color: #8b9cff;
+        }
+        label {
+            font-weight: bold;
+            display: block;
+            margin: 10px 0 4px;
+        }
+        select, input, button {
+            font-size: 14px;
+            padding: 6px 8px;
+            border-radius: 5px;
+            border: none;
+        }
+        button {
+            background: #667eea;
+            color: white;
+            cursor: pointer;
+            margin-top: 10px;
+        }
+        button:hover {
+            background: #7b8cf0;
+        }
+        #preview {
+            font-family: monospace;
+            font-size: 12px;
+            background: rgba(255, 255, 255, 0.05);
+            border-radius: 5px;
+            padding: 8px;
+            margin-top: 10px;
+            min-height: 40px;
+        }
+        .ok {
+            color: #a5d6a7;
+        }
+        .bad {
+            color: #ef9a9a;
+        }
+    </style>
+</head>
+<body>
+    <div id="wizard">
+        <h1>Quatplot Setup</h1>
+        <p>No configuration file was found. Pick the serial port your sensor is connected to, check that its output looks right, then save.</p>
+
+        <h2>1. Serial port</h2>
+        <label for="port">Port</label>
+        <select id="port"></select>
+        <button onclick="loadPorts()">Rescan</button>
+        <label for="baud">Baud rate</label>
+        <select id="baud">
+            <option>9600</option>
+            <option>38400</option>
+            <option>57600</option>
+            <option selected>115200</option>
+            <option>230400</option>
+            <option>460800</option>
+            <option>921600</option>
+        </select>
+
+        <h2>2. Line format</h2>
+        <label for="order">Component order</label>
+        <select id="order">
+            <option value="i,j,k,real">i,j,k,real (x,y,z,w)</option>
+            <option value="real,i,j,k">real,i,j,k (w,x,y,z)</option>
+        </select>
+
+        <h2>3. Preview</h2>
+        <button onclick="preview()">Preview incoming lines</button>
+        <div id="preview">Press preview to read a few lines from the device.</div>
+
+        <h2>4. Save</h2>
+        <button onclick="save()">Save and start</button>
+        <div id="saveStatus"></div>
+    </div>
+
+    <script>
+        function settings() {
+            return {
+                port: document.getElementById('port').value,
+                baud: parseInt(document.getElementById('baud').value, 10),
+                order: document.getElementById('order').value
+            };
+        }
+
+        // ensureLoggedIn asks for the password when the server requires one
+        function ensureLoggedIn() {
+            return fetch('/api/status').then(r => {
+                if (r.status !== 401) {
+                    return;
+                }
+                const password = window.prompt('Password');
+                if (password === null) {
+                    throw new Error('login cancelled');
+                }
+                return fetch('/api/login', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ password: password })
+                }).then(r => {
+                    if (!r.ok) {
+                        throw new Error('login failed');
+                    }
+                });
+            });
+        }
+
+        function loadPorts() {
+            ensureLoggedIn()
+                .then(() => fetch('/setup/ports'))
+                .then(r => r.json())
+                .then(ports => {
+                    const select = document.getElementById('port');
+                    select.innerHTML = '';
+                    if (ports.length === 0) {
+                        const opt = document.createElement('option');
+                        opt.textContent = 'No serial ports detected';
+                        opt.value = '';
+                        select.appendChild(opt);
+                    }
+                    ports.forEach(p => {
+                        const opt = document.createElement('option');
+                        opt.textContent = p;
+                        opt.value = p;
+                        select.appendChild(opt);
+                    });
+                })
+                .catch(e => console.error('Error listing ports:', e));
+        }
+
+        function preview() {
+            const s = settings();
+            const out = document.getElementById('preview');
+            if (!s.port) {
+                out.textContent = 'Select a port first.';
+                return;
+            }
+            out.textContent = 'Reading from ' + s.port + '...';
+            const params = new URLSearchParams({ port: s.port, baud: s.baud, order: s.order });
+            fetch('/setup/preview?' + params)
+                .then(r => r.ok ? r.json() : r.text().then(t => { throw new Error(t); }))
+                .then(lines => {
+                    out.innerHTML = '';
+                    if (lines.length === 0) {
+                        out.textContent = 'No lines received. Check the port and baud rate.';
+                        return;
+                    }
+                    lines.forEach(l => {
+                        const div = document.createElement('div');
+                        div.className = l.ok ? 'ok' : 'bad';
+                        div.textContent = (l.ok ? '✓ ' : '✗ ') + l.line + (l.ok ? '' : '  (' + l.error + ')');
+                        out.appendChild(div);
+                    });
+                })
+                .catch(e => { out.textContent = 'Preview failed: ' + e.message; });
+        }
+
+        function save() {
+            const s = settings();
+            const status = document.getElementById('saveStatus');
+            if (!s.port) {
+                status.textContent = 'Select a port first.';
+                return;
+            }
+            fetch('/setup', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify(s)
+            })
+                .then(r => r.ok ? r.json() : r.text().then(t => { throw new Error(t); }))
+                .then(() => { window.location.href = '/'; })
+                .catch(e => { status.textContent = 'Save failed: ' + e.message; });
+        }
+
+        window.onload = loadPorts;
+    </script>
+</body>
+</html>
+`
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// signingKeyEnv names the environment variable holding the signing key
+const signingKeyEnv = "QUATPLOT_SIGNING_KEY"
+
+// minSigningKey is the shortest signing key accepted, in bytes
+const minSigningKey = 16
+
+var (
+	signingKeyFile = flag.String("signing-key-file", "", "File holding a key, hex or base64, to HMAC-sign every WebSocket message with, so that consumers behind relays can check where it came from (or set "+signingKeyEnv+")")
+	signingKeyID   = flag.String("signing-key-id", "", "Name of the signing key, sent as kid with every signed message so that consumers can tell servers or keys apart")
+
+	// signingKey signs WebSocket messages, nil when they aren't signed
+	signingKey []byte
+)
+
+// initSigning loads the signing key from the environment, or failing that
+// from -signing-key-file
+func initSigning() error {
+	if *signingKeyID != "" && !json.Valid([]byte(`"`+*signingKeyID+`"`)) {
+		return fmt.Errorf("-signing-key-id %q can't contain quotes or backslashes", *signingKeyID)
+	}
+	var source, text string
+	if v := os.Getenv(signingKeyEnv); v != "" {
+		source, text = signingKeyEnv, v
+	} else if *signingKeyFile != "" {
+		data, err := os.ReadFile(*signingKeyFile)
+		if err != nil {
+			return err
+		}
+		source, text = *signingKeyFile, string(data)
+	} else {
+		if *signingKeyID != "" {
+			return errors.New("-signing-key-id needs a key, set " + signingKeyEnv + " or -signing-key-file")
+		}
+		return nil
+	}
+	key, err := parseSigningKey(text)
+	if err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+	signingKey = key
+	log.Printf("Signing WebSocket messages with HMAC-SHA256")
+	return nil
+}
+
+// parseSigningKey decodes a key of at least minSigningKey bytes given as
+// hex or base64
+func parseSigningKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil {
+		return nil, errors.New("signing key must be hex or base64 encoded")
+	}
+	if len(key) < minSigningKey {
+		return nil, fmt.Errorf("signing key is %d bytes, must be at least %d", len(key), minSigningKey)
+	}
+	return key, nil
+}
+
+// signMessage adds the kid and the signature to a JSON object as its last
+// fields. The signature is the HMAC-SHA256, in unpadded base64url, of the
+// message up to the comma before "sig", followed by the closing brace, so
+// that consumers can check it by cutting the signature off again. Messages
+// that aren't objects, and all messages when no key is set, are returned as
+// they are.
+func signMessage(data []byte) []byte {
+	if signingKey == nil || len(data) < 2 || data[0] != '{' || data[len(data)-1] != '}' {
+		return data
+	}
+	body := data[:len(data)-1]
+	signed := make([]byte, 0, len(data)+len(*signingKeyID)+64)
+	signed = append(signed, body...)
+	if *signingKeyID != "" {
+		if !bytes.HasSuffix(body, []byte("{")) {
+			signed = append(signed, ',')
+		}
+		signed = append(signed, `"kid":"`...)
+		signed = append(signed, *signingKeyID...)
+		signed = append(signed, '"')
+	}
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write(signed)
+	mac.Write([]byte("}"))
+	if !bytes.HasSuffix(signed, []byte("{")) {
+		signed = append(signed, ',')
+	}
+	signed = append(signed, `"sig":"`...)
+	signed = append(signed, base64.RawURLEncoding.EncodeToString(mac.Sum(nil))...)
+	return append(signed, `"}`...)
+}
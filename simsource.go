@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+func init() {
+	registerSource("simulate", sourceType{new: newSimulator, hamilton: true})
+}
+
+// Motions the simulator generates
+const (
+	simSpin   = "spin"
+	simWander = "wander"
+)
+
+var (
+	simulate  = flag.Bool("simulate", false, "Generate a synthetic rotation instead of reading a sensor, short for -source simulate")
+	simMotion = flag.String("sim-motion", simSpin, "Motion of the simulator, spin about -sim-axis or wander between random orientations")
+	simRate   = flag.Float64("sim-rate", 50, "Samples per second generated by the simulator")
+	simAxis   = flag.String("sim-axis", "0,0,1", "Axis the simulator spins about, as x,y,z")
+	simSpeed  = flag.Float64("sim-speed", 90, "Rotation speed of the simulator in degrees per second")
+)
+
+// simSource generates a smooth synthetic rotation, for working on the viewer
+// without a sensor attached
+type simSource struct {
+	motion string
+	rate   float64
+	axis   [3]float64
+	speed  float64 // Radians per second
+
+	start     time.Time
+	ticker    *time.Ticker
+	from, to  Quaternion // Orientations wandered between
+	leg       time.Time  // When the current wander leg started
+	legLength time.Duration
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newSimulator creates the simulator, following it with a simulated IMU
+// with -sim-truth
+func newSimulator(cfg Config) Source {
+	if *simTruth {
+		return newSimTruthSource(cfg)
+	}
+	return newSimSource(cfg)
+}
+
+func newSimSource(Config) Source {
+	return &simSource{motion: *simMotion, rate: *simRate, speed: *simSpeed * math.Pi / 180}
+}
+
+func (s *simSource) String() string {
+	if s.motion == simSpin {
+		return fmt.Sprintf("simulated spin about %s", *simAxis)
+	}
+	return "simulated " + s.motion
+}
+
+func (s *simSource) Open() error {
+	if s.motion != simSpin && s.motion != simWander {
+		return fmt.Errorf("unknown simulator motion %q, must be %s or %s", s.motion, simSpin, simWander)
+	}
+	if s.rate <= 0 || s.rate > 10000 {
+		return fmt.Errorf("invalid simulator rate %v, must be between 0 and 10000", s.rate)
+	}
+	if err := s.startMotion(time.Now()); err != nil {
+		return err
+	}
+	s.ticker = time.NewTicker(time.Duration(float64(time.Second) / s.rate))
+	s.closed = make(chan struct{})
+	return nil
+}
+
+// startMotion checks the axis and starts the motion at the given time
+func (s *simSource) startMotion(now time.Time) error {
+	axis, err := parseAxis(*simAxis)
+	if err != nil {
+		return err
+	}
+	s.axis = axis
+	s.start = now
+	s.from, s.to = randomOrientation(), randomOrientation()
+	s.leg = s.start
+	s.legLength = s.wanderTime()
+	return nil
+}
+
+func (s *simSource) ReadQuaternion() (Quaternion, error) {
+	select {
+	case now := <-s.ticker.C:
+		return s.orientation(now), nil
+	case <-s.closed:
+		return Quaternion{}, errors.New("source closed")
+	}
+}
+
+// orientation returns the orientation of the motion at the given time, which
+// must not go backwards between calls
+func (s *simSource) orientation(now time.Time) Quaternion {
+	if s.motion == simSpin {
+		angle := s.speed * now.Sub(s.start).Seconds()
+		return axisAngle(s.axis, angle)
+	}
+	for now.Sub(s.leg) >= s.legLength {
+		s.leg = s.leg.Add(s.legLength)
+		s.from, s.to = s.to, randomOrientation()
+		s.legLength = s.wanderTime()
+	}
+	t := float64(now.Sub(s.leg)) / float64(s.legLength)
+	// Ease in and out so that each leg starts and ends at rest
+	return quat.Slerp(s.from, s.to, t*t*(3-2*t))
+}
+
+// wanderTime returns how long to take turning from s.from to s.to, the
+// angle between them at the configured speed and at least half a second
+func (s *simSource) wanderTime() time.Duration {
+	dot := math.Abs(s.from.I*s.to.I + s.from.J*s.to.J + s.from.K*s.to.K + s.from.Real*s.to.Real)
+	angle := 2 * math.Acos(math.Min(dot, 1))
+	return max(time.Duration(angle/s.speed*float64(time.Second)), 500*time.Millisecond)
+}
+
+// Close stops the simulator. It may be called from another goroutine, and
+// more than once.
+func (s *simSource) Close() error {
+	s.closeOnce.Do(func() {
+		s.ticker.Stop()
+		close(s.closed)
+	})
+	return nil
+}
+
+// parseAxis parses an axis given as x,y,z and normalizes it
+func parseAxis(text string) ([3]float64, error) {
+	var axis [3]float64
+	parts := strings.Split(text, ",")
+	if len(parts) != 3 {
+		return axis, fmt.Errorf("invalid axis %q, expected x,y,z", text)
+	}
+	var norm float64
+	for n, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return axis, fmt.Errorf("invalid axis %q, expected x,y,z", text)
+		}
+		axis[n] = v
+		norm += v * v
+	}
+	if norm == 0 {
+		return axis, fmt.Errorf("invalid axis %q, must not be zero", text)
+	}
+	norm = math.Sqrt(norm)
+	for n := range axis {
+		axis[n] /= norm
+	}
+	return axis, nil
+}
+
+// axisAngle returns the rotation by angle radians about a unit axis
+func axisAngle(axis [3]float64, angle float64) Quaternion {
+	sin, cos := math.Sincos(angle / 2)
+	return Quaternion{I: axis[0] * sin, J: axis[1] * sin, K: axis[2] * sin, Real: cos}
+}
+
+// randomOrientation returns a uniformly distributed random rotation
+func randomOrientation() Quaternion {
+	u1, u2, u3 := rand.Float64(), 2*math.Pi*rand.Float64(), 2*math.Pi*rand.Float64()
+	a, b := math.Sqrt(1-u1), math.Sqrt(u1)
+	return Quaternion{I: a * math.Sin(u2), J: a * math.Cos(u2), K: b * math.Sin(u3), Real: b * math.Cos(u3)}
+}
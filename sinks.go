@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sinkBatchSize is the most samples written to a sink in one request
+	sinkBatchSize = 500
+	// sinkMinBackoff and sinkMaxBackoff bound the delay between retries of a failing sink
+	sinkMinBackoff = time.Second
+	sinkMaxBackoff = time.Minute
+)
+
+// Sink states reported by /api/sinks
+const (
+	sinkIdle     = "idle"
+	sinkOK       = "ok"
+	sinkRetrying = "retrying"
+	sinkDisabled = "disabled"
+)
+
+var sinkQueueSize = flag.Int("sink-queue", 10000, "Number of samples held for each output sink while it is unreachable")
+
+// sink is an output that samples are forwarded to, such as a time series database
+type sink interface {
+	Kind() string
+	Target() string // Where samples are sent, without credentials
+	Write(samples []historySample) error
+}
+
+// sinkChecker is implemented by sinks that can check their destination is reachable
+type sinkChecker interface {
+	Check() error
+}
+
+// sinkRunner queues samples for a sink and writes them in batches from its
+// own goroutine, so that a slow or failing destination never holds up the
+// serial reader. Failed writes are retried with exponential backoff. With a
+// disk buffer, a full queue is moved to disk instead of being dropped, and
+// replayed at a limited rate once the sink has caught up.
+type sinkRunner struct {
+	name  string
+	sink  sink
+	spool *sinkSpool    // Disk buffer, nil when buffering in memory only
+	wake  chan struct{} // Signals that samples are queued
+	kick  chan struct{} // Cuts a backoff short
+
+	mu          sync.Mutex
+	queue       []historySample
+	replay      []historySample // Samples of the oldest disk segment still to be written
+	gen         int             // Incremented when the queue is discarded
+	disabled    bool
+	state       string
+	written     uint64
+	dropped     uint64
+	failures    uint64
+	consecutive int
+	lastError   string
+	lastErrorAt time.Time
+	lastSuccess time.Time
+	backoff     time.Duration
+	nextRetry   time.Time
+}
+
+// sinkStatus describes the health of a sink in /api/sinks
+type sinkStatus struct {
+	Name                string     `json:"name"`
+	Kind                string     `json:"kind"`
+	Target              string     `json:"target"`
+	Enabled             bool       `json:"enabled"`
+	State               string     `json:"state"`
+	Queued              int        `json:"queued"`
+	Buffered            int        `json:"buffered"`
+	BufferedBytes       int64      `json:"buffered_bytes"`
+	Written             uint64     `json:"written"`
+	Dropped             uint64     `json:"dropped"`
+	Failures            uint64     `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorTime       *time.Time `json:"last_error_time,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	NextRetry           *time.Time `json:"next_retry,omitempty"`
+	BackoffMS           int64      `json:"backoff_ms,omitempty"`
+}
+
+// sinks holds the configured output sinks by name. It is filled in by
+// startSinks before the server starts and not modified afterwards.
+var sinks = map[string]*sinkRunner{}
+
+// configuredSinks returns the sinks enabled by command line flags, by name
+func configuredSinks() (map[string]sink, error) {
+	out := make(map[string]sink)
+	if *influxURL != "" {
+		out["influx"] = newInfluxSink(*influxURL, *influxToken, *influxMeasurement)
+	}
+	if *mqttURL != "" {
+		s, err := newMQTTSink(*mqttURL, *mqttTopic)
+		if err != nil {
+			return nil, fmt.Errorf("-mqtt-url: %w", err)
+		}
+		out["mqtt"] = s
+	}
+	return out, nil
+}
+
+// startSinks starts a writer for every configured sink
+func startSinks() error {
+	configured, err := configuredSinks()
+	if err != nil {
+		return err
+	}
+	for name, s := range configured {
+		r := &sinkRunner{
+			name:  name,
+			sink:  s,
+			wake:  make(chan struct{}, 1),
+			kick:  make(chan struct{}, 1),
+			state: sinkIdle,
+		}
+		if *sinkBufferDir != "" {
+			spool, err := openSinkSpool(filepath.Join(*sinkBufferDir, name), int64(*sinkBufferMax)<<20, encryptionKey)
+			if err != nil {
+				log.Printf("Error opening disk buffer for sink %s: %v. Buffering in memory only", name, err)
+			} else {
+				r.spool = spool
+				if n, _ := spool.size(); n > 0 {
+					log.Printf("Sink %s has %d samples buffered on disk, replaying", name, n)
+					signalChan(r.wake)
+				}
+			}
+		}
+		sinks[name] = r
+		log.Printf("Forwarding samples to %s sink %s", s.Kind(), s.Target())
+		go r.run()
+	}
+	return nil
+}
+
+// forwardToSinks queues a sample for every enabled sink
+func forwardToSinks(s historySample) {
+	for _, r := range sinks {
+		r.add(s)
+	}
+}
+
+// add queues a sample. When the queue is full it is moved to the disk
+// buffer, or without one the oldest sample is dropped.
+func (r *sinkRunner) add(s historySample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled {
+		return
+	}
+	if len(r.queue) >= *sinkQueueSize && r.spool != nil {
+		dropped, err := r.spool.write(r.queue)
+		if err != nil {
+			log.Printf("Error buffering samples for sink %s on disk: %v", r.name, err)
+		} else {
+			r.queue = nil
+			r.gen++
+			r.dropped += uint64(dropped)
+		}
+	}
+	if len(r.queue) >= *sinkQueueSize {
+		r.queue[0] = historySample{}
+		r.queue = r.queue[1:]
+		r.dropped++
+	}
+	r.queue = append(r.queue, s)
+	signalChan(r.wake)
+}
+
+// spillSinks moves the queues of sinks with a disk buffer to disk, so that
+// samples not yet written survive a restart
+func spillSinks() {
+	for _, r := range sinks {
+		r.mu.Lock()
+		if r.spool != nil && len(r.queue) > 0 {
+			if _, err := r.spool.write(r.queue); err != nil {
+				log.Printf("Error buffering samples for sink %s on disk: %v", r.name, err)
+			} else {
+				r.queue = nil
+				r.gen++
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// signalChan does a non-blocking send on a wake-up channel
+func signalChan(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// run writes queued samples until the queue is empty, backing off after
+// failures. Samples buffered on disk are older than those in the queue, so
+// they are written first, no faster than -sink-replay-rate.
+func (r *sinkRunner) run() {
+	for range r.wake {
+		for {
+			batch, gen, replay, ok := r.batch()
+			if !ok {
+				break
+			}
+			wait := r.finish(len(batch), gen, replay, r.sink.Write(batch))
+			if wait == 0 && replay && *sinkReplayRate > 0 {
+				time.Sleep(time.Duration(len(batch)) * time.Second / time.Duration(*sinkReplayRate))
+				continue
+			}
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-r.kick:
+				}
+			}
+		}
+	}
+}
+
+// batch returns the oldest samples waiting to be written without removing
+// them, and whether they were replayed from the disk buffer
+func (r *sinkRunner) batch() (samples []historySample, gen int, replay bool, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled {
+		return nil, 0, false, false
+	}
+	if len(r.replay) == 0 && r.spool != nil && len(r.spool.segments) > 0 {
+		loaded, err := r.spool.oldest()
+		if err != nil {
+			log.Printf("Error reading disk buffer of sink %s, discarding segment: %v", r.name, err)
+			r.dropped += uint64(r.spool.segments[0].samples)
+			r.spool.remove()
+		}
+		r.replay = loaded
+	}
+	if len(r.replay) > 0 {
+		n := min(len(r.replay), sinkBatchSize)
+		return append([]historySample(nil), r.replay[:n]...), r.gen, true, true
+	}
+	if len(r.queue) == 0 {
+		return nil, 0, false, false
+	}
+	n := min(len(r.queue), sinkBatchSize)
+	return append([]historySample(nil), r.queue[:n]...), r.gen, false, true
+}
+
+// finish records the result of writing a batch and returns how long to wait
+// before the next attempt
+func (r *sinkRunner) finish(n, gen int, replay bool, err error) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if err == nil {
+		switch {
+		case replay && len(r.replay) >= n:
+			r.replay = r.replay[n:]
+			if len(r.replay) == 0 {
+				// The segment is only deleted once all of it has been written
+				r.spool.remove()
+			}
+		case !replay && gen == r.gen:
+			r.queue = r.queue[n:]
+		}
+		r.written += uint64(n)
+		r.lastSuccess = now
+		r.consecutive = 0
+		r.backoff = 0
+		r.nextRetry = time.Time{}
+		if !r.disabled {
+			if r.state == sinkRetrying {
+				log.Printf("Sink %s recovered", r.name)
+			}
+			r.state = sinkOK
+		}
+		return 0
+	}
+
+	r.failures++
+	r.consecutive++
+	r.lastError = err.Error()
+	r.lastErrorAt = now
+	if r.disabled {
+		return 0
+	}
+	switch {
+	case r.backoff == 0:
+		r.backoff = sinkMinBackoff
+	case r.backoff < sinkMaxBackoff:
+		r.backoff = min(r.backoff*2, sinkMaxBackoff)
+	}
+	r.nextRetry = now.Add(r.backoff)
+	if r.state != sinkRetrying {
+		log.Printf("Error writing to sink %s: %v. Retrying with backoff...", r.name, err)
+	}
+	r.state = sinkRetrying
+	return r.backoff
+}
+
+// setEnabled enables or disables the sink. A disabled sink discards its
+// queue and ignores new samples until it is enabled again.
+func (r *sinkRunner) setEnabled(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if enabled == !r.disabled {
+		return
+	}
+	r.disabled = !enabled
+	if r.disabled {
+		// Samples already on disk are kept and replayed when re-enabled
+		r.queue = nil
+		r.replay = nil
+		r.gen++
+		r.state = sinkDisabled
+	} else {
+		r.state = sinkIdle
+	}
+	r.consecutive = 0
+	r.backoff = 0
+	r.nextRetry = time.Time{}
+	signalChan(r.kick)
+}
+
+// retry cuts a backoff short so that the next write is attempted now
+func (r *sinkRunner) retry() {
+	r.mu.Lock()
+	r.nextRetry = time.Time{}
+	r.mu.Unlock()
+	signalChan(r.kick)
+}
+
+func (r *sinkRunner) status() sinkStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := sinkStatus{
+		Name:                r.name,
+		Kind:                r.sink.Kind(),
+		Target:              r.sink.Target(),
+		Enabled:             !r.disabled,
+		State:               r.state,
+		Queued:              len(r.queue),
+		Written:             r.written,
+		Dropped:             r.dropped,
+		Failures:            r.failures,
+		ConsecutiveFailures: r.consecutive,
+		LastError:           r.lastError,
+		BackoffMS:           r.backoff.Milliseconds(),
+	}
+	if r.spool != nil {
+		st.Buffered, st.BufferedBytes = r.spool.size()
+	}
+	if !r.lastErrorAt.IsZero() {
+		t := r.lastErrorAt
+		st.LastErrorTime = &t
+	}
+	if !r.lastSuccess.IsZero() {
+		t := r.lastSuccess
+		st.LastSuccess = &t
+	}
+	if !r.nextRetry.IsZero() {
+		t := r.nextRetry
+		st.NextRetry = &t
+	}
+	return st
+}
+
+// sinkStatuses returns the status of every sink, sorted by name
+func sinkStatuses() []sinkStatus {
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]sinkStatus, 0, len(names))
+	for _, name := range names {
+		list = append(list, sinks[name].status())
+	}
+	return list
+}
+
+// handleSinks lists the output sinks with their health, and enables,
+// disables or retries one of them, e.g. POST /api/sinks/influx/disable
+func handleSinks(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sinks"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sinkStatuses())
+		return
+	}
+
+	name, action, _ := strings.Cut(path, "/")
+	s, ok := sinks[name]
+	if !ok {
+		http.Error(w, "unknown sink "+name, http.StatusNotFound)
+		return
+	}
+	if action == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.status())
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "enable":
+		log.Printf("Enabling sink %s", name)
+		s.setEnabled(true)
+	case "disable":
+		log.Printf("Disabling sink %s", name)
+		s.setEnabled(false)
+	case "retry":
+		s.retry()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.status())
+}
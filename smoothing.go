@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// smoothingInfo describes the low-pass filter of a namespace
+type smoothingInfo struct {
+	Seconds    float64 `json:"seconds"`    // Time constant or window length, 0 when off
+	Method     string  `json:"method"`     // "exponential" or "window"
+	Overridden bool    `json:"overridden"` // Set through /api/smoothing rather than the configuration
+}
+
+// smoothingOverride replaces the smoothing settings of the configuration
+type smoothingOverride struct {
+	Seconds float64
+	Method  string
+}
+
+// smoothingRequest is the body of POST /api/smoothing, settings left out
+// are kept
+type smoothingRequest struct {
+	Seconds *float64 `json:"seconds"`
+	Method  *string  `json:"method"`
+}
+
+// maxSmoothing bounds the smoothing set at runtime, seconds
+const maxSmoothing = 60
+
+func (ns *namespace) smoothingInfo() smoothingInfo {
+	cfg := ns.config()
+	return smoothingInfo{Seconds: cfg.Smoothing, Method: cfg.SmoothMethod, Overridden: ns.smoothing.Load() != nil}
+}
+
+// handleSmoothing changes the low-pass filter of the namespace at runtime:
+//
+//	GET  /api/smoothing          the filter in effect
+//	POST /api/smoothing          set "seconds" and "method", 0 seconds for none
+//	POST /api/smoothing/reset    go back to the configuration
+//
+// Clients are told of changes with a "smoothing" event.
+func handleSmoothing(w http.ResponseWriter, r *http.Request) {
+	ns := requestNamespace(r)
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/smoothing"), "/")
+	if action == "" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ns.smoothingInfo())
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "":
+		var req smoothingRequest
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		cur := ns.smoothingInfo()
+		set := smoothingOverride{Seconds: cur.Seconds, Method: cur.Method}
+		if req.Seconds != nil {
+			if *req.Seconds < 0 || *req.Seconds > maxSmoothing {
+				http.Error(w, fmt.Sprintf("seconds must be between 0 and %d", maxSmoothing), http.StatusBadRequest)
+				return
+			}
+			set.Seconds = *req.Seconds
+		}
+		if req.Method != nil {
+			method, err := parseSmoothMethod(*req.Method)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			set.Method = method
+		}
+		ns.smoothing.Store(&set)
+		log.Printf("Smoothing of the %s namespace set to %gs (%s)", ns, set.Seconds, set.Method)
+	case "reset":
+		ns.smoothing.Store(nil)
+		log.Printf("Smoothing of the %s namespace reset to the configuration", ns)
+	default:
+		http.Error(w, "unknown smoothing action "+action, http.StatusNotFound)
+		return
+	}
+	info := ns.smoothingInfo()
+	ns.broadcastEvent("smoothing", info)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
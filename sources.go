@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/intermernet/quatplot/serialreader"
+)
+
+// Source is an input that produces quaternions, such as a serial port. The
+// same source may be opened again after it has been closed.
+type Source = serialreader.Source
+
+// sourceType creates sources of one kind from the configuration
+type sourceType struct {
+	new      func(cfg Config) Source
+	once     bool // The input ends at EOF instead of being reopened, like stdin
+	hamilton bool // Quaternions are already in the Hamilton convention, like recordings
+}
+
+// sourceTypes holds the kinds of source selectable with -source, by name
+var sourceTypes = map[string]sourceType{}
+
+// registerSource makes a kind of source selectable with -source
+func registerSource(name string, t sourceType) {
+	sourceTypes[name] = t
+}
+
+// sourceNames returns the names of the registered kinds of source, sorted
+func sourceNames() []string {
+	names := make([]string, 0, len(sourceTypes))
+	for name := range sourceTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// taggedSource is implemented by sources whose samples carry the ID of the
+// device they came from, like recordings of several sensors
+type taggedSource interface {
+	ReadTagged() (device string, quat Quaternion, err error)
+}
+
+// lineReader parses quaternions from a stream of text lines, one per line,
+// or of binary packets when the format has a packet framing, skipping those
+// that don't parse. Every line is recorded in the preview buffer, packets in hex.
+type lineReader struct {
+	scanner *bufio.Scanner
+	format  *lineFormat
+	preview *previewBuffer
+}
+
+func newLineReader(r io.Reader, format *lineFormat, preview *previewBuffer) *lineReader {
+	scanner := bufio.NewScanner(r)
+	if format.packet != nil {
+		scanner.Split(format.packet.split)
+	}
+	return &lineReader{scanner: scanner, format: format, preview: preview}
+}
+
+func (l *lineReader) next() (Quaternion, error) {
+	for l.scanner.Scan() {
+		var (
+			line string
+			quat Quaternion
+			err  error
+		)
+		if l.format.packet != nil {
+			line = hex.EncodeToString(l.scanner.Bytes())
+			quat, err = l.format.parsePacket(l.scanner.Bytes())
+			if errors.Is(err, errNoSample) {
+				continue
+			}
+		} else {
+			line = l.scanner.Text()
+			quat, err = l.format.parse(line)
+		}
+		l.preview.add(line, quat, err)
+		if err != nil {
+			log.Printf("Error parsing quaternion: %v (line: %s)", err, line)
+			continue
+		}
+		return quat, nil
+	}
+	if err := l.scanner.Err(); err != nil {
+		return Quaternion{}, err
+	}
+	return Quaternion{}, io.EOF
+}
+
+// sourceRunner reads from a source and feeds its quaternions to the
+// broadcaster, reopening it when it fails. Each runner can be restarted or
+// disabled at runtime without affecting the others.
+type sourceRunner struct {
+	id     string
+	kind   string
+	device string // ID the samples are tagged with, empty when untagged
+	spec   string // Port of a tagged serial device
+	typ    sourceType
+	ns     *namespace
+
+	statusMu sync.RWMutex
+	status   serialStatus
+
+	mu       sync.Mutex
+	active   Source    // Open source, nil while connecting
+	opened   time.Time // When the source was opened, or last restarted by the watchdog
+	disabled bool
+	enabled  chan struct{} // Closed when a disabled source is enabled again
+	kick     chan struct{} // Cuts a backoff short
+	closing  bool          // The open source is being closed on purpose
+
+	failures    int       // Failed attempts in a row to open the source
+	nextAttempt time.Time // When the source is opened again, zero unless backing off
+
+	lastSample atomic.Int64 // Unix time in nanoseconds of the last sample read, for the watchdog
+}
+
+// sourceInfo describes a source in /api/sources
+type sourceInfo struct {
+	ID      string       `json:"id"`
+	Kind    string       `json:"kind"`
+	Enabled bool         `json:"enabled"`
+	Status  serialStatus `json:"status"`
+
+	Failures    int        `json:"failures,omitempty"`     // Failed attempts in a row to open it
+	NextAttempt *time.Time `json:"next_attempt,omitempty"` // While backing off
+}
+
+var startSourcesOnce sync.Once
+
+// initSources creates the runners for the configured kind of source, one
+// for each port when several serial ports are given
+func (ns *namespace) initSources(cfg Config) error {
+	typ, ok := sourceTypes[cfg.Source]
+	if !ok {
+		return fmt.Errorf("unknown source %q, must be one of %s", cfg.Source, strings.Join(sourceNames(), ", "))
+	}
+	// Raw captures are played a port at a time, like they were read
+	if cfg.Source != "serial" && cfg.Source != "raw" {
+		ns.sources[cfg.Source] = &sourceRunner{id: cfg.Source, kind: cfg.Source, typ: typ, ns: ns, status: newStatus(), kick: make(chan struct{}, 1)}
+		// The devices of a tagged source are only known once it sends samples
+		src := typ.new(cfg)
+		if _, tagged := src.(taggedSource); !tagged {
+			ns.devices = []string{""}
+		}
+		if _, ok := src.(*simTruthSource); ok {
+			ns.truth = newTruthMeter()
+		}
+		return nil
+	}
+
+	ports, err := parseDevicePorts(cfg.Port)
+	if err != nil {
+		return err
+	}
+	for _, p := range ports {
+		s := &sourceRunner{id: cfg.Source, kind: cfg.Source, typ: typ, ns: ns, status: newStatus(), kick: make(chan struct{}, 1)}
+		if p.ID != "" {
+			s.id, s.device, s.spec = p.ID, p.ID, p.Spec
+		}
+		ns.sources[s.id] = s
+		ns.devices = append(ns.devices, p.ID)
+	}
+	return nil
+}
+
+// sourceList returns the runners of the namespace, sorted by ID
+func (ns *namespace) sourceList() []*sourceRunner {
+	ids := make([]string, 0, len(ns.sources))
+	for id := range ns.sources {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	list := make([]*sourceRunner, len(ids))
+	for n, id := range ids {
+		list[n] = ns.sources[id]
+	}
+	return list
+}
+
+// startSources starts reading from the sources of every namespace if they
+// aren't already running
+func startSources() {
+	startSourcesOnce.Do(func() {
+		for _, ns := range namespaces() {
+			for _, s := range ns.sources {
+				go s.run()
+				if timeout := watchdogTimeout(); timeout > 0 {
+					go s.watch(timeout)
+				}
+			}
+			if *idleHeartbeat > 0 {
+				go ns.heartbeat(*idleHeartbeat)
+			}
+			if *logAttitude > 0 {
+				go ns.logAttitudes(*logAttitude)
+			}
+		}
+	})
+}
+
+// restartSources closes every open source of the default namespace so that
+// it is reopened with the current configuration
+func restartSources() {
+	for _, s := range defaultNamespace.sources {
+		s.restart()
+	}
+}
+
+// stopSources closes the sources of every namespace for good
+func stopSources() {
+	for _, ns := range namespaces() {
+		for _, s := range ns.sources {
+			s.disable()
+		}
+	}
+}
+
+// sourceName names the device or address a source reads from, for logs and
+// the status endpoint
+func sourceName(src Source) string {
+	if s, ok := src.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", src)
+}
+
+// run reads from the source until it ends, reopening it whenever it is closed
+func (s *sourceRunner) run() {
+	failures := 0
+	for {
+		cfg := s.ns.config()
+		if s.spec != "" {
+			cfg.Port = s.spec
+		}
+		src := s.typ.new(cfg)
+		name := sourceName(src)
+		if !s.info().Enabled {
+			s.setStatus(serialStatus{State: serialDisabled, Port: name})
+			s.waitEnabled()
+			continue
+		}
+
+		if err := src.Open(); err != nil {
+			failures++
+			st := classifyOpenError(name, err)
+			if *reconnectAttempts > 0 && failures >= *reconnectAttempts {
+				s.giveUp(name, st, failures, err)
+				failures = 0
+				continue
+			}
+			// Only log when the failure changes, the status endpoint always has the latest
+			if s.setStatus(st) {
+				log.Printf("Error opening %s: %v. Retrying with backoff...", name, err)
+				if st.Hint != "" {
+					log.Printf("Hint: %s", st.Hint)
+				}
+			}
+			s.backOff(failures)
+			continue
+		}
+		s.setStatus(serialStatus{State: serialConnected, Port: name})
+		s.setActive(src)
+		s.setFailures(0)
+		openedAt := time.Now()
+		log.Printf("Successfully opened %s", name)
+
+		var err error
+		tagged, _ := src.(taggedSource)
+		pipe := newPipeline(cfg.pipelineInfo())
+		outliers := newOutlierFilter()
+		smoothing := s.ns.smoothing.Load()
+		warnedNonFinite := false
+		for s.info().Enabled {
+			if o := s.ns.smoothing.Load(); o != smoothing {
+				// Changed through /api/smoothing
+				cfg, smoothing = s.ns.config(), o
+				pipe = newPipeline(cfg.pipelineInfo())
+			}
+			device, quat := s.device, Quaternion{}
+			if tagged != nil {
+				device, quat, err = tagged.ReadTagged()
+			} else {
+				quat, err = src.ReadQuaternion()
+			}
+			if err != nil {
+				break
+			}
+			s.lastSample.Store(time.Now().UnixNano())
+			if !isFinite(quat) {
+				// Such as "NaN" in a line, or a float32 packet read out of
+				// step. It can't be shown, and JSON can't encode it.
+				if !warnedNonFinite {
+					log.Printf("Ignoring samples from %s with NaN or infinite components", name)
+					warnedNonFinite = true
+				}
+				continue
+			}
+			if !s.typ.hamilton && cfg.inputKind() == inputQuaternion {
+				quat = toHamilton(quat, cfg.Convention)
+			}
+			outlier := outliers.outlier(device, quat, time.Now())
+			if outlier {
+				s.ns.outliers.Add(1)
+				if *outlierAction == outlierDrop {
+					continue
+				}
+			}
+			if _, truth := src.(*simTruthSource); !truth || device != simTruthDevice {
+				// The true orientation is what the pipeline is measured against
+				quat = s.ns.tare.apply(device, pipe.apply(device, quat, time.Now()))
+			}
+			s.ns.broadcastQuaternion(device, quat, outlier)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("Error reading from %s: %v", name, err)
+		}
+
+		s.setActive(nil)
+		src.Close()
+		if s.typ.once && errors.Is(err, io.EOF) {
+			s.setStatus(serialStatus{State: serialEnded, Port: name, Message: "end of input"})
+			log.Printf("End of input from %s", name)
+			return
+		}
+		s.setStatus(serialStatus{State: serialConnecting, Port: name, Message: "source closed"})
+		log.Printf("%s closed. Reconnecting...", name)
+		if !s.closedOnPurpose() && time.Since(openedAt) < sourceStable {
+			// Dropped straight away, e.g. a device that is being unplugged
+			failures++
+			s.backOff(failures)
+		} else {
+			failures = 0
+		}
+	}
+}
+
+// setActive records the open source, closing it straight away if the runner
+// was disabled while it was being opened
+func (s *sourceRunner) setActive(src Source) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = src
+	s.opened = time.Now()
+	if src != nil && s.disabled {
+		src.Close()
+	}
+}
+
+// restart closes the open source so that the runner reopens it, or cuts
+// its backoff short while it isn't open
+func (s *sourceRunner) restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active != nil {
+		s.closing = true
+		s.active.Close()
+		return
+	}
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// closedOnPurpose reports whether the source was last closed by restart or
+// disable rather than by an error
+func (s *sourceRunner) closedOnPurpose() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	closing := s.closing
+	s.closing = false
+	return closing || s.disabled
+}
+
+// setFailures records the failed attempts in a row to open the source
+func (s *sourceRunner) setFailures(n int) {
+	s.mu.Lock()
+	s.failures = n
+	s.mu.Unlock()
+}
+
+func (s *sourceRunner) info() sourceInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := sourceInfo{ID: s.id, Kind: s.kind, Enabled: !s.disabled, Status: s.getStatus(), Failures: s.failures}
+	if !s.nextAttempt.IsZero() {
+		next := s.nextAttempt
+		info.NextAttempt = &next
+	}
+	return info
+}
+
+// disable closes the source and keeps it closed until enable is called
+func (s *sourceRunner) disable() {
+	s.mu.Lock()
+	if !s.disabled {
+		s.disabled = true
+		s.enabled = make(chan struct{})
+	}
+	s.mu.Unlock()
+	s.restart()
+}
+
+// enable lets a disabled source reconnect
+func (s *sourceRunner) enable() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disabled {
+		s.disabled = false
+		close(s.enabled)
+	}
+}
+
+// waitEnabled blocks while the source is disabled
+func (s *sourceRunner) waitEnabled() {
+	s.mu.Lock()
+	ch := s.enabled
+	disabled := s.disabled
+	s.mu.Unlock()
+	if disabled {
+		<-ch
+	}
+}
+
+// handleSources lists the input sources, and restarts, disables or enables
+// one of them, e.g. POST /api/sources/serial/restart
+func handleSources(w http.ResponseWriter, r *http.Request) {
+	sources := requestNamespace(r).sources
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sources"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		list := []sourceInfo{}
+		for _, s := range requestNamespace(r).sourceList() {
+			list = append(list, s.info())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	id, action, _ := strings.Cut(path, "/")
+	s, ok := sources[id]
+	if !ok {
+		http.Error(w, "unknown source "+id, http.StatusNotFound)
+		return
+	}
+	if action == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.info())
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "restart":
+		if !s.info().Enabled {
+			http.Error(w, "source "+id+" is disabled", http.StatusConflict)
+			return
+		}
+		log.Printf("Restarting source %s", id)
+		s.ns.announceRestart("source", time.Second)
+		s.restart()
+	case "disable":
+		log.Printf("Disabling source %s", id)
+		s.disable()
+	case "enable":
+		log.Printf("Enabling source %s", id)
+		s.enable()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.info())
+}
+
+// isFinite reports whether every component of q is a number
+func isFinite(q Quaternion) bool {
+	for _, v := range [4]float64{q.I, q.J, q.K, q.Real} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
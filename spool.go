@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	sinkBufferDir  = flag.String("sink-buffer-dir", "", "Directory where samples for unreachable output sinks are buffered on disk (default: memory only)")
+	sinkBufferMax  = flag.Int("sink-buffer-max", 256, "Maximum size in MB of each sink's disk buffer")
+	sinkReplayRate = flag.Int("sink-replay-rate", 2000, "Maximum samples per second replayed to a sink from its disk buffer")
+)
+
+// sinkSpool stores samples a sink couldn't take in time as segment files of
+// JSON lines, oldest first, so they can be replayed once it is reachable.
+// Segments left over from a previous run are replayed too. With a key the
+// segments are encrypted.
+type sinkSpool struct {
+	dir      string
+	maxBytes int64
+	key      []byte
+	segments []spoolSegment
+}
+
+// spoolSegment is one file of buffered samples
+type spoolSegment struct {
+	path    string
+	samples int
+	bytes   int64
+}
+
+// openSinkSpool opens the buffer directory of a sink, picking up any segments
+// already in it. Encrypted segments are skipped when no key is given.
+func openSinkSpool(dir string, maxBytes int64, key []byte) (*sinkSpool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jsonl*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	s := &sinkSpool{dir: dir, maxBytes: maxBytes, key: key}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		seg := spoolSegment{path: path, bytes: info.Size()}
+		data, err := s.read(path)
+		if err != nil {
+			log.Printf("Skipping buffered samples in %s: %v", path, err)
+			continue
+		}
+		seg.samples = bytes.Count(data, []byte("\n"))
+		s.segments = append(s.segments, seg)
+	}
+	return s, nil
+}
+
+// read returns the JSON lines of a segment, decrypting it if needed
+func (s *sinkSpool) read(path string) ([]byte, error) {
+	if !strings.HasSuffix(path, ".enc") {
+		return os.ReadFile(path)
+	}
+	if s.key == nil {
+		return nil, errors.New("segment is encrypted and no encryption key is set")
+	}
+	return readSealedFile(path, s.key)
+}
+
+// size returns the number of samples and bytes buffered
+func (s *sinkSpool) size() (samples int, size int64) {
+	for _, seg := range s.segments {
+		samples += seg.samples
+		size += seg.bytes
+	}
+	return samples, size
+}
+
+// write stores samples as a new segment. When the buffer would grow past its
+// limit the oldest segments are deleted, and the number of samples lost is returned.
+func (s *sinkSpool) write(samples []historySample) (dropped int, err error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, sample := range samples {
+		if err := enc.Encode(sample); err != nil {
+			return 0, err
+		}
+	}
+
+	// Names sort in the order segments were written
+	path := filepath.Join(s.dir, fmt.Sprintf("%019d.jsonl", time.Now().UnixNano()))
+	if s.key != nil {
+		path += ".enc"
+		err = writeSealedFile(path, buf.Bytes(), s.key)
+	} else {
+		err = os.WriteFile(path, buf.Bytes(), 0o600)
+	}
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	s.segments = append(s.segments, spoolSegment{path: path, samples: len(samples), bytes: info.Size()})
+
+	for _, total := s.size(); total > s.maxBytes && len(s.segments) > 1; _, total = s.size() {
+		dropped += s.segments[0].samples
+		s.remove()
+	}
+	return dropped, nil
+}
+
+// oldest reads the samples of the oldest segment without removing it
+func (s *sinkSpool) oldest() ([]historySample, error) {
+	if len(s.segments) == 0 {
+		return nil, nil
+	}
+	data, err := s.read(s.segments[0].path)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []historySample
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var sample historySample
+		if err := json.Unmarshal([]byte(line), &sample); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.segments[0].path, err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, scanner.Err()
+}
+
+// remove deletes the oldest segment
+func (s *sinkSpool) remove() {
+	if len(s.segments) == 0 {
+		return
+	}
+	os.Remove(s.segments[0].path)
+	s.segments = s.segments[1:]
+}
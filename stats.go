@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rateWindow is the number of whole seconds averaged for rates
+const rateWindow = 5
+
+// rateMeter counts events or bytes and their rate over the last few seconds
+type rateMeter struct {
+	mu      sync.Mutex
+	total   uint64
+	buckets [rateWindow]uint64
+	stamps  [rateWindow]int64
+}
+
+// add records n units at the current time
+func (m *rateMeter) add(n int) {
+	now := time.Now().Unix()
+	idx := now % rateWindow
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stamps[idx] != now {
+		m.stamps[idx] = now
+		m.buckets[idx] = 0
+	}
+	m.buckets[idx] += uint64(n)
+	m.total += uint64(n)
+}
+
+// read returns the running total and the average rate per second over the
+// last completed seconds
+func (m *rateMeter) read() (total uint64, perSec float64) {
+	now := time.Now().Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sum uint64
+	for idx, stamp := range m.stamps {
+		if stamp < now && stamp >= now-rateWindow {
+			sum += m.buckets[idx]
+		}
+	}
+	return m.total, float64(sum) / rateWindow
+}
+
+var (
+	startTime    = time.Now()
+	samplesIn    rateMeter
+	bytesSent    rateMeter
+	messagesSent rateMeter
+)
+
+// clientStats are the traffic counters of one WebSocket client
+type clientStats struct {
+	ID             int64     `json:"id"`
+	Tenant         string    `json:"tenant,omitempty"` // Tenant the client is connected to, omitted for the default namespace
+	Addr           string    `json:"addr"`
+	Connected      time.Time `json:"connected"`
+	BytesSent      uint64    `json:"bytes_sent"`
+	BytesPerSec    float64   `json:"bytes_per_sec"`
+	MessagesSent   uint64    `json:"messages_sent"`
+	MessagesPerSec float64   `json:"messages_per_sec"`
+	PendingEvents  int       `json:"pending_events"`
+	Conflated      uint64    `json:"conflated"` // Samples replaced by a newer one before being sent
+	Skipped        uint64    `json:"skipped"`   // Samples skipped by the adaptive rate limit
+	RateLimited    bool      `json:"rate_limited"`
+	MaxRate        float64   `json:"max_rate_hz,omitempty"` // Adaptive rate limit, omitted when unlimited
+	Units          unitPrefs `json:"units"`
+	Client         string    `json:"client,omitempty"`      // Name the client gave in its hello, omitted when it sent none
+	Handshaking    bool      `json:"handshaking,omitempty"` // Still to complete the handshake of -client-protocol strict
+	// Subscription is what the client asked to be sent, omitted unless it did
+	Subscription *subscriptionInfo `json:"subscription,omitempty"`
+}
+
+// serverStats are the counters reported by /api/stats
+type serverStats struct {
+	Uptime         string        `json:"uptime"`
+	SamplesIn      uint64        `json:"samples_received"`
+	InputRate      float64       `json:"input_rate_hz"`
+	Outliers       uint64        `json:"outliers"` // Samples dropped or flagged as outliers, see -outlier-angle
+	Units          unitPrefs     `json:"units"`
+	Clients        int           `json:"clients"`
+	BytesSent      uint64        `json:"bytes_sent"`
+	BytesPerSec    float64       `json:"bytes_per_sec"`
+	MessagesSent   uint64        `json:"messages_sent"`
+	MessagesPerSec float64       `json:"messages_per_sec"`
+	PerClient      []clientStats `json:"per_client"`
+	Noise          []noiseStats  `json:"noise"`                  // Mean orientation and jitter of each device over -jitter-window
+	FilterError    *filterError  `json:"filter_error,omitempty"` // Error of the measured stream against the truth, with -sim-truth
+
+	Recording *recordingStats `json:"recording,omitempty"`
+	Uploads   *uploadStats    `json:"uploads,omitempty"` // Archiving of finished recordings to -storage
+	Retention *retentionStats `json:"retention,omitempty"`
+	Clock     *clockStats     `json:"clock,omitempty"`
+}
+
+// collectStats snapshots the counters seen from a namespace. The default
+// namespace sees the whole server, a tenant only its own input and clients.
+func collectStats(ns *namespace) serverStats {
+	var st serverStats
+	st.Uptime = time.Since(startTime).Round(time.Second).String()
+	st.Units = prefsFor(ns.config().AngleUnits)
+	st.Noise = ns.noise.stats(time.Now())
+	st.FilterError = ns.truth.stats(ns.config(), time.Now())
+	list := []*namespace{ns}
+	if ns == defaultNamespace {
+		list = namespaces()
+		st.SamplesIn, st.InputRate = samplesIn.read()
+		st.BytesSent, st.BytesPerSec = bytesSent.read()
+		st.MessagesSent, st.MessagesPerSec = messagesSent.read()
+		if activeRecorder != nil {
+			st.Recording = activeRecorder.stats()
+		}
+		if refClock != nil {
+			st.Clock = refClock.stats()
+		}
+		if activeUploader != nil {
+			st.Uploads = activeUploader.stats()
+		}
+		st.Retention = retentionInfo()
+	} else {
+		st.SamplesIn, st.InputRate = ns.samplesIn.read()
+	}
+
+	for _, ns := range list {
+		st.Outliers += ns.outliers.Load()
+		ns.clientsMu.Lock()
+		for _, c := range ns.clients {
+			st.PerClient = append(st.PerClient, c.stats())
+		}
+		ns.clientsMu.Unlock()
+	}
+	if ns != defaultNamespace {
+		for _, cs := range st.PerClient {
+			st.BytesSent += cs.BytesSent
+			st.BytesPerSec += cs.BytesPerSec
+			st.MessagesSent += cs.MessagesSent
+			st.MessagesPerSec += cs.MessagesPerSec
+		}
+	}
+
+	st.Clients = len(st.PerClient)
+	sort.Slice(st.PerClient, func(a, b int) bool { return st.PerClient[a].ID < st.PerClient[b].ID })
+	if st.PerClient == nil {
+		st.PerClient = []clientStats{}
+	}
+	return st
+}
+
+// stats snapshots the client's counters
+func (c *client) stats() clientStats {
+	events, _ := c.out.Pending()
+	c.mu.Lock()
+	cs := clientStats{
+		ID:            c.id,
+		Tenant:        c.ns.name,
+		Addr:          c.addr,
+		Connected:     c.connected,
+		PendingEvents: events,
+		Conflated:     c.conflated,
+		Skipped:       c.skipped,
+		RateLimited:   c.interval > 0,
+		Units:         prefsFor(c.units),
+		Client:        c.name,
+		Handshaking:   c.handshaking,
+	}
+	if c.interval > 0 {
+		cs.MaxRate = float64(time.Second) / float64(c.interval)
+	}
+	if c.sub.isSet() {
+		info := c.subscriptionInfo()
+		cs.Subscription = &info
+	}
+	c.mu.Unlock()
+	cs.BytesSent, cs.BytesPerSec = c.bytes.read()
+	cs.MessagesSent, cs.MessagesPerSec = c.messages.read()
+	return cs
+}
+
+// handleStats reports broadcast traffic totals and per-client rates as JSON
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collectStats(requestNamespace(r)))
+}
+
+// handleMetrics reports the same counters in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	st := collectStats(defaultNamespace)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, kind, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+	}
+	clientMetric := func(name, kind, help string, value func(clientStats) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, c := range st.PerClient {
+			fmt.Fprintf(w, "%s{client=\"%d\",addr=%q} %g\n", name, c.ID, c.Addr, value(c))
+		}
+	}
+
+	metric("quatplot_samples_received_total", "counter", "Samples read from the sensor.", float64(st.SamplesIn))
+	metric("quatplot_input_rate_hz", "gauge", "Rate of samples read from the sensor.", st.InputRate)
+	metric("quatplot_outliers_total", "counter", "Samples dropped or flagged for turning further than -outlier-angle from the previous one.", float64(st.Outliers))
+	metric("quatplot_clients", "gauge", "Connected WebSocket clients.", float64(st.Clients))
+	metric("quatplot_ws_bytes_sent_total", "counter", "Bytes sent to WebSocket clients.", float64(st.BytesSent))
+	metric("quatplot_ws_bytes_per_second", "gauge", "Bytes per second sent to WebSocket clients.", st.BytesPerSec)
+	metric("quatplot_ws_messages_sent_total", "counter", "Messages sent to WebSocket clients.", float64(st.MessagesSent))
+	clientMetric("quatplot_client_bytes_sent_total", "counter", "Bytes sent to one WebSocket client.",
+		func(c clientStats) float64 { return float64(c.BytesSent) })
+	clientMetric("quatplot_client_bytes_per_second", "gauge", "Bytes per second sent to one WebSocket client.",
+		func(c clientStats) float64 { return c.BytesPerSec })
+	clientMetric("quatplot_client_messages_sent_total", "counter", "Messages sent to one WebSocket client.",
+		func(c clientStats) float64 { return float64(c.MessagesSent) })
+	clientMetric("quatplot_client_conflated_total", "counter", "Samples replaced by a newer one before reaching the client.",
+		func(c clientStats) float64 { return float64(c.Conflated) })
+	clientMetric("quatplot_client_max_rate_hz", "gauge", "Adaptive rate limit of the client, 0 when unlimited.",
+		func(c clientStats) float64 { return c.MaxRate })
+
+	fmt.Fprintf(w, "# HELP quatplot_still Whether a device has stayed within -still-threshold of its mean orientation over -jitter-window.\n# TYPE quatplot_still gauge\n")
+	for _, n := range st.Noise {
+		still := 0
+		if n.Still {
+			still = 1
+		}
+		fmt.Fprintf(w, "quatplot_still{device=%q} %d\n", n.ID, still)
+	}
+	fmt.Fprintf(w, "# HELP quatplot_jitter_degrees RMS angle between a still device's samples and their mean orientation.\n# TYPE quatplot_jitter_degrees gauge\n")
+	for _, n := range st.Noise {
+		if n.Jitter != nil {
+			fmt.Fprintf(w, "quatplot_jitter_degrees{device=%q} %g\n", n.ID, *n.Jitter)
+		}
+	}
+
+	if fe := st.FilterError; fe != nil && fe.Samples > 0 {
+		metric("quatplot_filter_error_degrees", "gauge", "Angle between the simulator's measured and true orientations.", fe.Current)
+		metric("quatplot_filter_error_rmse_degrees", "gauge", "RMS angle between the simulator's measured and true orientations over the last 10 seconds.", fe.Angle.RMSE)
+	}
+
+	if st.Clock != nil {
+		synced := 0.0
+		if st.Clock.Synced {
+			synced = 1
+		}
+		metric("quatplot_clock_synced", "gauge", "Whether the clock offset to the reference server has been measured.", synced)
+		metric("quatplot_clock_offset_seconds", "gauge", "Offset added to local times to get reference times.", time.Duration(st.Clock.OffsetNS).Seconds())
+		metric("quatplot_clock_round_trip_seconds", "gauge", "Round trip of the exchange the clock offset was taken from.", time.Duration(st.Clock.DelayNS).Seconds())
+	}
+
+	if st.Recording != nil && st.Recording.Disk != nil && st.Recording.Disk.Error == "" {
+		low := 0.0
+		if st.Recording.Disk.Low {
+			low = 1
+		}
+		metric("quatplot_disk_free_bytes", "gauge", "Free space on the recording's volume.", float64(st.Recording.Disk.FreeBytes))
+		metric("quatplot_disk_low", "gauge", "Whether the recording's volume has less free space than -disk-min-free.", low)
+	}
+
+	if st.Uploads != nil {
+		metric("quatplot_uploads_pending", "gauge", "Finished recordings waiting to be archived to -storage.", float64(st.Uploads.Pending))
+		metric("quatplot_uploads_total", "counter", "Finished recordings archived to -storage.", float64(st.Uploads.Uploaded))
+	}
+
+	if st.Retention != nil {
+		areaMetric := func(name, kind, help string, value func(*retentionArea) float64) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+			for _, a := range []struct {
+				label string
+				area  *retentionArea
+			}{{"local", st.Retention.Local}, {"storage", st.Retention.Storage}} {
+				if a.area != nil {
+					fmt.Fprintf(w, "%s{area=%q} %g\n", name, a.label, value(a.area))
+				}
+			}
+		}
+		areaMetric("quatplot_retention_bytes", "gauge", "Size of the recordings kept by the retention policy, with their summaries.",
+			func(a *retentionArea) float64 { return float64(a.Bytes) })
+		areaMetric("quatplot_retention_deleted_total", "counter", "Recordings deleted by the retention policy.",
+			func(a *retentionArea) float64 { return float64(a.Deleted) })
+		areaMetric("quatplot_retention_freed_bytes_total", "counter", "Bytes freed by the retention policy.",
+			func(a *retentionArea) float64 { return float64(a.FreedBytes) })
+	}
+
+	sinkStats := sinkStatuses()
+	sinkMetric := func(name, kind, help string, value func(sinkStatus) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, s := range sinkStats {
+			fmt.Fprintf(w, "%s{sink=%q} %g\n", name, s.Name, value(s))
+		}
+	}
+	sinkMetric("quatplot_sink_written_total", "counter", "Samples written to an output sink.",
+		func(s sinkStatus) float64 { return float64(s.Written) })
+	sinkMetric("quatplot_sink_dropped_total", "counter", "Samples dropped because an output sink's queue was full.",
+		func(s sinkStatus) float64 { return float64(s.Dropped) })
+	sinkMetric("quatplot_sink_failures_total", "counter", "Failed writes to an output sink.",
+		func(s sinkStatus) float64 { return float64(s.Failures) })
+	sinkMetric("quatplot_sink_queued", "gauge", "Samples waiting to be written to an output sink.",
+		func(s sinkStatus) float64 { return float64(s.Queued) })
+}
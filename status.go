@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Serial link states reported by /api/status
+const (
+	serialConnecting       = "connecting"
+	serialConnected        = "connected"
+	serialBusy             = "busy"
+	serialNotFound         = "not_found"
+	serialPermissionDenied = "permission_denied"
+	serialError            = "error"
+	serialDisabled         = "disabled"
+	serialEnded            = "ended"
+	serialFailed           = "failed" // Given up on after -reconnect-attempts
+)
+
+// serialStatus describes the state of the serial link with an actionable hint when it is down
+type serialStatus struct {
+	ID      string    `json:"id,omitempty"` // Device the status is of, when several are read
+	State   string    `json:"state"`
+	Port    string    `json:"port"`
+	Message string    `json:"message,omitempty"`
+	Hint    string    `json:"hint,omitempty"`
+	Since   time.Time `json:"since"`
+
+	Devices []serialStatus `json:"devices,omitempty"` // Status of each device, when several are read
+}
+
+// newStatus returns the status of a link that hasn't been opened yet
+func newStatus() serialStatus {
+	return serialStatus{State: serialConnecting, Since: time.Now()}
+}
+
+// setStatus updates the status of the source and reports whether it
+// changed. Changes are broadcast to the namespace's WebSocket clients as
+// "status" events.
+func (s *sourceRunner) setStatus(st serialStatus) bool {
+	st.ID = s.device
+	s.statusMu.Lock()
+	prev := s.status
+	if prev.State == st.State && prev.Port == st.Port && prev.Message == st.Message {
+		s.statusMu.Unlock()
+		return false
+	}
+	st.Since = time.Now()
+	s.status = st
+	s.statusMu.Unlock()
+
+	s.ns.broadcastEvent("status", st)
+	return true
+}
+
+// getStatus returns a copy of the status of the source
+func (s *sourceRunner) getStatus() serialStatus {
+	s.statusMu.RLock()
+	defer s.statusMu.RUnlock()
+	return s.status
+}
+
+// getStatus returns the status of the namespace's input. With several
+// devices it is that of the first one not connected, or of the first one
+// when all are, with the status of every device in Devices.
+func (ns *namespace) getStatus() serialStatus {
+	list := ns.sourceList()
+	switch len(list) {
+	case 0:
+		return newStatus()
+	case 1:
+		return list[0].getStatus()
+	}
+	all := make([]serialStatus, len(list))
+	for n, s := range list {
+		all[n] = s.getStatus()
+	}
+	st := all[0]
+	for _, dev := range all {
+		if dev.State != serialConnected {
+			st = dev
+			break
+		}
+	}
+	st.Devices = all
+	return st
+}
+
+// handleStatus reports the state of the serial link, or links
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requestNamespace(r).getStatus())
+}
@@ -0,0 +1,28 @@
+package main
+
+import "os"
+
+func init() {
+	registerSource("stdin", sourceType{new: newStdinSource, once: true})
+}
+
+// stdinSource reads quaternion lines from standard input, e.g. piped from
+// another program with `sensor-tool | quatplot -source stdin`
+type stdinSource struct {
+	lines *lineReader
+}
+
+func newStdinSource(cfg Config) Source {
+	return &stdinSource{lines: newLineReader(os.Stdin, cfg.lineFormat(), cfg.previewBuffer())}
+}
+
+func (s *stdinSource) String() string { return "stdin" }
+
+func (s *stdinSource) Open() error { return nil }
+
+func (s *stdinSource) ReadQuaternion() (Quaternion, error) {
+	return s.lines.next()
+}
+
+// Close leaves stdin open, it can't be reopened
+func (s *stdinSource) Close() error { return nil }
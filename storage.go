@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var storageSpec = flag.String("storage", "memory", "Where the history buffer is saved and finished recordings are archived: memory, file:DIR or s3://BUCKET/PREFIX, see -s3-endpoint (default: memory, nothing is kept after the server stops)")
+
+// historySaveInterval is how often the history buffers are saved to the
+// storage, besides on shutdown
+const historySaveInterval = time.Minute
+
+// Storage keeps named objects, the saved history buffers and archived
+// recordings. Names are slash-separated paths, e.g. recordings/rig-2/session.qlog.
+type Storage interface {
+	Put(name string, r io.Reader, size int64) error
+	// Get returns an error matching fs.ErrNotExist when there is no such object
+	Get(name string) (io.ReadCloser, error)
+	// List returns the objects whose names start with prefix, sorted by name
+	List(prefix string) ([]storedObject, error)
+	Delete(name string) error
+	String() string // Where the objects are kept, for logs
+}
+
+// storedObject describes an object in the storage
+type storedObject struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// activeStorage is opened from the configuration before the sources start
+var activeStorage Storage = newMemoryStorage()
+
+// checkStorage checks the syntax of a storage setting without opening it
+func checkStorage(spec string) error {
+	kind, location, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "memory":
+		return nil
+	case "file":
+		if location == "" {
+			return errors.New("file storage needs a directory, e.g. file:/var/lib/quatplot")
+		}
+		return nil
+	case "s3":
+		_, _, err := parseS3Location(spec)
+		return err
+	}
+	return fmt.Errorf("unknown storage %q, use memory, file:DIR or s3://BUCKET/PREFIX", spec)
+}
+
+// openStorage opens the storage named by a setting
+func openStorage(spec string) (Storage, error) {
+	if err := checkStorage(spec); err != nil {
+		return nil, err
+	}
+	kind, location, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "file":
+		return &fileStorage{dir: location}, nil
+	case "s3":
+		return newS3Storage(spec)
+	}
+	return newMemoryStorage(), nil
+}
+
+// storagePersistent reports whether objects outlive the server, otherwise
+// nothing is saved or archived
+func storagePersistent() bool {
+	_, memory := activeStorage.(*memoryStorage)
+	return !memory
+}
+
+// initStorage opens the storage of the configuration, restores the history
+// buffer of each namespace from it and saves them every minute from then on
+func initStorage(cfg Config) error {
+	s, err := openStorage(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	activeStorage = s
+	if !storagePersistent() {
+		return nil
+	}
+	startUploads()
+	for _, ns := range namespaces() {
+		if err := ns.restoreHistory(); err != nil {
+			log.Printf("Error restoring the history of the %s namespace: %v", ns, err)
+		}
+	}
+	go saveHistoryLoop()
+	return nil
+}
+
+// historyObject names the object the namespace's history buffer is saved as
+func (ns *namespace) historyObject() string {
+	if ns.name == "" {
+		return "history.jsonl"
+	}
+	return "tenants/" + ns.name + "/history.jsonl"
+}
+
+// saveHistory writes the history buffer as JSON lines, encrypted when a key
+// is set
+func (ns *namespace) saveHistory() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range ns.history.within(time.Time{}) {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	data := buf.Bytes()
+	if encryptionKey != nil {
+		var err error
+		if data, err = sealBytes(data, encryptionKey); err != nil {
+			return err
+		}
+	}
+	return activeStorage.Put(ns.historyObject(), bytes.NewReader(data), int64(len(data)))
+}
+
+// restoreHistory fills the history buffer with the samples saved before the
+// server last stopped. They are numbered again, since sequence numbers start
+// over with each server epoch.
+func (ns *namespace) restoreHistory() error {
+	r, err := activeStorage.Get(ns.historyObject())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(data, sealedMagic) {
+		if encryptionKey == nil {
+			return fmt.Errorf("%s is encrypted, set the encryption key to restore it", ns.historyObject())
+		}
+		if data, err = readSealed(bytes.NewReader(data), encryptionKey); err != nil {
+			return err
+		}
+	}
+	var seq uint64
+	lines := bufio.NewScanner(bytes.NewReader(data))
+	lines.Buffer(nil, 1<<20)
+	for lines.Scan() {
+		var s historySample
+		if err := json.Unmarshal(lines.Bytes(), &s); err != nil {
+			return fmt.Errorf("%s: %v", ns.historyObject(), err)
+		}
+		seq++
+		s.Seq = seq
+		ns.history.add(s)
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+	ns.seq.Store(seq)
+	if seq > 0 {
+		log.Printf("Restored %d samples of the %s namespace from %s", seq, ns, activeStorage)
+	}
+	return nil
+}
+
+// saveHistoryLoop saves the history buffers that received samples every
+// historySaveInterval
+func saveHistoryLoop() {
+	saved := map[*namespace]uint64{}
+	for range time.Tick(historySaveInterval) {
+		for _, ns := range namespaces() {
+			if seq := ns.seq.Load(); seq != saved[ns] {
+				if err := ns.saveHistory(); err != nil {
+					log.Printf("Error saving the history of the %s namespace: %v", ns, err)
+					continue
+				}
+				saved[ns] = seq
+			}
+		}
+	}
+}
+
+// saveHistories saves the history buffer of every namespace, on shutdown
+func saveHistories() {
+	if !storagePersistent() {
+		return
+	}
+	for _, ns := range namespaces() {
+		if err := ns.saveHistory(); err != nil {
+			log.Printf("Error saving the history of the %s namespace: %v", ns, err)
+		}
+	}
+}
+
+// checkObjectName refuses names that would leave the storage, such as
+// ../config.json
+func checkObjectName(name string) error {
+	if name == "" || path.Clean(name) != name || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, `\`) {
+		return fmt.Errorf("invalid object name %q", name)
+	}
+	return nil
+}
+
+// memoryStorage keeps objects in memory until the server stops
+type memoryStorage struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data     []byte
+	modified time.Time
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{objects: map[string]memoryObject{}}
+}
+
+func (m *memoryStorage) String() string { return "memory" }
+
+func (m *memoryStorage) Put(name string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[name] = memoryObject{data: data, modified: time.Now()}
+	return nil
+}
+
+func (m *memoryStorage) Get(name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func (m *memoryStorage) List(prefix string) ([]storedObject, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := []storedObject{}
+	for name, o := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			list = append(list, storedObject{Name: name, Size: int64(len(o.data)), Modified: o.modified})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (m *memoryStorage) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, name)
+	return nil
+}
+
+// fileStorage keeps objects as files under a directory, e.g. a network
+// share
+type fileStorage struct {
+	dir string
+}
+
+func (s *fileStorage) String() string { return "file:" + s.dir }
+
+func (s *fileStorage) path(name string) (string, error) {
+	if err := checkObjectName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+// Put writes the object atomically by renaming a temporary file
+func (s *fileStorage) Put(name string, r io.Reader, size int64) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".quatplot-storage-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *fileStorage) Get(name string) (io.ReadCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *fileStorage) List(prefix string) ([]storedObject, error) {
+	list := []storedObject{}
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == s.dir {
+			return fs.SkipAll
+		}
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".quatplot-storage-") {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		list = append(list, storedObject{Name: name, Size: info.Size(), Modified: info.ModTime()})
+		return nil
+	})
+	return list, err
+}
+
+func (s *fileStorage) Delete(name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// storageInfo is the answer to GET /api/storage
+type storageInfo struct {
+	Storage string         `json:"storage"`
+	Objects []storedObject `json:"objects"`
+}
+
+// handleStorage lists and serves the objects in the storage:
+//
+//	GET /api/storage           every object, or those starting with ?prefix=
+//	GET /api/storage/{name}    the object, as a download
+func handleStorage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/storage"), "/")
+	if name == "" {
+		objects, err := activeStorage.List(r.URL.Query().Get("prefix"))
+		if err != nil {
+			log.Printf("Error listing %s: %v", activeStorage, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(storageInfo{Storage: activeStorage.String(), Objects: objects})
+		return
+	}
+	if err := checkObjectName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	obj, err := activeStorage.Get(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading %s from %s: %v", name, activeStorage, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer obj.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(name)))
+	io.Copy(w, obj)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/intermernet/quatplot/hub"
+)
+
+// maxSubscribeRate is the highest rate a client may subscribe to, faster
+// asks for every sample anyway
+const maxSubscribeRate = 1000
+
+// Fields of a sample a client can subscribe to
+const (
+	fieldQuat    = "quat"
+	fieldEuler   = "euler"
+	fieldGravity = "gravity"
+	fieldHeading = "heading"
+	fieldAngular = "angular_velocity"
+)
+
+// subscribeRequest is the data of a "subscribe" message. Each one replaces
+// the client's subscription, so fields left out go back to their default.
+type subscribeRequest struct {
+	Rate    float64  `json:"rate"`    // Most samples per second of each device, 0 for all
+	Device  string   `json:"device"`  // Only send this device
+	Devices []string `json:"devices"` // Or only these
+	Fields  []string `json:"fields"`  // Parts of each sample, quat, euler, gravity, heading and angular_velocity
+}
+
+// subscriptionInfo confirms a subscription in a "subscribed" event, or
+// explains why it was refused
+type subscriptionInfo struct {
+	Rate    float64  `json:"rate,omitempty"`
+	Devices []string `json:"devices,omitempty"` // All devices when empty
+	Fields  []string `json:"fields"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// subscription is what a client asked to be sent. The zero value is every
+// sample of every device, with the vectors asked for on connecting.
+type subscription struct {
+	interval time.Duration   // Minimum time between samples of a device, 0 for all
+	devices  map[string]bool // nil for all
+	noQuat   bool
+	noEuler  bool
+	vectors  *vectorSet // nil for those asked for on connecting
+}
+
+// isSet reports whether the subscription narrows anything
+func (s subscription) isSet() bool {
+	return s.interval > 0 || s.devices != nil || s.noQuat || s.noEuler || s.vectors != nil
+}
+
+// parseSubscription checks a subscribe request
+func parseSubscription(req subscribeRequest) (subscription, error) {
+	var sub subscription
+	if math.IsNaN(req.Rate) || req.Rate < 0 || req.Rate > maxSubscribeRate {
+		return sub, fmt.Errorf("rate must be between 0 and %d", maxSubscribeRate)
+	}
+	if req.Rate > 0 {
+		sub.interval = time.Duration(float64(time.Second) / req.Rate)
+	}
+	devices := req.Devices
+	if req.Device != "" {
+		devices = append(devices, req.Device)
+	}
+	if len(devices) > 0 {
+		sub.devices = map[string]bool{}
+		for _, d := range devices {
+			sub.devices[d] = true
+		}
+	}
+	if req.Fields != nil {
+		sub.noQuat, sub.noEuler = true, true
+		sub.vectors = &vectorSet{}
+		for _, f := range req.Fields {
+			switch f {
+			case fieldQuat:
+				sub.noQuat = false
+			case fieldEuler:
+				sub.noEuler = false
+			case fieldGravity:
+				sub.vectors.Gravity = true
+			case fieldHeading:
+				sub.vectors.Heading = true
+			case fieldAngular:
+				sub.vectors.AngularVelocity = true
+			default:
+				return subscription{}, fmt.Errorf("unknown field %q, expected quat, euler, gravity, heading or angular_velocity", f)
+			}
+		}
+	}
+	return sub, nil
+}
+
+// handleSubscribe replaces the subscription of a client and confirms it,
+// reporting whether it was accepted
+func (c *client) handleSubscribe(data json.RawMessage) bool {
+	var req subscribeRequest
+	err := json.Unmarshal(data, &req)
+	var sub subscription
+	if err == nil {
+		sub, err = parseSubscription(req)
+	}
+	c.mu.Lock()
+	if err == nil {
+		c.sub = sub
+	}
+	info := c.subscriptionInfo()
+	c.mu.Unlock()
+	if err != nil {
+		info.Error = err.Error()
+	}
+	c.sendEvent(mustMarshalEvent("subscribed", info))
+	return err == nil
+}
+
+// subscriptionInfo describes the client's subscription. Must be called
+// with c.mu held.
+func (c *client) subscriptionInfo() subscriptionInfo {
+	info := subscriptionInfo{Fields: []string{}}
+	if c.sub.interval > 0 {
+		info.Rate = math.Round(float64(time.Second)/float64(c.sub.interval)*1000) / 1000
+	}
+	for d := range c.sub.devices {
+		info.Devices = append(info.Devices, d)
+	}
+	sort.Strings(info.Devices)
+	enc := c.encodingLocked("")
+	if !enc.NoQuaternion {
+		info.Fields = append(info.Fields, fieldQuat)
+	}
+	if !enc.NoEuler {
+		info.Fields = append(info.Fields, fieldEuler)
+	}
+	info.Fields = append(info.Fields, enc.vectors.names()...)
+	return info
+}
+
+// encoding returns how samples are encoded for the client, and whether it
+// is sent those of the device at all
+func (c *client) encoding(device, frame string) (sampleEncoding, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sub.devices != nil && !c.sub.devices[device] {
+		return sampleEncoding{}, false
+	}
+	return c.encodingLocked(frame), true
+}
+
+// encodingLocked returns how samples are encoded for the client. Must be
+// called with c.mu held.
+func (c *client) encodingLocked(frame string) sampleEncoding {
+	enc := sampleEncoding{
+		Encoding: hub.Encoding{Units: c.units, Order: c.order, Keys: c.keys, NoQuaternion: c.sub.noQuat, NoEuler: c.sub.noEuler},
+		vectors:  c.vectors,
+		frame:    frame,
+	}
+	if c.sub.vectors != nil {
+		enc.vectors = *c.sub.vectors
+	}
+	return enc
+}
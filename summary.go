@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+const (
+	// summaryGapMin is the shortest interval between samples counted as a gap
+	summaryGapMin = 250 * time.Millisecond
+	// summaryGapFactor is how many times the average interval a gap must last
+	summaryGapFactor = 5
+	// summaryMaxGaps and summaryMaxEvents bound the lists kept in a summary
+	summaryMaxGaps   = 100
+	summaryMaxEvents = 1000
+	// summaryMinDrift is how long a device must be recorded for a drift estimate
+	summaryMinDrift = 10 * time.Second
+	// summaryStamp names the summary files of a session after its start
+	summaryStamp = "20060102T150405Z"
+)
+
+// sessionSummary describes one recording session, written next to the
+// recording when it stops
+type sessionSummary struct {
+	Recording   string          `json:"recording"`
+	Started     time.Time       `json:"started"`
+	Ended       *time.Time      `json:"ended,omitempty"` // Unset while the session is still recording
+	DurationSec float64         `json:"duration_s"`
+	Samples     uint64          `json:"samples"`
+	Devices     []deviceSummary `json:"devices"`
+	Events      []summaryEvent  `json:"events"`
+	EventsTotal int             `json:"events_total"`
+}
+
+// deviceSummary holds the statistics of the samples of one device
+type deviceSummary struct {
+	ID         string         `json:"id,omitempty"`
+	Samples    uint64         `json:"samples"`
+	First      time.Time      `json:"first"`
+	Last       time.Time      `json:"last"`
+	RateHz     float64        `json:"rate_hz"`
+	IntervalMS intervalStats  `json:"interval_ms"`
+	GapCount   int            `json:"gap_count"`
+	GapTotalMS float64        `json:"gap_total_ms"`
+	Gaps       []summaryGap   `json:"gaps"`
+	Extremes   angleExtremes  `json:"extremes_deg"`
+	Drift      *driftEstimate `json:"drift,omitempty"`
+}
+
+type intervalStats struct {
+	Min    float64 `json:"min"`
+	Mean   float64 `json:"mean"`
+	Max    float64 `json:"max"`
+	StdDev float64 `json:"stddev"`
+}
+
+// summaryGap is a stretch without samples
+type summaryGap struct {
+	Start      time.Time `json:"start"`
+	DurationMS float64   `json:"duration_ms"`
+}
+
+type angleExtremes struct {
+	Roll  angleRange `json:"roll"`
+	Pitch angleRange `json:"pitch"`
+	Yaw   angleRange `json:"yaw"`
+}
+
+type angleRange struct {
+	Min     float64   `json:"min"`
+	MinTime time.Time `json:"min_time"`
+	Max     float64   `json:"max"`
+	MaxTime time.Time `json:"max_time"`
+}
+
+// driftEstimate is the slope of a straight line fitted to the yaw over the
+// session, which is the heading drift when the sensor stays still
+type driftEstimate struct {
+	YawDegPerMin float64 `json:"yaw_deg_per_min"`
+}
+
+// summaryEvent is an event sent to clients during the session
+type summaryEvent struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data,omitempty"`
+}
+
+// deviceAccumulator gathers the statistics of a device as samples arrive
+type deviceAccumulator struct {
+	summary deviceSummary
+
+	intervals  uint64
+	meanNS     float64 // Running mean and sum of squared deviations of the intervals
+	m2         float64
+	minNS      float64
+	maxNS      float64
+	yawOffset  float64 // Added to the yaw to unwrap it across ±180°
+	lastYaw    float64
+	sumT, sumY float64 // Sums for the least-squares fit of yaw against time
+	sumTT      float64
+	sumTY      float64
+}
+
+// sessionAccumulator gathers the summary of a session. Its methods are
+// called with the recorder's lock held.
+type sessionAccumulator struct {
+	devices map[string]*deviceAccumulator
+	events  []summaryEvent
+	total   int
+}
+
+func newSessionAccumulator() *sessionAccumulator {
+	return &sessionAccumulator{devices: map[string]*deviceAccumulator{}}
+}
+
+func (a *sessionAccumulator) add(s historySample) {
+	d := a.devices[s.ID]
+	euler := quat.ToEuler(s.Quaternion, quat.Degrees)
+	if d == nil {
+		d = &deviceAccumulator{summary: deviceSummary{ID: s.ID, First: s.Time, Gaps: []summaryGap{}}}
+		d.summary.Extremes = angleExtremes{
+			Roll:  angleRange{Min: euler.Roll, MinTime: s.Time, Max: euler.Roll, MaxTime: s.Time},
+			Pitch: angleRange{Min: euler.Pitch, MinTime: s.Time, Max: euler.Pitch, MaxTime: s.Time},
+			Yaw:   angleRange{Min: euler.Yaw, MinTime: s.Time, Max: euler.Yaw, MaxTime: s.Time},
+		}
+		d.lastYaw = euler.Yaw
+		a.devices[s.ID] = d
+	} else {
+		d.addInterval(s.Time.Sub(d.summary.Last), d.summary.Last)
+	}
+	d.summary.Samples++
+	d.summary.Last = s.Time
+
+	d.summary.Extremes.Roll.add(euler.Roll, s.Time)
+	d.summary.Extremes.Pitch.add(euler.Pitch, s.Time)
+	d.summary.Extremes.Yaw.add(euler.Yaw, s.Time)
+
+	// Unwrap the yaw so that turning past ±180° doesn't look like a jump
+	if delta := euler.Yaw - d.lastYaw; delta > 180 {
+		d.yawOffset -= 360
+	} else if delta < -180 {
+		d.yawOffset += 360
+	}
+	d.lastYaw = euler.Yaw
+	t, y := s.Time.Sub(d.summary.First).Minutes(), euler.Yaw+d.yawOffset
+	d.sumT += t
+	d.sumY += y
+	d.sumTT += t * t
+	d.sumTY += t * y
+}
+
+func (d *deviceAccumulator) addInterval(interval time.Duration, last time.Time) {
+	ns := float64(interval)
+	if d.intervals > 0 && interval > summaryGapMin && ns > summaryGapFactor*d.meanNS {
+		d.summary.GapCount++
+		d.summary.GapTotalMS += ns / 1e6
+		if len(d.summary.Gaps) < summaryMaxGaps {
+			d.summary.Gaps = append(d.summary.Gaps, summaryGap{Start: last, DurationMS: ns / 1e6})
+		}
+	}
+	if d.intervals == 0 || ns < d.minNS {
+		d.minNS = ns
+	}
+	if ns > d.maxNS {
+		d.maxNS = ns
+	}
+	d.intervals++
+	delta := ns - d.meanNS
+	d.meanNS += delta / float64(d.intervals)
+	d.m2 += delta * (ns - d.meanNS)
+}
+
+func (r *angleRange) add(v float64, t time.Time) {
+	if v < r.Min {
+		r.Min, r.MinTime = v, t
+	}
+	if v > r.Max {
+		r.Max, r.MaxTime = v, t
+	}
+}
+
+func (a *sessionAccumulator) addEvent(eventType string, t time.Time, payload any) {
+	a.total++
+	if len(a.events) < summaryMaxEvents {
+		a.events = append(a.events, summaryEvent{Type: eventType, Time: t, Data: payload})
+	}
+}
+
+// summary returns the summary of the session so far
+func (a *sessionAccumulator) summary(path string, started time.Time, ended *time.Time) sessionSummary {
+	end := time.Now()
+	if ended != nil {
+		end = *ended
+	}
+	s := sessionSummary{
+		Recording:   filepath.Base(path),
+		Started:     started,
+		Ended:       ended,
+		DurationSec: end.Sub(started).Seconds(),
+		Devices:     []deviceSummary{},
+		Events:      append([]summaryEvent{}, a.events...),
+		EventsTotal: a.total,
+	}
+	for _, d := range a.devices {
+		ds := d.summary
+		ds.Gaps = append([]summaryGap{}, ds.Gaps...)
+		if d.intervals > 0 {
+			ds.IntervalMS = intervalStats{
+				Min:    d.minNS / 1e6,
+				Mean:   d.meanNS / 1e6,
+				Max:    d.maxNS / 1e6,
+				StdDev: math.Sqrt(d.m2/float64(d.intervals)) / 1e6,
+			}
+			if span := ds.Last.Sub(ds.First).Seconds(); span > 0 {
+				ds.RateHz = float64(d.intervals) / span
+			}
+		}
+		n := float64(ds.Samples)
+		if den := n*d.sumTT - d.sumT*d.sumT; ds.Last.Sub(ds.First) >= summaryMinDrift && den > 0 {
+			ds.Drift = &driftEstimate{YawDegPerMin: (n*d.sumTY - d.sumT*d.sumY) / den}
+		}
+		s.Samples += ds.Samples
+		s.Devices = append(s.Devices, ds)
+	}
+	sort.Slice(s.Devices, func(i, j int) bool { return s.Devices[i].ID < s.Devices[j].ID })
+	return s
+}
+
+// summaryBase returns the path of a session's summary files without their
+// extension, e.g. session.qlog.20240501T100000Z.summary
+func summaryBase(path string, started time.Time) string {
+	return path + "." + started.UTC().Format(summaryStamp) + ".summary"
+}
+
+// writeSummary stores the summary of a session as JSON and HTML next to the
+// recording, encrypted like the recording when a key is set
+func writeSummary(path string, s sessionSummary) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	var page bytes.Buffer
+	if err := summaryPage.Execute(&page, s); err != nil {
+		return err
+	}
+	base := summaryBase(path, s.Started)
+	for _, f := range []struct {
+		path string
+		data []byte
+	}{{base + ".json", append(data, '\n')}, {base + ".html", page.Bytes()}} {
+		if encryptionKey != nil {
+			err = writeSealedFile(f.path, f.data, encryptionKey)
+		} else {
+			err = os.WriteFile(f.path, f.data, 0o644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSummaryFile reads a stored summary file, decrypting it if needed
+func readSummaryFile(path string) ([]byte, error) {
+	if isSealedFile(path) {
+		return readSealedFile(path, encryptionKey)
+	}
+	return os.ReadFile(path)
+}
+
+// summaryListing describes a stored summary in /api/recording/summaries
+type summaryListing struct {
+	Session string    `json:"session"`
+	Started time.Time `json:"started"`
+}
+
+// handleRecordingSummary serves the summary of the session being recorded,
+// as JSON or with format=html as a page
+func handleRecordingSummary(w http.ResponseWriter, r *http.Request) {
+	if activeRecorder == nil {
+		http.Error(w, "not recording", http.StatusNotFound)
+		return
+	}
+	s := activeRecorder.summary()
+	if r.URL.Query().Get("format") == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		summaryPage.Execute(w, s)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// handleRecordingSummaries lists the summaries stored next to the recording,
+// and serves one of them at /api/recording/summaries/{session}
+func handleRecordingSummaries(w http.ResponseWriter, r *http.Request) {
+	if *recordPath == "" {
+		http.Error(w, "not recording", http.StatusNotFound)
+		return
+	}
+	session := strings.TrimPrefix(r.URL.Path, "/api/recording/summaries")
+	session = strings.TrimPrefix(session, "/")
+	if session == "" {
+		matches, _ := filepath.Glob(globEscape(*recordPath) + ".*.summary.json")
+		list := []summaryListing{}
+		for _, m := range matches {
+			name := strings.TrimSuffix(strings.TrimPrefix(m, *recordPath+"."), ".summary.json")
+			if started, err := time.Parse(summaryStamp, name); err == nil {
+				list = append(list, summaryListing{Session: name, Started: started})
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	started, err := time.Parse(summaryStamp, session)
+	if err != nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	ext, contentType := ".json", "application/json"
+	if r.URL.Query().Get("format") == "html" {
+		ext, contentType = ".html", "text/html; charset=utf-8"
+	}
+	data, err := readSummaryFile(summaryBase(*recordPath, started) + ext)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading summary of session %s: %v", session, err)
+		}
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// globEscape escapes the characters of a path that filepath.Glob treats specially
+func globEscape(path string) string {
+	r := strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`, `\`, `\\`)
+	return r.Replace(path)
+}
+
+var summaryPage = template.Must(template.New("summary").Funcs(template.FuncMap{
+	"fixed": func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) },
+	"time": func(t any) string {
+		if p, ok := t.(*time.Time); ok {
+			t = *p
+		}
+		return t.(time.Time).Format("2006-01-02 15:04:05.000 MST")
+	},
+	"json": func(v any) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Session {{time .Started}} - {{.Recording}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+th { background: #f0f0f0; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+</style>
+</head>
+<body>
+<h1>Session summary</h1>
+<table>
+<tr><th>Recording</th><td>{{.Recording}}</td></tr>
+<tr><th>Started</th><td>{{time .Started}}</td></tr>
+<tr><th>Ended</th><td>{{if .Ended}}{{time .Ended}}{{else}}still recording{{end}}</td></tr>
+<tr><th>Duration</th><td>{{fixed .DurationSec}} s</td></tr>
+<tr><th>Samples</th><td>{{.Samples}}</td></tr>
+</table>
+{{range .Devices}}
+<h2>{{if .ID}}Device {{.ID}}{{else}}Samples{{end}}</h2>
+<table>
+<tr><th>Samples</th><td class="num">{{.Samples}}</td></tr>
+<tr><th>Rate</th><td class="num">{{fixed .RateHz}} Hz</td></tr>
+<tr><th>Interval min / mean / max</th><td class="num">{{fixed .IntervalMS.Min}} / {{fixed .IntervalMS.Mean}} / {{fixed .IntervalMS.Max}} ms</td></tr>
+<tr><th>Interval std. dev.</th><td class="num">{{fixed .IntervalMS.StdDev}} ms</td></tr>
+<tr><th>Gaps</th><td class="num">{{.GapCount}}, {{fixed .GapTotalMS}} ms in total</td></tr>
+<tr><th>Yaw drift</th><td class="num">{{if .Drift}}{{fixed .Drift.YawDegPerMin}} °/min{{else}}too short to estimate{{end}}</td></tr>
+</table>
+<table>
+<tr><th>Angle</th><th>Min (°)</th><th>At</th><th>Max (°)</th><th>At</th></tr>
+<tr><td>Roll</td><td class="num">{{fixed .Extremes.Roll.Min}}</td><td>{{time .Extremes.Roll.MinTime}}</td><td class="num">{{fixed .Extremes.Roll.Max}}</td><td>{{time .Extremes.Roll.MaxTime}}</td></tr>
+<tr><td>Pitch</td><td class="num">{{fixed .Extremes.Pitch.Min}}</td><td>{{time .Extremes.Pitch.MinTime}}</td><td class="num">{{fixed .Extremes.Pitch.Max}}</td><td>{{time .Extremes.Pitch.MaxTime}}</td></tr>
+<tr><td>Yaw</td><td class="num">{{fixed .Extremes.Yaw.Min}}</td><td>{{time .Extremes.Yaw.MinTime}}</td><td class="num">{{fixed .Extremes.Yaw.Max}}</td><td>{{time .Extremes.Yaw.MaxTime}}</td></tr>
+</table>
+{{if .Gaps}}<table>
+<tr><th>Gap start</th><th>Duration (ms)</th></tr>
+{{range .Gaps}}<tr><td>{{time .Start}}</td><td class="num">{{fixed .DurationMS}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}
+<h2>Events</h2>
+{{if .Events}}<table>
+<tr><th>Time</th><th>Type</th><th>Data</th></tr>
+{{range .Events}}<tr><td>{{time .Time}}</td><td>{{.Type}}</td><td><code>{{json .Data}}</code></td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+// tareState holds the reference orientations set through /api/tare
+type tareState struct {
+	mu   sync.Mutex
+	raw  map[string]Quaternion // Latest orientation of each device before the tare
+	refs map[string]tareRef
+}
+
+// tareRef is the orientation a device was tared at
+type tareRef struct {
+	Device    string     `json:"device"`
+	Reference Quaternion `json:"reference"`
+	Time      time.Time  `json:"time"`
+}
+
+// tareInfo describes the tare of a namespace
+type tareInfo struct {
+	Devices []tareRef `json:"devices"` // Tared devices, sorted
+}
+
+// tareRequest is the body of POST /api/tare
+type tareRequest struct {
+	Device *string `json:"device"` // Device to tare, every device when omitted
+}
+
+// apply returns the orientation of the device relative to its reference,
+// q_ref⁻¹·q, and remembers q so that it can become the reference
+func (t *tareState) apply(device string, q Quaternion) Quaternion {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.raw == nil {
+		t.raw = map[string]Quaternion{}
+	}
+	t.raw[device] = q
+	ref, ok := t.refs[device]
+	if !ok {
+		return q
+	}
+	return quat.Multiply(quat.Conjugate(ref.Reference), q)
+}
+
+// set makes the latest orientation of the device, or of every device when
+// device is nil, its reference, and returns how many devices were tared
+func (t *tareState) set(device *string, now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.refs == nil {
+		t.refs = map[string]tareRef{}
+	}
+	n := 0
+	for id, q := range t.raw {
+		if device == nil || *device == id {
+			t.refs[id] = tareRef{Device: id, Reference: q, Time: now}
+			n++
+		}
+	}
+	return n
+}
+
+// clear removes the reference of the device, or of every device when device
+// is nil
+func (t *tareState) clear(device *string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if device == nil {
+		t.refs = nil
+		return
+	}
+	delete(t.refs, *device)
+}
+
+func (t *tareState) info() tareInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info := tareInfo{Devices: []tareRef{}}
+	for _, ref := range t.refs {
+		info.Devices = append(info.Devices, ref)
+	}
+	sort.Slice(info.Devices, func(i, j int) bool { return info.Devices[i].Device < info.Devices[j].Device })
+	return info
+}
+
+// handleTare zeroes the orientation of the namespace's devices:
+//
+//	GET  /api/tare          the references in effect
+//	POST /api/tare          make the current orientation the reference
+//	POST /api/tare/clear    remove the references
+//
+// Both POST requests take an optional "device", for every device when it's
+// omitted. Clients are told of changes with a "tare" event.
+func handleTare(w http.ResponseWriter, r *http.Request) {
+	ns := requestNamespace(r)
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tare"), "/")
+	if action == "" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ns.tare.info())
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req tareRequest
+	if r.ContentLength != 0 && !decodeJSONBody(w, r, &req) {
+		return
+	}
+	which := "every device"
+	if req.Device != nil {
+		which = "device " + *req.Device
+	}
+
+	switch action {
+	case "":
+		if ns.tare.set(req.Device, time.Now()) == 0 {
+			http.Error(w, "no orientation to tare at, no samples have been received", http.StatusConflict)
+			return
+		}
+		log.Printf("Tared %s of the %s namespace", which, ns)
+	case "clear":
+		ns.tare.clear(req.Device)
+		log.Printf("Cleared the tare of %s of the %s namespace", which, ns)
+	default:
+		http.Error(w, "unknown tare action "+action, http.StatusNotFound)
+		return
+	}
+	info := ns.tare.info()
+	ns.broadcastEvent("tare", info)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// tcpDialTimeout bounds how long tcp-connect waits for the remote end
+const tcpDialTimeout = 5 * time.Second
+
+func init() {
+	registerSource("tcp-listen", sourceType{new: newTCPListenSource})
+	registerSource("tcp-connect", sourceType{new: newTCPConnectSource})
+}
+
+// tcpListenSource accepts TCP connections streaming quaternion lines. Any
+// number of peers may connect and their samples are merged into one stream.
+type tcpListenSource struct {
+	addr    string
+	format  *lineFormat
+	preview *previewBuffer
+
+	ln        net.Listener
+	quats     chan Quaternion
+	done      chan struct{}
+	mu        sync.Mutex
+	conns     map[net.Conn]bool
+	closeOnce sync.Once
+}
+
+func newTCPListenSource(cfg Config) Source {
+	return &tcpListenSource{addr: cfg.Listen, format: cfg.lineFormat(), preview: cfg.previewBuffer()}
+}
+
+func (s *tcpListenSource) String() string { return "tcp-listen " + s.addr }
+
+func (s *tcpListenSource) Open() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	s.quats = make(chan Quaternion)
+	s.done = make(chan struct{})
+	s.conns = make(map[net.Conn]bool)
+	go s.accept()
+	return nil
+}
+
+// accept serves incoming connections until the listener is closed
+func (s *tcpListenSource) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		select {
+		case <-s.done:
+			s.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+		log.Printf("TCP connection from %s", conn.RemoteAddr())
+		go s.serve(conn)
+	}
+}
+
+// serve reads quaternions from one connection until it closes
+func (s *tcpListenSource) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		log.Printf("TCP connection from %s closed", conn.RemoteAddr())
+	}()
+
+	lines := newLineReader(conn, s.format, s.preview)
+	for {
+		quat, err := lines.next()
+		if err != nil {
+			return
+		}
+		select {
+		case s.quats <- quat:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *tcpListenSource) ReadQuaternion() (Quaternion, error) {
+	select {
+	case quat := <-s.quats:
+		return quat, nil
+	case <-s.done:
+		return Quaternion{}, net.ErrClosed
+	}
+}
+
+// Close stops listening and drops every connection
+func (s *tcpListenSource) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		close(s.done)
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		err = s.ln.Close()
+	})
+	return err
+}
+
+// tcpConnectSource dials out to a sensor gateway and reads quaternion lines
+// from the connection. The runner redials with backoff when it drops.
+type tcpConnectSource struct {
+	addr    string
+	format  *lineFormat
+	preview *previewBuffer
+
+	conn  net.Conn
+	lines *lineReader
+}
+
+func newTCPConnectSource(cfg Config) Source {
+	return &tcpConnectSource{addr: cfg.Connect, format: cfg.lineFormat(), preview: cfg.previewBuffer()}
+}
+
+func (s *tcpConnectSource) String() string { return "tcp " + s.addr }
+
+func (s *tcpConnectSource) Open() error {
+	conn, err := net.DialTimeout("tcp", s.addr, tcpDialTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.lines = newLineReader(conn, s.format, s.preview)
+	return nil
+}
+
+func (s *tcpConnectSource) ReadQuaternion() (Quaternion, error) {
+	return s.lines.next()
+}
+
+func (s *tcpConnectSource) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var maxRate = flag.Float64("max-rate", 0, "Most samples per second of each device sent to WebSocket clients, the latest of each interval, e.g. 60 for a sensor streaming at 400 Hz. Recording, sinks and the history still get every sample (default: 0, no limit)")
+
+// broadcastThrottle holds back the samples of each device that arrive
+// faster than -max-rate, sending the latest one at the end of the interval
+type broadcastThrottle struct {
+	mu      sync.Mutex
+	devices map[string]*throttledDevice
+}
+
+// throttledDevice is the broadcast state of one device
+type throttledDevice struct {
+	sent    time.Time // When a sample was last sent
+	pending bool      // A timer is due to send the latest sample
+	seq     uint64    // Latest sample held back
+	quat    Quaternion
+	omega   *quat.Vector
+	marks   sampleMarks
+}
+
+// maxRateInterval returns the shortest time between the broadcasts of a
+// device, 0 when unlimited
+func maxRateInterval() time.Duration {
+	if *maxRate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / *maxRate)
+}
+
+// admit reports whether a sample may be sent now. Otherwise it is kept,
+// replacing any held back before, and sent once the interval is over.
+func (t *broadcastThrottle) admit(ns *namespace, device string, seq uint64, q Quaternion, omega *quat.Vector, marks sampleMarks, now time.Time) bool {
+	interval := maxRateInterval()
+	if interval == 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.devices == nil {
+		t.devices = map[string]*throttledDevice{}
+	}
+	d := t.devices[device]
+	if d == nil {
+		d = &throttledDevice{}
+		t.devices[device] = d
+	}
+	if !d.pending && now.Sub(d.sent) >= interval {
+		d.sent = now
+		return true
+	}
+	d.seq, d.quat, d.omega, d.marks = seq, q, omega, marks
+	if !d.pending {
+		d.pending = true
+		time.AfterFunc(d.sent.Add(interval).Sub(now), func() { t.flush(ns, device) })
+	}
+	return false
+}
+
+// flush sends the sample of a device held back by admit
+func (t *broadcastThrottle) flush(ns *namespace, device string) {
+	t.mu.Lock()
+	d := t.devices[device]
+	now := time.Now()
+	d.pending, d.sent = false, now
+	seq, q, omega, marks := d.seq, d.quat, d.omega, d.marks
+	t.mu.Unlock()
+	ns.sendSample(device, seq, q, omega, marks, now)
+}
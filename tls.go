@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	tlsEnabled    = flag.Bool("tls", false, "Serve the viewer over HTTPS and WSS, with -cert and -key or -tls-self-signed")
+	tlsCert       = flag.String("cert", "", "PEM certificate, with its chain, the server presents with -tls. Reloaded when the file changes")
+	tlsKey        = flag.String("key", "", "PEM private key of -cert")
+	tlsSelfSigned = flag.Bool("tls-self-signed", false, "Serve HTTPS with a certificate generated at startup for the names and addresses of this machine, which browsers warn about once. Implies -tls")
+)
+
+// selfSignedValidity is how long a generated certificate is valid for
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// serveTLS reports whether the web server uses TLS
+func serveTLS() bool {
+	return *tlsEnabled || *tlsSelfSigned || *tlsCert != ""
+}
+
+// webScheme returns the scheme of the web server's URLs
+func webScheme() string {
+	if serveTLS() {
+		return "https"
+	}
+	return "http"
+}
+
+// initTLS returns the TLS configuration of the web server, nil when it
+// serves plain HTTP
+func initTLS() (*tls.Config, error) {
+	if !serveTLS() {
+		return nil, nil
+	}
+	switch {
+	case *tlsSelfSigned && (*tlsCert != "" || *tlsKey != ""):
+		return nil, errors.New("-tls-self-signed generates its own certificate, leave out -cert and -key")
+	case *tlsSelfSigned:
+		cert, err := selfSignedCert(time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("generating a certificate: %v", err)
+		}
+		sum := sha256.Sum256(cert.Certificate[0])
+		log.Printf("Serving HTTPS with a self-signed certificate for %s, SHA-256 fingerprint %s",
+			strings.Join(cert.Leaf.DNSNames, ", "), fingerprint(sum[:]))
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+	case *tlsCert == "" || *tlsKey == "":
+		return nil, errors.New("-tls needs -cert and -key, or -tls-self-signed")
+	}
+	r := &certReloader{certFile: *tlsCert, keyFile: *tlsKey}
+	if _, err := r.get(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return r.get() }, MinVersion: tls.VersionTLS12}, nil
+}
+
+// certReloader loads a certificate and key, and loads them again when the
+// certificate file changes, so that a renewed certificate is picked up
+// without a restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func (r *certReloader) get() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil && info.ModTime().Equal(r.modified) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			// Likely caught between writing the certificate and the key
+			log.Printf("Error reloading %s, keeping the previous certificate: %v", r.certFile, err)
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil {
+		log.Printf("Reloaded the certificate %s", r.certFile)
+	}
+	r.cert, r.modified = &cert, info.ModTime()
+	return r.cert, nil
+}
+
+// selfSignedCert generates a certificate for localhost and the name and
+// network addresses of this machine
+func selfSignedCert(now time.Time) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	names := []string{"localhost"}
+	if host, err := os.Hostname(); err == nil && host != "" && host != "localhost" {
+		names = append(names, host)
+		if !strings.Contains(host, ".") {
+			names = append(names, host+".local")
+		}
+	}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() {
+				ips = append(ips, n.IP)
+			}
+		}
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"quatplot"}, CommonName: names[len(names)-1]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// fingerprint formats a certificate hash as browsers show it, e.g. 3A:F1:...
+func fingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for n, b := range sum {
+		parts[n] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	wsclient "github.com/intermernet/quatplot/client"
+	"github.com/intermernet/quatplot/quat"
+)
+
+var (
+	tuiURL    = flag.String("tui-url", "", "WebSocket of the server the tui command shows, e.g. ws://pi.local:8080/ws (default: the -web port of this machine)")
+	tuiToken  = flag.String("tui-token", "", "API token the tui command connects with, when the server requires a password")
+	tuiDirect = flag.Bool("tui-direct", false, "Have the tui command read the configured source itself instead of connecting to a server")
+	// Self-signed certificates are generated afresh every start, so there is
+	// nothing to pin
+	tuiInsecure = flag.Bool("tui-insecure", false, "Have the tui command accept any certificate of a wss:// or https:// server, e.g. one started with -tls-self-signed")
+)
+
+const (
+	// tuiRefresh is how often the dashboard is redrawn
+	tuiRefresh = 100 * time.Millisecond
+	// tuiStatsInterval is how often the server's counters are fetched
+	tuiStatsInterval = 2 * time.Second
+	// tuiBarWidth is the number of cells of each half of an angle bar
+	tuiBarWidth = 20
+)
+
+// tuiDevice is what the dashboard knows of a device
+type tuiDevice struct {
+	q    Quaternion
+	last time.Time
+	rate rateMeter // Samples received
+}
+
+// tuiState is the state the dashboard shows, fed by the server or the
+// source and drawn every tuiRefresh
+type tuiState struct {
+	mu         sync.Mutex
+	where      string // What the dashboard reads, e.g. the server's URL
+	devices    map[string]*tuiDevice
+	statuses   map[string]serialStatus // Of each device, "" when untagged
+	inputRate  float64                 // Samples a second read from the sensor
+	clients    int                     // WebSocket clients of the server, -1 when unknown
+	connected  bool                    // Connected to the server, or reading the source
+	lastLog    string
+	lastLogged time.Time
+}
+
+// runTUI shows a live dashboard of a server, or of the configured source
+// with -tui-direct, in the terminal. It returns the process exit code.
+func runTUI() int {
+	st := &tuiState{devices: map[string]*tuiDevice{}, statuses: map[string]serialStatus{}, clients: -1}
+	// Log lines would scroll the dashboard away, the last one is shown in it
+	log.SetOutput(st)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *tuiDirect {
+		if err := st.readSource(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
+			return 1
+		}
+	} else {
+		u, err := tuiServerURL(*tuiURL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		st.readServer(ctx, u)
+	}
+
+	out := os.Stdout
+	fmt.Fprint(out, "\x1b[?25l\x1b[2J")
+	defer fmt.Fprint(out, "\x1b[?25h\n")
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	for {
+		st.draw(out)
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
+
+// tuiServerURL returns the WebSocket URL to connect to, accepting the
+// address of the web interface too, e.g. http://pi.local:8080
+func tuiServerURL(s string) (*url.URL, error) {
+	if s == "" {
+		s = webScheme() + "://localhost:" + *webPort + "/ws"
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -tui-url %q, e.g. ws://pi.local:8080/ws", s)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return nil, fmt.Errorf("invalid -tui-url %q, must be a ws, wss, http or https URL", s)
+	}
+	if !strings.HasSuffix(u.Path, "/ws") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+	}
+	return u, nil
+}
+
+// readServer follows the samples and events of a server, and polls its
+// counters for the input rate and the number of clients
+func (st *tuiState) readServer(ctx context.Context, u *url.URL) {
+	st.where = u.String()
+	c := wsclient.New(u.String(), wsclient.Options{Token: *tuiToken, Vectors: "none", TLS: tuiTLS()})
+	go c.Run(ctx)
+	go func() {
+		for s := range c.Samples() {
+			st.add(s.ID, s.Quaternion, time.Now())
+		}
+	}()
+	go func() {
+		for e := range c.Events() {
+			st.event(e)
+		}
+	}()
+
+	stats := *u
+	stats.Scheme = strings.Replace(stats.Scheme, "ws", "http", 1)
+	stats.Path = strings.TrimSuffix(stats.Path, "/ws") + "/api/stats"
+	stats.RawQuery = ""
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tuiTLS()}, Timeout: tuiStatsInterval}
+	go func() {
+		for {
+			st.pollStats(ctx, client, stats.String())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(tuiStatsInterval):
+			}
+		}
+	}()
+}
+
+// event tracks the state of the sensor from the server's events
+func (st *tuiState) event(e wsclient.Event) {
+	v, err := e.Decode()
+	if err != nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	switch v := v.(type) {
+	case *wsclient.Session:
+		st.connected = true
+		st.setStatusLocked(v.Status)
+	case *wsclient.Status:
+		st.statuses[v.ID] = tuiStatus(*v)
+	case *wsclient.Heartbeat:
+		st.setStatusLocked(v.Status)
+	case *wsclient.Restarting:
+		st.connected = false
+		st.logLocked(fmt.Sprintf("Server restarting (%s)", v.Reason))
+	}
+}
+
+// setStatusLocked replaces the status of every device with that of the
+// server's input. Must be called with st.mu held.
+func (st *tuiState) setStatusLocked(s wsclient.Status) {
+	clear(st.statuses)
+	if len(s.Devices) == 0 {
+		st.statuses[s.ID] = tuiStatus(s)
+	}
+	for _, d := range s.Devices {
+		st.statuses[d.ID] = tuiStatus(d)
+	}
+}
+
+func tuiStatus(s wsclient.Status) serialStatus {
+	return serialStatus{ID: s.ID, State: s.State, Port: s.Port, Message: s.Message, Hint: s.Hint, Since: s.Since}
+}
+
+// tuiTLS returns the TLS configuration of connections to the server, nil
+// to verify its certificate as usual
+func tuiTLS() *tls.Config {
+	if !*tuiInsecure {
+		return nil
+	}
+	return &tls.Config{InsecureSkipVerify: true}
+}
+
+// pollStats fetches the input rate and number of clients of the server
+func (st *tuiState) pollStats(ctx context.Context, client *http.Client, u string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	if *tuiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*tuiToken)
+	}
+	var stats struct {
+		InputRate float64 `json:"input_rate_hz"`
+		Clients   int     `json:"clients"`
+	}
+	resp, err := client.Do(req)
+	if err == nil {
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&stats)
+		} else {
+			err = fmt.Errorf("%s", resp.Status)
+		}
+		resp.Body.Close()
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err != nil {
+		st.inputRate, st.clients = 0, -1
+		st.connected = false
+		return
+	}
+	st.inputRate, st.clients = stats.InputRate, stats.Clients
+}
+
+// readSource opens the configured source in this process, with no web
+// server, e.g. to check a sensor over SSH before starting the server
+func (st *tuiState) readSource(ctx context.Context) error {
+	if _, err := initConfig(); err != nil {
+		return err
+	}
+	cfg := currentConfig()
+	defaultNamespace = newNamespace("", nil, "")
+	if err := defaultNamespace.initSources(cfg); err != nil {
+		return err
+	}
+	st.where = "source " + cfg.Source
+	if cfg.Source == "serial" {
+		st.where += " " + cfg.Port
+	}
+	st.connected, st.clients = true, -1
+	startSources()
+
+	ns := defaultNamespace
+	go func() {
+		var last uint64
+		ticker := time.NewTicker(tuiRefresh / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				stopSources()
+				return
+			case <-ticker.C:
+			}
+			// Samples are counted from the history, which holds every one
+			now := time.Now()
+			samples, _ := ns.history.since(last)
+			for _, s := range samples {
+				st.add(s.ID, s.Quaternion, now)
+				last = s.Seq
+			}
+			_, rate := ns.samplesIn.read()
+			st.mu.Lock()
+			st.inputRate = rate
+			for _, s := range ns.sourceList() {
+				st.statuses[s.device] = s.getStatus()
+			}
+			st.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// add makes q the latest orientation of a device
+func (st *tuiState) add(id string, q Quaternion, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	d := st.devices[id]
+	if d == nil {
+		d = &tuiDevice{}
+		st.devices[id] = d
+	}
+	d.q, d.last = q, now
+	d.rate.add(1)
+}
+
+// Write keeps the last line logged, to show it under the dashboard
+func (st *tuiState) Write(p []byte) (int, error) {
+	st.mu.Lock()
+	st.logLocked(string(p))
+	st.mu.Unlock()
+	return len(p), nil
+}
+
+func (st *tuiState) logLocked(line string) {
+	st.lastLog, st.lastLogged = strings.TrimSpace(line), time.Now()
+}
+
+// draw redraws the dashboard over the previous one
+func (st *tuiState) draw(w io.Writer) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var b strings.Builder
+	line := func(format string, args ...any) {
+		fmt.Fprintf(&b, format+"\x1b[K\n", args...)
+	}
+
+	b.WriteString("\x1b[H")
+	line("\x1b[1mquatplot\x1b[0m  %s", st.where)
+	link := "\x1b[32mconnected\x1b[0m"
+	if !st.connected {
+		link = "\x1b[31mdisconnected\x1b[0m"
+	}
+	if !*tuiDirect {
+		line("Server  %s", link)
+	}
+	ids := make([]string, 0, len(st.statuses))
+	for id := range st.statuses {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		s := st.statuses[id]
+		name := "Sensor "
+		if id != "" {
+			name = "Sensor " + id + " "
+		}
+		line("%s %s %s", name, stateColor(s.State), s.Port)
+		if s.State != serialConnected && s.Message != "" {
+			line("        %s", s.Message)
+		}
+	}
+	clients := "-"
+	if st.clients >= 0 {
+		clients = fmt.Sprint(st.clients)
+	}
+	line("Input   %.1f Hz    Clients %s", st.inputRate, clients)
+	line("")
+
+	ids = make([]string, 0, len(st.devices))
+	for id := range st.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) == 0 {
+		line("Waiting for samples...")
+	}
+	now := time.Now()
+	for _, id := range ids {
+		d := st.devices[id]
+		name := id
+		if name == "" {
+			name = "sensor"
+		}
+		_, rate := d.rate.read()
+		age := ""
+		if a := now.Sub(d.last); a > time.Second {
+			age = fmt.Sprintf("  \x1b[33mlast sample %s ago\x1b[0m", a.Round(time.Second))
+		}
+		line("\x1b[1m%s\x1b[0m  %.1f Hz%s", name, rate, age)
+		q := d.q
+		e := quat.ToEuler(q, "deg")
+		// The horizon is drawn to the right of the angles
+		h := horizon(e)
+		rows := []string{
+			fmt.Sprintf("  w %+.4f  x %+.4f  y %+.4f  z %+.4f", q.Real, q.I, q.J, q.K),
+			fmt.Sprintf("  roll  %+7.1f° %s", e.Roll, angleBar(e.Roll, 180)),
+			fmt.Sprintf("  pitch %+7.1f° %s", e.Pitch, angleBar(e.Pitch, 90)),
+			fmt.Sprintf("  yaw   %+7.1f° %s %-2s", e.Yaw, angleBar(e.Yaw, 180), compassPoint(e.Yaw)),
+			"",
+		}
+		width := len([]rune(rows[3]))
+		for n, row := range rows {
+			line("%s%s  %s", row, strings.Repeat(" ", width-len([]rune(row))), h[n])
+		}
+		line("")
+	}
+
+	if st.lastLog != "" && now.Sub(st.lastLogged) < time.Minute {
+		line("\x1b[2m%s\x1b[0m", st.lastLog)
+	}
+	line("\x1b[2mCtrl-C to quit\x1b[0m")
+	b.WriteString("\x1b[J")
+	io.WriteString(w, b.String())
+}
+
+// stateColor colors the state of a sensor: green when connected, yellow
+// while connecting, red otherwise
+func stateColor(state string) string {
+	color := "31"
+	switch state {
+	case serialConnected:
+		color = "32"
+	case serialConnecting:
+		color = "33"
+	}
+	return "\x1b[" + color + "m" + state + "\x1b[0m"
+}
+
+// angleBar draws an angle as a bar from the middle, full at ±limit
+func angleBar(angle, limit float64) string {
+	cells := int(math.Round(math.Max(-1, math.Min(1, angle/limit)) * tuiBarWidth))
+	bar := []rune(strings.Repeat("·", tuiBarWidth) + "|" + strings.Repeat("·", tuiBarWidth))
+	for n := 1; n <= abs(cells); n++ {
+		if cells > 0 {
+			bar[tuiBarWidth+n] = '█'
+		} else {
+			bar[tuiBarWidth-n] = '█'
+		}
+	}
+	return "[" + string(bar) + "]"
+}
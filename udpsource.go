@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+)
+
+// maxDatagram is the largest UDP payload read in one go
+const maxDatagram = 65535
+
+func init() {
+	registerSource("udp", sourceType{new: newUDPSource})
+}
+
+// udpSource listens for datagrams of quaternion lines, as sent by WiFi
+// boards such as the ESP32. A datagram may hold one or more lines, and any
+// number of senders may feed the same source.
+type udpSource struct {
+	addr    string
+	format  *lineFormat
+	preview *previewBuffer
+
+	conn    *net.UDPConn
+	buf     []byte
+	pending []Quaternion // Parsed from the last datagram, not yet returned
+	senders map[string]bool
+}
+
+func newUDPSource(cfg Config) Source {
+	return &udpSource{addr: cfg.Listen, format: cfg.lineFormat(), preview: cfg.previewBuffer()}
+}
+
+func (s *udpSource) String() string { return "udp " + s.addr }
+
+func (s *udpSource) Open() error {
+	addr, err := net.ResolveUDPAddr("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.buf = make([]byte, maxDatagram)
+	s.senders = make(map[string]bool)
+	return nil
+}
+
+func (s *udpSource) ReadQuaternion() (Quaternion, error) {
+	for len(s.pending) == 0 {
+		n, from, err := s.conn.ReadFromUDP(s.buf)
+		if err != nil {
+			return Quaternion{}, err
+		}
+		if sender := from.String(); !s.senders[sender] {
+			s.senders[sender] = true
+			log.Printf("Receiving UDP data from %s", sender)
+		}
+		if s.format.packet != nil {
+			// A datagram may hold one or more binary packets
+			packets := newLineReader(bytes.NewReader(s.buf[:n]), s.format, s.preview)
+			for {
+				quat, err := packets.next()
+				if err != nil {
+					break
+				}
+				s.pending = append(s.pending, quat)
+			}
+			continue
+		}
+		for _, line := range strings.Split(string(s.buf[:n]), "\n") {
+			line = strings.TrimRight(line, "\r")
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			quat, err := s.format.parse(line)
+			s.preview.add(line, quat, err)
+			if err != nil {
+				log.Printf("Error parsing quaternion from %s: %v (line: %s)", from, err, line)
+				continue
+			}
+			s.pending = append(s.pending, quat)
+		}
+	}
+	quat := s.pending[0]
+	s.pending = s.pending[1:]
+	return quat, nil
+}
+
+// Close stops listening, interrupting a read in progress
+func (s *udpSource) Close() error {
+	return s.conn.Close()
+}
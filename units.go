@@ -0,0 +1,13 @@
+package main
+
+// unitPrefs are the units derived values are expressed in
+type unitPrefs struct {
+	Angle string `json:"angle"`     // Euler angles, "deg" or "rad"
+	Rate  string `json:"rate"`      // Angular rates, "deg/s" or "rad/s"
+	Freq  string `json:"frequency"` // Sample and update rates, always "Hz"
+}
+
+// prefsFor describes the units used for a given angle unit
+func prefsFor(angle string) unitPrefs {
+	return unitPrefs{Angle: angle, Rate: angle + "/s", Freq: "Hz"}
+}
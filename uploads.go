@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var uploadRetryMax = flag.Duration("upload-retry-max", 5*time.Minute, "Longest wait between attempts to archive a finished recording to -storage, they are retried until they succeed")
+
+const (
+	// uploadRetryMin is the wait after the first failed attempt, doubled
+	// after each one up to -upload-retry-max
+	uploadRetryMin = 5 * time.Second
+	// uploadManifest lists the uploads still to be done, next to the
+	// recording, so that they are retried after a restart
+	uploadManifest = ".quatplot-uploads.json"
+)
+
+// uploadJob archives a finished recording and its summary files
+type uploadJob struct {
+	Host      string    `json:"host"`  // Names the folder of the node that recorded them
+	Files     []string  `json:"files"` // The recording first
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	Next      time.Time `json:"next"` // Earliest time of the next attempt
+}
+
+// uploader archives finished recordings to the storage in the background,
+// retrying with backoff until they are stored
+type uploader struct {
+	mu       sync.Mutex
+	pending  []*uploadJob
+	manifest string
+	uploaded uint64
+	lastErr  string
+	wake     chan struct{}
+	idle     chan struct{} // Closed and replaced whenever nothing is pending
+}
+
+// uploadStats describes the archiving of recordings in /api/stats
+type uploadStats struct {
+	Storage     string     `json:"storage"`
+	Pending     int        `json:"pending"`
+	Uploaded    uint64     `json:"uploaded"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// activeUploader is set by startUploads when recordings are archived
+var activeUploader *uploader
+
+// startUploads picks up the uploads a previous run left unfinished and
+// starts archiving recordings, when recording to persistent storage
+func startUploads() {
+	if *recordPath == "" {
+		return
+	}
+	u := &uploader{manifest: filepath.Join(filepath.Dir(*recordPath), uploadManifest), wake: make(chan struct{}, 1), idle: make(chan struct{})}
+	if err := u.load(); err != nil {
+		log.Printf("Error reading unfinished uploads: %v", err)
+	}
+	if len(u.pending) > 0 {
+		log.Printf("Resuming %d unfinished uploads to %s", len(u.pending), activeStorage)
+	}
+	activeUploader = u
+	go u.run()
+}
+
+// archiveRecording queues a finished recording and the files of its
+// session summary to be copied to the storage, under recordings/{host}/
+func archiveRecording(files ...string) {
+	u := activeUploader
+	if u == nil {
+		return
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	for n, p := range files {
+		// The manifest outlives the working directory
+		if abs, err := filepath.Abs(p); err == nil {
+			files[n] = abs
+		}
+	}
+	u.mu.Lock()
+	u.pending = append(u.pending, &uploadJob{Host: host, Files: files})
+	u.saveLocked()
+	u.mu.Unlock()
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// waitUploads waits up to timeout for the queued uploads to finish, on
+// shutdown. What is left is retried when the server next starts.
+func waitUploads(timeout time.Duration) {
+	u := activeUploader
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	idle, n := u.idle, len(u.pending)
+	u.mu.Unlock()
+	if n == 0 {
+		return
+	}
+	select {
+	case <-idle:
+	case <-time.After(timeout):
+		log.Printf("%d uploads to %s are unfinished, they are retried on the next start", n, activeStorage)
+	}
+}
+
+func (u *uploader) run() {
+	for {
+		u.mu.Lock()
+		var job *uploadJob
+		var wait time.Duration = -1
+		now := time.Now()
+		for _, j := range u.pending {
+			if d := j.Next.Sub(now); d <= 0 {
+				job = j
+				break
+			} else if wait < 0 || d < wait {
+				wait = d
+			}
+		}
+		u.mu.Unlock()
+
+		if job == nil {
+			var timer <-chan time.Time
+			if wait >= 0 {
+				timer = time.After(wait)
+			}
+			select {
+			case <-u.wake:
+			case <-timer:
+			}
+			continue
+		}
+		u.attempt(job)
+	}
+}
+
+// attempt uploads the files of a job, and schedules it again with backoff
+// when that fails
+func (u *uploader) attempt(job *uploadJob) {
+	err := uploadFiles(job)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err != nil {
+		job.Attempts++
+		job.LastError = err.Error()
+		delay := *uploadRetryMax
+		if job.Attempts < 16 {
+			delay = min(uploadRetryMin<<(job.Attempts-1), *uploadRetryMax)
+		}
+		job.Next = time.Now().Add(delay)
+		u.lastErr = err.Error()
+		log.Printf("Error archiving %s to %s: %v. Retrying in %v", job.Files[0], activeStorage, err, delay)
+	} else {
+		log.Printf("Archived %s to %s", job.Files[0], activeStorage)
+		u.uploaded++
+		u.lastErr = ""
+		for n, j := range u.pending {
+			if j == job {
+				u.pending = append(u.pending[:n], u.pending[n+1:]...)
+				break
+			}
+		}
+		if len(u.pending) == 0 {
+			close(u.idle)
+			u.idle = make(chan struct{})
+		}
+	}
+	u.saveLocked()
+}
+
+// uploadFiles copies the files of a job to the storage. Files that no
+// longer exist are skipped, they can't be uploaded any more.
+func uploadFiles(job *uploadJob) error {
+	for _, p := range job.Files {
+		f, err := os.Open(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Not archiving %s, it no longer exists", p)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err == nil {
+			name := "recordings/" + job.Host + "/" + filepath.Base(p)
+			err = activeStorage.Put(name, f, info.Size())
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load reads the uploads a previous run left unfinished
+func (u *uploader) load() error {
+	data, err := os.ReadFile(u.manifest)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &u.pending)
+}
+
+// saveLocked writes the pending uploads to the manifest atomically, or
+// removes it when there are none. Must be called with u.mu held.
+func (u *uploader) saveLocked() {
+	if len(u.pending) == 0 {
+		if err := os.Remove(u.manifest); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error removing %s: %v", u.manifest, err)
+		}
+		return
+	}
+	data, err := json.MarshalIndent(u.pending, "", "  ")
+	if err == nil {
+		tmp := u.manifest + ".tmp"
+		if err = os.WriteFile(tmp, append(data, '\n'), 0o644); err == nil {
+			err = os.Rename(tmp, u.manifest)
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving unfinished uploads to %s: %v", u.manifest, err)
+	}
+}
+
+// pendingFile reports whether a file is still to be uploaded, so that it
+// isn't deleted before it is archived
+func (u *uploader) pendingFile(path string) bool {
+	if u == nil {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, j := range u.pending {
+		for _, f := range j.Files {
+			if f == abs {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (u *uploader) stats() *uploadStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st := &uploadStats{Storage: activeStorage.String(), Pending: len(u.pending), Uploaded: u.uploaded, LastError: u.lastErr}
+	for _, j := range u.pending {
+		if j.Attempts > 0 && (st.NextAttempt == nil || j.Next.Before(*st.NextAttempt)) {
+			next := j.Next
+			st.NextAttempt = &next
+		}
+	}
+	return st
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+// configError is a problem found in one field of a configuration file
+type configError struct {
+	Field string
+	Msg   string
+}
+
+func (e configError) Error() string {
+	if e.Field == "" {
+		return e.Msg
+	}
+	return e.Field + ": " + e.Msg
+}
+
+// configErrors collects every problem found in a configuration file
+type configErrors []configError
+
+func (errs configErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for idx, e := range errs {
+		msgs[idx] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// configFields returns the JSON keys accepted in the configuration file
+func configFields() []string {
+	return jsonFields(reflect.TypeOf(Config{}))
+}
+
+// jsonFields returns the JSON keys of the exported fields of a struct type
+func jsonFields(t reflect.Type) []string {
+	var fields []string
+	for idx := 0; idx < t.NumField(); idx++ {
+		if name := jsonName(t.Field(idx)); name != "" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// jsonName returns the JSON key of a struct field, empty if it has none
+func jsonName(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// validateConfigFile decodes a configuration file in the format its name
+// tells and checks every field
+func validateConfigFile(path string, data []byte) (Config, configErrors) {
+	data, err := configJSONData(path, data)
+	if err != nil {
+		return Config{}, configErrors{{Msg: err.Error()}}
+	}
+	return validateConfigData(data)
+}
+
+// validateConfigData decodes a configuration file and checks every field,
+// returning all problems found rather than stopping at the first one
+func validateConfigData(data []byte) (Config, configErrors) {
+	var cfg Config
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line := bytes.Count(data[:syntaxErr.Offset], []byte("\n")) + 1
+			return cfg, configErrors{{Msg: fmt.Sprintf("line %d: %v", line, err)}}
+		}
+		return cfg, configErrors{{Msg: "expected an object of settings"}}
+	}
+
+	tenantsRaw := raw["tenants"]
+	delete(raw, "tenants")
+	errs, badType := decodeFields(raw, reflect.ValueOf(&cfg).Elem(), "")
+	errs = append(errs, checkSettings("", raw, badType, cfg)...)
+	if tenantsRaw != nil {
+		errs = append(errs, validateTenants(tenantsRaw, &cfg)...)
+	}
+	return cfg, errs
+}
+
+// validateTenants decodes and checks the tenants of a configuration file
+func validateTenants(data json.RawMessage, cfg *Config) configErrors {
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return configErrors{{Field: "tenants", Msg: fmt.Sprintf("expected an object of tenants by name, got %s", data)}}
+	}
+
+	var errs configErrors
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cfg.Tenants = make(map[string]TenantConfig, len(all))
+	for _, name := range names {
+		prefix := "tenants." + name + "."
+		if !tenantName.MatchString(name) {
+			errs = append(errs, configError{Field: "tenants." + name, Msg: "invalid name, use lower case letters, digits, - and _"})
+		}
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(all[name], &raw); err != nil {
+			errs = append(errs, configError{Field: "tenants." + name, Msg: fmt.Sprintf("expected an object, got %s", all[name])})
+			continue
+		}
+		var t TenantConfig
+		tenantErrs, badType := decodeFields(raw, reflect.ValueOf(&t).Elem(), prefix)
+		errs = append(errs, tenantErrs...)
+		errs = append(errs, checkSettings(prefix, raw, badType, t.apply(Config{}))...)
+		cfg.Tenants[name] = t
+	}
+	return errs
+}
+
+// decodeFields decodes the settings in raw into the fields of the struct v,
+// reporting unknown keys and values of the wrong type. Field names in errors
+// are prefixed with prefix.
+func decodeFields(raw map[string]json.RawMessage, v reflect.Value, prefix string) (configErrors, map[string]bool) {
+	var errs configErrors
+	known := jsonFields(v.Type())
+	var keys []string
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !containsString(known, key) {
+			errs = append(errs, configError{Field: prefix + key, Msg: "unknown setting" + didYouMean(key, known)})
+		}
+	}
+
+	// Decode field by field so that one bad value doesn't hide the others
+	badType := make(map[string]bool)
+	for idx := 0; idx < v.NumField(); idx++ {
+		name := jsonName(v.Type().Field(idx))
+		value, ok := raw[name]
+		if name == "" || !ok {
+			continue
+		}
+		if err := json.Unmarshal(value, v.Field(idx).Addr().Interface()); err != nil {
+			errs = append(errs, configError{Field: prefix + name, Msg: fmt.Sprintf("expected %s, got %s", jsonKind(v.Field(idx).Kind()), value)})
+			badType[name] = true
+		}
+	}
+	return errs, badType
+}
+
+// checkSettings checks the values of the settings given in raw, which are
+// shared by the main configuration and tenants
+func checkSettings(prefix string, raw map[string]json.RawMessage, badType map[string]bool, cfg Config) configErrors {
+	var errs configErrors
+	if _, ok := raw["baud"]; ok && !badType["baud"] && cfg.Baud <= 0 {
+		errs = append(errs, configError{Field: prefix + "baud", Msg: fmt.Sprintf("%d must be a positive baud rate", cfg.Baud)})
+	}
+	if _, ok := raw["port"]; ok && !badType["port"] {
+		if _, err := parseDevicePorts(cfg.Port); err != nil {
+			errs = append(errs, configError{Field: prefix + "port", Msg: err.Error()})
+		}
+	}
+	if cfg.Order != "" {
+		if err := checkOrder(cfg.Order); err != nil {
+			errs = append(errs, configError{Field: prefix + "order", Msg: err.Error()})
+		}
+	}
+	if cfg.Format != "" {
+		if f, err := parseLineFormat(cfg.Format); err != nil {
+			errs = append(errs, configError{Field: prefix + "format", Msg: err.Error()})
+		} else if input, err := parseInputMode(cfg.Input); err == nil && cfg.Input != "" {
+			if err := f.checkInput(input); err != nil {
+				errs = append(errs, configError{Field: prefix + "format", Msg: err.Error()})
+			}
+		}
+	}
+	if cfg.EulerOrder != "" {
+		if _, err := quat.ParseOrder(cfg.EulerOrder); err != nil {
+			errs = append(errs, configError{Field: prefix + "euler_order", Msg: err.Error()})
+		}
+	}
+	if cfg.AngleOrder != "" {
+		if _, err := quat.ParseOrder(cfg.AngleOrder); err != nil {
+			errs = append(errs, configError{Field: prefix + "angle_order", Msg: err.Error()})
+		}
+	}
+	if _, ok := raw["imu_rate"]; ok && !badType["imu_rate"] && cfg.IMURate < 0 {
+		errs = append(errs, configError{Field: prefix + "imu_rate", Msg: fmt.Sprintf("%g must not be negative", cfg.IMURate)})
+	}
+	if _, err := parseVectors(cfg.Vectors); err != nil {
+		errs = append(errs, configError{Field: prefix + "vectors", Msg: err.Error()})
+	}
+	if _, err := parseQuatKeys(cfg.QuatKeys); err != nil {
+		errs = append(errs, configError{Field: prefix + "quat_keys", Msg: err.Error()})
+	}
+	if _, err := parseRemap(cfg.Remap); err != nil {
+		errs = append(errs, configError{Field: prefix + "remap", Msg: err.Error()})
+	}
+	if _, err := parseMount(cfg.Mount); err != nil {
+		errs = append(errs, configError{Field: prefix + "mount", Msg: err.Error()})
+	}
+	if _, ok := raw["smoothing"]; ok && !badType["smoothing"] && cfg.Smoothing < 0 {
+		errs = append(errs, configError{Field: prefix + "smoothing", Msg: fmt.Sprintf("%g must not be negative", cfg.Smoothing)})
+	}
+	if _, err := parseSmoothMethod(cfg.SmoothMethod); err != nil {
+		errs = append(errs, configError{Field: prefix + "smoothing_method", Msg: err.Error()})
+	}
+	if err := checkStorage(cfg.Storage); err != nil {
+		errs = append(errs, configError{Field: prefix + "storage", Msg: err.Error()})
+	}
+	if _, ok := raw["streams"]; ok && !badType["streams"] {
+		if err := checkStreams(cfg.Streams); err != nil {
+			errs = append(errs, configError{Field: prefix + "streams", Msg: err.Error()})
+		}
+	}
+	checkChoice := func(field, value string, options []string) {
+		if value != "" && !containsString(options, strings.ToLower(value)) {
+			errs = append(errs, configError{Field: prefix + field, Msg: fmt.Sprintf("%q unknown%s", value, didYouMean(value, options))})
+		}
+	}
+	checkChoice("source", cfg.Source, sourceNames())
+	checkChoice("protocol", cfg.Protocol, []string{protocolText, protocolBinary, protocolBNORVC, protocolBNOSHTP})
+	checkChoice("input", cfg.Input, []string{inputQuaternion, inputEuler, inputMatrix, inputIMU})
+	checkChoice("ahrs", cfg.AHRS, []string{ahrsMadgwick, ahrsMahony})
+	checkChoice("gyro_units", cfg.GyroUnits, []string{"deg", "rad", "degrees", "radians", "degree", "radian"})
+	checkChoice("angle_units", cfg.AngleUnits, []string{"deg", "rad", "degrees", "radians", "degree", "radian"})
+	checkChoice("euler_units", cfg.EulerUnits, []string{"deg", "rad", "degrees", "radians", "degree", "radian"})
+	checkChoice("convention", cfg.Convention, []string{conventionHamilton, conventionJPL})
+	checkChoice("frame", cfg.Frame, []string{"enu", "ned", "nwu", "unspecified"})
+	keys := make([]string, 0, len(cfg.Flags))
+	for key := range cfg.Flags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := checkFileFlag(key); err != nil {
+			errs = append(errs, configError{Field: prefix + "flags." + key, Msg: err.Error()})
+		}
+	}
+	return errs
+}
+
+// runCheckConfig validates the configuration file, prints the result and
+// returns the process exit code
+func runCheckConfig() int {
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if _, errs := validateConfigFile(*configPath, data); len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, e)
+		}
+		return 1
+	}
+	fmt.Printf("%s: OK\n", *configPath)
+	return 0
+}
+
+func jsonKind(k reflect.Kind) string {
+	switch k {
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return "an integer"
+	case reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Slice:
+		return "a list"
+	}
+	return "an object"
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// didYouMean suggests the closest option to a misspelt value, if any is close enough
+func didYouMean(s string, options []string) string {
+	best, bestDist := "", len(s)/2+2
+	for _, opt := range options {
+		if d := editDistance(strings.ToLower(s), opt); d < bestDist {
+			best, bestDist = opt, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf("; did you mean %q?", best)
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
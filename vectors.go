@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/intermernet/quatplot/quat"
+)
+
+var derivedVectors = flag.String("vectors", "", "Derived vectors sent with each sample, comma separated: gravity, heading, angular_velocity (default: none)")
+
+// vectorSet selects the derived vectors sent with samples
+type vectorSet struct {
+	Gravity         bool
+	Heading         bool
+	AngularVelocity bool
+}
+
+// parseVectors parses a comma separated list of derived vectors, "none" or
+// empty for none
+func parseVectors(s string) (vectorSet, error) {
+	var v vectorSet
+	for _, name := range strings.Split(s, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "", "none":
+		case "gravity":
+			v.Gravity = true
+		case "heading":
+			v.Heading = true
+		case "angular_velocity":
+			v.AngularVelocity = true
+		default:
+			return vectorSet{}, fmt.Errorf("unknown vector %q, expected gravity, heading, angular_velocity or none", name)
+		}
+	}
+	return v, nil
+}
+
+// names lists the selected vectors, as declared in the session message
+func (v vectorSet) names() []string {
+	var names []string
+	if v.Gravity {
+		names = append(names, "gravity")
+	}
+	if v.Heading {
+		names = append(names, "heading")
+	}
+	if v.AngularVelocity {
+		names = append(names, "angular_velocity")
+	}
+	return names
+}
+
+// headingVector is the direction the sensor faces, in the horizontal plane
+// of the reference frame
+type headingVector struct {
+	quat.Vector
+	Bearing *float64 `json:"bearing,omitempty"` // Clockwise from north, when the frame is known
+}
+
+// gravityVector returns the direction of gravity in the sensor's own axes,
+// which is what an accelerometer at rest would point away from. Down is -Z
+// in the frame unless it is NED.
+func gravityVector(q Quaternion, frame string) *quat.Vector {
+	q, ok := quat.Normalize(q)
+	if !ok {
+		return nil
+	}
+	down := quat.Vector{Z: -1}
+	if frame == "ned" {
+		down.Z = 1
+	}
+	// Samples rotate body to reference, so the inverse takes down into the body
+	g := quat.Rotate(Quaternion{I: -q.I, J: -q.J, K: -q.K, Real: q.Real}, down)
+	return &g
+}
+
+// heading returns the sensor's forward axis, X, in the reference frame
+// projected onto the horizontal plane, or nil when it points straight up or
+// down and has no heading. The bearing is in the given angle units.
+func heading(q Quaternion, frame, units string) *headingVector {
+	q, ok := quat.Normalize(q)
+	if !ok {
+		return nil
+	}
+	f := quat.Rotate(q, quat.Vector{X: 1})
+	n := math.Hypot(f.X, f.Y)
+	if n < 1e-9 {
+		return nil
+	}
+	h := &headingVector{Vector: quat.Vector{X: f.X / n, Y: f.Y / n}}
+
+	var bearing float64
+	switch frame {
+	case "enu":
+		bearing = math.Atan2(h.X, h.Y)
+	case "ned":
+		bearing = math.Atan2(h.Y, h.X)
+	case "nwu":
+		bearing = math.Atan2(-h.Y, h.X)
+	default:
+		return h
+	}
+	if bearing < 0 {
+		bearing += 2 * math.Pi
+	}
+	bearing = quat.ConvertAngle(bearing, units)
+	h.Bearing = &bearing
+	return h
+}
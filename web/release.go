@@ -0,0 +1,14 @@
+//go:build release
+
+package web
+
+import "embed"
+
+// vendored names the files of VendorFiles and three.js's LICENSE, so that a
+// release build fails while one of them isn't in static/vendor instead of
+// making a viewer that needs internet access
+//
+//go:embed static/vendor/three.min.js static/vendor/OBJLoader.js static/vendor/MTLLoader.js
+//go:embed static/vendor/STLLoader.js static/vendor/PLYLoader.js static/vendor/GLTFLoader.js
+//go:embed static/vendor/LICENSE
+var vendored embed.FS
@@ -0,0 +1,1779 @@
+let scene, camera, renderer, mesh;
+let currentQuat = new THREE.Quaternion(0, 0, 0, 1);
+let devices = {}; // Tagged devices by ID, each with its own copy of the model
+let lastSamples = {}; // Latest sample of each device, '' when untagged
+let manualRotation = new THREE.Quaternion(0, 0, 0, 1);
+let ws;
+let sessionEpoch = null;
+let lastSeq = null;
+let resumeToken = sessionStorage.getItem('quatplotResumeToken');
+let angleUnits = 'deg';
+let streams = {}; // Display metadata of each device by ID, from the server
+let jitterHistory = {}; // Recent jitter of each device in degrees, null while moving
+const jitterPoints = 60;
+let overlayShown = localStorage.getItem('quatplotOverlay') !== '0'; // Whether the axes, grid and compass are drawn
+let overlay = null; // Group of the axes, grid and compass, turned with the manual rotation
+let compassNeedle = null;
+let referenceFrame = 'unspecified'; // Frame the server says orientations are in
+let trailShown = localStorage.getItem('quatplotTrail') === '1'; // Whether the trails of a body axis are drawn
+let trails = {}; // Sphere and recent points of the trail of each device, '' when untagged
+let trailAxis = new THREE.Vector3(1, 0, 0); // Body axis whose path is traced
+let trailSeconds = 10;
+const trailRadius = 2.5; // Models are scaled to at most 4 units
+const trailInterval = 20; // Milliseconds between the points of a trail
+const trailMaxSeconds = 120;
+let chartShown = localStorage.getItem('quatplotChart') === '1';
+let chartPaused = false;
+let chartPausedAt = 0;
+let chartHistory = {}; // Recent samples of each device for the chart, '' when untagged
+const chartSeconds = 60; // Longest window the chart shows
+let chartDrops = []; // When the server dropped samples of ours, from api/clients/drops
+let clockOffset = 0; // Milliseconds the browser's clock is ahead of the server's
+const chartInterval = 5; // Milliseconds between the samples kept for the chart
+const chartSeries = {
+    euler: [['roll', '#ef5350'], ['pitch', '#66bb6a'], ['yaw', '#42a5f5']],
+    quat: [['i', '#ef5350'], ['j', '#66bb6a'], ['k', '#42a5f5'], ['real', '#ffca28']],
+};
+// Version of the WebSocket messages the viewer speaks
+const protocolVersion = 1;
+let reconnectDelay = clientSettings.reconnect_ms;
+let disconnectedSince = null;
+let lastSampleAt = null;
+let sensorSilent = false; // Whether heartbeats say the sensor sends nothing
+let inputStates = {}; // State of the server's input by device ID, '' when untagged
+let presenting = false; // Whether our view is sent to the followers
+let following = localStorage.getItem('quatplotFollow') !== '0'; // Whether we show the presenter's view
+let lastSentView = null;
+let lastViewSentAt = 0;
+let defaultPosition = new THREE.Vector3();
+let modelLoaded = false;
+
+// Mouse rotation variables
+let isMouseDown = false;
+let previousMousePosition = { x: 0, y: 0 };
+let rotationSpeed = 0.005;
+
+// Zoom variables
+let baseCameraDistance = 5; // Base distance to object
+let zoomFactor = 1.0; // Multiplier for zoom (1.0 = no zoom)
+
+// Store loaded files
+let loadedObjFile = null;
+let loadedMtlFile = null;
+let loadedTextureFiles = [];
+let ownModelFiles = null; // Files the user loaded, shown again when the server stops choosing the model
+let libraryModel = null; // Name of the model from the server's library being shown
+
+// Initialize Three.js scene
+function init() {
+    const container = document.getElementById('renderer');
+    document.getElementById('followButton').textContent = 'Follow Presenter: ' + (following ? 'On' : 'Off');
+    showChart();
+    
+    // Scene
+    scene = new THREE.Scene();
+    scene.background = new THREE.Color(0x2a2a2a);
+    
+    // Camera
+    camera = new THREE.PerspectiveCamera(
+        75,
+        container.clientWidth / container.clientHeight,
+        0.1,
+        1000
+    );
+    camera.position.z = 5;
+    
+    // Renderer
+    renderer = new THREE.WebGLRenderer({ antialias: true });
+    renderer.setSize(container.clientWidth, container.clientHeight);
+    container.appendChild(renderer.domElement);
+    if (clientSettings.kiosk) {
+        document.body.classList.add('kiosk');
+        // Nobody is around to reload a display whose GPU context was lost
+        renderer.domElement.addEventListener('webglcontextlost', () => window.location.reload());
+        pollKioskStatus();
+        setInterval(pollKioskStatus, 5000);
+    }
+    
+    // Lights
+    const ambientLight = new THREE.AmbientLight(0xffffff, 0.5);
+    scene.add(ambientLight);
+    
+    const directionalLight = new THREE.DirectionalLight(0xffffff, 0.8);
+    directionalLight.position.set(1, 1, 1);
+    scene.add(directionalLight);
+    
+    const directionalLight2 = new THREE.DirectionalLight(0xffffff, 0.4);
+    directionalLight2.position.set(-1, -1, -1);
+    scene.add(directionalLight2);
+    
+    // Default cube if no model loaded
+    createDefaultCube();
+    buildOverlay();
+    document.getElementById('overlayButton').textContent = 'Axes and Compass: ' + (overlayShown ? 'On' : 'Off');
+    showTrail();
+    
+    // Handle window resize
+    window.addEventListener('resize', onWindowResize);
+    
+    // Handle mouse wheel for zooming
+    container.addEventListener('wheel', onMouseWheel, { passive: false });
+    
+    // Handle mouse rotation and panning
+    container.addEventListener('mousedown', onMouseDown);
+    container.addEventListener('mousemove', onMouseMove);
+    container.addEventListener('mouseup', onMouseUp);
+    container.addEventListener('mouseleave', onMouseUp);
+    
+    // Handle Shift key for pan mode cursor
+    window.addEventListener('keydown', onKeyDown);
+    window.addEventListener('keyup', onKeyUp);
+    
+    // Start animation loop
+    animate();
+    
+    // Connect WebSocket
+    connectWebSocket();
+}
+
+function toggleMenu() {
+    const controls = document.getElementById('controls');
+    controls.classList.toggle('show');
+    if (controls.classList.contains('show')) {
+        loadPorts();
+    }
+}
+
+// loadPorts fills the port picker with the serial ports of the
+// server, hiding it when the input can't be switched
+function loadPorts() {
+    const picker = document.getElementById('portPicker');
+    fetch('api/ports').then(r => r.ok ? r.json() : null).then(info => {
+        if (!info || !info.switchable) {
+            picker.classList.remove('show');
+            return;
+        }
+        const select = document.getElementById('portSelect');
+        select.innerHTML = '';
+        const names = info.ports.map(p => p.name);
+        if (names.indexOf(info.port) < 0) {
+            names.unshift(info.port); // e.g. auto, or a port that went away
+        }
+        names.forEach(name => {
+            const p = info.ports.find(p => p.name === name);
+            const opt = document.createElement('option');
+            opt.value = name;
+            opt.textContent = name + (p && p.product ? ' (' + p.product + ')' : '');
+            select.appendChild(opt);
+        });
+        select.value = info.port;
+        const baud = document.getElementById('baudSelect');
+        if (!Array.from(baud.options).some(o => o.value === String(info.baud))) {
+            const opt = document.createElement('option');
+            opt.textContent = info.baud;
+            baud.appendChild(opt);
+        }
+        baud.value = String(info.baud);
+        picker.classList.add('show');
+    }).catch(() => picker.classList.remove('show'));
+}
+
+// connectPort switches the server's serial input to the picked port
+// and baud rate, for every viewer and the recording alike
+function connectPort() {
+    const port = document.getElementById('portSelect').value;
+    const baud = parseInt(document.getElementById('baudSelect').value, 10);
+    fetch('api/connect', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ port: port, baud: baud })
+    }).then(r => {
+        if (!r.ok) {
+            return r.text().then(text => window.alert(text.trim()));
+        }
+    }).catch(err => console.error('Error switching port:', err));
+}
+
+function toggleInfo() {
+    const info = document.getElementById('info');
+    info.classList.toggle('hidden');
+}
+
+// pollNoise charts the jitter the server measures for each device
+// while the info panel is open
+function pollNoise() {
+    if (document.getElementById('info').classList.contains('hidden')) {
+        return;
+    }
+    fetch('api/stats').then(r => r.ok ? r.json() : null).then(stats => {
+        if (!stats) return;
+        stats.noise.forEach(n => {
+            const history = jitterHistory[n.id || ''] = jitterHistory[n.id || ''] || [];
+            history.push(n.still ? n.jitter_deg : null);
+            if (history.length > jitterPoints) history.shift();
+        });
+        drawNoise(stats.noise);
+        // Error against the simulator's true orientation, with -sim-truth
+        const fe = stats.filter_error;
+        document.getElementById('filterInfo').textContent = fe && fe.samples > 0 ?
+            'Filter error (' + fe.filter + '): ' + fe.current.toFixed(2) + '°, RMS ' + fe.angle.rmse.toFixed(2) + '° over 10 s' : '';
+    }).catch(() => {});
+}
+
+function drawNoise(noise) {
+    const info = document.getElementById('noiseInfo');
+    info.innerHTML = '';
+    noise.forEach(n => {
+        const row = document.createElement('div');
+        const label = n.id ? n.id + ': ' : '';
+        row.textContent = label + (n.still && n.jitter_deg !== undefined ? 'jitter ' + n.jitter_deg.toFixed(3) + '°' : 'moving');
+        info.appendChild(row);
+
+        // Sparkline of the jitter, with gaps while moving
+        const canvas = document.createElement('canvas');
+        canvas.width = 200;
+        canvas.height = 30;
+        info.appendChild(canvas);
+        const ctx = canvas.getContext('2d');
+        const history = jitterHistory[n.id || ''];
+        const top = Math.max(0.01, ...history.filter(v => v !== null)) * 1.2;
+        ctx.strokeStyle = '#8b9cff';
+        ctx.beginPath();
+        let drawing = false;
+        history.forEach((v, i) => {
+            if (v === null) {
+                drawing = false;
+                return;
+            }
+            const x = i * canvas.width / (jitterPoints - 1);
+            const y = canvas.height - v / top * canvas.height;
+            drawing ? ctx.lineTo(x, y) : ctx.moveTo(x, y);
+            drawing = true;
+        });
+        ctx.stroke();
+        ctx.fillStyle = '#999';
+        ctx.font = '9px monospace';
+        ctx.fillText(top.toFixed(3) + '°', 2, 9);
+    });
+}
+setInterval(pollNoise, 1000);
+
+function toggleChart() {
+    chartShown = !chartShown;
+    localStorage.setItem('quatplotChart', chartShown ? '1' : '0');
+    showChart();
+}
+
+function showChart() {
+    document.getElementById('chart').classList.toggle('hidden', !chartShown);
+    document.getElementById('chartButton').textContent = 'Chart: ' + (chartShown ? 'On' : 'Off');
+    if (!chartShown) {
+        // Samples are only kept while the chart is shown
+        chartHistory = {};
+        updateChartDevices();
+    }
+}
+
+// toggleChartPause freezes the chart, or carries on from now
+function toggleChartPause() {
+    chartPaused = !chartPaused;
+    chartPausedAt = Date.now();
+    document.getElementById('chartPause').textContent = chartPaused ? 'Resume' : 'Pause';
+}
+
+// recordChartSample keeps a sample for the chart, at most one every
+// chartInterval milliseconds of each device so that fast sensors don't
+// fill the browser's memory
+function recordChartSample(data) {
+    if (!chartShown || chartPaused) return;
+    const id = data.id || '';
+    const now = Date.now();
+    if (!chartHistory[id]) {
+        chartHistory[id] = [];
+        updateChartDevices();
+    }
+    const history = chartHistory[id];
+    if (history.length && now - history[history.length - 1].t < chartInterval) return;
+    history.push({
+        t: now,
+        quat: [data.i, data.j, data.k, data.real],
+        euler: data.euler ? [data.euler.roll, data.euler.pitch, data.euler.yaw] : null,
+    });
+}
+
+// pollChartDrops fetches when the server dropped or conflated samples
+// on their way to us, to shade them on the chart
+function pollChartDrops() {
+    if (!chartShown || chartPaused || !resumeToken) return;
+    const since = new Date(Date.now() - clockOffset - chartSeconds * 1000).toISOString();
+    fetch('api/clients/drops?token=' + encodeURIComponent(resumeToken) + '&since=' + since)
+        .then(r => r.ok ? r.json() : null)
+        .then(body => {
+            if (!body || !body.clients.length) return;
+            chartDrops = body.clients[0].ranges.map(d => ({
+                start: Date.parse(d.start) + clockOffset,
+                end: Date.parse(d.end) + clockOffset,
+                reason: d.reason,
+            }));
+        }).catch(() => {});
+}
+setInterval(pollChartDrops, 1000);
+
+// updateChartDevices offers a choice of device when there are several
+function updateChartDevices() {
+    const select = document.getElementById('chartDevice');
+    const ids = Object.keys(chartHistory).sort();
+    const current = select.value;
+    select.innerHTML = '';
+    if (ids.length < 2) return;
+    ids.forEach(id => {
+        const option = document.createElement('option');
+        option.value = id;
+        option.textContent = streams[id] ? streams[id].name : id || 'Sensor';
+        select.appendChild(option);
+    });
+    if (ids.includes(current)) select.value = current;
+}
+
+// drawChart plots the samples of the chosen device over the chosen
+// window, the Euler angles in the client's units or the quaternion
+function drawChart() {
+    if (!chartShown) return;
+    const canvas = document.getElementById('chartCanvas');
+    const ratio = window.devicePixelRatio || 1;
+    const width = canvas.clientWidth, height = canvas.clientHeight;
+    if (canvas.width !== Math.round(width * ratio) || canvas.height !== Math.round(height * ratio)) {
+        canvas.width = Math.round(width * ratio);
+        canvas.height = Math.round(height * ratio);
+    }
+    const ctx = canvas.getContext('2d');
+    ctx.setTransform(ratio, 0, 0, ratio, 0, 0);
+    ctx.clearRect(0, 0, width, height);
+
+    const mode = document.getElementById('chartMode').value;
+    const select = document.getElementById('chartDevice');
+    const id = select.value || Object.keys(chartHistory).sort()[0] || '';
+    const history = chartHistory[id] || [];
+    const end = chartPaused ? chartPausedAt : Date.now();
+    if (!chartPaused) {
+        const stale = history.findIndex(p => p.t >= end - chartSeconds * 1000);
+        history.splice(0, stale < 0 ? history.length : stale);
+    }
+    const span = Number(document.getElementById('chartWindow').value) * 1000;
+    const values = p => mode === 'euler' ? p.euler : p.quat;
+    const visible = history.filter(p => p.t >= end - span && p.t <= end && values(p));
+
+    // Euler angles wrap around at the full range, quaternions stay within it
+    const full = mode === 'euler' ? (angleUnits === 'deg' ? 180 : Math.PI) : 1;
+    let lo = -full, hi = full;
+    if (document.getElementById('chartScale').value === 'auto' && visible.length) {
+        lo = Math.min(...visible.map(p => Math.min(...values(p))));
+        hi = Math.max(...visible.map(p => Math.max(...values(p))));
+        const pad = Math.max((hi - lo) * 0.1, full / 100);
+        lo = Math.max(lo - pad, -full);
+        hi = Math.min(hi + pad, full);
+    }
+
+    const left = 50, top = 8, bottom = height - 16, right = width - 8;
+    const x = t => left + (t - (end - span)) / span * (right - left);
+    const y = v => bottom - (v - lo) / (hi - lo) * (bottom - top);
+    // Shade where we missed samples, darker while we were reconnecting
+    chartDrops.forEach(d => {
+        if (d.end < end - span || d.start > end) return;
+        const from = Math.max(x(d.start), left), to = Math.min(x(d.end), right);
+        ctx.fillStyle = d.reason === 'disconnected' ? 'rgba(244, 67, 54, 0.35)' : 'rgba(255, 193, 7, 0.25)';
+        ctx.fillRect(from, top, Math.max(to - from, 1), bottom - top);
+    });
+    const unit = mode !== 'euler' ? '' : angleUnits === 'deg' ? '°' : ' rad';
+    const digits = mode === 'euler' && angleUnits === 'deg' ? 1 : 3;
+    ctx.font = '10px monospace';
+    ctx.fillStyle = '#999';
+    ctx.strokeStyle = 'rgba(255, 255, 255, 0.2)';
+    ctx.beginPath();
+    [lo, (lo + hi) / 2, hi].forEach(v => {
+        ctx.moveTo(left, y(v));
+        ctx.lineTo(right, y(v));
+        ctx.fillText(v.toFixed(digits) + unit, 2, Math.min(Math.max(y(v) + 3, 10), bottom));
+    });
+    ctx.stroke();
+    ctx.fillText('-' + span / 1000 + ' s', left, height - 3);
+    ctx.fillText(chartPaused ? 'paused' : 'now', right - 36, height - 3);
+
+    // Draw about two points per pixel, with gaps where the stream paused
+    // or an angle wrapped around
+    const stride = Math.max(1, Math.floor(visible.length / ((right - left) * 2)));
+    chartSeries[mode].forEach(([name, color], n) => {
+        ctx.strokeStyle = color;
+        ctx.beginPath();
+        let prev = null;
+        for (let i = 0; i < visible.length; i += stride) {
+            const p = visible[i];
+            const v = values(p)[n];
+            if (prev && p.t - prev.t < 1000 && Math.abs(v - values(prev)[n]) < full) {
+                ctx.lineTo(x(p.t), y(v));
+            } else {
+                ctx.moveTo(x(p.t), y(v));
+            }
+            prev = p;
+        }
+        ctx.stroke();
+        ctx.fillStyle = color;
+        ctx.fillText(name, right - 40 * (chartSeries[mode].length - n), top + 8);
+    });
+}
+
+// Directions of the reference frames the server may declare, in the
+// coordinates orientations rotate into, which the scene uses as they are
+const frameAxes = {
+    enu: { up: [0, 0, 1], north: [0, 1, 0], east: [1, 0, 0], labels: ['E', 'N', 'U'] },
+    ned: { up: [0, 0, -1], north: [1, 0, 0], east: [0, 1, 0], labels: ['N', 'E', 'D'] },
+    nwu: { up: [0, 0, 1], north: [1, 0, 0], east: [0, -1, 0], labels: ['N', 'W', 'U'] },
+};
+
+function toggleOverlay() {
+    overlayShown = !overlayShown;
+    localStorage.setItem('quatplotOverlay', overlayShown ? '1' : '0');
+    document.getElementById('overlayButton').textContent = 'Axes and Compass: ' + (overlayShown ? 'On' : 'Off');
+    if (overlay) overlay.visible = overlayShown;
+}
+
+// makeLabel returns a sprite showing a few characters of text
+function makeLabel(text, color) {
+    const canvas = document.createElement('canvas');
+    canvas.width = canvas.height = 64;
+    const ctx = canvas.getContext('2d');
+    ctx.font = 'bold 44px Arial';
+    ctx.fillStyle = color;
+    ctx.textAlign = 'center';
+    ctx.textBaseline = 'middle';
+    ctx.fillText(text, 32, 32);
+    const sprite = new THREE.Sprite(new THREE.SpriteMaterial({ map: new THREE.CanvasTexture(canvas), depthTest: false }));
+    sprite.scale.set(0.5, 0.5, 1);
+    return sprite;
+}
+
+// buildOverlay draws the axes of the reference frame, and with a known
+// frame a ground grid below the model and a compass around it whose
+// needle follows the sensor's x axis, so that drift in heading shows
+function buildOverlay() {
+    if (overlay) {
+        scene.remove(overlay);
+    }
+    overlay = new THREE.Group();
+    overlay.visible = overlayShown;
+    const frame = frameAxes[referenceFrame];
+    const vec = a => new THREE.Vector3(a[0], a[1], a[2]);
+
+    overlay.add(new THREE.AxesHelper(3));
+    const labels = frame ? frame.labels : ['X', 'Y', 'Z'];
+    ['#ff5252', '#69f0ae', '#448aff'].forEach((color, n) => {
+        const label = makeLabel(labels[n], color);
+        label.position.setComponent(n, 3.3);
+        overlay.add(label);
+    });
+
+    // Without a frame, up is the scene's own and north is unknown
+    const up = frame ? vec(frame.up) : new THREE.Vector3(0, 1, 0);
+    const ground = new THREE.Group();
+    ground.quaternion.setFromUnitVectors(new THREE.Vector3(0, 1, 0), up);
+    ground.position.copy(up).multiplyScalar(-2.5);
+    ground.add(new THREE.GridHelper(20, 20, 0x666666, 0x404040));
+    overlay.add(ground);
+
+    compassNeedle = null;
+    if (frame) {
+        const ring = new THREE.Mesh(new THREE.RingGeometry(3.9, 4, 64),
+            new THREE.MeshBasicMaterial({ color: 0xaaaaaa, side: THREE.DoubleSide }));
+        ring.quaternion.setFromUnitVectors(new THREE.Vector3(0, 0, 1), up);
+        overlay.add(ring);
+        const north = vec(frame.north), east = vec(frame.east);
+        [['N', north, '#ff5252'], ['E', east, '#ffffff'], ['S', north.clone().negate(), '#ffffff'], ['W', east.clone().negate(), '#ffffff']]
+            .forEach(([text, dir, color]) => {
+                const label = makeLabel(text, color);
+                label.position.copy(dir).multiplyScalar(4.4);
+                overlay.add(label);
+            });
+        compassNeedle = new THREE.Line(new THREE.BufferGeometry().setFromPoints([new THREE.Vector3(), new THREE.Vector3()]),
+            new THREE.LineBasicMaterial({ color: 0xffca28 }));
+        compassNeedle.userData.up = up;
+        overlay.add(compassNeedle);
+    }
+    scene.add(overlay);
+}
+
+// updateOverlay turns the overlay with the manual rotation, as the
+// models are, and points the needle along the sensor's x axis projected
+// onto the ground
+function updateOverlay() {
+    if (!overlay || !overlay.visible) return;
+    overlay.quaternion.copy(manualRotation);
+    if (!compassNeedle) return;
+    const ids = Object.keys(devices).sort();
+    const quat = ids.length ? devices[ids[0]].quat : currentQuat;
+    const up = compassNeedle.userData.up;
+    const heading = new THREE.Vector3(1, 0, 0).applyQuaternion(quat);
+    heading.sub(up.clone().multiplyScalar(heading.dot(up)));
+    // Pointing straight up or down the sensor has no heading
+    compassNeedle.visible = heading.length() > 0.1;
+    heading.normalize().multiplyScalar(3.9);
+    const points = compassNeedle.geometry.attributes.position;
+    points.setXYZ(1, heading.x, heading.y, heading.z);
+    points.needsUpdate = true;
+}
+
+// toggleTrail shows or hides the path a body axis traced on a sphere
+// around each model
+function toggleTrail() {
+    trailShown = !trailShown;
+    localStorage.setItem('quatplotTrail', trailShown ? '1' : '0');
+    showTrail();
+}
+
+function showTrail() {
+    const axis = localStorage.getItem('quatplotTrailAxis');
+    const seconds = localStorage.getItem('quatplotTrailSeconds');
+    if (axis) document.getElementById('trailAxis').value = axis;
+    if (seconds) document.getElementById('trailSeconds').value = seconds;
+    setTrailOptions();
+    document.getElementById('trailButton').textContent = 'Trail: ' + (trailShown ? 'On' : 'Off');
+    document.getElementById('trailOptions').classList.toggle('show', trailShown);
+    if (!trailShown) {
+        clearTrails();
+    }
+}
+
+// setTrailOptions takes the traced axis and the length of the trails from
+// their menus, starting the trails over when the axis changes
+function setTrailOptions() {
+    const axis = document.getElementById('trailAxis').value;
+    const seconds = document.getElementById('trailSeconds').value;
+    localStorage.setItem('quatplotTrailAxis', axis);
+    localStorage.setItem('quatplotTrailSeconds', seconds);
+    trailSeconds = Math.min(Number(seconds) || 10, trailMaxSeconds);
+    const v = { x: [1, 0, 0], y: [0, 1, 0], z: [0, 0, 1] }[axis] || [1, 0, 0];
+    if (!trailAxis.equals(new THREE.Vector3(v[0], v[1], v[2]))) {
+        trailAxis.set(v[0], v[1], v[2]);
+        clearTrails();
+    }
+}
+
+function clearTrails() {
+    for (const id in trails) {
+        scene.remove(trails[id].group);
+        trails[id].line.geometry.dispose();
+    }
+    trails = {};
+}
+
+// makeTrail returns the sphere, line and head of the trail of a device
+function makeTrail(id) {
+    const group = new THREE.Group();
+    group.add(new THREE.Mesh(new THREE.SphereGeometry(trailRadius, 24, 16),
+        new THREE.MeshBasicMaterial({ color: 0xffffff, wireframe: true, transparent: true, opacity: 0.08 })));
+    const points = Math.ceil(trailMaxSeconds * 1000 / trailInterval) + 2;
+    const geometry = new THREE.BufferGeometry();
+    geometry.setAttribute('position', new THREE.BufferAttribute(new Float32Array(points * 3), 3));
+    geometry.setAttribute('color', new THREE.BufferAttribute(new Float32Array(points * 3), 3));
+    geometry.setDrawRange(0, 0);
+    const line = new THREE.Line(geometry, new THREE.LineBasicMaterial({ vertexColors: true }));
+    line.frustumCulled = false;
+    group.add(line);
+    const head = new THREE.Mesh(new THREE.SphereGeometry(0.06, 8, 8), new THREE.MeshBasicMaterial());
+    group.add(head);
+    scene.add(group);
+    return { group: group, line: line, head: head, times: [], points: [] };
+}
+
+// updateTrails adds the current direction of the traced axis of each
+// device to its trail, forgets the points older than the trail's length
+// and fades the rest into the background with their age, in the colour
+// of the device's stream
+function updateTrails() {
+    if (!trailShown) return;
+    const now = performance.now();
+    const tagged = Object.keys(devices);
+    const ids = tagged.length ? tagged : [''];
+    for (const id in trails) {
+        if (!ids.includes(id)) {
+            scene.remove(trails[id].group);
+            trails[id].line.geometry.dispose();
+            delete trails[id];
+        }
+    }
+    const background = scene.background;
+    const span = trailSeconds * 1000;
+    ids.forEach(id => {
+        const model = id ? devices[id].model : mesh;
+        if (!model) return;
+        const t = trails[id] || (trails[id] = makeTrail(id));
+        const stream = streams[id];
+        const trailColor = new THREE.Color(stream && stream.color ? stream.color : '#ffca28');
+        t.head.material.color.copy(trailColor);
+        t.group.position.copy(model.position);
+        t.group.quaternion.copy(manualRotation);
+
+        const quat = id ? devices[id].quat : currentQuat;
+        const point = trailAxis.clone().applyQuaternion(quat).multiplyScalar(trailRadius);
+        t.head.position.copy(point);
+        if (!t.times.length || now - t.times[t.times.length - 1] >= trailInterval) {
+            t.times.push(now);
+            t.points.push(point);
+        }
+        let old = 0;
+        while (old < t.times.length && now - t.times[old] > span) old++;
+        if (old) {
+            t.times.splice(0, old);
+            t.points.splice(0, old);
+        }
+
+        const positions = t.line.geometry.attributes.position;
+        const colors = t.line.geometry.attributes.color;
+        const color = new THREE.Color();
+        t.points.forEach((p, n) => {
+            positions.setXYZ(n, p.x, p.y, p.z);
+            color.copy(background).lerp(trailColor, 1 - (now - t.times[n]) / span);
+            colors.setXYZ(n, color.r, color.g, color.b);
+        });
+        // Up to the head between the points kept
+        const n = t.points.length;
+        positions.setXYZ(n, point.x, point.y, point.z);
+        colors.setXYZ(n, trailColor.r, trailColor.g, trailColor.b);
+        positions.needsUpdate = true;
+        colors.needsUpdate = true;
+        t.line.geometry.setDrawRange(0, n + 1);
+    });
+}
+
+function createDefaultCube() {
+    const geometry = new THREE.BoxGeometry(2, 2, 2);
+    const material = new THREE.MeshPhongMaterial({ 
+        color: 0x00ff00,
+        flatShading: true
+    });
+    mesh = new THREE.Mesh(geometry, material);
+    
+    // Add edges for better visibility
+    const edges = new THREE.EdgesGeometry(geometry);
+    const line = new THREE.LineSegments(edges, new THREE.LineBasicMaterial({ color: 0x000000 }));
+    mesh.add(line);
+    
+    scene.add(mesh);
+    defaultPosition.copy(mesh.position);
+    modelLoaded = false;
+    placeDevices();
+    updateModelInfo('Default cube');
+    
+    // Point camera at the model
+    camera.lookAt(mesh.position);
+}
+
+function onWindowResize() {
+    const container = document.getElementById('renderer');
+    camera.aspect = container.clientWidth / container.clientHeight;
+    camera.updateProjectionMatrix();
+    renderer.setSize(container.clientWidth, container.clientHeight);
+}
+
+function onMouseWheel(event) {
+    event.preventDefault();
+    
+    // Zoom speed (percentage change per scroll)
+    const zoomSpeed = 0.05;
+    
+    // Determine zoom direction
+    const delta = event.deltaY > 0 ? 1 : -1;
+    
+    // Update zoom factor (smaller = closer, larger = farther)
+    zoomFactor *= (1 + delta * zoomSpeed);
+    
+    // Clamp zoom factor (0.1 to 10x)
+    zoomFactor = Math.max(0.1, Math.min(zoomFactor, 10));
+    
+    // Apply zoom to camera position
+    camera.position.z = baseCameraDistance * zoomFactor;
+    
+    console.log('Zoom:', (1/zoomFactor).toFixed(2) + 'x', 'Camera pos:', 
+                camera.position.x.toFixed(2), camera.position.y.toFixed(2), camera.position.z.toFixed(2));
+    
+    // Update zoom display
+    updateZoomInfo();
+}
+
+function updateZoomInfo() {
+    const zoomEl = document.getElementById('zoomInfo');
+    zoomEl.textContent = 'Zoom: ' + (1 / zoomFactor).toFixed(2) + 'x';
+}
+
+function onMouseDown(event) {
+    isMouseDown = true;
+    previousMousePosition = {
+        x: event.clientX,
+        y: event.clientY
+    };
+}
+
+function onMouseMove(event) {
+    if (!isMouseDown) return;
+    
+    const deltaMove = {
+        x: event.clientX - previousMousePosition.x,
+        y: event.clientY - previousMousePosition.y
+    };
+    
+    // Check if Shift key is held - pan camera instead of rotate
+    if (event.shiftKey) {
+        // Pan camera (move left/right/up/down)
+        const panSpeed = 0.01;
+        camera.position.x -= deltaMove.x * panSpeed;
+        camera.position.y += deltaMove.y * panSpeed;
+    } else {
+        // Rotate object
+        // Create rotation quaternions for X and Y axis rotations
+        const deltaRotationQuaternion = new THREE.Quaternion()
+            .setFromEuler(new THREE.Euler(
+                deltaMove.y * rotationSpeed,
+                deltaMove.x * rotationSpeed,
+                0,
+                'XYZ'
+            ));
+        
+        // Apply the delta rotation to the manual rotation
+        manualRotation.multiplyQuaternions(deltaRotationQuaternion, manualRotation);
+        manualRotation.normalize();
+    }
+    
+    previousMousePosition = {
+        x: event.clientX,
+        y: event.clientY
+    };
+}
+
+function onMouseUp() {
+    isMouseDown = false;
+}
+
+function onKeyDown(event) {
+    if (event.key === 'Shift') {
+        const container = document.getElementById('renderer');
+        if (!isMouseDown) {
+            container.style.cursor = 'move';
+        }
+    }
+}
+
+function onKeyUp(event) {
+    if (event.key === 'Shift') {
+        const container = document.getElementById('renderer');
+        if (!isMouseDown) {
+            container.style.cursor = 'grab';
+        }
+    }
+}
+
+function animate() {
+    requestAnimationFrame(animate);
+    
+    if (mesh) {
+        // Apply combined rotation: manual rotation * sensor quaternion
+        const combinedQuat = new THREE.Quaternion();
+        combinedQuat.multiplyQuaternions(manualRotation, currentQuat);
+        mesh.quaternion.copy(combinedQuat);
+    }
+    for (const id in devices) {
+        if (devices[id].model) {
+            devices[id].model.quaternion.multiplyQuaternions(manualRotation, devices[id].quat);
+        }
+    }
+    
+    updateOverlay();
+    updateTrails();
+    sendView();
+    if (!chartPaused) {
+        drawChart();
+    }
+    renderer.render(scene, camera);
+}
+
+function togglePresenting() {
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({ type: 'present', data: { active: !presenting } }));
+    }
+}
+
+function toggleFollowing() {
+    following = !following;
+    localStorage.setItem('quatplotFollow', following ? '1' : '0');
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({ type: 'follow', data: { active: following } }));
+    }
+    document.getElementById('followButton').textContent = 'Follow Presenter: ' + (following ? 'On' : 'Off');
+}
+
+// tare asks the server to zero the orientation of every device, or
+// to stop doing so, for every viewer and the recording alike
+function tare(clear) {
+    fetch(clear ? 'api/tare/clear' : 'api/tare', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: '{}'
+    }).then(r => {
+        if (!r.ok) {
+            return r.text().then(text => window.alert(text.trim()));
+        }
+    }).catch(err => console.error('Error taring:', err));
+}
+
+// showTare lists the tared devices, as told by the server
+function showTare(info) {
+    const el = document.getElementById('tareInfo');
+    if (info.devices.length === 0) {
+        el.textContent = 'Not tared';
+        return;
+    }
+    el.textContent = info.devices.map(d => (d.device || 'sensor') + ' since ' + new Date(d.time).toLocaleTimeString()).join(', ');
+}
+
+// showServer shows the version and input of the server from its session
+// message, with its welcome when that is text
+function showServer(session) {
+    const settings = session.settings || {};
+    let text = (session.server || 'quatplot') + ' ' + (session.version || '') +
+        ', protocol ' + session.protocol + ', ' + settings.source + ' ' + settings.input;
+    if (typeof session.welcome === 'string') {
+        text = session.welcome + ' (' + text + ')';
+    }
+    document.getElementById('serverInfo').textContent = text;
+}
+
+// showPresenter shows who presents, as told by the server
+function showPresenter(info) {
+    if (info.error) {
+        window.alert(info.error);
+        return;
+    }
+    presenting = !!info.presenting;
+    lastSentView = null;
+    document.getElementById('presentButton').textContent = presenting ? 'Stop Presenting' : 'Present';
+    const el = document.getElementById('presenterInfo');
+    if (presenting) {
+        el.textContent = 'You are presenting';
+    } else if (info.active) {
+        el.textContent = (info.user || 'Client ' + info.client) + (following ? ' is presenting, following' : ' is presenting');
+    } else {
+        el.textContent = 'Nobody is presenting';
+    }
+}
+
+// sendView sends our view to the server while presenting, when it
+// changed, at most 30 times a second
+function sendView() {
+    if (!presenting || !ws || ws.readyState !== WebSocket.OPEN) return;
+    const now = performance.now();
+    if (now - lastViewSentAt < 33) return;
+    const view = JSON.stringify({
+        type: 'view',
+        data: {
+            zoom: zoomFactor,
+            rotation: { i: manualRotation.x, j: manualRotation.y, k: manualRotation.z, real: manualRotation.w },
+            pan: [camera.position.x, camera.position.y]
+        }
+    });
+    if (view === lastSentView) return;
+    ws.send(view);
+    lastSentView = view;
+    lastViewSentAt = now;
+}
+
+// applyView shows the presenter's view
+function applyView(view) {
+    zoomFactor = view.zoom;
+    manualRotation.set(view.rotation.i, view.rotation.j, view.rotation.k, view.rotation.real);
+    camera.position.set(view.pan[0], view.pan[1], baseCameraDistance * zoomFactor);
+    updateZoomInfo();
+}
+
+// ensureLoggedIn asks for the password when the server requires one
+// and the login cookie is missing or has expired
+function ensureLoggedIn() {
+    return fetch('api/status').then(r => {
+        if (r.status !== 401) {
+            return;
+        }
+        const password = window.prompt('Password');
+        if (password === null) {
+            throw new Error('login cancelled');
+        }
+        return fetch('api/login', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ password: password })
+        }).then(r => {
+            if (!r.ok) {
+                throw new Error('login failed');
+            }
+        });
+    });
+}
+
+function connectWebSocket() {
+    ensureLoggedIn()
+        .then(openWebSocket)
+        .catch(e => {
+            console.error('Error logging in:', e);
+            updateStatus(false);
+            scheduleReconnect();
+        });
+}
+
+function openWebSocket() {
+    // The viewer reads i, j, k and real whatever -quat-keys says
+    const params = new URLSearchParams({keys: 'ijk'});
+    if (resumeToken) {
+        params.set('token', resumeToken);
+    }
+    if (following) {
+        params.set('follow', '1');
+    }
+    if (sessionEpoch !== null && lastSeq !== null) {
+        // Let the server tell us how many samples we missed while away
+        params.set('epoch', sessionEpoch);
+        params.set('last_seq', lastSeq);
+    }
+    // Relative to the page, so that tenants under /t/{name}/ get their own stream
+    const url = new URL('ws', window.location.href);
+    url.protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+    url.search = params;
+    ws = new WebSocket(url);
+    
+    ws.onopen = function() {
+        console.log('WebSocket connected');
+        updateStatus(true);
+        reconnectDelay = clientSettings.reconnect_ms;
+        disconnectedSince = null;
+        // Servers started with -client-protocol strict wait for both
+        // before sending samples
+        ws.send(JSON.stringify({ type: 'hello', data: { protocol: protocolVersion, client: 'quatplot-web' } }));
+        ws.send(JSON.stringify({ type: 'subscribe', data: {} }));
+    };
+    
+    ws.onmessage = function(event) {
+        try {
+            const data = JSON.parse(event.data);
+            if (data.type) {
+                // Typed messages are events, samples have no type
+                handleEvent(data);
+                return;
+            }
+            lastSeq = data.seq;
+            lastSampleAt = Date.now();
+            if (sensorSilent) {
+                updateStatus(true);
+            }
+            // Samples of several sensors are tagged with the device ID
+            const quat = data.id ? deviceModel(data.id).quat : currentQuat;
+            // Three.js quaternion format: (x, y, z, w) = (i, j, k, real)
+            quat.set(data.i, data.j, data.k, data.real);
+            quat.normalize();
+            lastSamples[data.id || ''] = data;
+            updateQuatInfo();
+            recordChartSample(data);
+        } catch (e) {
+            console.error('Error parsing quaternion data:', e);
+        }
+    };
+    
+    ws.onerror = function(error) {
+        console.error('WebSocket error:', error);
+        updateStatus(false);
+    };
+    
+    ws.onclose = function(event) {
+        if (event.reason) {
+            console.log('WebSocket closed by the server: ' + event.reason);
+        }
+        console.log('WebSocket closed. Reconnecting...');
+        // The server forgets the presenter with the connection
+        showPresenter({ active: false });
+        updateStatus(false);
+        scheduleReconnect();
+    };
+}
+
+// scheduleReconnect tries to connect again, backing off up to the
+// longest delay. When the connection has been down for too long but
+// the server answers, the page is reloaded in case it got stuck.
+function scheduleReconnect() {
+    if (disconnectedSince === null) {
+        disconnectedSince = Date.now();
+    }
+    const reload = clientSettings.reload_after_ms;
+    if (reload > 0 && Date.now() - disconnectedSince > reload) {
+        fetch('api/status').then(() => {
+            console.log('Disconnected for too long, reloading');
+            window.location.reload();
+        }).catch(() => {});
+    }
+    setTimeout(connectWebSocket, reconnectDelay);
+    reconnectDelay = Math.min(reconnectDelay * 2, clientSettings.max_reconnect_ms);
+}
+
+// pollKioskStatus shows the server's uptime and the state of the
+// stream in the kiosk overlay
+function pollKioskStatus() {
+    const el = document.getElementById('kioskStatus');
+    fetch('api/stats').then(r => r.json()).then(stats => {
+        let text = 'Up ' + stats.uptime;
+        if (!ws || ws.readyState !== WebSocket.OPEN) {
+            text += ' · reconnecting';
+        } else if (lastSampleAt === null || Date.now() - lastSampleAt > 5000) {
+            text += ' · waiting for data';
+        } else {
+            text += ' · ' + stats.input_rate_hz.toFixed(0) + ' Hz';
+        }
+        el.textContent = text;
+    }).catch(() => {
+        el.textContent = 'Server unreachable';
+    });
+}
+
+function handleEvent(msg) {
+    switch (msg.type) {
+        case 'session':
+            sessionEpoch = msg.data.epoch;
+            resumeToken = msg.data.token;
+            sessionStorage.setItem('quatplotResumeToken', resumeToken);
+            if (msg.data.units.angle !== angleUnits) {
+                // The chart can't mix samples in different units
+                chartHistory = {};
+            }
+            angleUnits = msg.data.units.angle;
+            clockOffset = Date.now() - Date.parse(msg.time);
+            if (msg.data.convention.frame !== referenceFrame) {
+                referenceFrame = msg.data.convention.frame;
+                buildOverlay();
+            }
+            streams = {};
+            msg.data.streams.forEach(s => streams[s.id] = s);
+            showLibraryModel(msg.data.model || null);
+            updateQuatInfo();
+            inputStates = {};
+            setInputStatus(msg.data.status);
+            showServer(msg.data);
+            updateStatus(true);
+            fetch('api/tare').then(r => r.json()).then(showTare).catch(() => {});
+            break;
+        case 'model':
+            showLibraryModel(msg.data.model);
+            break;
+        case 'presenter':
+            showPresenter(msg.data);
+            break;
+        case 'tare':
+            showTare(msg.data);
+            break;
+        case 'view':
+            if (following && !presenting) {
+                applyView(msg.data);
+            }
+            break;
+        case 'stream':
+            // A device that appeared after connecting
+            streams[msg.data.id] = msg.data;
+            updateQuatInfo();
+            break;
+        case 'resume':
+            if (msg.data.epoch_changed) {
+                console.log('Server restarted while disconnected, sequence numbers were reset');
+            } else if (msg.data.missed > 0) {
+                console.log('Missed ' + msg.data.missed + ' samples while disconnected');
+            }
+            break;
+        case 'heartbeat':
+            // Sent while the sensor is silent, the connection is fine
+            setInputStatus(msg.data.status);
+            updateStatus(true, describeSilence(msg.data));
+            break;
+        case 'status':
+            // The server's link to the sensor changed state
+            setInputStatus(msg.data);
+            updateStatus(true);
+            break;
+        case 'history':
+            // Sent with -backfill-on-connect, the viewer only shows
+            // the current orientation
+            break;
+        case 'restarting':
+            // Wait out the announced downtime instead of hammering the server
+            console.log('Server restarting (' + msg.data.reason + '), expected downtime ' + msg.data.expected_downtime_ms + ' ms');
+            reconnectDelay = Math.max(1000, msg.data.expected_downtime_ms);
+            break;
+        default:
+            console.log('Server event:', msg.type, msg.data);
+    }
+}
+
+// describeSilence explains a heartbeat, e.g. "no data for 12 s"
+function describeSilence(hb) {
+    let text = hb.last_sample_age_ms === undefined ? 'no data yet' :
+        'no data for ' + Math.round(hb.last_sample_age_ms / 1000) + ' s';
+    if (hb.status.state !== 'connected') {
+        text += ' (' + hb.status.state.replace('_', ' ') + ')';
+    }
+    return text;
+}
+
+// setInputStatus records the state of the server's input, of each
+// device when several sensors are read
+function setInputStatus(st) {
+    (st.devices || [st]).forEach(d => inputStates[d.id || ''] = d);
+}
+
+// inputProblem returns the state of the first device the server
+// isn't connected to, null when all are
+function inputProblem() {
+    return Object.values(inputStates).find(st => st.state !== 'connected') || null;
+}
+
+// updateStatus shows the state of the connection and of the server's
+// link to the sensor, and why no samples arrive when the server says
+// the sensor is silent
+function updateStatus(connected, silence) {
+    const statusEl = document.getElementById('status');
+    const problem = connected ? inputProblem() : null;
+    sensorSilent = Boolean(connected && silence);
+    statusEl.title = '';
+    if (problem) {
+        statusEl.textContent = 'Server connected · sensor ' + problem.state.replace('_', ' ');
+        statusEl.title = [problem.message, problem.hint].filter(Boolean).join('. ');
+        statusEl.className = problem.state === 'connecting' ? 'status idle' : 'status disconnected';
+    } else if (sensorSilent) {
+        statusEl.textContent = 'Connected · ' + silence;
+        statusEl.className = 'status idle';
+    } else if (connected) {
+        statusEl.textContent = 'Connected';
+        statusEl.className = 'status connected';
+    } else {
+        statusEl.textContent = 'Disconnected';
+        statusEl.className = 'status disconnected';
+    }
+}
+
+// deviceModel returns a tagged device, adding a copy of the model for
+// devices seen for the first time
+function deviceModel(id) {
+    if (!devices[id]) {
+        devices[id] = { quat: new THREE.Quaternion(0, 0, 0, 1), model: null };
+        placeDevices();
+    }
+    return devices[id];
+}
+
+// placeDevices shows a copy of the current model for each tagged
+// device, side by side in order of ID, in place of the single model
+function placeDevices() {
+    const ids = Object.keys(devices).sort();
+    if (!mesh || ids.length === 0) return;
+    const spacing = 5; // Models are scaled to at most 4 units
+    ids.forEach((id, n) => {
+        const device = devices[id];
+        if (device.model) {
+            scene.remove(device.model);
+        }
+        device.model = mesh.clone();
+        device.model.visible = true;
+        device.model.position.copy(defaultPosition);
+        device.model.position.x += (n - (ids.length - 1) / 2) * spacing;
+        scene.add(device.model);
+    });
+    mesh.visible = false;
+}
+
+function updateQuatInfo() {
+    const info = document.getElementById('quatInfo');
+    info.innerHTML = '';
+    Object.keys(lastSamples).sort().forEach(id => appendQuatInfo(info, id, lastSamples[id]));
+}
+
+function appendQuatInfo(info, id, quat) {
+    const stream = streams[id];
+    if (id || (stream && stream.name !== 'Sensor')) {
+        const name = stream ? stream.name : id;
+        const color = stream ? stream.color : '#ffffff';
+        info.innerHTML += '<div style="margin-top: 5px;"><span style="color: ' + color + ';">&#9632;</span> <strong>' + name.replace(/[<>&"]/g, '') + '</strong></div>';
+    }
+    info.innerHTML += 
+        '<div>i: ' + quat.i.toFixed(4) + '</div>' +
+        '<div>j: ' + quat.j.toFixed(4) + '</div>' +
+        '<div>k: ' + quat.k.toFixed(4) + '</div>' +
+        '<div>real: ' + quat.real.toFixed(4) + '</div>';
+    if (quat.euler) {
+        // Euler angles are computed by the server in the client's
+        // units, and shown in the stream's when it has its own
+        const units = stream && stream.units ? stream.units : angleUnits;
+        let scale = 1;
+        if (units !== angleUnits) {
+            scale = units === 'deg' ? 180 / Math.PI : Math.PI / 180;
+        }
+        const unit = units === 'deg' ? '°' : ' rad';
+        const digits = units === 'deg' ? 1 : 3;
+        info.innerHTML +=
+            '<div style="margin-top: 5px;">roll: ' + (quat.euler.roll * scale).toFixed(digits) + unit + '</div>' +
+            '<div>pitch: ' + (quat.euler.pitch * scale).toFixed(digits) + unit + '</div>' +
+            '<div>yaw: ' + (quat.euler.yaw * scale).toFixed(digits) + unit + '</div>';
+    }
+}
+
+// showLibraryModel loads the model the server asks every viewer to
+// show from its library, or goes back to the viewer's own when null
+function showLibraryModel(model) {
+    if (!model) {
+        if (libraryModel === null) return;
+        libraryModel = null;
+        if (ownModelFiles) {
+            loadModelFiles({ target: { files: ownModelFiles } }, true);
+        } else {
+            if (mesh) scene.remove(mesh);
+            createDefaultCube();
+        }
+        return;
+    }
+    if (model.name === libraryModel) return;
+    libraryModel = model.name;
+    const names = [model.name].concat(model.mtl ? [model.mtl] : [], model.textures || [], model.resources || []);
+    updateModelInfo('Downloading ' + model.name + '...');
+    Promise.all(names.map(name => fetch('models/' + encodeURIComponent(name)).then(r => {
+        if (!r.ok) throw new Error(name + ': ' + r.status);
+        return r.blob();
+    }).then(blob => new File([blob], name)))).then(files => {
+        // A newer choice may have arrived while downloading
+        if (libraryModel === model.name) {
+            loadModelFiles({ target: { files: files } }, true);
+        }
+    }).catch(e => {
+        console.error('Error downloading model:', e);
+        updateModelInfo('Download failed');
+    });
+}
+
+function updateModelInfo(text) {
+    document.getElementById('modelInfo').textContent = text;
+}
+
+function loadModelFiles(event, fromLibrary) {
+    const files = Array.from(event.target.files);
+    if (files.length === 0) return;
+    if (!fromLibrary) {
+        ownModelFiles = files;
+        libraryModel = null;
+    }
+    
+    // STL, PLY and glTF models load on their own, with a glTF's buffers and images
+    const modelFile = files.find(f => /\.(stl|ply|glb|gltf)$/i.test(f.name));
+    if (modelFile && !files.some(f => f.name.toLowerCase().endsWith('.obj'))) {
+        loadOtherModel(modelFile, files);
+        return;
+    }
+    
+    // Separate OBJ, MTL, and texture files
+    const objFile = files.find(f => f.name.toLowerCase().endsWith('.obj'));
+    const mtlFile = files.find(f => f.name.toLowerCase().endsWith('.mtl'));
+    const textureFiles = files.filter(f => {
+        const lower = f.name.toLowerCase();
+        return lower.endsWith('.jpg') || lower.endsWith('.jpeg') || 
+               lower.endsWith('.png') || lower.endsWith('.bmp') || lower.endsWith('.gif');
+    });
+    
+    if (!objFile) {
+        alert('Please select at least one .obj, .stl, .ply, .glb or .gltf file');
+        return;
+    }
+    
+    console.log('Loading files:', objFile.name, mtlFile ? mtlFile.name : '(no MTL)', 
+                textureFiles.length + ' textures');
+    
+    // Check file size (warn if > 50MB)
+    const maxSize = 50 * 1024 * 1024; // 50MB
+    if (objFile.size > maxSize) {
+        const sizeMB = (objFile.size / (1024 * 1024)).toFixed(2);
+        if (!confirm('This file is quite large (' + sizeMB + ' MB). Loading may take a while and could freeze the browser. Continue?')) {
+            return;
+        }
+    }
+    
+    loadedObjFile = objFile;
+    loadedMtlFile = mtlFile;
+    loadedTextureFiles = textureFiles;
+    
+    // Show loading message
+    updateModelInfo('Loading ' + objFile.name + '...');
+    console.log('Loading file: ' + objFile.name + ' (' + (objFile.size / 1024).toFixed(2) + ' KB)');
+    
+    // If we have an MTL file, load it first, then load the OBJ
+    if (mtlFile) {
+        loadWithMaterial(objFile, mtlFile);
+    } else {
+        loadOBJOnly(objFile);
+    }
+}
+
+function loadOtherModel(modelFile, files) {
+    const ext = modelFile.name.toLowerCase().split('.').pop();
+    const maxSize = 50 * 1024 * 1024; // 50MB
+    if (modelFile.size > maxSize) {
+        const sizeMB = (modelFile.size / (1024 * 1024)).toFixed(2);
+        if (!confirm('This file is quite large (' + sizeMB + ' MB). Loading may take a while and could freeze the browser. Continue?')) {
+            return;
+        }
+    }
+    loadedObjFile = modelFile;
+    loadedMtlFile = null;
+    loadedTextureFiles = [];
+    updateModelInfo('Loading ' + modelFile.name + '...');
+    console.log('Loading file: ' + modelFile.name + ' (' + (modelFile.size / 1024).toFixed(2) + ' KB)');
+    
+    // A .gltf finds its buffers and images among the other files chosen
+    const blobURLs = {};
+    files.forEach(f => {
+        if (f !== modelFile) blobURLs[f.name] = URL.createObjectURL(f);
+    });
+    const releaseURLs = () => Object.values(blobURLs).forEach(url => URL.revokeObjectURL(url));
+    
+    const failed = function(error) {
+        console.error('Error loading ' + ext.toUpperCase() + ' file:', error);
+        alert('Error loading ' + ext.toUpperCase() + ' file: ' + (error.message || error) + '\n\nCheck console for details.');
+        updateModelInfo('Load failed');
+        releaseURLs();
+        createDefaultCube();
+    };
+    
+    const reader = new FileReader();
+    reader.onerror = function() {
+        console.error('Error reading file:', reader.error);
+        alert('Error reading file: ' + reader.error.message);
+        updateModelInfo('Load failed');
+        releaseURLs();
+    };
+    reader.onload = function(e) {
+        const contents = e.target.result;
+        updateModelInfo('Parsing ' + modelFile.name + '...');
+        try {
+            if (ext === 'stl') {
+                const geometry = new THREE.STLLoader().parse(contents);
+                showOtherModel(modelFile, meshFromGeometry(geometry, true));
+                releaseURLs();
+            } else if (ext === 'ply') {
+                const geometry = new THREE.PLYLoader().parse(contents);
+                showOtherModel(modelFile, meshFromGeometry(geometry, false));
+                releaseURLs();
+            } else {
+                const manager = new THREE.LoadingManager();
+                manager.setURLModifier(url => {
+                    const name = decodeURIComponent(url.split(/[\\/]/).pop());
+                    return blobURLs[name] || url;
+                });
+                new THREE.GLTFLoader(manager).parse(contents, '', function(gltf) {
+                    showOtherModel(modelFile, gltf.scene);
+                    releaseURLs();
+                }, failed);
+            }
+        } catch (error) {
+            failed(error);
+        }
+    };
+    reader.readAsArrayBuffer(modelFile);
+}
+
+// meshFromGeometry returns the mesh of an STL or PLY geometry, or the points
+// of a PLY point cloud, coloured by its vertices if it has colours
+function meshFromGeometry(geometry, stl) {
+    const colored = stl ? geometry.hasColors : geometry.hasAttribute('color');
+    if (!stl && !geometry.index && !geometry.hasAttribute('normal')) {
+        // A PLY without faces is a point cloud
+        geometry.computeBoundingSphere();
+        const pointSize = geometry.boundingSphere.radius / 200;
+        return new THREE.Points(geometry, new THREE.PointsMaterial({
+            size: pointSize,
+            vertexColors: colored,
+            color: colored ? 0xffffff : 0x049ef4
+        }));
+    }
+    if (!geometry.hasAttribute('normal')) {
+        geometry.computeVertexNormals();
+    }
+    return new THREE.Mesh(geometry, new THREE.MeshPhongMaterial({
+        color: colored ? 0xffffff : 0x049ef4,
+        vertexColors: colored,
+        flatShading: false
+    }));
+}
+
+// showOtherModel centers, scales and shows a model loaded by loadOtherModel
+function showOtherModel(modelFile, model) {
+    if (mesh) {
+        scene.remove(mesh);
+    }
+    const object = new THREE.Group();
+    object.add(model);
+    
+    const size = new THREE.Box3().setFromObject(object).getSize(new THREE.Vector3());
+    const maxDim = Math.max(size.x, size.y, size.z);
+    if (maxDim < 0.0001) {
+        console.error('Model has invalid dimensions');
+        alert('Error: Model has invalid dimensions (too small or zero size)');
+        createDefaultCube();
+        return;
+    }
+    
+    // Scale the largest dimension to 4, then center at the origin
+    const scale = 4 / maxDim;
+    object.scale.set(scale, scale, scale);
+    const scaledCenter = new THREE.Box3().setFromObject(object).getCenter(new THREE.Vector3());
+    object.position.set(-scaledCenter.x, -scaledCenter.y, -scaledCenter.z);
+    
+    let meshCount = 0;
+    object.traverse(function(child) {
+        if (child.isMesh || child.isPoints) meshCount++;
+    });
+    
+    mesh = object;
+    scene.add(mesh);
+    defaultPosition.copy(mesh.position);
+    modelLoaded = true;
+    placeDevices();
+    
+    baseCameraDistance = 4 * 1.3;
+    zoomFactor = 1.0;
+    camera.position.set(0, 0, baseCameraDistance);
+    camera.rotation.set(0, 0, 0);
+    camera.lookAt(0, 0, 0);
+    updateZoomInfo();
+    
+    updateModelInfo(modelFile.name + ' (' + meshCount + ' meshes)');
+    console.log(modelFile.name + ' loaded successfully - Meshes: ' + meshCount);
+}
+
+function loadOBJOnly(objFile) {
+    const reader = new FileReader();
+    
+    reader.onerror = function() {
+        console.error('Error reading file:', reader.error);
+        alert('Error reading file: ' + reader.error.message);
+        updateModelInfo('Load failed');
+    };
+    
+    reader.onload = function(e) {
+        const contents = e.target.result;
+        
+        console.log('File read successfully, parsing OBJ...');
+        console.log('Content length: ' + contents.length + ' characters');
+        
+        // Remove existing mesh
+        if (mesh) {
+            scene.remove(mesh);
+        }
+        
+        // Load OBJ
+        const loader = new THREE.OBJLoader();
+        try {
+            updateModelInfo('Parsing ' + objFile.name + '...');
+            const object = loader.parse(contents);
+            
+            console.log('OBJ parsed successfully, processing geometry...');
+            
+            // Center and scale the object
+            const box = new THREE.Box3().setFromObject(object);
+            const center = box.getCenter(new THREE.Vector3());
+            const size = box.getSize(new THREE.Vector3());
+            
+            console.log('Original model size:', size.x.toFixed(3), size.y.toFixed(3), size.z.toFixed(3));
+            
+            const maxDim = Math.max(size.x, size.y, size.z);
+            
+            // Ensure maxDim is not zero or too small
+            if (maxDim < 0.0001) {
+                console.error('Model has invalid dimensions');
+                alert('Error: Model has invalid dimensions (too small or zero size)');
+                createDefaultCube();
+                return;
+            }
+            
+            const targetSize = 4; // Target size for largest dimension
+            const scale = targetSize / maxDim;
+            
+            console.log('Scaling factor:', scale.toFixed(3));
+            console.log('Bounding box center:', center.x.toFixed(3), center.y.toFixed(3), center.z.toFixed(3));
+            
+            // First scale, then center at origin
+            object.scale.set(scale, scale, scale);
+            
+            // Recalculate bounding box after scaling
+            const scaledBox = new THREE.Box3().setFromObject(object);
+            const scaledCenter = scaledBox.getCenter(new THREE.Vector3());
+            
+            // Move object so its center is at the origin
+            object.position.set(-scaledCenter.x, -scaledCenter.y, -scaledCenter.z);
+            
+            // Apply default material if no MTL
+            let meshCount = 0;
+            object.traverse(function(child) {
+                if (child instanceof THREE.Mesh) {
+                    meshCount++;
+                    if (!child.material || child.material.name === '') {
+                        child.material = new THREE.MeshPhongMaterial({ 
+                            color: 0x049ef4,
+                            flatShading: false
+                        });
+                    }
+                }
+            });
+            
+            mesh = object;
+            scene.add(mesh);
+            defaultPosition.copy(mesh.position);
+            modelLoaded = true;
+            placeDevices();
+            
+            // Adjust camera distance to fit the scaled object in viewport
+            // Closer camera for better view - 1.3x the target size
+            baseCameraDistance = 4 * 1.3; // targetSize = 4, so 4 * 1.3 = 5.2
+            zoomFactor = 1.0; // Reset zoom
+            console.log('Base camera distance set to:', baseCameraDistance);
+            camera.position.set(0, 0, baseCameraDistance);
+            
+            // Ensure camera is looking at origin (no rotation)
+            camera.rotation.set(0, 0, 0);
+            camera.lookAt(0, 0, 0);
+            
+            console.log('Mesh position:', mesh.position.x.toFixed(2), mesh.position.y.toFixed(2), mesh.position.z.toFixed(2));
+            updateZoomInfo();
+            
+            console.log('Camera positioned at distance:', camera.position.z.toFixed(2));
+            
+            updateModelInfo(objFile.name + ' (' + meshCount + ' meshes)');
+            console.log('OBJ file loaded successfully - Meshes: ' + meshCount + ', Camera distance: ' + baseCameraDistance.toFixed(2));
+        } catch (error) {
+            console.error('Error loading OBJ file:', error);
+            console.error('Error stack:', error.stack);
+            alert('Error loading OBJ file: ' + error.message + '\n\nCheck console for details.');
+            updateModelInfo('Load failed');
+            createDefaultCube();
+        }
+    };
+    
+    reader.readAsText(objFile);
+}
+
+function loadWithMaterial(objFile, mtlFile) {
+    // Load MTL file first
+    const mtlReader = new FileReader();
+    
+    mtlReader.onerror = function() {
+        console.error('Error reading MTL file:', mtlReader.error);
+        alert('Error reading MTL file: ' + mtlReader.error.message);
+        updateModelInfo('Load failed');
+    };
+    
+    mtlReader.onload = function(e) {
+        const mtlContents = e.target.result;
+        
+        console.log('MTL file read successfully, reading OBJ...');
+        
+        // Load OBJ file
+        const objReader = new FileReader();
+        
+        objReader.onerror = function() {
+            console.error('Error reading OBJ file:', objReader.error);
+            alert('Error reading OBJ file: ' + objReader.error.message);
+            updateModelInfo('Load failed');
+        };
+        
+        objReader.onload = function(e) {
+            const objContents = e.target.result;
+            
+            console.log('OBJ file read successfully, parsing with materials...');
+            console.log('OBJ content length: ' + objContents.length + ' characters');
+            
+            // Create blob URLs for texture files
+            const textureMap = {};
+            loadedTextureFiles.forEach(file => {
+                const url = URL.createObjectURL(file);
+                textureMap[file.name] = url;
+                console.log('Created blob URL for texture:', file.name);
+            });
+            
+            // Remove existing mesh
+            if (mesh) {
+                scene.remove(mesh);
+            }
+            
+            try {
+                updateModelInfo('Parsing materials...');
+                
+                // Create custom loading manager to handle texture files
+                const manager = new THREE.LoadingManager();
+                
+                // Track when all textures are loaded
+                manager.onLoad = function() {
+                    console.log('All textures loaded successfully');
+                    // Clean up blob URLs after all textures are loaded
+                    setTimeout(() => {
+                        Object.values(textureMap).forEach(url => URL.revokeObjectURL(url));
+                        console.log('Blob URLs cleaned up');
+                    }, 100); // Small delay to ensure textures are in GPU memory
+                };
+                
+                manager.onError = function(url) {
+                    console.error('Error loading texture:', url);
+                };
+                
+                manager.setURLModifier((url) => {
+                    // Extract just the filename from the URL
+                    const filename = url.split('/').pop().split('\\').pop();
+                    
+                    // If we have a blob URL for this texture, use it
+                    if (textureMap[filename]) {
+                        console.log('Mapping texture:', filename, '-> blob URL');
+                        return textureMap[filename];
+                    }
+                    
+                    console.warn('Texture not found in loaded files:', filename);
+                    return url; // Fall back to original URL
+                });
+                
+                // Parse MTL with custom manager
+                const mtlLoader = new THREE.MTLLoader(manager);
+                const materials = mtlLoader.parse(mtlContents, '');
+                materials.preload();
+                
+                console.log('Materials parsed, parsing OBJ...');
+                updateModelInfo('Parsing geometry...');
+                
+                // Parse OBJ with materials
+                const objLoader = new THREE.OBJLoader();
+                objLoader.setMaterials(materials);
+                const object = objLoader.parse(objContents);
+                
+                console.log('OBJ parsed successfully, processing...');
+                
+                // Center and scale the object
+                const box = new THREE.Box3().setFromObject(object);
+                const center = box.getCenter(new THREE.Vector3());
+                const size = box.getSize(new THREE.Vector3());
+                
+                console.log('Original model size:', size.x.toFixed(3), size.y.toFixed(3), size.z.toFixed(3));
+                
+                const maxDim = Math.max(size.x, size.y, size.z);
+                
+                // Ensure maxDim is not zero or too small
+                if (maxDim < 0.0001) {
+                    console.error('Model has invalid dimensions');
+                    alert('Error: Model has invalid dimensions (too small or zero size)');
+                    createDefaultCube();
+                    return;
+                }
+                
+                const targetSize = 4; // Target size for largest dimension
+                const scale = targetSize / maxDim;
+                
+                console.log('Scaling factor:', scale.toFixed(3));
+                console.log('Bounding box center:', center.x.toFixed(3), center.y.toFixed(3), center.z.toFixed(3));
+                
+                // First scale, then center at origin
+                object.scale.set(scale, scale, scale);
+                
+                // Recalculate bounding box after scaling
+                const scaledBox = new THREE.Box3().setFromObject(object);
+                const scaledCenter = scaledBox.getCenter(new THREE.Vector3());
+                
+                // Move object so its center is at the origin
+                object.position.set(-scaledCenter.x, -scaledCenter.y, -scaledCenter.z);
+                
+                let meshCount = 0;
+                object.traverse(function(child) {
+                    if (child instanceof THREE.Mesh) {
+                        meshCount++;
+                    }
+                });
+                
+                mesh = object;
+                scene.add(mesh);
+                defaultPosition.copy(mesh.position);
+                modelLoaded = true;
+                placeDevices();
+                
+                // Adjust camera distance to fit the scaled object in viewport
+                // Closer camera for better view - 1.3x the target size
+                baseCameraDistance = 4 * 1.3; // targetSize = 4, so 4 * 1.3 = 5.2
+                zoomFactor = 1.0; // Reset zoom
+                console.log('Base camera distance set to:', baseCameraDistance);
+                camera.position.set(0, 0, baseCameraDistance);
+                
+                // Ensure camera is looking at origin (no rotation)
+                camera.rotation.set(0, 0, 0);
+                camera.lookAt(0, 0, 0);
+                
+                console.log('Mesh position:', mesh.position.x.toFixed(2), mesh.position.y.toFixed(2), mesh.position.z.toFixed(2));
+                updateZoomInfo();
+                
+                console.log('Camera positioned at distance:', camera.position.z.toFixed(2));
+                
+                console.log('Camera positioned at distance:', camera.position.z.toFixed(2));
+                
+                updateModelInfo(objFile.name + ' + ' + mtlFile.name + ' (' + meshCount + ' meshes)');
+                console.log('Model loaded successfully - Meshes: ' + meshCount + ', Camera distance: ' + baseCameraDistance.toFixed(2));
+            } catch (error) {
+                console.error('Error loading model with materials:', error);
+                console.error('Error stack:', error.stack);
+                alert('Error loading model with materials: ' + error.message + '\n\nCheck console for details.');
+                updateModelInfo('Load failed');
+                // Clean up blob URLs on error
+                Object.values(textureMap).forEach(url => URL.revokeObjectURL(url));
+                createDefaultCube();
+            }
+        };
+        
+        objReader.readAsText(objFile);
+    };
+    
+    mtlReader.readAsText(mtlFile);
+}
+
+function resetOrientation() {
+    currentQuat.set(0, 0, 0, 1);
+    manualRotation.set(0, 0, 0, 1);
+    for (const id in devices) {
+        devices[id].quat.set(0, 0, 0, 1);
+    }
+    if (mesh) {
+        mesh.quaternion.set(0, 0, 0, 1);
+    }
+    clearTrails();
+    console.log('Orientation reset');
+}
+
+function resetZoom() {
+    zoomFactor = 1.0;
+    camera.position.z = baseCameraDistance;
+    updateZoomInfo();
+    console.log('Zoom reset to base distance:', baseCameraDistance);
+}
+
+function resetCamera() {
+    // Reset camera position to origin (except Z distance)
+    camera.position.x = 0;
+    camera.position.y = 0;
+    camera.position.z = baseCameraDistance;
+    
+    // Reset camera rotation
+    camera.rotation.set(0, 0, 0);
+    camera.lookAt(0, 0, 0);
+    
+    // Reset zoom
+    zoomFactor = 1.0;
+    updateZoomInfo();
+    
+    console.log('Camera reset to default position');
+}
+
+// Initialize when page loads
+window.onload = init;
@@ -0,0 +1,138 @@
+// Package web is the quatplot viewer, a page that shows the orientation of
+// each device streamed by a WebSocket at "ws" next to it, as served by the
+// hub package, and that talks to the api/ endpoints of the quatplot server
+// when they are there.
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed static
+var static embed.FS
+
+// settingsPlaceholder is replaced by the settings in the page
+const settingsPlaceholder = "{{CLIENT_SETTINGS}}"
+
+// pageName is the file of the viewer page among the assets
+const pageName = "index.html"
+
+// VendorFiles are the assets of three.js and the loaders the page uses,
+// vendored with make vendor-web. Without them the page loads them from
+// their CDN.
+var VendorFiles = []string{
+	"vendor/three.min.js", "vendor/OBJLoader.js", "vendor/MTLLoader.js",
+	"vendor/STLLoader.js", "vendor/PLYLoader.js", "vendor/GLTFLoader.js",
+}
+
+// Settings are injected into the viewer page
+type Settings struct {
+	Kiosk          bool `json:"kiosk"`            // Hide the menus and show the uptime overlay
+	ReconnectMs    int  `json:"reconnect_ms"`     // Delay before the first reconnect attempt
+	MaxReconnectMs int  `json:"max_reconnect_ms"` // Attempts back off up to this delay
+	ReloadAfterMs  int  `json:"reload_after_ms"`  // Reload the page after being disconnected this long, 0 for never
+}
+
+// DefaultSettings are those of an attended viewer
+var DefaultSettings = Settings{ReconnectMs: 3000, MaxReconnectMs: 3000}
+
+// Files returns the assets of the viewer: index.html, app.js, style.css and
+// three.js with its loaders in vendor/. Files in root, when it isn't empty,
+// are used instead of the built-in ones of the same name, and are read on
+// every request so that they can be edited while the server runs.
+func Files(root string) fs.FS {
+	files, _ := fs.Sub(static, "static")
+	if root == "" {
+		return files
+	}
+	return overlayFS{os.DirFS(root), files}
+}
+
+// overlayFS reads files from top, or from bottom when top doesn't have them
+type overlayFS struct {
+	top, bottom fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.bottom.Open(name)
+	}
+	return f, err
+}
+
+// PageFrom returns the viewer page of files with the settings filled in
+func PageFrom(files fs.FS, s Settings) ([]byte, error) {
+	page, err := fs.ReadFile(files, pageName)
+	if err != nil {
+		return nil, err
+	}
+	settings, _ := json.Marshal(s)
+	return bytes.Replace(page, []byte(settingsPlaceholder), settings, 1), nil
+}
+
+// Page returns the built-in viewer page with the settings filled in
+func Page(s Settings) []byte {
+	page, _ := PageFrom(Files(""), s)
+	return page
+}
+
+// ServePage writes the viewer page of files. It isn't cached, as the
+// settings in it change with the server's.
+func ServePage(w http.ResponseWriter, files fs.FS, s Settings) {
+	page, err := PageFrom(files, s)
+	if err != nil {
+		http.Error(w, "Viewer page not found", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(page)
+}
+
+// ServeAsset writes the asset of files at the request's path, such as
+// /app.js, with the content type of its extension. Browsers keep assets
+// but check with the ETag that they are current before using them, so an
+// upgraded server is picked up on the next load. Paths that aren't an
+// asset are not found.
+func ServeAsset(w http.ResponseWriter, r *http.Request, files fs.FS) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == pageName {
+		// The page is only served with its settings filled in
+		http.NotFound(w, r)
+		return
+	}
+	data, err := fs.ReadFile(files, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	sum := sha256.Sum256(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// Handler serves the viewer page at / and its assets next to it, e.g.
+// mounted at / with a hub.Hub at /ws
+func Handler(s Settings) http.Handler {
+	files := Files("")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			ServePage(w, files, s)
+			return
+		}
+		ServeAsset(w, r, files)
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"runtime/debug"
+	"strings"
+)
+
+var welcomeMessage = flag.String("welcome", "", `Sent to clients as welcome in the session message on connect, a JSON value or plain text, e.g. {"site":"Lab A"}`)
+
+// protocolVersion is the version of the WebSocket messages, raised when a
+// change would break existing clients
+const protocolVersion = 1
+
+// sessionSettings are the settings of a namespace sent in the session
+// message, for clients that configure themselves from them
+type sessionSettings struct {
+	Source    string        `json:"source"`             // Kind of input, e.g. "serial"
+	Input     string        `json:"input"`              // What the input holds, e.g. "quaternion"
+	Format    string        `json:"format"`             // Layout of incoming lines
+	Pipeline  *pipelineInfo `json:"pipeline,omitempty"` // Corrections applied to samples, omitted when none are
+	Smoothing smoothingInfo `json:"smoothing"`
+	InputRate float64       `json:"input_rate_hz"` // Samples a second read when the client connected
+}
+
+// sessionSettings returns the settings of the namespace sent to clients
+func (ns *namespace) sessionSettings() sessionSettings {
+	cfg := ns.config()
+	_, rate := ns.samplesIn.read()
+	return sessionSettings{
+		Source:    cfg.Source,
+		Input:     cfg.inputKind(),
+		Format:    cfg.inputFormat(),
+		Pipeline:  cfg.pipelineInfo(),
+		Smoothing: ns.smoothingInfo(),
+		InputRate: rate,
+	}
+}
+
+// serverVersion returns the version of the module, or the commit it was
+// built from, "devel" when the binary says neither
+func serverVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var revision string
+	var modified bool
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// welcomePayload reads the value of -welcome: JSON as it is, anything else
+// as a string
+func welcomePayload(s string) json.RawMessage {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	if json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	data, _ := json.Marshal(s)
+	return data
+}